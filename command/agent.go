@@ -14,6 +14,7 @@ import (
 	"net/http"
 	"os"
 	"path/filepath"
+	"slices"
 	"sort"
 	"strings"
 	"sync"
@@ -29,15 +30,23 @@ import (
 	"github.com/hashicorp/go-secure-stdlib/parseutil"
 	"github.com/hashicorp/go-secure-stdlib/reloadutil"
 	"github.com/hashicorp/vault/api"
+	"github.com/hashicorp/vault/command/agent"
 	agentConfig "github.com/hashicorp/vault/command/agent/config"
 	"github.com/hashicorp/vault/command/agent/exec"
 	"github.com/hashicorp/vault/command/agent/template"
+	"github.com/hashicorp/vault/command/agent/tokenbroker"
 	"github.com/hashicorp/vault/command/agentproxyshared"
 	"github.com/hashicorp/vault/command/agentproxyshared/auth"
 	"github.com/hashicorp/vault/command/agentproxyshared/cache"
+	"github.com/hashicorp/vault/command/agentproxyshared/errorfile"
 	"github.com/hashicorp/vault/command/agentproxyshared/sink"
+	"github.com/hashicorp/vault/command/agentproxyshared/sink/audit"
+	commandsink "github.com/hashicorp/vault/command/agentproxyshared/sink/command"
 	"github.com/hashicorp/vault/command/agentproxyshared/sink/file"
 	"github.com/hashicorp/vault/command/agentproxyshared/sink/inmem"
+	"github.com/hashicorp/vault/command/agentproxyshared/sink/kubernetes"
+	"github.com/hashicorp/vault/command/agentproxyshared/sink/stdout"
+	"github.com/hashicorp/vault/command/agentproxyshared/sink/webhook"
 	"github.com/hashicorp/vault/command/agentproxyshared/winsvc"
 	"github.com/hashicorp/vault/helper/logging"
 	"github.com/hashicorp/vault/helper/metricsutil"
@@ -93,6 +102,7 @@ type AgentCommand struct {
 
 	flagConfigs        []string
 	flagExitAfterAuth  bool
+	flagVerify         bool
 	flagTestVerifyOnly bool
 }
 
@@ -145,6 +155,16 @@ func (c *AgentCommand) Flags() *FlagSets {
 			"all sinks successfully wrote it",
 	})
 
+	f.BoolVar(&BoolVar{
+		Name:    "verify",
+		Target:  &c.flagVerify,
+		Default: false,
+		Usage: "If set to true, the agent will check the configuration for " +
+			"problems, such as sink paths which can't be written, and exit " +
+			"without authenticating or writing any files, with code 0 if none " +
+			"were found, or 1 otherwise",
+	})
+
 	// Internal-only flags to follow.
 	//
 	// Why hello there little source code reader! Welcome to the Vault source
@@ -206,6 +226,33 @@ func (c *AgentCommand) Run(args []string) int {
 	}
 
 	c.applyConfigOverrides(f, config) // This only needs to happen on start-up to aggregate config from flags and env vars
+
+	// Verifying the configuration mustn't have side effects, so is done
+	// before anything, such as cleaning up stale files, is
+	if c.flagVerify {
+		errs := agent.VerifyConfig(config)
+		if len(errs) == 0 {
+			c.UI.Output("Configuration is valid")
+			return 0
+		}
+		c.UI.Error(fmt.Sprintf("Found %d problem(s) with the configuration:", len(errs)))
+		for _, err := range errs {
+			c.UI.Error(fmt.Sprintf("  * %s", err))
+		}
+		return 1
+	}
+
+	// Only tokens are written to stdout by a stdout sink, so that they can be
+	// piped into another process
+	if config.AutoAuth != nil && slices.ContainsFunc(config.AutoAuth.Sinks, func(sc *agentConfig.Sink) bool {
+		return sc.Type == "stdout"
+	}) {
+		if c.logFlags.flagCombineLogs {
+			c.UI.Error("The stdout sink can't be used with -combine-logs, as logs would be mixed in with tokens")
+			return 1
+		}
+		c.UI = stderrUI()
+	}
 	c.config = config
 
 	l, err := c.newLogger()
@@ -229,6 +276,15 @@ func (c *AgentCommand) Run(args []string) int {
 		c.logGate.Flush()
 	}
 
+	// Find, and with cleanup_remove remove, files left behind by earlier
+	// configurations before anything is written
+	if len(config.CleanupGlobs) > 0 {
+		if _, err := agent.CleanupStaleFiles(c.logger.Named("cleanup"), config, c.flagConfigs); err != nil {
+			c.UI.Error(fmt.Sprintf("Error cleaning up stale files: %s", err))
+			return 1
+		}
+	}
+
 	infoKeys := make([]string, 0, 10)
 	info := make(map[string]string)
 	info["log level"] = config.LogLevel
@@ -269,6 +325,93 @@ func (c *AgentCommand) Run(args []string) int {
 		return 1
 	}
 
+	// Connect to Vault through the configured proxy, or the one given by the
+	// environment.
+	var proxyURL string
+	if config.Vault != nil {
+		proxyURL = config.Vault.ProxyURL
+	}
+	if err := agentproxyshared.ConfigureProxy(client, proxyURL); err != nil {
+		c.UI.Error(fmt.Sprintf("Error configuring proxy: %v", err))
+		return 1
+	}
+
+	// Fail over to the next of several Vault addresses when the one in use
+	// can't be reached. This has to be set up before the circuit breaker, so
+	// that it only sees a failure once every address has failed.
+	var failover *agentproxyshared.Failover
+	if config.Vault != nil && len(config.Vault.VaultAddresses) > 0 {
+		failover, err = agentproxyshared.NewFailover(&agentproxyshared.FailoverConfig{
+			Logger:           c.logger.Named("failover"),
+			Addresses:        config.Vault.VaultAddresses,
+			MetricsSignifier: "agent",
+		})
+		if err == nil {
+			err = failover.InstallOnClient(client)
+		}
+		if err != nil {
+			c.UI.Error(fmt.Sprintf("Error configuring failover: %v", err))
+			return 1
+		}
+		config.Vault.Failover = failover
+	}
+
+	// Stop connecting to Vault for a while after too many consecutive
+	// failures. This has to be set up before the client TLS reloader, which
+	// makes its connections with the transport's dialer.
+	if config.Vault != nil && config.Vault.CircuitBreaker != nil {
+		breakerConfig := &agentproxyshared.CircuitBreakerConfig{
+			Logger:           c.logger.Named("circuit_breaker"),
+			FailureThreshold: config.Vault.CircuitBreaker.FailureThreshold,
+			Cooldown:         config.Vault.CircuitBreaker.Cooldown,
+			MetricsSignifier: "agent",
+		}
+		if failover != nil {
+			breakerConfig.Dial = failover.DialContext
+		}
+		breaker := agentproxyshared.NewCircuitBreaker(breakerConfig)
+		if err := breaker.InstallOnClient(client); err != nil {
+			c.UI.Error(fmt.Sprintf("Error configuring circuit breaker: %v", err))
+			return 1
+		}
+		config.Vault.CircuitBreaker.Dialer = breaker
+	}
+
+	// The template runner can only be given a dialer, so it reaches Vault
+	// through the proxy by tunneling, through the circuit breaker if there is
+	// one.
+	if proxyURL != "" {
+		var dial func(ctx context.Context, network, addr string) (net.Conn, error)
+		if config.Vault.CircuitBreaker != nil {
+			dial = config.Vault.CircuitBreaker.Dialer.DialContext
+		}
+		config.Vault.ProxyDialer, err = agentproxyshared.NewProxyDialer(proxyURL, dial)
+		if err != nil {
+			c.UI.Error(fmt.Sprintf("Error configuring proxy: %v", err))
+			return 1
+		}
+	}
+
+	// Allow the CA and client certificate files used to reach Vault to be
+	// re-read on SIGHUP, along with the listeners' certificates.
+	if c.flagCACert != "" || c.flagCAPath != "" || c.flagClientCert != "" || c.flagClientKey != "" {
+		clientTLSReloader, err := agentproxyshared.NewClientTLSReloader(c.logger.Named("client.tls"), client, &api.TLSConfig{
+			CACert:        c.flagCACert,
+			CAPath:        c.flagCAPath,
+			ClientCert:    c.flagClientCert,
+			ClientKey:     c.flagClientKey,
+			TLSServerName: c.flagTLSServerName,
+			Insecure:      c.flagTLSSkipVerify,
+		})
+		if err != nil {
+			c.UI.Error(fmt.Sprintf("Error configuring client TLS reloading: %v", err))
+			return 1
+		}
+		c.tlsReloadFuncsLock.Lock()
+		c.tlsReloadFuncs = append(c.tlsReloadFuncs, clientTLSReloader.ReloadTLS)
+		c.tlsReloadFuncsLock.Unlock()
+	}
+
 	serverHealth, err := client.Sys().Health()
 	if err == nil {
 		// We don't exit on error here, as this is not worth stopping Agent over
@@ -348,30 +491,62 @@ func (c *AgentCommand) Run(args []string) int {
 			sinkClient.SetDisableKeepAlives(true)
 		}
 
+		sinkInitTimeout := config.AutoAuth.SinkInitTimeout
 		for _, sc := range config.AutoAuth.Sinks {
+			var newSink func(*sink.SinkConfig) (sink.Sink, error)
 			switch sc.Type {
 			case "file":
-				config := &sink.SinkConfig{
-					Logger:    c.logger.Named("sink.file"),
-					Config:    sc.Config,
-					Client:    sinkClient,
-					WrapTTL:   sc.WrapTTL,
-					DHType:    sc.DHType,
-					DeriveKey: sc.DeriveKey,
-					DHPath:    sc.DHPath,
-					AAD:       sc.AAD,
-				}
-				s, err := file.NewFileSink(config)
-				if err != nil {
-					c.UI.Error(fmt.Errorf("error creating file sink: %w", err).Error())
-					return 1
-				}
-				config.Sink = s
-				sinks = append(sinks, config)
+				newSink = file.NewFileSink
+			case "kubernetes":
+				newSink = kubernetes.NewKubernetesSink
+			case "command":
+				newSink = commandsink.NewCommandSink
+			case "stdout":
+				newSink = stdout.NewStdoutSink
+			case "audit":
+				newSink = audit.NewAuditSink
+			case "webhook":
+				newSink = webhook.NewWebhookSink
 			default:
 				c.UI.Error(fmt.Sprintf("Unknown sink type %q", sc.Type))
 				return 1
 			}
+
+			var readinessProbe *sink.ReadinessProbe
+			if sc.ReadinessProbe != nil {
+				readinessProbe = &sink.ReadinessProbe{
+					URL:      sc.ReadinessProbe.URL,
+					Interval: sc.ReadinessProbe.Interval,
+					Timeout:  sc.ReadinessProbe.Timeout,
+				}
+			}
+
+			config := &sink.SinkConfig{
+				Name:           sc.Name,
+				Logger:         c.logger.Named("sink." + sc.Type),
+				Config:         sc.Config,
+				Client:         sinkClient,
+				Emit:           sc.Emit,
+				WrapTTL:        sc.WrapTTL,
+				DHType:         sc.DHType,
+				DeriveKey:      sc.DeriveKey,
+				DHPath:         sc.DHPath,
+				AAD:            sc.AAD,
+				ReadinessProbe: readinessProbe,
+			}
+			s, err := newSink(config)
+			switch {
+			case err != nil && sinkInitTimeout > 0:
+				// Leave it to the sink server to retry creating the sink
+				c.logger.Warn(fmt.Sprintf("error creating %s sink, will retry", sc.Type), "error", err, "sink_init_timeout", sinkInitTimeout)
+				config.NewSink = newSink
+			case err != nil:
+				c.UI.Error(fmt.Errorf("error creating %s sink: %w", sc.Type, err).Error())
+				return 1
+			default:
+				config.Sink = s
+			}
+			sinks = append(sinks, config)
 		}
 
 		authConfig := &auth.AuthConfig{
@@ -555,6 +730,7 @@ func (c *AgentCommand) Run(args []string) int {
 	var ss *sink.SinkServer
 	var ts *template.Server
 	var es *exec.Server
+	var tb *tokenbroker.Server
 	if method != nil {
 		enableTemplateTokenCh := len(config.Templates) > 0
 		enableEnvTemplateTokenCh := len(config.EnvTemplates) > 0
@@ -567,9 +743,12 @@ func (c *AgentCommand) Run(args []string) int {
 			return 1
 		}
 
-		// Override the set namespace with the auto-auth specific namespace
+		// Override the set namespace with the auto-auth specific namespace.
+		// The auth handler applies it on every authentication attempt, and
+		// the sink server uses it when response-wrapping tokens.
+		var authNamespace string
 		if !namespaceSetByEnvironmentVariable && config.AutoAuth.Method.Namespace != "" {
-			ahClient.SetNamespace(config.AutoAuth.Method.Namespace)
+			authNamespace = config.AutoAuth.Method.Namespace
 		}
 
 		if config.DisableIdleConnsAutoAuth {
@@ -580,6 +759,23 @@ func (c *AgentCommand) Run(args []string) int {
 			ahClient.SetDisableKeepAlives(true)
 		}
 
+		var errorFile *errorfile.File
+		if config.AutoAuth.ErrorFile != "" {
+			errorFile = errorfile.New(config.AutoAuth.ErrorFile, c.logger.Named("errorfile"))
+		}
+
+		var tokenStore *auth.TokenStore
+		if config.AutoAuth.PersistTokenPath != "" {
+			key := auth.KeyFromEnv(config.AutoAuth.PersistTokenKeyEnv)
+			if config.AutoAuth.PersistTokenKeyFile != "" {
+				key = auth.KeyFromFile(config.AutoAuth.PersistTokenKeyFile)
+			}
+			if tokenStore, err = auth.NewTokenStore(config.AutoAuth.PersistTokenPath, key); err != nil {
+				c.UI.Error(fmt.Sprintf("Error creating persisted token store: %v", err))
+				return 1
+			}
+		}
+
 		ah = auth.NewAuthHandler(&auth.AuthHandlerConfig{
 			Logger:                       c.logger.Named("auth.handler"),
 			Client:                       ahClient,
@@ -593,21 +789,37 @@ func (c *AgentCommand) Run(args []string) int {
 			ExitOnError:                  config.AutoAuth.Method.ExitOnError,
 			UserAgent:                    useragent.AgentAutoAuthString(),
 			MetricsSignifier:             "agent",
+			AuthMethodName:               config.AutoAuth.Method.Type,
+			Namespace:                    authNamespace,
+			AuthHeaders:                  config.AutoAuth.Method.AuthHeaders(),
+			ErrorFile:                    errorFile,
+			TokenStore:                   tokenStore,
+			ExitAfterAuth:                config.ExitAfterAuth,
+			RedactTokens:                 config.RedactTokens,
 		})
 
 		ss = sink.NewSinkServer(&sink.SinkServerConfig{
-			Logger:        c.logger.Named("sink.server"),
-			Client:        ahClient,
-			ExitAfterAuth: config.ExitAfterAuth,
+			Logger:           c.logger.Named("sink.server"),
+			Client:           ahClient,
+			ExitAfterAuth:    config.ExitAfterAuth,
+			SinkInitTimeout:  config.AutoAuth.SinkInitTimeout,
+			Namespace:        authNamespace,
+			ErrorFile:        errorFile,
+			MetricsSignifier: "agent",
+			RedactTokens:     config.RedactTokens,
 		})
 
 		ts = template.NewServer(&template.ServerConfig{
-			Logger:        c.logger.Named("template.server"),
-			LogLevel:      c.logger.GetLevel(),
-			LogWriter:     c.logWriter,
-			AgentConfig:   c.config,
-			Namespace:     templateNamespace,
-			ExitAfterAuth: config.ExitAfterAuth,
+			Logger:             c.logger.Named("template.server"),
+			LogLevel:           c.logger.GetLevel(),
+			LogWriter:          c.logWriter,
+			AgentConfig:        c.config,
+			Namespace:          templateNamespace,
+			ExitAfterAuth:      config.ExitAfterAuth,
+			TemplateNamespaces: config.TemplateNamespaces,
+			RenewLease:         config.TemplateRenewLease,
+			TokenSequence:      ah.TokenSequence,
+			RedactTokens:       config.RedactTokens,
 		})
 
 		es, err = exec.NewServer(&exec.ServerConfig{
@@ -621,6 +833,22 @@ func (c *AgentCommand) Run(args []string) int {
 			c.logger.Error("could not create exec server", "error", err)
 			return 1
 		}
+
+		if config.TokenBroker != nil {
+			tb, err = tokenbroker.NewServer(&tokenbroker.ServerConfig{
+				Logger:           c.logger.Named("token_broker"),
+				TokenSource:      ah,
+				Address:          config.TokenBroker.Address,
+				AllowNonLoopback: config.TokenBroker.AllowNonLoopback,
+				Secret:           config.TokenBroker.Secret,
+			})
+			if err != nil {
+				c.logger.Error("could not create token broker", "error", err)
+				return 1
+			}
+			info["token broker address"] = "http://" + config.TokenBroker.Address
+			infoKeys = append(infoKeys, "token broker address")
+		}
 	}
 
 	var listeners []net.Listener
@@ -800,9 +1028,14 @@ func (c *AgentCommand) Run(args []string) int {
 
 	// Start auto-auth and sink servers
 	if method != nil {
+		// Once ctx is done, the servers are stopped before the auth handler,
+		// so that they don't signal it to re-authenticate after it's stopped
+		coord := agent.NewCoordinator(ctx)
 
 		g.Add(func() error {
-			return ah.Run(ctx, method)
+			return coord.RunAuth(func(ctx context.Context) error {
+				return ah.Run(ctx, method)
+			})
 		}, func(error) {
 			// Let the lease cache know this is a shutdown; no need to evict
 			// everything
@@ -813,7 +1046,9 @@ func (c *AgentCommand) Run(args []string) int {
 		})
 
 		g.Add(func() error {
-			err := ss.Run(ctx, ah.OutputCh, sinks, ah.AuthInProgress)
+			err := coord.RunServer(func(ctx context.Context) error {
+				return ss.Run(ctx, ah.OutputCh, sinks, ah.AuthInProgress)
+			})
 			c.logger.Info("sinks finished, exiting")
 
 			// Start goroutine to drain from ah.OutputCh from this point onward
@@ -844,7 +1079,9 @@ func (c *AgentCommand) Run(args []string) int {
 		})
 
 		g.Add(func() error {
-			return ts.Run(ctx, ah.TemplateTokenCh, config.Templates, ah.AuthInProgress, ah.InvalidToken)
+			return coord.RunServer(func(ctx context.Context) error {
+				return ts.Run(ctx, ah.TemplateTokenCh, config.Templates, ah.AuthInProgress, ah.InvalidToken)
+			})
 		}, func(error) {
 			// Let the lease cache know this is a shutdown; no need to evict
 			// everything
@@ -856,7 +1093,9 @@ func (c *AgentCommand) Run(args []string) int {
 		})
 
 		g.Add(func() error {
-			return es.Run(ctx, ah.ExecTokenCh)
+			return coord.RunServer(func(ctx context.Context) error {
+				return es.Run(ctx, ah.ExecTokenCh)
+			})
 		}, func(err error) {
 			// Let the lease cache know this is a shutdown; no need to evict
 			// everything
@@ -867,6 +1106,13 @@ func (c *AgentCommand) Run(args []string) int {
 			es.Close()
 		})
 
+		if tb != nil {
+			g.Add(func() error {
+				return tb.Run(ctx)
+			}, func(error) {
+				cancelFunc()
+			})
+		}
 	}
 
 	// Server configuration output
@@ -1238,6 +1484,7 @@ func (c *AgentCommand) loadConfig(paths []string) (*agentConfig.Config, error) {
 // Currently only reloading the following are supported:
 // * log level
 // * TLS certs for listeners
+// * CA and client certificate files used to reach Vault
 func (c *AgentCommand) reloadConfig(paths []string) error {
 	// Notify systemd that the server is reloading
 	c.notifySystemd(systemd.SdNotifyReloading)
@@ -1317,3 +1564,16 @@ func (c *AgentCommand) outputErrors(err error) {
 		}
 	}
 }
+
+// stderrUI returns a UI which writes everything to stderr, for use when a
+// stdout sink is writing tokens to stdout.
+func stderrUI() cli.Ui {
+	return &cli.ColoredUi{
+		ErrorColor: cli.UiColorRed,
+		WarnColor:  cli.UiColorYellow,
+		Ui: &cli.BasicUi{
+			Reader: os.Stdin,
+			Writer: os.Stderr,
+		},
+	}
+}
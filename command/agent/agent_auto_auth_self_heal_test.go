@@ -15,6 +15,7 @@ import (
 	ctconfig "github.com/hashicorp/consul-template/config"
 	"github.com/hashicorp/go-hclog"
 	"github.com/hashicorp/vault/api"
+	"github.com/hashicorp/vault/command/agent/agenttest"
 	agentConfig "github.com/hashicorp/vault/command/agent/config"
 	"github.com/hashicorp/vault/command/agent/template"
 	"github.com/hashicorp/vault/command/agentproxyshared/auth"
@@ -49,11 +50,7 @@ func TestAutoAuthSelfHealing_TokenFileAuth_SinkOutput(t *testing.T) {
 	// Write token to the auto-auth token file
 	pathVaultToken := makeTempFile(t, "token-file", token)
 
-	// Give us some leeway of 3 errors 1 from each of: auth handler, sink server template server.
-	errCh := make(chan error, 3)
-	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
-
-	// Create auth handler
+	// Create auth method
 	am, err := tokenfile.NewTokenFileAuthMethod(&auth.AuthConfig{
 		Logger: logger.Named("auth.method"),
 		Config: map[string]interface{}{
@@ -64,20 +61,6 @@ func TestAutoAuthSelfHealing_TokenFileAuth_SinkOutput(t *testing.T) {
 
 	// Create sink file
 	pathSinkFile := makeTempFile(t, "sink-file", "")
-	require.NoError(t, err)
-
-	ahConfig := &auth.AuthHandlerConfig{
-		Logger:                       logger.Named("auth.handler"),
-		Client:                       serverClient,
-		EnableExecTokenCh:            true,
-		EnableTemplateTokenCh:        true,
-		EnableReauthOnNewCredentials: true,
-		ExitOnError:                  false,
-	}
-	ah := auth.NewAuthHandler(ahConfig)
-	go func() {
-		errCh <- ah.Run(ctx, am)
-	}()
 
 	config := &sink.SinkConfig{
 		Logger: logger.Named("sink.file"),
@@ -89,58 +72,52 @@ func TestAutoAuthSelfHealing_TokenFileAuth_SinkOutput(t *testing.T) {
 	require.NoError(t, err)
 	config.Sink = fs
 
-	ss := sink.NewSinkServer(&sink.SinkServerConfig{
-		Logger: logger.Named("sink.server"),
-		Client: serverClient,
-	})
-	go func() {
-		errCh <- ss.Run(ctx, ah.OutputCh, []*sink.SinkConfig{config}, ah.AuthInProgress)
-	}()
+	pathTemplateOutput := makeTempFile(t, "template-output", "")
+	templateTest := &ctconfig.TemplateConfig{
+		Contents:    pointerutil.StringPtr(`{{ with secret "auth/token/lookup-self" }}{{ .Data.id }}{{ end }}`),
+		Destination: pointerutil.StringPtr(pathTemplateOutput),
+	}
 
-	// Create template server
-	sc := &template.ServerConfig{
-		Logger: logger.Named("template.server"),
-		AgentConfig: &agentConfig.Config{
-			Vault: &agentConfig.Vault{
-				Address:       serverClient.Address(),
-				TLSSkipVerify: true,
-			},
-			TemplateConfig: &agentConfig.TemplateConfig{
-				StaticSecretRenderInt: 1 * time.Second,
-			},
-			AutoAuth: &agentConfig.AutoAuth{
-				Sinks: []*agentConfig.Sink{
-					{
-						Type: "file",
-						Config: map[string]interface{}{
-							"path": pathSinkFile,
+	h := agenttest.New(t, &agenttest.Config{
+		Logger: logger,
+		Client: serverClient,
+		Method: am,
+		AuthHandler: &auth.AuthHandlerConfig{
+			EnableReauthOnNewCredentials: true,
+			ExitOnError:                  false,
+		},
+		Sinks:     []*sink.SinkConfig{config},
+		Templates: []*ctconfig.TemplateConfig{templateTest},
+		TemplateServer: &template.ServerConfig{
+			AgentConfig: &agentConfig.Config{
+				Vault: &agentConfig.Vault{
+					Address:       serverClient.Address(),
+					TLSSkipVerify: true,
+				},
+				TemplateConfig: &agentConfig.TemplateConfig{
+					StaticSecretRenderInt: 1 * time.Second,
+				},
+				AutoAuth: &agentConfig.AutoAuth{
+					Sinks: []*agentConfig.Sink{
+						{
+							Type: "file",
+							Config: map[string]interface{}{
+								"path": pathSinkFile,
+							},
 						},
 					},
 				},
+				ExitAfterAuth: false,
 			},
+			LogLevel:      hclog.Trace,
+			LogWriter:     hclog.DefaultOutput,
 			ExitAfterAuth: false,
 		},
-		LogLevel:      hclog.Trace,
-		LogWriter:     hclog.DefaultOutput,
-		ExitAfterAuth: false,
-	}
-
-	pathTemplateOutput := makeTempFile(t, "template-output", "")
-	require.NoError(t, err)
-	templateTest := &ctconfig.TemplateConfig{
-		Contents:    pointerutil.StringPtr(`{{ with secret "auth/token/lookup-self" }}{{ .Data.id }}{{ end }}`),
-		Destination: pointerutil.StringPtr(pathTemplateOutput),
-	}
-	templatesToRender := []*ctconfig.TemplateConfig{templateTest}
-
-	server := template.NewServer(sc)
-	go func() {
-		errCh <- server.Run(ctx, ah.TemplateTokenCh, templatesToRender, ah.AuthInProgress, ah.InvalidToken)
-	}()
+		Timeout: 30 * time.Second,
+	})
 
-	// Send token to template channel, and wait for the template to render
-	ah.TemplateTokenCh <- token
-	err = waitForFileContent(t, pathTemplateOutput, token)
+	// Wait for the template to render with the token
+	h.AwaitRender(pathTemplateOutput, token)
 
 	// Revoke Token
 	err = serverClient.Auth().Token().RevokeOrphan(token)
@@ -160,27 +137,12 @@ func TestAutoAuthSelfHealing_TokenFileAuth_SinkOutput(t *testing.T) {
 
 	// Wait for auto-auth to complete and verify token has been written to the sink
 	// and the template has been re-rendered
-	err = waitForFileContent(t, pathSinkFile, newToken)
-	require.NoError(t, err)
+	h.AwaitSink(pathSinkFile, newToken)
+	h.AwaitRender(pathTemplateOutput, newToken)
 
-	err = waitForFileContent(t, pathTemplateOutput, newToken)
-	require.NoError(t, err)
-
-	// Calling cancel will stop the 'Run' funcs we started in Goroutines, we should
-	// then check that there were no errors in our channel.
-	cancel()
-	wrapUpTimeout := 5 * time.Second
-	for {
-		select {
-		case <-time.After(wrapUpTimeout):
-			t.Fatal("test timed out")
-		case err := <-errCh:
-			require.NoError(t, err)
-		case <-ctx.Done():
-			// We can finish the test ourselves
-			return
-		}
-	}
+	// Stopping the harness stops the servers, which should have returned no
+	// errors
+	require.NoError(t, h.Stop())
 }
 
 // Test_NoAutoAuthSelfHealing_BadPolicy tests that auto auth
@@ -0,0 +1,292 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: BUSL-1.1
+
+// Package agenttest provides a Harness running the auth handler, sink server
+// and template server of the agent wired together, for testing how they
+// interact, such as re-authenticating when a token is revoked, without
+// repeating the wiring in each test. Paired with the fake method of the
+// authtest package and a custom template Renderer, no Vault server is needed.
+package agenttest
+
+import (
+	"context"
+	"errors"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	ctconfig "github.com/hashicorp/consul-template/config"
+	"github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/go-multierror"
+	"github.com/hashicorp/vault/api"
+	agentconfig "github.com/hashicorp/vault/command/agent/config"
+	"github.com/hashicorp/vault/command/agent/template"
+	"github.com/hashicorp/vault/command/agentproxyshared/auth"
+	"github.com/hashicorp/vault/command/agentproxyshared/sink"
+)
+
+// DefaultTimeout is how long the Harness waits for a token to be received or
+// a file to have the expected contents before failing the test.
+const DefaultTimeout = 10 * time.Second
+
+// awaitInterval is how often a file is checked while awaiting its contents.
+const awaitInterval = 50 * time.Millisecond
+
+// Config is the configuration of a Harness. Only Method is required.
+type Config struct {
+	Logger hclog.Logger
+
+	// Client is used by the auth handler and sink server, unless their
+	// configs set their own. It defaults to a client created with
+	// api.DefaultConfig.
+	Client *api.Client
+
+	// Method is the auth method the auth handler authenticates with, e.g.
+	// an authtest.Method.
+	Method auth.AuthMethod
+
+	// Sinks are the sinks tokens are written to, and Templates the templates
+	// rendered with them. Either may be empty.
+	Sinks     []*sink.SinkConfig
+	Templates []*ctconfig.TemplateConfig
+
+	// AuthHandler, SinkServer and TemplateServer, if set, are the configs
+	// the servers are created with, e.g. to set a template Renderer. Their
+	// logger and client default to the Harness's, and the auth handler is
+	// always set to deliver tokens to templates if there are any, and never
+	// to exec. Without a template server config, templates are rendered by
+	// consul-template from the Vault at the client's address.
+	AuthHandler    *auth.AuthHandlerConfig
+	SinkServer     *sink.SinkServerConfig
+	TemplateServer *template.ServerConfig
+
+	// Timeout overrides DefaultTimeout.
+	Timeout time.Duration
+}
+
+// Harness runs the auth handler, sink server and template server, wired as
+// the agent wires them, until the test ends or Stop is called.
+type Harness struct {
+	AuthHandler    *auth.AuthHandler
+	SinkServer     *sink.SinkServer
+	TemplateServer *template.Server
+
+	t            testing.TB
+	timeout      time.Duration
+	hasTemplates bool
+	cancel       context.CancelFunc
+	wg           sync.WaitGroup
+
+	l    sync.Mutex
+	errs *multierror.Error
+
+	stopOnce sync.Once
+}
+
+// New starts a Harness with the given configuration. It's stopped when the
+// test ends, failing the test if any of the servers returned an error.
+func New(t testing.TB, conf *Config) *Harness {
+	t.Helper()
+	if conf == nil || conf.Method == nil {
+		t.Fatal("agenttest: no auth method provided")
+	}
+
+	logger := conf.Logger
+	if logger == nil {
+		logger = hclog.NewNullLogger()
+	}
+	client := conf.Client
+	if client == nil {
+		var err error
+		if client, err = api.NewClient(api.DefaultConfig()); err != nil {
+			t.Fatalf("agenttest: error creating client: %v", err)
+		}
+	}
+
+	ahConfig := &auth.AuthHandlerConfig{}
+	if conf.AuthHandler != nil {
+		*ahConfig = *conf.AuthHandler
+	}
+	if ahConfig.Logger == nil {
+		ahConfig.Logger = logger.Named("auth.handler")
+	}
+	if ahConfig.Client == nil {
+		ahConfig.Client = client
+	}
+	hasTemplates := len(conf.Templates) > 0
+	ahConfig.EnableTemplateTokenCh = hasTemplates
+	ahConfig.EnableExecTokenCh = false
+
+	ssConfig := &sink.SinkServerConfig{}
+	if conf.SinkServer != nil {
+		*ssConfig = *conf.SinkServer
+	}
+	if ssConfig.Logger == nil {
+		ssConfig.Logger = logger.Named("sink.server")
+	}
+	if ssConfig.Client == nil {
+		ssConfig.Client = client
+	}
+
+	h := &Harness{
+		AuthHandler:  auth.NewAuthHandler(ahConfig),
+		SinkServer:   sink.NewSinkServer(ssConfig),
+		t:            t,
+		timeout:      conf.Timeout,
+		hasTemplates: hasTemplates,
+	}
+	if h.timeout <= 0 {
+		h.timeout = DefaultTimeout
+	}
+	if hasTemplates {
+		tsConfig := templateServerConfig(conf.TemplateServer, logger, client)
+		if tsConfig.TokenSequence == nil {
+			tsConfig.TokenSequence = h.AuthHandler.TokenSequence
+		}
+		h.TemplateServer = template.NewServer(tsConfig)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	h.cancel = cancel
+	h.run(func() error {
+		return h.AuthHandler.Run(ctx, conf.Method)
+	})
+	h.run(func() error {
+		return h.SinkServer.Run(ctx, h.AuthHandler.OutputCh, conf.Sinks, h.AuthHandler.AuthInProgress)
+	})
+	if h.TemplateServer != nil {
+		h.run(func() error {
+			return h.TemplateServer.Run(ctx, h.AuthHandler.TemplateTokenCh, conf.Templates, h.AuthHandler.AuthInProgress, h.AuthHandler.InvalidToken)
+		})
+	}
+
+	t.Cleanup(func() {
+		if err := h.Stop(); err != nil {
+			t.Errorf("agenttest: %v", err)
+		}
+	})
+	return h
+}
+
+// templateServerConfig returns a copy of conf, or if it's nil, a config for
+// rendering templates from the Vault at client's address, with the logger and
+// client defaulted.
+func templateServerConfig(conf *template.ServerConfig, logger hclog.Logger, client *api.Client) *template.ServerConfig {
+	tsConfig := &template.ServerConfig{
+		AgentConfig: &agentconfig.Config{
+			Vault: &agentconfig.Vault{
+				Address: client.Address(),
+			},
+			TemplateConfig: &agentconfig.TemplateConfig{},
+		},
+		LogLevel:  hclog.Trace,
+		LogWriter: hclog.DefaultOutput,
+	}
+	if conf != nil {
+		*tsConfig = *conf
+	}
+	if tsConfig.Logger == nil {
+		tsConfig.Logger = logger.Named("template.server")
+	}
+	if tsConfig.Client == nil {
+		tsConfig.Client = client
+	}
+	return tsConfig
+}
+
+// run runs f in a goroutine, recording the error it returns.
+func (h *Harness) run(f func() error) {
+	h.wg.Add(1)
+	go func() {
+		defer h.wg.Done()
+		if err := f(); err != nil {
+			h.l.Lock()
+			h.errs = multierror.Append(h.errs, err)
+			h.l.Unlock()
+		}
+	}()
+}
+
+// PushToken delivers token to the sinks and templates, as the auth handler
+// does once it has authenticated, failing the test if they don't receive it
+// in time. The auth handler itself isn't told of the token, so it keeps
+// renewing the token it last obtained.
+func (h *Harness) PushToken(token string) {
+	h.t.Helper()
+	h.send(h.AuthHandler.OutputCh, token, "sink server")
+	if h.hasTemplates {
+		h.send(h.AuthHandler.TemplateTokenCh, token, "template server")
+	}
+}
+
+func (h *Harness) send(ch chan string, token, receiver string) {
+	h.t.Helper()
+	timer := time.NewTimer(h.timeout)
+	defer timer.Stop()
+	select {
+	case ch <- token:
+	case <-timer.C:
+		h.t.Fatalf("agenttest: timed out pushing token to the %s", receiver)
+	}
+}
+
+// Revoke reports the current token as invalid to the auth handler, as the
+// template server does when Vault rejects it after it has been revoked, so
+// that the auth handler re-authenticates. Revoking the token in Vault, if
+// there is one, is left to the caller.
+func (h *Harness) Revoke() {
+	select {
+	case h.AuthHandler.InvalidToken <- errors.New("token revoked"):
+	default:
+		// A report is already pending
+	}
+}
+
+// AwaitRender waits for the template destination dest to hold contents,
+// failing the test if it doesn't in time.
+func (h *Harness) AwaitRender(dest, contents string) {
+	h.t.Helper()
+	h.awaitFile("template destination", dest, contents)
+}
+
+// AwaitSink waits for the file at path, such as that of a file sink, to hold
+// contents, failing the test if it doesn't in time.
+func (h *Harness) AwaitSink(path, contents string) {
+	h.t.Helper()
+	h.awaitFile("sink", path, contents)
+}
+
+func (h *Harness) awaitFile(kind, path, contents string) {
+	h.t.Helper()
+	deadline := time.Now().Add(h.timeout)
+	var last string
+	var lastErr error
+	for {
+		b, err := os.ReadFile(path)
+		if err == nil && string(b) == contents {
+			return
+		}
+		last, lastErr = string(b), err
+		if time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(awaitInterval)
+	}
+	if lastErr != nil {
+		h.t.Fatalf("agenttest: timed out waiting for %s %s: %v", kind, path, lastErr)
+	}
+	h.t.Fatalf("agenttest: timed out waiting for %s %s to hold %q, got %q", kind, path, contents, last)
+}
+
+// Stop stops the servers and waits for them to return, returning their
+// errors. It's called when the test ends, and only stops them once.
+func (h *Harness) Stop() error {
+	h.stopOnce.Do(func() {
+		h.cancel()
+		h.wg.Wait()
+	})
+	h.l.Lock()
+	defer h.l.Unlock()
+	return h.errs.ErrorOrNil()
+}
@@ -0,0 +1,76 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: BUSL-1.1
+
+package agenttest
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+
+	ctconfig "github.com/hashicorp/consul-template/config"
+	"github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/vault/command/agent/template"
+	"github.com/hashicorp/vault/command/agentproxyshared/auth/authtest"
+	"github.com/hashicorp/vault/command/agentproxyshared/sink"
+	"github.com/hashicorp/vault/command/agentproxyshared/sink/file"
+	"github.com/hashicorp/vault/sdk/helper/logging"
+	"github.com/hashicorp/vault/sdk/helper/pointerutil"
+)
+
+// tokenRenderer renders every template as the token it's rendered with.
+type tokenRenderer struct{}
+
+func (tokenRenderer) Render(_ context.Context, _ *ctconfig.TemplateConfig, token string) ([]byte, error) {
+	return []byte(token), nil
+}
+
+// TestHarness tests that the Harness delivers the tokens the auth handler
+// obtains to the sinks and templates, re-authenticating when the token is
+// revoked, and that tokens can be pushed to them directly.
+func TestHarness(t *testing.T) {
+	logger := logging.NewVaultLogger(hclog.Trace)
+	dir := t.TempDir()
+
+	sinkPath := filepath.Join(dir, "sink")
+	sinkConfig := &sink.SinkConfig{
+		Logger: logger.Named("sink.file"),
+		Config: map[string]interface{}{
+			"path": sinkPath,
+		},
+	}
+	fs, err := file.NewFileSink(sinkConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sinkConfig.Sink = fs
+
+	dest := filepath.Join(dir, "render")
+	h := New(t, &Config{
+		Logger: logger,
+		Method: authtest.WithTokens("token-1", "token-2"),
+		Sinks:  []*sink.SinkConfig{sinkConfig},
+		Templates: []*ctconfig.TemplateConfig{{
+			Contents:    pointerutil.StringPtr("{{ .Token }}"),
+			Destination: pointerutil.StringPtr(dest),
+		}},
+		TemplateServer: &template.ServerConfig{
+			Renderer: tokenRenderer{},
+		},
+	})
+
+	h.AwaitSink(sinkPath, "token-1")
+	h.AwaitRender(dest, "token-1")
+
+	h.Revoke()
+	h.AwaitSink(sinkPath, "token-2")
+	h.AwaitRender(dest, "token-2")
+
+	h.PushToken("pushed-token")
+	h.AwaitSink(sinkPath, "pushed-token")
+	h.AwaitRender(dest, "pushed-token")
+
+	if err := h.Stop(); err != nil {
+		t.Fatal(err)
+	}
+}
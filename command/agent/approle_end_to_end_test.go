@@ -6,9 +6,11 @@ package agent
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"os"
+	"path/filepath"
 	"strings"
 	"testing"
 	"time"
@@ -790,6 +792,245 @@ func testAppRoleWithWrapping(t *testing.T, bindSecretID bool, secretIDLess bool,
 	}
 }
 
+// TestAppRoleWithWrapping_AlreadyUsed tests that a wrapped secret ID is only
+// unwrapped once, and that a clear error is returned if the wrapping token in
+// the secret ID file has already been used.
+func TestAppRoleWithWrapping_AlreadyUsed(t *testing.T) {
+	coreConfig := &vault.CoreConfig{
+		CredentialBackends: map[string]logical.Factory{
+			"approle": credAppRole.Factory,
+		},
+	}
+
+	cluster := vault.NewTestCluster(t, coreConfig, &vault.TestClusterOptions{
+		HandlerFunc: vaulthttp.Handler,
+	})
+
+	cluster.Start()
+	defer cluster.Cleanup()
+
+	vault.TestWaitActive(t, cluster.Cores[0].Core)
+	client := cluster.Cores[0].Client
+
+	err := client.Sys().EnableAuthWithOptions("approle", &api.EnableAuthOptions{
+		Type: "approle",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.Logical().Write("auth/approle/role/test1", nil); err != nil {
+		t.Fatal(err)
+	}
+	resp, err := client.Logical().Read("auth/approle/role/test1/role-id")
+	if err != nil {
+		t.Fatal(err)
+	}
+	roleID := resp.Data["role_id"].(string)
+
+	wrapClient, err := client.Clone()
+	if err != nil {
+		t.Fatal(err)
+	}
+	wrapClient.SetToken(client.Token())
+	wrapClient.SetWrappingLookupFunc(func(operation, path string) string {
+		return "1m"
+	})
+	wrappedSecretID := func() string {
+		t.Helper()
+		resp, err := wrapClient.Logical().Write("auth/approle/role/test1/secret-id", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp.WrapInfo.Token
+	}
+
+	dir := t.TempDir()
+	rolePath := filepath.Join(dir, "role-id")
+	secretPath := filepath.Join(dir, "secret-id")
+	if err := os.WriteFile(rolePath, []byte(roleID), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	am, err := agentapprole.NewApproleAuthMethod(&auth.AuthConfig{
+		Logger:    logging.NewVaultLogger(log.Trace),
+		MountPath: "auth/approle",
+		Config: map[string]interface{}{
+			"role_id_file_path":                   rolePath,
+			"secret_id_file_path":                 secretPath,
+			"secret_id_response_wrapping_path":    "auth/approle/role/test1/secret-id",
+			"remove_secret_id_file_after_reading": false,
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The secret ID is unwrapped once, and re-used while the file is unchanged
+	if err := os.WriteFile(secretPath, []byte(wrappedSecretID()), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	var secretIDs []interface{}
+	for i := 0; i < 2; i++ {
+		_, _, data, err := am.Authenticate(context.Background(), client)
+		if err != nil {
+			t.Fatal(err)
+		}
+		secretIDs = append(secretIDs, data["secret_id"])
+	}
+	if secretIDs[0] == "" || secretIDs[0] != secretIDs[1] {
+		t.Fatalf("expected the same secret ID to be used, got %v", secretIDs)
+	}
+
+	// A wrapping token that has been used elsewhere can't be unwrapped
+	usedToken := wrappedSecretID()
+	if _, err := client.Logical().Unwrap(usedToken); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(secretPath, []byte(usedToken), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	_, _, _, err = am.Authenticate(context.Background(), client)
+	if !errors.Is(err, agentapprole.ErrSecretIDNotProvisioned) {
+		t.Fatalf("expected secret ID not provisioned error, got: %v", err)
+	}
+}
+
+// TestAppRoleSecretIDRotation tests that the approle auth method fetches a
+// new secret ID on the configured interval with the token it authenticated,
+// without using up one of the secret ID's uses, and writes it to the secret ID
+// file to authenticate with.
+func TestAppRoleSecretIDRotation(t *testing.T) {
+	coreConfig := &vault.CoreConfig{
+		CredentialBackends: map[string]logical.Factory{
+			"approle": credAppRole.Factory,
+		},
+	}
+
+	cluster := vault.NewTestCluster(t, coreConfig, &vault.TestClusterOptions{
+		HandlerFunc: vaulthttp.Handler,
+	})
+
+	cluster.Start()
+	defer cluster.Cleanup()
+
+	vault.TestWaitActive(t, cluster.Cores[0].Core)
+	client := cluster.Cores[0].Client
+
+	err := client.Sys().EnableAuthWithOptions("approle", &api.EnableAuthOptions{
+		Type: "approle",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = client.Sys().PutPolicy("rotate-secret-id", `
+path "auth/approle/role/test1/secret-id" {
+	capabilities = ["update"]
+}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = client.Logical().Write("auth/approle/role/test1", map[string]interface{}{
+		"token_policies":     "rotate-secret-id",
+		"secret_id_num_uses": 2,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := client.Logical().Read("auth/approle/role/test1/role-id")
+	if err != nil {
+		t.Fatal(err)
+	}
+	roleID := resp.Data["role_id"].(string)
+	resp, err = client.Logical().Write("auth/approle/role/test1/secret-id", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	secretID := resp.Data["secret_id"].(string)
+
+	dir := t.TempDir()
+	rolePath := filepath.Join(dir, "role-id")
+	secretPath := filepath.Join(dir, "secret-id")
+	if err := os.WriteFile(rolePath, []byte(roleID), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(secretPath, []byte(secretID), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	am, err := agentapprole.NewApproleAuthMethod(&auth.AuthConfig{
+		Logger:    logging.NewVaultLogger(log.Trace),
+		MountPath: "auth/approle",
+		Config: map[string]interface{}{
+			"role_id_file_path":                   rolePath,
+			"secret_id_file_path":                 secretPath,
+			"remove_secret_id_file_after_reading": false,
+			"secret_id_rotation_path":             "auth/approle/role/test1/secret-id",
+			"secret_id_rotation_interval":         "1s",
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer am.Shutdown()
+
+	loginClient, err := client.Clone()
+	if err != nil {
+		t.Fatal(err)
+	}
+	loginClient.SetToken("")
+
+	// Stands in for the auth handler, logging in with the method's data
+	path, _, data, err := am.Authenticate(context.Background(), client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data["secret_id"] != secretID {
+		t.Fatalf("expected secret ID from file, got %v", data["secret_id"])
+	}
+	resp, err = loginClient.Logical().Write(path, data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	am.(auth.AuthMethodWithToken).Authenticated(resp.Auth.ClientToken)
+	am.CredSuccess()
+
+	select {
+	case <-am.NewCreds():
+	case <-time.After(10 * time.Second):
+		t.Fatal("timed out waiting for secret ID to be rotated")
+	}
+
+	// Rotating didn't log in with the old secret ID, so it has a use left
+	resp, err = client.Logical().Write("auth/approle/role/test1/secret-id/lookup", map[string]interface{}{
+		"secret_id": secretID,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if uses, _ := resp.Data["secret_id_num_uses"].(json.Number).Int64(); uses != 1 {
+		t.Fatalf("expected the old secret ID to have 1 use left, got %d", uses)
+	}
+
+	// The rotated secret ID is written to the file, and used from it
+	rotated, err := os.ReadFile(secretPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(rotated) == secretID {
+		t.Fatal("expected the rotated secret ID to be written to the file")
+	}
+	path, _, data, err = am.Authenticate(context.Background(), client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data["secret_id"] != string(rotated) {
+		t.Fatalf("expected rotated secret ID to be used, got %v", data["secret_id"])
+	}
+	if _, err := loginClient.Logical().Write(path, data); err != nil {
+		t.Fatalf("error logging in with rotated secret ID: %v", err)
+	}
+}
+
 func addConstraints(add bool, cfg map[string]interface{}) map[string]interface{} {
 	if add {
 		// extraConstraints to add when bind_secret_id=false (otherwise Vault would fail with: "at least one constraint should be enabled on the role")
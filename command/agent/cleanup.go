@@ -0,0 +1,282 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: BUSL-1.1
+
+package agent
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	ctconfig "github.com/hashicorp/consul-template/config"
+	hclog "github.com/hashicorp/go-hclog"
+	agentConfig "github.com/hashicorp/vault/command/agent/config"
+	"github.com/hashicorp/vault/command/agent/template"
+	"github.com/hashicorp/vault/command/agentproxyshared/sink/file"
+	"github.com/hashicorp/vault/helper/osutil"
+)
+
+// CleanupStaleFiles finds the regular files matching the configuration's
+// cleanup_globs which aren't among the files the agent is configured to read
+// or write, see configuredFiles, or the configuration files or directories
+// at configPaths it was loaded from, so that files such as token files written to
+// paths used by earlier deployments don't linger. They're only removed if the
+// configuration sets cleanup_remove; otherwise they're logged, so that globs
+// can be checked before anything is removed. It's meant to be run at startup,
+// before anything is written. The paths of the stale files are returned.
+//
+// Every glob is validated before anything is removed, and an error is
+// returned, without removing anything, if any is too broad; see
+// validateCleanupGlob. Files which can't be removed are logged and skipped.
+func CleanupStaleFiles(logger hclog.Logger, cfg *agentConfig.Config, configPaths []string) ([]string, error) {
+	for _, glob := range cfg.CleanupGlobs {
+		if err := validateCleanupGlob(glob); err != nil {
+			return nil, err
+		}
+	}
+
+	keep, keepGlobs, err := configuredFiles(cfg, configPaths)
+	if err != nil {
+		return nil, err
+	}
+
+	var stale []string
+	for _, glob := range cfg.CleanupGlobs {
+		matches, err := filepath.Glob(glob)
+		if err != nil {
+			return stale, fmt.Errorf("invalid cleanup glob %q: %w", glob, err)
+		}
+		for _, path := range matches {
+			path, err = filepath.Abs(path)
+			if err != nil {
+				continue
+			}
+			if _, ok := keep[path]; ok || matchesAny(keepGlobs, path) {
+				continue
+			}
+			// Directories, symlinks and the like are never removed
+			info, err := os.Lstat(path)
+			if err != nil || !info.Mode().IsRegular() {
+				continue
+			}
+			if !cfg.CleanupRemove {
+				logger.Info("found stale file, set cleanup_remove to remove it", "path", path)
+				stale = append(stale, path)
+				continue
+			}
+			if err := os.Remove(path); err != nil {
+				logger.Warn("failed to remove stale file", "path", path, "error", err)
+				continue
+			}
+			logger.Info("removed stale file", "path", path)
+			stale = append(stale, path)
+		}
+	}
+	return stale, nil
+}
+
+// validateCleanupGlob returns an error if glob is invalid, isn't absolute, or
+// could match every file in the root directory or a top-level directory, such
+// as "/*" or "/tmp/*".
+func validateCleanupGlob(glob string) error {
+	if _, err := filepath.Match(glob, ""); err != nil {
+		return fmt.Errorf("invalid cleanup glob %q: %w", glob, err)
+	}
+	if !filepath.IsAbs(glob) {
+		return fmt.Errorf("cleanup glob %q must be an absolute path", glob)
+	}
+
+	elems := strings.Split(strings.TrimPrefix(filepath.ToSlash(filepath.Clean(glob)), filepath.ToSlash(filepath.VolumeName(glob))), "/")[1:]
+	for i, elem := range elems {
+		if !strings.ContainsAny(elem, `*?[\`) {
+			continue
+		}
+		// The wildcard must be at least two levels down, or one level down if
+		// its element has some literal text to narrow what it matches
+		if i >= 2 || (i == 1 && strings.Trim(elem, "*?") != "") {
+			return nil
+		}
+		return fmt.Errorf("cleanup glob %q is too broad", glob)
+	}
+	return nil
+}
+
+// sidecarExts are the extensions added to the paths of the files the agent
+// writes to give the paths of the files it writes alongside them: template
+// checksums, signatures and backups, and file sink locks.
+var sidecarExts = []string{
+	template.ChecksumSidecarExt,
+	template.SignatureExt,
+	".bak",
+	".old.bak",
+	file.LockFileExt,
+}
+
+// configuredFiles returns the absolute paths of the files the agent is
+// configured to read or write: its configuration files, file and audit sink
+// paths, template sources and destinations, and the files written alongside
+// them, its PID file and auto-auth error file, persisted token and its key
+// file, the auto-auth method's credential files, and its TLS certificates
+// and keys. Files whose names aren't known up front are returned as globs:
+// those in configuration directories, the paths of file sinks with
+// path_template set, which depend on the tokens written, and the files the
+// audit sink rotates its log to.
+func configuredFiles(cfg *agentConfig.Config, configPaths []string) (map[string]struct{}, []string, error) {
+	files := make(map[string]struct{})
+	var globs []string
+	add := func(path string) {
+		if path == "" {
+			return
+		}
+		if abs, err := filepath.Abs(path); err == nil {
+			files[abs] = struct{}{}
+		}
+	}
+	addWithSidecars := func(path string) {
+		if path == "" {
+			return
+		}
+		add(path)
+		for _, ext := range sidecarExts {
+			add(path + ext)
+		}
+	}
+	addGlob := func(glob string) {
+		if abs, err := filepath.Abs(glob); err == nil {
+			globs = append(globs, abs)
+		}
+	}
+
+	for _, path := range configPaths {
+		// Only the .hcl and .json files in a configuration directory are
+		// loaded, see agentConfig.LoadConfigDir
+		if info, err := os.Stat(path); err == nil && info.IsDir() {
+			addGlob(filepath.Join(escapeGlob(path), "*.hcl"))
+			addGlob(filepath.Join(escapeGlob(path), "*.json"))
+			continue
+		}
+		add(path)
+	}
+
+	if cfg.AutoAuth != nil {
+		add(cfg.AutoAuth.ErrorFile)
+		add(cfg.AutoAuth.PersistTokenPath)
+		add(cfg.AutoAuth.PersistTokenKeyFile)
+		if cfg.AutoAuth.Method != nil {
+			// Method credential files are configured with keys such as
+			// role_id_file_path, secret_id_file_path and token_file_path
+			for key, v := range cfg.AutoAuth.Method.Config {
+				path, ok := v.(string)
+				if !ok {
+					continue
+				}
+				switch {
+				case strings.HasSuffix(key, "path"), key == "ca_cert", key == "client_cert", key == "client_key":
+					add(path)
+				}
+			}
+		}
+		for _, sc := range cfg.AutoAuth.Sinks {
+			add(sc.DHPath)
+			path, ok := sc.Config["path"].(string)
+			if !ok {
+				continue
+			}
+			// Sinks expand environment variables in their paths
+			path, err := osutil.ExpandEnv(path)
+			if err != nil {
+				return nil, nil, fmt.Errorf("could not expand sink path: %w", err)
+			}
+			if pathTemplate, _ := sc.Config["path_template"].(bool); pathTemplate {
+				addGlob(pathTemplateGlob(path))
+				continue
+			}
+			addWithSidecars(path)
+			if sc.Type == "audit" {
+				addGlob(auditRotatedGlob(path))
+			}
+		}
+	}
+	if cfg.Vault != nil {
+		add(cfg.Vault.CACert)
+		add(cfg.Vault.ClientCert)
+		add(cfg.Vault.ClientKey)
+	}
+	if cfg.SharedConfig != nil {
+		add(cfg.PidFile)
+		for _, l := range cfg.Listeners {
+			add(l.TLSCertFile)
+			add(l.TLSKeyFile)
+			add(l.TLSClientCAFile)
+		}
+	}
+
+	for _, tc := range cfg.Templates {
+		dest, err := osutil.ExpandEnv(ctconfig.StringVal(tc.Destination))
+		if err != nil {
+			return nil, nil, fmt.Errorf("could not expand template destination: %w", err)
+		}
+		addWithSidecars(dest)
+		add(ctconfig.StringVal(tc.Source))
+	}
+	return files, globs, nil
+}
+
+// auditRotatedGlob returns a glob matching the names the audit sink writing
+// to path renames its log to when rotating it, e.g. "audit-*.log" for
+// "audit.log".
+func auditRotatedGlob(path string) string {
+	ext := filepath.Ext(path)
+	if ext == "" {
+		ext = ".log"
+	}
+	return escapeGlob(strings.TrimSuffix(path, filepath.Ext(path))) + "-*" + escapeGlob(ext)
+}
+
+// pathTemplateGlob returns a glob matching any path a file sink's path
+// template could be rendered to, with each action replaced by a wildcard.
+func pathTemplateGlob(path string) string {
+	var b strings.Builder
+	for {
+		i := strings.Index(path, "{{")
+		if i < 0 {
+			break
+		}
+		j := strings.Index(path[i:], "}}")
+		if j < 0 {
+			break
+		}
+		b.WriteString(escapeGlob(path[:i]))
+		b.WriteString("*")
+		path = path[i+j+2:]
+	}
+	b.WriteString(escapeGlob(path))
+	return b.String()
+}
+
+// escapeGlob escapes the characters filepath.Match treats specially in s.
+func escapeGlob(s string) string {
+	if filepath.Separator == '\\' {
+		// Backslashes are separators, so can't be used to escape
+		return s
+	}
+	var b strings.Builder
+	for _, r := range s {
+		if strings.ContainsRune(`*?[\`, r) {
+			b.WriteByte('\\')
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+// matchesAny returns whether path matches any of globs.
+func matchesAny(globs []string, path string) bool {
+	for _, glob := range globs {
+		if ok, _ := filepath.Match(glob, path); ok {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,178 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: BUSL-1.1
+
+package agent
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	ctconfig "github.com/hashicorp/consul-template/config"
+	hclog "github.com/hashicorp/go-hclog"
+	agentConfig "github.com/hashicorp/vault/command/agent/config"
+	"github.com/hashicorp/vault/sdk/helper/logging"
+	"github.com/hashicorp/vault/sdk/helper/pointerutil"
+)
+
+// TestCleanupStaleFiles tests that only the matching files the agent isn't
+// configured to read or write are removed.
+func TestCleanupStaleFiles(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv("CLEANUP_TEST_POD", "pod")
+	if err := os.Mkdir(filepath.Join(dir, "config.d"), 0o700); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{
+		"current.token", "current.token.lock", "old.token", "role.token", "render.txt", "render.txt.sha256",
+		"other.txt", "abc.templated.token", "ca.txt", "pod.token", "source.txt", "agent.hcl",
+		"audit.txt", "audit-1700000000000000000.txt", "config.d/agent.hcl", "config.d/other.token",
+	} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte("contents"), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Mkdir(filepath.Join(dir, "dir.token"), 0o700); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := &agentConfig.Config{
+		AutoAuth: &agentConfig.AutoAuth{
+			Method: &agentConfig.Method{
+				Config: map[string]interface{}{"role_id_file_path": filepath.Join(dir, "role.token")},
+			},
+			Sinks: []*agentConfig.Sink{
+				{
+					Type:   "file",
+					Config: map[string]interface{}{"path": filepath.Join(dir, "current.token")},
+				},
+				{
+					Type: "file",
+					Config: map[string]interface{}{
+						"path":          filepath.Join(dir, "{{ .Accessor }}.templated.token"),
+						"path_template": true,
+					},
+				},
+				{
+					Type:   "file",
+					Config: map[string]interface{}{"path": filepath.Join(dir, "${CLEANUP_TEST_POD}.token")},
+				},
+				{
+					Type:   "audit",
+					Config: map[string]interface{}{"path": filepath.Join(dir, "audit.txt")},
+				},
+			},
+		},
+		Vault: &agentConfig.Vault{
+			CACert: filepath.Join(dir, "ca.txt"),
+		},
+		Templates: []*ctconfig.TemplateConfig{
+			{
+				Source:      pointerutil.StringPtr(filepath.Join(dir, "source.txt")),
+				Destination: pointerutil.StringPtr(filepath.Join(dir, "render.txt")),
+			},
+		},
+		CleanupGlobs: []string{
+			filepath.Join(dir, "*.token"), filepath.Join(dir, "*.txt"), filepath.Join(dir, "*.hcl"),
+			filepath.Join(dir, "config.d", "*"),
+		},
+		CleanupRemove: true,
+	}
+	configPaths := []string{filepath.Join(dir, "agent.hcl"), filepath.Join(dir, "config.d")}
+
+	removed, err := CleanupStaleFiles(logging.NewVaultLogger(hclog.Trace), cfg, configPaths)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(removed) != 3 {
+		t.Fatalf("expected 3 files to be removed, got %v", removed)
+	}
+	for name, exists := range map[string]bool{
+		"current.token":       true,
+		"current.token.lock":  true,
+		"old.token":           false,
+		"role.token":          true,
+		"abc.templated.token": true,
+		"render.txt":          true,
+		"render.txt.sha256":   true,
+		"other.txt":           false,
+		"ca.txt":              true,
+		"dir.token":           true,
+		// Sink paths are checked once environment variables are expanded
+		"pod.token": true,
+		// Template sources and configuration files are read by the agent
+		"source.txt":           true,
+		"agent.hcl":            true,
+		"config.d/agent.hcl":   true,
+		"config.d/other.token": false,
+		// The audit sink keeps its rotated files
+		"audit.txt":                     true,
+		"audit-1700000000000000000.txt": true,
+	} {
+		_, err := os.Stat(filepath.Join(dir, name))
+		if exists != (err == nil) {
+			t.Fatalf("expected %s to exist: %t, got %v", name, exists, err)
+		}
+	}
+}
+
+// TestCleanupStaleFiles_DryRun tests that stale files are only reported
+// without cleanup_remove.
+func TestCleanupStaleFiles_DryRun(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "old.token")
+	if err := os.WriteFile(path, []byte("contents"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	stale, err := CleanupStaleFiles(logging.NewVaultLogger(hclog.Trace), &agentConfig.Config{
+		CleanupGlobs: []string{filepath.Join(dir, "*.token")},
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(stale) != 1 || stale[0] != path {
+		t.Fatalf("expected %s to be stale, got %v", path, stale)
+	}
+	if _, err := os.Stat(path); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCleanupStaleFiles_TooBroad(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "old.token")
+	if err := os.WriteFile(path, []byte("contents"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	// Nothing is removed if any glob is too broad
+	_, err := CleanupStaleFiles(logging.NewVaultLogger(hclog.Trace), &agentConfig.Config{
+		CleanupGlobs: []string{filepath.Join(dir, "*.token"), "/*"},
+	}, nil)
+	if err == nil || !strings.Contains(err.Error(), "too broad") {
+		t.Fatalf("expected too broad error, got %v", err)
+	}
+	if _, err := os.Stat(path); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestValidateCleanupGlob(t *testing.T) {
+	for glob, valid := range map[string]bool{
+		"/vault/secrets/*":       true,
+		"/vault/secrets/*.token": true,
+		"/tmp/agent-*":           true,
+		"/vault/*/token":         false,
+		"/tmp/*":                 false,
+		"/*":                     false,
+		"/*/secrets/token":       false,
+		"vault/secrets/*":        false,
+		"/vault/secrets/[":       false,
+	} {
+		if err := validateCleanupGlob(glob); valid != (err == nil) {
+			t.Errorf("expected %q to be valid: %t, got %v", glob, valid, err)
+		}
+	}
+}
@@ -9,8 +9,11 @@ import (
 	"fmt"
 	"io"
 	"net"
+	"net/http"
+	"net/url"
 	"os"
 	"path/filepath"
+	"reflect"
 	"strings"
 	"syscall"
 	"time"
@@ -21,7 +24,9 @@ import (
 	"github.com/hashicorp/go-secure-stdlib/parseutil"
 	"github.com/hashicorp/hcl"
 	"github.com/hashicorp/hcl/hcl/ast"
+	"github.com/hashicorp/vault/command/agent/tokenbroker"
 	"github.com/hashicorp/vault/command/agentproxyshared"
+	"github.com/hashicorp/vault/command/agentproxyshared/auth"
 	"github.com/hashicorp/vault/helper/namespace"
 	"github.com/hashicorp/vault/internalshared/configutil"
 	"github.com/hashicorp/vault/sdk/helper/pointerutil"
@@ -50,6 +55,19 @@ type Config struct {
 	DisableKeepAlivesAutoAuth   bool                       `hcl:"-"`
 	Exec                        *ExecConfig                `hcl:"exec,optional"`
 	EnvTemplates                []*ctconfig.TemplateConfig `hcl:"env_template,optional"`
+	CleanupGlobs                []string                   `hcl:"cleanup_globs"`
+	CleanupRemove               bool                       `hcl:"cleanup_remove"`
+	TokenBroker                 *TokenBroker               `hcl:"token_broker"`
+	RedactTokens                bool                       `hcl:"redact_tokens"`
+
+	// TemplateNamespaces are the namespaces set on templates with
+	// "namespace", keyed by the template, which they read secrets from in
+	// place of the auto-auth or vault stanza's namespace.
+	TemplateNamespaces map[*ctconfig.TemplateConfig]string `hcl:"-"`
+
+	// TemplateRenewLease holds the templates with "renew_lease" set, whose
+	// leased secrets are renewed rather than issued again on each render.
+	TemplateRenewLease map[*ctconfig.TemplateConfig]bool `hcl:"-"`
 }
 
 const (
@@ -82,16 +100,40 @@ type Retry struct {
 
 // Vault contains configuration for connecting to Vault servers
 type Vault struct {
-	Address          string      `hcl:"address"`
-	CACert           string      `hcl:"ca_cert"`
-	CAPath           string      `hcl:"ca_path"`
-	TLSSkipVerify    bool        `hcl:"-"`
-	TLSSkipVerifyRaw interface{} `hcl:"tls_skip_verify"`
-	ClientCert       string      `hcl:"client_cert"`
-	ClientKey        string      `hcl:"client_key"`
-	TLSServerName    string      `hcl:"tls_server_name"`
-	Namespace        string      `hcl:"namespace"`
-	Retry            *Retry      `hcl:"retry"`
+	Address          string          `hcl:"address"`
+	CACert           string          `hcl:"ca_cert"`
+	CAPath           string          `hcl:"ca_path"`
+	TLSSkipVerify    bool            `hcl:"-"`
+	TLSSkipVerifyRaw interface{}     `hcl:"tls_skip_verify"`
+	ClientCert       string          `hcl:"client_cert"`
+	ClientKey        string          `hcl:"client_key"`
+	TLSServerName    string          `hcl:"tls_server_name"`
+	Namespace        string          `hcl:"namespace"`
+	Retry            *Retry          `hcl:"retry"`
+	CircuitBreaker   *CircuitBreaker `hcl:"circuit_breaker"`
+	ProxyURL         string          `hcl:"proxy_url"`
+	VaultAddresses   []string        `hcl:"addresses"`
+
+	// ProxyDialer is set at runtime to connect through ProxyURL, for the
+	// template runner to connect to Vault through it.
+	ProxyDialer transportDialer `hcl:"-"`
+
+	// Failover is set at runtime to fail over between VaultAddresses, for
+	// the template runner to connect to Vault through it.
+	Failover transportDialer `hcl:"-"`
+}
+
+// CircuitBreaker contains the configuration of the circuit breaker which
+// stops the agent connecting to Vault for a while after too many consecutive
+// failures.
+type CircuitBreaker struct {
+	FailureThreshold int           `hcl:"failure_threshold"`
+	CooldownRaw      interface{}   `hcl:"cooldown"`
+	Cooldown         time.Duration `hcl:"-"`
+
+	// Dialer is set at runtime to the breaker, for the template runner to
+	// connect to Vault through it.
+	Dialer transportDialer `hcl:"-"`
 }
 
 // transportDialer is an interface that allows passing a custom dialer function
@@ -104,6 +146,15 @@ type transportDialer interface {
 	DialContext(ctx context.Context, network, address string) (net.Conn, error)
 }
 
+// TokenBroker contains the configuration of the token broker, which serves
+// the auto-auth token to local processes over HTTP
+type TokenBroker struct {
+	Address             string      `hcl:"address"`
+	Secret              string      `hcl:"secret"`
+	AllowNonLoopbackRaw interface{} `hcl:"allow_non_loopback"`
+	AllowNonLoopback    bool        `hcl:"-"`
+}
+
 // APIProxy contains any configuration needed for proxy mode
 type APIProxy struct {
 	UseAutoAuthTokenRaw interface{} `hcl:"use_auto_auth_token"`
@@ -130,6 +181,25 @@ type AutoAuth struct {
 	Sinks  []*Sink `hcl:"sinks"`
 
 	EnableReauthOnNewCredentials bool `hcl:"enable_reauth_on_new_credentials"`
+
+	// SinkInitTimeout is how long sinks which fail to be created at startup,
+	// e.g. because their directory doesn't exist yet, will be retried before
+	// the agent gives up. By default, the agent fails immediately.
+	SinkInitTimeoutRaw interface{}   `hcl:"sink_init_timeout"`
+	SinkInitTimeout    time.Duration `hcl:"-"`
+
+	// ErrorFile, if set, is the path of a file the agent keeps holding the
+	// most recent auto-auth or sink failure, and empties once it recovers.
+	ErrorFile string `hcl:"error_file"`
+
+	// PersistTokenPath, if set, is the path of a file the agent persists
+	// each token it obtains to, encrypted with the base64 encoded AES-256
+	// key read from the file at PersistTokenKeyFile, or the environment
+	// variable PersistTokenKeyEnv, so that if Vault can't be reached when
+	// it starts, it can use the token until it can.
+	PersistTokenPath    string `hcl:"persist_token_path"`
+	PersistTokenKeyFile string `hcl:"persist_token_key_file"`
+	PersistTokenKeyEnv  string `hcl:"persist_token_key_env"`
 }
 
 // Method represents the configuration for the authentication backend
@@ -145,11 +215,30 @@ type Method struct {
 	Namespace     string        `hcl:"namespace"`
 	ExitOnError   bool          `hcl:"exit_on_err"`
 	Config        map[string]interface{}
+
+	// Headers are HTTP headers sent with each of the method's login
+	// requests, e.g. for a gateway in front of Vault.
+	Headers map[string]string `hcl:"headers"`
+}
+
+// AuthHeaders returns the method's Headers as an http.Header, or nil if it
+// has none.
+func (m *Method) AuthHeaders() http.Header {
+	if len(m.Headers) == 0 {
+		return nil
+	}
+	headers := make(http.Header, len(m.Headers))
+	for key, value := range m.Headers {
+		headers.Set(key, value)
+	}
+	return headers
 }
 
 // Sink defines a location to write the authenticated token
 type Sink struct {
 	Type       string
+	Name       string        `hcl:"name"`
+	Emit       string        `hcl:"emit"`
 	WrapTTLRaw interface{}   `hcl:"wrap_ttl"`
 	WrapTTL    time.Duration `hcl:"-"`
 	DHType     string        `hcl:"dh_type"`
@@ -158,6 +247,19 @@ type Sink struct {
 	AAD        string        `hcl:"aad"`
 	AADEnvVar  string        `hcl:"aad_env_var"`
 	Config     map[string]interface{}
+
+	// ReadinessProbe, if set, holds back the first token written to the
+	// sink until a GET of the probe's URL returns 200.
+	ReadinessProbe *SinkReadinessProbe `hcl:"readiness_probe"`
+}
+
+// SinkReadinessProbe is the readiness probe of a sink's consumer.
+type SinkReadinessProbe struct {
+	URL         string        `hcl:"url"`
+	IntervalRaw interface{}   `hcl:"interval"`
+	Interval    time.Duration `hcl:"-"`
+	TimeoutRaw  interface{}   `hcl:"timeout"`
+	Timeout     time.Duration `hcl:"-"`
 }
 
 // TemplateConfig defines global behaviors around template
@@ -168,6 +270,33 @@ type TemplateConfig struct {
 	MaxConnectionsPerHostRaw interface{}   `hcl:"max_connections_per_host"`
 	MaxConnectionsPerHost    int           `hcl:"-"`
 	LeaseRenewalThreshold    *float64      `hcl:"lease_renewal_threshold"`
+
+	// RenderIntervalJitter, a fraction of the static secret render interval
+	// in [0, 1), offsets the interval by a random amount of up to that
+	// fraction either way, so that a fleet of agents don't all render at
+	// once. The offset is picked once per process, unless
+	// RenderIntervalJitterPerCycle is set, in which case it's picked again
+	// for each render. consul-template only takes the interval once, so the
+	// latter only applies to custom Renderers.
+	RenderIntervalJitter         float64 `hcl:"render_interval_jitter"`
+	RenderIntervalJitterPerCycle bool    `hcl:"render_interval_jitter_per_cycle"`
+
+	// DisableLookupSelf turns off recovering from invalid tokens with
+	// lookup-self, for tokens whose policy intentionally doesn't allow it:
+	// the token isn't checked with lookup-self at startup or before
+	// re-authenticating, and templates denied lookup-self don't trigger
+	// re-authentication.
+	DisableLookupSelf bool `hcl:"disable_lookup_self"`
+
+	// Wait and Retry are passed through to the consul-template runner. Wait
+	// is the quiescence timer applied to every template which doesn't set its
+	// own, and Retry overrides how fetching secrets is retried, which is
+	// otherwise based on the vault stanza's retry and the auto-auth method's
+	// backoff.
+	WaitRaw  interface{}           `hcl:"wait"`
+	Wait     *ctconfig.WaitConfig  `hcl:"-"`
+	RetryRaw interface{}           `hcl:"retry"`
+	Retry    *ctconfig.RetryConfig `hcl:"-"`
 }
 
 type ExecConfig struct {
@@ -260,6 +389,23 @@ func (c *Config) Merge(c2 *Config) *Config {
 		result.Templates = append(result.Templates, l)
 	}
 
+	for _, namespaces := range []map[*ctconfig.TemplateConfig]string{c.TemplateNamespaces, c2.TemplateNamespaces} {
+		for tmpl, ns := range namespaces {
+			if result.TemplateNamespaces == nil {
+				result.TemplateNamespaces = make(map[*ctconfig.TemplateConfig]string)
+			}
+			result.TemplateNamespaces[tmpl] = ns
+		}
+	}
+	for _, renewLease := range []map[*ctconfig.TemplateConfig]bool{c.TemplateRenewLease, c2.TemplateRenewLease} {
+		for tmpl, renew := range renewLease {
+			if result.TemplateRenewLease == nil {
+				result.TemplateRenewLease = make(map[*ctconfig.TemplateConfig]bool)
+			}
+			result.TemplateRenewLease[tmpl] = renew
+		}
+	}
+
 	result.ExitAfterAuth = c.ExitAfterAuth
 	if c2.ExitAfterAuth {
 		result.ExitAfterAuth = c2.ExitAfterAuth
@@ -288,6 +434,16 @@ func (c *Config) Merge(c2 *Config) *Config {
 		result.EnvTemplates = append(result.EnvTemplates, envTmpl)
 	}
 
+	result.CleanupGlobs = append(append([]string(nil), c.CleanupGlobs...), c2.CleanupGlobs...)
+	result.CleanupRemove = c.CleanupRemove || c2.CleanupRemove
+
+	result.TokenBroker = c.TokenBroker
+	if c2.TokenBroker != nil {
+		result.TokenBroker = c2.TokenBroker
+	}
+
+	result.RedactTokens = c.RedactTokens || c2.RedactTokens
+
 	return result
 }
 
@@ -349,11 +505,22 @@ func (c *Config) ValidateConfig() error {
 		if len(c.AutoAuth.Sinks) == 0 &&
 			(c.APIProxy == nil || !c.APIProxy.UseAutoAuthToken) &&
 			len(c.Templates) == 0 &&
-			len(c.EnvTemplates) == 0 {
-			return fmt.Errorf("auto_auth requires at least one sink or at least one template or api_proxy.use_auto_auth_token=true")
+			len(c.EnvTemplates) == 0 &&
+			c.TokenBroker == nil {
+			return fmt.Errorf("auto_auth requires at least one sink or at least one template or api_proxy.use_auto_auth_token=true or a token_broker")
 		}
 	}
 
+	if c.TokenBroker != nil && c.AutoAuth == nil {
+		return fmt.Errorf("token_broker requires auto_auth to be configured")
+	}
+
+	// With wrap_ttl, the agent only ever has the response-wrapped token, which
+	// can be unwrapped just once, so it can't serve a usable token
+	if c.TokenBroker != nil && c.AutoAuth.Method != nil && c.AutoAuth.Method.WrapTTL > 0 {
+		return fmt.Errorf("token_broker cannot be used with auto_auth.method.wrap_ttl")
+	}
+
 	if c.AutoAuth == nil && c.Cache == nil && len(c.Listeners) == 0 {
 		return fmt.Errorf("no auto_auth, cache, or listener block found in config")
 	}
@@ -635,6 +802,10 @@ func LoadConfigFile(path string) (*Config, error) {
 		return nil, fmt.Errorf("error parsing 'api_proxy':%w", err)
 	}
 
+	if err := parseTokenBroker(result, list); err != nil {
+		return nil, fmt.Errorf("error parsing 'token_broker': %w", err)
+	}
+
 	if err := parseTemplateConfig(result, list); err != nil {
 		return nil, fmt.Errorf("error parsing 'template_config': %w", err)
 	}
@@ -750,6 +921,28 @@ func parseVault(result *Config, list *ast.ObjectList) error {
 		}
 	}
 
+	if v.ProxyURL != "" {
+		if _, err := agentproxyshared.ParseProxyURL(v.ProxyURL); err != nil {
+			return fmt.Errorf("error parsing 'proxy_url': %w", err)
+		}
+	}
+
+	if len(v.VaultAddresses) > 0 {
+		if _, err := agentproxyshared.ParseFailoverAddresses(v.VaultAddresses); err != nil {
+			return fmt.Errorf("error parsing 'addresses': %w", err)
+		}
+		if v.ProxyURL != "" {
+			return errors.New("'addresses' can't be used with 'proxy_url'")
+		}
+		switch v.Address {
+		case "":
+			v.Address = v.VaultAddresses[0]
+		case v.VaultAddresses[0]:
+		default:
+			return errors.New("'address' must be the first of 'addresses' if both are set")
+		}
+	}
+
 	result.Vault = &v
 
 	subs, ok := item.Val.(*ast.ObjectType)
@@ -761,6 +954,10 @@ func parseVault(result *Config, list *ast.ObjectList) error {
 		return fmt.Errorf("error parsing 'retry': %w", err)
 	}
 
+	if err := parseCircuitBreaker(result, subs.List); err != nil {
+		return fmt.Errorf("error parsing 'circuit_breaker': %w", err)
+	}
+
 	return nil
 }
 
@@ -789,6 +986,46 @@ func parseRetry(result *Config, list *ast.ObjectList) error {
 	return nil
 }
 
+func parseCircuitBreaker(result *Config, list *ast.ObjectList) error {
+	name := "circuit_breaker"
+
+	breakerList := list.Filter(name)
+	if len(breakerList.Items) == 0 {
+		return nil
+	}
+
+	if len(breakerList.Items) > 1 {
+		return fmt.Errorf("one and only one %q block is required", name)
+	}
+
+	item := breakerList.Items[0]
+
+	var cb CircuitBreaker
+	err := hcl.DecodeObject(&cb, item.Val)
+	if err != nil {
+		return err
+	}
+
+	if cb.FailureThreshold < 0 {
+		return errors.New("'failure_threshold' must not be negative")
+	}
+
+	if cb.CooldownRaw != nil {
+		cb.Cooldown, err = parseutil.ParseDurationSecond(cb.CooldownRaw)
+		if err != nil {
+			return fmt.Errorf("error parsing 'cooldown': %w", err)
+		}
+		if cb.Cooldown < 0 {
+			return errors.New("'cooldown' must not be negative")
+		}
+		cb.CooldownRaw = nil
+	}
+
+	result.Vault.CircuitBreaker = &cb
+
+	return nil
+}
+
 func parseAPIProxy(result *Config, list *ast.ObjectList) error {
 	name := "api_proxy"
 
@@ -833,6 +1070,49 @@ func parseAPIProxy(result *Config, list *ast.ObjectList) error {
 	return nil
 }
 
+func parseTokenBroker(result *Config, list *ast.ObjectList) error {
+	name := "token_broker"
+
+	brokerList := list.Filter(name)
+	if len(brokerList.Items) == 0 {
+		return nil
+	}
+
+	if len(brokerList.Items) > 1 {
+		return fmt.Errorf("one and only one %q block is required", name)
+	}
+
+	item := brokerList.Items[0]
+
+	var broker TokenBroker
+	err := hcl.DecodeObject(&broker, item.Val)
+	if err != nil {
+		return err
+	}
+
+	if broker.AllowNonLoopbackRaw != nil {
+		broker.AllowNonLoopback, err = parseutil.ParseBool(broker.AllowNonLoopbackRaw)
+		if err != nil {
+			return fmt.Errorf("error parsing 'allow_non_loopback': %w", err)
+		}
+		broker.AllowNonLoopbackRaw = nil
+	}
+
+	if broker.Secret == "" {
+		return errors.New("'secret' must be set")
+	}
+	if broker.Address == "" {
+		broker.Address = tokenbroker.DefaultAddress
+	}
+	if err := tokenbroker.ValidateAddress(broker.Address, broker.AllowNonLoopback); err != nil {
+		return err
+	}
+
+	result.TokenBroker = &broker
+
+	return nil
+}
+
 func parseCache(result *Config, list *ast.ObjectList) error {
 	name := "cache"
 
@@ -984,6 +1264,24 @@ func parseAutoAuth(result *Config, list *ast.ObjectList) error {
 		result.AutoAuth.Method.MinBackoffRaw = nil
 	}
 
+	if result.AutoAuth.SinkInitTimeoutRaw != nil {
+		var err error
+		if result.AutoAuth.SinkInitTimeout, err = parseutil.ParseDurationSecond(result.AutoAuth.SinkInitTimeoutRaw); err != nil {
+			return err
+		}
+		result.AutoAuth.SinkInitTimeoutRaw = nil
+	}
+
+	hasKey := result.AutoAuth.PersistTokenKeyFile != "" || result.AutoAuth.PersistTokenKeyEnv != ""
+	switch {
+	case result.AutoAuth.PersistTokenPath == "" && hasKey:
+		return errors.New("error parsing auto_auth: persist_token_key_file and persist_token_key_env require persist_token_path")
+	case result.AutoAuth.PersistTokenPath != "" && !hasKey:
+		return errors.New("error parsing auto_auth: persist_token_path requires persist_token_key_file or persist_token_key_env")
+	case result.AutoAuth.PersistTokenKeyFile != "" && result.AutoAuth.PersistTokenKeyEnv != "":
+		return errors.New("error parsing auto_auth: only one of persist_token_key_file and persist_token_key_env can be set")
+	}
+
 	return nil
 }
 
@@ -1030,6 +1328,10 @@ func parseMethod(result *Config, list *ast.ObjectList) error {
 	// Canonicalize namespace path if provided
 	m.Namespace = namespace.Canonicalize(m.Namespace)
 
+	if err := auth.ValidateAuthHeaders(m.AuthHeaders()); err != nil {
+		return fmt.Errorf("method.headers: %w", err)
+	}
+
 	result.AutoAuth.Method = &m
 	return nil
 }
@@ -1043,6 +1345,7 @@ func parseSinks(result *Config, list *ast.ObjectList) error {
 	}
 
 	var ts []*Sink
+	names := make(map[string]struct{}, len(sinkList.Items))
 
 	for _, item := range sinkList.Items {
 		var s Sink
@@ -1059,6 +1362,13 @@ func parseSinks(result *Config, list *ast.ObjectList) error {
 			}
 		}
 
+		if s.Name != "" {
+			if _, ok := names[s.Name]; ok {
+				return multierror.Prefix(fmt.Errorf("duplicate sink name %q", s.Name), fmt.Sprintf("sink.%s", s.Type))
+			}
+			names[s.Name] = struct{}{}
+		}
+
 		if s.WrapTTLRaw != nil {
 			var err error
 			if s.WrapTTL, err = parseutil.ParseDurationSecond(s.WrapTTLRaw); err != nil {
@@ -1067,6 +1377,22 @@ func parseSinks(result *Config, list *ast.ObjectList) error {
 			s.WrapTTLRaw = nil
 		}
 
+		switch s.Emit {
+		case "", "token":
+		case "accessor":
+			if s.WrapTTL != 0 {
+				return multierror.Prefix(errors.New("'wrap_ttl' can't be specified when emitting the accessor"), fmt.Sprintf("sink.%s", s.Type))
+			}
+		default:
+			return multierror.Prefix(errors.New("invalid value for 'emit'"), fmt.Sprintf("sink.%s", s.Type))
+		}
+
+		if s.ReadinessProbe != nil {
+			if err := parseSinkReadinessProbe(s.ReadinessProbe); err != nil {
+				return multierror.Prefix(err, fmt.Sprintf("sink.%s.readiness_probe", s.Type))
+			}
+		}
+
 		switch s.DHType {
 		case "":
 		case "curve25519":
@@ -1099,6 +1425,36 @@ func parseSinks(result *Config, list *ast.ObjectList) error {
 	return nil
 }
 
+func parseSinkReadinessProbe(p *SinkReadinessProbe) error {
+	if p.URL == "" {
+		return errors.New("'url' must be specified")
+	}
+	if u, err := url.Parse(p.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return errors.New("'url' must be an http or https URL")
+	}
+
+	var err error
+	if p.IntervalRaw != nil {
+		if p.Interval, err = parseutil.ParseDurationSecond(p.IntervalRaw); err != nil {
+			return fmt.Errorf("error parsing 'interval': %w", err)
+		}
+		if p.Interval < 0 {
+			return errors.New("'interval' must not be negative")
+		}
+		p.IntervalRaw = nil
+	}
+	if p.TimeoutRaw != nil {
+		if p.Timeout, err = parseutil.ParseDurationSecond(p.TimeoutRaw); err != nil {
+			return fmt.Errorf("error parsing 'timeout': %w", err)
+		}
+		if p.Timeout < 0 {
+			return errors.New("'timeout' must not be negative")
+		}
+		p.TimeoutRaw = nil
+	}
+	return nil
+}
+
 func parseTemplateConfig(result *Config, list *ast.ObjectList) error {
 	name := "template_config"
 
@@ -1132,6 +1488,10 @@ func parseTemplateConfig(result *Config, list *ast.ObjectList) error {
 		result.TemplateConfig.StaticSecretRenderIntRaw = nil
 	}
 
+	if jitter := result.TemplateConfig.RenderIntervalJitter; jitter < 0 || jitter >= 1 {
+		return fmt.Errorf("'render_interval_jitter' must be at least 0 and less than 1, got %v", jitter)
+	}
+
 	if result.TemplateConfig.MaxConnectionsPerHostRaw != nil {
 		var err error
 		if result.TemplateConfig.MaxConnectionsPerHost, err = parseutil.SafeParseInt(result.TemplateConfig.MaxConnectionsPerHostRaw); err != nil {
@@ -1143,9 +1503,80 @@ func parseTemplateConfig(result *Config, list *ast.ObjectList) error {
 		result.TemplateConfig.MaxConnectionsPerHost = DefaultTemplateConfigMaxConnsPerHost
 	}
 
+	if result.TemplateConfig.WaitRaw != nil {
+		var wait ctconfig.WaitConfig
+		if err := decodeTemplateConfigBlock(result.TemplateConfig.WaitRaw, &wait); err != nil {
+			return fmt.Errorf("error parsing 'wait': %w", err)
+		}
+		min, max := ctconfig.TimeDurationVal(wait.Min), ctconfig.TimeDurationVal(wait.Max)
+		if min < 0 || max < 0 {
+			return errors.New("'wait' min and max must not be negative")
+		}
+		if wait.Max != nil && max < min {
+			return fmt.Errorf("'wait' max (%s) must not be less than min (%s)", max, min)
+		}
+		result.TemplateConfig.Wait = &wait
+		result.TemplateConfig.WaitRaw = nil
+	}
+
+	if result.TemplateConfig.RetryRaw != nil {
+		var retry ctconfig.RetryConfig
+		if err := decodeTemplateConfigBlock(result.TemplateConfig.RetryRaw, &retry); err != nil {
+			return fmt.Errorf("error parsing 'retry': %w", err)
+		}
+		backoff, maxBackoff := ctconfig.TimeDurationVal(retry.Backoff), ctconfig.TimeDurationVal(retry.MaxBackoff)
+		if ctconfig.IntVal(retry.Attempts) < 0 {
+			return errors.New("'retry' attempts must not be negative")
+		}
+		if backoff < 0 || maxBackoff < 0 {
+			return errors.New("'retry' backoff and max_backoff must not be negative")
+		}
+		if backoff > 0 && maxBackoff > 0 && maxBackoff < backoff {
+			return fmt.Errorf("'retry' max_backoff (%s) must not be less than backoff (%s)", maxBackoff, backoff)
+		}
+		result.TemplateConfig.Retry = &retry
+		result.TemplateConfig.RetryRaw = nil
+	}
+
 	return nil
 }
 
+// decodeTemplateConfigBlock decodes a block within template_config into the
+// consul-template configuration it's passed through as. The block is decoded
+// by HCL as a list of maps, which are flattened, so that as with
+// consul-template, if a key is given more than once, the last value wins.
+func decodeTemplateConfigBlock(raw interface{}, result interface{}) error {
+	if blocks, ok := raw.([]map[string]interface{}); ok {
+		flattened := make(map[string]interface{})
+		for _, block := range blocks {
+			for k, v := range block {
+				flattened[k] = v
+			}
+		}
+		raw = flattened
+	}
+
+	decoder, err := mapstructure.NewDecoder(&mapstructure.DecoderConfig{
+		DecodeHook: mapstructure.ComposeDecodeHookFunc(
+			ctconfig.StringToWaitDurationHookFunc(),
+			// Durations are parsed as everywhere else in the agent's
+			// configuration, so that plain numbers are seconds
+			func(_ reflect.Type, t reflect.Type, data interface{}) (interface{}, error) {
+				if t != reflect.TypeOf(time.Duration(0)) {
+					return data, nil
+				}
+				return parseutil.ParseDurationSecond(data)
+			},
+		),
+		ErrorUnused: true,
+		Result:      result,
+	})
+	if err != nil {
+		return errors.New("mapstructure decoder creation failed")
+	}
+	return decoder.Decode(raw)
+}
+
 func parseTemplates(result *Config, list *ast.ObjectList) error {
 	name := "template"
 
@@ -1186,6 +1617,25 @@ func parseTemplates(result *Config, list *ast.ObjectList) error {
 			parsed["exec"] = exec[len(exec)-1]
 		}
 
+		// The namespace is the agent's own, rather than consul-template's
+		var ns string
+		if nsRaw, ok := parsed["namespace"]; ok {
+			if ns, ok = nsRaw.(string); !ok || ns == "" {
+				return errors.New("template namespace must be a non-empty string")
+			}
+			delete(parsed, "namespace")
+		}
+
+		// As is renew_lease
+		var renewLease bool
+		if renewLeaseRaw, ok := parsed["renew_lease"]; ok {
+			var err error
+			if renewLease, err = parseutil.ParseBool(renewLeaseRaw); err != nil {
+				return fmt.Errorf("error parsing template renew_lease: %w", err)
+			}
+			delete(parsed, "renew_lease")
+		}
+
 		var tc ctconfig.TemplateConfig
 
 		// Use mapstructure to populate the basic config fields
@@ -1207,6 +1657,18 @@ func parseTemplates(result *Config, list *ast.ObjectList) error {
 		if err := decoder.Decode(parsed); err != nil {
 			return err
 		}
+		if ns != "" {
+			if result.TemplateNamespaces == nil {
+				result.TemplateNamespaces = make(map[*ctconfig.TemplateConfig]string)
+			}
+			result.TemplateNamespaces[&tc] = namespace.Canonicalize(ns)
+		}
+		if renewLease {
+			if result.TemplateRenewLease == nil {
+				result.TemplateRenewLease = make(map[*ctconfig.TemplateConfig]bool)
+			}
+			result.TemplateRenewLease[&tc] = true
+		}
 		tcs = append(tcs, &tc)
 	}
 	result.Templates = tcs
@@ -0,0 +1,21 @@
+# Copyright (c) HashiCorp, Inc.
+# SPDX-License-Identifier: BUSL-1.1
+
+pid_file = "./pidfile"
+
+auto_auth {
+	method {
+		type = "aws"
+		config = {
+			role = "foobar"
+		}
+	}
+
+	sink "file" {
+		emit = "accessor"
+		wrap_ttl = "5m"
+		config = {
+			path = "/tmp/file-accessor"
+		}
+	}
+}
@@ -0,0 +1,22 @@
+# Copyright (c) HashiCorp, Inc.
+# SPDX-License-Identifier: BUSL-1.1
+
+pid_file = "./pidfile"
+
+auto_auth {
+	method {
+		type = "aws"
+		config = {
+			role = "foobar"
+		}
+	}
+
+	sink "file" {
+		readiness_probe {
+			url = "127.0.0.1:8080/ready"
+		}
+		config = {
+			path = "/tmp/file-token"
+		}
+	}
+}
@@ -0,0 +1,16 @@
+# Copyright (c) HashiCorp, Inc.
+# SPDX-License-Identifier: BUSL-1.1
+
+vault {
+  address = "http://127.0.0.1:1111"
+}
+
+template_config {
+  static_secret_render_interval = "5m"
+  render_interval_jitter = 1.5
+}
+
+template {
+  source      = "/path/on/disk/to/template.ctmpl"
+  destination = "/path/on/disk/where/template/will/render.txt"
+}
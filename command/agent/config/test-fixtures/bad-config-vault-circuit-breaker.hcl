@@ -0,0 +1,10 @@
+# Copyright (c) HashiCorp, Inc.
+# SPDX-License-Identifier: BUSL-1.1
+
+vault {
+	address = "http://127.0.0.1:8200"
+
+	circuit_breaker {
+		failure_threshold = -1
+	}
+}
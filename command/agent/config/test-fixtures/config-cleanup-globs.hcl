@@ -0,0 +1,23 @@
+# Copyright (c) HashiCorp, Inc.
+# SPDX-License-Identifier: BUSL-1.1
+
+pid_file = "./pidfile"
+
+cleanup_globs = ["/vault/secrets/*.token", "/vault/secrets/old/*"]
+cleanup_remove = true
+
+auto_auth {
+	method {
+		type = "aws"
+		config = {
+			role = "foobar"
+		}
+	}
+
+	sink {
+		type = "file"
+		config = {
+			path = "/vault/secrets/agent.token"
+		}
+	}
+}
@@ -0,0 +1,16 @@
+# Copyright (c) HashiCorp, Inc.
+# SPDX-License-Identifier: BUSL-1.1
+
+pid_file = "./pidfile"
+
+auto_auth {
+	method {
+		type = "approle"
+		headers = {
+			"X-Gateway-Key" = "gateway-secret"
+		}
+		config = {
+			role_id_file_path = "/tmp/role-id"
+		}
+	}
+}
@@ -0,0 +1,26 @@
+# Copyright (c) HashiCorp, Inc.
+# SPDX-License-Identifier: BUSL-1.1
+
+pid_file = "./pidfile"
+
+auto_auth {
+	method {
+		type = "aws"
+		config = {
+			role = "foobar"
+		}
+	}
+
+	sink "file" {
+		config = {
+			path = "/tmp/file-token"
+		}
+	}
+
+	sink "file" {
+		emit = "accessor"
+		config = {
+			path = "/tmp/file-accessor"
+		}
+	}
+}
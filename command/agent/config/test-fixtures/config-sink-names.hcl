@@ -0,0 +1,27 @@
+# Copyright (c) HashiCorp, Inc.
+# SPDX-License-Identifier: BUSL-1.1
+
+pid_file = "./pidfile"
+
+auto_auth {
+	method {
+		type = "aws"
+		config = {
+			role = "foobar"
+		}
+	}
+
+	sink "file" {
+		name = "foo"
+		config = {
+			path = "/tmp/file-foo"
+		}
+	}
+
+	sink "file" {
+		name = "bar"
+		config = {
+			path = "/tmp/file-bar"
+		}
+	}
+}
@@ -0,0 +1,24 @@
+# Copyright (c) HashiCorp, Inc.
+# SPDX-License-Identifier: BUSL-1.1
+
+pid_file = "./pidfile"
+
+auto_auth {
+	method {
+		type = "aws"
+		config = {
+			role = "foobar"
+		}
+	}
+
+	sink "file" {
+		readiness_probe {
+			url      = "http://127.0.0.1:8080/ready"
+			interval = "5s"
+			timeout  = 2
+		}
+		config = {
+			path = "/tmp/file-token"
+		}
+	}
+}
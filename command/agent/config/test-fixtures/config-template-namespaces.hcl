@@ -0,0 +1,26 @@
+# Copyright (c) HashiCorp, Inc.
+# SPDX-License-Identifier: BUSL-1.1
+
+pid_file = "./pidfile"
+
+auto_auth {
+  method {
+    type      = "aws"
+    namespace = "/my-namespace"
+
+    config = {
+      role = "foobar"
+    }
+  }
+}
+
+template {
+  source      = "/path/on/disk/to/tenant-a.ctmpl"
+  destination = "/path/on/disk/where/template/will/render-a.txt"
+  namespace   = "tenant-a"
+}
+
+template {
+  source      = "/path/on/disk/to/default.ctmpl"
+  destination = "/path/on/disk/where/template/will/render-default.txt"
+}
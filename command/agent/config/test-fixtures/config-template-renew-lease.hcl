@@ -0,0 +1,25 @@
+# Copyright (c) HashiCorp, Inc.
+# SPDX-License-Identifier: BUSL-1.1
+
+pid_file = "./pidfile"
+
+auto_auth {
+  method {
+    type = "aws"
+
+    config = {
+      role = "foobar"
+    }
+  }
+}
+
+template {
+  source      = "/path/on/disk/to/database.ctmpl"
+  destination = "/path/on/disk/where/template/will/render-database.txt"
+  renew_lease = true
+}
+
+template {
+  source      = "/path/on/disk/to/default.ctmpl"
+  destination = "/path/on/disk/where/template/will/render-default.txt"
+}
@@ -13,6 +13,20 @@ template_config {
   static_secret_render_interval = 60
   max_connections_per_host = 100
   lease_renewal_threshold = 0.8
+  render_interval_jitter = 0.1
+  render_interval_jitter_per_cycle = true
+  disable_lookup_self = true
+
+  wait {
+    min = "5s"
+    max = 30
+  }
+
+  retry {
+    attempts    = 3
+    backoff     = "250ms"
+    max_backoff = "1m"
+  }
 }
 
 template {
@@ -0,0 +1,22 @@
+# Copyright (c) HashiCorp, Inc.
+# SPDX-License-Identifier: BUSL-1.1
+
+pid_file = "./pidfile"
+
+vault {
+	address = "http://127.0.0.1:8200"
+
+	circuit_breaker {
+		failure_threshold = 3
+		cooldown = "1m"
+	}
+}
+
+auto_auth {
+	method {
+		type = "aws"
+		config = {
+			role = "foobar"
+		}
+	}
+}
@@ -0,0 +1,98 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: BUSL-1.1
+
+package agent
+
+import (
+	"context"
+	"sync"
+)
+
+// Coordinator derives the contexts the auth handler and the servers it
+// delivers tokens to run with, so that they stop in a fixed order. Once the
+// context it was created with is done, or Stop is called, the servers'
+// context is cancelled first, and only once every server run with RunServer
+// has returned is the auth handler's, so that a server never asks a stopped
+// auth handler to re-authenticate, or waits on it for a token.
+type Coordinator struct {
+	authCtx       context.Context
+	cancelAuth    context.CancelFunc
+	serverCtx     context.Context
+	cancelServers context.CancelFunc
+
+	l        sync.Mutex
+	stopping bool
+	servers  sync.WaitGroup
+
+	stopOnce sync.Once
+	doneCh   chan struct{}
+}
+
+// NewCoordinator returns a Coordinator which stops everything it runs once
+// ctx is done. The contexts it derives carry ctx's values.
+func NewCoordinator(ctx context.Context) *Coordinator {
+	c := &Coordinator{
+		doneCh: make(chan struct{}),
+	}
+	c.authCtx, c.cancelAuth = context.WithCancel(context.WithoutCancel(ctx))
+	c.serverCtx, c.cancelServers = context.WithCancel(context.WithoutCancel(ctx))
+
+	go func() {
+		select {
+		case <-ctx.Done():
+			c.Stop()
+		case <-c.doneCh:
+		}
+	}()
+	return c
+}
+
+// RunAuth calls run, such as the auth handler's Run, with the context which is
+// cancelled last, and returns its error.
+func (c *Coordinator) RunAuth(run func(context.Context) error) error {
+	return run(c.authCtx)
+}
+
+// RunServer calls run, such as a sink or template server's Run, with the
+// context which is cancelled first, and returns its error. Stopping waits for
+// it to return before the auth handler is stopped.
+func (c *Coordinator) RunServer(run func(context.Context) error) error {
+	c.l.Lock()
+	if c.stopping {
+		c.l.Unlock()
+		return run(c.serverCtx)
+	}
+	c.servers.Add(1)
+	c.l.Unlock()
+
+	defer c.servers.Done()
+	return run(c.serverCtx)
+}
+
+// ServerContext returns the context servers are run with, for anything else
+// which should stop along with them.
+func (c *Coordinator) ServerContext() context.Context {
+	return c.serverCtx
+}
+
+// Stop stops the servers, waits for them to return, and then stops the auth
+// handler. It returns once the auth handler's context has been cancelled,
+// and may be called more than once.
+func (c *Coordinator) Stop() {
+	c.stopOnce.Do(func() {
+		c.l.Lock()
+		c.stopping = true
+		c.l.Unlock()
+
+		c.cancelServers()
+		c.servers.Wait()
+		c.cancelAuth()
+		close(c.doneCh)
+	})
+}
+
+// Done returns a channel which is closed once Stop has cancelled the auth
+// handler's context.
+func (c *Coordinator) Done() <-chan struct{} {
+	return c.doneCh
+}
@@ -0,0 +1,71 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: BUSL-1.1
+
+package agent
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// TestCoordinator tests that once the Coordinator's context is done, the
+// servers are stopped, and the auth handler only once they've all returned.
+func TestCoordinator(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	coord := NewCoordinator(ctx)
+
+	authCtxCh := make(chan context.Context, 1)
+	authErrCh := make(chan error, 1)
+	go func() {
+		authErrCh <- coord.RunAuth(func(ctx context.Context) error {
+			authCtxCh <- ctx
+			<-ctx.Done()
+			return nil
+		})
+	}()
+	authCtx := <-authCtxCh
+
+	// Each server checks the auth handler is still running once it's
+	// stopped, the second after a delay
+	serverErrCh := make(chan error, 2)
+	for _, delay := range []time.Duration{0, 100 * time.Millisecond} {
+		started := make(chan struct{})
+		go func() {
+			serverErrCh <- coord.RunServer(func(ctx context.Context) error {
+				close(started)
+				<-ctx.Done()
+				time.Sleep(delay)
+				return authCtx.Err()
+			})
+		}()
+		<-started
+	}
+
+	cancel()
+	for range 2 {
+		select {
+		case err := <-serverErrCh:
+			require.NoError(t, err, "auth handler stopped before a server")
+		case <-time.After(5 * time.Second):
+			t.Fatal("timed out waiting for servers to stop")
+		}
+	}
+	select {
+	case err := <-authErrCh:
+		require.NoError(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the auth handler to stop")
+	}
+	<-coord.Done()
+
+	// A server run after stopping is stopped straight away
+	err := coord.RunServer(func(ctx context.Context) error {
+		return ctx.Err()
+	})
+	require.ErrorIs(t, err, context.Canceled)
+	coord.Stop()
+}
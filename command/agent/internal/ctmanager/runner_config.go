@@ -4,17 +4,52 @@
 package ctmanager
 
 import (
+	"crypto/tls"
 	"fmt"
 	"io"
+	"math/rand"
+	"net/http"
+	"net/url"
 	"strings"
+	"time"
 
 	ctconfig "github.com/hashicorp/consul-template/config"
+	"github.com/hashicorp/consul-template/dependency"
 	ctlogging "github.com/hashicorp/consul-template/logging"
 	"github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/vault/api"
 	"github.com/hashicorp/vault/command/agent/config"
+	"github.com/hashicorp/vault/command/agentproxyshared"
 	"github.com/hashicorp/vault/sdk/helper/pointerutil"
 )
 
+// renderJitter places the static secret render interval of this process
+// within the range allowed by its jitter. It's rolled once, so that the
+// interval is stable for the life of the process.
+var renderJitter = rand.Float64()
+
+// RenderInterval returns the interval at which static secrets are rendered:
+// the template config's static secret render interval, or consul-template's
+// default, offset by up to its render interval jitter, a fraction of the
+// interval, either way. Where in that range it falls is given by r, in
+// [0, 1).
+func RenderInterval(tc *config.TemplateConfig, r float64) time.Duration {
+	interval := ctconfig.DefaultVaultLeaseDuration
+	if tc == nil {
+		return interval
+	}
+	if tc.StaticSecretRenderInt > 0 {
+		interval = tc.StaticSecretRenderInt
+	}
+	return interval + time.Duration((2*r-1)*tc.RenderIntervalJitter*float64(interval))
+}
+
+// StableRenderInterval returns the RenderInterval of this process, which
+// doesn't change while it runs.
+func StableRenderInterval(tc *config.TemplateConfig) time.Duration {
+	return RenderInterval(tc, renderJitter)
+}
+
 type ManagerConfig struct {
 	AgentConfig *config.Config
 	Namespace   string
@@ -41,8 +76,11 @@ func NewConfig(mc ManagerConfig, templates ctconfig.TemplateConfigs) (*ctconfig.
 	if mc.AgentConfig.TemplateConfig != nil {
 		conf.Vault.LeaseRenewalThreshold = mc.AgentConfig.TemplateConfig.LeaseRenewalThreshold
 
-		if mc.AgentConfig.TemplateConfig.StaticSecretRenderInt != 0 {
-			conf.Vault.DefaultLeaseDuration = &mc.AgentConfig.TemplateConfig.StaticSecretRenderInt
+		// consul-template only sets the default lease duration once per
+		// process, so the jitter can't be re-rolled each cycle
+		if mc.AgentConfig.TemplateConfig.StaticSecretRenderInt != 0 || mc.AgentConfig.TemplateConfig.RenderIntervalJitter > 0 {
+			interval := StableRenderInterval(mc.AgentConfig.TemplateConfig)
+			conf.Vault.DefaultLeaseDuration = &interval
 		}
 	}
 
@@ -77,6 +115,7 @@ func NewConfig(mc ManagerConfig, templates ctconfig.TemplateConfigs) (*ctconfig.
 	}
 
 	// Use the cache if available or fallback to the Vault server values.
+	failoverTLS := mc.AgentConfig.Cache == nil && mc.AgentConfig.Vault.Failover != nil && strings.HasPrefix(mc.AgentConfig.Vault.Address, "https")
 	if mc.AgentConfig.Cache != nil {
 		if mc.AgentConfig.Cache.InProcDialer == nil {
 			return nil, fmt.Errorf("missing in-process dialer configuration")
@@ -89,6 +128,16 @@ func NewConfig(mc ManagerConfig, templates ctconfig.TemplateConfigs) (*ctconfig.
 		// setting it here to override the setting at the top of this function,
 		// and to prevent the vault/http client from defaulting to https.
 		conf.Vault.Address = pointerutil.StringPtr("http://127.0.0.1:8200")
+	} else if failoverTLS {
+		// consul-template verifies certificates against the host name of
+		// the address it's configured with, which is wrong once the failover
+		// has moved to another address, so it's given a plain http address
+		// and a dialer which makes the TLS connections itself
+		u, err := url.Parse(mc.AgentConfig.Vault.Address)
+		if err != nil {
+			return nil, fmt.Errorf("error parsing vault address: %w", err)
+		}
+		conf.Vault.Address = pointerutil.StringPtr("http://" + u.Host)
 	} else if strings.HasPrefix(mc.AgentConfig.Vault.Address, "https") || mc.AgentConfig.Vault.CACert != "" {
 		skipVerify := mc.AgentConfig.Vault.TLSSkipVerify
 		verify := !skipVerify
@@ -102,6 +151,36 @@ func NewConfig(mc ManagerConfig, templates ctconfig.TemplateConfigs) (*ctconfig.
 			ServerName: &mc.AgentConfig.Vault.TLSServerName,
 		}
 	}
+
+	// Connect to Vault through the proxy, the circuit breaker and the
+	// failover shared with the rest of the agent, if configured. The proxy
+	// dialer connects through the breaker, which connects through the
+	// failover. Connections through the cache already use all of them.
+	if mc.AgentConfig.Cache == nil {
+		var dialer dependency.TransportDialer
+		switch {
+		case mc.AgentConfig.Vault.ProxyDialer != nil:
+			dialer = mc.AgentConfig.Vault.ProxyDialer
+		case mc.AgentConfig.Vault.CircuitBreaker != nil && mc.AgentConfig.Vault.CircuitBreaker.Dialer != nil:
+			dialer = mc.AgentConfig.Vault.CircuitBreaker.Dialer
+		case mc.AgentConfig.Vault.Failover != nil:
+			dialer = mc.AgentConfig.Vault.Failover
+		}
+		if failoverTLS {
+			tlsConfig, err := vaultTLSConfig(mc.AgentConfig.Vault)
+			if err != nil {
+				return nil, err
+			}
+			dialer = agentproxyshared.NewTLSDialer(dialer.DialContext, tlsConfig)
+		}
+		if dialer != nil {
+			if conf.Vault.Transport == nil {
+				conf.Vault.Transport = &ctconfig.TransportConfig{}
+			}
+			conf.Vault.Transport.CustomDialer = dialer
+		}
+	}
+
 	enabled := attempts > 0
 	conf.Vault.Retry = &ctconfig.RetryConfig{
 		Attempts: &attempts,
@@ -121,6 +200,17 @@ func NewConfig(mc ManagerConfig, templates ctconfig.TemplateConfigs) (*ctconfig.
 		}
 	}
 
+	// Apply the retry and wait settings from template_config, which take
+	// precedence over those above
+	if mc.AgentConfig.TemplateConfig != nil {
+		if mc.AgentConfig.TemplateConfig.Retry != nil {
+			conf.Vault.Retry = conf.Vault.Retry.Merge(mc.AgentConfig.TemplateConfig.Retry)
+		}
+		if mc.AgentConfig.TemplateConfig.Wait != nil {
+			conf.Wait = mc.AgentConfig.TemplateConfig.Wait.Copy()
+		}
+	}
+
 	conf.Finalize()
 
 	// setup log level from TemplateServer config
@@ -135,6 +225,27 @@ func NewConfig(mc ManagerConfig, templates ctconfig.TemplateConfigs) (*ctconfig.
 	return conf, nil
 }
 
+// vaultTLSConfig returns the TLS configuration for connecting to Vault with
+// the agent's vault stanza.
+func vaultTLSConfig(v *config.Vault) (*tls.Config, error) {
+	apiConfig := &api.Config{
+		HttpClient: &http.Client{
+			Transport: &http.Transport{TLSClientConfig: &tls.Config{}},
+		},
+	}
+	if err := apiConfig.ConfigureTLS(&api.TLSConfig{
+		CACert:        v.CACert,
+		CAPath:        v.CAPath,
+		ClientCert:    v.ClientCert,
+		ClientKey:     v.ClientKey,
+		TLSServerName: v.TLSServerName,
+		Insecure:      v.TLSSkipVerify,
+	}); err != nil {
+		return nil, fmt.Errorf("error configuring TLS for templates: %w", err)
+	}
+	return apiConfig.TLSConfig(), nil
+}
+
 // logLevelToString converts a go-hclog level to a matching, uppercase string
 // value. It's used to convert Vault Agent's hclog level to a string version
 // suitable for use in Consul Template's runner configuration input.
@@ -0,0 +1,163 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: BUSL-1.1
+
+package agent
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	hclog "github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/vault/api"
+	agentConfig "github.com/hashicorp/vault/command/agent/config"
+	"github.com/hashicorp/vault/command/agent/template"
+	"github.com/hashicorp/vault/command/agentproxyshared"
+	"github.com/hashicorp/vault/command/agentproxyshared/auth"
+	"github.com/hashicorp/vault/command/agentproxyshared/sink"
+	"github.com/hashicorp/vault/command/agentproxyshared/sink/audit"
+	"github.com/hashicorp/vault/command/agentproxyshared/sink/command"
+	"github.com/hashicorp/vault/command/agentproxyshared/sink/file"
+	"github.com/hashicorp/vault/command/agentproxyshared/sink/kubernetes"
+	"github.com/hashicorp/vault/command/agentproxyshared/sink/stdout"
+	"github.com/hashicorp/vault/command/agentproxyshared/sink/webhook"
+)
+
+// RunOnceConfig configures RunOnce.
+type RunOnceConfig struct {
+	Logger hclog.Logger
+	// Client is used to authenticate, and to response-wrap tokens for sinks
+	// with a wrap_ttl.
+	Client *api.Client
+	// Config is the agent configuration, of which the auto_auth method and
+	// sinks, and the templates, are used.
+	Config *agentConfig.Config
+	// Timeout, if set, is how long to wait for the token to be written and
+	// the templates rendered before failing.
+	Timeout time.Duration
+}
+
+// RunOnce authenticates using the configured auto-auth method, writes the
+// token to every sink and renders every template once, and then stops,
+// as the agent does with exit_after_auth set. Unlike running each component
+// with ExitAfterAuth, the auth handler, sink server and template server are
+// all stopped together once the sinks and templates are done, and the errors
+// from all of them are returned; see FirstPass. If ctx is done or the timeout
+// elapses first, that error is returned along with any others.
+func RunOnce(ctx context.Context, cfg *RunOnceConfig) error {
+	if cfg == nil || cfg.Config == nil || cfg.Config.AutoAuth == nil || cfg.Config.AutoAuth.Method == nil {
+		return errors.New("no auto_auth method configured")
+	}
+	if cfg.Client == nil {
+		return errors.New("no client provided")
+	}
+
+	logger := cfg.Logger
+	if logger == nil {
+		logger = hclog.NewNullLogger()
+	}
+	config := cfg.Config
+	method := config.AutoAuth.Method
+
+	vaultAddress := cfg.Client.Address()
+	if config.Vault != nil && config.Vault.Address != "" {
+		vaultAddress = config.Vault.Address
+	}
+	am, err := agentproxyshared.GetAutoAuthMethodFromConfig(method.Type, &auth.AuthConfig{
+		Logger:    logger.Named(fmt.Sprintf("auth.%s", method.Type)),
+		MountPath: method.MountPath,
+		Config:    method.Config,
+	}, vaultAddress)
+	if err != nil {
+		return fmt.Errorf("error creating %s auth method: %w", method.Type, err)
+	}
+
+	var sinks []*sink.SinkConfig
+	for _, sc := range config.AutoAuth.Sinks {
+		var newSink func(*sink.SinkConfig) (sink.Sink, error)
+		switch sc.Type {
+		case "file":
+			newSink = file.NewFileSink
+		case "kubernetes":
+			newSink = kubernetes.NewKubernetesSink
+		case "command":
+			newSink = command.NewCommandSink
+		case "stdout":
+			newSink = stdout.NewStdoutSink
+		case "audit":
+			newSink = audit.NewAuditSink
+		case "webhook":
+			newSink = webhook.NewWebhookSink
+		default:
+			return fmt.Errorf("unknown sink type %q", sc.Type)
+		}
+		var readinessProbe *sink.ReadinessProbe
+		if sc.ReadinessProbe != nil {
+			readinessProbe = &sink.ReadinessProbe{
+				URL:      sc.ReadinessProbe.URL,
+				Interval: sc.ReadinessProbe.Interval,
+				Timeout:  sc.ReadinessProbe.Timeout,
+			}
+		}
+
+		sinkConfig := &sink.SinkConfig{
+			Logger:         logger.Named("sink." + sc.Type),
+			Config:         sc.Config,
+			Client:         cfg.Client,
+			Emit:           sc.Emit,
+			WrapTTL:        sc.WrapTTL,
+			DHType:         sc.DHType,
+			DeriveKey:      sc.DeriveKey,
+			DHPath:         sc.DHPath,
+			AAD:            sc.AAD,
+			ReadinessProbe: readinessProbe,
+		}
+		s, err := newSink(sinkConfig)
+		if err != nil {
+			return fmt.Errorf("error creating %s sink: %w", sc.Type, err)
+		}
+		sinkConfig.Sink = s
+		sinks = append(sinks, sinkConfig)
+	}
+
+	if len(config.Templates) > 0 && config.Vault == nil {
+		return errors.New("templates require a vault stanza")
+	}
+
+	var tsConfig *template.ServerConfig
+	if len(config.Templates) > 0 {
+		tsConfig = &template.ServerConfig{
+			Logger:             logger.Named("template.server"),
+			LogLevel:           logger.GetLevel(),
+			LogWriter:          logger.StandardWriter(&hclog.StandardLoggerOptions{}),
+			AgentConfig:        config,
+			Namespace:          method.Namespace,
+			TemplateNamespaces: config.TemplateNamespaces,
+			RenewLease:         config.TemplateRenewLease,
+		}
+	}
+
+	p, err := FirstPass(&auth.AuthHandlerConfig{
+		Logger:         logger.Named("auth.handler"),
+		Client:         cfg.Client,
+		WrapTTL:        method.WrapTTL,
+		MinBackoff:     method.MinBackoff,
+		MaxBackoff:     method.MaxBackoff,
+		ExitOnError:    method.ExitOnError,
+		AuthMethodName: method.Type,
+		Namespace:      method.Namespace,
+		AuthHeaders:    method.AuthHeaders(),
+	}, &sink.SinkServerConfig{
+		Logger:    logger.Named("sink.server"),
+		Client:    cfg.Client,
+		Namespace: method.Namespace,
+	}, tsConfig, sinks, config.Templates, cfg.Timeout)
+	if err != nil {
+		return err
+	}
+
+	err = p.Run(ctx, am)
+	am.Shutdown()
+	return err
+}
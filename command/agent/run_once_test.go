@@ -0,0 +1,97 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: BUSL-1.1
+
+package agent
+
+import (
+	"context"
+	"os"
+	"testing"
+	"time"
+
+	ctconfig "github.com/hashicorp/consul-template/config"
+	"github.com/hashicorp/vault/api"
+	agentConfig "github.com/hashicorp/vault/command/agent/config"
+	"github.com/hashicorp/vault/helper/testhelpers/corehelpers"
+	"github.com/hashicorp/vault/helper/testhelpers/minimal"
+	"github.com/hashicorp/vault/sdk/helper/pointerutil"
+	"github.com/stretchr/testify/require"
+)
+
+// TestRunOnce tests that RunOnce writes the token to the sinks and renders
+// the templates, and then returns.
+func TestRunOnce(t *testing.T) {
+	// Unset the environment variable so that agent picks up the right test cluster address
+	t.Setenv(api.EnvVaultAddress, "")
+
+	cluster := minimal.NewTestSoloCluster(t, nil)
+	logger := corehelpers.NewTestLogger(t)
+	serverClient := cluster.Cores[0].Client
+
+	secret, err := serverClient.Auth().Token().Create(&api.TokenCreateRequest{})
+	require.NoError(t, err)
+	token := secret.Auth.ClientToken
+
+	newConfig := func(token string) *agentConfig.Config {
+		return &agentConfig.Config{
+			Vault: &agentConfig.Vault{
+				Address:       serverClient.Address(),
+				TLSSkipVerify: true,
+			},
+			AutoAuth: &agentConfig.AutoAuth{
+				Method: &agentConfig.Method{
+					Type: "token_file",
+					Config: map[string]interface{}{
+						"token_file_path": makeTempFile(t, "token-file", token),
+					},
+				},
+				Sinks: []*agentConfig.Sink{
+					{
+						Type: "file",
+						Config: map[string]interface{}{
+							"path": makeTempFile(t, "sink-file", ""),
+						},
+					},
+				},
+			},
+			Templates: []*ctconfig.TemplateConfig{
+				{
+					Contents:    pointerutil.StringPtr(`{{ with secret "auth/token/lookup-self" }}{{ .Data.id }}{{ end }}`),
+					Destination: pointerutil.StringPtr(makeTempFile(t, "template-output", "")),
+				},
+			},
+		}
+	}
+
+	client, err := serverClient.Clone()
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	config := newConfig(token)
+	err = RunOnce(ctx, &RunOnceConfig{
+		Logger: logger,
+		Client: client,
+		Config: config,
+	})
+	require.NoError(t, err)
+	require.NoError(t, ctx.Err())
+
+	content, err := os.ReadFile(config.AutoAuth.Sinks[0].Config["path"].(string))
+	require.NoError(t, err)
+	require.Equal(t, token, string(content))
+	content, err = os.ReadFile(*config.Templates[0].Destination)
+	require.NoError(t, err)
+	require.Equal(t, token, string(content))
+
+	// If authentication never succeeds, the context's error is returned
+	ctx, cancel = context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	err = RunOnce(ctx, &RunOnceConfig{
+		Logger: logger,
+		Client: client,
+		Config: newConfig("invalid"),
+	})
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+}
@@ -0,0 +1,223 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: BUSL-1.1
+
+package template
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	ctconfig "github.com/hashicorp/consul-template/config"
+)
+
+// DefaultCanaryTimeout is the default time allowed for each canary template
+// to render.
+const DefaultCanaryTimeout = 30 * time.Second
+
+// CanaryResult is the outcome of the latest render of a canary template, as
+// returned by Server.CanaryResults.
+type CanaryResult struct {
+	// Name identifies the canary: its destination, which is never written
+	// to, or if it has none, its position in CanaryTemplates, e.g.
+	// "canary[0]".
+	Name string
+	// Time is when the render finished.
+	Time time.Time
+	// Error is why the render failed, or nil if it succeeded.
+	Error error
+}
+
+// canaries holds the latest result of each canary template.
+type canaries struct {
+	l       sync.Mutex
+	results map[string]CanaryResult
+}
+
+// CanaryResults returns the outcome of the latest render of each canary
+// template, in the order of CanaryTemplates. Canaries which haven't been
+// rendered yet are left out.
+func (ts *Server) CanaryResults() []CanaryResult {
+	ts.canaries.l.Lock()
+	defer ts.canaries.l.Unlock()
+	var results []CanaryResult
+	for i, canary := range ts.config.CanaryTemplates {
+		if result, ok := ts.canaries.results[canaryName(i, canary)]; ok {
+			results = append(results, result)
+		}
+	}
+	return results
+}
+
+// startCanaries starts rendering the CanaryTemplates with each new token
+// received on incoming, returning the channel the tokens are passed on to
+// Run's loop on, which replaces any token it hasn't taken yet. Canaries are
+// rendered on their own goroutine, so that they never hold up rendering the
+// templates, until ctx is done.
+func (ts *Server) startCanaries(ctx context.Context, incoming chan string) chan string {
+	out := make(chan string, 1)
+	tokens := make(chan string, 1)
+	go ts.runCanaries(ctx, tokens)
+	go func() {
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case token, ok := <-incoming:
+				if !ok {
+					close(out)
+					return
+				}
+				for _, ch := range []chan string{out, tokens} {
+					select {
+					case <-ch:
+					default:
+					}
+					ch <- token
+				}
+			}
+		}
+	}()
+	return out
+}
+
+// runCanaries renders the CanaryTemplates with each new token received on
+// tokens, until ctx is done.
+func (ts *Server) runCanaries(ctx context.Context, tokens <-chan string) {
+	var latestToken string
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case token := <-tokens:
+			if token == latestToken {
+				continue
+			}
+			latestToken = token
+			ts.renderCanaries(ctx, token)
+		}
+	}
+}
+
+// renderCanaries renders each of the CanaryTemplates once with token to a
+// temporary directory, which is removed afterwards, recording its result and
+// emitting a CanaryRendered or CanaryFailed event. The canaries are rendered
+// the same way as RenderOnce renders templates, except that every error
+// fails the render, rather than being retried, and without running their
+// commands.
+func (ts *Server) renderCanaries(ctx context.Context, token string) {
+	dir, err := os.MkdirTemp("", "vault-agent-canary")
+	if err != nil {
+		ts.logger.Error("template server: unable to create directory for canary templates", "error", err)
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	conf := ts.canaryConfig()
+	timeout := ts.config.CanaryTimeout
+	if timeout <= 0 {
+		timeout = DefaultCanaryTimeout
+	}
+	for i, canary := range ts.config.CanaryTemplates {
+		name := canaryName(i, canary)
+		tmpl := canary.Copy()
+		tmpl.Destination = ctconfig.String(filepath.Join(dir, fmt.Sprintf("canary-%d", i)))
+		tmpl.Backup = nil
+		tmpl.User = nil
+		tmpl.Group = nil
+		tmpl.Uid = nil
+		tmpl.Gid = nil
+		tmpl.Command = nil
+		tmpl.Exec = nil
+		tmpl.MapToEnvironmentVariable = nil
+
+		renderCtx, cancel := context.WithTimeout(ctx, timeout)
+		err := NewServer(conf).RenderOnce(renderCtx, token, []*ctconfig.TemplateConfig{tmpl})
+		if err == nil && renderCtx.Err() != nil {
+			// Run returns without an error once its context is done
+			err = fmt.Errorf("canary didn't render within %s", timeout)
+		}
+		cancel()
+		if ctx.Err() != nil {
+			return
+		}
+		if err == nil {
+			if _, statErr := os.Stat(ctconfig.StringVal(tmpl.Destination)); statErr != nil {
+				err = errors.New("canary rendered nothing")
+			}
+		}
+		ts.recordCanary(name, err)
+	}
+}
+
+// canaryConfig returns the configuration of the Servers which render the
+// canaries, leaving out everything other than how templates are rendered.
+func (ts *Server) canaryConfig() *ServerConfig {
+	conf := *ts.config
+	conf.Logger = ts.config.Logger.Named("canary")
+	conf.CanaryTemplates = nil
+	conf.CompositeTemplates = nil
+	conf.TemplateNamespaces = nil
+	conf.PreflightCapabilities = nil
+	conf.RenewLease = nil
+	conf.OnSecretLeaseExpiring = nil
+	conf.EnableEventCh = false
+	conf.StartupRenderDeadline = 0
+	conf.RequireEphemeralDest = false
+	conf.SignatureKeyPath = ""
+	conf.WriteChecksumSidecar = false
+	conf.WriteRetry = nil
+	conf.ErrorPolicy = &ErrorPolicy{
+		InvalidToken:     ErrorActionFail,
+		PermissionDenied: ErrorActionFail,
+		NotFound:         ErrorActionFail,
+		Other:            ErrorActionFail,
+	}
+	return &conf
+}
+
+// recordCanary records the result of rendering the named canary, logging and
+// emitting an event for it.
+func (ts *Server) recordCanary(name string, err error) {
+	result := CanaryResult{
+		Name:  name,
+		Time:  time.Now(),
+		Error: err,
+	}
+	ts.canaries.l.Lock()
+	if ts.canaries.results == nil {
+		ts.canaries.results = make(map[string]CanaryResult)
+	}
+	ts.canaries.results[name] = result
+	ts.canaries.l.Unlock()
+
+	if err != nil {
+		ts.logger.Warn("template server: canary template failed to render", "canary", name, "error", err)
+		ts.emitEvent(TemplateEvent{
+			Type:        CanaryFailed,
+			Time:        result.Time,
+			Destination: name,
+			Error:       err,
+		})
+		return
+	}
+	ts.logger.Info("template server: canary template rendered", "canary", name)
+	ts.emitEvent(TemplateEvent{
+		Type:        CanaryRendered,
+		Time:        result.Time,
+		Destination: name,
+	})
+}
+
+// canaryName returns the name identifying the canary template at index i of
+// CanaryTemplates, see CanaryResult.Name.
+func canaryName(i int, canary *ctconfig.TemplateConfig) string {
+	if dest := ctconfig.StringVal(canary.Destination); dest != "" {
+		return dest
+	}
+	return fmt.Sprintf("canary[%d]", i)
+}
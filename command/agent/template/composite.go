@@ -0,0 +1,137 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: BUSL-1.1
+
+package template
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	ctconfig "github.com/hashicorp/consul-template/config"
+)
+
+// CompositeTemplate renders an ordered list of sub-templates, or sections,
+// into a single destination, so that a file assembled from several secrets
+// can be kept as separate templates, with the order of its sections fixed.
+// The sections are joined into one template, so the destination is written
+// atomically, with every section rendered from the same token.
+type CompositeTemplate struct {
+	// Template holds the destination, and the options used to render and
+	// write it, such as its permissions and delimiters. Its Contents and
+	// Source must be unset.
+	Template *ctconfig.TemplateConfig
+
+	// Sections are rendered in the order given.
+	Sections []*CompositeSection
+
+	// Separator, if set, is placed between each section. It's rendered as
+	// part of the template, like the sections.
+	Separator string
+}
+
+// CompositeSection is one of the sub-templates of a CompositeTemplate. Exactly
+// one of Contents and Source must be set.
+type CompositeSection struct {
+	// Name identifies the section in errors. It must be unique within the
+	// CompositeTemplate.
+	Name string
+
+	// Contents is the template itself.
+	Contents string
+
+	// Source is the path of a file holding the template. It's read when the
+	// Server starts.
+	Source string
+}
+
+// composeTemplates returns a template for each CompositeTemplate, with its
+// sections joined, in order, as its contents.
+func composeTemplates(composites []*CompositeTemplate) ([]*ctconfig.TemplateConfig, error) {
+	composed := make([]*ctconfig.TemplateConfig, 0, len(composites))
+	for _, c := range composites {
+		tmpl, err := c.compose()
+		if err != nil {
+			return nil, err
+		}
+		composed = append(composed, tmpl)
+	}
+	return composed, nil
+}
+
+// compose returns a copy of the CompositeTemplate's Template with the
+// sections joined as its contents. Each section is preceded by a comment
+// naming it, which renders as nothing, but identifies the section in parse
+// errors.
+func (c *CompositeTemplate) compose() (*ctconfig.TemplateConfig, error) {
+	if c.Template == nil {
+		return nil, errors.New("composite template has no template")
+	}
+	dest := ctconfig.StringVal(c.Template.Destination)
+	if dest == "" {
+		return nil, errors.New("composite template has no destination")
+	}
+	if ctconfig.StringVal(c.Template.Contents) != "" || ctconfig.StringVal(c.Template.Source) != "" {
+		return nil, fmt.Errorf("composite template %s must not set contents or source", dest)
+	}
+	if len(c.Sections) == 0 {
+		return nil, fmt.Errorf("composite template %s has no sections", dest)
+	}
+
+	leftDelim, rightDelim := "{{", "}}"
+	if d := ctconfig.StringVal(c.Template.LeftDelim); d != "" {
+		leftDelim = d
+	}
+	if d := ctconfig.StringVal(c.Template.RightDelim); d != "" {
+		rightDelim = d
+	}
+
+	var b strings.Builder
+	names := make(map[string]struct{}, len(c.Sections))
+	for idx, section := range c.Sections {
+		if section.Name == "" {
+			return nil, fmt.Errorf("composite template %s: section %d has no name", dest, idx)
+		}
+		if strings.Contains(section.Name, "*/") {
+			return nil, fmt.Errorf("composite template %s: section name %q must not contain \"*/\"", dest, section.Name)
+		}
+		if _, ok := names[section.Name]; ok {
+			return nil, fmt.Errorf("composite template %s: duplicate section %q", dest, section.Name)
+		}
+		names[section.Name] = struct{}{}
+
+		contents, err := section.contents()
+		if err != nil {
+			return nil, fmt.Errorf("composite template %s: section %q: %w", dest, section.Name, err)
+		}
+
+		if idx > 0 {
+			b.WriteString(c.Separator)
+		}
+		fmt.Fprintf(&b, "%s/* section %q */%s", leftDelim, section.Name, rightDelim)
+		b.WriteString(contents)
+	}
+
+	tmpl := c.Template.Copy()
+	tmpl.Contents = ctconfig.String(b.String())
+	return tmpl, nil
+}
+
+// contents returns the section's template, reading it from Source if set.
+func (s *CompositeSection) contents() (string, error) {
+	switch {
+	case s.Contents != "" && s.Source != "":
+		return "", errors.New("only one of contents and source may be set")
+	case s.Source != "":
+		data, err := os.ReadFile(s.Source)
+		if err != nil {
+			return "", fmt.Errorf("error reading source: %w", err)
+		}
+		return string(data), nil
+	case s.Contents != "":
+		return s.Contents, nil
+	default:
+		return "", errors.New("one of contents or source must be set")
+	}
+}
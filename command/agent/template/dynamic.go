@@ -0,0 +1,222 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: BUSL-1.1
+
+package template
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+	"sync"
+
+	ctconfig "github.com/hashicorp/consul-template/config"
+	"github.com/hashicorp/consul-template/manager"
+	"github.com/hashicorp/vault/helper/osutil"
+)
+
+// ErrServerNotRunning is returned by AddTemplate and RemoveTemplate if the
+// Server isn't running with any templates.
+var ErrServerNotRunning = errors.New("template server is not running")
+
+// templateUpdate is a request to add or remove a template from a running
+// Server. The Run loop applies it between renders, and replies on errCh.
+type templateUpdate struct {
+	// add is the template to add. If nil, the template with the destination
+	// remove is removed instead.
+	add    *ctconfig.TemplateConfig
+	remove string
+
+	// inspect, if set, is called with the current runner and templates
+	// instead of changing them, and its error is replied with. The runner is
+	// nil with a custom Renderer.
+	inspect func(runner *manager.Runner, templates []*ctconfig.TemplateConfig) error
+
+	// restart, if set, replaces the runner with one with the same templates,
+	// so that their dependencies are all fetched again. It does nothing with
+	// a custom Renderer.
+	restart bool
+
+	errCh chan error
+}
+
+// updates is the state used to pass templateUpdates to the Run loop.
+type updates struct {
+	l      sync.Mutex
+	ch     chan *templateUpdate
+	doneCh chan struct{}
+}
+
+// start returns the channel that updates are sent to until stop is called.
+func (u *updates) start() <-chan *templateUpdate {
+	u.l.Lock()
+	defer u.l.Unlock()
+	u.ch = make(chan *templateUpdate)
+	u.doneCh = make(chan struct{})
+	return u.ch
+}
+
+func (u *updates) stop() {
+	u.l.Lock()
+	defer u.l.Unlock()
+	if u.doneCh != nil {
+		close(u.doneCh)
+	}
+	u.ch, u.doneCh = nil, nil
+}
+
+func (u *updates) send(update *templateUpdate) error {
+	u.l.Lock()
+	ch, doneCh := u.ch, u.doneCh
+	u.l.Unlock()
+	if ch == nil {
+		return ErrServerNotRunning
+	}
+
+	update.errCh = make(chan error, 1)
+	select {
+	case ch <- update:
+	case <-doneCh:
+		return ErrServerNotRunning
+	}
+	return <-update.errCh
+}
+
+// AddTemplate starts rendering a template alongside those the Server is
+// already running with. An error is returned if another template already has
+// the same destination.
+//
+// With a custom Renderer, the other templates keep being rendered as they
+// were. The templates rendered by the consul-template runner can't be changed
+// without replacing it though, so with no custom Renderer, a started runner is
+// restarted with the new set of templates. It fetches all of their secrets
+// again, so dynamic secrets, such as database credentials, are issued anew
+// for the other templates too. Their destinations are only rewritten, and
+// their commands only run, if that changes what they render.
+func (ts *Server) AddTemplate(tmpl *ctconfig.TemplateConfig) error {
+	if tmpl == nil {
+		return errors.New("template server: template is nil")
+	}
+	prepared, err := ts.prepareTemplates([]*ctconfig.TemplateConfig{tmpl})
+	if err != nil {
+		return fmt.Errorf("template server: %w", err)
+	}
+	if ctconfig.StringVal(prepared[0].Destination) == "" {
+		return errors.New("template server: template has no destination")
+	}
+	if err := ts.checkEphemeralDestinations(prepared); err != nil {
+		return fmt.Errorf("template server: %w", err)
+	}
+	return ts.updates.send(&templateUpdate{add: prepared[0]})
+}
+
+// RemoveTemplate stops rendering the template with the given destination.
+// Environment variables in destination are expanded, as they are in the
+// templates' destinations. If DeleteRemovedDestinations is set, the
+// destination file is also deleted. An error is returned if no template has
+// the destination.
+//
+// As with AddTemplate, with no custom Renderer the runner is restarted with
+// the remaining templates, which fetches their secrets again.
+func (ts *Server) RemoveTemplate(destination string) error {
+	if destination == "" {
+		return errors.New("template server: destination is empty")
+	}
+	destination, err := osutil.ExpandEnv(destination)
+	if err != nil {
+		return fmt.Errorf("template server: could not expand destination: %w", err)
+	}
+	return ts.updates.send(&templateUpdate{remove: destination})
+}
+
+// Dependencies returns the dependencies of the template with the given
+// destination, as seen by the consul-template runner, such as
+// "vault.read(secret/data/app)". They're sorted, and are empty until the
+// template has first been evaluated with a token. Environment variables in
+// destination are expanded, as they are in the templates' destinations. An
+// error is returned if no template has the destination, or if the Server has
+// a custom Renderer, whose dependencies aren't known.
+func (ts *Server) Dependencies(destination string) ([]string, error) {
+	if destination == "" {
+		return nil, errors.New("template server: destination is empty")
+	}
+	destination, err := osutil.ExpandEnv(destination)
+	if err != nil {
+		return nil, fmt.Errorf("template server: could not expand destination: %w", err)
+	}
+
+	var deps []string
+	err = ts.updates.send(&templateUpdate{
+		inspect: func(runner *manager.Runner, templates []*ctconfig.TemplateConfig) error {
+			if !slices.ContainsFunc(templates, func(tmpl *ctconfig.TemplateConfig) bool {
+				return ctconfig.StringVal(tmpl.Destination) == destination
+			}) {
+				return fmt.Errorf("template server: destination %q is not managed", destination)
+			}
+			if runner == nil {
+				return errors.New("template server: dependencies aren't known with a custom renderer")
+			}
+
+			seen := make(map[string]struct{})
+			for _, event := range runner.RenderEvents() {
+				if event.UsedDeps == nil || !slices.ContainsFunc(event.TemplateConfigs, func(tmpl *ctconfig.TemplateConfig) bool {
+					return ctconfig.StringVal(tmpl.Destination) == destination
+				}) {
+					continue
+				}
+				for _, dep := range event.UsedDeps.List() {
+					seen[dep.String()] = struct{}{}
+				}
+			}
+			deps = make([]string, 0, len(seen))
+			for dep := range seen {
+				deps = append(deps, dep)
+			}
+			slices.Sort(deps)
+			return nil
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	return deps, nil
+}
+
+// apply returns a copy of templates with the update applied, along with the
+// template removed by it, if any.
+func (u *templateUpdate) apply(templates []*ctconfig.TemplateConfig) ([]*ctconfig.TemplateConfig, *ctconfig.TemplateConfig, error) {
+	updated := make([]*ctconfig.TemplateConfig, 0, len(templates)+1)
+	var removed *ctconfig.TemplateConfig
+	for _, tmpl := range templates {
+		dest := ctconfig.StringVal(tmpl.Destination)
+		if u.add != nil && dest == ctconfig.StringVal(u.add.Destination) {
+			return nil, nil, fmt.Errorf("template server: destination %q is already managed", dest)
+		}
+		if u.add == nil && dest == u.remove {
+			removed = tmpl
+			continue
+		}
+		updated = append(updated, tmpl)
+	}
+
+	if u.add != nil {
+		return append(updated, u.add), nil, nil
+	}
+	if removed == nil {
+		return nil, nil, fmt.Errorf("template server: destination %q is not managed", u.remove)
+	}
+	return updated, removed, nil
+}
+
+// deleteDestination deletes the destination of a removed template, if the
+// Server is configured to.
+func (ts *Server) deleteDestination(removed *ctconfig.TemplateConfig) error {
+	if removed == nil || !ts.config.DeleteRemovedDestinations {
+		return nil
+	}
+	dest := ctconfig.StringVal(removed.Destination)
+	if err := os.Remove(dest); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("template server: template removed, but failed to delete %s: %w", dest, err)
+	}
+	return nil
+}
@@ -0,0 +1,66 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: BUSL-1.1
+
+package template
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"path/filepath"
+
+	ctconfig "github.com/hashicorp/consul-template/config"
+	"github.com/hashicorp/go-multierror"
+)
+
+// checkEphemeralDestinations returns an error naming every template whose
+// destination isn't on an in-memory filesystem, if RequireEphemeralDest is
+// set, so that rendered secrets are never written to persistent storage.
+func (ts *Server) checkEphemeralDestinations(templates []*ctconfig.TemplateConfig) error {
+	if !ts.config.RequireEphemeralDest {
+		return nil
+	}
+
+	var errs *multierror.Error
+	for _, tmpl := range templates {
+		dest := ctconfig.StringVal(tmpl.Destination)
+		if dest == "" {
+			continue
+		}
+		if err := checkEphemeralPath(dest); err != nil {
+			errs = multierror.Append(errs, fmt.Errorf("destination %q: %w", dest, err))
+		}
+	}
+	if errs != nil {
+		return fmt.Errorf("ephemeral destinations are required: %w", errs)
+	}
+	return nil
+}
+
+// checkEphemeralPath returns an error if path, or the closest of its parent
+// directories which exists if it doesn't yet, isn't on an in-memory
+// filesystem. Symlinks are followed, as they are when writing it.
+func checkEphemeralPath(path string) error {
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return err
+	}
+	for {
+		ephemeral, fsType, err := isEphemeralFS(path)
+		if errors.Is(err, fs.ErrNotExist) {
+			parent := filepath.Dir(path)
+			if parent == path {
+				return err
+			}
+			path = parent
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if !ephemeral {
+			return fmt.Errorf("%s is on a %s filesystem, not tmpfs or ramfs", path, fsType)
+		}
+		return nil
+	}
+}
@@ -0,0 +1,31 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: BUSL-1.1
+
+//go:build linux
+
+package template
+
+import (
+	"fmt"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// isEphemeralFS returns whether path is on a tmpfs or ramfs mount, along with
+// the type of its filesystem.
+func isEphemeralFS(path string) (bool, string, error) {
+	var stat unix.Statfs_t
+	if err := unix.Statfs(path, &stat); err != nil {
+		return false, "", &os.PathError{Op: "statfs", Path: path, Err: err}
+	}
+	// The type is signed on some architectures
+	switch uint32(stat.Type) {
+	case unix.TMPFS_MAGIC:
+		return true, "tmpfs", nil
+	case unix.RAMFS_MAGIC:
+		return true, "ramfs", nil
+	default:
+		return false, fmt.Sprintf("0x%x", uint32(stat.Type)), nil
+	}
+}
@@ -0,0 +1,75 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: BUSL-1.1
+
+//go:build linux
+
+package template
+
+import (
+	"context"
+	"path/filepath"
+	sync "sync/atomic"
+	"testing"
+
+	ctconfig "github.com/hashicorp/consul-template/config"
+	"github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/vault/command/agent/config"
+	"github.com/hashicorp/vault/sdk/helper/logging"
+	"github.com/hashicorp/vault/sdk/helper/pointerutil"
+	"github.com/stretchr/testify/require"
+)
+
+// tmpfsDir returns a directory on a tmpfs mount, skipping the test if there
+// isn't one.
+func tmpfsDir(t *testing.T) string {
+	t.Helper()
+	ephemeral, _, err := isEphemeralFS("/dev/shm")
+	if err != nil || !ephemeral {
+		t.Skip("/dev/shm is not a tmpfs mount")
+	}
+	return filepath.Join("/dev/shm", t.Name())
+}
+
+// persistentDir returns a directory which isn't on an in-memory filesystem,
+// skipping the test if there isn't one.
+func persistentDir(t *testing.T) string {
+	t.Helper()
+	for _, dir := range []string{t.TempDir(), "/"} {
+		if ephemeral, _, err := isEphemeralFS(dir); err == nil && !ephemeral {
+			return dir
+		}
+	}
+	t.Skip("no persistent filesystem found")
+	return ""
+}
+
+func TestCheckEphemeralPath(t *testing.T) {
+	// Destinations which don't exist yet are checked by their parents
+	require.NoError(t, checkEphemeralPath(filepath.Join(tmpfsDir(t), "missing", "render")))
+	require.ErrorContains(t, checkEphemeralPath(filepath.Join(persistentDir(t), "render")), "not tmpfs or ramfs")
+}
+
+// TestServerRun_RequireEphemeralDest tests that Run refuses to start if a
+// destination isn't on an in-memory filesystem.
+func TestServerRun_RequireEphemeralDest(t *testing.T) {
+	persistent := filepath.Join(persistentDir(t), "render_01")
+	server := NewServer(&ServerConfig{
+		Logger:               logging.NewVaultLogger(hclog.Trace),
+		AgentConfig:          &config.Config{Vault: &config.Vault{}},
+		RequireEphemeralDest: true,
+	})
+	templatesToRender := []*ctconfig.TemplateConfig{
+		{
+			Contents:    pointerutil.StringPtr(templateContents),
+			Destination: pointerutil.StringPtr(filepath.Join(tmpfsDir(t), "render_01")),
+		},
+		{
+			Contents:    pointerutil.StringPtr(templateContents),
+			Destination: pointerutil.StringPtr(persistent),
+		},
+	}
+	err := server.Run(context.Background(), make(chan string), templatesToRender, &sync.Bool{}, make(chan error, 1))
+	require.ErrorContains(t, err, "ephemeral destinations are required")
+	require.ErrorContains(t, err, persistent)
+	require.NotContains(t, err.Error(), "/dev/shm")
+}
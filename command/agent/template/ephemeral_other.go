@@ -0,0 +1,17 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: BUSL-1.1
+
+//go:build !linux
+
+package template
+
+import (
+	"errors"
+	"runtime"
+)
+
+// isEphemeralFS always returns an error, as the filesystem of a path can only
+// be checked on linux.
+func isEphemeralFS(string) (bool, string, error) {
+	return false, "", errors.New("ephemeral destinations can only be checked on linux, not " + runtime.GOOS)
+}
@@ -0,0 +1,128 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: BUSL-1.1
+
+package template
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/hashicorp/vault/api"
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+// ErrorCategory is a class of error returned by Vault while rendering
+// templates.
+type ErrorCategory string
+
+const (
+	// ErrorCategoryInvalidToken is a 403 caused by the token being invalid,
+	// e.g. because it has expired or been revoked.
+	ErrorCategoryInvalidToken ErrorCategory = "invalid-token"
+	// ErrorCategoryPermissionDenied is any other 403, i.e. the token is valid
+	// but its policies don't allow the request.
+	ErrorCategoryPermissionDenied ErrorCategory = "permission-denied"
+	// ErrorCategoryNotFound is a 404.
+	ErrorCategoryNotFound ErrorCategory = "not-found"
+	// ErrorCategoryMissingKey is a template referencing a key missing from a
+	// secret, with error_on_missing_key set. A new token won't add the key,
+	// so these errors are always retried.
+	ErrorCategoryMissingKey ErrorCategory = "missing-key"
+	// ErrorCategoryOther is any other error.
+	ErrorCategoryOther ErrorCategory = "other"
+)
+
+// ErrorAction is the action the Server takes in response to an error.
+type ErrorAction string
+
+const (
+	// ErrorActionIgnore takes no action, leaving the template runner to
+	// retry the request without logging the error.
+	ErrorActionIgnore ErrorAction = "ignore"
+	// ErrorActionRetry logs the error and leaves the template runner to
+	// retry the request.
+	ErrorActionRetry ErrorAction = "retry"
+	// ErrorActionReauth asks the auth handler to re-authenticate, as it
+	// would for an invalid token.
+	ErrorActionReauth ErrorAction = "reauth"
+	// ErrorActionFail stops the template server, returning the error.
+	ErrorActionFail ErrorAction = "fail"
+)
+
+// ErrorPolicy maps categories of errors returned by Vault while rendering
+// templates to the action the Server takes in response. A zero value field
+// uses the action from DefaultErrorPolicy.
+type ErrorPolicy struct {
+	InvalidToken     ErrorAction
+	PermissionDenied ErrorAction
+	NotFound         ErrorAction
+	Other            ErrorAction
+}
+
+// DefaultErrorPolicy returns the policy used when none is configured. Only
+// invalid tokens trigger re-authentication; other errors are retried by the
+// template runner.
+func DefaultErrorPolicy() *ErrorPolicy {
+	return &ErrorPolicy{
+		InvalidToken:     ErrorActionReauth,
+		PermissionDenied: ErrorActionRetry,
+		NotFound:         ErrorActionRetry,
+		Other:            ErrorActionRetry,
+	}
+}
+
+// Action returns the action to take for an error of the given category.
+func (p *ErrorPolicy) Action(category ErrorCategory) ErrorAction {
+	if p == nil {
+		p = DefaultErrorPolicy()
+	}
+
+	var action ErrorAction
+	switch category {
+	case ErrorCategoryMissingKey:
+		return ErrorActionRetry
+	case ErrorCategoryInvalidToken:
+		action = p.InvalidToken
+	case ErrorCategoryPermissionDenied:
+		action = p.PermissionDenied
+	case ErrorCategoryNotFound:
+		action = p.NotFound
+	default:
+		action = p.Other
+	}
+
+	if action == "" {
+		return DefaultErrorPolicy().Action(category)
+	}
+	return action
+}
+
+// missingKeyError is the message of the error returned by text/template for a
+// missing key when error_on_missing_key is set.
+const missingKeyError = "map has no entry for key"
+
+// ClassifyError returns the category of an error returned by Vault, or by
+// rendering a template.
+func ClassifyError(err error) ErrorCategory {
+	if err != nil && strings.Contains(err.Error(), missingKeyError) {
+		return ErrorCategoryMissingKey
+	}
+
+	var responseError *api.ResponseError
+	if !errors.As(err, &responseError) {
+		return ErrorCategoryOther
+	}
+
+	switch responseError.StatusCode {
+	case http.StatusForbidden:
+		if strings.Contains(responseError.Error(), logical.ErrInvalidToken.Error()) {
+			return ErrorCategoryInvalidToken
+		}
+		return ErrorCategoryPermissionDenied
+	case http.StatusNotFound:
+		return ErrorCategoryNotFound
+	default:
+		return ErrorCategoryOther
+	}
+}
@@ -0,0 +1,359 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: BUSL-1.1
+
+package template
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+
+	ctconfig "github.com/hashicorp/consul-template/config"
+	"github.com/hashicorp/consul-template/renderer"
+)
+
+// ChecksumSidecarExt is the extension added to a template's destination to
+// give the path of its checksum file, written with WriteChecksumSidecar.
+const ChecksumSidecarExt = ".sha256"
+
+// ErrRenderTooLarge is returned, wrapped, when a template's rendered contents
+// exceed MaxRenderBytes.
+var ErrRenderTooLarge = errors.New("rendered contents exceed the maximum render size")
+
+// renderFile writes rendered templates to disk for both the consul-template
+// runner and custom Renderers. It behaves like consul-template's
+// renderer.Render, except that the file's owner is set on the temporary file
+// before it's renamed into place, so the destination never appears with the
+// agent's own ownership, and a failure to set it is reported clearly. Failed
+// writes are retried as configured with WriteRetry, and contents larger than
+// MaxRenderBytes aren't written at all. Retries stop once ctx is done.
+func (ts *Server) renderFile(ctx context.Context, i *renderer.RenderInput) (*renderer.RenderResult, error) {
+	if err := ts.checkRenderSize(i); err != nil {
+		return nil, err
+	}
+	if i.Dry {
+		return renderer.Render(i)
+	}
+
+	uid, err := lookupUser(i.User)
+	if err != nil {
+		return nil, fmt.Errorf("failed looking up user: %w", err)
+	}
+	gid, err := lookupGroup(i.Group)
+	if err != nil {
+		return nil, fmt.Errorf("failed looking up group: %w", err)
+	}
+
+	return ts.retryWrite(ctx, i.Path, func() (*renderer.RenderResult, error) {
+		return ts.writeFile(i, uid, gid)
+	})
+}
+
+// rendererFunc returns renderFile as the consul-template runner's renderer,
+// with writes retried until ctx is done.
+func (ts *Server) rendererFunc(ctx context.Context) renderer.Renderer {
+	return func(i *renderer.RenderInput) (*renderer.RenderResult, error) {
+		return ts.renderFile(ctx, i)
+	}
+}
+
+// checkRenderSize returns an error wrapping ErrRenderTooLarge, and emits a
+// RenderTooLarge event, if the rendered contents exceed MaxRenderBytes.
+func (ts *Server) checkRenderSize(i *renderer.RenderInput) error {
+	limit := ts.config.MaxRenderBytes
+	if limit <= 0 || int64(len(i.Contents)) <= limit {
+		return nil
+	}
+	err := fmt.Errorf("%w: %s rendered %d bytes, the limit is %d", ErrRenderTooLarge, i.Path, len(i.Contents), limit)
+	ts.emitEvent(TemplateEvent{
+		Type:        RenderTooLarge,
+		Destination: i.Path,
+		Error:       err,
+	})
+	return err
+}
+
+// writeFile writes the rendered contents to the destination, unless it's
+// already up to date, with the configured permissions and owner, followed by
+// the checksum and signature files.
+func (ts *Server) writeFile(i *renderer.RenderInput, uid, gid int) (*renderer.RenderResult, error) {
+	existing, err := os.ReadFile(i.Path)
+	fileExists := err == nil
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, fmt.Errorf("failed reading file: %w", err)
+	}
+
+	if fileExists && bytes.Equal(existing, i.Contents) && !ts.chownNeeded(i.Path, uid, gid) && !chmodNeeded(i.Path, i.Perms) {
+		if err := ts.writeChecksum(i, uid, gid); err != nil {
+			return nil, fmt.Errorf("failed writing checksum file: %w", err)
+		}
+		if err := ts.writeSignature(i, uid, gid); err != nil {
+			return nil, fmt.Errorf("failed writing signature file: %w", err)
+		}
+		return &renderer.RenderResult{
+			DidRender:   false,
+			WouldRender: true,
+			Contents:    existing,
+		}, nil
+	}
+
+	if err := ts.atomicWrite(i, uid, gid); err != nil {
+		return nil, fmt.Errorf("failed writing file: %w", err)
+	}
+	if !fileExists || !bytes.Equal(existing, i.Contents) {
+		added, removed := countChangedLines(existing, i.Contents)
+		ts.emitEvent(TemplateEvent{
+			Type:         RenderChanged,
+			Destination:  i.Path,
+			Created:      !fileExists,
+			LinesAdded:   added,
+			LinesRemoved: removed,
+		})
+	}
+	if err := ts.writeChecksum(i, uid, gid); err != nil {
+		return nil, fmt.Errorf("failed writing checksum file: %w", err)
+	}
+	if err := ts.writeSignature(i, uid, gid); err != nil {
+		return nil, fmt.Errorf("failed writing signature file: %w", err)
+	}
+
+	return &renderer.RenderResult{
+		DidRender:   true,
+		WouldRender: true,
+		Contents:    i.Contents,
+	}, nil
+}
+
+// countChangedLines returns the number of lines in updated which aren't in
+// previous, and the number in previous which aren't in updated, treating
+// each as a multiset of lines, so that it's cheap for large files.
+func countChangedLines(previous, updated []byte) (added, removed int) {
+	counts := make(map[string]int)
+	for _, line := range splitLines(previous) {
+		counts[string(line)]++
+	}
+	for _, line := range splitLines(updated) {
+		if counts[string(line)] > 0 {
+			counts[string(line)]--
+			continue
+		}
+		added++
+	}
+	for _, n := range counts {
+		removed += n
+	}
+	return added, removed
+}
+
+// splitLines splits b into lines, without a trailing empty line if b ends
+// with a newline.
+func splitLines(b []byte) [][]byte {
+	if len(b) == 0 {
+		return nil
+	}
+	return bytes.Split(bytes.TrimSuffix(b, []byte("\n")), []byte("\n"))
+}
+
+// chownNeeded returns whether the file at path isn't owned by uid and gid,
+// where -1 means either doesn't matter.
+func (ts *Server) chownNeeded(path string, uid, gid int) bool {
+	if uid == -1 && gid == -1 {
+		return false
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return true
+	}
+	currUID, currGID, ok := fileOwner(info)
+	if !ok {
+		return false
+	}
+	return (uid != -1 && uid != currUID) || (gid != -1 && gid != currGID)
+}
+
+// chmodNeeded returns whether the file at path doesn't have the permissions
+// perms, where 0 means they don't matter.
+func chmodNeeded(path string, perms os.FileMode) bool {
+	if perms == 0 {
+		return false
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return true
+	}
+	return !fileModeMatches(info, perms)
+}
+
+// atomicWrite writes the contents to a temporary file alongside the
+// destination, sets its permissions and ownership, and renames it into place.
+func (ts *Server) atomicWrite(i *renderer.RenderInput, uid, gid int) error {
+	if i.Path == "" {
+		return renderer.ErrMissingDest
+	}
+
+	parent := filepath.Dir(i.Path)
+	if _, err := os.Stat(parent); errors.Is(err, fs.ErrNotExist) {
+		if !i.CreateDestDirs {
+			return renderer.ErrNoParentDir
+		}
+		if err := os.MkdirAll(parent, 0o755); err != nil {
+			return err
+		}
+	}
+
+	// The temporary file is created readable only by the agent, so the
+	// contents aren't exposed before its permissions are set, which may then
+	// relax them
+	f, err := os.CreateTemp(parent, "")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	if _, err := f.Write(i.Contents); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	// Inherit the permissions and ownership of an existing file, unless
+	// they're configured
+	perms := i.Perms
+	ownerUID, ownerGID := -1, -1
+	if info, err := os.Stat(i.Path); err == nil {
+		if perms == 0 {
+			perms = info.Mode()
+		}
+		if currUID, currGID, ok := fileOwner(info); ok {
+			ownerUID, ownerGID = currUID, currGID
+		}
+	} else if !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	if perms == 0 {
+		perms = renderer.DefaultFilePerms
+	}
+	if err := os.Chmod(f.Name(), perms); err != nil {
+		return err
+	}
+
+	if uid != -1 {
+		ownerUID = uid
+	}
+	if gid != -1 {
+		ownerGID = gid
+	}
+	if err := chownFile(f.Name(), ownerUID, ownerGID); err != nil {
+		switch {
+		case uid == -1 && gid == -1:
+			ts.logger.Warn("could not preserve owner of rendered file", "destination", i.Path, "error", err)
+		case errors.Is(err, errOwnershipUnsupported):
+			ts.logger.Warn("ignoring configured owner of rendered file", "destination", i.Path, "error", err)
+		case errors.Is(err, fs.ErrPermission):
+			return fmt.Errorf("could not set owner of %s to uid %d and gid %d, as the agent isn't running with the privileges needed to change file ownership: %w", i.Path, uid, gid, err)
+		default:
+			return fmt.Errorf("could not set owner of %s to uid %d and gid %d: %w", i.Path, uid, gid, err)
+		}
+	}
+
+	// Keep a copy of the current file. os.Link preserves its mode.
+	if i.Backup {
+		bak, old := i.Path+".bak", i.Path+".old.bak"
+		os.Rename(bak, old) // ignore error
+		if err := os.Link(i.Path, bak); err != nil {
+			ts.logger.Warn("could not back up rendered file", "destination", i.Path, "error", err)
+		} else {
+			os.Remove(old) // ignore error
+		}
+	}
+
+	return os.Rename(f.Name(), i.Path)
+}
+
+// writeChecksum writes the hex SHA-256 digest of the rendered contents to a
+// file alongside the destination, with the ".sha256" extension, if the Server
+// is configured to. It's written after the destination, and only when the
+// digest has changed, so that consumers can watch it to tell when the
+// contents really changed. It's given the destination's permissions and
+// ownership.
+func (ts *Server) writeChecksum(i *renderer.RenderInput, uid, gid int) error {
+	if !ts.config.WriteChecksumSidecar {
+		return nil
+	}
+
+	sum := sha256.Sum256(i.Contents)
+	digest := []byte(hex.EncodeToString(sum[:]))
+	path := i.Path + ChecksumSidecarExt
+	perms := i.Perms
+	if info, err := os.Stat(i.Path); err == nil {
+		perms = info.Mode()
+	}
+	if existing, err := os.ReadFile(path); err == nil && bytes.Equal(existing, digest) && !ts.chownNeeded(path, uid, gid) && !chmodNeeded(path, perms) {
+		return nil
+	}
+	return ts.atomicWrite(&renderer.RenderInput{
+		Contents: digest,
+		Path:     path,
+		Perms:    perms,
+		User:     i.User,
+		Group:    i.Group,
+	}, uid, gid)
+}
+
+// lookupUser returns the uid of the user given by name or id, or -1 if none
+// is given.
+func lookupUser(s string) (int, error) {
+	if s == "" {
+		return -1, nil
+	}
+	if id, err := strconv.Atoi(s); err == nil {
+		return id, nil
+	}
+	u, err := user.Lookup(s)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(u.Uid)
+}
+
+// lookupGroup returns the gid of the group given by name or id, or -1 if
+// none is given.
+func lookupGroup(s string) (int, error) {
+	if s == "" {
+		return -1, nil
+	}
+	if id, err := strconv.Atoi(s); err == nil {
+		return id, nil
+	}
+	g, err := user.LookupGroup(s)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(g.Gid)
+}
+
+// normalizeOwner sets the template's user and group from the uid and gid
+// kept for compatibility, as consul-template does when finalizing its
+// configuration, so that they're honored by custom Renderers too.
+func normalizeOwner(tmpl *ctconfig.TemplateConfig) {
+	if tmpl.User == nil && tmpl.Uid != nil {
+		tmpl.User = ctconfig.String(strconv.Itoa(*tmpl.Uid))
+	}
+	if tmpl.Group == nil && tmpl.Gid != nil {
+		tmpl.Group = ctconfig.String(strconv.Itoa(*tmpl.Gid))
+	}
+}
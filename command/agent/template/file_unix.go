@@ -0,0 +1,40 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: BUSL-1.1
+
+//go:build !windows
+
+package template
+
+import (
+	"errors"
+	"os"
+	"syscall"
+)
+
+// errOwnershipUnsupported is returned by chownFile on platforms without file
+// ownership.
+var errOwnershipUnsupported = errors.New("setting file ownership is not supported on this platform")
+
+// fileOwner returns the uid and gid of the file described by info.
+func fileOwner(info os.FileInfo) (int, int, bool) {
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return -1, -1, false
+	}
+	return int(stat.Uid), int(stat.Gid), true
+}
+
+// chownFile sets the owner of the file at path, leaving the uid or gid
+// unchanged if it's -1.
+func chownFile(path string, uid, gid int) error {
+	if uid == -1 && gid == -1 {
+		return nil
+	}
+	return os.Chown(path, uid, gid)
+}
+
+// fileModeMatches returns whether the file described by info has the
+// permissions perms.
+func fileModeMatches(info os.FileInfo, perms os.FileMode) bool {
+	return info.Mode().Perm() == perms.Perm()
+}
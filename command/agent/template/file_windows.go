@@ -0,0 +1,32 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: BUSL-1.1
+
+//go:build windows
+
+package template
+
+import (
+	"errors"
+	"os"
+)
+
+// errOwnershipUnsupported is returned by chownFile on platforms without file
+// ownership.
+var errOwnershipUnsupported = errors.New("setting file ownership is not supported on windows")
+
+func fileOwner(os.FileInfo) (int, int, bool) {
+	return -1, -1, false
+}
+
+func chownFile(_ string, uid, gid int) error {
+	if uid == -1 && gid == -1 {
+		return nil
+	}
+	return errOwnershipUnsupported
+}
+
+// fileModeMatches reports every file as matching, as os.Chmod only sets
+// whether a file is read-only on windows, so modes can't be compared.
+func fileModeMatches(os.FileInfo, os.FileMode) bool {
+	return true
+}
@@ -0,0 +1,92 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: BUSL-1.1
+
+package template
+
+import (
+	"fmt"
+	"maps"
+	"reflect"
+	"strings"
+	texttemplate "text/template"
+	"unicode"
+
+	ctconfig "github.com/hashicorp/consul-template/config"
+	cttemplate "github.com/hashicorp/consul-template/template"
+)
+
+// textTemplateBuiltins are the functions predefined by text/template, which
+// would be shadowed by template functions with the same name.
+var textTemplateBuiltins = []string{
+	"and", "call", "html", "index", "slice", "js", "len", "not", "or",
+	"print", "printf", "println", "urlquery",
+	"eq", "ge", "gt", "le", "lt", "ne",
+}
+
+// validateTemplateFuncs checks that the functions can be added to the
+// templates' function map, without replacing any of the built-in functions.
+func validateTemplateFuncs(funcs texttemplate.FuncMap) error {
+	for name, fn := range funcs {
+		if !validFuncName(name) {
+			return fmt.Errorf("template function name %q is not a valid identifier", name)
+		}
+		if fn == nil || reflect.TypeOf(fn).Kind() != reflect.Func {
+			return fmt.Errorf("template function %q is not a function", name)
+		}
+		for _, builtin := range textTemplateBuiltins {
+			if name == builtin {
+				return fmt.Errorf("template function %q conflicts with a built-in function", name)
+			}
+		}
+		if isConsulTemplateFunc(name) {
+			return fmt.Errorf("template function %q conflicts with a built-in function", name)
+		}
+	}
+	return nil
+}
+
+// validFuncName returns whether name can be used as a function name, using
+// the same rules as text/template.
+func validFuncName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for i, r := range name {
+		switch {
+		case r == '_':
+		case i == 0 && !unicode.IsLetter(r):
+			return false
+		case !unicode.IsLetter(r) && !unicode.IsDigit(r):
+			return false
+		}
+	}
+	return true
+}
+
+// isConsulTemplateFunc returns whether name is one of the functions that
+// consul-template adds to every template. Its function map isn't exported,
+// but functions in it are replaced by one that errors when denylisted, so
+// this checks for that error when calling name with it denylisted.
+func isConsulTemplateFunc(name string) bool {
+	tmpl, err := cttemplate.NewTemplate(&cttemplate.NewTemplateInput{
+		Contents:         fmt.Sprintf("{{ %s }}", name),
+		FunctionDenylist: []string{name},
+	})
+	if err != nil {
+		return false
+	}
+	_, err = tmpl.Execute(nil)
+	return err != nil && strings.Contains(err.Error(), "function is disabled")
+}
+
+// addTemplateFuncs adds the functions to the template's function map. The
+// template's own functions take precedence.
+func addTemplateFuncs(tmpl *ctconfig.TemplateConfig, funcs texttemplate.FuncMap) {
+	if len(funcs) == 0 {
+		return
+	}
+	merged := make(texttemplate.FuncMap, len(funcs)+len(tmpl.ExtFuncMap))
+	maps.Copy(merged, funcs)
+	maps.Copy(merged, tmpl.ExtFuncMap)
+	tmpl.ExtFuncMap = merged
+}
@@ -0,0 +1,60 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: BUSL-1.1
+
+package template
+
+import (
+	"context"
+	"time"
+)
+
+// tokenCheck is the result of checking whether the token an invalid token
+// error was received with is really invalid.
+type tokenCheck struct {
+	token string
+	// err is the invalid token error, or nil if the token was found to be
+	// valid
+	err error
+}
+
+// checkToken looks up token until it's found to be valid, or the
+// InvalidTokenGrace elapses, in which case err, the invalid token error that
+// triggered the check, is returned. Otherwise it returns nil, so that errors
+// which don't mean the token is invalid, such as those seen while a Vault
+// cluster elects a new leader, don't trigger re-authentication.
+func (ts *Server) checkToken(ctx context.Context, token string, err error) error {
+	grace := ts.config.InvalidTokenGrace
+	client, cloneErr := ts.config.Client.CloneWithHeaders()
+	if cloneErr != nil {
+		ts.logger.Warn("template server: failed to create client to check token", "error", cloneErr)
+		return err
+	}
+	client.SetToken(token)
+	if ts.config.Namespace != "" {
+		client.SetNamespace(ts.config.Namespace)
+	}
+
+	ts.logger.Debug("template server: checking token before re-authenticating", "grace", grace)
+	deadline := time.Now().Add(grace)
+	timer := time.NewTimer(min(grace, time.Second))
+	defer timer.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return err
+		case <-timer.C:
+		}
+
+		_, lookupErr := client.Auth().Token().LookupSelfWithContext(ctx)
+		if lookupErr == nil {
+			return nil
+		}
+		ts.logger.Debug("template server: token lookup failed", "error", lookupErr)
+
+		remaining := time.Until(deadline)
+		if remaining <= 0 {
+			return err
+		}
+		timer.Reset(min(remaining, time.Second))
+	}
+}
@@ -0,0 +1,134 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: BUSL-1.1
+
+package template
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	ctconfig "github.com/hashicorp/consul-template/config"
+)
+
+// DefaultSecretLeaseExpiringThreshold is the default fraction of a secret's
+// lease duration after which OnSecretLeaseExpiring is called.
+const DefaultSecretLeaseExpiringThreshold = 0.9
+
+// SecretLease describes the lease of a secret read to render a template.
+type SecretLease struct {
+	// Destination is the destination of the template which read the secret.
+	// It's set by the Server.
+	Destination string
+
+	// Path is the path the secret was read from.
+	Path string
+
+	LeaseID       string
+	LeaseDuration time.Duration
+	Renewable     bool
+
+	// ExpiresAt is when the lease expires, counted from when the template
+	// was rendered. It's set by the Server.
+	ExpiresAt time.Time
+}
+
+// LeaseRenderer is implemented by Renderers which report the leases of the
+// secrets read to render each template, so that the Server can call
+// OnSecretLeaseExpiring before they expire.
+type LeaseRenderer interface {
+	Renderer
+	RenderWithLeases(ctx context.Context, template *ctconfig.TemplateConfig, token string) ([]byte, []*SecretLease, error)
+}
+
+// leaseTimers holds the timers which call OnSecretLeaseExpiring for the
+// leases of each template, by destination.
+type leaseTimers struct {
+	l      sync.Mutex
+	timers map[string][]*time.Timer
+}
+
+// validateLeaseExpiring returns an error if the configured
+// SecretLeaseExpiringThreshold isn't a fraction of the lease duration, or if
+// OnSecretLeaseExpiring is set without a Renderer which reports leases, as it
+// would never be called.
+func (ts *Server) validateLeaseExpiring() error {
+	if t := ts.config.SecretLeaseExpiringThreshold; t < 0 || t >= 1 {
+		return errors.New("secret lease expiring threshold must be at least 0 and less than 1")
+	}
+	if ts.config.OnSecretLeaseExpiring == nil {
+		return nil
+	}
+	if _, ok := ts.config.Renderer.(LeaseRenderer); !ok {
+		return errors.New("secret lease expiring callback requires a custom renderer which implements LeaseRenderer")
+	}
+	return nil
+}
+
+// render renders tmpl with the configured Renderer, returning the leases of
+// the secrets it read if the Renderer reports them.
+func (ts *Server) render(ctx context.Context, tmpl *ctconfig.TemplateConfig, token string) ([]byte, []*SecretLease, error) {
+	if lr, ok := ts.config.Renderer.(LeaseRenderer); ok {
+		return lr.RenderWithLeases(ctx, tmpl, token)
+	}
+	contents, err := ts.config.Renderer.Render(ctx, tmpl, token)
+	return contents, nil, err
+}
+
+// watchLeases replaces the timers for the leases of the template with the
+// destination dest, so that OnSecretLeaseExpiring is called once the
+// threshold of each lease's duration has elapsed, unless the template is
+// rendered again first. It does nothing if OnSecretLeaseExpiring isn't set.
+func (ts *Server) watchLeases(dest string, leases []*SecretLease) {
+	callback := ts.config.OnSecretLeaseExpiring
+	if callback == nil {
+		return
+	}
+	threshold := ts.config.SecretLeaseExpiringThreshold
+	if threshold == 0 {
+		threshold = DefaultSecretLeaseExpiringThreshold
+	}
+
+	ts.leaseTimers.l.Lock()
+	defer ts.leaseTimers.l.Unlock()
+	for _, timer := range ts.leaseTimers.timers[dest] {
+		timer.Stop()
+	}
+	delete(ts.leaseTimers.timers, dest)
+
+	now := time.Now()
+	for _, lease := range leases {
+		if lease == nil || lease.LeaseID == "" || lease.LeaseDuration <= 0 {
+			continue
+		}
+		expiring := *lease
+		expiring.Destination = dest
+		expiring.ExpiresAt = now.Add(lease.LeaseDuration)
+		wait := time.Duration(threshold * float64(lease.LeaseDuration))
+		timer := time.AfterFunc(wait, func() {
+			ts.logger.Debug("template server: secret lease expiring", "destination", dest, "path", expiring.Path, "expires_at", expiring.ExpiresAt)
+			callback(expiring)
+		})
+		if ts.leaseTimers.timers == nil {
+			ts.leaseTimers.timers = make(map[string][]*time.Timer)
+		}
+		ts.leaseTimers.timers[dest] = append(ts.leaseTimers.timers[dest], timer)
+	}
+}
+
+// stopLeaseTimers stops the timers for the leases of the template with the
+// destination dest, or if it's empty, of every template.
+func (ts *Server) stopLeaseTimers(dest string) {
+	ts.leaseTimers.l.Lock()
+	defer ts.leaseTimers.l.Unlock()
+	for d, timers := range ts.leaseTimers.timers {
+		if dest != "" && d != dest {
+			continue
+		}
+		for _, timer := range timers {
+			timer.Stop()
+		}
+		delete(ts.leaseTimers.timers, d)
+	}
+}
@@ -0,0 +1,251 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: BUSL-1.1
+
+package template
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	ctconfig "github.com/hashicorp/consul-template/config"
+	"github.com/hashicorp/vault/api"
+	"github.com/hashicorp/vault/command/agentproxyshared/hookcontext"
+)
+
+// leaseRenewFraction is the fraction of a lease's duration after which it's
+// renewed.
+const leaseRenewFraction = 2.0 / 3.0
+
+// leaseRenewals holds the leases being kept alive for the templates set to
+// RenewLease, by destination. A template holding leases isn't rendered again
+// on the static secret render interval, only once they can't be renewed.
+type leaseRenewals struct {
+	l sync.Mutex
+	// renew holds the destinations of the templates set to RenewLease
+	renew map[string]bool
+	held  map[string]*heldLeases
+
+	// expired receives the destinations of templates whose leases can no
+	// longer be renewed, until done is closed
+	expired chan string
+	done    chan struct{}
+}
+
+// heldLeases are the leases of the secrets read by one render of a template.
+type heldLeases struct {
+	leases []*SecretLease
+	timers []*time.Timer
+}
+
+// setRenewLease records whether the template prepared from tmpl, whose
+// destination is dest, is set to RenewLease.
+func (ts *Server) setRenewLease(tmpl *ctconfig.TemplateConfig, dest string) {
+	if !ts.config.RenewLease[tmpl] {
+		return
+	}
+	ts.leaseRenewals.l.Lock()
+	defer ts.leaseRenewals.l.Unlock()
+	if ts.leaseRenewals.renew == nil {
+		ts.leaseRenewals.renew = make(map[string]bool)
+	}
+	ts.leaseRenewals.renew[dest] = true
+}
+
+// startLeaseRenewals returns the channel receiving the destinations of
+// templates whose leases can no longer be renewed, which must be rendered
+// again, until stopLeaseRenewals is called.
+func (ts *Server) startLeaseRenewals() <-chan string {
+	ts.leaseRenewals.l.Lock()
+	defer ts.leaseRenewals.l.Unlock()
+	ts.leaseRenewals.expired = make(chan string)
+	ts.leaseRenewals.done = make(chan struct{})
+	return ts.leaseRenewals.expired
+}
+
+// stopLeaseRenewals stops renewing the leases of every template.
+func (ts *Server) stopLeaseRenewals() {
+	ts.leaseRenewals.l.Lock()
+	defer ts.leaseRenewals.l.Unlock()
+	for dest, held := range ts.leaseRenewals.held {
+		held.stop()
+		delete(ts.leaseRenewals.held, dest)
+	}
+	if ts.leaseRenewals.done != nil {
+		close(ts.leaseRenewals.done)
+		ts.leaseRenewals.done = nil
+	}
+}
+
+// releaseLeases stops renewing the leases of the template with the
+// destination dest, such as when it's removed.
+func (ts *Server) releaseLeases(dest string) {
+	ts.leaseRenewals.l.Lock()
+	defer ts.leaseRenewals.l.Unlock()
+	if held, ok := ts.leaseRenewals.held[dest]; ok {
+		held.stop()
+		delete(ts.leaseRenewals.held, dest)
+	}
+}
+
+// withoutHeldLeases returns the templates which aren't holding leases, and so
+// should be rendered on the static secret render interval.
+func (ts *Server) withoutHeldLeases(templates []*ctconfig.TemplateConfig) []*ctconfig.TemplateConfig {
+	ts.leaseRenewals.l.Lock()
+	defer ts.leaseRenewals.l.Unlock()
+	if len(ts.leaseRenewals.held) == 0 {
+		return templates
+	}
+	unheld := make([]*ctconfig.TemplateConfig, 0, len(templates))
+	for _, tmpl := range templates {
+		if _, ok := ts.leaseRenewals.held[ctconfig.StringVal(tmpl.Destination)]; !ok {
+			unheld = append(unheld, tmpl)
+		}
+	}
+	return unheld
+}
+
+// holdLeases starts renewing the renewable leases of the secrets read to
+// render the template with the destination dest, if it's set to RenewLease,
+// replacing those of its previous render. Leases are renewed with the client
+// in ctx once leaseRenewFraction of their duration has elapsed, for as long
+// as they were first issued for. Once one can't be renewed, or Vault renews
+// it for less time, as it's reached its max TTL, the template is rendered
+// again, issuing new secrets, before it expires.
+func (ts *Server) holdLeases(ctx context.Context, dest string, leases []*SecretLease) {
+	ts.leaseRenewals.l.Lock()
+	defer ts.leaseRenewals.l.Unlock()
+	if !ts.leaseRenewals.renew[dest] || ts.leaseRenewals.done == nil {
+		return
+	}
+	if held, ok := ts.leaseRenewals.held[dest]; ok {
+		held.stop()
+		delete(ts.leaseRenewals.held, dest)
+	}
+
+	client, ok := hookcontext.Client(ctx)
+	if !ok {
+		ts.logger.Warn("template server: no client to renew leases with, rendering on the static secret render interval", "destination", dest)
+		return
+	}
+
+	held := &heldLeases{}
+	now := time.Now()
+	for _, lease := range leases {
+		if lease == nil || lease.LeaseID == "" || lease.LeaseDuration <= 0 || !lease.Renewable {
+			continue
+		}
+		renewing := *lease
+		renewing.Destination = dest
+		renewing.ExpiresAt = now.Add(lease.LeaseDuration)
+		held.leases = append(held.leases, &renewing)
+	}
+	if len(held.leases) == 0 {
+		return
+	}
+	if ts.leaseRenewals.held == nil {
+		ts.leaseRenewals.held = make(map[string]*heldLeases)
+	}
+	ts.leaseRenewals.held[dest] = held
+	for _, lease := range held.leases {
+		ts.scheduleRenewal(ctx, client, held, lease, fractionOf(lease.LeaseDuration))
+	}
+	ts.logger.Debug("template server: renewing leases of template", "destination", dest, "leases", len(held.leases))
+}
+
+// scheduleRenewal renews lease after wait. It's called with the
+// leaseRenewals lock held.
+func (ts *Server) scheduleRenewal(ctx context.Context, client *api.Client, held *heldLeases, lease *SecretLease, wait time.Duration) {
+	held.timers = append(held.timers, time.AfterFunc(wait, func() {
+		ts.renewLease(ctx, client, held, lease)
+	}))
+}
+
+// renewLease renews lease, scheduling its next renewal, or once it can't be
+// renewed any further, the template being rendered again.
+func (ts *Server) renewLease(ctx context.Context, client *api.Client, held *heldLeases, lease *SecretLease) {
+	secret, err := client.Sys().RenewWithContext(ctx, lease.LeaseID, int(lease.LeaseDuration.Seconds()))
+	if ctx.Err() != nil {
+		return
+	}
+
+	ts.leaseRenewals.l.Lock()
+	if ts.leaseRenewals.held[lease.Destination] != held {
+		// The template has been rendered again, or removed
+		ts.leaseRenewals.l.Unlock()
+		return
+	}
+	switch {
+	case err != nil:
+		ts.logger.Warn("template server: error renewing lease, rendering template again", "destination", lease.Destination, "path", lease.Path, "error", err)
+		ts.leaseRenewals.l.Unlock()
+		ts.leasesExpired(held, lease.Destination)
+		return
+
+	case secret == nil || !secret.Renewable || time.Duration(secret.LeaseDuration)*time.Second < lease.LeaseDuration:
+		// This is the last renewal, so the template is rendered again before
+		// the lease expires
+		var duration time.Duration
+		if secret != nil {
+			duration = time.Duration(secret.LeaseDuration) * time.Second
+		}
+		ts.logger.Debug("template server: lease can't be renewed further, rendering template again before it expires", "destination", lease.Destination, "path", lease.Path, "ttl", duration)
+		lease.ExpiresAt = time.Now().Add(duration)
+		held.timers = append(held.timers, time.AfterFunc(fractionOf(duration), func() {
+			ts.leasesExpired(held, lease.Destination)
+		}))
+
+	default:
+		ts.logger.Debug("template server: renewed lease", "destination", lease.Destination, "path", lease.Path)
+		lease.ExpiresAt = time.Now().Add(time.Duration(secret.LeaseDuration) * time.Second)
+		ts.scheduleRenewal(ctx, client, held, lease, fractionOf(time.Duration(secret.LeaseDuration)*time.Second))
+	}
+	leases := held.remaining(time.Now())
+	ts.leaseRenewals.l.Unlock()
+
+	// The leases expire later than when the template was rendered
+	ts.watchLeases(lease.Destination, leases)
+}
+
+// leasesExpired stops renewing held, the leases of the template with the
+// destination dest, and passes dest to the run loop to render it again.
+func (ts *Server) leasesExpired(held *heldLeases, dest string) {
+	ts.leaseRenewals.l.Lock()
+	if ts.leaseRenewals.held[dest] != held {
+		ts.leaseRenewals.l.Unlock()
+		return
+	}
+	held.stop()
+	delete(ts.leaseRenewals.held, dest)
+	expired, done := ts.leaseRenewals.expired, ts.leaseRenewals.done
+	ts.leaseRenewals.l.Unlock()
+
+	select {
+	case expired <- dest:
+	case <-done:
+	}
+}
+
+// remaining returns copies of the leases with the time remaining until they
+// expire as their durations.
+func (h *heldLeases) remaining(now time.Time) []*SecretLease {
+	leases := make([]*SecretLease, 0, len(h.leases))
+	for _, lease := range h.leases {
+		l := *lease
+		l.LeaseDuration = lease.ExpiresAt.Sub(now)
+		leases = append(leases, &l)
+	}
+	return leases
+}
+
+func (h *heldLeases) stop() {
+	for _, timer := range h.timers {
+		timer.Stop()
+	}
+	h.timers = nil
+}
+
+// fractionOf returns leaseRenewFraction of d.
+func fractionOf(d time.Duration) time.Duration {
+	return time.Duration(leaseRenewFraction * float64(d))
+}
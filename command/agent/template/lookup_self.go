@@ -0,0 +1,87 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: BUSL-1.1
+
+package template
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+
+	ctconfig "github.com/hashicorp/consul-template/config"
+)
+
+// lookupSelfPath is the path tokens look themselves up with.
+const lookupSelfPath = "auth/token/lookup-self"
+
+// lookupSelfDisabled returns whether disable_lookup_self is set, for tokens
+// which intentionally can't look themselves up. The token isn't then checked
+// with lookup-self before re-authenticating, and templates being denied
+// lookup-self don't trigger re-authentication.
+func (ts *Server) lookupSelfDisabled() bool {
+	return ts.config.AgentConfig != nil && ts.config.AgentConfig.TemplateConfig != nil &&
+		ts.config.AgentConfig.TemplateConfig.DisableLookupSelf
+}
+
+// usesLookupSelf returns whether healing from invalid tokens relies on the
+// token being able to call lookup-self: to check it for the
+// InvalidTokenGrace, or because a template reads it, and so re-authenticates
+// if it's denied.
+func (ts *Server) usesLookupSelf(templates []*ctconfig.TemplateConfig) bool {
+	if ts.config.InvalidTokenGrace > 0 {
+		return true
+	}
+	for _, tmpl := range templates {
+		if strings.Contains(ctconfig.StringVal(tmpl.Contents), lookupSelfPath) {
+			return true
+		}
+		if source := ctconfig.StringVal(tmpl.Source); source != "" {
+			// Errors are left for rendering to report
+			if contents, err := os.ReadFile(source); err == nil && strings.Contains(string(contents), lookupSelfPath) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// checkLookupSelf returns an error if token isn't allowed lookup-self, when
+// it's needed to heal from invalid tokens and not disabled, so that the
+// token's missing capability is reported, rather than looking like the token
+// is invalid. The token's capabilities are checked, rather than calling
+// lookup-self, as an invalid token would be denied it too. Errors checking
+// them are only logged, as the token may not be allowed to check them either.
+func (ts *Server) checkLookupSelf(ctx context.Context, token string, templates []*ctconfig.TemplateConfig) error {
+	if ts.lookupSelfDisabled() || ts.config.Client == nil || !ts.usesLookupSelf(templates) {
+		return nil
+	}
+
+	client, err := ts.config.Client.CloneWithHeaders()
+	if err != nil {
+		return fmt.Errorf("error creating client to check lookup-self: %w", err)
+	}
+	client.SetToken(token)
+	if ts.config.Namespace != "" {
+		client.SetNamespace(ts.config.Namespace)
+	}
+
+	ts.logger.Debug("template server: checking token can call lookup-self")
+	capabilities, err := client.Sys().CapabilitiesSelfWithContext(ctx, lookupSelfPath)
+	if err != nil {
+		ts.logger.Warn("template server: unable to check token can call lookup-self", "error", err)
+		return nil
+	}
+	if !canRead(capabilities) {
+		return fmt.Errorf("the auto-auth token can't call %s, which is needed to recover from invalid tokens, its capabilities are [%s]; "+
+			"grant its policy read on %q, or set disable_lookup_self in template_config if it intentionally lacks that capability",
+			lookupSelfPath, strings.Join(capabilities, ", "), lookupSelfPath)
+	}
+	return nil
+}
+
+// isLookupSelfDenied returns whether err is a template being denied
+// lookup-self.
+func isLookupSelfDenied(err error) bool {
+	return ClassifyError(err) == ErrorCategoryPermissionDenied && strings.Contains(err.Error(), lookupSelfPath)
+}
@@ -0,0 +1,189 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: BUSL-1.1
+
+package template
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+
+	ctconfig "github.com/hashicorp/consul-template/config"
+	"github.com/hashicorp/go-multierror"
+)
+
+// namespaceGroup is the templates read from one namespace.
+type namespaceGroup struct {
+	namespace string
+	templates []*ctconfig.TemplateConfig
+}
+
+// namespaceGroups groups the templates by the namespace they read secrets
+// from, with those not in TemplateNamespaces in the Server's own Namespace,
+// in the order the namespaces first appear. It returns nil if every template
+// reads from the Server's own Namespace.
+func (ts *Server) namespaceGroups(templates []*ctconfig.TemplateConfig) []*namespaceGroup {
+	var groups []*namespaceGroup
+	byNamespace := make(map[string]*namespaceGroup)
+	for _, tmpl := range templates {
+		namespace, ok := ts.config.TemplateNamespaces[tmpl]
+		if !ok {
+			namespace = ts.config.Namespace
+		}
+		group, ok := byNamespace[namespace]
+		if !ok {
+			group = &namespaceGroup{namespace: namespace}
+			byNamespace[namespace] = group
+			groups = append(groups, group)
+		}
+		group.templates = append(group.templates, tmpl)
+	}
+	if len(groups) == 1 && groups[0].namespace == ts.config.Namespace {
+		return nil
+	}
+	return groups
+}
+
+// runNamespaced renders the templates of each namespace group with a Server of
+// its own, as the consul-template runner reads every secret from the one
+// namespace, and shares fetched secrets between templates by path. Each
+// token received is passed to all of them. It returns once they've all
+// returned, or with the first error, stopping the rest.
+func (ts *Server) runNamespaced(ctx context.Context, incoming chan string, groups []*namespaceGroup, tokenRenewalInProgress *atomic.Bool, invalidTokenCh chan error) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	ts.logger.Info("starting template servers for each namespace", "namespaces", len(groups))
+
+	servers := make([]*Server, 0, len(groups))
+	tokenChs := make([]chan string, 0, len(groups))
+	for _, group := range groups {
+		conf := *ts.config
+		conf.Logger = ts.config.Logger.With("namespace", group.namespace)
+		conf.Namespace = group.namespace
+		conf.TemplateNamespaces = nil
+		conf.CanaryTemplates = nil
+		if group.namespace != ts.config.Namespace {
+			// These are rendered, and checked, in the Server's own namespace
+			conf.CompositeTemplates = nil
+			conf.PreflightCapabilities = nil
+		}
+		servers = append(servers, NewServer(&conf))
+		tokenChs = append(tokenChs, make(chan string, 1))
+	}
+	if !containsNamespace(groups, ts.config.Namespace) && (len(ts.config.CompositeTemplates) > 0 || len(ts.config.PreflightCapabilities) > 0) {
+		conf := *ts.config
+		conf.TemplateNamespaces = nil
+		conf.CanaryTemplates = nil
+		servers = append(servers, NewServer(&conf))
+		tokenChs = append(tokenChs, make(chan string, 1))
+		groups = append(groups, &namespaceGroup{namespace: ts.config.Namespace})
+	}
+
+	var wg sync.WaitGroup
+	go ts.fanOutTokens(ctx, incoming, tokenChs)
+	go ts.awaitNamespacesReady(ctx, servers)
+	for _, s := range servers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ts.forwardEvents(ctx, s)
+		}()
+	}
+
+	errCh := make(chan error, len(servers))
+	for i, s := range servers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errCh <- s.Run(ctx, tokenChs[i], groups[i].templates, tokenRenewalInProgress, invalidTokenCh)
+		}()
+	}
+
+	var errs *multierror.Error
+	for range servers {
+		if err := <-errCh; err != nil {
+			errs = multierror.Append(errs, err)
+			cancel()
+		}
+	}
+	cancel()
+	wg.Wait()
+	if errs == nil && allReady(servers) {
+		// They may have become ready just before returning
+		ts.markReady()
+	}
+	return errs.ErrorOrNil()
+}
+
+func allReady(servers []*Server) bool {
+	for _, s := range servers {
+		if !s.ready.Load() {
+			return false
+		}
+	}
+	return true
+}
+
+func containsNamespace(groups []*namespaceGroup, namespace string) bool {
+	for _, group := range groups {
+		if group.namespace == namespace {
+			return true
+		}
+	}
+	return false
+}
+
+// fanOutTokens passes each token received on incoming to each of tokenChs,
+// replacing any token not yet taken, until ctx is done or incoming is closed,
+// which closes tokenChs.
+func (ts *Server) fanOutTokens(ctx context.Context, incoming chan string, tokenChs []chan string) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case token, ok := <-incoming:
+			if !ok {
+				for _, ch := range tokenChs {
+					close(ch)
+				}
+				return
+			}
+			ts.token.Store(token)
+			for _, ch := range tokenChs {
+				select {
+				case <-ch:
+				default:
+				}
+				ch <- token
+			}
+		}
+	}
+}
+
+// awaitNamespacesReady marks the Server ready once each of servers is.
+func (ts *Server) awaitNamespacesReady(ctx context.Context, servers []*Server) {
+	for _, s := range servers {
+		select {
+		case <-ctx.Done():
+			return
+		case <-s.ReadyCh:
+		}
+	}
+	ts.markReady()
+}
+
+// forwardEvents emits the events of s as the Server's own until ctx is done.
+func (ts *Server) forwardEvents(ctx context.Context, s *Server) {
+	if !ts.config.EnableEventCh {
+		return
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case event := <-s.EventCh:
+			ts.emitEvent(event)
+		}
+	}
+}
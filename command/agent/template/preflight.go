@@ -0,0 +1,72 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: BUSL-1.1
+
+package template
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	ctconfig "github.com/hashicorp/consul-template/config"
+	"github.com/hashicorp/go-multierror"
+)
+
+// validatePreflightCapabilities returns an error if PreflightCapabilities is
+// set without a Client to check them with.
+func (ts *Server) validatePreflightCapabilities() error {
+	if len(ts.config.PreflightCapabilities) > 0 && ts.config.Client == nil {
+		return errors.New("preflight capabilities require a client")
+	}
+	return nil
+}
+
+// preflight checks that token can read each of the PreflightCapabilities
+// paths, returning an error naming every path it can't, and that it can call
+// lookup-self if templates need it to. It's called with the first token,
+// before anything is rendered.
+func (ts *Server) preflight(ctx context.Context, token string, templates []*ctconfig.TemplateConfig) error {
+	if err := ts.checkLookupSelf(ctx, token, templates); err != nil {
+		return err
+	}
+	if len(ts.config.PreflightCapabilities) == 0 {
+		return nil
+	}
+
+	client, err := ts.config.Client.CloneWithHeaders()
+	if err != nil {
+		return fmt.Errorf("error creating client to check capabilities: %w", err)
+	}
+	client.SetToken(token)
+	if ts.config.Namespace != "" {
+		client.SetNamespace(ts.config.Namespace)
+	}
+
+	ts.logger.Debug("template server: checking token capabilities", "paths", ts.config.PreflightCapabilities)
+	var errs *multierror.Error
+	for _, path := range ts.config.PreflightCapabilities {
+		capabilities, err := client.Sys().CapabilitiesSelfWithContext(ctx, path)
+		if err != nil {
+			errs = multierror.Append(errs, fmt.Errorf("error checking capabilities on %q: %w", path, err))
+			continue
+		}
+		if !canRead(capabilities) {
+			errs = multierror.Append(errs, fmt.Errorf("token can't read %q, its capabilities are [%s]", path, strings.Join(capabilities, ", ")))
+		}
+	}
+	if errs != nil {
+		return fmt.Errorf("preflight capability check failed: %w", errs)
+	}
+	return nil
+}
+
+// canRead returns whether capabilities allow reading.
+func canRead(capabilities []string) bool {
+	for _, c := range capabilities {
+		if c == "read" || c == "root" {
+			return true
+		}
+	}
+	return false
+}
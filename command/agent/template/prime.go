@@ -0,0 +1,218 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: BUSL-1.1
+
+package template
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+
+	ctconfig "github.com/hashicorp/consul-template/config"
+	dep "github.com/hashicorp/consul-template/dependency"
+	"github.com/hashicorp/consul-template/manager"
+	cttemplate "github.com/hashicorp/consul-template/template"
+	"github.com/hashicorp/go-multierror"
+	"github.com/hashicorp/vault/command/agent/internal/ctmanager"
+	"github.com/hashicorp/vault/helper/logging"
+	"github.com/hashicorp/vault/sdk/helper/pointerutil"
+)
+
+// maxPrimeRounds bounds how many times the templates are evaluated by Prime,
+// as each round can only discover the dependencies which are read using the
+// data fetched in the round before it.
+const maxPrimeRounds = 10
+
+// Prime fetches the dependencies of the AgentConfig's templates, such as the
+// secrets they read, ahead of their first render, returning an error naming
+// each dependency which couldn't be fetched. Dependencies shared by several
+// templates are only fetched once.
+//
+// Dependencies are resolved the same way the consul-template runner resolves
+// them, by evaluating the templates, and are fetched with the same Vault
+// configuration as the runner, with the token Run last received, or if it
+// hasn't received one, the Client's. The runner keeps a cache of its own,
+// which can't be filled from outside, so priming only speeds up the first
+// render when the runner's requests are served by the agent's cache, which
+// the runner uses whenever it's configured. Without it, Prime only checks
+// that every dependency can be fetched. As with any request through the
+// cache, dynamic secrets fetched by Prime are only issued once when they're
+// then read by the runner with the same token.
+//
+// It's safe to call before Run, and while it's running. An error is returned
+// if the Server has a custom Renderer, whose dependencies aren't known.
+func (ts *Server) Prime(ctx context.Context) error {
+	if ts.config.Renderer != nil {
+		return errors.New("template server: dependencies aren't known with a custom renderer")
+	}
+	if ts.config.AgentConfig == nil || len(ts.config.AgentConfig.Templates) == 0 {
+		return nil
+	}
+	token := ts.token.Load()
+	if token == "" && ts.config.Client != nil {
+		token = ts.config.Client.Token()
+	}
+	if token == "" {
+		return errors.New("template server: priming requires a token")
+	}
+
+	templates, err := expandDestinations(ts.config.AgentConfig.Templates)
+	if err != nil {
+		return fmt.Errorf("template server: %w", err)
+	}
+	for _, tmpl := range templates {
+		if ts.config.ErrMissingKey && tmpl.ErrMissingKey == nil {
+			tmpl.ErrMissingKey = pointerutil.BoolPtr(true)
+		}
+		addTemplateFuncs(tmpl, ts.config.TemplateFuncs)
+	}
+
+	logWriter := ts.config.LogWriter
+	if ts.config.RedactTokens {
+		logWriter = logging.NewRedactingWriter(logWriter)
+	}
+	runnerConfig, err := ctmanager.NewConfig(ctmanager.ManagerConfig{
+		AgentConfig: ts.config.AgentConfig,
+		Namespace:   ts.config.Namespace,
+		LogLevel:    ts.config.LogLevel,
+		LogWriter:   logWriter,
+	}, templates)
+	if err != nil {
+		return fmt.Errorf("template server failed to generate runner config: %w", err)
+	}
+	runnerConfig = runnerConfig.Merge(tokenConfig(&token))
+
+	parsed, err := parseTemplates(runnerConfig)
+	if err != nil {
+		return fmt.Errorf("template server: %w", err)
+	}
+	clients, err := manager.NewClientSet(runnerConfig)
+	if err != nil {
+		return fmt.Errorf("template server: error creating clients: %w", err)
+	}
+	defer clients.Stop()
+
+	brain := cttemplate.NewBrain()
+	failed := make(map[string]error)
+	var fetched int
+	for round := 0; round < maxPrimeRounds && ctx.Err() == nil; round++ {
+		missing := ts.missingDependencies(parsed, brain, runnerConfig, failed)
+		if len(missing) == 0 {
+			break
+		}
+		for d, err := range ts.fetchDependencies(ctx, clients, brain, missing) {
+			failed[d] = err
+		}
+		fetched += len(missing)
+	}
+	if err := ctx.Err(); err != nil {
+		return fmt.Errorf("template server: priming interrupted: %w", err)
+	}
+
+	ts.logger.Debug("template server: primed template dependencies", "dependencies", fetched, "failed", len(failed))
+	var errs *multierror.Error
+	for d, err := range failed {
+		errs = multierror.Append(errs, fmt.Errorf("error fetching %s: %w", d, err))
+	}
+	if errs != nil {
+		return fmt.Errorf("template server: priming failed: %w", errs)
+	}
+	return nil
+}
+
+// parseTemplates parses the templates of the runner configuration the same
+// way the consul-template runner does.
+func parseTemplates(conf *ctconfig.Config) ([]*cttemplate.Template, error) {
+	parsed := make([]*cttemplate.Template, 0, len(*conf.Templates))
+	for _, tmpl := range *conf.Templates {
+		leftDelim := ctconfig.StringVal(tmpl.LeftDelim)
+		if leftDelim == "" {
+			leftDelim = ctconfig.StringVal(conf.DefaultDelims.Left)
+		}
+		rightDelim := ctconfig.StringVal(tmpl.RightDelim)
+		if rightDelim == "" {
+			rightDelim = ctconfig.StringVal(conf.DefaultDelims.Right)
+		}
+		t, err := cttemplate.NewTemplate(&cttemplate.NewTemplateInput{
+			Source:           ctconfig.StringVal(tmpl.Source),
+			Contents:         ctconfig.StringVal(tmpl.Contents),
+			ErrMissingKey:    ctconfig.BoolVal(tmpl.ErrMissingKey),
+			ErrFatal:         ctconfig.BoolVal(tmpl.ErrFatal),
+			LeftDelim:        leftDelim,
+			RightDelim:       rightDelim,
+			ExtFuncMap:       tmpl.ExtFuncMap,
+			FunctionDenylist: tmpl.FunctionDenylist,
+			SandboxPath:      ctconfig.StringVal(tmpl.SandboxPath),
+			Destination:      ctconfig.StringVal(tmpl.Destination),
+			Config:           tmpl,
+			ReaderFunc:       conf.ReaderFunc,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("error parsing %s: %w", tmpl.Display(), err)
+		}
+		parsed = append(parsed, t)
+	}
+	return parsed, nil
+}
+
+// missingDependencies evaluates the templates with the data in brain,
+// returning the dependencies they read which it doesn't hold yet, by name,
+// other than those which have already failed. Templates which fail to
+// evaluate are left for the runner to report.
+func (ts *Server) missingDependencies(templates []*cttemplate.Template, brain *cttemplate.Brain, conf *ctconfig.Config, failed map[string]error) map[string]dep.Dependency {
+	missing := make(map[string]dep.Dependency)
+	for _, tmpl := range templates {
+		result, err := tmpl.Execute(&cttemplate.ExecuteInput{
+			Brain:  brain,
+			Config: conf,
+		})
+		if err != nil {
+			ts.logger.Debug("template server: error evaluating template while priming", "error", err)
+			continue
+		}
+		for _, d := range result.Missing.List() {
+			if _, ok := failed[d.String()]; !ok {
+				missing[d.String()] = d
+			}
+		}
+	}
+	return missing
+}
+
+// fetchDependencies fetches each of the dependencies, up to
+// MaxConcurrentRenders at once if it's set, storing their data in brain, and returning
+// the errors of those which couldn't be fetched, by name.
+func (ts *Server) fetchDependencies(ctx context.Context, clients *dep.ClientSet, brain *cttemplate.Brain, deps map[string]dep.Dependency) map[string]error {
+	limit := ts.config.MaxConcurrentRenders
+	if limit <= 0 {
+		limit = len(deps)
+	}
+
+	var l sync.Mutex
+	errs := make(map[string]error)
+	sem := make(chan struct{}, limit)
+	var wg sync.WaitGroup
+	for name, d := range deps {
+		sem <- struct{}{}
+		if ctx.Err() != nil {
+			<-sem
+			break
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() { <-sem }()
+			data, _, err := d.Fetch(clients, &dep.QueryOptions{})
+			l.Lock()
+			defer l.Unlock()
+			if err != nil {
+				errs[name] = err
+				return
+			}
+			brain.Remember(d, data)
+		}()
+	}
+	wg.Wait()
+	return errs
+}
@@ -0,0 +1,171 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: BUSL-1.1
+
+package template
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	ctconfig "github.com/hashicorp/consul-template/config"
+	"github.com/hashicorp/consul-template/manager"
+	"github.com/hashicorp/vault/api"
+)
+
+// DefaultReactiveRenderInterval is the default interval at which the Server
+// checks for new versions of the KV v2 secrets its templates read, when
+// ReactiveRender is set.
+const DefaultReactiveRenderInterval = 5 * time.Second
+
+// pinnedVersion matches the suffix consul-template adds to the dependency of
+// a secret read at a fixed version, which never changes.
+var pinnedVersion = regexp.MustCompile(`\.v[0-9]+$`)
+
+// watchVersions polls the current version of each KV v2 secret read by the
+// templates, and has the Run loop restart the runner, so that every
+// dependency is fetched again, when any has changed. Otherwise, secrets
+// without a lease are only fetched again once the static secret render
+// interval elapses. It returns once ctx is done or the Server stops running.
+func (ts *Server) watchVersions(ctx context.Context) {
+	interval := ts.config.ReactiveRenderInterval
+	if interval <= 0 {
+		interval = DefaultReactiveRenderInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	// metadataPaths holds the metadata path of each secret read, or "" if it
+	// isn't in a KV v2 mount
+	metadataPaths := make(map[string]string)
+	versions := make(map[string]string)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		token := ts.token.Load()
+		if token == "" {
+			continue
+		}
+		paths, err := ts.vaultReadPaths()
+		if err != nil {
+			return
+		}
+
+		client, err := ts.config.Client.CloneWithHeaders()
+		if err != nil {
+			ts.logger.Warn("template server: failed to create client to check secret versions", "error", err)
+			continue
+		}
+		client.SetToken(token)
+		if ts.config.Namespace != "" {
+			client.SetNamespace(ts.config.Namespace)
+		}
+
+		changed := false
+		for _, path := range paths {
+			metadataPath, ok := metadataPaths[path]
+			if !ok {
+				metadataPath, err = kvMetadataPath(ctx, client, path)
+				if err != nil {
+					ts.logger.Debug("template server: failed to check if secret is KV v2", "path", path, "error", err)
+					continue
+				}
+				metadataPaths[path] = metadataPath
+			}
+			if metadataPath == "" {
+				continue
+			}
+
+			version, err := currentVersion(ctx, client, metadataPath)
+			if err != nil {
+				ts.logger.Debug("template server: failed to read secret version", "path", path, "error", err)
+				continue
+			}
+			if last, ok := versions[path]; ok && last != version {
+				ts.logger.Info("template server: secret has a new version, rendering templates", "path", path, "version", version)
+				changed = true
+			}
+			versions[path] = version
+		}
+
+		if changed {
+			if err := ts.updates.send(&templateUpdate{restart: true}); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// vaultReadPaths returns the paths of the secrets read by the templates,
+// excluding those read at a fixed version.
+func (ts *Server) vaultReadPaths() ([]string, error) {
+	var paths []string
+	err := ts.updates.send(&templateUpdate{
+		inspect: func(runner *manager.Runner, _ []*ctconfig.TemplateConfig) error {
+			if runner == nil {
+				return nil
+			}
+			seen := make(map[string]struct{})
+			for _, event := range runner.RenderEvents() {
+				if event.UsedDeps == nil {
+					continue
+				}
+				for _, dep := range event.UsedDeps.List() {
+					path, ok := strings.CutPrefix(dep.String(), "vault.read(")
+					path = strings.TrimSuffix(path, ")")
+					if !ok || pinnedVersion.MatchString(path) {
+						continue
+					}
+					if _, ok := seen[path]; !ok {
+						seen[path] = struct{}{}
+						paths = append(paths, path)
+					}
+				}
+			}
+			return nil
+		},
+	})
+	return paths, err
+}
+
+// kvMetadataPath returns the path of the metadata of the secret at path, or
+// "" if it isn't in a KV v2 mount. As with consul-template, path may or may
+// not include the "data/" prefix.
+func kvMetadataPath(ctx context.Context, client *api.Client, path string) (string, error) {
+	secret, err := client.Logical().ReadWithContext(ctx, "sys/internal/ui/mounts/"+path)
+	if err != nil {
+		return "", err
+	}
+	if secret == nil {
+		return "", fmt.Errorf("no mount found for %s", path)
+	}
+
+	mountPath, _ := secret.Data["path"].(string)
+	options, _ := secret.Data["options"].(map[string]interface{})
+	if version, _ := options["version"].(string); version != "2" || mountPath == "" {
+		return "", nil
+	}
+
+	rest := strings.TrimPrefix(strings.TrimPrefix(path, mountPath), "data/")
+	return mountPath + "metadata/" + rest, nil
+}
+
+// currentVersion returns the current version of the secret whose metadata is
+// at metadataPath.
+func currentVersion(ctx context.Context, client *api.Client, metadataPath string) (string, error) {
+	secret, err := client.Logical().ReadWithContext(ctx, metadataPath)
+	if err != nil {
+		return "", err
+	}
+	if secret == nil || secret.Data["current_version"] == nil {
+		return "", errors.New("no current version in secret metadata")
+	}
+	return fmt.Sprint(secret.Data["current_version"]), nil
+}
@@ -0,0 +1,286 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: BUSL-1.1
+
+package template
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"sync"
+	"time"
+
+	ctconfig "github.com/hashicorp/consul-template/config"
+	"github.com/hashicorp/consul-template/renderer"
+	"github.com/hashicorp/go-multierror"
+	"github.com/hashicorp/vault/command/agent/config"
+	"github.com/hashicorp/vault/command/agent/internal/ctmanager"
+	"github.com/hashicorp/vault/command/agentproxyshared/hookcontext"
+	"github.com/hashicorp/vault/command/agentproxyshared/tracing"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// Renderer renders the contents of a single template using the given Vault
+// token. When a Renderer is set on the ServerConfig, the Server uses it in
+// place of the consul-template runner, while still writing the rendered
+// contents to the template's destination using the same atomic write,
+// permission and ownership handling. The context passed to Render also
+// carries the token and, if the ServerConfig has a Client, a client
+// authenticated with it, in the ServerConfig's Namespace; see the hookcontext
+// package. Templates are rendered in parallel, see MaxConcurrentRenders, so
+// Render must be safe for concurrent use.
+type Renderer interface {
+	Render(ctx context.Context, template *ctconfig.TemplateConfig, token string) ([]byte, error)
+}
+
+// runWithRenderer is the equivalent of the consul-template runner loop for
+// servers configured with a custom Renderer. Templates are rendered whenever a
+// new token is received, and then again on every static secret render
+// interval. Templates added through updates are rendered straight away if
+// there's a token. If startupDeadlineCh fires before every template has
+// rendered, an error is returned.
+func (ts *Server) runWithRenderer(ctx context.Context, incoming chan string, templates []*ctconfig.TemplateConfig, updates <-chan *templateUpdate, startupDeadlineCh <-chan time.Time) error {
+	finalized := make([]*ctconfig.TemplateConfig, 0, len(templates))
+	for _, tmpl := range templates {
+		t := tmpl.Copy()
+		t.Finalize()
+		finalized = append(finalized, t)
+	}
+
+	// The static secret render interval is jittered, either once for the
+	// process, or on every tick
+	var templateConfig *config.TemplateConfig
+	if ts.config.AgentConfig != nil {
+		templateConfig = ts.config.AgentConfig.TemplateConfig
+	}
+	perCycle := templateConfig != nil && templateConfig.RenderIntervalJitterPerCycle
+	interval := func() time.Duration {
+		if perCycle {
+			return ctmanager.RenderInterval(templateConfig, rand.Float64())
+		}
+		return ctmanager.StableRenderInterval(templateConfig)
+	}
+
+	if len(ts.config.RenewLease) > 0 && ts.config.Client == nil {
+		return errors.New("template server: lease renewal requires a client")
+	}
+
+	defer ts.stopLeaseTimers("")
+	expiredLeases := ts.startLeaseRenewals()
+	defer ts.stopLeaseRenewals()
+
+	var latestToken string
+	staleTokens := newTokenSequence(ts.config.StaleTokenWindow, ts.config.TokenSequence)
+	hookCtx := ctx
+	var ticker *time.Ticker
+	var tickerCh <-chan time.Time
+	var ticked bool
+	rendered := make(map[*ctconfig.TemplateConfig]struct{}, len(finalized))
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+
+		case <-startupDeadlineCh:
+			return ts.startupDeadlineError()
+
+		case token := <-incoming:
+			if token == latestToken {
+				ts.tokenRenewed(ctx, token)
+				continue
+			}
+			if !staleTokens.adopt(token, time.Now()) {
+				ts.logger.Warn("template server ignoring stale token received after a newer one")
+				continue
+			}
+			ts.logger.Info("template server received new token")
+			if latestToken == "" {
+				if err := ts.preflight(ctx, token, finalized); err != nil {
+					return fmt.Errorf("template server: %w", err)
+				}
+			}
+			latestToken = token
+
+			hookCtx = ts.newHookContext(ctx, token, false)
+
+		case u := <-updates:
+			if u.inspect != nil {
+				u.errCh <- u.inspect(nil, finalized)
+				continue
+			}
+			if u.add != nil {
+				u.add = u.add.Copy()
+				u.add.Finalize()
+			}
+			updated, removed, err := u.apply(finalized)
+			if err != nil {
+				u.errCh <- err
+				continue
+			}
+			finalized = updated
+			if removed != nil {
+				delete(rendered, removed)
+				ts.stopLeaseTimers(ctconfig.StringVal(removed.Destination))
+				ts.releaseLeases(ctconfig.StringVal(removed.Destination))
+				u.errCh <- ts.deleteDestination(removed)
+				continue
+			}
+
+			// Other templates are left to be rendered on the next tick
+			if latestToken != "" {
+				if err := ts.renderAll(hookCtx, []*ctconfig.TemplateConfig{u.add}, latestToken, rendered); err != nil {
+					ts.errLogger.Error("template server error", "error", err)
+				}
+			}
+			u.errCh <- nil
+			continue
+
+		case dest := <-expiredLeases:
+			for _, tmpl := range finalized {
+				if ctconfig.StringVal(tmpl.Destination) != dest {
+					continue
+				}
+				if err := ts.renderAll(hookCtx, []*ctconfig.TemplateConfig{tmpl}, latestToken, rendered); err != nil {
+					ts.errLogger.Error("template server error", "error", err)
+				}
+			}
+			continue
+
+		case <-tickerCh:
+			ticked = true
+		}
+
+		// Templates holding leases are rendered again once they can't be
+		// renewed, rather than on the interval
+		toRender := finalized
+		if ticked {
+			toRender = ts.withoutHeldLeases(finalized)
+		}
+		err := ts.renderAll(hookCtx, toRender, latestToken, rendered)
+		if len(rendered) == len(finalized) {
+			startupDeadlineCh = nil
+			ts.markReady()
+		}
+		if err != nil {
+			ts.errLogger.Error("template server error", "error", err)
+		}
+		if ts.exitAfterAuth {
+			if err != nil {
+				return fmt.Errorf("template server: %w", err)
+			}
+			return nil
+		}
+
+		switch {
+		case tickerCh == nil:
+			ticker = time.NewTicker(interval())
+			defer ticker.Stop()
+			tickerCh = ticker.C
+		case ticked && perCycle:
+			ticker.Reset(interval())
+		}
+		ticked = false
+	}
+}
+
+// newHookContext returns the context passed to the Renderer when rendering
+// with token, recording whether it's been delivered again.
+func (ts *Server) newHookContext(ctx context.Context, token string, renewed bool) context.Context {
+	tokenCtx := hookcontext.WithRenewed(ts.config.Tracer.TokenContext(ctx, token), renewed)
+	hookCtx, err := hookcontext.New(tokenCtx, ts.config.Client, token)
+	if err != nil {
+		ts.logger.Warn("error creating client for renderer, only passing the token", "error", err)
+		return hookcontext.WithToken(tokenCtx, token)
+	}
+	if client, ok := hookcontext.Client(hookCtx); ok && ts.config.Namespace != "" {
+		client.SetNamespace(ts.config.Namespace)
+	}
+	return hookCtx
+}
+
+// tokenRenewed calls OnTokenRenewed, if set, on its own goroutine, for the
+// token the templates were last rendered with having been delivered again.
+func (ts *Server) tokenRenewed(ctx context.Context, token string) {
+	if ts.config.OnTokenRenewed == nil {
+		return
+	}
+	go ts.config.OnTokenRenewed(ts.newHookContext(ctx, token, true), token)
+}
+
+// renderAll renders each template with the configured Renderer and writes the
+// result to its destination, returning the accumulated errors. Templates which
+// are written successfully are added to rendered. Up to MaxConcurrentRenders
+// templates, if set, are rendered at once, and the rest wait their turn.
+func (ts *Server) renderAll(ctx context.Context, templates []*ctconfig.TemplateConfig, token string, rendered map[*ctconfig.TemplateConfig]struct{}) (err error) {
+	ctx, span := ts.config.Tracer.Start(ctx, "template.render", attribute.Int("templates", len(templates)))
+	defer func() {
+		tracing.End(span, err)
+	}()
+
+	limit := ts.config.MaxConcurrentRenders
+	if limit <= 0 {
+		limit = len(templates)
+	}
+
+	results := make([]error, len(templates))
+	sem := make(chan struct{}, limit)
+	var wg sync.WaitGroup
+	for idx, tmpl := range templates {
+		sem <- struct{}{}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() { <-sem }()
+			results[idx] = ts.renderTemplate(ctx, tmpl, token)
+		}()
+	}
+	wg.Wait()
+
+	var errs *multierror.Error
+	for idx, tmpl := range templates {
+		if results[idx] != nil {
+			errs = multierror.Append(errs, results[idx])
+			continue
+		}
+		rendered[tmpl] = struct{}{}
+	}
+	return errs.ErrorOrNil()
+}
+
+// renderTemplate renders a single template with the configured Renderer and
+// writes the result to its destination, then watches the leases of the
+// secrets it read, and renews them if it's set to RenewLease, if the Renderer
+// reports them.
+func (ts *Server) renderTemplate(ctx context.Context, tmpl *ctconfig.TemplateConfig, token string) error {
+	contents, leases, err := ts.render(ctx, tmpl, token)
+	if err != nil {
+		return fmt.Errorf("error rendering %s: %w", tmpl.Display(), err)
+	}
+	if _, err := ts.writeTemplate(ctx, tmpl, contents); err != nil {
+		return fmt.Errorf("error writing %s: %w", tmpl.Display(), err)
+	}
+	ts.watchLeases(ctconfig.StringVal(tmpl.Destination), leases)
+	ts.holdLeases(ctx, ctconfig.StringVal(tmpl.Destination), leases)
+	return nil
+}
+
+// writeTemplate writes rendered contents to the template's destination the
+// same way as the consul-template runner does, handling atomic writes,
+// backups, permissions and ownership.
+func (ts *Server) writeTemplate(ctx context.Context, tmpl *ctconfig.TemplateConfig, contents []byte) (*renderer.RenderResult, error) {
+	dest := ctconfig.StringVal(tmpl.Destination)
+	if dest == "" {
+		return nil, errors.New("template has no destination")
+	}
+
+	return ts.renderFile(ctx, &renderer.RenderInput{
+		Backup:         ctconfig.BoolVal(tmpl.Backup),
+		Contents:       contents,
+		CreateDestDirs: ctconfig.BoolVal(tmpl.CreateDestDirs),
+		Path:           dest,
+		Perms:          ctconfig.FileModeVal(tmpl.Perms),
+		User:           ctconfig.StringVal(tmpl.User),
+		Group:          ctconfig.StringVal(tmpl.Group),
+	})
+}
@@ -0,0 +1,89 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: BUSL-1.1
+
+package template
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/hashicorp/consul-template/renderer"
+)
+
+const (
+	// SignatureExt is the extension added to a template's destination to give
+	// the path of its detached signature, written with SignatureKeyPath.
+	SignatureExt = ".sig"
+
+	// SignatureAlgorithmEd25519 signs rendered contents with an Ed25519 key,
+	// producing a raw 64 byte signature. It's the default, and currently the
+	// only supported, SignatureAlgorithm.
+	SignatureAlgorithmEd25519 = "ed25519"
+)
+
+// loadSigningKey reads the PEM encoded PKCS #8 private key at path, such as
+// one generated by "openssl genpkey -algorithm ed25519", for the given
+// algorithm.
+func loadSigningKey(path, algorithm string) (ed25519.PrivateKey, error) {
+	if algorithm == "" {
+		algorithm = SignatureAlgorithmEd25519
+	}
+	if algorithm != SignatureAlgorithmEd25519 {
+		return nil, fmt.Errorf("unsupported signature algorithm %q", algorithm)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading signing key: %w", err)
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM data found in signing key %s", path)
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing signing key: %w", err)
+	}
+	edKey, ok := key.(ed25519.PrivateKey)
+	if !ok {
+		return nil, errors.New("signing key is not an ed25519 key")
+	}
+	return edKey, nil
+}
+
+// writeSignature writes a detached signature of the rendered contents to a
+// file alongside the destination, with the ".sig" extension, if the Server is
+// configured with a signing key. It's written atomically after the
+// destination, so that a verifier never sees the signature of contents which
+// haven't been written yet, and only when it has changed. It's given the
+// destination's permissions and ownership.
+func (ts *Server) writeSignature(i *renderer.RenderInput, uid, gid int) error {
+	if ts.signingKey == nil {
+		return nil
+	}
+
+	// Ed25519 signatures are deterministic, so the signature only changes
+	// with the contents
+	sig := ed25519.Sign(ts.signingKey, i.Contents)
+	path := i.Path + SignatureExt
+	if existing, err := os.ReadFile(path); err == nil && bytes.Equal(existing, sig) && !ts.chownNeeded(path, uid, gid) {
+		return nil
+	}
+
+	perms := i.Perms
+	if info, err := os.Stat(i.Path); err == nil {
+		perms = info.Mode()
+	}
+	return ts.atomicWrite(&renderer.RenderInput{
+		Contents: sig,
+		Path:     path,
+		Perms:    perms,
+		User:     i.User,
+		Group:    i.Group,
+	}, uid, gid)
+}
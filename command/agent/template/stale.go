@@ -0,0 +1,111 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: BUSL-1.1
+
+package template
+
+import (
+	"time"
+)
+
+// maxTokenAdoptions is how many of the tokens adopted most recently a
+// tokenSequence remembers when they were adopted.
+const maxTokenAdoptions = 64
+
+// tokenSequence orders the tokens a Server receives, so that a token which
+// has been superseded by a newer one can be recognized, and ignored, if it's
+// delivered late, such as under rapid re-authentication. Tokens are ordered
+// by the sequence numbers the auth handler stamped them with, if the Server
+// is configured with TokenSequence, or otherwise in the order the Server
+// first sees them. A superseded token is only ignored within the window after
+// it was superseded, after which it's taken as a new token again, e.g. when a
+// token file is reverted to a previous token.
+type tokenSequence struct {
+	window time.Duration
+	// sequence returns the auth handler's sequence number for a token, if
+	// it's known
+	sequence func(token string) (uint64, bool)
+
+	current uint64
+	// adoptions are the tokens adopted most recently, oldest first
+	adoptions []tokenAdoption
+
+	// next and seen number the tokens in the order they're first seen, when
+	// sequence isn't set
+	next uint64
+	seen map[string]uint64
+}
+
+type tokenAdoption struct {
+	seq uint64
+	at  time.Time
+}
+
+func newTokenSequence(window time.Duration, sequence func(token string) (uint64, bool)) *tokenSequence {
+	return &tokenSequence{
+		window:   window,
+		sequence: sequence,
+		seen:     make(map[string]uint64),
+	}
+}
+
+// adopt returns whether token is newer than the current token, in which case
+// it becomes the current token, or false if it was superseded within the
+// window. Tokens are always adopted if the window isn't set. Tokens which
+// sequence doesn't know are adopted without changing the order, as where
+// they'd fall in it is unknown.
+func (s *tokenSequence) adopt(token string, now time.Time) bool {
+	if s.window <= 0 {
+		return true
+	}
+
+	seq, ok := s.number(token, now)
+	switch {
+	case !ok:
+		return true
+	case seq == s.current:
+		return true
+	case seq < s.current && !s.expired(seq, now):
+		return false
+	}
+
+	s.current = seq
+	s.adoptions = append(s.adoptions, tokenAdoption{seq: seq, at: now})
+	if len(s.adoptions) > maxTokenAdoptions {
+		s.adoptions = s.adoptions[1:]
+	}
+	return true
+}
+
+// expired returns whether the superseded token numbered seq was superseded,
+// by the first newer token adopted, longer than the window ago. Tokens
+// superseded so long ago that it's no longer known when are expired too.
+func (s *tokenSequence) expired(seq uint64, now time.Time) bool {
+	for _, a := range s.adoptions {
+		if a.seq > seq {
+			return now.Sub(a.at) > s.window
+		}
+	}
+	return true
+}
+
+// number returns the sequence number of token, and whether it's known.
+func (s *tokenSequence) number(token string, now time.Time) (uint64, bool) {
+	if s.sequence != nil {
+		return s.sequence(token)
+	}
+
+	// Superseded tokens are forgotten once they've expired, so that they're
+	// numbered as new tokens if they're seen again
+	for t, seq := range s.seen {
+		if seq < s.current && s.expired(seq, now) {
+			delete(s.seen, t)
+		}
+	}
+	seq, ok := s.seen[token]
+	if !ok {
+		s.next++
+		seq = s.next
+		s.seen[token] = seq
+	}
+	return seq, true
+}
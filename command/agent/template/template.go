@@ -10,12 +10,13 @@ package template
 
 import (
 	"context"
+	"crypto/ed25519"
 	"errors"
 	"fmt"
 	"io"
 	"math"
-	"strings"
 	sync "sync/atomic"
+	texttemplate "text/template"
 	"time"
 
 	ctconfig "github.com/hashicorp/consul-template/config"
@@ -24,11 +25,15 @@ import (
 	"github.com/hashicorp/vault/api"
 	"github.com/hashicorp/vault/command/agent/config"
 	"github.com/hashicorp/vault/command/agent/internal/ctmanager"
+	"github.com/hashicorp/vault/command/agentproxyshared/tracing"
+	"github.com/hashicorp/vault/helper/logging"
+	"github.com/hashicorp/vault/helper/osutil"
 	"github.com/hashicorp/vault/helper/useragent"
 	"github.com/hashicorp/vault/sdk/helper/backoff"
 	"github.com/hashicorp/vault/sdk/helper/consts"
 	"github.com/hashicorp/vault/sdk/helper/pointerutil"
-	"github.com/hashicorp/vault/sdk/logical"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 	"go.uber.org/atomic"
 )
 
@@ -50,8 +55,235 @@ type ServerConfig struct {
 	// the same io.Writer that Vault Agent itself is using.
 	LogLevel  hclog.Level
 	LogWriter io.Writer
+
+	// Renderer, if set, is used to render templates instead of the internal
+	// Consul Template Runner. Rendered contents are still written to each
+	// template's destination by the Server.
+	Renderer Renderer
+
+	// Client, if set, is cloned and authenticated with the current token for
+	// the context passed to the Renderer; see the hookcontext package.
+	Client *api.Client
+
+	// InvalidTokenInterval is the minimum time between invalid token errors
+	// being signaled to the auth handler. Errors received within the interval
+	// are coalesced into a single signal sent when it elapses. Defaults to
+	// DefaultInvalidTokenInterval.
+	InvalidTokenInterval time.Duration
+
+	// InvalidTokenGrace, if set, is how long the Server keeps checking
+	// whether the token is valid, by looking it up with Client, after an
+	// invalid token error, before signaling the auth handler. If the token
+	// is found to be valid, e.g. because the error was seen while the Vault
+	// cluster elected a new leader, no signal is sent. It requires Client.
+	// Defaults to signaling straight away, as it does if the template_config
+	// sets disable_lookup_self.
+	InvalidTokenGrace time.Duration
+
+	// ErrorPolicy determines how the Server responds to errors returned by
+	// Vault while rendering templates. Defaults to DefaultErrorPolicy.
+	ErrorPolicy *ErrorPolicy
+
+	// StartupRenderDeadline, if set, is how long after Run is called every
+	// template must have rendered at least once. If any hasn't, Run stops
+	// and returns an error. Defaults to no deadline.
+	StartupRenderDeadline time.Duration
+
+	// ErrMissingKey, if set, makes templates which don't set
+	// error_on_missing_key themselves fail to render when they reference a
+	// key missing from a secret, rather than rendering "<no value>". The
+	// render is retried, as it is for other template errors, without
+	// triggering re-authentication.
+	ErrMissingKey bool
+
+	// TemplateFuncs are added to the functions available to every template,
+	// alongside those built in to consul-template. Run returns an error if
+	// any has the same name as a built-in function.
+	TemplateFuncs texttemplate.FuncMap
+
+	// DeleteRemovedDestinations, if set, makes RemoveTemplate delete the
+	// destination file of the template it removes.
+	DeleteRemovedDestinations bool
+
+	// LogRateLimitWindow, if set, is the window within which repeats of the
+	// errors logged while rendering is failing are collapsed into a count, so
+	// that an outage doesn't flood the logs.
+	LogRateLimitWindow time.Duration
+
+	// RedactTokens, if set, replaces anything in the Server's log messages
+	// and arguments, and in the output the internal Consul Template Runner
+	// writes to LogWriter, which looks like a Vault token with "REDACTED",
+	// at every level including trace. It's a safety net for environments
+	// where tokens must never reach the logs, see
+	// logging.NewRedactingLogger. It's off by default, as redacting adds a
+	// pattern match to each log call.
+	RedactTokens bool
+
+	// ReactiveRender, if set, makes the Server poll the current version of
+	// each KV v2 secret its templates read, and render the templates again
+	// soon after a new version is written, rather than waiting for the
+	// static secret render interval to elapse. It requires Client, and is
+	// ignored with a custom Renderer.
+	//
+	// ReactiveRenderInterval is how often the versions are polled. Defaults
+	// to DefaultReactiveRenderInterval.
+	ReactiveRender         bool
+	ReactiveRenderInterval time.Duration
+
+	// WriteChecksumSidecar, if set, makes the Server write the hex SHA-256
+	// digest of each template's rendered contents to a file alongside its
+	// destination, named with ChecksumSidecarExt added. It's replaced
+	// atomically after the destination, and only when the contents change,
+	// so it can be watched to tell real changes from rewrites.
+	WriteChecksumSidecar bool
+
+	// SignatureKeyPath, if set, is the path of a PEM encoded PKCS #8 private
+	// key with which the Server writes a detached signature of each
+	// template's rendered contents to a file alongside its destination, named
+	// with SignatureExt added, so that consumers can verify it was rendered
+	// by the agent. It's replaced atomically after the destination.
+	//
+	// SignatureAlgorithm is the algorithm of the key. Only
+	// SignatureAlgorithmEd25519, the default, is supported.
+	SignatureKeyPath   string
+	SignatureAlgorithm string
+
+	// WriteRetry, if set, makes the Server retry writing a rendered template
+	// to its destination when it fails, rather than leaving it stale until
+	// the template is next rendered. Defaults to not retrying.
+	WriteRetry *WriteRetry
+
+	// MaxRenderBytes, if positive, is the largest a template's rendered
+	// contents may be. A render exceeding it fails with ErrRenderTooLarge,
+	// leaving the destination as it was, and emits a RenderTooLarge event,
+	// so that a runaway template can't fill the disk. Other templates are
+	// still written. Defaults to no limit.
+	MaxRenderBytes int64
+
+	// EnableEventCh enables delivery of TemplateEvents on the Server's
+	// EventCh.
+	EnableEventCh bool
+
+	// CompositeTemplates are rendered alongside the templates passed to Run,
+	// each from an ordered list of sections into a single destination.
+	CompositeTemplates []*CompositeTemplate
+
+	// MaxConcurrentRenders, if set, bounds how many templates a custom
+	// Renderer renders in parallel, with the rest queued until one finishes,
+	// so that a render of every template, such as after re-authenticating,
+	// doesn't use every CPU at once. It also bounds how many dependencies
+	// Prime fetches at once. Zero, the default, leaves them unbounded. It
+	// doesn't apply to the consul-template runner, which always renders
+	// templates one at a time.
+	MaxConcurrentRenders int
+
+	// OnSecretLeaseExpiring, if set, is called on its own goroutine once
+	// SecretLeaseExpiringThreshold of the duration of the lease of a secret
+	// read by a template has elapsed, unless the template has been rendered
+	// again, so that consumers of a credential can reconnect with a new one
+	// before it expires. Leases are only known if the Server has a custom
+	// Renderer which implements LeaseRenderer, as the consul-template runner
+	// doesn't expose them, so Run returns an error if it's set otherwise.
+	//
+	// SecretLeaseExpiringThreshold is the fraction of the lease duration, at
+	// least 0 and less than 1. Defaults to
+	// DefaultSecretLeaseExpiringThreshold.
+	OnSecretLeaseExpiring        func(SecretLease)
+	SecretLeaseExpiringThreshold float64
+
+	// OnTokenRenewed, if set, is called on its own goroutine when the token
+	// the templates were last rendered with is delivered again, rather than
+	// a new one, as the auth handler does when the token's lease is renewed,
+	// or an auth method re-reads the same token. The
+	// templates aren't rendered again. The context is the one a custom
+	// Renderer would be passed, on which hookcontext.Renewed is set, so that
+	// consumers can skip work that's only needed for a new token.
+	OnTokenRenewed func(ctx context.Context, token string)
+
+	// PreflightCapabilities, if set, are paths the templates read from, such
+	// as one in each KV mount, which the first token is checked to be able
+	// to read before anything is rendered, with Vault's capabilities-self
+	// API. If it can't read any of them, Run fails with an error naming
+	// them, rather than the templates failing to render with permission
+	// denied errors. It requires Client.
+	PreflightCapabilities []string
+
+	// StaleTokenWindow, if set, is how long a token which has been replaced
+	// by a newer one is remembered, so that if it's received again within
+	// that time, having been delivered late, it's ignored rather than
+	// replacing the newer token. Tokens are ordered by TokenSequence if it's
+	// set, or otherwise in the order they're first received. A superseded
+	// token received after the window has elapsed is used as a new token.
+	StaleTokenWindow time.Duration
+
+	// TokenSequence, if set, returns the sequence number the auth handler
+	// stamped a token with, and whether it's known, such as the auth
+	// handler's TokenSequence, so that StaleTokenWindow can tell whether a
+	// token was issued before the current one, even if it's never been
+	// received before. Tokens it doesn't know are always used.
+	TokenSequence func(token string) (uint64, bool)
+
+	// TemplateNamespaces, if set, are the namespaces particular templates
+	// passed to Run read their secrets from, keyed by the template, in place
+	// of Namespace. The consul-template runner reads every secret from one
+	// namespace, so the templates of each namespace are rendered by a runner
+	// of their own, all using the same token. Composite templates, and the
+	// PreflightCapabilities, use Namespace. Templates can't be added or
+	// removed while running with more than one namespace.
+	TemplateNamespaces map[*ctconfig.TemplateConfig]string
+
+	// RequireEphemeralDest, if set, makes Run and AddTemplate check that the
+	// destination of every template is on a tmpfs or ramfs mount, and fail
+	// with an error naming those which aren't, so that rendered secrets are
+	// never written to persistent storage. Destinations which don't exist yet
+	// are checked by their closest existing parent directory. It's only
+	// supported on linux; elsewhere they always fail if it's set.
+	RequireEphemeralDest bool
+
+	// RenewLease, if set for a template passed to Run or AddTemplate, makes
+	// the Server renew the leases of the secrets read to render it, rather
+	// than rendering it again on the static secret render interval, so that
+	// the same credentials, such as those of a database, are kept alive
+	// across renders. It's rendered again, issuing new secrets, once one of
+	// them can't be renewed or reaches its max TTL, as well as when a new
+	// token is received. With a custom Renderer, leases are only known if it
+	// implements LeaseRenderer, and they're renewed with Client, which must
+	// be set. The consul-template runner renews the leases of the renewable
+	// secrets every template reads itself, only reading them again once they
+	// can't be renewed, so templates it renders behave this way whether or
+	// not they're set to RenewLease.
+	RenewLease map[*ctconfig.TemplateConfig]bool
+
+	// CanaryTemplates, if set, are rendered once with each new token Run
+	// receives, to a temporary directory which is removed afterwards, so
+	// that a template change, and the token's access to its secrets, can be
+	// checked before the real templates are changed. Their destinations are
+	// never written to, and only identify them, and their commands aren't
+	// run. Any error fails the render, rather than being retried. Their
+	// results are reported with CanaryRendered and CanaryFailed events, and
+	// by CanaryResults. They're rendered on their own, so never hold up
+	// rendering the templates passed to Run.
+	//
+	// CanaryTimeout is the time allowed for each canary to render. Defaults
+	// to DefaultCanaryTimeout.
+	CanaryTemplates []*ctconfig.TemplateConfig
+	CanaryTimeout   time.Duration
+
+	// Tracer, if set, traces rendering the templates with each token
+	// received, until every template has been rendered with it. Sharing the
+	// auth handler's Tracer makes the spans part of the trace of the
+	// authentication which issued the token.
+	Tracer *tracing.Tracer
 }
 
+// DefaultInvalidTokenInterval is the default minimum time between re-auth
+// requests made by the Server because of invalid token errors.
+const DefaultInvalidTokenInterval = 5 * time.Second
+
+// errRenderSuperseded marks the span of rendering with a token which was
+// replaced before every template had been rendered with it.
+var errRenderSuperseded = errors.New("token replaced before rendering finished")
+
 // Server manages the Consul Template Runner which renders templates
 type Server struct {
 	// config holds the ServerConfig used to create it. It's passed along in other
@@ -73,18 +305,60 @@ type Server struct {
 	DoneCh  chan struct{}
 	stopped *atomic.Bool
 
+	// ReadyCh is closed once every template has been rendered at least once,
+	// so that embedders can wait for their destinations to be populated. It
+	// isn't closed if Run returns first.
+	ReadyCh <-chan struct{}
+	readyCh chan struct{}
+	ready   *atomic.Bool
+
+	// EventCh receives TemplateEvents, if EnableEventCh is set. It isn't
+	// closed.
+	EventCh chan TemplateEvent
+
+	// updates passes templates added and removed while running to Run
+	updates updates
+
+	// token is the latest token received by Run, for use outside of it
+	token *atomic.String
+
+	// signingKey is the key loaded from SignatureKeyPath, if set
+	signingKey ed25519.PrivateKey
+
+	// leaseTimers call OnSecretLeaseExpiring for the leases of the secrets
+	// read by custom Renderers
+	leaseTimers leaseTimers
+
+	// leaseRenewals renew the leases of the templates set to RenewLease
+	leaseRenewals leaseRenewals
+
+	// canaries holds the results of rendering the CanaryTemplates
+	canaries canaries
+
 	logger        hclog.Logger
+	errLogger     *logging.RateLimitedLogger
 	exitAfterAuth bool
 }
 
 // NewServer returns a new configured server
 func NewServer(conf *ServerConfig) *Server {
+	logger := conf.Logger
+	if conf.RedactTokens {
+		logger = logging.NewRedactingLogger(logger)
+	}
+	readyCh := make(chan struct{})
 	ts := Server{
 		DoneCh:        make(chan struct{}),
 		stopped:       atomic.NewBool(false),
+		ReadyCh:       readyCh,
+		readyCh:       readyCh,
+		ready:         atomic.NewBool(false),
 		runnerStarted: atomic.NewBool(false),
+		token:         atomic.NewString(""),
+		EventCh:       make(chan TemplateEvent, 10),
 
-		logger:        conf.Logger,
+		logger:        logger,
+		errLogger:     logging.NewRateLimitedLogger(logger, conf.LogRateLimitWindow),
 		config:        conf,
 		exitAfterAuth: conf.ExitAfterAuth,
 	}
@@ -98,70 +372,183 @@ func (ts *Server) Run(ctx context.Context, incoming chan string, templates []*ct
 	if incoming == nil {
 		return errors.New("template server: incoming channel is nil")
 	}
+	if len(ts.config.CanaryTemplates) > 0 {
+		canaryCtx, cancel := context.WithCancel(ctx)
+		defer cancel()
+		incoming = ts.startCanaries(canaryCtx, incoming)
+	}
+	if groups := ts.namespaceGroups(templates); groups != nil {
+		return ts.runNamespaced(ctx, incoming, groups, tokenRenewalInProgress, invalidTokenCh)
+	}
+	if err := validateTemplateFuncs(ts.config.TemplateFuncs); err != nil {
+		return fmt.Errorf("template server: %w", err)
+	}
+	if err := ts.validateLeaseExpiring(); err != nil {
+		return fmt.Errorf("template server: %w", err)
+	}
+	if err := ts.validatePreflightCapabilities(); err != nil {
+		return fmt.Errorf("template server: %w", err)
+	}
+	if ts.config.SignatureKeyPath != "" {
+		key, err := loadSigningKey(ts.config.SignatureKeyPath, ts.config.SignatureAlgorithm)
+		if err != nil {
+			return fmt.Errorf("template server: %w", err)
+		}
+		ts.signingKey = key
+	}
+
+	composed, err := composeTemplates(ts.config.CompositeTemplates)
+	if err != nil {
+		return fmt.Errorf("template server: %w", err)
+	}
+	templates = append(append([]*ctconfig.TemplateConfig(nil), templates...), composed...)
 
 	latestToken := new(string)
 	ts.logger.Info("starting template server")
 
 	defer func() {
+		ts.errLogger.Close()
 		ts.logger.Info("template server stopped")
 	}()
 
 	// If there are no templates, we wait for context cancellation and then return
 	if len(templates) == 0 {
 		ts.logger.Info("no templates found")
+		ts.markReady()
 		<-ctx.Done()
 		return nil
 	}
 
+	templates, err = ts.prepareTemplates(templates)
+	if err != nil {
+		return fmt.Errorf("template server: %w", err)
+	}
+	if err := ts.checkEphemeralDestinations(templates); err != nil {
+		return fmt.Errorf("template server: %w", err)
+	}
+
+	updates := ts.updates.start()
+	defer ts.updates.stop()
+
+	// The deadline covers the whole of startup, including waiting for the
+	// first token
+	var startupDeadlineCh <-chan time.Time
+	if ts.config.StartupRenderDeadline > 0 {
+		startupDeadline := time.NewTimer(ts.config.StartupRenderDeadline)
+		defer startupDeadline.Stop()
+		startupDeadlineCh = startupDeadline.C
+	}
+
+	if ts.config.Renderer != nil {
+		if ts.config.ReactiveRender {
+			ts.logger.Warn("template server: reactive render is not supported with a custom renderer, ignoring")
+		}
+		return ts.runWithRenderer(ctx, incoming, templates, updates, startupDeadlineCh)
+	}
+	if ts.config.ReactiveRender && ts.config.Client == nil {
+		return errors.New("template server: reactive render requires a client")
+	}
+	if ts.config.InvalidTokenGrace > 0 && ts.config.Client == nil {
+		return errors.New("template server: invalid token grace requires a client")
+	}
+	if ts.config.InvalidTokenGrace > 0 && ts.lookupSelfDisabled() {
+		ts.logger.Warn("template server: invalid token grace is ignored as disable_lookup_self is set")
+	}
+
 	// construct a consul template vault config based the agents vault
 	// configuration
 	var runnerConfig *ctconfig.Config
 	var runnerConfigErr error
+	logWriter := ts.config.LogWriter
+	if ts.config.RedactTokens {
+		logWriter = logging.NewRedactingWriter(logWriter)
+	}
 	managerConfig := ctmanager.ManagerConfig{
 		AgentConfig: ts.config.AgentConfig,
 		Namespace:   ts.config.Namespace,
 		LogLevel:    ts.config.LogLevel,
-		LogWriter:   ts.config.LogWriter,
+		LogWriter:   logWriter,
 	}
 	runnerConfig, runnerConfigErr = ctmanager.NewConfig(managerConfig, templates)
 	if runnerConfigErr != nil {
 		return fmt.Errorf("template server failed to runner generate config: %w", runnerConfigErr)
 	}
+	runnerConfig.RendererFunc = ts.rendererFunc(ctx)
 
-	var err error
 	ts.runner, err = manager.NewRunner(runnerConfig, false)
 	if err != nil {
 		return fmt.Errorf("template server failed to create: %w", err)
 	}
 
-	// Build the lookup map using the id mapping from the Template runner. This is
-	// used to check the template rendering against the expected templates. This
-	// returns a map with a generated ID and a slice of templates for that id. The
-	// slice is determined by the source or contents of the template, so if a
-	// configuration has multiple templates specified, but are the same source /
-	// contents, they will be identified by the same key.
-	idMap := ts.runner.TemplateConfigMapping()
-	lookupMap := make(map[string][]*ctconfig.TemplateConfig, len(idMap))
-	for id, ctmpls := range idMap {
-		for _, ctmpl := range ctmpls {
-			tl := lookupMap[id]
-			tl = append(tl, ctmpl)
-			lookupMap[id] = tl
-		}
+	ts.lookupMap = templateLookupMap(ts.runner)
+
+	if ts.config.ReactiveRender {
+		go ts.watchVersions(ctx)
 	}
-	ts.lookupMap = lookupMap
 
 	// Create  backoff object to calculate backoff time before restarting a failed
 	// consul template server
 	restartBackoff := backoff.NewBackoff(math.MaxInt, consts.DefaultMinBackoff, consts.DefaultMaxBackoff)
 
+	invalidTokenInterval := ts.config.InvalidTokenInterval
+	if invalidTokenInterval <= 0 {
+		invalidTokenInterval = DefaultInvalidTokenInterval
+	}
+	staleTokens := newTokenSequence(ts.config.StaleTokenWindow, ts.config.TokenSequence)
+	var lastInvalidToken time.Time
+	var pendingInvalidToken error
+	var pendingInvalidTokenCh <-chan time.Time
+	signalInvalidToken := func(err error) {
+		lastInvalidToken = time.Now()
+
+		// Drain the error channel and incoming channel before sending a new error
+		select {
+		case <-invalidTokenCh:
+		case <-incoming:
+		default:
+		}
+		invalidTokenCh <- err
+	}
+
+	// With an InvalidTokenGrace, the token is checked before signaling, and
+	// only one check is made at a time
+	tokenCheckCh := make(chan tokenCheck, 1)
+	checkingToken := false
+	requestReauth := func(err error) {
+		if ts.config.InvalidTokenGrace <= 0 || ts.lookupSelfDisabled() {
+			signalInvalidToken(err)
+			return
+		}
+		if checkingToken {
+			return
+		}
+		checkingToken = true
+		token := *latestToken
+		go func() {
+			tokenCheckCh <- tokenCheck{token: token, err: ts.checkToken(ctx, token, err)}
+		}()
+	}
+
+	// renderSpan traces rendering the templates with the latest token, and is
+	// ended once they've all been rendered with it
+	var renderSpan trace.Span
+	endRender := func(err error) {
+		if renderSpan != nil {
+			tracing.End(renderSpan, err)
+			renderSpan = nil
+		}
+	}
+	defer endRender(nil)
+
 	for {
 		select {
 		case <-ctx.Done():
 			ts.runner.Stop()
 			return nil
 		case token := <-incoming:
-			if token != *latestToken {
+			if token == *latestToken {
+				ts.tokenRenewed(ctx, token)
+			} else {
 				ts.logger.Info("template server received new token")
 
 				// If the runner was previously started and we intend to exit
@@ -172,20 +559,36 @@ func (ts *Server) Run(ctx context.Context, incoming chan string, templates []*ct
 					continue
 				}
 
+				if !staleTokens.adopt(token, time.Now()) {
+					ts.logger.Warn("template server ignoring stale token received after a newer one")
+					continue
+				}
+
+				if !ts.runnerStarted.Load() {
+					if err := ts.preflight(ctx, token, templates); err != nil {
+						ts.runner.Stop()
+						return fmt.Errorf("template server: %w", err)
+					}
+				}
+
 				ts.runner.Stop()
 				*latestToken = token
-				ctv := ctconfig.Config{
-					Vault: &ctconfig.VaultConfig{
-						Token:           latestToken,
-						ClientUserAgent: pointerutil.StringPtr(useragent.AgentTemplatingString()),
-					},
-				}
+				ts.token.Store(token)
+
+				endRender(errRenderSuperseded)
+				_, renderSpan = ts.config.Tracer.Start(ts.config.Tracer.TokenContext(ctx, token), "template.render", attribute.Int("templates", len(templates)))
+
+				// Any invalid token error waiting to be signaled was for the
+				// previous token
+				pendingInvalidToken = nil
+				pendingInvalidTokenCh = nil
 
-				runnerConfig = runnerConfig.Merge(&ctv)
+				runnerConfig = runnerConfig.Merge(tokenConfig(latestToken))
 				var runnerErr error
 				ts.runner, runnerErr = manager.NewRunner(runnerConfig, false)
 				if runnerErr != nil {
 					ts.logger.Error("template server failed with new Vault token", "error", runnerErr)
+					endRender(runnerErr)
 					continue
 				}
 				ts.runnerStarted.CAS(false, true)
@@ -193,8 +596,9 @@ func (ts *Server) Run(ctx context.Context, incoming chan string, templates []*ct
 			}
 
 		case err := <-ts.runner.ErrCh:
-			ts.logger.Error("template server error", "error", err.Error())
+			ts.errLogger.Error("template server error", "error", err.Error(), "category", ClassifyError(err))
 			ts.runner.StopImmediately()
+			endRender(err)
 
 			// Return after stopping the runner if exit on retry failure was
 			// specified
@@ -239,6 +643,12 @@ func (ts *Server) Run(ctx context.Context, incoming chan string, templates []*ct
 				}
 			}
 
+			if doneRendering {
+				startupDeadlineCh = nil
+				ts.markReady()
+				endRender(nil)
+			}
+
 			if doneRendering && ts.exitAfterAuth {
 				// if we want to exit after auth, go ahead and shut down the runner and
 				// return. The deferred closing of the DoneCh will allow agent to
@@ -247,27 +657,236 @@ func (ts *Server) Run(ctx context.Context, incoming chan string, templates []*ct
 				return nil
 			}
 		case err := <-ts.runner.ServerErrCh:
-			var responseError *api.ResponseError
-			ok := errors.As(err, &responseError)
-			if !ok {
-				ts.logger.Error("template server: could not extract error response")
+			category := ClassifyError(err)
+			switch ts.config.ErrorPolicy.Action(category) {
+			case ErrorActionIgnore:
 				continue
+			case ErrorActionRetry:
+				ts.logger.Debug("template server: received error, retrying", "category", category, "error", err)
+				continue
+			case ErrorActionFail:
+				ts.logger.Error("template server: received error, stopping", "category", category, "error", err)
+				ts.runner.StopImmediately()
+				return fmt.Errorf("template server: %w", err)
 			}
-			if responseError.StatusCode == 403 && strings.Contains(responseError.Error(), logical.ErrInvalidToken.Error()) && !tokenRenewalInProgress.Load() {
-				ts.logger.Info("template server: received invalid token error")
-
-				// Drain the error channel and incoming channel before sending a new error
-				select {
-				case <-invalidTokenCh:
-				case <-incoming:
-				default:
+
+			if ts.lookupSelfDisabled() && isLookupSelfDenied(err) {
+				ts.errLogger.Warn("template server: template denied lookup-self, not re-authenticating as disable_lookup_self is set", "error", err)
+				continue
+			}
+
+			if !tokenRenewalInProgress.Load() {
+				ts.logger.Info("template server: received error, re-authenticating", "category", category)
+
+				// Coalesce errors received within the interval into a single
+				// signal, so that many failing templates don't repeatedly
+				// trigger re-authentication
+				if wait := invalidTokenInterval - time.Since(lastInvalidToken); wait > 0 {
+					if pendingInvalidToken == nil {
+						ts.logger.Debug("template server: delaying invalid token signal", "wait", wait)
+						pendingInvalidTokenCh = time.After(wait)
+					}
+					pendingInvalidToken = err
+					continue
+				}
+				requestReauth(err)
+			}
+
+		case u := <-updates:
+			if u.inspect != nil {
+				u.errCh <- u.inspect(ts.runner, templates)
+				continue
+			}
+			if u.restart {
+				// Only a started runner is replaced, as one waiting for its
+				// first token has nothing to fetch again
+				if ts.runnerStarted.Load() {
+					runner, err := manager.NewRunner(runnerConfig, false)
+					if err != nil {
+						u.errCh <- fmt.Errorf("template server failed to create: %w", err)
+						continue
+					}
+					ts.runner.Stop()
+					ts.runner = runner
+					go ts.runner.Start()
 				}
-				invalidTokenCh <- err
+				u.errCh <- nil
+				continue
+			}
+			updated, removed, err := u.apply(templates)
+			if err != nil {
+				u.errCh <- err
+				continue
+			}
+
+			// The runner has to be replaced to change its templates
+			updatedConfig, err := ctmanager.NewConfig(managerConfig, updated)
+			if err != nil {
+				u.errCh <- fmt.Errorf("template server failed to generate runner config: %w", err)
+				continue
+			}
+			updatedConfig.RendererFunc = ts.rendererFunc(ctx)
+			if *latestToken != "" {
+				updatedConfig = updatedConfig.Merge(tokenConfig(latestToken))
+			}
+			runner, err := manager.NewRunner(updatedConfig, false)
+			if err != nil {
+				u.errCh <- fmt.Errorf("template server failed to create: %w", err)
+				continue
+			}
+
+			ts.runner.Stop()
+			templates, runnerConfig, ts.runner = updated, updatedConfig, runner
+			ts.lookupMap = templateLookupMap(ts.runner)
+			if ts.runnerStarted.Load() {
+				go ts.runner.Start()
+			}
+			u.errCh <- ts.deleteDestination(removed)
+
+		case <-startupDeadlineCh:
+			ts.runner.StopImmediately()
+			return ts.startupDeadlineError()
+
+		case <-pendingInvalidTokenCh:
+			err := pendingInvalidToken
+			pendingInvalidToken = nil
+			pendingInvalidTokenCh = nil
+			if !tokenRenewalInProgress.Load() {
+				requestReauth(err)
+			}
+
+		case check := <-tokenCheckCh:
+			checkingToken = false
+			if check.token != *latestToken {
+				// The token has already been replaced
+				continue
+			}
+			if check.err == nil {
+				ts.logger.Info("template server: token is valid, not re-authenticating")
+				continue
+			}
+			if !tokenRenewalInProgress.Load() {
+				signalInvalidToken(check.err)
 			}
 		}
 	}
 }
 
+// templateLookupMap builds the lookup map using the id mapping from the
+// Template runner. This is used to check the template rendering against the
+// expected templates. This returns a map with a generated ID and a slice of
+// templates for that id. The slice is determined by the source or contents of
+// the template, so if a configuration has multiple templates specified, but
+// are the same source / contents, they will be identified by the same key.
+func templateLookupMap(runner *manager.Runner) map[string][]*ctconfig.TemplateConfig {
+	idMap := runner.TemplateConfigMapping()
+	lookupMap := make(map[string][]*ctconfig.TemplateConfig, len(idMap))
+	for id, ctmpls := range idMap {
+		for _, ctmpl := range ctmpls {
+			tl := lookupMap[id]
+			tl = append(tl, ctmpl)
+			lookupMap[id] = tl
+		}
+	}
+	return lookupMap
+}
+
+// tokenConfig returns the runner configuration that sets its Vault token.
+func tokenConfig(token *string) *ctconfig.Config {
+	return &ctconfig.Config{
+		Vault: &ctconfig.VaultConfig{
+			Token:           token,
+			ClientUserAgent: pointerutil.StringPtr(useragent.AgentTemplatingString()),
+		},
+	}
+}
+
+// prepareTemplates returns copies of the templates with their destinations
+// expanded, and with the ServerConfig's defaults applied.
+func (ts *Server) prepareTemplates(templates []*ctconfig.TemplateConfig) ([]*ctconfig.TemplateConfig, error) {
+	prepared, err := expandDestinations(templates)
+	if err != nil {
+		return nil, err
+	}
+	for i, tmpl := range prepared {
+		ts.setRenewLease(templates[i], ctconfig.StringVal(tmpl.Destination))
+		if ts.config.ErrMissingKey && tmpl.ErrMissingKey == nil {
+			tmpl.ErrMissingKey = pointerutil.BoolPtr(true)
+		}
+		addTemplateFuncs(tmpl, ts.config.TemplateFuncs)
+		normalizeOwner(tmpl)
+	}
+	return prepared, nil
+}
+
+// expandDestinations returns copies of the templates with any environment
+// variables in their destinations expanded.
+func expandDestinations(templates []*ctconfig.TemplateConfig) ([]*ctconfig.TemplateConfig, error) {
+	expanded := make([]*ctconfig.TemplateConfig, 0, len(templates))
+	for _, tmpl := range templates {
+		t := tmpl.Copy()
+		if t.Destination != nil {
+			dest, err := osutil.ExpandEnv(*t.Destination)
+			if err != nil {
+				return nil, fmt.Errorf("could not expand destination: %w", err)
+			}
+			t.Destination = &dest
+		}
+		expanded = append(expanded, t)
+	}
+	return expanded, nil
+}
+
+// startupDeadlineError returns the error returned by Run when templates
+// haven't all rendered within the StartupRenderDeadline.
+func (ts *Server) startupDeadlineError() error {
+	ts.logger.Error("template server: not all templates rendered before the startup render deadline", "deadline", ts.config.StartupRenderDeadline)
+	return fmt.Errorf("template server: not all templates rendered within %s of starting", ts.config.StartupRenderDeadline)
+}
+
+// RenderOnce renders each of the templates a single time using the given
+// token, and returns once they've all been rendered. It runs the same code as
+// Run does with ExitAfterAuth set, so templates are rendered just as they are
+// by the long-running server, but without the need for an auth handler to
+// supply tokens. As the token can't be replaced, errors which would otherwise
+// trigger re-authentication are returned instead.
+func (ts *Server) RenderOnce(ctx context.Context, token string, templates []*ctconfig.TemplateConfig) error {
+	if token == "" {
+		return errors.New("template server: token is empty")
+	}
+	if len(templates) == 0 && len(ts.config.CompositeTemplates) == 0 {
+		return nil
+	}
+
+	conf := *ts.config
+	conf.ExitAfterAuth = true
+	conf.CanaryTemplates = nil
+	onceAction := func(category ErrorCategory) ErrorAction {
+		if action := ts.config.ErrorPolicy.Action(category); action != ErrorActionReauth {
+			return action
+		}
+		return ErrorActionFail
+	}
+	conf.ErrorPolicy = &ErrorPolicy{
+		InvalidToken:     onceAction(ErrorCategoryInvalidToken),
+		PermissionDenied: onceAction(ErrorCategoryPermissionDenied),
+		NotFound:         onceAction(ErrorCategoryNotFound),
+		Other:            onceAction(ErrorCategoryOther),
+	}
+
+	incoming := make(chan string, 1)
+	incoming <- token
+	return NewServer(&conf).Run(ctx, incoming, templates, &sync.Bool{}, make(chan error, 1))
+}
+
+// markReady closes ReadyCh, if it hasn't been already.
+func (ts *Server) markReady() {
+	if ts.ready.CAS(false, true) {
+		ts.logger.Info("all templates rendered")
+		close(ts.readyCh)
+	}
+}
+
 func (ts *Server) Stop() {
 	if ts.stopped.CAS(false, true) {
 		close(ts.DoneCh)
@@ -5,21 +5,37 @@ package template
 
 import (
 	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
+	"encoding/pem"
+	"errors"
 	"fmt"
+	"io/fs"
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"path/filepath"
 	"strings"
+	stdsync "sync"
 	sync "sync/atomic"
+	"syscall"
 	"testing"
+	texttemplate "text/template"
 	"time"
 
 	ctconfig "github.com/hashicorp/consul-template/config"
+	"github.com/hashicorp/consul-template/renderer"
 	"github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/vault/api"
 	"github.com/hashicorp/vault/command/agent/config"
 	"github.com/hashicorp/vault/command/agent/internal/ctmanager"
 	"github.com/hashicorp/vault/command/agentproxyshared"
+	"github.com/hashicorp/vault/command/agentproxyshared/hookcontext"
 	"github.com/hashicorp/vault/internalshared/configutil"
 	"github.com/hashicorp/vault/internalshared/listenerutil"
 	"github.com/hashicorp/vault/sdk/helper/logging"
@@ -202,6 +218,65 @@ func TestCacheConfigNoListener(t *testing.T) {
 	assert.NotNil(t, ctConfig.Vault.Transport.CustomDialer)
 }
 
+// TestRunnerConfig_WaitRetry tests that the wait and retry settings from
+// template_config are applied to the runner, taking precedence over the
+// retry settings from elsewhere.
+func TestRunnerConfig_WaitRetry(t *testing.T) {
+	agentConfig := newAgentConfig(nil, false, false)
+	agentConfig.AutoAuth = &config.AutoAuth{
+		Method: &config.Method{
+			MinBackoff: time.Second,
+			MaxBackoff: time.Minute,
+		},
+	}
+	agentConfig.TemplateConfig = &config.TemplateConfig{
+		Wait: &ctconfig.WaitConfig{
+			Min: ctconfig.TimeDuration(5 * time.Second),
+			Max: ctconfig.TimeDuration(30 * time.Second),
+		},
+		Retry: &ctconfig.RetryConfig{
+			Attempts: ctconfig.Int(3),
+			Backoff:  ctconfig.TimeDuration(250 * time.Millisecond),
+		},
+	}
+	serverConfig := ServerConfig{AgentConfig: agentConfig}
+
+	ctConfig, err := newRunnerConfig(&serverConfig, ctconfig.TemplateConfigs{})
+	require.NoError(t, err)
+
+	require.True(t, ctconfig.BoolVal(ctConfig.Wait.Enabled))
+	require.Equal(t, 5*time.Second, ctconfig.TimeDurationVal(ctConfig.Wait.Min))
+	require.Equal(t, 30*time.Second, ctconfig.TimeDurationVal(ctConfig.Wait.Max))
+	require.Equal(t, 3, ctconfig.IntVal(ctConfig.Vault.Retry.Attempts))
+	require.Equal(t, 250*time.Millisecond, ctconfig.TimeDurationVal(ctConfig.Vault.Retry.Backoff))
+	require.Equal(t, time.Minute, ctconfig.TimeDurationVal(ctConfig.Vault.Retry.MaxBackoff))
+}
+
+// TestRunnerConfig_CircuitBreaker tests that the runner connects to Vault
+// through the agent's circuit breaker, if configured, unless it goes through
+// the cache.
+func TestRunnerConfig_CircuitBreaker(t *testing.T) {
+	breaker := agentproxyshared.NewCircuitBreaker(&agentproxyshared.CircuitBreakerConfig{})
+	agentConfig := newAgentConfig(nil, false, false)
+	agentConfig.Vault.CircuitBreaker = &config.CircuitBreaker{Dialer: breaker}
+	serverConfig := ServerConfig{AgentConfig: agentConfig}
+
+	ctConfig, err := newRunnerConfig(&serverConfig, ctconfig.TemplateConfigs{})
+	require.NoError(t, err)
+	require.Equal(t, breaker, ctConfig.Vault.Transport.CustomDialer)
+
+	agentConfig = newAgentConfig(nil, true, false)
+	bListener := bufconn.Listen(1024 * 1024)
+	defer bListener.Close()
+	agentConfig.Cache.InProcDialer = listenerutil.NewBufConnWrapper(bListener)
+	agentConfig.Vault.CircuitBreaker = &config.CircuitBreaker{Dialer: breaker}
+	serverConfig = ServerConfig{AgentConfig: agentConfig}
+
+	ctConfig, err = newRunnerConfig(&serverConfig, ctconfig.TemplateConfigs{})
+	require.NoError(t, err)
+	require.Equal(t, agentConfig.Cache.InProcDialer, ctConfig.Vault.Transport.CustomDialer)
+}
+
 func createHttpTestServer() *httptest.Server {
 	// create http test server
 	mux := http.NewServeMux()
@@ -236,6 +311,9 @@ func TestServerRun(t *testing.T) {
 		Username string `json:"username"`
 		Password string `json:"password"`
 		Version  string `json:"version"`
+		// Downstream holds templating for a downstream tool, which should
+		// be rendered as is when using custom delimiters
+		Downstream string `json:"downstream"`
 	}
 
 	type templateTest struct {
@@ -350,6 +428,25 @@ func TestServerRun(t *testing.T) {
 			expectError:        false,
 			exitOnRetryFailure: true,
 		},
+		"with custom delimiters": {
+			templateMap: map[string]*templateTest{
+				"render_01": {
+					template: &ctconfig.TemplateConfig{
+						Contents:   pointerutil.StringPtr(templateContentsWithCustomDelims),
+						LeftDelim:  pointerutil.StringPtr("[["),
+						RightDelim: pointerutil.StringPtr("]]"),
+					},
+				},
+			},
+			expectedValues: &secretRender{
+				Username:   "appuser",
+				Password:   "password",
+				Version:    "3",
+				Downstream: "{{ .Values.username }}",
+			},
+			expectError:        false,
+			exitOnRetryFailure: true,
+		},
 	}
 
 	for name, tc := range testCases {
@@ -514,74 +611,2337 @@ func TestNewServerLogLevels(t *testing.T) {
 	}
 }
 
-var jsonResponse = `
-{
-  "request_id": "8af096e9-518c-7351-eff5-5ba20554b21f",
-  "lease_id": "",
-  "renewable": false,
-  "lease_duration": 0,
-  "data": {
-    "data": {
-      "password": "password",
-      "username": "appuser"
-    },
-    "metadata": {
-      "created_time": "2019-10-07T22:18:44.233247Z",
-      "deletion_time": "",
-      "destroyed": false,
-      "version": 3
-    }
-  },
-  "wrap_info": null,
-  "warnings": null,
-  "auth": null
+// staticRenderer is a Renderer that returns fixed contents, recording the
+// token it was called with, and the token and client from its context.
+type staticRenderer struct {
+	l        stdsync.Mutex
+	contents string
+	token    string
+	ctxToken string
+	client   *api.Client
 }
-`
 
-var templateContents = `
-{{ with secret "kv/myapp/config"}}
-{
-{{ if .Data.data.username}}"username":"{{ .Data.data.username}}",{{ end }}
-{{ if .Data.data.password }}"password":"{{ .Data.data.password }}",{{ end }}
-{{ if .Data.metadata.version}}"version":"{{ .Data.metadata.version }}"{{ end }}
+func (r *staticRenderer) Render(ctx context.Context, _ *ctconfig.TemplateConfig, token string) ([]byte, error) {
+	r.l.Lock()
+	defer r.l.Unlock()
+	r.token = token
+	r.ctxToken, _ = hookcontext.Token(ctx)
+	r.client, _ = hookcontext.Client(ctx)
+	return []byte(r.contents), nil
 }
-{{ end }}
-`
 
-var templateContentsMissingKey = `
-{{ with secret "kv/myapp/config"}}
-{
-{{ if .Data.data.foo}}"foo":"{{ .Data.data.foo}}"{{ end }}
+// TestServerRun_Renderer tests that a custom Renderer is used in place of the
+// consul-template runner, and that its output is written to the destination.
+func TestServerRun_Renderer(t *testing.T) {
+	dstFile := filepath.Join(t.TempDir(), "render_01")
+	r := &staticRenderer{contents: "rendered by a custom engine"}
+	client, err := api.NewClient(nil)
+	require.NoError(t, err)
+
+	server := NewServer(&ServerConfig{
+		Logger:        logging.NewVaultLogger(hclog.Trace),
+		AgentConfig:   &config.Config{},
+		ExitAfterAuth: true,
+		Renderer:      r,
+		Client:        client,
+	})
+
+	templatesToRender := []*ctconfig.TemplateConfig{
+		{
+			Contents:    pointerutil.StringPtr("unused"),
+			Destination: pointerutil.StringPtr(dstFile),
+			Perms:       pointerutil.FileModePtr(0o600),
+		},
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+
+	templateTokenCh := make(chan string, 1)
+	templateTokenCh <- "test"
+	err = server.Run(ctx, templateTokenCh, templatesToRender, &sync.Bool{}, make(chan error, 1))
+	require.NoError(t, err)
+	require.Equal(t, "test", r.token)
+	require.Equal(t, "test", r.ctxToken)
+	require.NotNil(t, r.client)
+	require.NotSame(t, client, r.client)
+	require.Equal(t, "test", r.client.Token())
+
+	content, err := os.ReadFile(dstFile)
+	require.NoError(t, err)
+	require.Equal(t, r.contents, string(content))
+
+	fi, err := os.Stat(dstFile)
+	require.NoError(t, err)
+	require.Equal(t, os.FileMode(0o600), fi.Mode().Perm())
 }
-{{ end }}
-`
 
-var templateContentsBad = `
-{{ with secret "kv/myapp/config-bad"}}
-{
-{{ if .Data.data.username}}"username":"{{ .Data.data.username}}",{{ end }}
-{{ if .Data.data.password }}"password":"{{ .Data.data.password }}",{{ end }}
-{{ if .Data.metadata.version}}"version":"{{ .Data.metadata.version }}"{{ end }}
+// TestServerRun_DestinationEnv tests that environment variables in template
+// destinations are expanded.
+func TestServerRun_DestinationEnv(t *testing.T) {
+	tmpDir := t.TempDir()
+	t.Setenv("TEMPLATE_TEST_DIR", tmpDir)
+
+	server := NewServer(&ServerConfig{
+		Logger:        logging.NewVaultLogger(hclog.Trace),
+		AgentConfig:   &config.Config{},
+		ExitAfterAuth: true,
+		Renderer:      &staticRenderer{contents: "rendered"},
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+
+	templateTokenCh := make(chan string, 1)
+	templateTokenCh <- "test"
+	templatesToRender := []*ctconfig.TemplateConfig{
+		{
+			Contents:    pointerutil.StringPtr("unused"),
+			Destination: pointerutil.StringPtr("${TEMPLATE_TEST_DIR}/render_01"),
+		},
+	}
+	err := server.Run(ctx, templateTokenCh, templatesToRender, &sync.Bool{}, make(chan error, 1))
+	require.NoError(t, err)
+	content, err := os.ReadFile(filepath.Join(tmpDir, "render_01"))
+	require.NoError(t, err)
+	require.Equal(t, "rendered", string(content))
+
+	templatesToRender[0].Destination = pointerutil.StringPtr("${TEMPLATE_TEST_UNDEFINED}/render_01")
+	err = server.Run(ctx, templateTokenCh, templatesToRender, &sync.Bool{}, make(chan error, 1))
+	require.ErrorContains(t, err, "TEMPLATE_TEST_UNDEFINED")
 }
-{{ end }}
-`
 
-var templateContentsPermDenied = `
-{{ with secret "kv/myapp/perm-denied"}}
-{
-{{ if .Data.data.username}}"username":"{{ .Data.data.username}}",{{ end }}
-{{ if .Data.data.password }}"password":"{{ .Data.data.password }}",{{ end }}
-{{ if .Data.metadata.version}}"version":"{{ .Data.metadata.version }}"{{ end }}
+// TestServerRun_Ownership tests that the uid and gid configured on a template
+// are set on the rendered file, replacing an existing file's owner.
+func TestServerRun_Ownership(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("changing file ownership requires running as root")
+	}
+
+	tmpDir := t.TempDir()
+	dest := filepath.Join(tmpDir, "render_01")
+	require.NoError(t, os.WriteFile(dest, []byte("existing"), 0o600))
+
+	server := NewServer(&ServerConfig{
+		Logger:        logging.NewVaultLogger(hclog.Trace),
+		AgentConfig:   &config.Config{},
+		ExitAfterAuth: true,
+		Renderer:      &staticRenderer{contents: "rendered"},
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+
+	templateTokenCh := make(chan string, 1)
+	templateTokenCh <- "test"
+	templatesToRender := []*ctconfig.TemplateConfig{
+		{
+			Contents:    pointerutil.StringPtr("unused"),
+			Destination: pointerutil.StringPtr(dest),
+			Uid:         ctconfig.Int(65534),
+			Gid:         ctconfig.Int(65533),
+		},
+	}
+	require.NoError(t, server.Run(ctx, templateTokenCh, templatesToRender, &sync.Bool{}, make(chan error, 1)))
+
+	content, err := os.ReadFile(dest)
+	require.NoError(t, err)
+	require.Equal(t, "rendered", string(content))
+
+	info, err := os.Stat(dest)
+	require.NoError(t, err)
+	require.Equal(t, os.FileMode(0o600), info.Mode().Perm())
+	uid, gid, ok := fileOwner(info)
+	require.True(t, ok)
+	require.Equal(t, 65534, uid)
+	require.Equal(t, 65533, gid)
+
+	// Only the owner changing causes the file to be rewritten
+	result, err := server.writeTemplate(context.Background(), &ctconfig.TemplateConfig{
+		Destination: pointerutil.StringPtr(dest),
+		User:        pointerutil.StringPtr("0"),
+	}, []byte("rendered"))
+	require.NoError(t, err)
+	require.True(t, result.DidRender)
+	info, err = os.Stat(dest)
+	require.NoError(t, err)
+	uid, gid, _ = fileOwner(info)
+	require.Equal(t, 0, uid)
+	require.Equal(t, 65533, gid)
 }
-{{ end }}
-`
 
-var templateContentsWithSprigFunctions = `
-{{ with secret "kv/myapp/config"}}
-{
-{{ if .Data.data.username}}"username":"{{ .Data.data.username | sprig_upper }}",{{ end }}
-{{ if .Data.data.password }}"password":"{{ .Data.data.password | sprig_replace "word" "phrase" }}",{{ end }}
-{{ if .Data.metadata.version}}"version":"{{ .Data.metadata.version }}"{{ end }}
+// TestServer_Perms tests that the permissions configured on each template are
+// set on its destination through the temporary file it's renamed from, and
+// applied to an existing file even if its contents are unchanged.
+func TestServer_Perms(t *testing.T) {
+	tmpDir := t.TempDir()
+	server := NewServer(&ServerConfig{
+		Logger:      logging.NewVaultLogger(hclog.Trace),
+		AgentConfig: &config.Config{},
+	})
+
+	for name, perms := range map[string]os.FileMode{
+		"cert.pem": 0o644,
+		"key.pem":  0o600,
+	} {
+		dest := filepath.Join(tmpDir, name)
+		result, err := server.writeTemplate(context.Background(), &ctconfig.TemplateConfig{
+			Destination: pointerutil.StringPtr(dest),
+			Perms:       pointerutil.FileModePtr(perms),
+		}, []byte(name))
+		require.NoError(t, err)
+		require.True(t, result.DidRender)
+		info, err := os.Stat(dest)
+		require.NoError(t, err)
+		require.Equal(t, perms, info.Mode().Perm(), name)
+	}
+
+	// No temporary files are left behind
+	entries, err := os.ReadDir(tmpDir)
+	require.NoError(t, err)
+	require.Len(t, entries, 2)
+
+	dest := filepath.Join(tmpDir, "key.pem")
+	require.NoError(t, os.Chmod(dest, 0o644))
+	result, err := server.writeTemplate(context.Background(), &ctconfig.TemplateConfig{
+		Destination: pointerutil.StringPtr(dest),
+		Perms:       pointerutil.FileModePtr(0o600),
+	}, []byte("key.pem"))
+	require.NoError(t, err)
+	require.True(t, result.DidRender)
+	info, err := os.Stat(dest)
+	require.NoError(t, err)
+	require.Equal(t, os.FileMode(0o600), info.Mode().Perm())
+
+	// Without configured permissions, the existing file's are kept
+	result, err = server.writeTemplate(context.Background(), &ctconfig.TemplateConfig{
+		Destination: pointerutil.StringPtr(dest),
+	}, []byte("key.pem"))
+	require.NoError(t, err)
+	require.False(t, result.DidRender)
+}
+
+// TestServerRun_ChecksumSidecar tests that the digest of the rendered contents
+// is written alongside the destination, and only replaced when they change.
+func TestServerRun_ChecksumSidecar(t *testing.T) {
+	dest := filepath.Join(t.TempDir(), "render_01")
+	sidecar := dest + ChecksumSidecarExt
+
+	server := NewServer(&ServerConfig{
+		Logger:               logging.NewVaultLogger(hclog.Trace),
+		AgentConfig:          &config.Config{},
+		ExitAfterAuth:        true,
+		Renderer:             &staticRenderer{contents: "rendered"},
+		WriteChecksumSidecar: true,
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+
+	templateTokenCh := make(chan string, 1)
+	templateTokenCh <- "test"
+	templatesToRender := []*ctconfig.TemplateConfig{
+		{
+			Contents:    pointerutil.StringPtr("unused"),
+			Destination: pointerutil.StringPtr(dest),
+			Perms:       ctconfig.FileMode(0o640),
+		},
+	}
+	require.NoError(t, server.Run(ctx, templateTokenCh, templatesToRender, &sync.Bool{}, make(chan error, 1)))
+
+	sum := sha256.Sum256([]byte("rendered"))
+	content, err := os.ReadFile(sidecar)
+	require.NoError(t, err)
+	require.Equal(t, hex.EncodeToString(sum[:]), string(content))
+	info, err := os.Stat(sidecar)
+	require.NoError(t, err)
+	require.Equal(t, os.FileMode(0o640), info.Mode().Perm())
+
+	// Rewriting the same contents leaves the sidecar in place
+	require.NoError(t, os.Chtimes(sidecar, time.Time{}, time.Unix(0, 0)))
+	_, err = server.writeTemplate(context.Background(), templatesToRender[0], []byte("rendered"))
+	require.NoError(t, err)
+	info, err = os.Stat(sidecar)
+	require.NoError(t, err)
+	require.Equal(t, time.Unix(0, 0), info.ModTime())
+
+	_, err = server.writeTemplate(context.Background(), templatesToRender[0], []byte("changed"))
+	require.NoError(t, err)
+	sum = sha256.Sum256([]byte("changed"))
+	content, err = os.ReadFile(sidecar)
+	require.NoError(t, err)
+	require.Equal(t, hex.EncodeToString(sum[:]), string(content))
+}
+
+// TestServerRun_Signature tests that a detached signature of the rendered
+// contents is written alongside the destination, and verifies with the
+// public key.
+func TestServerRun_Signature(t *testing.T) {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	der, err := x509.MarshalPKCS8PrivateKey(priv)
+	require.NoError(t, err)
+	keyPath := filepath.Join(t.TempDir(), "signing.pem")
+	require.NoError(t, os.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0o600))
+
+	dest := filepath.Join(t.TempDir(), "render_01")
+	server := NewServer(&ServerConfig{
+		Logger:           logging.NewVaultLogger(hclog.Trace),
+		AgentConfig:      &config.Config{},
+		ExitAfterAuth:    true,
+		Renderer:         &staticRenderer{contents: "rendered"},
+		SignatureKeyPath: keyPath,
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+
+	templateTokenCh := make(chan string, 1)
+	templateTokenCh <- "test"
+	templatesToRender := []*ctconfig.TemplateConfig{
+		{
+			Contents:    pointerutil.StringPtr("unused"),
+			Destination: pointerutil.StringPtr(dest),
+			Perms:       ctconfig.FileMode(0o640),
+		},
+	}
+	require.NoError(t, server.Run(ctx, templateTokenCh, templatesToRender, &sync.Bool{}, make(chan error, 1)))
+
+	sig, err := os.ReadFile(dest + SignatureExt)
+	require.NoError(t, err)
+	require.True(t, ed25519.Verify(pub, []byte("rendered"), sig))
+	info, err := os.Stat(dest + SignatureExt)
+	require.NoError(t, err)
+	require.Equal(t, os.FileMode(0o640), info.Mode().Perm())
+
+	_, err = server.writeTemplate(context.Background(), templatesToRender[0], []byte("changed"))
+	require.NoError(t, err)
+	sig, err = os.ReadFile(dest + SignatureExt)
+	require.NoError(t, err)
+	require.True(t, ed25519.Verify(pub, []byte("changed"), sig))
+
+	// Other algorithms are rejected
+	_, rsaErr := loadSigningKey(keyPath, "rsa")
+	require.ErrorContains(t, rsaErr, `unsupported signature algorithm "rsa"`)
+}
+
+// concurrencyRenderer is a Renderer which records the most renders it has
+// seen in progress at once.
+type concurrencyRenderer struct {
+	inFlight sync.Int32
+	max      sync.Int32
+}
+
+func (r *concurrencyRenderer) Render(context.Context, *ctconfig.TemplateConfig, string) ([]byte, error) {
+	n := r.inFlight.Add(1)
+	defer r.inFlight.Add(-1)
+	for {
+		seen := r.max.Load()
+		if n <= seen || r.max.CompareAndSwap(seen, n) {
+			break
+		}
+	}
+	time.Sleep(20 * time.Millisecond)
+	return []byte("rendered"), nil
+}
+
+// TestServer_MaxConcurrentRenders tests that no more templates are rendered
+// at once than configured, and that by default they're all rendered at once.
+func TestServer_MaxConcurrentRenders(t *testing.T) {
+	for _, limit := range []int{0, 1, 3} {
+		t.Run(fmt.Sprintf("limit_%d", limit), func(t *testing.T) {
+			r := &concurrencyRenderer{}
+			server := NewServer(&ServerConfig{
+				Logger:               logging.NewVaultLogger(hclog.Trace),
+				AgentConfig:          &config.Config{},
+				Renderer:             r,
+				MaxConcurrentRenders: limit,
+			})
+
+			dir := t.TempDir()
+			var templates []*ctconfig.TemplateConfig
+			for i := 0; i < 10; i++ {
+				templates = append(templates, &ctconfig.TemplateConfig{
+					Destination: pointerutil.StringPtr(filepath.Join(dir, fmt.Sprintf("render_%02d", i))),
+				})
+			}
+
+			rendered := make(map[*ctconfig.TemplateConfig]struct{})
+			require.NoError(t, server.renderAll(context.Background(), templates, "token", rendered))
+			require.Len(t, rendered, len(templates))
+
+			expected := int32(limit)
+			if limit == 0 {
+				expected = int32(len(templates))
+			}
+			require.LessOrEqual(t, r.max.Load(), expected)
+			if expected > 1 {
+				require.Greater(t, r.max.Load(), int32(1), "expected templates to render in parallel")
+			}
+		})
+	}
+}
+
+// TestRenderInterval tests that the jittered static secret render interval
+// stays within the configured fraction of the interval, and that the stable
+// interval doesn't change.
+func TestRenderInterval(t *testing.T) {
+	require.Equal(t, ctconfig.DefaultVaultLeaseDuration, ctmanager.RenderInterval(nil, 0.9))
+
+	tc := &config.TemplateConfig{StaticSecretRenderInt: 10 * time.Minute}
+	require.Equal(t, 10*time.Minute, ctmanager.RenderInterval(tc, 0.9))
+
+	tc.RenderIntervalJitter = 0.2
+	require.Equal(t, 8*time.Minute, ctmanager.RenderInterval(tc, 0))
+	require.Equal(t, 10*time.Minute, ctmanager.RenderInterval(tc, 0.5))
+	for i := 0; i < 1000; i++ {
+		interval := ctmanager.RenderInterval(tc, float64(i)/1000)
+		require.GreaterOrEqual(t, interval, 8*time.Minute)
+		require.Less(t, interval, 12*time.Minute)
+	}
+
+	stable := ctmanager.StableRenderInterval(tc)
+	require.GreaterOrEqual(t, stable, 8*time.Minute)
+	require.Less(t, stable, 12*time.Minute)
+	require.Equal(t, stable, ctmanager.StableRenderInterval(tc))
+}
+
+// leaseRenderer is a LeaseRenderer which reports a single lease.
+type leaseRenderer struct {
+	staticRenderer
+	lease *SecretLease
+}
+
+func (r *leaseRenderer) RenderWithLeases(ctx context.Context, tmpl *ctconfig.TemplateConfig, token string) ([]byte, []*SecretLease, error) {
+	contents, err := r.Render(ctx, tmpl, token)
+	return contents, []*SecretLease{r.lease}, err
+}
+
+// TestServer_OnSecretLeaseExpiring tests that the callback is called once the
+// threshold of the lease duration of a secret reported by a LeaseRenderer has
+// elapsed, unless the template is rendered again first, and that it's
+// rejected without a Renderer which reports leases.
+func TestServer_OnSecretLeaseExpiring(t *testing.T) {
+	dest := filepath.Join(t.TempDir(), "render_01")
+	tmpl := &ctconfig.TemplateConfig{Destination: pointerutil.StringPtr(dest)}
+	expiringCh := make(chan SecretLease, 10)
+	newServer := func(r Renderer) *Server {
+		return NewServer(&ServerConfig{
+			Logger:                       logging.NewVaultLogger(hclog.Trace),
+			AgentConfig:                  &config.Config{},
+			Renderer:                     r,
+			OnSecretLeaseExpiring:        func(lease SecretLease) { expiringCh <- lease },
+			SecretLeaseExpiringThreshold: 0.5,
+		})
+	}
+
+	r := &leaseRenderer{
+		staticRenderer: staticRenderer{contents: "rendered"},
+		lease: &SecretLease{
+			Path:          "database/creds/app",
+			LeaseID:       "database/creds/app/abcd",
+			LeaseDuration: 400 * time.Millisecond,
+		},
+	}
+	server := newServer(r)
+	start := time.Now()
+	require.NoError(t, server.renderAll(context.Background(), []*ctconfig.TemplateConfig{tmpl}, "token", map[*ctconfig.TemplateConfig]struct{}{}))
+
+	// Rendering again replaces the lease being watched
+	time.Sleep(100 * time.Millisecond)
+	require.NoError(t, server.renderAll(context.Background(), []*ctconfig.TemplateConfig{tmpl}, "token", map[*ctconfig.TemplateConfig]struct{}{}))
+	select {
+	case lease := <-expiringCh:
+		require.GreaterOrEqual(t, time.Since(start), 300*time.Millisecond)
+		require.Equal(t, dest, lease.Destination)
+		require.Equal(t, "database/creds/app/abcd", lease.LeaseID)
+		require.WithinDuration(t, time.Now().Add(200*time.Millisecond), lease.ExpiresAt, 100*time.Millisecond)
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the lease expiring callback")
+	}
+	select {
+	case <-expiringCh:
+		t.Fatal("expected the callback to be called once")
+	case <-time.After(300 * time.Millisecond):
+	}
+
+	server = newServer(&staticRenderer{contents: "rendered"})
+	require.NoError(t, server.renderAll(context.Background(), []*ctconfig.TemplateConfig{tmpl}, "token", map[*ctconfig.TemplateConfig]struct{}{}))
+	select {
+	case <-expiringCh:
+		t.Fatal("expected no callback without leases")
+	case <-time.After(300 * time.Millisecond):
+	}
+
+	server = NewServer(&ServerConfig{
+		Logger:                       logging.NewVaultLogger(hclog.Trace),
+		AgentConfig:                  &config.Config{},
+		Renderer:                     r,
+		SecretLeaseExpiringThreshold: 1.5,
+	})
+	err := server.Run(context.Background(), make(chan string), []*ctconfig.TemplateConfig{tmpl}, &sync.Bool{}, make(chan error, 1))
+	require.ErrorContains(t, err, "secret lease expiring threshold")
+
+	// The callback is rejected where leases aren't known, as it would never
+	// be called
+	for _, r := range []Renderer{nil, &staticRenderer{contents: "rendered"}} {
+		server = NewServer(&ServerConfig{
+			Logger:                logging.NewVaultLogger(hclog.Trace),
+			AgentConfig:           &config.Config{},
+			Renderer:              r,
+			OnSecretLeaseExpiring: func(SecretLease) {},
+		})
+		err = server.Run(context.Background(), make(chan string), []*ctconfig.TemplateConfig{tmpl}, &sync.Bool{}, make(chan error, 1))
+		require.ErrorContains(t, err, "implements LeaseRenderer")
+	}
+}
+
+// TestServerRun_RenewLease tests that the leases of a template set to
+// RenewLease are renewed, rather than it being rendered again, until renewing
+// fails.
+func TestServerRun_RenewLease(t *testing.T) {
+	var renewals sync.Int32
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v1/sys/leases/renew", func(w http.ResponseWriter, r *http.Request) {
+		var body map[string]interface{}
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&body))
+		require.Equal(t, "database/creds/app/abcd", body["lease_id"])
+		if renewals.Add(1) > 2 {
+			w.WriteHeader(400)
+			fmt.Fprintln(w, `{"errors":["lease not found"]}`)
+			return
+		}
+		fmt.Fprintln(w, `{"lease_id":"database/creds/app/abcd","renewable":true,"lease_duration":1}`)
+	})
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+	client, err := api.NewClient(&api.Config{Address: ts.URL})
+	require.NoError(t, err)
+
+	tmpl := &ctconfig.TemplateConfig{Destination: pointerutil.StringPtr(filepath.Join(t.TempDir(), "render_01"))}
+	renders := make(chan int32, 10)
+	r := &countingLeaseRenderer{
+		leaseRenderer: leaseRenderer{
+			staticRenderer: staticRenderer{contents: "rendered"},
+			lease: &SecretLease{
+				Path:          "database/creds/app",
+				LeaseID:       "database/creds/app/abcd",
+				LeaseDuration: time.Second,
+				Renewable:     true,
+			},
+		},
+		renders: renders,
+	}
+	server := NewServer(&ServerConfig{
+		Logger:      logging.NewVaultLogger(hclog.Trace),
+		AgentConfig: &config.Config{},
+		Renderer:    r,
+		Client:      client,
+		RenewLease:  map[*ctconfig.TemplateConfig]bool{tmpl: true},
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	incoming := make(chan string, 1)
+	incoming <- "token"
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- server.Run(ctx, incoming, []*ctconfig.TemplateConfig{tmpl}, &sync.Bool{}, make(chan error, 1))
+	}()
+
+	for _, expected := range []int32{1, 2} {
+		select {
+		case n := <-renders:
+			require.Equal(t, expected, n)
+		case <-time.After(5 * time.Second):
+			t.Fatal("timed out waiting for render")
+		}
+	}
+	// The template is rendered again once renewing fails
+	require.Equal(t, int32(3), renewals.Load())
+
+	cancel()
+	require.NoError(t, <-errCh)
+
+	server = NewServer(&ServerConfig{
+		Logger:      logging.NewVaultLogger(hclog.Trace),
+		AgentConfig: &config.Config{},
+		Renderer:    r,
+		RenewLease:  map[*ctconfig.TemplateConfig]bool{tmpl: true},
+	})
+	err = server.Run(context.Background(), make(chan string), []*ctconfig.TemplateConfig{tmpl}, &sync.Bool{}, make(chan error, 1))
+	require.ErrorContains(t, err, "lease renewal requires a client")
+}
+
+// countingLeaseRenderer is a leaseRenderer which sends the number of renders
+// so far on renders after each one.
+type countingLeaseRenderer struct {
+	leaseRenderer
+	count   int32
+	renders chan int32
+}
+
+func (r *countingLeaseRenderer) RenderWithLeases(ctx context.Context, tmpl *ctconfig.TemplateConfig, token string) ([]byte, []*SecretLease, error) {
+	r.count++
+	r.renders <- r.count
+	return r.leaseRenderer.RenderWithLeases(ctx, tmpl, token)
+}
+
+// TestServerRun_RenewLease_Runner tests that on the consul-template runner
+// path, the lease of a secret read by a template set to RenewLease is renewed,
+// rather than the secret being read again.
+func TestServerRun_RenewLease_Runner(t *testing.T) {
+	var reads, renewals sync.Int32
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v1/database/creds/app", func(w http.ResponseWriter, r *http.Request) {
+		n := reads.Add(1)
+		fmt.Fprintf(w, `{"lease_id":"database/creds/app/abcd","renewable":true,"lease_duration":2,"data":{"username":"user-%d"}}`, n)
+	})
+	mux.HandleFunc("/v1/sys/leases/renew", func(w http.ResponseWriter, r *http.Request) {
+		renewals.Add(1)
+		fmt.Fprintln(w, `{"lease_id":"database/creds/app/abcd","renewable":true,"lease_duration":2}`)
+	})
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	dest := filepath.Join(t.TempDir(), "render_01")
+	tmpl := &ctconfig.TemplateConfig{
+		Contents:    pointerutil.StringPtr(`{{ with secret "database/creds/app" }}{{ .Data.username }}{{ end }}`),
+		Destination: pointerutil.StringPtr(dest),
+	}
+	server := NewServer(&ServerConfig{
+		Logger: logging.NewVaultLogger(hclog.Trace),
+		AgentConfig: &config.Config{
+			Vault: &config.Vault{
+				Address: ts.URL,
+			},
+		},
+		LogLevel:   hclog.Trace,
+		LogWriter:  hclog.DefaultOutput,
+		RenewLease: map[*ctconfig.TemplateConfig]bool{tmpl: true},
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	incoming := make(chan string, 1)
+	incoming <- "token"
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- server.Run(ctx, incoming, []*ctconfig.TemplateConfig{tmpl}, &sync.Bool{}, make(chan error, 1))
+	}()
+
+	require.Eventually(t, func() bool {
+		return renewals.Load() >= 2
+	}, 10*time.Second, 50*time.Millisecond)
+	contents, err := os.ReadFile(dest)
+	require.NoError(t, err)
+	require.Equal(t, "user-1", string(contents))
+	require.Equal(t, int32(1), reads.Load())
+
+	cancel()
+	require.NoError(t, <-errCh)
+}
+
+// TestServer_WriteRetry tests that failed writes of rendered templates are
+// retried, except for permanent errors, and that an event is emitted when the
+// retries are exhausted.
+func TestServer_WriteRetry(t *testing.T) {
+	dest := filepath.Join(t.TempDir(), "render_01")
+	server := NewServer(&ServerConfig{
+		Logger:      logging.NewVaultLogger(hclog.Trace),
+		AgentConfig: &config.Config{},
+		WriteRetry: &WriteRetry{
+			Attempts:   2,
+			Backoff:    10 * time.Millisecond,
+			MaxBackoff: 10 * time.Millisecond,
+		},
+		EnableEventCh: true,
+	})
+	tmpl := &ctconfig.TemplateConfig{Destination: pointerutil.StringPtr(dest)}
+
+	// A directory in place of the destination can't be read or replaced
+	require.NoError(t, os.Mkdir(dest, 0o755))
+	_, err := server.writeTemplate(context.Background(), tmpl, []byte("rendered"))
+	require.Error(t, err)
+	select {
+	case event := <-server.EventCh:
+		require.Equal(t, WriteRetriesExhausted, event.Type)
+		require.Equal(t, dest, event.Destination)
+		require.Equal(t, 3, event.Attempts)
+		require.Error(t, event.Error)
+	default:
+		t.Fatal("expected a write retries exhausted event")
+	}
+
+	// The write succeeds once the directory is removed between retries
+	server.config.WriteRetry = &WriteRetry{
+		Attempts:   5,
+		Backoff:    100 * time.Millisecond,
+		MaxBackoff: 100 * time.Millisecond,
+	}
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		os.Remove(dest)
+	}()
+	_, err = server.writeTemplate(context.Background(), tmpl, []byte("rendered"))
+	require.NoError(t, err)
+	content, err := os.ReadFile(dest)
+	require.NoError(t, err)
+	require.Equal(t, "rendered", string(content))
+	event := <-server.EventCh
+	require.Equal(t, RenderChanged, event.Type)
+
+	// Permanent errors aren't retried
+	server.config.WriteRetry.Backoff = time.Hour
+	server.config.WriteRetry.MaxBackoff = time.Hour
+	_, err = server.writeTemplate(context.Background(), &ctconfig.TemplateConfig{
+		Destination: pointerutil.StringPtr(filepath.Join(dest+".missing", "render_02")),
+	}, []byte("rendered"))
+	require.ErrorIs(t, err, renderer.ErrNoParentDir)
+	require.Empty(t, server.EventCh)
+	require.True(t, isPermanentWriteError(&fs.PathError{Op: "open", Path: dest, Err: syscall.EACCES}))
+
+	// Waiting to retry stops once the context is done
+	require.NoError(t, os.Remove(dest))
+	require.NoError(t, os.Mkdir(dest, 0o755))
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(20*time.Millisecond, cancel)
+	start := time.Now()
+	_, err = server.writeTemplate(ctx, tmpl, []byte("rendered"))
+	require.Error(t, err)
+	require.Less(t, time.Since(start), 10*time.Second)
+	require.Empty(t, server.EventCh)
+}
+
+// TestServer_RenderChanged tests that an event summarizing the change is
+// emitted when a template's rendered contents change, and only then.
+func TestServer_RenderChanged(t *testing.T) {
+	dest := filepath.Join(t.TempDir(), "render_01")
+	server := NewServer(&ServerConfig{
+		Logger:        logging.NewVaultLogger(hclog.Trace),
+		AgentConfig:   &config.Config{},
+		EnableEventCh: true,
+	})
+	tmpl := &ctconfig.TemplateConfig{Destination: pointerutil.StringPtr(dest)}
+
+	expectEvent := func(created bool, added, removed int) {
+		t.Helper()
+		select {
+		case event := <-server.EventCh:
+			require.Equal(t, RenderChanged, event.Type)
+			require.Equal(t, dest, event.Destination)
+			require.Equal(t, created, event.Created)
+			require.Equal(t, added, event.LinesAdded)
+			require.Equal(t, removed, event.LinesRemoved)
+			require.NotContains(t, fmt.Sprintf("%#v", event), "s3cr3t")
+		default:
+			t.Fatal("expected a render changed event")
+		}
+	}
+
+	_, err := server.writeTemplate(context.Background(), tmpl, []byte("user=app\npassword=s3cr3t-1\n"))
+	require.NoError(t, err)
+	expectEvent(true, 2, 0)
+
+	_, err = server.writeTemplate(context.Background(), tmpl, []byte("user=app\npassword=s3cr3t-1\n"))
+	require.NoError(t, err)
+	require.Empty(t, server.EventCh)
+
+	_, err = server.writeTemplate(context.Background(), tmpl, []byte("password=s3cr3t-2\nuser=app\nport=5432\n"))
+	require.NoError(t, err)
+	expectEvent(false, 2, 1)
+}
+
+// TestServerRun_InvalidTokenInterval tests that invalid token errors from many
+// templates are coalesced, rather than each triggering re-authentication.
+func TestServerRun_InvalidTokenInterval(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v1/kv/", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(403)
+		fmt.Fprintln(w, `{"errors":["permission denied", "invalid token"]}`)
+	})
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	tmpDir := t.TempDir()
+	var templatesToRender []*ctconfig.TemplateConfig
+	for i := 0; i < 5; i++ {
+		templatesToRender = append(templatesToRender, &ctconfig.TemplateConfig{
+			Contents:    pointerutil.StringPtr(fmt.Sprintf(`{{ with secret "kv/myapp/%d" }}{{ end }}`, i)),
+			Destination: pointerutil.StringPtr(filepath.Join(tmpDir, fmt.Sprintf("render_%02d", i))),
+		})
+	}
+
+	server := NewServer(&ServerConfig{
+		Logger: logging.NewVaultLogger(hclog.Trace),
+		AgentConfig: &config.Config{
+			Vault: &config.Vault{
+				Address: ts.URL,
+				Retry: &config.Retry{
+					NumRetries: 3,
+				},
+			},
+			TemplateConfig: &config.TemplateConfig{},
+		},
+		LogLevel:             hclog.Trace,
+		LogWriter:            hclog.DefaultOutput,
+		InvalidTokenInterval: 2 * time.Second,
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	templateTokenCh := make(chan string, 1)
+	invalidTokenCh := make(chan error, 1)
+	errCh := make(chan error)
+	go func() {
+		errCh <- server.Run(ctx, templateTokenCh, templatesToRender, &sync.Bool{}, invalidTokenCh)
+	}()
+	templateTokenCh <- "test"
+
+	var signals int
+	for done := false; !done; {
+		select {
+		case <-invalidTokenCh:
+			signals++
+		case err := <-errCh:
+			require.NoError(t, err)
+			done = true
+		}
+	}
+
+	// One signal is sent immediately, and the remaining errors are coalesced
+	// into a single signal once the interval elapses
+	require.Equal(t, 2, signals)
+}
+
+// TestServerRun_InvalidTokenGrace tests that invalid token errors are only
+// signaled if the token still can't be looked up once the grace elapses.
+func TestServerRun_InvalidTokenGrace(t *testing.T) {
+	testCases := map[string]struct {
+		lookupStatus int
+		signals      int
+	}{
+		"valid token": {
+			lookupStatus: http.StatusOK,
+			signals:      0,
+		},
+		"invalid token": {
+			lookupStatus: http.StatusForbidden,
+			signals:      1,
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			mux := http.NewServeMux()
+			mux.HandleFunc("/v1/kv/", func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(403)
+				fmt.Fprintln(w, `{"errors":["permission denied", "invalid token"]}`)
+			})
+			mux.HandleFunc("/v1/auth/token/lookup-self", func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(tc.lookupStatus)
+				if tc.lookupStatus != http.StatusOK {
+					fmt.Fprintln(w, `{"errors":["permission denied"]}`)
+					return
+				}
+				fmt.Fprintln(w, `{"data":{"id":"test","ttl":3600}}`)
+			})
+			ts := httptest.NewServer(mux)
+			defer ts.Close()
+
+			client, err := api.NewClient(&api.Config{Address: ts.URL})
+			require.NoError(t, err)
+
+			server := NewServer(&ServerConfig{
+				Logger: logging.NewVaultLogger(hclog.Trace),
+				AgentConfig: &config.Config{
+					Vault: &config.Vault{
+						Address: ts.URL,
+						Retry: &config.Retry{
+							NumRetries: 3,
+						},
+					},
+					TemplateConfig: &config.TemplateConfig{},
+				},
+				LogLevel:          hclog.Trace,
+				LogWriter:         hclog.DefaultOutput,
+				Client:            client,
+				InvalidTokenGrace: 500 * time.Millisecond,
+			})
+
+			ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+			defer cancel()
+
+			templateTokenCh := make(chan string, 1)
+			invalidTokenCh := make(chan error, 1)
+			errCh := make(chan error)
+			templatesToRender := []*ctconfig.TemplateConfig{
+				{
+					Contents:    pointerutil.StringPtr(`{{ with secret "kv/myapp/config" }}{{ end }}`),
+					Destination: pointerutil.StringPtr(filepath.Join(t.TempDir(), "render_01")),
+				},
+			}
+			go func() {
+				errCh <- server.Run(ctx, templateTokenCh, templatesToRender, &sync.Bool{}, invalidTokenCh)
+			}()
+			templateTokenCh <- "test"
+
+			var signals int
+			for done := false; !done; {
+				select {
+				case <-invalidTokenCh:
+					signals++
+				case err := <-errCh:
+					require.NoError(t, err)
+					done = true
+				}
+			}
+			require.Equal(t, tc.signals, signals)
+		})
+	}
+}
+
+// TestServerRun_PreflightCapabilities tests that nothing is rendered, and Run
+// fails naming the paths, if the first token can't read every path in
+// PreflightCapabilities.
+func TestServerRun_PreflightCapabilities(t *testing.T) {
+	testCases := map[string]struct {
+		paths []string
+		err   string
+	}{
+		"can read": {
+			paths: []string{"kv-a/data/app", "kv-c/data/app"},
+		},
+		"can't read": {
+			paths: []string{"kv-a/data/app", "kv-b/data/app", "kv-c/data/app"},
+			err:   `token can't read "kv-b/data/app", its capabilities are [deny]`,
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				var body struct {
+					Path string `json:"path"`
+				}
+				if r.URL.Path != "/v1/sys/capabilities-self" || r.Header.Get("X-Vault-Token") != "test" || json.NewDecoder(r.Body).Decode(&body) != nil {
+					w.WriteHeader(http.StatusForbidden)
+					fmt.Fprintln(w, `{"errors":["permission denied"]}`)
+					return
+				}
+				capabilities := `["read", "list"]`
+				if strings.HasPrefix(body.Path, "kv-b/") {
+					capabilities = `["deny"]`
+				}
+				fmt.Fprintf(w, `{"data":{%q:%s,"capabilities":%s}}`, body.Path, capabilities, capabilities)
+			}))
+			defer ts.Close()
+
+			client, err := api.NewClient(&api.Config{Address: ts.URL})
+			require.NoError(t, err)
+
+			dest := filepath.Join(t.TempDir(), "render_01")
+			server := NewServer(&ServerConfig{
+				Logger:                logging.NewVaultLogger(hclog.Trace),
+				AgentConfig:           &config.Config{},
+				Renderer:              &staticRenderer{contents: "rendered"},
+				Client:                client,
+				ExitAfterAuth:         true,
+				PreflightCapabilities: tc.paths,
+			})
+
+			templateTokenCh := make(chan string, 1)
+			templateTokenCh <- "test"
+			err = server.Run(context.Background(), templateTokenCh, []*ctconfig.TemplateConfig{{Destination: pointerutil.StringPtr(dest)}}, &sync.Bool{}, make(chan error, 1))
+			if tc.err == "" {
+				require.NoError(t, err)
+				contents, err := os.ReadFile(dest)
+				require.NoError(t, err)
+				require.Equal(t, "rendered", string(contents))
+				return
+			}
+
+			require.ErrorContains(t, err, tc.err)
+			require.NotContains(t, err.Error(), "kv-a/")
+			require.NotContains(t, err.Error(), "kv-c/")
+			require.NoFileExists(t, dest)
+		})
+	}
+
+	server := NewServer(&ServerConfig{
+		Logger:                logging.NewVaultLogger(hclog.Trace),
+		AgentConfig:           &config.Config{},
+		Renderer:              &staticRenderer{contents: "rendered"},
+		PreflightCapabilities: []string{"kv-a/data/app"},
+	})
+	err := server.Run(context.Background(), make(chan string), []*ctconfig.TemplateConfig{{Destination: pointerutil.StringPtr(filepath.Join(t.TempDir(), "render_01"))}}, &sync.Bool{}, make(chan error, 1))
+	require.ErrorContains(t, err, "preflight capabilities require a client")
+}
+
+// TestServerRun_LookupSelfDenied tests that a token denied lookup-self fails
+// with a clear error at startup if templates rely on it, unless
+// disable_lookup_self is set.
+func TestServerRun_LookupSelfDenied(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/sys/capabilities-self" {
+			w.WriteHeader(http.StatusForbidden)
+			fmt.Fprintln(w, `{"errors":["permission denied"]}`)
+			return
+		}
+		fmt.Fprintln(w, `{"data":{"auth/token/lookup-self":["deny"],"capabilities":["deny"]}}`)
+	}))
+	defer ts.Close()
+
+	client, err := api.NewClient(&api.Config{Address: ts.URL})
+	require.NoError(t, err)
+
+	testCases := map[string]struct {
+		contents string
+		disabled bool
+		err      string
+	}{
+		"reads lookup-self": {
+			contents: `{{ with secret "auth/token/lookup-self" }}{{ .Data.id }}{{ end }}`,
+			err:      "the auto-auth token can't call auth/token/lookup-self",
+		},
+		"disabled": {
+			contents: `{{ with secret "auth/token/lookup-self" }}{{ .Data.id }}{{ end }}`,
+			disabled: true,
+		},
+		"doesn't read lookup-self": {
+			contents: `{{ with secret "kv/data/app" }}{{ .Data.data.foo }}{{ end }}`,
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			dest := filepath.Join(t.TempDir(), "render_01")
+			server := NewServer(&ServerConfig{
+				Logger: logging.NewVaultLogger(hclog.Trace),
+				AgentConfig: &config.Config{
+					TemplateConfig: &config.TemplateConfig{
+						DisableLookupSelf: tc.disabled,
+					},
+				},
+				Renderer:      &staticRenderer{contents: "rendered"},
+				Client:        client,
+				ExitAfterAuth: true,
+			})
+
+			templateTokenCh := make(chan string, 1)
+			templateTokenCh <- "test"
+			templates := []*ctconfig.TemplateConfig{{
+				Contents:    pointerutil.StringPtr(tc.contents),
+				Destination: pointerutil.StringPtr(dest),
+			}}
+			err = server.Run(context.Background(), templateTokenCh, templates, &sync.Bool{}, make(chan error, 1))
+			if tc.err != "" {
+				require.ErrorContains(t, err, tc.err)
+				require.ErrorContains(t, err, "disable_lookup_self")
+				require.NoFileExists(t, dest)
+				return
+			}
+			require.NoError(t, err)
+			require.FileExists(t, dest)
+		})
+	}
+}
+
+// recordingRenderer renders every template as the token it's rendered with,
+// recording the tokens.
+type recordingRenderer struct {
+	l      stdsync.Mutex
+	tokens []string
+}
+
+func (r *recordingRenderer) Render(_ context.Context, _ *ctconfig.TemplateConfig, token string) ([]byte, error) {
+	r.l.Lock()
+	defer r.l.Unlock()
+	r.tokens = append(r.tokens, token)
+	return []byte(token), nil
+}
+
+func (r *recordingRenderer) rendered() []string {
+	r.l.Lock()
+	defer r.l.Unlock()
+	return append([]string(nil), r.tokens...)
+}
+
+// TestServerRun_StaleTokenWindow tests that a token received again after it
+// has been replaced is ignored within the StaleTokenWindow, and used
+// otherwise.
+func TestServerRun_StaleTokenWindow(t *testing.T) {
+	testCases := map[string]struct {
+		window   time.Duration
+		sequence func(token string) (uint64, bool)
+		tokens   []string
+		rendered []string
+	}{
+		"window": {
+			window:   time.Minute,
+			tokens:   []string{"token-1", "token-2", "token-1", "token-3"},
+			rendered: []string{"token-1", "token-2", "token-3"},
+		},
+		"no window": {
+			tokens:   []string{"token-1", "token-2", "token-1", "token-3"},
+			rendered: []string{"token-1", "token-2", "token-1", "token-3"},
+		},
+		// token-1 was issued before token-2, but is first delivered after it
+		"auth handler order": {
+			window: time.Minute,
+			sequence: func(token string) (uint64, bool) {
+				seq, ok := map[string]uint64{"token-1": 1, "token-2": 2, "token-3": 3}[token]
+				return seq, ok
+			},
+			tokens:   []string{"token-2", "token-1", "token-3"},
+			rendered: []string{"token-2", "token-3"},
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			r := &recordingRenderer{}
+			server := NewServer(&ServerConfig{
+				Logger:           logging.NewVaultLogger(hclog.Trace),
+				AgentConfig:      &config.Config{},
+				Renderer:         r,
+				StaleTokenWindow: tc.window,
+				TokenSequence:    tc.sequence,
+			})
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			templateTokenCh := make(chan string)
+			errCh := make(chan error, 1)
+			dest := filepath.Join(t.TempDir(), "render_01")
+			go func() {
+				errCh <- server.Run(ctx, templateTokenCh, []*ctconfig.TemplateConfig{{Destination: pointerutil.StringPtr(dest)}}, &sync.Bool{}, make(chan error, 1))
+			}()
+
+			// The channel is unbuffered, so each token is handled before the
+			// next is received, and token-1 is delivered out of order
+			for _, token := range tc.tokens {
+				select {
+				case templateTokenCh <- token:
+				case err := <-errCh:
+					t.Fatalf("template server exited: %v", err)
+				}
+			}
+			require.Eventually(t, func() bool {
+				contents, err := os.ReadFile(dest)
+				return err == nil && string(contents) == "token-3"
+			}, 5*time.Second, 10*time.Millisecond)
+			require.Equal(t, tc.rendered, r.rendered())
+
+			cancel()
+			require.NoError(t, <-errCh)
+		})
+	}
+}
+
+// TestServerRun_OnTokenRenewed tests that OnTokenRenewed is called, with a
+// context marked renewed, when the token the templates were rendered with is
+// delivered again, and that they aren't rendered again.
+func TestServerRun_OnTokenRenewed(t *testing.T) {
+	r := &recordingRenderer{}
+	renewedCh := make(chan bool, 1)
+	server := NewServer(&ServerConfig{
+		Logger:      logging.NewVaultLogger(hclog.Trace),
+		AgentConfig: &config.Config{},
+		Renderer:    r,
+		OnTokenRenewed: func(ctx context.Context, token string) {
+			ctxToken, _ := hookcontext.Token(ctx)
+			renewedCh <- hookcontext.Renewed(ctx) && ctxToken == token
+		},
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	templateTokenCh := make(chan string)
+	errCh := make(chan error, 1)
+	dest := filepath.Join(t.TempDir(), "render_01")
+	go func() {
+		errCh <- server.Run(ctx, templateTokenCh, []*ctconfig.TemplateConfig{{Destination: pointerutil.StringPtr(dest)}}, &sync.Bool{}, make(chan error, 1))
+	}()
+
+	templateTokenCh <- "token-1"
+	templateTokenCh <- "token-1"
+	select {
+	case renewed := <-renewedCh:
+		require.True(t, renewed, "expected the context to be marked renewed and carry the token")
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for OnTokenRenewed")
+	}
+
+	cancel()
+	require.NoError(t, <-errCh)
+	require.Equal(t, []string{"token-1"}, r.rendered())
+}
+
+// TestTokenSequence tests that superseded tokens are only recognized within
+// the window.
+func TestTokenSequence(t *testing.T) {
+	now := time.Now()
+	s := newTokenSequence(time.Minute, nil)
+	require.True(t, s.adopt("token-1", now))
+	require.True(t, s.adopt("token-2", now))
+	require.False(t, s.adopt("token-1", now.Add(30*time.Second)))
+	require.True(t, s.adopt("token-3", now.Add(30*time.Second)))
+	require.False(t, s.adopt("token-2", now.Add(time.Minute)))
+
+	// token-1 was superseded over a minute ago, so it's new again
+	require.True(t, s.adopt("token-1", now.Add(90*time.Second)))
+	require.False(t, s.adopt("token-3", now.Add(90*time.Second)))
+
+	require.True(t, newTokenSequence(0, nil).adopt("token-1", now))
+}
+
+// TestTokenSequence_AuthHandler tests that tokens are ordered by the auth
+// handler's sequence numbers, so that an older token which hasn't been seen
+// before is recognized as superseded.
+func TestTokenSequence_AuthHandler(t *testing.T) {
+	sequences := map[string]uint64{"token-1": 1, "token-2": 2, "token-3": 3}
+	s := newTokenSequence(time.Minute, func(token string) (uint64, bool) {
+		seq, ok := sequences[token]
+		return seq, ok
+	})
+
+	now := time.Now()
+	require.True(t, s.adopt("token-2", now))
+	require.False(t, s.adopt("token-1", now.Add(30*time.Second)))
+	require.True(t, s.adopt("token-3", now.Add(30*time.Second)))
+	require.True(t, s.adopt("token-3", now.Add(40*time.Second)))
+
+	// Tokens the auth handler doesn't know are used as they are
+	require.True(t, s.adopt("other", now.Add(40*time.Second)))
+	require.False(t, s.adopt("token-2", now.Add(40*time.Second)))
+
+	// token-1 was superseded over a minute ago
+	require.True(t, s.adopt("token-1", now.Add(90*time.Second)))
+}
+
+// TestErrorPolicy tests classification of Vault errors, and that the default
+// policy only re-authenticates on invalid tokens.
+func TestErrorPolicy(t *testing.T) {
+	testCases := map[string]struct {
+		err      error
+		category ErrorCategory
+		action   ErrorAction
+	}{
+		"invalid token": {
+			err:      &api.ResponseError{StatusCode: 403, Errors: []string{"permission denied", "invalid token"}},
+			category: ErrorCategoryInvalidToken,
+			action:   ErrorActionReauth,
+		},
+		"permission denied": {
+			err:      &api.ResponseError{StatusCode: 403, Errors: []string{"permission denied"}},
+			category: ErrorCategoryPermissionDenied,
+			action:   ErrorActionRetry,
+		},
+		"not found": {
+			err:      fmt.Errorf("wrapped: %w", &api.ResponseError{StatusCode: 404}),
+			category: ErrorCategoryNotFound,
+			action:   ErrorActionRetry,
+		},
+		"other": {
+			err:      errors.New("connection refused"),
+			category: ErrorCategoryOther,
+			action:   ErrorActionRetry,
+		},
+		"missing key": {
+			err:      errors.New(`template: render:4:18: executing "render" at <.Data.data.foo>: map has no entry for key "foo"`),
+			category: ErrorCategoryMissingKey,
+			action:   ErrorActionRetry,
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			category := ClassifyError(tc.err)
+			require.Equal(t, tc.category, category)
+
+			var policy *ErrorPolicy
+			require.Equal(t, tc.action, policy.Action(category))
+			require.Equal(t, tc.action, (&ErrorPolicy{}).Action(category))
+		})
+	}
+
+	policy := &ErrorPolicy{PermissionDenied: ErrorActionReauth}
+	require.Equal(t, ErrorActionReauth, policy.Action(ErrorCategoryPermissionDenied))
+	require.Equal(t, ErrorActionRetry, policy.Action(ErrorCategoryNotFound))
+
+	policy = &ErrorPolicy{Other: ErrorActionReauth}
+	require.Equal(t, ErrorActionRetry, policy.Action(ErrorCategoryMissingKey))
+}
+
+// TestServerRun_ErrMissingKey tests that with ErrMissingKey set on the
+// ServerConfig, a template referencing a missing key fails to render rather
+// than writing its destination, and is retried without re-authenticating.
+func TestServerRun_ErrMissingKey(t *testing.T) {
+	ts := createHttpTestServer()
+	defer ts.Close()
+
+	dstFile := filepath.Join(t.TempDir(), "render_01")
+	templatesToRender := []*ctconfig.TemplateConfig{
+		{
+			Contents:    pointerutil.StringPtr(templateContentsMissingKey),
+			Destination: pointerutil.StringPtr(dstFile),
+		},
+	}
+
+	newServer := func(exitOnRetryFailure bool) *Server {
+		return NewServer(&ServerConfig{
+			Logger: logging.NewVaultLogger(hclog.Trace),
+			AgentConfig: &config.Config{
+				Vault: &config.Vault{
+					Address: ts.URL,
+					Retry: &config.Retry{
+						NumRetries: 3,
+					},
+				},
+				TemplateConfig: &config.TemplateConfig{
+					ExitOnRetryFailure: exitOnRetryFailure,
+				},
+			},
+			LogLevel:      hclog.Trace,
+			LogWriter:     hclog.DefaultOutput,
+			ExitAfterAuth: true,
+			ErrMissingKey: true,
+		})
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+
+	templateTokenCh := make(chan string, 1)
+	templateTokenCh <- "test"
+	err := newServer(true).Run(ctx, templateTokenCh, templatesToRender, &sync.Bool{}, make(chan error, 1))
+	require.Error(t, err)
+	require.Equal(t, ErrorCategoryMissingKey, ClassifyError(err))
+	_, err = os.Stat(dstFile)
+	require.True(t, os.IsNotExist(err), "expected %s not to have been written", dstFile)
+
+	// Without exit_on_retry_failure, the render is retried until the context
+	// is done, and re-authentication isn't requested
+	retryCtx, retryCancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer retryCancel()
+
+	templateTokenCh <- "test"
+	invalidTokenCh := make(chan error, 1)
+	err = newServer(false).Run(retryCtx, templateTokenCh, templatesToRender, &sync.Bool{}, invalidTokenCh)
+	require.NoError(t, err)
+	require.Empty(t, invalidTokenCh)
+	_, err = os.Stat(dstFile)
+	require.True(t, os.IsNotExist(err), "expected %s not to have been written", dstFile)
+}
+
+// TestServerRun_ErrorPolicyFail tests that the server stops when it receives
+// an error the policy says should fail.
+func TestServerRun_ErrorPolicyFail(t *testing.T) {
+	ts := createHttpTestServer()
+	defer ts.Close()
+
+	server := NewServer(&ServerConfig{
+		Logger: logging.NewVaultLogger(hclog.Trace),
+		AgentConfig: &config.Config{
+			Vault: &config.Vault{
+				Address: ts.URL,
+				Retry: &config.Retry{
+					NumRetries: 3,
+				},
+			},
+			TemplateConfig: &config.TemplateConfig{},
+		},
+		LogLevel:  hclog.Trace,
+		LogWriter: hclog.DefaultOutput,
+		ErrorPolicy: &ErrorPolicy{
+			PermissionDenied: ErrorActionFail,
+		},
+	})
+
+	templatesToRender := []*ctconfig.TemplateConfig{
+		{
+			Contents:    pointerutil.StringPtr(templateContentsPermDenied),
+			Destination: pointerutil.StringPtr(filepath.Join(t.TempDir(), "render_01")),
+		},
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	templateTokenCh := make(chan string, 1)
+	templateTokenCh <- "test"
+	err := server.Run(ctx, templateTokenCh, templatesToRender, &sync.Bool{}, make(chan error, 1))
+	require.Error(t, err)
+	require.Equal(t, ErrorCategoryPermissionDenied, ClassifyError(err))
+}
+
+// TestServerRenderOnce tests that templates can be rendered a single time
+// with a given token, and that errors which would normally trigger
+// re-authentication are returned.
+func TestServerRenderOnce(t *testing.T) {
+	ts := createHttpTestServer()
+	defer ts.Close()
+
+	server := NewServer(&ServerConfig{
+		Logger: logging.NewVaultLogger(hclog.Trace),
+		AgentConfig: &config.Config{
+			Vault: &config.Vault{
+				Address: ts.URL,
+				Retry: &config.Retry{
+					NumRetries: 3,
+				},
+			},
+			TemplateConfig: &config.TemplateConfig{},
+		},
+		LogLevel:  hclog.Trace,
+		LogWriter: hclog.DefaultOutput,
+		ErrorPolicy: &ErrorPolicy{
+			PermissionDenied: ErrorActionReauth,
+		},
+	})
+
+	tmpDir := t.TempDir()
+	templatesToRender := []*ctconfig.TemplateConfig{
+		{
+			Contents:    pointerutil.StringPtr(templateContents),
+			Destination: pointerutil.StringPtr(filepath.Join(tmpDir, "render_01")),
+		},
+		{
+			Contents:    pointerutil.StringPtr(templateContents),
+			Destination: pointerutil.StringPtr(filepath.Join(tmpDir, "render_02")),
+		},
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	err := server.RenderOnce(ctx, "test", templatesToRender)
+	require.NoError(t, err)
+	require.NoError(t, ctx.Err(), "expected templates to render before the context expired")
+	for _, tmpl := range templatesToRender {
+		content, err := os.ReadFile(*tmpl.Destination)
+		require.NoError(t, err)
+		require.Contains(t, string(content), `"username":"appuser"`)
+	}
+
+	err = server.RenderOnce(ctx, "test", []*ctconfig.TemplateConfig{
+		{
+			Contents:    pointerutil.StringPtr(templateContentsPermDenied),
+			Destination: pointerutil.StringPtr(filepath.Join(tmpDir, "render_03")),
+		},
+	})
+	require.Error(t, err)
+	require.Equal(t, ErrorCategoryPermissionDenied, ClassifyError(err))
+
+	require.Error(t, server.RenderOnce(ctx, "", templatesToRender))
+}
+
+// TestServerRun_StartupRenderDeadline tests that the server fails if templates
+// haven't rendered before the startup render deadline, but keeps running once
+// they have.
+func TestServerRun_StartupRenderDeadline(t *testing.T) {
+	ts := createHttpTestServer()
+	defer ts.Close()
+
+	newServer := func() *Server {
+		return NewServer(&ServerConfig{
+			Logger: logging.NewVaultLogger(hclog.Trace),
+			AgentConfig: &config.Config{
+				Vault: &config.Vault{
+					Address: ts.URL,
+					Retry: &config.Retry{
+						NumRetries: 3,
+					},
+				},
+				TemplateConfig: &config.TemplateConfig{},
+			},
+			LogLevel:              hclog.Trace,
+			LogWriter:             hclog.DefaultOutput,
+			StartupRenderDeadline: time.Second,
+		})
+	}
+
+	templatesToRender := []*ctconfig.TemplateConfig{
+		{
+			Contents:    pointerutil.StringPtr(templateContents),
+			Destination: pointerutil.StringPtr(filepath.Join(t.TempDir(), "render_01")),
+		},
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	// Without a token, nothing can be rendered
+	err := newServer().Run(ctx, make(chan string), templatesToRender, &sync.Bool{}, make(chan error, 1))
+	require.ErrorContains(t, err, "not all templates rendered within 1s")
+	require.NoError(t, ctx.Err())
+
+	// Once rendered, the server carries on past the deadline
+	runCtx, runCancel := context.WithTimeout(ctx, 3*time.Second)
+	defer runCancel()
+	templateTokenCh := make(chan string, 1)
+	templateTokenCh <- "test"
+	err = newServer().Run(runCtx, templateTokenCh, templatesToRender, &sync.Bool{}, make(chan error, 1))
+	require.NoError(t, err)
+	require.ErrorIs(t, runCtx.Err(), context.DeadlineExceeded)
+	content, err := os.ReadFile(*templatesToRender[0].Destination)
+	require.NoError(t, err)
+	require.Contains(t, string(content), `"username":"appuser"`)
+}
+
+// TestServerRun_ReadyCh tests that ReadyCh is closed once every template has
+// been rendered, with both the runner and a custom Renderer.
+func TestServerRun_ReadyCh(t *testing.T) {
+	ts := createHttpTestServer()
+	defer ts.Close()
+
+	for name, renderer := range map[string]Renderer{
+		"runner":   nil,
+		"renderer": &staticRenderer{contents: "rendered"},
+	} {
+		t.Run(name, func(t *testing.T) {
+			server := NewServer(&ServerConfig{
+				Logger: logging.NewVaultLogger(hclog.Trace),
+				AgentConfig: &config.Config{
+					Vault: &config.Vault{
+						Address: ts.URL,
+						Retry: &config.Retry{
+							NumRetries: 3,
+						},
+					},
+					TemplateConfig: &config.TemplateConfig{},
+				},
+				LogLevel:  hclog.Trace,
+				LogWriter: hclog.DefaultOutput,
+				Renderer:  renderer,
+			})
+
+			tmpDir := t.TempDir()
+			templatesToRender := []*ctconfig.TemplateConfig{
+				{
+					Contents:    pointerutil.StringPtr(templateContents),
+					Destination: pointerutil.StringPtr(filepath.Join(tmpDir, "render_01")),
+				},
+				{
+					Contents:    pointerutil.StringPtr(templateContents + "\n"),
+					Destination: pointerutil.StringPtr(filepath.Join(tmpDir, "render_02")),
+				},
+			}
+
+			ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+			defer cancel()
+
+			templateTokenCh := make(chan string, 1)
+			errCh := make(chan error, 1)
+			go func() {
+				errCh <- server.Run(ctx, templateTokenCh, templatesToRender, &sync.Bool{}, make(chan error, 1))
+			}()
+
+			// Nothing can be rendered without a token
+			select {
+			case <-server.ReadyCh:
+				t.Fatal("ReadyCh closed before templates were rendered")
+			case <-time.After(500 * time.Millisecond):
+			}
+
+			templateTokenCh <- "test"
+			select {
+			case <-server.ReadyCh:
+			case err := <-errCh:
+				t.Fatalf("server exited: %v", err)
+			case <-ctx.Done():
+				t.Fatal("timed out waiting for ReadyCh")
+			}
+			for _, tmpl := range templatesToRender {
+				_, err := os.Stat(*tmpl.Destination)
+				require.NoError(t, err)
+			}
+
+			cancel()
+			require.NoError(t, <-errCh)
+		})
+	}
+}
+
+var jsonResponse = `
+{
+  "request_id": "8af096e9-518c-7351-eff5-5ba20554b21f",
+  "lease_id": "",
+  "renewable": false,
+  "lease_duration": 0,
+  "data": {
+    "data": {
+      "password": "password",
+      "username": "appuser"
+    },
+    "metadata": {
+      "created_time": "2019-10-07T22:18:44.233247Z",
+      "deletion_time": "",
+      "destroyed": false,
+      "version": 3
+    }
+  },
+  "wrap_info": null,
+  "warnings": null,
+  "auth": null
+}
+`
+
+var templateContents = `
+{{ with secret "kv/myapp/config"}}
+{
+{{ if .Data.data.username}}"username":"{{ .Data.data.username}}",{{ end }}
+{{ if .Data.data.password }}"password":"{{ .Data.data.password }}",{{ end }}
+{{ if .Data.metadata.version}}"version":"{{ .Data.metadata.version }}"{{ end }}
+}
+{{ end }}
+`
+
+var templateContentsMissingKey = `
+{{ with secret "kv/myapp/config"}}
+{
+{{ if .Data.data.foo}}"foo":"{{ .Data.data.foo}}"{{ end }}
+}
+{{ end }}
+`
+
+var templateContentsBad = `
+{{ with secret "kv/myapp/config-bad"}}
+{
+{{ if .Data.data.username}}"username":"{{ .Data.data.username}}",{{ end }}
+{{ if .Data.data.password }}"password":"{{ .Data.data.password }}",{{ end }}
+{{ if .Data.metadata.version}}"version":"{{ .Data.metadata.version }}"{{ end }}
+}
+{{ end }}
+`
+
+var templateContentsPermDenied = `
+{{ with secret "kv/myapp/perm-denied"}}
+{
+{{ if .Data.data.username}}"username":"{{ .Data.data.username}}",{{ end }}
+{{ if .Data.data.password }}"password":"{{ .Data.data.password }}",{{ end }}
+{{ if .Data.metadata.version}}"version":"{{ .Data.metadata.version }}"{{ end }}
+}
+{{ end }}
+`
+
+var templateContentsWithSprigFunctions = `
+{{ with secret "kv/myapp/config"}}
+{
+{{ if .Data.data.username}}"username":"{{ .Data.data.username | sprig_upper }}",{{ end }}
+{{ if .Data.data.password }}"password":"{{ .Data.data.password | sprig_replace "word" "phrase" }}",{{ end }}
+{{ if .Data.metadata.version}}"version":"{{ .Data.metadata.version }}"{{ end }}
+}
+{{ end }}
+`
+
+var templateContentsWithCustomDelims = `
+[[ with secret "kv/myapp/config"]]
+{
+[[ if .Data.data.username]]"username":"[[ .Data.data.username]]",[[ end ]]
+[[ if .Data.data.password ]]"password":"[[ .Data.data.password ]]",[[ end ]]
+[[ if .Data.metadata.version]]"version":"[[ .Data.metadata.version ]]",[[ end ]]
+"downstream":"{{ .Values.username }}"
+}
+[[ end ]]
+`
+
+// TestServerRun_TemplateFuncs tests that functions from the ServerConfig can
+// be used by templates, and that ones replacing built-in functions are
+// rejected.
+func TestServerRun_TemplateFuncs(t *testing.T) {
+	ts := createHttpTestServer()
+	defer ts.Close()
+
+	newServer := func(funcs texttemplate.FuncMap) *Server {
+		return NewServer(&ServerConfig{
+			Logger: logging.NewVaultLogger(hclog.Trace),
+			AgentConfig: &config.Config{
+				Vault: &config.Vault{
+					Address: ts.URL,
+					Retry: &config.Retry{
+						NumRetries: 3,
+					},
+				},
+				TemplateConfig: &config.TemplateConfig{
+					ExitOnRetryFailure: true,
+				},
+			},
+			LogLevel:      hclog.Trace,
+			LogWriter:     hclog.DefaultOutput,
+			ExitAfterAuth: true,
+			TemplateFuncs: funcs,
+		})
+	}
+
+	dstFile := filepath.Join(t.TempDir(), "render_01")
+	templatesToRender := []*ctconfig.TemplateConfig{
+		{
+			Contents:    pointerutil.StringPtr(`{{ with secret "kv/myapp/config" }}{{ .Data.data.username | base64url }}{{ end }}`),
+			Destination: pointerutil.StringPtr(dstFile),
+		},
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+
+	templateTokenCh := make(chan string, 1)
+	templateTokenCh <- "test"
+	server := newServer(texttemplate.FuncMap{
+		"base64url": func(s string) string {
+			return base64.URLEncoding.EncodeToString([]byte(s))
+		},
+	})
+	err := server.Run(ctx, templateTokenCh, templatesToRender, &sync.Bool{}, make(chan error, 1))
+	require.NoError(t, err)
+	content, err := os.ReadFile(dstFile)
+	require.NoError(t, err)
+	require.Equal(t, base64.URLEncoding.EncodeToString([]byte("appuser")), string(content))
+
+	for name, fn := range map[string]interface{}{
+		"secret":      func() string { return "" },
+		"sprig_upper": func() string { return "" },
+		"printf":      func() string { return "" },
+		"bad-name":    func() string { return "" },
+		"notAFunc":    "value",
+	} {
+		err := newServer(texttemplate.FuncMap{name: fn}).Run(ctx, templateTokenCh, templatesToRender, &sync.Bool{}, make(chan error, 1))
+		require.Error(t, err, name)
+		require.Contains(t, err.Error(), fmt.Sprintf("%q", name))
+	}
+}
+
+// TestServerRun_CompositeTemplate tests that the sections of a composite
+// template are rendered, in order, into its destination.
+func TestServerRun_CompositeTemplate(t *testing.T) {
+	ts := createHttpTestServer()
+	defer ts.Close()
+
+	tmpDir := t.TempDir()
+	source := filepath.Join(tmpDir, "credentials.tmpl")
+	require.NoError(t, os.WriteFile(source, []byte(`{{ with secret "kv/myapp/config" }}password = {{ .Data.data.password }}{{ end }}`), 0o600))
+	dest := filepath.Join(tmpDir, "app.conf")
+
+	newServer := func(composite *CompositeTemplate) *Server {
+		return NewServer(&ServerConfig{
+			Logger: logging.NewVaultLogger(hclog.Trace),
+			AgentConfig: &config.Config{
+				Vault: &config.Vault{
+					Address: ts.URL,
+					Retry: &config.Retry{
+						NumRetries: 3,
+					},
+				},
+				TemplateConfig: &config.TemplateConfig{
+					ExitOnRetryFailure: true,
+				},
+			},
+			LogLevel:           hclog.Trace,
+			LogWriter:          hclog.DefaultOutput,
+			ExitAfterAuth:      true,
+			CompositeTemplates: []*CompositeTemplate{composite},
+		})
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+
+	templateTokenCh := make(chan string, 1)
+	templateTokenCh <- "test"
+	server := newServer(&CompositeTemplate{
+		Template: &ctconfig.TemplateConfig{
+			Destination: pointerutil.StringPtr(dest),
+			Perms:       ctconfig.FileMode(0o600),
+		},
+		Sections: []*CompositeSection{
+			{Name: "header", Contents: "[app]"},
+			{Name: "username", Contents: `{{ with secret "kv/myapp/config" }}username = {{ .Data.data.username }}{{ end }}`},
+			{Name: "password", Source: source},
+		},
+		Separator: "\n",
+	})
+	require.NoError(t, server.Run(ctx, templateTokenCh, nil, &sync.Bool{}, make(chan error, 1)))
+	content, err := os.ReadFile(dest)
+	require.NoError(t, err)
+	require.Equal(t, "[app]\nusername = appuser\npassword = password", string(content))
+
+	for name, composite := range map[string]*CompositeTemplate{
+		"no sections": {
+			Template: &ctconfig.TemplateConfig{Destination: pointerutil.StringPtr(dest)},
+		},
+		"duplicate section": {
+			Template: &ctconfig.TemplateConfig{Destination: pointerutil.StringPtr(dest)},
+			Sections: []*CompositeSection{{Name: "a", Contents: "a"}, {Name: "a", Contents: "b"}},
+		},
+		"contents and source": {
+			Template: &ctconfig.TemplateConfig{Destination: pointerutil.StringPtr(dest)},
+			Sections: []*CompositeSection{{Name: "a", Contents: "a", Source: source}},
+		},
+		"template contents": {
+			Template: &ctconfig.TemplateConfig{Destination: pointerutil.StringPtr(dest), Contents: pointerutil.StringPtr("a")},
+			Sections: []*CompositeSection{{Name: "a", Contents: "a"}},
+		},
+	} {
+		err := newServer(composite).Run(ctx, templateTokenCh, nil, &sync.Bool{}, make(chan error, 1))
+		require.ErrorContains(t, err, "composite template", name)
+	}
+}
+
+// TestServerAddRemoveTemplate tests that templates can be added to and removed
+// from a running server using a custom Renderer.
+func TestServerAddRemoveTemplate(t *testing.T) {
+	tmpDir := t.TempDir()
+	dstFile1 := filepath.Join(tmpDir, "render_01")
+	dstFile2 := filepath.Join(tmpDir, "render_02")
+
+	server := NewServer(&ServerConfig{
+		Logger:                    logging.NewVaultLogger(hclog.Trace),
+		AgentConfig:               &config.Config{},
+		Renderer:                  &staticRenderer{contents: "rendered"},
+		DeleteRemovedDestinations: true,
+	})
+	require.ErrorIs(t, server.RemoveTemplate(dstFile1), ErrServerNotRunning)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+
+	templateTokenCh := make(chan string, 1)
+	templateTokenCh <- "test"
+	templatesToRender := []*ctconfig.TemplateConfig{
+		{
+			Contents:    pointerutil.StringPtr("unused"),
+			Destination: pointerutil.StringPtr(dstFile1),
+		},
+	}
+	errCh := make(chan error)
+	go func() {
+		errCh <- server.Run(ctx, templateTokenCh, templatesToRender, &sync.Bool{}, make(chan error, 1))
+	}()
+	require.Eventually(t, func() bool {
+		_, err := os.Stat(dstFile1)
+		return err == nil
+	}, 10*time.Second, 50*time.Millisecond)
+
+	// Added templates are rendered straight away
+	tmpl := &ctconfig.TemplateConfig{
+		Contents:    pointerutil.StringPtr("unused"),
+		Destination: pointerutil.StringPtr(dstFile2),
+	}
+	require.NoError(t, server.AddTemplate(tmpl))
+	content, err := os.ReadFile(dstFile2)
+	require.NoError(t, err)
+	require.Equal(t, "rendered", string(content))
+	require.ErrorContains(t, server.AddTemplate(tmpl), "already managed")
+
+	require.NoError(t, server.RemoveTemplate(dstFile1))
+	_, err = os.Stat(dstFile1)
+	require.True(t, os.IsNotExist(err), "expected %s to have been deleted", dstFile1)
+	require.ErrorContains(t, server.RemoveTemplate(dstFile1), "not managed")
+
+	cancel()
+	require.NoError(t, <-errCh)
+	require.ErrorIs(t, server.AddTemplate(tmpl), ErrServerNotRunning)
+}
+
+// TestServerAddRemoveTemplate_Runner tests that templates can be added to and
+// removed from a running server using the consul-template runner, and that
+// the runner restarting to do so fetches the other templates' secrets again,
+// but doesn't rewrite their destinations if they're unchanged.
+func TestServerAddRemoveTemplate_Runner(t *testing.T) {
+	var reads sync.Int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/kv/myapp/config" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		reads.Add(1)
+		fmt.Fprintln(w, jsonResponse)
+	}))
+	defer ts.Close()
+
+	tmpDir := t.TempDir()
+	dstFile1 := filepath.Join(tmpDir, "render_01")
+	dstFile2 := filepath.Join(tmpDir, "render_02")
+
+	server := NewServer(&ServerConfig{
+		Logger: logging.NewVaultLogger(hclog.Trace),
+		AgentConfig: &config.Config{
+			Vault: &config.Vault{
+				Address: ts.URL,
+				Retry: &config.Retry{
+					NumRetries: 3,
+				},
+			},
+			TemplateConfig: &config.TemplateConfig{},
+		},
+		LogLevel:  hclog.Trace,
+		LogWriter: hclog.DefaultOutput,
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+
+	templateTokenCh := make(chan string, 1)
+	templateTokenCh <- "test"
+	templatesToRender := []*ctconfig.TemplateConfig{
+		{
+			Contents:    pointerutil.StringPtr(templateContents),
+			Destination: pointerutil.StringPtr(dstFile1),
+		},
+	}
+	errCh := make(chan error)
+	go func() {
+		errCh <- server.Run(ctx, templateTokenCh, templatesToRender, &sync.Bool{}, make(chan error, 1))
+	}()
+
+	rendered := func(path string) func() bool {
+		return func() bool {
+			content, err := os.ReadFile(path)
+			return err == nil && strings.Contains(string(content), `"username":"appuser"`)
+		}
+	}
+	require.Eventually(t, rendered(dstFile1), 10*time.Second, 50*time.Millisecond)
+	before, err := os.Stat(dstFile1)
+	require.NoError(t, err)
+	readsBefore := reads.Load()
+
+	require.NoError(t, server.AddTemplate(&ctconfig.TemplateConfig{
+		Contents:    pointerutil.StringPtr(templateContents),
+		Destination: pointerutil.StringPtr(dstFile2),
+	}))
+	require.Eventually(t, rendered(dstFile2), 10*time.Second, 50*time.Millisecond)
+
+	// The new runner fetched the secret again, but the first destination is
+	// left as it was, as its contents didn't change
+	require.Greater(t, reads.Load(), readsBefore)
+	after, err := os.Stat(dstFile1)
+	require.NoError(t, err)
+	require.True(t, os.SameFile(before, after), "expected %s not to have been rewritten", dstFile1)
+	require.Equal(t, before.ModTime(), after.ModTime())
+
+	// The destination is left in place by default
+	require.NoError(t, server.RemoveTemplate(dstFile1))
+	_, err = os.Stat(dstFile1)
+	require.NoError(t, err)
+	require.ErrorContains(t, server.RemoveTemplate(dstFile1), "not managed")
+
+	cancel()
+	require.NoError(t, <-errCh)
+}
+
+// TestServerDependencies tests that the dependencies of a template rendered
+// by the runner can be listed by its destination.
+func TestServerDependencies(t *testing.T) {
+	ts := createHttpTestServer()
+	defer ts.Close()
+
+	dstFile := filepath.Join(t.TempDir(), "render_01")
+
+	server := NewServer(&ServerConfig{
+		Logger: logging.NewVaultLogger(hclog.Trace),
+		AgentConfig: &config.Config{
+			Vault: &config.Vault{
+				Address: ts.URL,
+				Retry: &config.Retry{
+					NumRetries: 3,
+				},
+			},
+			TemplateConfig: &config.TemplateConfig{},
+		},
+		LogLevel:  hclog.Trace,
+		LogWriter: hclog.DefaultOutput,
+	})
+
+	_, err := server.Dependencies(dstFile)
+	require.ErrorIs(t, err, ErrServerNotRunning)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+
+	templateTokenCh := make(chan string, 1)
+	templateTokenCh <- "test"
+	templatesToRender := []*ctconfig.TemplateConfig{
+		{
+			Contents:    pointerutil.StringPtr(templateContents),
+			Destination: pointerutil.StringPtr(dstFile),
+		},
+	}
+	errCh := make(chan error)
+	go func() {
+		errCh <- server.Run(ctx, templateTokenCh, templatesToRender, &sync.Bool{}, make(chan error, 1))
+	}()
+
+	require.Eventually(t, func() bool {
+		deps, err := server.Dependencies(dstFile)
+		return err == nil && len(deps) > 0
+	}, 10*time.Second, 50*time.Millisecond)
+
+	deps, err := server.Dependencies(dstFile)
+	require.NoError(t, err)
+	require.Equal(t, []string{"vault.read(kv/myapp/config)"}, deps)
+
+	_, err = server.Dependencies(filepath.Join(t.TempDir(), "other"))
+	require.ErrorContains(t, err, "not managed")
+
+	cancel()
+	require.NoError(t, <-errCh)
+}
+
+// TestServerRun_ReactiveRender tests that a template reading a KV v2 secret is
+// rendered again soon after a new version of the secret is written, well
+// before the static secret render interval elapses.
+func TestServerRun_ReactiveRender(t *testing.T) {
+	var version sync.Int64
+	version.Store(1)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v1/sys/internal/ui/mounts/secret/data/app", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, `{"data":{"path":"secret/","type":"kv","options":{"version":"2"}}}`)
+	})
+	mux.HandleFunc("/v1/secret/data/app", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, `{"data":{"data":{"password":"pass-%[1]d"},"metadata":{"version":%[1]d}}}`, version.Load())
+	})
+	mux.HandleFunc("/v1/secret/metadata/app", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, `{"data":{"current_version":%d}}`, version.Load())
+	})
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	client, err := api.NewClient(&api.Config{Address: ts.URL})
+	require.NoError(t, err)
+
+	dstFile := filepath.Join(t.TempDir(), "render_01")
+	server := NewServer(&ServerConfig{
+		Logger: logging.NewVaultLogger(hclog.Trace),
+		AgentConfig: &config.Config{
+			Vault: &config.Vault{
+				Address: ts.URL,
+				Retry: &config.Retry{
+					NumRetries: 3,
+				},
+			},
+			TemplateConfig: &config.TemplateConfig{
+				StaticSecretRenderInt: time.Hour,
+			},
+		},
+		LogLevel:               hclog.Trace,
+		LogWriter:              hclog.DefaultOutput,
+		Client:                 client,
+		ReactiveRender:         true,
+		ReactiveRenderInterval: 100 * time.Millisecond,
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+
+	templateTokenCh := make(chan string, 1)
+	templateTokenCh <- "test"
+	templatesToRender := []*ctconfig.TemplateConfig{
+		{
+			Contents:    pointerutil.StringPtr(`{{ with secret "secret/data/app" }}{{ .Data.data.password }}{{ end }}`),
+			Destination: pointerutil.StringPtr(dstFile),
+		},
+	}
+	errCh := make(chan error)
+	go func() {
+		errCh <- server.Run(ctx, templateTokenCh, templatesToRender, &sync.Bool{}, make(chan error, 1))
+	}()
+
+	rendered := func(contents string) func() bool {
+		return func() bool {
+			content, err := os.ReadFile(dstFile)
+			return err == nil && string(content) == contents
+		}
+	}
+	require.Eventually(t, rendered("pass-1"), 10*time.Second, 50*time.Millisecond)
+
+	// Give the server time to see the first version
+	time.Sleep(500 * time.Millisecond)
+	version.Store(2)
+	require.Eventually(t, rendered("pass-2"), 10*time.Second, 50*time.Millisecond)
+
+	cancel()
+	require.NoError(t, <-errCh)
+}
+
+// TestServerRun_ReactiveRenderNoClient tests that Run fails if ReactiveRender
+// is set without a client to check secret versions with.
+func TestServerRun_ReactiveRenderNoClient(t *testing.T) {
+	server := NewServer(&ServerConfig{
+		Logger:         logging.NewVaultLogger(hclog.Trace),
+		AgentConfig:    &config.Config{Vault: &config.Vault{}},
+		ReactiveRender: true,
+	})
+	templatesToRender := []*ctconfig.TemplateConfig{
+		{
+			Contents:    pointerutil.StringPtr(templateContents),
+			Destination: pointerutil.StringPtr(filepath.Join(t.TempDir(), "render_01")),
+		},
+	}
+	err := server.Run(context.Background(), make(chan string), templatesToRender, &sync.Bool{}, make(chan error, 1))
+	require.ErrorContains(t, err, "requires a client")
+}
+
+// namespaceRenderer renders every template as the namespace of the client
+// it's rendered with.
+type namespaceRenderer struct{}
+
+func (namespaceRenderer) Render(ctx context.Context, _ *ctconfig.TemplateConfig, _ string) ([]byte, error) {
+	client, ok := hookcontext.Client(ctx)
+	if !ok {
+		return nil, errors.New("no client")
+	}
+	return []byte(client.Namespace()), nil
+}
+
+// TestServerRun_TemplateNamespaces tests that templates with a namespace in
+// TemplateNamespaces are rendered in it, and the rest in the Server's own
+// Namespace.
+func TestServerRun_TemplateNamespaces(t *testing.T) {
+	client, err := api.NewClient(&api.Config{Address: "http://127.0.0.1:8200"})
+	require.NoError(t, err)
+
+	dir := t.TempDir()
+	templates := make([]*ctconfig.TemplateConfig, 3)
+	for i := range templates {
+		templates[i] = &ctconfig.TemplateConfig{Destination: pointerutil.StringPtr(filepath.Join(dir, fmt.Sprintf("render_%02d", i)))}
+	}
+	server := NewServer(&ServerConfig{
+		Logger:        logging.NewVaultLogger(hclog.Trace),
+		AgentConfig:   &config.Config{},
+		Renderer:      namespaceRenderer{},
+		Client:        client,
+		ExitAfterAuth: true,
+		Namespace:     "base/",
+		TemplateNamespaces: map[*ctconfig.TemplateConfig]string{
+			templates[0]: "tenant-a/",
+			templates[2]: "tenant-b/",
+		},
+	})
+
+	templateTokenCh := make(chan string, 1)
+	templateTokenCh <- "test"
+	err = server.Run(context.Background(), templateTokenCh, templates, &sync.Bool{}, make(chan error, 1))
+	require.NoError(t, err)
+
+	for i, namespace := range []string{"tenant-a/", "base/", "tenant-b/"} {
+		contents, err := os.ReadFile(*templates[i].Destination)
+		require.NoError(t, err)
+		require.Equal(t, namespace, string(contents))
+	}
+	select {
+	case <-server.ReadyCh:
+	default:
+		t.Fatal("expected the server to be ready")
+	}
+}
+
+// contentsRenderer renders every template as its contents, failing those
+// whose contents are "fail".
+type contentsRenderer struct{}
+
+func (contentsRenderer) Render(_ context.Context, tmpl *ctconfig.TemplateConfig, _ string) ([]byte, error) {
+	contents := ctconfig.StringVal(tmpl.Contents)
+	if contents == "fail" {
+		return nil, errors.New("permission denied")
+	}
+	return []byte(contents), nil
+}
+
+// TestServerRun_CanaryTemplates tests that canary templates are rendered with
+// each new token, reporting their results, without writing their
+// destinations.
+func TestServerRun_CanaryTemplates(t *testing.T) {
+	dir := t.TempDir()
+	tmpl := &ctconfig.TemplateConfig{
+		Contents:    pointerutil.StringPtr("rendered"),
+		Destination: pointerutil.StringPtr(filepath.Join(dir, "render_01")),
+	}
+	canaryDest := filepath.Join(dir, "canary_01")
+	server := NewServer(&ServerConfig{
+		Logger:        logging.NewVaultLogger(hclog.Trace),
+		AgentConfig:   &config.Config{},
+		Renderer:      contentsRenderer{},
+		EnableEventCh: true,
+		CanaryTemplates: []*ctconfig.TemplateConfig{
+			{
+				Contents:    pointerutil.StringPtr("canary"),
+				Destination: pointerutil.StringPtr(canaryDest),
+			},
+			{
+				Contents: pointerutil.StringPtr("fail"),
+			},
+		},
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	incoming := make(chan string, 1)
+	incoming <- "token"
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- server.Run(ctx, incoming, []*ctconfig.TemplateConfig{tmpl}, &sync.Bool{}, make(chan error, 1))
+	}()
+
+	var events []TemplateEvent
+	for len(events) < 2 {
+		select {
+		case event := <-server.EventCh:
+			// The template being rendered is reported too
+			if event.Type != RenderChanged {
+				events = append(events, event)
+			}
+		case <-time.After(10 * time.Second):
+			t.Fatal("timed out waiting for canary events")
+		}
+	}
+	require.Equal(t, CanaryRendered, events[0].Type)
+	require.Equal(t, canaryDest, events[0].Destination)
+	require.Equal(t, CanaryFailed, events[1].Type)
+	require.Equal(t, "canary[1]", events[1].Destination)
+
+	results := server.CanaryResults()
+	require.Len(t, results, 2)
+	require.Equal(t, canaryDest, results[0].Name)
+	require.NoError(t, results[0].Error)
+	require.Equal(t, "canary[1]", results[1].Name)
+	require.ErrorContains(t, results[1].Error, "permission denied")
+
+	select {
+	case <-server.ReadyCh:
+	case <-time.After(10 * time.Second):
+		t.Fatal("timed out waiting for the templates to render")
+	}
+	contents, err := os.ReadFile(*tmpl.Destination)
+	require.NoError(t, err)
+	require.Equal(t, "rendered", string(contents))
+	require.NoFileExists(t, canaryDest)
+
+	cancel()
+	require.NoError(t, <-errCh)
+}
+
+// TestServerRun_MaxRenderBytes tests that a template rendering more than
+// MaxRenderBytes isn't written, leaving its destination as it was, while the
+// other templates are.
+func TestServerRun_MaxRenderBytes(t *testing.T) {
+	dir := t.TempDir()
+	small := &ctconfig.TemplateConfig{
+		Contents:    pointerutil.StringPtr("small"),
+		Destination: pointerutil.StringPtr(filepath.Join(dir, "render_01")),
+	}
+	large := &ctconfig.TemplateConfig{
+		Contents:    pointerutil.StringPtr(strings.Repeat("x", 64)),
+		Destination: pointerutil.StringPtr(filepath.Join(dir, "render_02")),
+	}
+	require.NoError(t, os.WriteFile(*large.Destination, []byte("previous"), 0o600))
+
+	server := NewServer(&ServerConfig{
+		Logger:         logging.NewVaultLogger(hclog.Trace),
+		AgentConfig:    &config.Config{},
+		ExitAfterAuth:  true,
+		Renderer:       contentsRenderer{},
+		MaxRenderBytes: 32,
+		EnableEventCh:  true,
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+
+	templateTokenCh := make(chan string, 1)
+	templateTokenCh <- "test"
+	err := server.Run(ctx, templateTokenCh, []*ctconfig.TemplateConfig{small, large}, &sync.Bool{}, make(chan error, 1))
+	require.ErrorIs(t, err, ErrRenderTooLarge)
+
+	content, err := os.ReadFile(*small.Destination)
+	require.NoError(t, err)
+	require.Equal(t, "small", string(content))
+	content, err = os.ReadFile(*large.Destination)
+	require.NoError(t, err)
+	require.Equal(t, "previous", string(content))
+
+	for {
+		select {
+		case event := <-server.EventCh:
+			if event.Type != RenderTooLarge {
+				continue
+			}
+			require.Equal(t, *large.Destination, event.Destination)
+			require.ErrorIs(t, event.Error, ErrRenderTooLarge)
+			return
+		default:
+			t.Fatal("expected a render-too-large event")
+		}
+	}
+}
+
+// TestServer_Prime tests that Prime fetches the dependencies of every
+// template once, including those only known once others have been fetched,
+// and reports those which couldn't be.
+func TestServer_Prime(t *testing.T) {
+	var reads, nestedReads sync.Int32
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v1/kv/myapp/config", func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, "test-token", r.Header.Get("X-Vault-Token"))
+		reads.Add(1)
+		fmt.Fprintln(w, jsonResponse)
+	})
+	mux.HandleFunc("/v1/kv/myapp/appuser", func(w http.ResponseWriter, r *http.Request) {
+		nestedReads.Add(1)
+		fmt.Fprintln(w, jsonResponse)
+	})
+	mux.HandleFunc("/v1/kv/myapp/perm-denied", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(403)
+		fmt.Fprintln(w, `{"errors":["1 error occurred:\n\t* permission denied\n\n"]}`)
+	})
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+	client, err := api.NewClient(&api.Config{Address: ts.URL})
+	require.NoError(t, err)
+	client.SetToken("test-token")
+
+	dir := t.TempDir()
+	server := NewServer(&ServerConfig{
+		Logger: logging.NewVaultLogger(hclog.Trace),
+		Client: client,
+		AgentConfig: &config.Config{
+			Vault: &config.Vault{
+				Address: ts.URL,
+			},
+			Templates: []*ctconfig.TemplateConfig{
+				{
+					Contents:    pointerutil.StringPtr(templateContents),
+					Destination: pointerutil.StringPtr(filepath.Join(dir, "render_01")),
+				},
+				{
+					Contents:    pointerutil.StringPtr(`{{ with secret "kv/myapp/config" }}{{ with secret (printf "kv/myapp/%s" .Data.data.username) }}{{ .Data.data.password }}{{ end }}{{ end }}`),
+					Destination: pointerutil.StringPtr(filepath.Join(dir, "render_02")),
+				},
+				{
+					Contents:    pointerutil.StringPtr(`{{ with secret "kv/myapp/perm-denied" }}{{ .Data }}{{ end }}`),
+					Destination: pointerutil.StringPtr(filepath.Join(dir, "render_03")),
+				},
+			},
+		},
+	})
+
+	err = server.Prime(context.Background())
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "kv/myapp/perm-denied")
+	require.NotContains(t, err.Error(), "kv/myapp/appuser")
+	require.Equal(t, int32(1), reads.Load())
+	require.Equal(t, int32(1), nestedReads.Load())
+
+	// Nothing is rendered
+	_, err = os.Stat(filepath.Join(dir, "render_01"))
+	require.ErrorIs(t, err, fs.ErrNotExist)
+
+	server = NewServer(&ServerConfig{
+		Logger:      logging.NewVaultLogger(hclog.Trace),
+		AgentConfig: &config.Config{},
+		Renderer:    contentsRenderer{},
+	})
+	require.Error(t, server.Prime(context.Background()))
 }
-{{ end }}
-`
@@ -0,0 +1,170 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: BUSL-1.1
+
+package template
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"syscall"
+	"time"
+
+	"github.com/hashicorp/consul-template/renderer"
+	"github.com/hashicorp/vault/sdk/helper/backoff"
+)
+
+const (
+	// DefaultWriteRetryBackoff is the default time waited before retrying a
+	// failed write.
+	DefaultWriteRetryBackoff = 250 * time.Millisecond
+
+	// DefaultWriteRetryMaxBackoff is the default maximum time waited between
+	// retries of a failed write.
+	DefaultWriteRetryMaxBackoff = 5 * time.Second
+)
+
+// WriteRetry configures retrying writes of rendered templates to their
+// destinations which fail, such as while a full disk is freed up by log
+// rotation, rather than leaving the destination stale until the template is
+// next rendered. Errors which retrying won't fix, such as permission denied,
+// aren't retried.
+type WriteRetry struct {
+	// Attempts is the number of times a failed write is retried.
+	Attempts int
+
+	// Backoff is the time waited before the first retry, which is doubled for
+	// each retry after it, up to MaxBackoff. They default to
+	// DefaultWriteRetryBackoff and DefaultWriteRetryMaxBackoff.
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+}
+
+// TemplateEventType identifies the kind of a TemplateEvent.
+type TemplateEventType string
+
+const (
+	// WriteRetriesExhausted is emitted when writing a rendered template
+	// still fails after every attempt configured with WriteRetry. The
+	// destination is left as it was until the template is next rendered.
+	WriteRetriesExhausted TemplateEventType = "write-retries-exhausted"
+
+	// RenderChanged is emitted when a template is rendered to its
+	// destination with contents which differ from what was there before,
+	// including when the destination is first created. The event only
+	// summarizes the change, so that it never exposes the contents.
+	RenderChanged TemplateEventType = "render-changed"
+
+	// CanaryRendered and CanaryFailed are emitted when one of the
+	// CanaryTemplates renders, or fails to. The Destination is the name of
+	// the canary, see CanaryResult.
+	CanaryRendered TemplateEventType = "canary-rendered"
+	CanaryFailed   TemplateEventType = "canary-failed"
+
+	// RenderTooLarge is emitted when a template's rendered contents exceed
+	// MaxRenderBytes, and so aren't written. The destination is left as it
+	// was until the template is next rendered.
+	RenderTooLarge TemplateEventType = "render-too-large"
+)
+
+// TemplateEvent describes a notable occurrence while rendering templates.
+// Events are delivered on Server.EventCh when EnableEventCh is set.
+type TemplateEvent struct {
+	Type TemplateEventType
+	Time time.Time
+	// Destination is the path of the file the event relates to.
+	Destination string
+	// Attempts is the number of times the write was attempted.
+	Attempts int
+	// Error is the error associated with the event, if any.
+	Error error
+
+	// Created, LinesAdded and LinesRemoved summarize a RenderChanged event.
+	// Created is set if the destination didn't exist before. Lines are
+	// counted regardless of their order, so a line which only moved isn't
+	// counted as changed.
+	Created      bool
+	LinesAdded   int
+	LinesRemoved int
+}
+
+// emitEvent sends an event on EventCh, if enabled. Events are dropped rather
+// than blocking rendering if the consumer is not keeping up.
+func (ts *Server) emitEvent(event TemplateEvent) {
+	if !ts.config.EnableEventCh {
+		return
+	}
+	if event.Time.IsZero() {
+		event.Time = time.Now()
+	}
+
+	select {
+	case ts.EventCh <- event:
+	default:
+		ts.logger.Warn("template event channel is full, dropping event", "type", event.Type)
+	}
+}
+
+// retryWrite calls write, retrying it as configured with WriteRetry if it
+// fails with an error which isn't permanent. If every attempt fails, a
+// WriteRetriesExhausted event is emitted and the last error is returned. If
+// ctx is done while waiting to retry, the last error is returned straight
+// away.
+func (ts *Server) retryWrite(ctx context.Context, path string, write func() (*renderer.RenderResult, error)) (*renderer.RenderResult, error) {
+	result, err := write()
+	retry := ts.config.WriteRetry
+	if err == nil || retry == nil || retry.Attempts <= 0 || isPermanentWriteError(err) {
+		return result, err
+	}
+
+	minBackoff := retry.Backoff
+	if minBackoff <= 0 {
+		minBackoff = DefaultWriteRetryBackoff
+	}
+	maxBackoff := retry.MaxBackoff
+	if maxBackoff <= 0 {
+		maxBackoff = DefaultWriteRetryMaxBackoff
+	}
+	b := backoff.NewBackoff(retry.Attempts, minBackoff, max(minBackoff, maxBackoff))
+	for {
+		sleep, maxErr := b.Next()
+		if maxErr != nil {
+			break
+		}
+		ts.logger.Warn("failed writing rendered template, retrying", "destination", path, "backoff", sleep, "error", err)
+		timer := time.NewTimer(sleep)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, err
+		case <-timer.C:
+		}
+
+		result, err = write()
+		if err == nil {
+			return result, nil
+		}
+		if isPermanentWriteError(err) {
+			return nil, err
+		}
+	}
+
+	ts.logger.Error("failed writing rendered template, giving up until it's next rendered", "destination", path, "attempts", retry.Attempts+1, "error", err)
+	ts.emitEvent(TemplateEvent{
+		Type:        WriteRetriesExhausted,
+		Destination: path,
+		Attempts:    retry.Attempts + 1,
+		Error:       err,
+	})
+	return nil, err
+}
+
+// isPermanentWriteError returns whether a write failed with an error which
+// retrying straight away won't fix, such as permission denied or a read-only
+// file system.
+func isPermanentWriteError(err error) bool {
+	return errors.Is(err, fs.ErrPermission) ||
+		errors.Is(err, syscall.EROFS) ||
+		errors.Is(err, renderer.ErrMissingDest) ||
+		errors.Is(err, renderer.ErrNoParentDir)
+}
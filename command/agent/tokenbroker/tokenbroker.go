@@ -0,0 +1,177 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: BUSL-1.1
+
+// Package tokenbroker serves the auto-auth token to local processes over
+// HTTP, guarded by a shared secret, as an alternative to reading it from a
+// file sink.
+package tokenbroker
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/vault/sdk/helper/jsonutil"
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+// DefaultAddress is the address the broker listens on if none is configured.
+const DefaultAddress = "127.0.0.1:8202"
+
+// TokenSource provides the current token, as *auth.AuthHandler does.
+type TokenSource interface {
+	CurrentToken() (string, bool)
+}
+
+type ServerConfig struct {
+	Logger hclog.Logger
+
+	// TokenSource is where the tokens served come from, usually the
+	// auto-auth AuthHandler.
+	TokenSource TokenSource
+
+	// Address is the address to listen on. It defaults to DefaultAddress. It
+	// must be a loopback address unless AllowNonLoopback is set.
+	Address          string
+	AllowNonLoopback bool
+
+	// Secret is the bearer token clients must present in the Authorization
+	// header.
+	Secret string
+}
+
+// Server serves GET /token, returning the current token to clients which
+// present the configured secret.
+type Server struct {
+	logger      hclog.Logger
+	tokenSource TokenSource
+	address     string
+	secret      []byte
+}
+
+type tokenResponse struct {
+	Token string `json:"token"`
+}
+
+// NewServer validates the configuration, and returns a new Server.
+func NewServer(conf *ServerConfig) (*Server, error) {
+	if conf.TokenSource == nil {
+		return nil, errors.New("token broker: no token source provided")
+	}
+	if conf.Secret == "" {
+		return nil, errors.New("token broker: a secret is required")
+	}
+
+	address := conf.Address
+	if address == "" {
+		address = DefaultAddress
+	}
+	if err := ValidateAddress(address, conf.AllowNonLoopback); err != nil {
+		return nil, fmt.Errorf("token broker: %w", err)
+	}
+
+	return &Server{
+		logger:      conf.Logger,
+		tokenSource: conf.TokenSource,
+		address:     address,
+		secret:      []byte(conf.Secret),
+	}, nil
+}
+
+// ValidateAddress returns an error if address isn't a valid host and port,
+// or, unless allowNonLoopback is set, if its host isn't a loopback address.
+// An empty host, which listens on every interface, isn't a loopback
+// address.
+func ValidateAddress(address string, allowNonLoopback bool) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return fmt.Errorf("invalid address %q: %w", address, err)
+	}
+	if allowNonLoopback {
+		return nil
+	}
+	if strings.EqualFold(host, "localhost") {
+		return nil
+	}
+	if ip := net.ParseIP(host); ip != nil && ip.IsLoopback() {
+		return nil
+	}
+	return fmt.Errorf("address %q is not a loopback address, which must be explicitly allowed", address)
+}
+
+// Run listens on the configured address, and serves requests until ctx is
+// done.
+func (s *Server) Run(ctx context.Context) error {
+	ln, err := net.Listen("tcp", s.address)
+	if err != nil {
+		return fmt.Errorf("token broker: error listening on %s: %w", s.address, err)
+	}
+	return s.serve(ctx, ln)
+}
+
+// serve serves requests on ln until ctx is done.
+func (s *Server) serve(ctx context.Context, ln net.Listener) error {
+	mux := http.NewServeMux()
+	mux.Handle("/token", s.handleToken())
+	server := &http.Server{
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
+		ReadTimeout:       30 * time.Second,
+		IdleTimeout:       5 * time.Minute,
+		ErrorLog:          s.logger.StandardLogger(nil),
+	}
+
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- server.Serve(ln)
+	}()
+	s.logger.Info("token broker listening", "address", ln.Addr().String())
+
+	select {
+	case <-ctx.Done():
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		server.Shutdown(shutdownCtx)
+		s.logger.Info("token broker stopped")
+		return nil
+	case err := <-errCh:
+		return fmt.Errorf("token broker: %w", err)
+	}
+}
+
+func (s *Server) handleToken() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			logical.RespondError(w, http.StatusMethodNotAllowed, nil)
+			return
+		}
+
+		secret, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(secret), s.secret) != 1 {
+			s.logger.Warn("rejected token request with a missing or invalid secret", "remote_addr", r.RemoteAddr)
+			logical.RespondError(w, http.StatusUnauthorized, errors.New("missing or invalid secret"))
+			return
+		}
+
+		token, ok := s.tokenSource.CurrentToken()
+		if !ok {
+			logical.RespondError(w, http.StatusServiceUnavailable, errors.New("agent is not authenticated"))
+			return
+		}
+
+		body, err := jsonutil.EncodeJSON(&tokenResponse{Token: token})
+		if err != nil {
+			logical.RespondError(w, http.StatusInternalServerError, fmt.Errorf("failed to encode token response: %w", err))
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+		w.Write(body)
+	})
+}
@@ -0,0 +1,136 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: BUSL-1.1
+
+package tokenbroker
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"testing"
+
+	"github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/vault/sdk/helper/logging"
+)
+
+type staticTokenSource struct {
+	token string
+}
+
+func (s *staticTokenSource) CurrentToken() (string, bool) {
+	return s.token, s.token != ""
+}
+
+func TestServer(t *testing.T) {
+	source := &staticTokenSource{}
+	server, err := NewServer(&ServerConfig{
+		Logger:      logging.NewVaultLogger(hclog.Trace),
+		TokenSource: source,
+		Secret:      "broker-secret",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- server.serve(ctx, ln)
+	}()
+	defer func() {
+		cancel()
+		if err := <-errCh; err != nil {
+			t.Fatal(err)
+		}
+	}()
+
+	request := func(method, secret string) *http.Response {
+		t.Helper()
+		req, err := http.NewRequest(method, "http://"+ln.Addr().String()+"/token", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if secret != "" {
+			req.Header.Set("Authorization", "Bearer "+secret)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { resp.Body.Close() })
+		return resp
+	}
+
+	for name, tc := range map[string]struct {
+		method string
+		secret string
+		status int
+	}{
+		"no secret":       {http.MethodGet, "", http.StatusUnauthorized},
+		"wrong secret":    {http.MethodGet, "wrong", http.StatusUnauthorized},
+		"wrong method":    {http.MethodPost, "broker-secret", http.StatusMethodNotAllowed},
+		"unauthenticated": {http.MethodGet, "broker-secret", http.StatusServiceUnavailable},
+	} {
+		t.Run(name, func(t *testing.T) {
+			if resp := request(tc.method, tc.secret); resp.StatusCode != tc.status {
+				t.Fatalf("expected status %d, got %d", tc.status, resp.StatusCode)
+			}
+		})
+	}
+
+	source.token = "test-token"
+	resp := request(http.MethodGet, "broker-secret")
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", resp.StatusCode)
+	}
+	var body tokenResponse
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		t.Fatal(err)
+	}
+	if body.Token != "test-token" {
+		t.Fatalf("expected token %q, got %q", "test-token", body.Token)
+	}
+	if resp.Header.Get("Cache-Control") != "no-store" {
+		t.Fatalf("expected response not to be cached, got Cache-Control %q", resp.Header.Get("Cache-Control"))
+	}
+}
+
+func TestValidateAddress(t *testing.T) {
+	for _, tc := range []struct {
+		address          string
+		allowNonLoopback bool
+		valid            bool
+	}{
+		{"127.0.0.1:8202", false, true},
+		{"[::1]:8202", false, true},
+		{"localhost:8202", false, true},
+		{"0.0.0.0:8202", false, false},
+		{":8202", false, false},
+		{"10.0.0.1:8202", false, false},
+		{"10.0.0.1:8202", true, true},
+		{"127.0.0.1", false, false},
+	} {
+		err := ValidateAddress(tc.address, tc.allowNonLoopback)
+		if tc.valid && err != nil {
+			t.Fatalf("expected %q to be valid, got %v", tc.address, err)
+		}
+		if !tc.valid && err == nil {
+			t.Fatalf("expected %q to be invalid", tc.address)
+		}
+	}
+}
+
+func TestNewServer_NoSecret(t *testing.T) {
+	_, err := NewServer(&ServerConfig{
+		Logger:      logging.NewVaultLogger(hclog.Trace),
+		TokenSource: &staticTokenSource{},
+	})
+	if err == nil {
+		t.Fatal("expected error without a secret")
+	}
+}
@@ -0,0 +1,385 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: BUSL-1.1
+
+package agent
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"text/template"
+
+	ctconfig "github.com/hashicorp/consul-template/config"
+	hclog "github.com/hashicorp/go-hclog"
+	agentConfig "github.com/hashicorp/vault/command/agent/config"
+	"github.com/hashicorp/vault/command/agentproxyshared/sink"
+	"github.com/hashicorp/vault/command/agentproxyshared/sink/audit"
+	"github.com/hashicorp/vault/command/agentproxyshared/sink/command"
+	"github.com/hashicorp/vault/command/agentproxyshared/sink/stdout"
+	"github.com/hashicorp/vault/command/agentproxyshared/sink/webhook"
+	"github.com/hashicorp/vault/helper/osutil"
+	"github.com/hashicorp/vault/sdk/helper/parseutil"
+)
+
+// VerifyConfig checks that an agent configuration can be run, going beyond
+// the parsing done by agentConfig.LoadConfigFile to check that the auto-auth
+// method's required values are set, that sink paths and template
+// destinations are writable, and that options which can't be used together
+// aren't. It doesn't build the auth method, authenticate or write any files,
+// so it is safe to run against the configuration of a live agent. Every
+// problem found is returned, rather than just the first.
+func VerifyConfig(cfg *agentConfig.Config) []error {
+	if cfg == nil {
+		return []error{errors.New("no config provided")}
+	}
+
+	var errs []error
+	if err := cfg.ValidateConfig(); err != nil {
+		errs = append(errs, err)
+	}
+
+	if cfg.AutoAuth != nil {
+		errs = append(errs, verifyAutoAuth(cfg)...)
+	}
+
+	for i, tc := range cfg.Templates {
+		for _, err := range verifyTemplate(tc) {
+			errs = append(errs, fmt.Errorf("template[%d]: %w", i, err))
+		}
+	}
+
+	for i, glob := range cfg.CleanupGlobs {
+		if err := validateCleanupGlob(glob); err != nil {
+			errs = append(errs, fmt.Errorf("cleanup_globs[%d]: %w", i, err))
+		}
+	}
+
+	return errs
+}
+
+func verifyAutoAuth(cfg *agentConfig.Config) []error {
+	var errs []error
+
+	method := cfg.AutoAuth.Method
+	if method == nil {
+		errs = append(errs, errors.New("auto_auth: no method configured"))
+	} else {
+		for _, err := range verifyMethod(cfg, method) {
+			errs = append(errs, fmt.Errorf("auto_auth.method.%s: %w", method.Type, err))
+		}
+	}
+
+	for i, sc := range cfg.AutoAuth.Sinks {
+		for _, err := range verifySink(cfg.AutoAuth, sc) {
+			errs = append(errs, fmt.Errorf("auto_auth.sink[%d]: %w", i, err))
+		}
+	}
+
+	return errs
+}
+
+func verifyMethod(cfg *agentConfig.Config, method *agentConfig.Method) []error {
+	var errs []error
+
+	if method.MinBackoff > 0 && method.MaxBackoff > 0 && method.MinBackoff > method.MaxBackoff {
+		errs = append(errs, fmt.Errorf("min_backoff (%s) is greater than max_backoff (%s)", method.MinBackoff, method.MaxBackoff))
+	}
+
+	if method.WrapTTL > 0 {
+		if len(cfg.AutoAuth.Sinks) != 1 {
+			errs = append(errs, errors.New("wrapping enabled on auth method and 0 or many sinks defined"))
+		}
+		for _, sc := range cfg.AutoAuth.Sinks {
+			if sc.WrapTTL > 0 {
+				errs = append(errs, errors.New("wrapping enabled both on auth method and sink"))
+				break
+			}
+		}
+	}
+
+	requiredKeys, ok := autoAuthMethodRequiredKeys[method.Type]
+	if !ok {
+		return append(errs, fmt.Errorf("unknown auth method %q", method.Type))
+	}
+	if method.Config == nil && len(requiredKeys) > 0 {
+		return append(errs, errors.New("empty config data"))
+	}
+	for _, key := range requiredKeys {
+		raw, ok := method.Config[key]
+		if !ok {
+			errs = append(errs, fmt.Errorf("missing '%s' value", key))
+			continue
+		}
+		if value, ok := raw.(string); !ok {
+			errs = append(errs, fmt.Errorf("could not convert '%s' config value to string", key))
+		} else if value == "" {
+			errs = append(errs, fmt.Errorf("'%s' value is empty", key))
+		}
+	}
+
+	return errs
+}
+
+// autoAuthMethodRequiredKeys holds the config keys each auto-auth method
+// requires to be set to a non-empty string. They're checked here, rather
+// than by building the method, because some methods' constructors start
+// goroutines which fetch credentials, or read, and may remove, the files
+// they're configured with. The method's other values are only checked when
+// the agent starts.
+var autoAuthMethodRequiredKeys = map[string][]string{
+	"alicloud":   {"role", "region"},
+	"aws":        {"type", "role"},
+	"azure":      {"role", "resource"},
+	"cert":       nil,
+	"cf":         {"role"},
+	"gcp":        {"type", "role"},
+	"jwt":        {"path", "role"},
+	"kerberos":   {"username", "service", "realm", "keytab_path", "krb5conf_path"},
+	"kubernetes": {"role"},
+	"approle":    {"role_id_file_path"},
+	"oci":        {"type", "role"},
+	"oidc":       {"role"},
+	"token_file": {"token_file_path"},
+	"tpm_file":   {"sealed_blob_path"},
+	"pcf":        {"role"}, // Deprecated.
+	"ldap":       {"username", "password_file_path"},
+}
+
+func verifySink(autoAuth *agentConfig.AutoAuth, sc *agentConfig.Sink) []error {
+	var verifyType func(*agentConfig.AutoAuth, *agentConfig.Sink) []error
+	switch sc.Type {
+	case "file":
+		verifyType = verifyFileSink
+	case "kubernetes":
+		verifyType = verifyKubernetesSink
+	case "command":
+		verifyType = verifyCommandSink
+	case "stdout":
+		verifyType = verifyStdoutSink
+	case "audit":
+		verifyType = verifyAuditSink
+	case "webhook":
+		verifyType = verifyWebhookSink
+	default:
+		return []error{fmt.Errorf("unknown sink type %q", sc.Type)}
+	}
+
+	var errs []error
+
+	if sc.DHType != "" && sc.DHPath == "" {
+		errs = append(errs, errors.New("dh_type specified without dh_path"))
+	}
+
+	return append(errs, verifyType(autoAuth, sc)...)
+}
+
+func verifyFileSink(autoAuth *agentConfig.AutoAuth, sc *agentConfig.Sink) []error {
+	var errs []error
+
+	pathRaw, ok := sc.Config["path"]
+	if !ok {
+		return append(errs, errors.New("'path' not specified for file sink"))
+	}
+	path, ok := pathRaw.(string)
+	if !ok || path == "" {
+		return append(errs, errors.New("could not parse 'path' as string"))
+	}
+	path, err := osutil.ExpandEnv(path)
+	if err != nil {
+		return append(errs, fmt.Errorf("could not expand 'path': %w", err))
+	}
+
+	var pathTemplate bool
+	if pathTemplateRaw, ok := sc.Config["path_template"]; ok {
+		if pathTemplate, ok = pathTemplateRaw.(bool); !ok {
+			errs = append(errs, errors.New("could not parse 'path_template' as bool"))
+		}
+	}
+	if pathTemplate {
+		if _, err := template.New("path").Parse(path); err != nil {
+			errs = append(errs, fmt.Errorf("could not parse 'path' as a template: %w", err))
+		}
+	}
+
+	// A sink whose directory doesn't exist yet may still be created within
+	// the sink_init_timeout, e.g. once a volume has been mounted. The
+	// directory of a templated path can only be checked if it's fixed.
+	dir := filepath.Dir(path)
+	if !pathTemplate || !strings.Contains(dir, "{{") {
+		if err := verifyWritableDir(dir); err != nil {
+			if !os.IsNotExist(err) || autoAuth.SinkInitTimeout == 0 {
+				errs = append(errs, err)
+			}
+		}
+	}
+
+	if fi, err := os.Stat(path); err == nil && fi.IsDir() {
+		errs = append(errs, fmt.Errorf("%s is a directory", path))
+	}
+
+	if fifoRaw, ok := sc.Config["fifo"]; ok {
+		if _, err := parseutil.ParseBool(fifoRaw); err != nil {
+			errs = append(errs, fmt.Errorf("could not parse 'fifo' as bool: %w", err))
+		}
+	}
+
+	return errs
+}
+
+// verifyKubernetesSink checks the kubernetes sink's configuration. Whether
+// the secret can be updated is only known once running in the cluster.
+func verifyKubernetesSink(_ *agentConfig.AutoAuth, sc *agentConfig.Sink) []error {
+	var errs []error
+
+	secretNameRaw, ok := sc.Config["secret_name"]
+	if !ok {
+		errs = append(errs, errors.New("'secret_name' not specified for kubernetes sink"))
+	} else if secretName, ok := secretNameRaw.(string); !ok || secretName == "" {
+		errs = append(errs, errors.New("could not parse 'secret_name' as string"))
+	}
+
+	for _, key := range []string{"namespace", "data_key"} {
+		if raw, ok := sc.Config[key]; ok {
+			if value, ok := raw.(string); !ok || value == "" {
+				errs = append(errs, fmt.Errorf("could not parse '%s' as string", key))
+			}
+		}
+	}
+
+	return errs
+}
+
+// verifyCommandSink checks the command sink's configuration, and that its
+// command can be found.
+func verifyCommandSink(_ *agentConfig.AutoAuth, sc *agentConfig.Sink) []error {
+	_, err := command.NewCommandSink(&sink.SinkConfig{
+		Logger: hclog.NewNullLogger(),
+		Config: sc.Config,
+	})
+	if err != nil {
+		return []error{err}
+	}
+
+	// NewCommandSink has checked it's a string or list of strings
+	var name string
+	switch cmd := sc.Config["command"].(type) {
+	case string:
+		name = cmd
+	case []string:
+		name = cmd[0]
+	case []interface{}:
+		name = cmd[0].(string)
+	}
+	if _, err := exec.LookPath(name); err != nil {
+		return []error{err}
+	}
+	return nil
+}
+
+// verifyStdoutSink checks the stdout sink's configuration.
+func verifyStdoutSink(_ *agentConfig.AutoAuth, sc *agentConfig.Sink) []error {
+	if _, err := stdout.NewStdoutSink(&sink.SinkConfig{
+		Logger: hclog.NewNullLogger(),
+		Config: sc.Config,
+	}); err != nil {
+		return []error{err}
+	}
+	return nil
+}
+
+// verifyAuditSink checks the audit sink's configuration, and that its file
+// can be written.
+func verifyAuditSink(autoAuth *agentConfig.AutoAuth, sc *agentConfig.Sink) []error {
+	if _, err := audit.NewAuditSink(&sink.SinkConfig{
+		Logger: hclog.NewNullLogger(),
+		Config: sc.Config,
+	}); err != nil {
+		return []error{err}
+	}
+
+	// NewAuditSink has checked the path is a string which can be expanded
+	path, _ := osutil.ExpandEnv(sc.Config["path"].(string))
+	if err := verifyWritableDir(filepath.Dir(path)); err != nil {
+		if !os.IsNotExist(err) || autoAuth.SinkInitTimeout == 0 {
+			return []error{err}
+		}
+	}
+	if fi, err := os.Stat(path); err == nil && fi.IsDir() {
+		return []error{fmt.Errorf("%s is a directory", path)}
+	}
+	return nil
+}
+
+func verifyWebhookSink(_ *agentConfig.AutoAuth, sc *agentConfig.Sink) []error {
+	if _, err := webhook.NewWebhookSink(&sink.SinkConfig{
+		Logger: hclog.NewNullLogger(),
+		Config: sc.Config,
+	}); err != nil {
+		return []error{err}
+	}
+	return nil
+}
+
+func verifyTemplate(tc *ctconfig.TemplateConfig) []error {
+	var errs []error
+
+	source := stringValue(tc.Source)
+	contents := stringValue(tc.Contents)
+	switch {
+	case source != "" && contents != "":
+		errs = append(errs, errors.New("only one of source and contents may be specified"))
+	case source == "" && contents == "":
+		errs = append(errs, errors.New("one of source or contents must be specified"))
+	case source != "":
+		if _, err := os.Stat(source); err != nil {
+			errs = append(errs, fmt.Errorf("error reading source: %w", err))
+		}
+	}
+
+	destination := stringValue(tc.Destination)
+	if destination == "" {
+		return append(errs, errors.New("destination must be specified"))
+	}
+	destination, err := osutil.ExpandEnv(destination)
+	if err != nil {
+		return append(errs, fmt.Errorf("could not expand destination: %w", err))
+	}
+
+	// Unless told otherwise, consul-template creates the destination's
+	// parent directories when rendering.
+	createDestDirs := tc.CreateDestDirs == nil || *tc.CreateDestDirs
+	if err := verifyWritableDir(filepath.Dir(destination)); err != nil {
+		if !os.IsNotExist(err) || !createDestDirs {
+			errs = append(errs, err)
+		}
+	}
+
+	return errs
+}
+
+// verifyWritableDir checks that dir is an existing directory that the agent
+// can create files in. The returned error satisfies os.IsNotExist if the
+// directory doesn't exist.
+func verifyWritableDir(dir string) error {
+	fi, err := os.Stat(dir)
+	if err != nil {
+		return err
+	}
+	if !fi.IsDir() {
+		return fmt.Errorf("%s is not a directory", dir)
+	}
+	if err := checkWritable(dir); err != nil {
+		return fmt.Errorf("directory %s is not writable: %w", dir, err)
+	}
+	return nil
+}
+
+func stringValue(s *string) string {
+	if s == nil {
+		return ""
+	}
+	return *s
+}
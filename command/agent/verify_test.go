@@ -0,0 +1,225 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: BUSL-1.1
+
+package agent
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	ctconfig "github.com/hashicorp/consul-template/config"
+	agentConfig "github.com/hashicorp/vault/command/agent/config"
+	"github.com/hashicorp/vault/sdk/helper/pointerutil"
+)
+
+func TestVerifyConfig(t *testing.T) {
+	dir := t.TempDir()
+	roleIDPath := filepath.Join(dir, "role-id")
+	if err := os.WriteFile(roleIDPath, []byte("role"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	jwtPath := filepath.Join(dir, "jwt")
+	if err := os.WriteFile(jwtPath, []byte("jwt"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	missingDir := filepath.Join(dir, "missing")
+
+	newConfig := func() *agentConfig.Config {
+		return &agentConfig.Config{
+			AutoAuth: &agentConfig.AutoAuth{
+				Method: &agentConfig.Method{
+					Type:      "approle",
+					MountPath: "auth/approle",
+					Config: map[string]interface{}{
+						"role_id_file_path": roleIDPath,
+					},
+				},
+				Sinks: []*agentConfig.Sink{
+					{
+						Type:   "file",
+						Config: map[string]interface{}{"path": filepath.Join(dir, "token")},
+					},
+				},
+			},
+			Templates: []*ctconfig.TemplateConfig{
+				{
+					Contents:    pointerutil.StringPtr("{{ with secret \"secret/foo\" }}{{ end }}"),
+					Destination: pointerutil.StringPtr(filepath.Join(missingDir, "render.txt")),
+				},
+			},
+		}
+	}
+
+	testCases := map[string]struct {
+		modify func(*agentConfig.Config)
+		errs   []string
+	}{
+		"valid": {
+			modify: func(*agentConfig.Config) {},
+		},
+		"incomplete method": {
+			modify: func(c *agentConfig.Config) {
+				c.AutoAuth.Method.Config = map[string]interface{}{}
+			},
+			errs: []string{"auto_auth.method.approle: missing 'role_id_file_path' value"},
+		},
+		"empty method value": {
+			modify: func(c *agentConfig.Config) {
+				c.AutoAuth.Method.Config["role_id_file_path"] = ""
+			},
+			errs: []string{"auto_auth.method.approle: 'role_id_file_path' value is empty"},
+		},
+		"unknown method": {
+			modify: func(c *agentConfig.Config) {
+				c.AutoAuth.Method.Type = "unknown"
+			},
+			errs: []string{"auto_auth.method.unknown: unknown auth method \"unknown\""},
+		},
+		"jwt method": {
+			modify: func(c *agentConfig.Config) {
+				c.AutoAuth.Method.Type = "jwt"
+				c.AutoAuth.Method.Config = map[string]interface{}{
+					"path":                     jwtPath,
+					"role":                     "test",
+					"remove_jwt_after_reading": true,
+				}
+			},
+		},
+		"backoff conflict": {
+			modify: func(c *agentConfig.Config) {
+				c.AutoAuth.Method.MinBackoff = time.Minute
+				c.AutoAuth.Method.MaxBackoff = time.Second
+			},
+			errs: []string{"min_backoff (1m0s) is greater than max_backoff (1s)"},
+		},
+		"wrapping conflict": {
+			modify: func(c *agentConfig.Config) {
+				c.AutoAuth.Method.WrapTTL = time.Minute
+				c.AutoAuth.Sinks[0].WrapTTL = time.Minute
+			},
+			errs: []string{"wrapping enabled both on auth method and sink"},
+		},
+		"missing sink dir": {
+			modify: func(c *agentConfig.Config) {
+				c.AutoAuth.Sinks[0].Config["path"] = filepath.Join(missingDir, "token")
+			},
+			errs: []string{"auto_auth.sink[0]: stat " + missingDir},
+		},
+		"missing sink dir with init timeout": {
+			modify: func(c *agentConfig.Config) {
+				c.AutoAuth.Sinks[0].Config["path"] = filepath.Join(missingDir, "token")
+				c.AutoAuth.SinkInitTimeout = time.Minute
+			},
+		},
+		"missing template dir": {
+			modify: func(c *agentConfig.Config) {
+				c.Templates[0].CreateDestDirs = pointerutil.BoolPtr(false)
+			},
+			errs: []string{"template[0]: stat " + missingDir},
+		},
+		"undefined variable in sink path": {
+			modify: func(c *agentConfig.Config) {
+				c.AutoAuth.Sinks[0].Config["path"] = "${VERIFY_TEST_UNDEFINED}/token"
+			},
+			errs: []string{"auto_auth.sink[0]: could not expand 'path': undefined environment variables"},
+		},
+		"path template": {
+			modify: func(c *agentConfig.Config) {
+				c.AutoAuth.Sinks[0].Config["path"] = filepath.Join(missingDir, "token-{{ .Accessor")
+				c.AutoAuth.Sinks[0].Config["path_template"] = true
+			},
+			errs: []string{
+				"auto_auth.sink[0]: could not parse 'path' as a template",
+				"auto_auth.sink[0]: stat " + missingDir,
+			},
+		},
+		"kubernetes sink": {
+			modify: func(c *agentConfig.Config) {
+				c.AutoAuth.Sinks[0].Type = "kubernetes"
+				c.AutoAuth.Sinks[0].Config = map[string]interface{}{
+					"secret_name": "vault-token",
+					"data_key":    "",
+				}
+			},
+			errs: []string{"auto_auth.sink[0]: could not parse 'data_key' as string"},
+		},
+		"command sink": {
+			modify: func(c *agentConfig.Config) {
+				c.AutoAuth.Sinks[0].Type = "command"
+				c.AutoAuth.Sinks[0].Config = map[string]interface{}{
+					"command": []interface{}{"verify-test-missing-command"},
+				}
+			},
+			errs: []string{"auto_auth.sink[0]: exec: \"verify-test-missing-command\""},
+		},
+		"command sink token delivery": {
+			modify: func(c *agentConfig.Config) {
+				c.AutoAuth.Sinks[0].Type = "command"
+				c.AutoAuth.Sinks[0].Config = map[string]interface{}{
+					"command":        "true",
+					"token_delivery": "file",
+				}
+			},
+			errs: []string{"auto_auth.sink[0]: unknown 'token_delivery' \"file\""},
+		},
+		"stdout sink format": {
+			modify: func(c *agentConfig.Config) {
+				c.AutoAuth.Sinks[0].Type = "stdout"
+				c.AutoAuth.Sinks[0].Config = map[string]interface{}{
+					"format": "yaml",
+				}
+			},
+			errs: []string{"auto_auth.sink[0]: unknown 'format' \"yaml\""},
+		},
+		"cleanup glob too broad": {
+			modify: func(c *agentConfig.Config) {
+				c.CleanupGlobs = []string{"/tmp/*"}
+			},
+			errs: []string{"cleanup_globs[0]: cleanup glob \"/tmp/*\" is too broad"},
+		},
+		"template source and contents": {
+			modify: func(c *agentConfig.Config) {
+				c.Templates[0].Source = pointerutil.StringPtr(roleIDPath)
+			},
+			errs: []string{"template[0]: only one of source and contents may be specified"},
+		},
+		"multiple errors": {
+			modify: func(c *agentConfig.Config) {
+				c.AutoAuth.Sinks[0].Type = "unknown"
+				c.Templates[0].Destination = nil
+			},
+			errs: []string{
+				"auto_auth.sink[0]: unknown sink type \"unknown\"",
+				"template[0]: destination must be specified",
+			},
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			cfg := newConfig()
+			tc.modify(cfg)
+
+			errs := VerifyConfig(cfg)
+			if len(errs) != len(tc.errs) {
+				t.Fatalf("expected %d errors, got %d: %v", len(tc.errs), len(errs), errs)
+			}
+			for i, err := range errs {
+				if !strings.Contains(err.Error(), tc.errs[i]) {
+					t.Fatalf("expected error %d to contain %q, got %q", i, tc.errs[i], err)
+				}
+			}
+
+			if _, err := os.Stat(missingDir); !os.IsNotExist(err) {
+				t.Fatalf("expected %s not to have been created", missingDir)
+			}
+			// The auth method isn't built, so its files aren't read or removed
+			if _, err := os.Stat(jwtPath); err != nil {
+				t.Fatalf("expected %s to have been left in place: %v", jwtPath, err)
+			}
+		})
+	}
+}
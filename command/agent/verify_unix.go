@@ -0,0 +1,14 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: BUSL-1.1
+
+//go:build !windows
+
+package agent
+
+import "golang.org/x/sys/unix"
+
+// checkWritable checks that the current user has write access to path,
+// without writing to it.
+func checkWritable(path string) error {
+	return unix.Access(path, unix.W_OK)
+}
@@ -0,0 +1,337 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: BUSL-1.1
+
+package agent
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	ctconfig "github.com/hashicorp/consul-template/config"
+	hclog "github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/go-multierror"
+	"github.com/hashicorp/vault/command/agent/template"
+	"github.com/hashicorp/vault/command/agentproxyshared/auth"
+	"github.com/hashicorp/vault/command/agentproxyshared/sink"
+)
+
+// Pipeline is an auth handler wired to the servers its tokens are delivered
+// to, as set up by SinkOnly, TemplatesOnly or FirstPass.
+//
+// The auth handler always delivers tokens on its OutputCh, and blocks until
+// they're received, so something has to receive them even when there are no
+// sinks. The sink server does that when it has no sinks, as long as it isn't
+// set to exit after auth, in which case it stops receiving after the first
+// token. Likewise, the auth handler must only deliver tokens to its
+// TemplateTokenCh and ExecTokenCh if there's a server to receive them.
+// SinkOnly, TemplatesOnly and FirstPass take care of both.
+type Pipeline struct {
+	AuthHandler *auth.AuthHandler
+
+	// SinkServer writes tokens to the sinks passed to SinkOnly. With
+	// TemplatesOnly, it has no sinks, and only receives tokens from the auth
+	// handler so that it isn't blocked.
+	SinkServer *sink.SinkServer
+
+	// TemplateServer is nil unless the Pipeline was created by TemplatesOnly,
+	// or by FirstPass with templates.
+	TemplateServer *template.Server
+
+	sinks     []*sink.SinkConfig
+	templates []*ctconfig.TemplateConfig
+
+	// firstPass is set for Pipelines created by FirstPass, which run until
+	// the first token has been written and rendered, or timeout elapses
+	firstPass bool
+	timeout   time.Duration
+}
+
+// SinkOnly returns a Pipeline delivering tokens from an auth handler created
+// with ahConfig to sinks, through a sink server created with ssConfig. The
+// auth handler is set not to deliver tokens to templates or exec.
+func SinkOnly(ahConfig *auth.AuthHandlerConfig, ssConfig *sink.SinkServerConfig, sinks []*sink.SinkConfig) (*Pipeline, error) {
+	if ahConfig == nil {
+		return nil, errors.New("auth handler config is nil")
+	}
+	if ssConfig == nil {
+		return nil, errors.New("sink server config is nil")
+	}
+	if len(sinks) == 0 {
+		return nil, errors.New("at least one sink is required")
+	}
+
+	conf := *ahConfig
+	conf.EnableTemplateTokenCh = false
+	conf.EnableExecTokenCh = false
+
+	return &Pipeline{
+		AuthHandler: auth.NewAuthHandler(&conf),
+		SinkServer:  sink.NewSinkServer(ssConfig),
+		sinks:       sinks,
+	}, nil
+}
+
+// TemplatesOnly returns a Pipeline rendering templates, through a template
+// server created with tsConfig, with tokens from an auth handler created with
+// ahConfig. The auth handler is set to deliver tokens to templates but not to
+// exec, and a sink server with no sinks is created to receive its OutputCh.
+func TemplatesOnly(ahConfig *auth.AuthHandlerConfig, tsConfig *template.ServerConfig, templates []*ctconfig.TemplateConfig) (*Pipeline, error) {
+	if ahConfig == nil {
+		return nil, errors.New("auth handler config is nil")
+	}
+	if tsConfig == nil {
+		return nil, errors.New("template server config is nil")
+	}
+	if len(templates) == 0 {
+		return nil, errors.New("at least one template is required")
+	}
+
+	conf := *ahConfig
+	conf.EnableTemplateTokenCh = true
+	conf.EnableExecTokenCh = false
+
+	logger := tsConfig.Logger
+	if logger == nil {
+		logger = hclog.NewNullLogger()
+	}
+
+	ah := auth.NewAuthHandler(&conf)
+	tsConf := *tsConfig
+	if tsConf.TokenSequence == nil {
+		tsConf.TokenSequence = ah.TokenSequence
+	}
+
+	return &Pipeline{
+		AuthHandler: ah,
+		// Not exiting after auth, so that it keeps receiving tokens for as
+		// long as the auth handler runs
+		SinkServer: sink.NewSinkServer(&sink.SinkServerConfig{
+			Logger: logger.Named("sink.server"),
+			Client: conf.Client,
+		}),
+		TemplateServer: template.NewServer(&tsConf),
+		templates:      templates,
+	}, nil
+}
+
+// FirstPass returns a Pipeline which authenticates with an auth handler
+// created with ahConfig, writes the token to sinks through a sink server
+// created with ssConfig, and renders templates through a template server
+// created with tsConfig, once, as the agent does with exit_after_auth set.
+// Either sinks or templates may be empty, and tsConfig is only needed with
+// templates. Both servers are set to exit after auth, and the auth handler
+// not to deliver tokens to exec.
+//
+// Its Run returns exactly once the first full pass is complete, i.e. the
+// sink server has written the first token to every sink and the template
+// server has rendered every template with it, or, if timeout is set, once it
+// has elapsed, in which case an error is returned. Unlike SinkOnly and
+// TemplatesOnly, it waits for both servers, not whichever returns first.
+func FirstPass(ahConfig *auth.AuthHandlerConfig, ssConfig *sink.SinkServerConfig, tsConfig *template.ServerConfig, sinks []*sink.SinkConfig, templates []*ctconfig.TemplateConfig, timeout time.Duration) (*Pipeline, error) {
+	if ahConfig == nil {
+		return nil, errors.New("auth handler config is nil")
+	}
+	if ssConfig == nil {
+		return nil, errors.New("sink server config is nil")
+	}
+	if len(templates) > 0 && tsConfig == nil {
+		return nil, errors.New("template server config is nil")
+	}
+	if timeout < 0 {
+		return nil, errors.New("timeout must not be negative")
+	}
+
+	conf := *ahConfig
+	conf.EnableTemplateTokenCh = len(templates) > 0
+	conf.EnableExecTokenCh = false
+
+	ssConf := *ssConfig
+	ssConf.ExitAfterAuth = true
+
+	p := &Pipeline{
+		AuthHandler: auth.NewAuthHandler(&conf),
+		SinkServer:  sink.NewSinkServer(&ssConf),
+		sinks:       sinks,
+		templates:   templates,
+		firstPass:   true,
+		timeout:     timeout,
+	}
+	if len(templates) > 0 {
+		tsConf := *tsConfig
+		tsConf.ExitAfterAuth = true
+		if tsConf.TokenSequence == nil {
+			tsConf.TokenSequence = p.AuthHandler.TokenSequence
+		}
+		p.TemplateServer = template.NewServer(&tsConf)
+	}
+	return p, nil
+}
+
+// Run runs the auth handler with method, along with the servers it delivers
+// tokens to. It returns once ctx is done, the auth handler stops, or the
+// sink server (for SinkOnly) or template server (for TemplatesOnly) returns,
+// as it does after the first token if it's set to exit after auth. Whatever
+// returns first, the rest are stopped, and the errors from all of them are
+// returned. The method isn't shut down, as it's left to the caller.
+//
+// For Pipelines created by FirstPass, see FirstPass instead.
+func (p *Pipeline) Run(ctx context.Context, method auth.AuthMethod) error {
+	if p.firstPass {
+		return p.runFirstPass(ctx, method)
+	}
+
+	coord := NewCoordinator(ctx)
+	defer coord.Stop()
+
+	authErrCh := make(chan error, 1)
+	go func() {
+		authErrCh <- coord.RunAuth(func(ctx context.Context) error {
+			return p.AuthHandler.Run(ctx, method)
+		})
+	}()
+
+	sinkErrCh := make(chan error, 1)
+	go func() {
+		sinkErrCh <- coord.RunServer(func(ctx context.Context) error {
+			return p.SinkServer.Run(ctx, p.AuthHandler.OutputCh, p.sinks, p.AuthHandler.AuthInProgress)
+		})
+	}()
+
+	// With templates, the sink server only receives tokens for the auth
+	// handler's sake, so it's the template server that's waited for
+	serverErrCh := sinkErrCh
+	var templateErrCh chan error
+	if p.TemplateServer != nil {
+		templateErrCh = make(chan error, 1)
+		go func() {
+			templateErrCh <- coord.RunServer(func(ctx context.Context) error {
+				return p.TemplateServer.Run(ctx, p.AuthHandler.TemplateTokenCh, p.templates, p.AuthHandler.AuthInProgress, p.AuthHandler.InvalidToken)
+			})
+		}()
+		serverErrCh = templateErrCh
+	}
+
+	var errs *multierror.Error
+	authDone, serverDone := false, false
+	select {
+	case err := <-serverErrCh:
+		serverDone = true
+		errs = multierror.Append(errs, err)
+	case err := <-authErrCh:
+		authDone = true
+		errs = multierror.Append(errs, err)
+	}
+
+	coord.Stop()
+	if !authDone {
+		errs = multierror.Append(errs, <-authErrCh)
+	}
+	if !serverDone {
+		errs = multierror.Append(errs, <-serverErrCh)
+	}
+	if templateErrCh != nil {
+		errs = multierror.Append(errs, <-sinkErrCh)
+	}
+	return errs.ErrorOrNil()
+}
+
+// runFirstPass runs a Pipeline created by FirstPass.
+func (p *Pipeline) runFirstPass(ctx context.Context, method auth.AuthMethod) error {
+	coord := NewCoordinator(ctx)
+	defer coord.Stop()
+
+	authErrCh := make(chan error, 1)
+	go func() {
+		authErrCh <- coord.RunAuth(func(ctx context.Context) error {
+			return p.AuthHandler.Run(ctx, method)
+		})
+	}()
+
+	// The sink and template servers both return once they've written or
+	// rendered everything with the first token. After that, the tokens they
+	// would have received are drained, so that the auth handler isn't
+	// blocked delivering them while the other server finishes. Draining
+	// continues until the auth handler has returned, as it may be blocked
+	// delivering a token until then.
+	drainCtx, stopDraining := context.WithCancel(context.Background())
+	defer stopDraining()
+	pending := 1
+	passErrCh := make(chan error, 2)
+	go func() {
+		passErrCh <- coord.RunServer(func(ctx context.Context) error {
+			return p.SinkServer.Run(ctx, p.AuthHandler.OutputCh, p.sinks, p.AuthHandler.AuthInProgress)
+		})
+		drainTokens(drainCtx, p.AuthHandler.OutputCh)
+	}()
+	if p.TemplateServer != nil {
+		pending++
+		go func() {
+			passErrCh <- coord.RunServer(func(ctx context.Context) error {
+				return p.TemplateServer.Run(ctx, p.AuthHandler.TemplateTokenCh, p.templates, p.AuthHandler.AuthInProgress, p.AuthHandler.InvalidToken)
+			})
+			drainTokens(drainCtx, p.AuthHandler.TemplateTokenCh)
+		}()
+	}
+
+	var timeoutCh <-chan time.Time
+	if p.timeout > 0 {
+		timer := time.NewTimer(p.timeout)
+		defer timer.Stop()
+		timeoutCh = timer.C
+	}
+
+	var errs *multierror.Error
+	authDone, timedOut := false, false
+	for pending > 0 {
+		select {
+		case err := <-passErrCh:
+			pending--
+			errs = multierror.Append(errs, err)
+			if err != nil {
+				// There's no point waiting for the rest of the pass
+				coord.Stop()
+			}
+		case err := <-authErrCh:
+			// The auth handler only stops early if it fails with
+			// exit_on_err set, or the context is done
+			authDone = true
+			errs = multierror.Append(errs, err)
+			coord.Stop()
+		case <-timeoutCh:
+			timedOut = true
+			timeoutCh = nil
+			coord.Stop()
+		}
+	}
+
+	// Check whether the pass completed before it's cut short below
+	switch {
+	case timedOut:
+		errs = multierror.Append(errs, fmt.Errorf("timed out after %s before the first token was written and templates rendered", p.timeout))
+	case ctx.Err() != nil:
+		errs = multierror.Append(errs, fmt.Errorf("stopped before the first token was written and templates rendered: %w", ctx.Err()))
+	}
+
+	coord.Stop()
+	if !authDone {
+		errs = multierror.Append(errs, <-authErrCh)
+	}
+	return errs.ErrorOrNil()
+}
+
+// drainTokens receives and discards tokens from ch until ctx is done or ch is
+// closed.
+func drainTokens(ctx context.Context, ch chan string) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case _, ok := <-ch:
+			if !ok {
+				return
+			}
+		}
+	}
+}
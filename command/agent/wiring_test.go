@@ -0,0 +1,308 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: BUSL-1.1
+
+package agent
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	ctconfig "github.com/hashicorp/consul-template/config"
+	"github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/vault/api"
+	agentConfig "github.com/hashicorp/vault/command/agent/config"
+	"github.com/hashicorp/vault/command/agent/template"
+	"github.com/hashicorp/vault/command/agentproxyshared/auth"
+	"github.com/hashicorp/vault/command/agentproxyshared/auth/authtest"
+	tokenfile "github.com/hashicorp/vault/command/agentproxyshared/auth/token-file"
+	"github.com/hashicorp/vault/command/agentproxyshared/sink"
+	"github.com/hashicorp/vault/command/agentproxyshared/sink/file"
+	"github.com/hashicorp/vault/command/agentproxyshared/tracing"
+	"github.com/hashicorp/vault/helper/testhelpers/corehelpers"
+	"github.com/hashicorp/vault/sdk/helper/pointerutil"
+	"github.com/stretchr/testify/require"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+// newWiringTestServer returns a client for a server which answers token
+// lookups for token as if it were a root token.
+func newWiringTestServer(t *testing.T, token string) *api.Client {
+	t.Helper()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/auth/token/lookup-self" || r.Header.Get("X-Vault-Token") != token {
+			w.WriteHeader(http.StatusForbidden)
+			w.Write([]byte(`{"errors":["permission denied"]}`))
+			return
+		}
+		fmt.Fprintf(w, `{"data":{"id":%q,"ttl":0,"renewable":false,"type":"service","policies":["root"]}}`, token)
+	}))
+	t.Cleanup(server.Close)
+
+	client, err := api.NewClient(&api.Config{Address: server.URL})
+	require.NoError(t, err)
+	return client
+}
+
+func newWiringTestMethod(t *testing.T, token string) auth.AuthMethod {
+	t.Helper()
+
+	am, err := tokenfile.NewTokenFileAuthMethod(&auth.AuthConfig{
+		Logger: corehelpers.NewTestLogger(t).Named("auth.method"),
+		Config: map[string]interface{}{
+			"token_file_path": makeTempFile(t, "token-file", token),
+		},
+	})
+	require.NoError(t, err)
+	return am
+}
+
+// TestSinkOnly tests that a Pipeline created by SinkOnly writes the token to
+// its sinks, and returns once they're written with exit after auth set.
+func TestSinkOnly(t *testing.T) {
+	t.Setenv(api.EnvVaultAddress, "")
+	logger := corehelpers.NewTestLogger(t)
+	token := "sink-only-token"
+	client := newWiringTestServer(t, token)
+
+	pathSinkFile := makeTempFile(t, "sink-file", "")
+	config := &sink.SinkConfig{
+		Logger: logger.Named("sink.file"),
+		Config: map[string]interface{}{
+			"path": pathSinkFile,
+		},
+	}
+	fs, err := file.NewFileSink(config)
+	require.NoError(t, err)
+	config.Sink = fs
+
+	_, err = SinkOnly(&auth.AuthHandlerConfig{Logger: logger, Client: client}, &sink.SinkServerConfig{Logger: logger}, nil)
+	require.Error(t, err)
+
+	p, err := SinkOnly(&auth.AuthHandlerConfig{
+		Logger: logger.Named("auth.handler"),
+		Client: client,
+		// Nothing would receive these
+		EnableTemplateTokenCh: true,
+		EnableExecTokenCh:     true,
+	}, &sink.SinkServerConfig{
+		Logger:        logger.Named("sink.server"),
+		Client:        client,
+		ExitAfterAuth: true,
+	}, []*sink.SinkConfig{config})
+	require.NoError(t, err)
+	require.Nil(t, p.TemplateServer)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	require.NoError(t, p.Run(ctx, newWiringTestMethod(t, token)))
+	require.NoError(t, ctx.Err())
+
+	contents, err := os.ReadFile(pathSinkFile)
+	require.NoError(t, err)
+	require.Equal(t, token, string(contents))
+}
+
+// TestTemplatesOnly tests that a Pipeline created by TemplatesOnly renders its
+// templates without any sinks, and returns once they're rendered with exit
+// after auth set.
+func TestTemplatesOnly(t *testing.T) {
+	t.Setenv(api.EnvVaultAddress, "")
+	logger := corehelpers.NewTestLogger(t)
+	token := "templates-only-token"
+	client := newWiringTestServer(t, token)
+
+	tsConfig := &template.ServerConfig{
+		Logger: logger.Named("template.server"),
+		AgentConfig: &agentConfig.Config{
+			Vault: &agentConfig.Vault{
+				Address: client.Address(),
+			},
+		},
+		LogLevel:      hclog.Trace,
+		LogWriter:     hclog.DefaultOutput,
+		ExitAfterAuth: true,
+	}
+
+	_, err := TemplatesOnly(&auth.AuthHandlerConfig{Logger: logger, Client: client}, tsConfig, nil)
+	require.Error(t, err)
+
+	pathTemplateOutput := makeTempFile(t, "template-output", "")
+	templates := []*ctconfig.TemplateConfig{
+		{
+			Contents:    pointerutil.StringPtr(`rendered`),
+			Destination: pointerutil.StringPtr(pathTemplateOutput),
+		},
+	}
+
+	p, err := TemplatesOnly(&auth.AuthHandlerConfig{
+		Logger: logger.Named("auth.handler"),
+		Client: client,
+		// Nothing would receive these
+		EnableExecTokenCh: true,
+	}, tsConfig, templates)
+	require.NoError(t, err)
+	require.NotNil(t, p.TemplateServer)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	require.NoError(t, p.Run(ctx, newWiringTestMethod(t, token)))
+	require.NoError(t, ctx.Err())
+
+	contents, err := os.ReadFile(pathTemplateOutput)
+	require.NoError(t, err)
+	require.Equal(t, "rendered", string(contents))
+}
+
+// TestFirstPass tests that a Pipeline created by FirstPass returns once the
+// token has been written to its sinks and its templates rendered, and fails
+// if that doesn't happen within the timeout.
+func TestFirstPass(t *testing.T) {
+	t.Setenv(api.EnvVaultAddress, "")
+	logger := corehelpers.NewTestLogger(t)
+	token := "first-pass-token"
+	client := newWiringTestServer(t, token)
+
+	pathSinkFile := makeTempFile(t, "sink-file", "")
+	config := &sink.SinkConfig{
+		Logger: logger.Named("sink.file"),
+		Config: map[string]interface{}{
+			"path": pathSinkFile,
+		},
+	}
+	fs, err := file.NewFileSink(config)
+	require.NoError(t, err)
+	config.Sink = fs
+
+	pathTemplateOutput := makeTempFile(t, "template-output", "")
+	templates := []*ctconfig.TemplateConfig{
+		{
+			Contents:    pointerutil.StringPtr(`rendered`),
+			Destination: pointerutil.StringPtr(pathTemplateOutput),
+		},
+	}
+	tsConfig := &template.ServerConfig{
+		Logger: logger.Named("template.server"),
+		AgentConfig: &agentConfig.Config{
+			Vault: &agentConfig.Vault{
+				Address: client.Address(),
+			},
+		},
+		LogLevel:  hclog.Trace,
+		LogWriter: hclog.DefaultOutput,
+	}
+	ahConfig := &auth.AuthHandlerConfig{
+		Logger: logger.Named("auth.handler"),
+		Client: client,
+	}
+	ssConfig := &sink.SinkServerConfig{
+		Logger: logger.Named("sink.server"),
+		Client: client,
+	}
+
+	_, err = FirstPass(ahConfig, ssConfig, nil, nil, templates, 0)
+	require.Error(t, err)
+
+	p, err := FirstPass(ahConfig, ssConfig, tsConfig, []*sink.SinkConfig{config}, templates, 30*time.Second)
+	require.NoError(t, err)
+	require.NotNil(t, p.TemplateServer)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	require.NoError(t, p.Run(ctx, newWiringTestMethod(t, token)))
+	require.NoError(t, ctx.Err())
+
+	contents, err := os.ReadFile(pathSinkFile)
+	require.NoError(t, err)
+	require.Equal(t, token, string(contents))
+	contents, err = os.ReadFile(pathTemplateOutput)
+	require.NoError(t, err)
+	require.Equal(t, "rendered", string(contents))
+
+	// Authentication never succeeds, so the pass times out
+	p, err = FirstPass(ahConfig, ssConfig, nil, []*sink.SinkConfig{config}, nil, 500*time.Millisecond)
+	require.NoError(t, err)
+	require.Nil(t, p.TemplateServer)
+	err = p.Run(ctx, authtest.WithErrors(errors.New("login failed")))
+	require.ErrorContains(t, err, "timed out after 500ms")
+	require.NoError(t, ctx.Err())
+}
+
+// TestFirstPass_Tracing tests that with a Tracer shared by the auth handler
+// and servers, authenticating, writing the token to the sinks and rendering
+// the templates with it are traced as one trace.
+func TestFirstPass_Tracing(t *testing.T) {
+	t.Setenv(api.EnvVaultAddress, "")
+	logger := corehelpers.NewTestLogger(t)
+	token := "first-pass-tracing-token"
+	client := newWiringTestServer(t, token)
+
+	recorder := tracetest.NewSpanRecorder()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+	defer provider.Shutdown(context.Background())
+	tracer := tracing.NewTracer(provider.Tracer("vault-agent"))
+
+	pathSinkFile := makeTempFile(t, "sink-file", "")
+	config := &sink.SinkConfig{
+		Logger: logger.Named("sink.file"),
+		Config: map[string]interface{}{
+			"path": pathSinkFile,
+		},
+	}
+	fs, err := file.NewFileSink(config)
+	require.NoError(t, err)
+	config.Sink = fs
+
+	templates := []*ctconfig.TemplateConfig{
+		{
+			Contents:    pointerutil.StringPtr(`rendered`),
+			Destination: pointerutil.StringPtr(makeTempFile(t, "template-output", "")),
+		},
+	}
+	tsConfig := &template.ServerConfig{
+		Logger: logger.Named("template.server"),
+		AgentConfig: &agentConfig.Config{
+			Vault: &agentConfig.Vault{
+				Address: client.Address(),
+			},
+		},
+		LogLevel:  hclog.Trace,
+		LogWriter: hclog.DefaultOutput,
+		Tracer:    tracer,
+	}
+
+	p, err := FirstPass(&auth.AuthHandlerConfig{
+		Logger: logger.Named("auth.handler"),
+		Client: client,
+		Tracer: tracer,
+	}, &sink.SinkServerConfig{
+		Logger: logger.Named("sink.server"),
+		Client: client,
+		Tracer: tracer,
+	}, tsConfig, []*sink.SinkConfig{config}, templates, 30*time.Second)
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	require.NoError(t, p.Run(ctx, newWiringTestMethod(t, token)))
+
+	spans := make(map[string]sdktrace.ReadOnlySpan)
+	for _, span := range recorder.Ended() {
+		spans[span.Name()] = span
+	}
+	authSpan, ok := spans["auto-auth.authenticate"]
+	require.True(t, ok, "no auth span in %v", spans)
+	for _, name := range []string{"sink.write", "template.render"} {
+		span, ok := spans[name]
+		require.True(t, ok, "no %s span in %v", name, spans)
+		require.Equal(t, authSpan.SpanContext().TraceID(), span.SpanContext().TraceID(), name)
+		require.Equal(t, authSpan.SpanContext().SpanID(), span.Parent().SpanID(), name)
+	}
+}
@@ -12,6 +12,7 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"io/fs"
 	"net"
 	"net/http"
 	"os"
@@ -2843,6 +2844,65 @@ cache {}
 	wg.Wait()
 }
 
+// TestAgent_Verify tests that with -verify, the agent reports the problems
+// found with its configuration, exiting with code 1 if there are any and 0
+// otherwise, without writing the sink's token file.
+func TestAgent_Verify(t *testing.T) {
+	dir := t.TempDir()
+	roleIDPath := filepath.Join(dir, "role-id")
+	if err := os.WriteFile(roleIDPath, []byte("role"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	for name, tc := range map[string]struct {
+		sinkPath string
+		code     int
+		output   string
+	}{
+		"valid": {
+			sinkPath: filepath.Join(dir, "token"),
+			code:     0,
+			output:   "Configuration is valid",
+		},
+		"unwritable sink": {
+			sinkPath: filepath.Join(dir, "missing", "token"),
+			code:     1,
+			output:   "auto_auth.sink[0]",
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			config := populateTempFile(t, "agent-config.hcl", fmt.Sprintf(`
+auto_auth {
+  method {
+    type = "approle"
+    config = {
+      role_id_file_path = "%s"
+    }
+  }
+  sink {
+    type = "file"
+    config = {
+      path = "%s"
+    }
+  }
+}
+`, roleIDPath, tc.sinkPath))
+
+			ui, cmd := testAgentCommand(t, logging.NewVaultLogger(hclog.Trace))
+			code := cmd.Run([]string{"-config", config.Name(), "-verify"})
+			if code != tc.code {
+				t.Fatalf("expected code %d, got %d: %s%s", tc.code, code, ui.OutputWriter.String(), ui.ErrorWriter.String())
+			}
+			if output := ui.OutputWriter.String() + ui.ErrorWriter.String(); !strings.Contains(output, tc.output) {
+				t.Fatalf("expected output to contain %q, got %q", tc.output, output)
+			}
+			if _, err := os.Stat(tc.sinkPath); !errors.Is(err, fs.ErrNotExist) {
+				t.Fatalf("expected the sink's token file not to be written, got %v", err)
+			}
+		})
+	}
+}
+
 func TestAgent_LogFile_CliOverridesConfig(t *testing.T) {
 	// Create basic config
 	configFile := populateTempFile(t, "agent-config.hcl", BasicHclConfig)
@@ -10,14 +10,24 @@ import (
 	"io/ioutil"
 	"net/http"
 	"os"
+	"path/filepath"
 	"strings"
+	"sync"
+	"time"
 
 	hclog "github.com/hashicorp/go-hclog"
 	"github.com/hashicorp/go-secure-stdlib/parseutil"
 	"github.com/hashicorp/vault/api"
 	"github.com/hashicorp/vault/command/agentproxyshared/auth"
+	"github.com/hashicorp/vault/sdk/helper/consts"
 )
 
+// ErrSecretIDNotProvisioned is returned by Authenticate when the secret ID file
+// holds a wrapping token which has already been unwrapped or has expired. A
+// new wrapped secret ID must be written to the file before authentication can
+// succeed.
+var ErrSecretIDNotProvisioned = errors.New("secret ID not provisioned: wrapping token has already been used or has expired")
+
 type approleMethod struct {
 	logger    hclog.Logger
 	mountPath string
@@ -28,8 +38,29 @@ type approleMethod struct {
 	cachedSecretID                 string
 	removeSecretIDFileAfterReading bool
 	secretIDResponseWrappingPath   string
+	// unwrappedToken is the last wrapping token the cached secret ID was
+	// unwrapped from
+	unwrappedToken string
+
+	secretIDRotationPath     string
+	secretIDRotationInterval time.Duration
+	// client is the client last used to authenticate, from which the
+	// client used to rotate the secret ID is derived, and token the last
+	// token authenticated with, which it's rotated with
+	client *api.Client
+	token  string
+
+	l               sync.Mutex
+	ticker          *time.Ticker
+	stopCh          chan struct{}
+	doneCh          chan struct{}
+	credSuccessGate chan struct{}
+	once            *sync.Once
+	credsFound      chan struct{}
 }
 
+var _ auth.AuthMethodWithToken = &approleMethod{}
+
 func NewApproleAuthMethod(conf *auth.AuthConfig) (auth.AuthMethod, error) {
 	if conf == nil {
 		return nil, errors.New("empty config")
@@ -42,6 +73,10 @@ func NewApproleAuthMethod(conf *auth.AuthConfig) (auth.AuthMethod, error) {
 		logger:                         conf.Logger,
 		mountPath:                      conf.MountPath,
 		removeSecretIDFileAfterReading: true,
+		stopCh:                         make(chan struct{}),
+		doneCh:                         make(chan struct{}),
+		credSuccessGate:                make(chan struct{}),
+		once:                           new(sync.Once),
 	}
 
 	roleIDFilePathRaw, ok := conf.Config["role_id_file_path"]
@@ -85,12 +120,58 @@ func NewApproleAuthMethod(conf *auth.AuthConfig) (auth.AuthMethod, error) {
 				return nil, errors.New("'secret_id_response_wrapping_path' value is empty")
 			}
 		}
+
+		secretIDRotationPathRaw, ok := conf.Config["secret_id_rotation_path"]
+		if ok {
+			a.secretIDRotationPath, ok = secretIDRotationPathRaw.(string)
+			if !ok {
+				return nil, errors.New("could not convert 'secret_id_rotation_path' config value to string")
+			}
+			if a.secretIDRotationPath == "" {
+				return nil, errors.New("'secret_id_rotation_path' value is empty")
+			}
+		}
+
+		secretIDRotationIntervalRaw, ok := conf.Config["secret_id_rotation_interval"]
+		if ok {
+			interval, err := parseutil.ParseDurationSecond(secretIDRotationIntervalRaw)
+			if err != nil {
+				return nil, fmt.Errorf("error parsing 'secret_id_rotation_interval' value: %w", err)
+			}
+			if interval <= 0 {
+				return nil, errors.New("'secret_id_rotation_interval' value must be positive")
+			}
+			a.secretIDRotationInterval = interval
+		}
+
+		if (a.secretIDRotationPath == "") != (a.secretIDRotationInterval == 0) {
+			return nil, errors.New("'secret_id_rotation_path' and 'secret_id_rotation_interval' must be set together")
+		}
+		// The rotated secret ID is written to the secret ID file, unwrapped,
+		// to be used after a restart
+		if a.isRotationConfigured() && a.removeSecretIDFileAfterReading {
+			return nil, errors.New("'secret_id_rotation_path' requires 'remove_secret_id_file_after_reading' to be false")
+		}
+		if a.isRotationConfigured() && a.secretIDResponseWrappingPath != "" {
+			return nil, errors.New("'secret_id_rotation_path' can't be used with 'secret_id_response_wrapping_path'")
+		}
+	}
+
+	if a.isRotationConfigured() {
+		a.credsFound = make(chan struct{})
+		a.ticker = time.NewTicker(a.secretIDRotationInterval)
+
+		go a.runRotation()
 	}
 
 	return a, nil
 }
 
 func (a *approleMethod) Authenticate(ctx context.Context, client *api.Client) (string, http.Header, map[string]interface{}, error) {
+	a.l.Lock()
+	defer a.l.Unlock()
+	a.client = client
+
 	if _, err := os.Stat(a.roleIDFilePath); err == nil {
 		roleID, err := ioutil.ReadFile(a.roleIDFilePath)
 		if err != nil {
@@ -133,8 +214,17 @@ func (a *approleMethod) Authenticate(ctx context.Context, client *api.Client) (s
 			}
 			a.logger.Warn("secret ID file exists but read empty value, re-using cached value")
 		} else {
-			stringSecretID := strings.TrimSpace(string(secretID))
-			if a.secretIDResponseWrappingPath != "" {
+			fileSecretID := strings.TrimSpace(string(secretID))
+			stringSecretID := fileSecretID
+			switch {
+			case a.secretIDResponseWrappingPath == "":
+			case fileSecretID == a.unwrappedToken && a.cachedSecretID != "":
+				// Wrapping tokens can only be used once, so if the file hasn't
+				// been removed after reading, use the secret ID we've already
+				// unwrapped from it
+				a.logger.Debug("wrapping token in secret ID file has already been unwrapped, re-using cached value")
+				stringSecretID = a.cachedSecretID
+			default:
 				clonedClient, err := client.Clone()
 				if err != nil {
 					return "", nil, nil, fmt.Errorf("error cloning client to unwrap secret ID: %w", err)
@@ -143,7 +233,7 @@ func (a *approleMethod) Authenticate(ctx context.Context, client *api.Client) (s
 				// Validate the creation path
 				resp, err := clonedClient.Logical().ReadWithContext(ctx, "sys/wrapping/lookup")
 				if err != nil {
-					return "", nil, nil, fmt.Errorf("error looking up wrapped secret ID: %w", err)
+					return "", nil, nil, fmt.Errorf("error looking up wrapped secret ID: %w", wrappingTokenError(err))
 				}
 				if resp == nil {
 					return "", nil, nil, errors.New("response nil when looking up wrapped secret ID")
@@ -166,7 +256,7 @@ func (a *approleMethod) Authenticate(ctx context.Context, client *api.Client) (s
 				// Now get the secret ID
 				resp, err = clonedClient.Logical().UnwrapWithContext(ctx, "")
 				if err != nil {
-					return "", nil, nil, fmt.Errorf("error unwrapping secret ID: %w", err)
+					return "", nil, nil, fmt.Errorf("error unwrapping secret ID: %w", wrappingTokenError(err))
 				}
 				if resp == nil {
 					return "", nil, nil, errors.New("response nil when unwrapping secret ID")
@@ -183,6 +273,7 @@ func (a *approleMethod) Authenticate(ctx context.Context, client *api.Client) (s
 					return "", nil, nil, errors.New("secret_id in response could not be parsed as string when unwrapping secret ID")
 				}
 				stringSecretID = secretID
+				a.unwrappedToken = fileSecretID
 			}
 			a.cachedSecretID = stringSecretID
 			if a.removeSecretIDFileAfterReading {
@@ -203,12 +294,154 @@ func (a *approleMethod) Authenticate(ctx context.Context, client *api.Client) (s
 	}, nil
 }
 
+// wrappingTokenError returns ErrSecretIDNotProvisioned, wrapping err, if err
+// is due to the wrapping token being invalid, e.g. because it has already been
+// used. Otherwise err is returned as is.
+func wrappingTokenError(err error) error {
+	if strings.Contains(err.Error(), consts.ErrInvalidWrappingToken.Error()) {
+		return fmt.Errorf("%w: %w", ErrSecretIDNotProvisioned, err)
+	}
+	return err
+}
+
 func (a *approleMethod) NewCreds() chan struct{} {
-	return nil
+	return a.credsFound
 }
 
 func (a *approleMethod) CredSuccess() {
+	a.once.Do(func() {
+		close(a.credSuccessGate)
+	})
+}
+
+// Authenticated records the token authenticated with, to rotate the secret ID
+// with, so that rotating doesn't use up one of the secret ID's uses.
+func (a *approleMethod) Authenticated(token string) {
+	a.l.Lock()
+	defer a.l.Unlock()
+	a.token = token
 }
 
 func (a *approleMethod) Shutdown() {
+	if a.isRotationConfigured() {
+		a.ticker.Stop()
+		close(a.stopCh)
+		<-a.doneCh
+	}
+}
+
+func (a *approleMethod) isRotationConfigured() bool {
+	return a.secretIDRotationPath != ""
+}
+
+// runRotation fetches a new secret ID on every tick of the rotation interval,
+// which is then used for subsequent logins.
+func (a *approleMethod) runRotation() {
+	defer close(a.doneCh)
+
+	select {
+	case <-a.stopCh:
+		return
+
+	case <-a.credSuccessGate:
+		// We only start rotating once we've successfully authenticated,
+		// so that there's a secret ID to rotate and a client to use
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-a.stopCh:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	for {
+		select {
+		case <-a.stopCh:
+			return
+
+		case <-a.ticker.C:
+		}
+
+		if err := a.rotateSecretID(ctx); err != nil {
+			a.logger.Error("error rotating secret ID, will retry at the next interval", "error", err)
+			continue
+		}
+
+		a.logger.Info("rotated secret ID")
+		select {
+		case a.credsFound <- struct{}{}:
+		case <-a.stopCh:
+		}
+	}
+}
+
+// rotateSecretID uses the token last authenticated with to fetch a new secret
+// ID from the rotation path, and writes it to the secret ID file, so that it's
+// used for subsequent logins, including after a restart.
+func (a *approleMethod) rotateSecretID(ctx context.Context) error {
+	a.l.Lock()
+	client, token := a.client, a.token
+	a.l.Unlock()
+
+	if client == nil || token == "" {
+		return errors.New("no token known to rotate the secret ID with")
+	}
+
+	rotationClient, err := client.CloneWithHeaders()
+	if err != nil {
+		return fmt.Errorf("error cloning client to rotate secret ID: %w", err)
+	}
+	rotationClient.SetToken(token)
+
+	resp, err := rotationClient.Logical().WriteWithContext(ctx, a.secretIDRotationPath, nil)
+	if err != nil {
+		return fmt.Errorf("error fetching new secret ID: %w", err)
+	}
+	if resp == nil || resp.Data == nil {
+		return errors.New("data in response nil when fetching new secret ID")
+	}
+	newSecretID, ok := resp.Data["secret_id"].(string)
+	if !ok || newSecretID == "" {
+		return errors.New("secret_id in response could not be parsed as string when fetching new secret ID")
+	}
+
+	a.l.Lock()
+	defer a.l.Unlock()
+	if err := writeFileAtomic(a.secretIDFilePath, newSecretID); err != nil {
+		return fmt.Errorf("error writing new secret ID to file: %w", err)
+	}
+	a.cachedSecretID = newSecretID
+	return nil
+}
+
+// writeFileAtomic replaces the file at path with one holding contents, with
+// the same permissions, so that it's never read part written.
+func writeFileAtomic(path, contents string) error {
+	mode := os.FileMode(0o600)
+	if info, err := os.Stat(path); err == nil {
+		mode = info.Mode().Perm()
+	}
+
+	f, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	if _, err := f.WriteString(contents); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Chmod(mode); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path)
 }
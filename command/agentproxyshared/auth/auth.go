@@ -11,17 +11,72 @@ import (
 	"math"
 	"math/rand"
 	"net/http"
+	"sort"
+	"strings"
+	"sync"
 	"sync/atomic"
 	"time"
 
 	"github.com/armon/go-metrics"
 	"github.com/hashicorp/go-hclog"
 	"github.com/hashicorp/vault/api"
+	"github.com/hashicorp/vault/command/agentproxyshared/errorfile"
+	"github.com/hashicorp/vault/command/agentproxyshared/tracing"
+	"github.com/hashicorp/vault/helper/logging"
 	"github.com/hashicorp/vault/sdk/helper/backoff"
 	"github.com/hashicorp/vault/sdk/helper/consts"
 	"github.com/hashicorp/vault/sdk/helper/jsonutil"
+	"go.opentelemetry.io/otel/trace"
 )
 
+// lastAuthGaugeInterval is how often the seconds_since_last_auth gauge is
+// refreshed while the auth handler is running.
+const lastAuthGaugeInterval = 10 * time.Second
+
+const (
+	// authRequestRetries is how many times a login or token lookup which
+	// times out or fails with a server error is retried straight away, when the handler
+	// has an AuthRequestTimeout, before the handler backs off. It's also how
+	// many times an auth method's TransientError is retried.
+	authRequestRetries = 2
+
+	// authRequestRetryWait is how long to wait between those retries.
+	authRequestRetryWait = 250 * time.Millisecond
+)
+
+// OutputDeliveryMode controls what the AuthHandler does when a token can't be
+// sent on its OutputCh straight away, because the sink server isn't keeping
+// up.
+type OutputDeliveryMode string
+
+const (
+	// OutputDeliveryBlock waits for the token to be received, however long
+	// that takes, during which the handler doesn't renew or re-authenticate.
+	// It's the default.
+	OutputDeliveryBlock OutputDeliveryMode = "block"
+
+	// OutputDeliveryDrop waits up to the OutputDeliveryTimeout, and then
+	// drops the token with a warning, leaving any token already waiting to
+	// be received.
+	OutputDeliveryDrop OutputDeliveryMode = "drop"
+
+	// OutputDeliveryLatest waits up to the OutputDeliveryTimeout, and then
+	// replaces the token waiting to be received with the new one, so that
+	// the sink server gets the latest token once it catches up.
+	OutputDeliveryLatest OutputDeliveryMode = "latest"
+)
+
+// defaultOutputDeliveryTimeout is the OutputDeliveryTimeout used when it
+// isn't set and the OutputDeliveryMode isn't OutputDeliveryBlock.
+const defaultOutputDeliveryTimeout = 10 * time.Second
+
+// errorFileSource identifies the handler's errors in the ErrorFile.
+const errorFileSource = "auth"
+
+// errAuthAttemptFailed marks the span of an authentication attempt which
+// didn't deliver a token. The reason is logged, rather than traced.
+var errAuthAttemptFailed = errors.New("authentication attempt failed")
+
 // AuthMethod is the interface that auto-auth methods implement for the agent/proxy
 // to use.
 type AuthMethod interface {
@@ -40,6 +95,70 @@ type AuthMethodWithClient interface {
 	AuthClient(client *api.Client) (*api.Client, error)
 }
 
+// AuthMethodWithHealth is an extended interface for auth methods that can
+// cheaply check whether they could authenticate, such as that a file they
+// read credentials from exists, without performing a login.
+type AuthMethodWithHealth interface {
+	AuthMethod
+	Healthy(ctx context.Context) error
+}
+
+// AuthMethodWithLogin is an extended interface for auth methods which complete
+// the login themselves, such as interactive ones, rather than returning a
+// request for the handler to make. The handler uses the response Login
+// returns as it would the response to that request, and doesn't call
+// Authenticate.
+type AuthMethodWithLogin interface {
+	AuthMethod
+	Login(ctx context.Context, client *api.Client) (*api.Secret, error)
+}
+
+// AuthMethodWithToken is an extended interface for auth methods which make
+// requests of their own with the token the handler authenticated with, such
+// as to rotate their credentials. Authenticated is called with each token
+// the handler authenticates with, other than wrapped ones, before CredSuccess.
+type AuthMethodWithToken interface {
+	AuthMethod
+	Authenticated(token string)
+}
+
+// AuthMethodWithRejection is an extended interface for auth methods whose
+// credentials may be replaced while they're being used, such as a token file
+// being rewritten by a provisioner.
+type AuthMethodWithRejection interface {
+	AuthMethod
+	// Rejected is called when Vault rejects the credentials Authenticate
+	// returned with err. If it returns true, as it has newer ones, the
+	// handler calls Authenticate again and retries the request, once, before
+	// counting the attempt as failed.
+	Rejected(ctx context.Context, err error) bool
+}
+
+// Healthy returns the result of the method's health check, if it has one.
+// Methods which don't implement AuthMethodWithHealth are always healthy.
+func Healthy(ctx context.Context, method AuthMethod) error {
+	if h, ok := method.(AuthMethodWithHealth); ok {
+		return h.Healthy(ctx)
+	}
+	return nil
+}
+
+// TransientError is returned by an AuthMethod's Authenticate when the attempt
+// failed for a reason likely to clear up straight away, such as a device it
+// reads credentials from being busy. The handler retries these up to
+// authRequestRetries times before backing off.
+type TransientError struct {
+	Err error
+}
+
+func (e *TransientError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *TransientError) Unwrap() error {
+	return e.Err
+}
+
 type AuthConfig struct {
 	Logger    hclog.Logger
 	MountPath string
@@ -55,10 +174,14 @@ type AuthHandler struct {
 	ExecTokenCh                  chan string
 	AuthInProgress               *atomic.Bool
 	InvalidToken                 chan error
+	EventCh                      chan AuthEvent
 	token                        string
 	userAgent                    string
 	metricsSignifier             string
 	logger                       hclog.Logger
+	errLogger                    *logging.RateLimitedLogger
+	errorFile                    *errorfile.File
+	renewIncrement               time.Duration
 	client                       *api.Client
 	random                       *rand.Rand
 	wrapTTL                      time.Duration
@@ -67,7 +190,108 @@ type AuthHandler struct {
 	enableReauthOnNewCredentials bool
 	enableTemplateTokenCh        bool
 	enableExecTokenCh            bool
+	enableEventCh                bool
 	exitOnError                  bool
+	errorClassifier              ErrorClassifier
+	authMethodName               string
+	expiryWarnFraction           float64
+	tokenValidator               TokenValidator
+	namespace                    string
+	authRequestTimeout           time.Duration
+	outputDeliveryMode           OutputDeliveryMode
+	outputDeliveryTimeout        time.Duration
+	authHeaders                  http.Header
+
+	// lastDelivered is the last token sent to the sinks, templates and exec
+	// process
+	lastDelivered string
+
+	// lastAuthTime is the time, in Unix nanoseconds, at which a token was
+	// last successfully obtained or renewed. It is zero if the handler has
+	// never authenticated.
+	lastAuthTime atomic.Int64
+
+	pause            pauseState
+	renewWhilePaused bool
+
+	expectedPolicies map[string]struct{}
+
+	tracer *tracing.Tracer
+
+	// reauthLimiter is nil unless MaxReauthsPerWindow is set
+	reauthLimiter *reauthLimiter
+
+	tokenOverrides *TokenOverrides
+
+	tokenStore          *TokenStore
+	triedPersistedToken bool
+	exitAfterAuth       bool
+
+	// reauthCh holds the reason for a re-authentication requested with
+	// TriggerReauth, and reauthenticating is set while the handler is
+	// authenticating, so that requests made meanwhile are dropped
+	reauthCh         chan string
+	reauthenticating atomic.Bool
+
+	eventHistory *eventHistory
+
+	// eventL guards EventCh, which Run closes on returning, setting stopped,
+	// so that events emitted afterwards, e.g. by Pause, are dropped, and
+	// TriggerReauth does nothing
+	eventL  sync.Mutex
+	stopped bool
+
+	// current is the last token delivered, while it's usable, for
+	// CurrentToken
+	current atomic.Pointer[currentToken]
+
+	sequences tokenSequences
+}
+
+// maxSequencedTokens is how many of the tokens delivered most recently
+// TokenSequence remembers.
+const maxSequencedTokens = 16
+
+// tokenSequences numbers the tokens the handler delivers in the order it
+// first delivers them, for TokenSequence.
+type tokenSequences struct {
+	l    sync.Mutex
+	last uint64
+	seqs map[string]uint64
+}
+
+// stamp numbers token, unless it's already been numbered, forgetting tokens
+// which are no longer among the most recent maxSequencedTokens.
+func (s *tokenSequences) stamp(token string) {
+	s.l.Lock()
+	defer s.l.Unlock()
+	if _, ok := s.seqs[token]; ok {
+		return
+	}
+	if s.seqs == nil {
+		s.seqs = make(map[string]uint64)
+	}
+	s.last++
+	s.seqs[token] = s.last
+	for t, seq := range s.seqs {
+		if s.last-seq >= maxSequencedTokens {
+			delete(s.seqs, t)
+		}
+	}
+}
+
+func (s *tokenSequences) get(token string) (uint64, bool) {
+	s.l.Lock()
+	defer s.l.Unlock()
+	seq, ok := s.seqs[token]
+	return seq, ok
+}
+
+// currentToken is a delivered token, and the time at which it expires, or
+// the zero time if it doesn't.
+type currentToken struct {
+	token  string
+	expiry time.Time
 }
 
 type AuthHandlerConfig struct {
@@ -82,14 +306,148 @@ type AuthHandlerConfig struct {
 	UserAgent string
 	// MetricsSignifier is the first argument we will give to
 	// metrics.IncrCounter, signifying what the name of the application is
-	MetricsSignifier             string
+	MetricsSignifier string
+	// AuthMethodName is the type of the auto-auth method in use, e.g.
+	// "approle". It is used as the auth_method label on auth metrics.
+	AuthMethodName               string
 	EnableReauthOnNewCredentials bool
 	EnableTemplateTokenCh        bool
 	EnableExecTokenCh            bool
-	ExitOnError                  bool
+	// EnableEventCh enables delivery of AuthEvents on the handler's EventCh.
+	EnableEventCh bool
+	// EventHistorySize, if set, is the number of the most recent AuthEvents
+	// kept for RecentEvents, whether or not EnableEventCh is set.
+	EventHistorySize int
+	// ExpiryWarnFraction, if set, causes a TokenNearExpiry event to be emitted
+	// when the current token has less than this fraction of its TTL left,
+	// regardless of whether the token is being renewed, or once its lifetime
+	// watcher reports it can't be renewed any further, if that's sooner. The
+	// TTL is reset by each renewal. It must be in [0, 1).
+	ExpiryWarnFraction float64
+	// TokenValidator, if set, is called with each newly obtained token before
+	// it's delivered to the sinks, templates, or exec process. If it returns
+	// an error, the token is revoked, unless it was read from a token file or
+	// preloaded, and authentication is retried. It is not called when the
+	// token is response-wrapped.
+	TokenValidator TokenValidator
+	// Namespace, if set, is the namespace in which auto-auth authenticates
+	// and looks up its token, overriding any namespace set on Client. It is
+	// applied to the client used for every authentication attempt, including
+	// clients returned by an AuthMethodWithClient.
+	Namespace string
+	// AuthRequestTimeout, if set, limits how long each request to Vault made
+	// to log in or look up a token may take, and each call to the
+	// TokenValidator, separately from the context passed to Run. Requests
+	// which time out or fail with a server error are retried a small number
+	// of times before falling back to the usual backoff. If unset, requests
+	// are only limited by the client's own timeout, and aren't retried.
+	AuthRequestTimeout time.Duration
+	// LogRateLimitWindow, if set, is the window within which repeats of the
+	// errors logged while authentication is failing are collapsed into a
+	// count, so that an outage doesn't flood the logs.
+	LogRateLimitWindow time.Duration
+	// RedactTokens, if set, replaces anything in the handler's log messages
+	// and arguments which looks like a Vault token with "REDACTED", at every
+	// level including trace. It's a safety net for environments where tokens
+	// must never reach the logs, see logging.NewRedactingLogger. It's off by
+	// default, as redacting adds a pattern match to each log call.
+	RedactTokens bool
+	// OutputDeliveryMode controls what happens when a token can't be sent on
+	// OutputCh within the OutputDeliveryTimeout. If unset, sending blocks
+	// until the token is received, as with OutputDeliveryBlock.
+	OutputDeliveryMode OutputDeliveryMode
+	// OutputDeliveryTimeout is how long to wait to send a token on OutputCh
+	// before applying the OutputDeliveryMode. If unset, it defaults to ten
+	// seconds. It's ignored with OutputDeliveryBlock.
+	OutputDeliveryTimeout time.Duration
+	// RenewIncrement, if set, is the increment requested each time the
+	// token is renewed, capping how far each renewal extends its TTL. It must
+	// be a whole number of seconds. Vault may grant less, e.g. once the
+	// token nears its max TTL, which is logged. If unset, Vault chooses the
+	// increment.
+	RenewIncrement time.Duration
+	// RenewWhilePaused, if set, keeps the current token renewed while the
+	// handler is paused. Otherwise renewal stops until it's resumed.
+	RenewWhilePaused bool
+	// MaxReauthsPerWindow, if set, caps how many times the handler
+	// authenticates, obtaining a new token, within any Window, as a safety
+	// valve against re-authentication storms exhausting token quotas. Beyond
+	// it, an error is logged, a ReauthRateLimited event emitted, and the
+	// current token kept until the window allows another. Renewals don't
+	// count. It requires Window.
+	MaxReauthsPerWindow int
+	// Window is the sliding window over which MaxReauthsPerWindow applies.
+	Window time.Duration
+	// ExpectedPolicies, if set, are the policies each newly obtained token
+	// is expected to have. If a token has any others, including identity
+	// policies, they're logged and an UnexpectedPolicies event is emitted,
+	// to help catch over-privileged tokens, but the token is still used. It
+	// isn't checked when the token is response-wrapped.
+	ExpectedPolicies []string
+	// TokenOverrides, if set, are parameters of the tokens created when
+	// authenticating, overriding the defaults of the auth method's role,
+	// for auth methods which implement AuthMethodWithTokenParameters; Run
+	// returns an error if they're set for any other method. A warning is
+	// logged for overrides Vault clamps, or doesn't grant in full.
+	TokenOverrides *TokenOverrides
+	// TokenStore, if set, is where each token obtained or renewed is
+	// persisted, encrypted, so that if authentication fails when the handler
+	// starts because Vault can't be reached or is failing, the last token can
+	// be delivered until it succeeds, provided it's still valid. Wrapped
+	// tokens aren't persisted.
+	TokenStore *TokenStore
+	// ExitAfterAuth is set if the servers the handler delivers tokens to exit
+	// once they've been delivered the first, so that a persisted token, which
+	// may not be valid, isn't delivered in place of one obtained by
+	// authenticating. Tokens are still persisted for later runs.
+	ExitAfterAuth bool
+	// AuthHeaders, if set, are HTTP headers set on the client used for every
+	// authentication attempt, including clients returned by an
+	// AuthMethodWithClient, e.g. for a gateway in front of Vault which
+	// requires its own key. They replace any values the client already has
+	// for the same headers, and can't include Vault's own X-Vault- headers.
+	AuthHeaders http.Header
+	// ErrorFile, if set, is updated with each authentication or renewal
+	// failure, and cleared once the handler succeeds again.
+	ErrorFile *errorfile.File
+	// Tracer, if set, traces each authentication, from the attempt starting
+	// until its token has been delivered. Passing the same Tracer to the sink
+	// and template servers the token is delivered to makes their spans for it
+	// part of the same trace.
+	Tracer *tracing.Tracer
+	// ErrorClassifier, if set, decides what the handler does after each
+	// failed attempt to authenticate, such as backing off for longer on
+	// errors from rate limiting, or exiting on errors retrying won't fix. If
+	// unset, the handler backs off before trying again, and with ExitOnError
+	// set, exits once the backoff's retries are exhausted.
+	ErrorClassifier ErrorClassifier
+	ExitOnError     bool
 }
 
+// ValidateAuthHeaders returns an error if headers, such as the AuthHeaders of
+// an AuthHandlerConfig, has an empty name or one of Vault's own X-Vault-
+// headers, which auto-auth manages itself.
+func ValidateAuthHeaders(headers http.Header) error {
+	for key := range headers {
+		if strings.TrimSpace(key) == "" {
+			return errors.New("auth header names must not be empty")
+		}
+		if strings.HasPrefix(strings.ToLower(key), "x-vault-") {
+			return fmt.Errorf("auth header %q is reserved by Vault and can't be set", key)
+		}
+	}
+	return nil
+}
+
+// TokenValidator vets a token obtained by the AuthHandler, returning an error
+// if the token shouldn't be used.
+type TokenValidator func(ctx context.Context, auth *api.Secret) error
+
 func NewAuthHandler(conf *AuthHandlerConfig) *AuthHandler {
+	logger := conf.Logger
+	if conf.RedactTokens {
+		logger = logging.NewRedactingLogger(logger)
+	}
 	ah := &AuthHandler{
 		// This is buffered so that if we try to output after the sink server
 		// has been shut down, during agent/proxy shutdown, we won't block
@@ -97,9 +455,12 @@ func NewAuthHandler(conf *AuthHandlerConfig) *AuthHandler {
 		TemplateTokenCh:              make(chan string, 1),
 		ExecTokenCh:                  make(chan string, 1),
 		InvalidToken:                 make(chan error, 1),
+		reauthCh:                     make(chan string, 1),
+		EventCh:                      make(chan AuthEvent, 10),
 		AuthInProgress:               &atomic.Bool{},
 		token:                        conf.Token,
-		logger:                       conf.Logger,
+		logger:                       logger,
+		errLogger:                    logging.NewRateLimitedLogger(logger, conf.LogRateLimitWindow),
 		client:                       conf.Client,
 		random:                       rand.New(rand.NewSource(int64(time.Now().Nanosecond()))),
 		wrapTTL:                      conf.WrapTTL,
@@ -108,14 +469,157 @@ func NewAuthHandler(conf *AuthHandlerConfig) *AuthHandler {
 		enableReauthOnNewCredentials: conf.EnableReauthOnNewCredentials,
 		enableTemplateTokenCh:        conf.EnableTemplateTokenCh,
 		enableExecTokenCh:            conf.EnableExecTokenCh,
+		enableEventCh:                conf.EnableEventCh,
+		expiryWarnFraction:           conf.ExpiryWarnFraction,
+		tokenValidator:               conf.TokenValidator,
+		namespace:                    conf.Namespace,
+		authRequestTimeout:           conf.AuthRequestTimeout,
+		outputDeliveryMode:           conf.OutputDeliveryMode,
+		outputDeliveryTimeout:        conf.OutputDeliveryTimeout,
+		authHeaders:                  conf.AuthHeaders.Clone(),
+		errorFile:                    conf.ErrorFile,
+		tracer:                       conf.Tracer,
+		eventHistory:                 newEventHistory(conf.EventHistorySize),
+		renewIncrement:               conf.RenewIncrement,
+		renewWhilePaused:             conf.RenewWhilePaused,
 		exitOnError:                  conf.ExitOnError,
+		errorClassifier:              conf.ErrorClassifier,
 		userAgent:                    conf.UserAgent,
 		metricsSignifier:             conf.MetricsSignifier,
+		authMethodName:               conf.AuthMethodName,
+		tokenStore:                   conf.TokenStore,
+		exitAfterAuth:                conf.ExitAfterAuth,
+		tokenOverrides:               conf.TokenOverrides,
+	}
+
+	if conf.MaxReauthsPerWindow > 0 {
+		ah.reauthLimiter = &reauthLimiter{
+			max:    conf.MaxReauthsPerWindow,
+			window: conf.Window,
+		}
+	}
+
+	if len(conf.ExpectedPolicies) > 0 {
+		ah.expectedPolicies = make(map[string]struct{}, len(conf.ExpectedPolicies))
+		for _, policy := range conf.ExpectedPolicies {
+			ah.expectedPolicies[policy] = struct{}{}
+		}
 	}
 
 	return ah
 }
 
+// LastAuthTime returns the time at which the handler last successfully
+// authenticated or renewed its token, or the zero time if it never has.
+func (ah *AuthHandler) LastAuthTime() time.Time {
+	nanos := ah.lastAuthTime.Load()
+	if nanos == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, nanos)
+}
+
+// CurrentToken returns the token last delivered to the sinks, response
+// wrapped if WrapTTL is set, and whether there is one. There's none before
+// the handler first authenticates, once the token has expired or renewing
+// it has failed because it's no longer valid, or after Run returns.
+func (ah *AuthHandler) CurrentToken() (string, bool) {
+	current := ah.current.Load()
+	if current == nil || (!current.expiry.IsZero() && !time.Now().Before(current.expiry)) {
+		return "", false
+	}
+	return current.token, true
+}
+
+// TokenSequence returns the sequence number the handler stamped token with
+// when it first delivered it, and whether it's one of the tokens it delivered
+// most recently. Tokens delivered later have higher numbers, so that those
+// receiving tokens from the handler, such as the template server, can tell a
+// superseded token delivered late from a new one. A renewed token keeps its
+// number.
+func (ah *AuthHandler) TokenSequence(token string) (uint64, bool) {
+	return ah.sequences.get(token)
+}
+
+// setCurrentToken records the token last delivered, with its remaining TTL,
+// or 0 if it doesn't expire, and persists it to the TokenStore, if any.
+func (ah *AuthHandler) setCurrentToken(token string, ttl time.Duration) {
+	current := &currentToken{token: token}
+	if ttl > 0 {
+		current.expiry = time.Now().Add(ttl)
+	}
+	ah.current.Store(current)
+	ah.persistToken(token, current.expiry)
+}
+
+// TriggerReauth requests that the handler re-authenticate straight away,
+// e.g. because its token is known to have been revoked, rather than waiting
+// for renewal or a template render to fail. It doesn't block. The request is
+// dropped if the handler is already authenticating, or another request is
+// waiting to be handled. Otherwise a ReauthTriggered event is emitted with
+// the reason. If the handler is paused, it re-authenticates once resumed.
+// Once Run has returned, it does nothing.
+func (ah *AuthHandler) TriggerReauth(reason string) {
+	// Held throughout, so that the request and its event aren't left behind
+	// by a Run which returns meanwhile
+	ah.eventL.Lock()
+	defer ah.eventL.Unlock()
+	if ah.stopped {
+		ah.logger.Info("auth handler has stopped, ignoring re-authentication request", "reason", reason)
+		return
+	}
+	if ah.reauthenticating.Load() {
+		ah.logger.Info("re-authentication already in progress, ignoring request", "reason", reason)
+		return
+	}
+	select {
+	case ah.reauthCh <- reason:
+		ah.logger.Info("re-authentication requested", "reason", reason)
+		ah.emitEventLocked(AuthEvent{
+			Type:   ReauthTriggered,
+			Reason: reason,
+		})
+	default:
+		ah.logger.Info("re-authentication already requested, ignoring request", "reason", reason)
+	}
+}
+
+// setAuthenticated records a successful authentication or renewal.
+func (ah *AuthHandler) setAuthenticated() {
+	ah.lastAuthTime.Store(time.Now().UnixNano())
+	ah.emitSecondsSinceLastAuth()
+	ah.errorFile.Clear(errorFileSource)
+}
+
+// emitSecondsSinceLastAuth sets the seconds_since_last_auth gauge. If the
+// handler has never authenticated, the gauge is set to a large sentinel value
+// so that alerts on staleness fire.
+func (ah *AuthHandler) emitSecondsSinceLastAuth() {
+	value := float32(math.MaxInt32)
+	if last := ah.LastAuthTime(); !last.IsZero() {
+		value = float32(time.Since(last).Seconds())
+	}
+	metrics.SetGaugeWithLabels([]string{ah.metricsSignifier, "seconds_since_last_auth"}, value, []metrics.Label{
+		{Name: "auth_method", Value: ah.authMethodName},
+	})
+}
+
+// runLastAuthGauge periodically updates the seconds_since_last_auth gauge
+// until the context is cancelled.
+func (ah *AuthHandler) runLastAuthGauge(ctx context.Context) {
+	ticker := time.NewTicker(lastAuthGaugeInterval)
+	defer ticker.Stop()
+
+	for {
+		ah.emitSecondsSinceLastAuth()
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
 func backoffSleep(ctx context.Context, backoff *autoAuthBackoff) bool {
 	nextSleep, err := backoff.backoff.Next()
 	if err != nil {
@@ -142,6 +646,29 @@ func (ah *AuthHandler) Run(ctx context.Context, am AuthMethod) error {
 	if ah.minBackoff > ah.maxBackoff {
 		return errors.New("auth handler: min_backoff cannot be greater than max_backoff")
 	}
+	if ah.expiryWarnFraction < 0 || ah.expiryWarnFraction >= 1 {
+		return errors.New("auth handler: expiry warn fraction must be at least 0 and less than 1")
+	}
+	switch ah.outputDeliveryMode {
+	case "", OutputDeliveryBlock, OutputDeliveryDrop, OutputDeliveryLatest:
+	default:
+		return fmt.Errorf("auth handler: unknown output delivery mode %q", ah.outputDeliveryMode)
+	}
+	if ah.renewIncrement < 0 || ah.renewIncrement%time.Second != 0 {
+		return errors.New("auth handler: renew increment must be a positive whole number of seconds")
+	}
+	if err := ValidateAuthHeaders(ah.authHeaders); err != nil {
+		return fmt.Errorf("auth handler: %w", err)
+	}
+	if ah.reauthLimiter != nil && ah.reauthLimiter.window <= 0 {
+		return errors.New("auth handler: max reauths per window requires a positive window")
+	}
+	if err := ah.tokenOverrides.validate(); err != nil {
+		return fmt.Errorf("auth handler: %w", err)
+	}
+	if _, ok := am.(AuthMethodWithTokenParameters); ah.tokenOverrides != nil && !ok {
+		return errors.New("auth handler: token overrides are set, but the auth method doesn't support token parameters")
+	}
 	backoffCfg := newAutoAuthBackoff(ah.minBackoff, ah.maxBackoff, ah.exitOnError)
 
 	ah.logger.Info("starting auth handler")
@@ -149,11 +676,24 @@ func (ah *AuthHandler) Run(ctx context.Context, am AuthMethod) error {
 	// Set unauthenticated when starting up
 	metrics.SetGauge([]string{ah.metricsSignifier, "authenticated"}, 0)
 
+	gaugeCtx, gaugeCancel := context.WithCancel(ctx)
+	defer gaugeCancel()
+	go ah.runLastAuthGauge(gaugeCtx)
+
+	var expiry *expiryWatcher
+
 	defer func() {
 		am.Shutdown()
+		expiry.Stop()
 		close(ah.OutputCh)
 		close(ah.TemplateTokenCh)
 		close(ah.ExecTokenCh)
+		ah.eventL.Lock()
+		ah.stopped = true
+		close(ah.EventCh)
+		ah.eventL.Unlock()
+		ah.current.Store(nil)
+		ah.errLogger.Close()
 		ah.logger.Info("auth handler stopped")
 		// Set unauthenticated when shutting down
 		metrics.SetGauge([]string{ah.metricsSignifier, "authenticated"}, 0)
@@ -186,15 +726,38 @@ func (ah *AuthHandler) Run(ctx context.Context, am AuthMethod) error {
 		}
 		headers.Set("User-Agent", ah.userAgent)
 		ah.client.SetHeaders(headers)
+		if ah.namespace != "" {
+			ah.client.SetNamespace(ah.namespace)
+		}
 	}
 
 	var watcher *api.LifetimeWatcher
 	first := true
 
+	// attemptSpan traces the current authentication attempt, and is ended
+	// once its token is delivered, or when the next attempt starts
+	var attemptSpan trace.Span
+	endAttempt := func(err error) {
+		if attemptSpan != nil {
+			tracing.End(attemptSpan, err)
+			attemptSpan = nil
+		}
+	}
+	defer endAttempt(nil)
+
 	for {
+		endAttempt(errAuthAttemptFailed)
+		if !ah.waitWhilePaused(ctx) {
+			return nil
+		}
+		if !ah.waitForReauthLimit(ctx) {
+			return nil
+		}
+
 		// We will unset this bool in sink.go once the token has been written to
 		// any sinks, or the sink server stops
 		ah.AuthInProgress.Store(true)
+		ah.reauthenticating.Store(true)
 		// Drain any Invalid Token errors from the channel that could have been sent before AuthInProgress
 		// was set to true
 		select {
@@ -204,12 +767,20 @@ func (ah *AuthHandler) Run(ctx context.Context, am AuthMethod) error {
 			// Do nothing, keep going
 		}
 		select {
+		case <-ah.reauthCh:
+			ah.logger.Info("renewal already in progress, draining requested re-authentication")
+		default:
+		}
+		select {
 		case <-ctx.Done():
 			return nil
 
 		default:
 		}
 
+		var attemptCtx context.Context
+		attemptCtx, attemptSpan = ah.tracer.Start(ctx, "auto-auth.authenticate")
+
 		var clientToUse *api.Client
 		var err error
 		var path string
@@ -221,12 +792,13 @@ func (ah *AuthHandler) Run(ctx context.Context, am AuthMethod) error {
 		case AuthMethodWithClient:
 			clientToUse, err = am.(AuthMethodWithClient).AuthClient(ah.client)
 			if err != nil {
-				ah.logger.Error("error creating client for authentication call", "error", err, "backoff", backoffCfg)
+				ah.errLogger.Error("error creating client for authentication call", "error", err, "backoff", backoffCfg)
+				ah.errorFile.Record(errorFileSource, "error creating client for authentication call", err)
 				metrics.IncrCounter([]string{ah.metricsSignifier, "auth", "failure"}, 1)
 				// Set unauthenticated when authentication fails
 				metrics.SetGauge([]string{ah.metricsSignifier, "authenticated"}, 0)
 
-				if backoffSleep(ctx, backoffCfg) {
+				if ah.backoffAfterError(ctx, backoffCfg, err) {
 					continue
 				}
 
@@ -236,26 +808,49 @@ func (ah *AuthHandler) Run(ctx context.Context, am AuthMethod) error {
 			clientToUse = ah.client
 		}
 
+		if ah.namespace != "" {
+			clientToUse.SetNamespace(ah.namespace)
+		}
+		if len(ah.authHeaders) > 0 {
+			// Replaced rather than added, so that they don't accumulate on a
+			// client reused across re-authentications
+			headers := clientToUse.Headers()
+			if headers == nil {
+				headers = make(http.Header)
+			}
+			for key, values := range ah.authHeaders {
+				headers[http.CanonicalHeaderKey(key)] = values
+			}
+			clientToUse.SetHeaders(headers)
+		}
+
 		// Disable retry on the client to ensure our backoffOrQuit function is
 		// the only source of retry/backoff.
 		clientToUse.SetMaxRetries(0)
 
 		var secret *api.Secret = new(api.Secret)
+		// preloaded is set when the token is the preloaded one, which isn't
+		// the handler's to revoke
+		var preloaded bool
 		if first && ah.token != "" {
+			preloaded = true
 			ah.logger.Debug("using preloaded token")
 
 			first = false
 			ah.logger.Debug("lookup-self with preloaded token")
 			clientToUse.SetToken(ah.token)
 
-			secret, err = clientToUse.Auth().Token().LookupSelfWithContext(ctx)
+			secret, err = ah.doAuthRequest(ctx, clientToUse.Auth().Token().LookupSelfWithContext)
 			if err != nil {
-				ah.logger.Error("could not look up token", "err", err, "backoff", backoffCfg)
+				ah.errLogger.Error("could not look up token", "err", err, "backoff", backoffCfg)
+				ah.errorFile.Record(errorFileSource, "could not look up token", err)
 				metrics.IncrCounter([]string{ah.metricsSignifier, "auth", "failure"}, 1)
 				// Set unauthenticated when authentication fails
 				metrics.SetGauge([]string{ah.metricsSignifier, "authenticated"}, 0)
+				// Bridge an outage at startup with the last token persisted
+				ah.usePersistedToken(ctx, clientToUse, err)
 
-				if backoffSleep(ctx, backoffCfg) {
+				if ah.backoffAfterError(ctx, backoffCfg, err) {
 					continue
 				}
 				return err
@@ -267,31 +862,37 @@ func (ah *AuthHandler) Run(ctx context.Context, am AuthMethod) error {
 				LeaseDuration: int(duration),
 				Renewable:     secret.Data["renewable"].(bool),
 			}
+		} else if _, ok := am.(AuthMethodWithLogin); ok {
+			// The method's Login is called in place of the login request below
+			ah.logger.Info("authenticating")
 		} else {
 			ah.logger.Info("authenticating")
 
-			path, header, data, err = am.Authenticate(ctx, ah.client)
+			path, header, data, err = ah.authenticate(ctx, am)
 			if err != nil {
-				ah.logger.Error("error getting path or data from method", "error", err, "backoff", backoffCfg)
+				ah.errLogger.Error("error getting path or data from method", "error", err, "backoff", backoffCfg)
+				ah.errorFile.Record(errorFileSource, "error getting path or data from method", err)
 				metrics.IncrCounter([]string{ah.metricsSignifier, "auth", "failure"}, 1)
 				// Set unauthenticated when authentication fails
 				metrics.SetGauge([]string{ah.metricsSignifier, "authenticated"}, 0)
 
-				if backoffSleep(ctx, backoffCfg) {
+				if ah.backoffAfterError(ctx, backoffCfg, err) {
 					continue
 				}
 				return err
 			}
+			data = ah.applyTokenOverrides(am, data)
 		}
 
 		if ah.wrapTTL > 0 {
 			wrapClient, err := clientToUse.CloneWithHeaders()
 			if err != nil {
-				ah.logger.Error("error creating client for wrapped call", "error", err, "backoff", backoffCfg)
+				ah.errLogger.Error("error creating client for wrapped call", "error", err, "backoff", backoffCfg)
+				ah.errorFile.Record(errorFileSource, "error creating client for wrapped call", err)
 				metrics.IncrCounter([]string{ah.metricsSignifier, "auth", "failure"}, 1)
 				metrics.SetGauge([]string{ah.metricsSignifier, "authenticated"}, 0)
 
-				if backoffSleep(ctx, backoffCfg) {
+				if ah.backoffAfterError(ctx, backoffCfg, err) {
 					continue
 				}
 				return err
@@ -301,38 +902,70 @@ func (ah *AuthHandler) Run(ctx context.Context, am AuthMethod) error {
 			})
 			clientToUse = wrapClient
 		}
-		for key, values := range header {
-			for _, value := range values {
-				clientToUse.AddHeader(key, value)
+		addHeaders := func(header http.Header) {
+			for key, values := range header {
+				for _, value := range values {
+					clientToUse.AddHeader(key, value)
+				}
 			}
 		}
+		addHeaders(header)
 
 		// This should only happen if there's no preloaded token (regular auto-auth login)
 		// or if a preloaded token has expired and is now switching to auto-auth.
 		if secret.Auth == nil {
-			isTokenFileMethod = path == "auth/token/lookup-self"
-			if isTokenFileMethod {
+			request := func() (*api.Secret, error) {
+				if lm, ok := am.(AuthMethodWithLogin); ok {
+					return lm.Login(ctx, clientToUse)
+				}
+				isTokenFileMethod = path == "auth/token/lookup-self"
+				if !isTokenFileMethod {
+					return ah.doAuthRequest(ctx, func(ctx context.Context) (*api.Secret, error) {
+						return clientToUse.Logical().WriteWithContext(ctx, path, data)
+					})
+				}
 				token, _ := data["token"].(string)
-				// The error is called clientErr as to not shadow the other err above it.
-				lookupSelfClient, clientErr := clientToUse.CloneWithHeaders()
-				if clientErr != nil {
-					ah.logger.Error("failed to clone client to perform token lookup")
-					return clientErr
+				lookupSelfClient, err := clientToUse.CloneWithHeaders()
+				if err != nil {
+					return nil, fmt.Errorf("failed to clone client to perform token lookup: %w", err)
 				}
 				lookupSelfClient.SetToken(token)
-				secret, err = lookupSelfClient.Auth().Token().LookupSelf()
-			} else {
-				secret, err = clientToUse.Logical().WriteWithContext(ctx, path, data)
+				if params := ah.tokenParameters(am); len(params) > 0 {
+					// The token from the file can't be given the overrides,
+					// so a child of it is created with them, and handled like
+					// the token from any other login
+					path, isTokenFileMethod = "auth/token/create", false
+					return ah.doAuthRequest(ctx, func(ctx context.Context) (*api.Secret, error) {
+						return lookupSelfClient.Logical().WriteWithContext(ctx, path, params)
+					})
+				}
+				return ah.doAuthRequest(ctx, lookupSelfClient.Auth().Token().LookupSelfWithContext)
+			}
+			secret, err = request()
+
+			// The method may have been given new credentials while the
+			// request was being made, so it gets one more chance with them
+			if rm, ok := am.(AuthMethodWithRejection); ok && err != nil && !isOutageError(err) && rm.Rejected(ctx, err) {
+				ah.logger.Info("authentication was rejected, retrying with the auth method's new credentials", "error", err)
+				path, header, data, err = ah.authenticate(ctx, am)
+				if err == nil {
+					data = ah.applyTokenOverrides(am, data)
+					addHeaders(header)
+					secret, err = request()
+				}
 			}
 
 			// Check errors/sanity
 			if err != nil {
-				ah.logger.Error("error authenticating", "error", err, "backoff", backoffCfg)
+				ah.errLogger.Error("error authenticating", "error", err, "backoff", backoffCfg)
+				ah.errorFile.Record(errorFileSource, "error authenticating", err)
 				metrics.IncrCounter([]string{ah.metricsSignifier, "auth", "failure"}, 1)
 				// Set unauthenticated when authentication fails
 				metrics.SetGauge([]string{ah.metricsSignifier, "authenticated"}, 0)
+				// Bridge an outage at startup with the last token persisted
+				ah.usePersistedToken(ctx, clientToUse, err)
 
-				if backoffSleep(ctx, backoffCfg) {
+				if ah.backoffAfterError(ctx, backoffCfg, err) {
 					continue
 				}
 				return err
@@ -344,50 +977,50 @@ func (ah *AuthHandler) Run(ctx context.Context, am AuthMethod) error {
 		switch {
 		case ah.wrapTTL > 0:
 			if secret.WrapInfo == nil {
-				ah.logger.Error("authentication returned nil wrap info", "backoff", backoffCfg)
+				ah.errLogger.Error("authentication returned nil wrap info", "backoff", backoffCfg)
+				ah.errorFile.Record(errorFileSource, "authentication returned nil wrap info", nil)
 				metrics.IncrCounter([]string{ah.metricsSignifier, "auth", "failure"}, 1)
 				// Set unauthenticated when authentication fails
 				metrics.SetGauge([]string{ah.metricsSignifier, "authenticated"}, 0)
 
-				if backoffSleep(ctx, backoffCfg) {
+				if ah.backoffAfterError(ctx, backoffCfg, err) {
 					continue
 				}
 				return err
 			}
 			if secret.WrapInfo.Token == "" {
-				ah.logger.Error("authentication returned empty wrapped client token", "backoff", backoffCfg)
+				ah.errLogger.Error("authentication returned empty wrapped client token", "backoff", backoffCfg)
+				ah.errorFile.Record(errorFileSource, "authentication returned empty wrapped client token", nil)
 				metrics.IncrCounter([]string{ah.metricsSignifier, "auth", "failure"}, 1)
 				// Set unauthenticated when authentication fails
 				metrics.SetGauge([]string{ah.metricsSignifier, "authenticated"}, 0)
 
-				if backoffSleep(ctx, backoffCfg) {
+				if ah.backoffAfterError(ctx, backoffCfg, err) {
 					continue
 				}
 				return err
 			}
 			wrappedResp, err := jsonutil.EncodeJSON(secret.WrapInfo)
 			if err != nil {
-				ah.logger.Error("failed to encode wrapinfo", "error", err, "backoff", backoffCfg)
+				ah.errLogger.Error("failed to encode wrapinfo", "error", err, "backoff", backoffCfg)
+				ah.errorFile.Record(errorFileSource, "failed to encode wrapinfo", err)
 				metrics.IncrCounter([]string{ah.metricsSignifier, "auth", "failure"}, 1)
 				// Set unauthenticated when authentication fails
 				metrics.SetGauge([]string{ah.metricsSignifier, "authenticated"}, 0)
 
-				if backoffSleep(ctx, backoffCfg) {
+				if ah.backoffAfterError(ctx, backoffCfg, err) {
 					continue
 				}
 				return err
 			}
 			ah.logger.Info("authentication successful, sending wrapped token to sinks and pausing")
-			ah.OutputCh <- string(wrappedResp)
-			if ah.enableTemplateTokenCh {
-				ah.TemplateTokenCh <- string(wrappedResp)
-			}
-			if ah.enableExecTokenCh {
-				ah.ExecTokenCh <- string(wrappedResp)
-			}
+			ah.deliverToken(attemptCtx, string(wrappedResp), time.Duration(secret.WrapInfo.TTL)*time.Second, secret.RequestID)
 
 			am.CredSuccess()
 			backoffCfg.backoff.Reset()
+			ah.reauthLimiter.record(time.Now())
+			endAttempt(nil)
+			ah.errorFile.Clear(errorFileSource)
 
 			select {
 			case <-ctx.Done():
@@ -408,24 +1041,26 @@ func (ah *AuthHandler) Run(ctx context.Context, am AuthMethod) error {
 				// We still check the response of the request to ensure the token is valid
 				// i.e. if the token is invalid, we will fail in the authentication step
 				if secret == nil || secret.Data == nil {
-					ah.logger.Error("token file validation failed, token may be invalid", "backoff", backoffCfg)
+					ah.errLogger.Error("token file validation failed, token may be invalid", "backoff", backoffCfg)
+					ah.errorFile.Record(errorFileSource, "token file validation failed, token may be invalid", nil)
 					metrics.IncrCounter([]string{ah.metricsSignifier, "auth", "failure"}, 1)
 					// Set unauthenticated when authentication fails
 					metrics.SetGauge([]string{ah.metricsSignifier, "authenticated"}, 0)
 
-					if backoffSleep(ctx, backoffCfg) {
+					if ah.backoffAfterError(ctx, backoffCfg, err) {
 						continue
 					}
 					return err
 				}
 				token, ok := secret.Data["id"].(string)
 				if !ok || token == "" {
-					ah.logger.Error("token file validation returned empty client token", "backoff", backoffCfg)
+					ah.errLogger.Error("token file validation returned empty client token", "backoff", backoffCfg)
+					ah.errorFile.Record(errorFileSource, "token file validation returned empty client token", nil)
 					metrics.IncrCounter([]string{ah.metricsSignifier, "auth", "failure"}, 1)
 					// Set unauthenticated when authentication fails
 					metrics.SetGauge([]string{ah.metricsSignifier, "authenticated"}, 0)
 
-					if backoffSleep(ctx, backoffCfg) {
+					if ah.backoffAfterError(ctx, backoffCfg, err) {
 						continue
 					}
 					return err
@@ -439,15 +1074,24 @@ func (ah *AuthHandler) Run(ctx context.Context, am AuthMethod) error {
 					LeaseDuration: int(duration),
 					Renewable:     renewable,
 				}
+				if ah.tokenValidator != nil {
+					if err := ah.validateToken(ctx, secret); err != nil {
+						ah.errLogger.Error("token failed validation, discarding", "error", err, "backoff", backoffCfg)
+						ah.errorFile.Record(errorFileSource, "token failed validation, discarding", err)
+						metrics.IncrCounter([]string{ah.metricsSignifier, "auth", "failure"}, 1)
+						// Set unauthenticated when authentication fails
+						metrics.SetGauge([]string{ah.metricsSignifier, "authenticated"}, 0)
+
+						if ah.backoffAfterError(ctx, backoffCfg, err) {
+							continue
+						}
+						return fmt.Errorf("token failed validation: %w", err)
+					}
+				}
+				ah.checkPolicies(secret)
 				ah.logger.Info("authentication successful, sending token to sinks")
 
-				ah.OutputCh <- token
-				if ah.enableTemplateTokenCh {
-					ah.TemplateTokenCh <- token
-				}
-				if ah.enableExecTokenCh {
-					ah.ExecTokenCh <- token
-				}
+				ah.deliverToken(attemptCtx, token, time.Duration(leaseDuration)*time.Second, secret.RequestID)
 
 				tokenType := secret.Data["type"].(string)
 				if tokenType == "batch" {
@@ -455,57 +1099,87 @@ func (ah *AuthHandler) Run(ctx context.Context, am AuthMethod) error {
 				}
 			} else {
 				if secret == nil || secret.Auth == nil {
-					ah.logger.Error("authentication returned nil auth info", "backoff", backoffCfg)
+					ah.errLogger.Error("authentication returned nil auth info", "backoff", backoffCfg)
+					ah.errorFile.Record(errorFileSource, "authentication returned nil auth info", nil)
 					metrics.IncrCounter([]string{ah.metricsSignifier, "auth", "failure"}, 1)
 					// Set unauthenticated when authentication fails
 					metrics.SetGauge([]string{ah.metricsSignifier, "authenticated"}, 0)
 
-					if backoffSleep(ctx, backoffCfg) {
+					if ah.backoffAfterError(ctx, backoffCfg, err) {
 						continue
 					}
 					return err
 				}
 				if secret.Auth.ClientToken == "" {
-					ah.logger.Error("authentication returned empty client token", "backoff", backoffCfg)
+					ah.errLogger.Error("authentication returned empty client token", "backoff", backoffCfg)
+					ah.errorFile.Record(errorFileSource, "authentication returned empty client token", nil)
 					metrics.IncrCounter([]string{ah.metricsSignifier, "auth", "failure"}, 1)
 					// Set unauthenticated when authentication fails
 					metrics.SetGauge([]string{ah.metricsSignifier, "authenticated"}, 0)
 
-					if backoffSleep(ctx, backoffCfg) {
+					if ah.backoffAfterError(ctx, backoffCfg, err) {
 						continue
 					}
 					return err
 				}
 
+				if ah.tokenValidator != nil {
+					if err := ah.validateToken(ctx, secret); err != nil {
+						ah.errLogger.Error("token failed validation, discarding", "error", err, "backoff", backoffCfg)
+						ah.errorFile.Record(errorFileSource, "token failed validation, discarding", err)
+						metrics.IncrCounter([]string{ah.metricsSignifier, "auth", "failure"}, 1)
+						// Set unauthenticated when authentication fails
+						metrics.SetGauge([]string{ah.metricsSignifier, "authenticated"}, 0)
+						if !preloaded {
+							ah.revokeToken(ctx, clientToUse, secret.Auth.ClientToken)
+						}
+
+						if ah.backoffAfterError(ctx, backoffCfg, err) {
+							continue
+						}
+						return fmt.Errorf("token failed validation: %w", err)
+					}
+				}
+
+				ah.checkPolicies(secret)
+				ah.checkTokenOverrides(am, secret)
 				leaseDuration = secret.LeaseDuration
 				ah.logger.Info("authentication successful, sending token to sinks")
-				ah.OutputCh <- secret.Auth.ClientToken
-				if ah.enableTemplateTokenCh {
-					ah.TemplateTokenCh <- secret.Auth.ClientToken
-				}
-				if ah.enableExecTokenCh {
-					ah.ExecTokenCh <- secret.Auth.ClientToken
-				}
+				ah.deliverToken(attemptCtx, secret.Auth.ClientToken, tokenTTL(secret), secret.RequestID)
 			}
 
+			if tm, ok := am.(AuthMethodWithToken); ok {
+				tm.Authenticated(secret.Auth.ClientToken)
+			}
 			am.CredSuccess()
 			backoffCfg.backoff.Reset()
+			ah.reauthLimiter.record(time.Now())
+			endAttempt(nil)
 		}
 
 		if watcher != nil {
 			watcher.Stop()
 		}
 
-		watcher, err = clientToUse.NewLifetimeWatcher(&api.LifetimeWatcherInput{
-			Secret: secret,
-		})
+		watcherInput := &api.LifetimeWatcherInput{
+			Secret:    secret,
+			Increment: int(ah.renewIncrement.Seconds()),
+		}
+		// Have the watcher return renewal errors for renewable tokens, rather
+		// than retrying them until the token expires, so that transient
+		// errors can be retried and permanent ones trigger re-authentication.
+		if secret.Auth != nil && secret.Auth.Renewable {
+			watcherInput.RenewBehavior = api.RenewBehaviorErrorOnErrors
+		}
+		watcher, err = clientToUse.NewLifetimeWatcher(watcherInput)
 		if err != nil {
-			ah.logger.Error("error creating lifetime watcher", "error", err, "backoff", backoffCfg)
+			ah.errLogger.Error("error creating lifetime watcher", "error", err, "backoff", backoffCfg)
+			ah.errorFile.Record(errorFileSource, "error creating lifetime watcher", err)
 			metrics.IncrCounter([]string{ah.metricsSignifier, "auth", "failure"}, 1)
 			// Set unauthenticated when authentication fails
 			metrics.SetGauge([]string{ah.metricsSignifier, "authenticated"}, 0)
 
-			if backoffSleep(ctx, backoffCfg) {
+			if ah.backoffAfterError(ctx, backoffCfg, err) {
 				continue
 			}
 			return err
@@ -513,26 +1187,132 @@ func (ah *AuthHandler) Run(ctx context.Context, am AuthMethod) error {
 
 		metrics.IncrCounter([]string{ah.metricsSignifier, "auth", "success"}, 1)
 		metrics.SetGauge([]string{ah.metricsSignifier, "authenticated"}, 1)
-		// We don't want to trigger the renewal process for the root token
-		if isRootToken(leaseDuration, isTokenFileMethod, secret) {
+		ah.setAuthenticated()
+		tokenExpiry := time.Now().Add(tokenTTL(secret))
+		expiry = ah.startExpiryWatcher(tokenTTL(secret))
+		// We don't want to trigger the renewal process for the root token,
+		// or other tokens which don't expire, as the lifetime watcher would
+		// return straight away, as though the token had expired
+		renewing := false
+		switch {
+		case isRootToken(leaseDuration, isTokenFileMethod, secret):
 			ah.logger.Info("not starting token renewal process, as token is root token")
-		} else {
+			ah.emitEvent(AuthEvent{
+				Type: TokenNonExpiring,
+			})
+		case tokenTTL(secret) == 0:
+			ah.logger.Info("non-expiring token, no renewal scheduled")
+			ah.emitEvent(AuthEvent{
+				Type: TokenNonExpiring,
+			})
+		default:
 			ah.logger.Info("starting renewal process")
 			go watcher.Renew()
+			renewing = true
 		}
 
+		// renewalPaused is set while renewal is stopped because the handler is
+		// paused, and reauthPending if re-authentication was triggered while
+		// it was paused
+		var renewalPaused, reauthPending bool
+		ah.reauthenticating.Store(false)
+
+		renewalBackoff := newAutoAuthBackoff(ah.minBackoff, ah.maxBackoff, false)
+
 	LifetimeWatcherLoop:
 		for {
+			paused, pauseCh := ah.pause.get()
+			switch {
+			case paused && renewing && !renewalPaused && !ah.renewWhilePaused:
+				ah.logger.Info("stopping renewal while paused")
+				watcher.Stop()
+				renewalPaused = true
+			case !paused && renewalPaused:
+				renewalPaused = false
+				if !reauthPending {
+					watcher, err = clientToUse.NewLifetimeWatcher(watcherInput)
+					if err != nil {
+						ah.logger.Error("error creating lifetime watcher, re-authenticating", "error", err)
+						break LifetimeWatcherLoop
+					}
+					ah.logger.Info("resuming renewal process")
+					go watcher.Renew()
+				}
+			}
+			if !paused && reauthPending {
+				ah.logger.Info("re-authenticating, as was triggered while paused")
+				break LifetimeWatcherLoop
+			}
+
+			doneCh, renewCh := watcher.DoneCh(), watcher.RenewCh()
+			if renewalPaused {
+				doneCh, renewCh = nil, nil
+			}
+
 			select {
+			case <-pauseCh:
+				continue
+
 			case <-ctx.Done():
 				ah.logger.Info("shutdown triggered, stopping lifetime watcher")
 				watcher.Stop()
 				break LifetimeWatcherLoop
 
-			case err := <-watcher.DoneCh():
+			case err := <-doneCh:
+				if err != nil && isMaxTTLError(err) {
+					// This is the expected end of a token's life, rather than
+					// a failure, so re-authenticate straight away
+					ah.logger.Info("token has reached its max TTL, re-authenticating")
+					expiry.done()
+					ah.emitEvent(AuthEvent{
+						Type:  TokenMaxTTLReached,
+						Error: err,
+					})
+					break LifetimeWatcherLoop
+				}
+				if err != nil && isTransientRenewalError(err) {
+					ah.errLogger.Warn("transient error renewing token, retrying renewal", "error", err, "backoff", renewalBackoff)
+					ah.errorFile.Record(errorFileSource, "transient error renewing token, retrying renewal", err)
+					ah.emitEvent(AuthEvent{
+						Type:  RenewalFailedTransient,
+						TTL:   time.Until(tokenExpiry),
+						Error: err,
+					})
+
+					// Renewal has a backoff of its own, whose retries only
+					// run out when the token expires, so that transient
+					// errors neither use up the auth backoff's retries nor
+					// make a handler set to exit on errors exit
+					backoffSleep(ctx, renewalBackoff)
+					if ctx.Err() != nil {
+						break LifetimeWatcherLoop
+					}
+
+					if time.Now().Before(tokenExpiry) {
+						watcher, err = clientToUse.NewLifetimeWatcher(watcherInput)
+						if err == nil {
+							go watcher.Renew()
+							continue
+						}
+						ah.logger.Error("error creating lifetime watcher", "error", err)
+					}
+
+					ah.logger.Info("unable to renew token before it expired, re-authenticating")
+					break LifetimeWatcherLoop
+				}
+
 				ah.logger.Info("lifetime watcher done channel triggered, re-authenticating")
+				if err == nil {
+					expiry.done()
+				}
 				if err != nil {
-					ah.logger.Error("error renewing token", "error", err, "backoff", backoffCfg)
+					ah.current.Store(nil)
+					ah.emitEvent(AuthEvent{
+						Type:  RenewalFailedPermanent,
+						Error: err,
+					})
+					ah.errLogger.Error("error renewing token", "error", err, "backoff", backoffCfg)
+					ah.errorFile.Record(errorFileSource, "error renewing token", err)
 					metrics.IncrCounter([]string{ah.metricsSignifier, "auth", "failure"}, 1)
 					// Set unauthenticated when authentication fails
 					metrics.SetGauge([]string{ah.metricsSignifier, "authenticated"}, 0)
@@ -559,22 +1339,290 @@ func (ah *AuthHandler) Run(ctx context.Context, am AuthMethod) error {
 
 				break LifetimeWatcherLoop
 
-			case <-watcher.RenewCh():
+			case renewal := <-renewCh:
 				metrics.IncrCounter([]string{ah.metricsSignifier, "auth", "success"}, 1)
 				// Set authenticated when authentication succeeds
 				metrics.SetGauge([]string{ah.metricsSignifier, "authenticated"}, 1)
+				ah.setAuthenticated()
+				backoffCfg.backoff.Reset()
+				renewalBackoff.backoff.Reset()
+				if renewal.Secret != nil && renewal.Secret.Auth != nil {
+					watcherInput.Secret = renewal.Secret
+					tokenExpiry = time.Now().Add(tokenTTL(renewal.Secret))
+					if current := ah.current.Load(); current != nil {
+						ah.setCurrentToken(current.token, tokenTTL(renewal.Secret))
+					}
+					if granted := tokenTTL(renewal.Secret); ah.renewIncrement > 0 && granted < ah.renewIncrement {
+						ah.logger.Info("token renewed for less than the requested increment, it may be nearing its max TTL",
+							"increment", ah.renewIncrement.String(), "granted", granted.String())
+					}
+				}
+				expiry.renewed(renewal)
 				ah.logger.Info("renewed auth token")
+				ah.sendRenewal(ctx)
+				ah.emitEvent(AuthEvent{
+					Type:    TokenRenewed,
+					TTL:     tokenTTL(renewal.Secret),
+					Renewed: true,
+				})
 			case <-credCh:
+				if ah.Paused() {
+					ah.logger.Info("auth method found new credentials, re-authenticating once resumed")
+					reauthPending = true
+					continue
+				}
 				ah.logger.Info("auth method found new credentials, re-authenticating")
 				break LifetimeWatcherLoop
+			case reason := <-ah.reauthCh:
+				if ah.Paused() {
+					ah.logger.Info("re-authentication requested, re-authenticating once resumed", "reason", reason)
+					reauthPending = true
+					continue
+				}
+				ah.logger.Info("re-authentication requested, re-authenticating", "reason", reason)
+				break LifetimeWatcherLoop
 			case <-ah.InvalidToken:
+				if ah.Paused() {
+					ah.logger.Info("invalid token found, re-authenticating once resumed")
+					reauthPending = true
+					continue
+				}
 				ah.logger.Info("invalid token found, re-authenticating")
 				break LifetimeWatcherLoop
 			}
 		}
+
+		// The token is being replaced, so stop watching it for expiry
+		expiry.Stop()
+		expiry = nil
 	}
 }
 
+// deliverToken sends a newly obtained token to the sinks, and the templates
+// and exec process if enabled, then emits a TokenIssued event, or a
+// TokenRenewed event if it's the token last delivered, e.g. one re-read by
+// the token_file method. The token is recorded as issued by the attempt
+// traced in ctx, whose request had the ID correlationID.
+func (ah *AuthHandler) deliverToken(ctx context.Context, token string, ttl time.Duration, correlationID string) {
+	ah.tracer.TokenIssued(ctx, token, correlationID)
+	ah.sequences.stamp(token)
+	ah.setCurrentToken(token, ttl)
+	sent := ah.sendOutput(token)
+	if ah.enableTemplateTokenCh {
+		ah.TemplateTokenCh <- token
+	}
+	if ah.enableExecTokenCh {
+		ah.ExecTokenCh <- token
+	}
+
+	if token == ah.lastDelivered {
+		ah.emitEvent(AuthEvent{
+			Type:    TokenRenewed,
+			TTL:     ttl,
+			Renewed: true,
+		})
+	} else {
+		ah.emitEvent(AuthEvent{
+			Type: TokenIssued,
+			TTL:  ttl,
+		})
+	}
+	// A token dropped rather than sent to the sinks hasn't been delivered,
+	// so the next token isn't taken as a renewal of it
+	if sent {
+		ah.lastDelivered = token
+	}
+}
+
+// sendRenewal tells the sinks, and the templates if enabled, that the
+// current token's lease has been renewed, by sending it again on OutputCh
+// and TemplateTokenCh. The SinkServer and template Server take a token they
+// already have as a renewal, passing it on to RenewalSinks and
+// OnTokenRenewed rather than writing or rendering it again. Nothing is sent
+// if the current token was dropped rather than sent to the sinks, or to the
+// exec process, which would be restarted. Sending gives up once ctx is done.
+func (ah *AuthHandler) sendRenewal(ctx context.Context) {
+	current := ah.current.Load()
+	if current == nil || current.token != ah.lastDelivered {
+		return
+	}
+	select {
+	case ah.OutputCh <- current.token:
+	case <-ctx.Done():
+		return
+	}
+	if ah.enableTemplateTokenCh {
+		select {
+		case ah.TemplateTokenCh <- current.token:
+		case <-ctx.Done():
+		}
+	}
+}
+
+// sendOutput sends token on OutputCh, according to the handler's
+// OutputDeliveryMode, returning false if it was dropped.
+func (ah *AuthHandler) sendOutput(token string) bool {
+	if ah.outputDeliveryMode == "" || ah.outputDeliveryMode == OutputDeliveryBlock {
+		ah.OutputCh <- token
+		return true
+	}
+
+	timeout := ah.outputDeliveryTimeout
+	if timeout <= 0 {
+		timeout = defaultOutputDeliveryTimeout
+	}
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case ah.OutputCh <- token:
+		return true
+	case <-timer.C:
+	}
+
+	if ah.outputDeliveryMode == OutputDeliveryDrop {
+		ah.logger.Warn("timed out sending token to sinks, dropping it", "timeout", timeout)
+		return false
+	}
+
+	ah.logger.Warn("timed out sending token to sinks, replacing the token waiting to be sent", "timeout", timeout)
+	// The handler is the only sender, so once the waiting token is taken,
+	// or received in the meantime, there's room for this one
+	select {
+	case <-ah.OutputCh:
+	default:
+	}
+	ah.OutputCh <- token
+	return true
+}
+
+// doAuthRequest makes a request to log in or look up a token. If the handler
+// has an AuthRequestTimeout, each attempt is limited to it, and attempts which
+// time out or fail with a server error are retried up to authRequestRetries
+// times.
+func (ah *AuthHandler) doAuthRequest(ctx context.Context, req func(context.Context) (*api.Secret, error)) (*api.Secret, error) {
+	if ah.authRequestTimeout <= 0 {
+		return req(ctx)
+	}
+
+	for attempt := 0; ; attempt++ {
+		reqCtx, cancel := context.WithTimeout(ctx, ah.authRequestTimeout)
+		secret, err := req(reqCtx)
+		timedOut := errors.Is(reqCtx.Err(), context.DeadlineExceeded) && ctx.Err() == nil
+		cancel()
+		if err == nil || attempt >= authRequestRetries || !(timedOut || isServerError(err)) {
+			return secret, err
+		}
+
+		ah.errLogger.Warn("auth request failed, retrying", "error", err, "attempt", attempt+1)
+		select {
+		case <-time.After(authRequestRetryWait):
+		case <-ctx.Done():
+			return nil, err
+		}
+	}
+}
+
+// authenticate calls the method's Authenticate, retrying attempts which fail
+// with a TransientError up to authRequestRetries times.
+func (ah *AuthHandler) authenticate(ctx context.Context, am AuthMethod) (string, http.Header, map[string]interface{}, error) {
+	for attempt := 0; ; attempt++ {
+		path, header, data, err := am.Authenticate(ctx, ah.client)
+		var transientErr *TransientError
+		if err == nil || attempt >= authRequestRetries || !errors.As(err, &transientErr) {
+			return path, header, data, err
+		}
+
+		ah.errLogger.Warn("transient error getting path or data from method, retrying", "error", err, "attempt", attempt+1)
+		select {
+		case <-time.After(authRequestRetryWait):
+		case <-ctx.Done():
+			return "", nil, nil, err
+		}
+	}
+}
+
+// validateToken calls the handler's TokenValidator, limited to the
+// AuthRequestTimeout if one is set.
+func (ah *AuthHandler) validateToken(ctx context.Context, secret *api.Secret) error {
+	if ah.authRequestTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, ah.authRequestTimeout)
+		defer cancel()
+	}
+	return ah.tokenValidator(ctx, secret)
+}
+
+// revokeToken revokes a token the handler obtained but won't use, such as one
+// its TokenValidator rejected, so that it isn't left valid until it expires.
+// Errors are logged, rather than failing the attempt.
+func (ah *AuthHandler) revokeToken(ctx context.Context, client *api.Client, token string) {
+	revokeClient, err := client.CloneWithHeaders()
+	if err != nil {
+		ah.logger.Warn("error cloning client to revoke discarded token", "error", err)
+		return
+	}
+	revokeClient.SetToken(token)
+	if ah.authRequestTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, ah.authRequestTimeout)
+		defer cancel()
+	}
+	if err := revokeClient.Auth().Token().RevokeSelfWithContext(ctx, ""); err != nil {
+		ah.logger.Warn("error revoking discarded token", "error", err)
+		return
+	}
+	ah.logger.Info("revoked discarded token")
+}
+
+// checkPolicies logs and emits an UnexpectedPolicies event if the token has
+// any policies, token or identity, beyond the ExpectedPolicies. It only observes the token, so
+// errors reading its policies are logged, rather than failing the attempt.
+func (ah *AuthHandler) checkPolicies(secret *api.Secret) {
+	if ah.expectedPolicies == nil {
+		return
+	}
+
+	policies, err := secret.TokenPolicies()
+	if err != nil {
+		ah.logger.Warn("error reading token policies, not checking them against the expected policies", "error", err)
+		return
+	}
+	// A login response's policies normally include its identity policies,
+	// but not necessarily
+	if secret.Auth != nil {
+		policies = append(append([]string(nil), policies...), secret.Auth.IdentityPolicies...)
+	}
+
+	var unexpected []string
+	seen := make(map[string]struct{})
+	for _, policy := range policies {
+		if _, ok := ah.expectedPolicies[policy]; ok {
+			continue
+		}
+		if _, ok := seen[policy]; ok {
+			continue
+		}
+		seen[policy] = struct{}{}
+		unexpected = append(unexpected, policy)
+	}
+	if len(unexpected) == 0 {
+		return
+	}
+
+	sort.Strings(unexpected)
+	ah.logger.Warn("token has policies beyond those expected", "unexpected_policies", unexpected)
+	ah.emitEvent(AuthEvent{
+		Type:     UnexpectedPolicies,
+		Policies: unexpected,
+	})
+}
+
+// isServerError reports whether err is a 5xx response from Vault.
+func isServerError(err error) bool {
+	var responseErr *api.ResponseError
+	return errors.As(err, &responseErr) && responseErr.StatusCode >= http.StatusInternalServerError
+}
+
 // isRootToken checks if the secret in the argument is the root token
 // This is determinable without leaseDuration and isTokenFileMethod,
 // but those make it easier to rule out other tokens cheaply.
@@ -593,6 +1641,39 @@ func isRootToken(leaseDuration int, isTokenFileMethod bool, secret *api.Secret)
 	return false
 }
 
+// isTransientRenewalError reports whether an error renewing a token is likely
+// to be temporary, e.g. a network or server error, and so worth retrying.
+// Client errors, such as the token having been revoked, and tokens which are
+// no longer renewable, are permanent.
+func isTransientRenewalError(err error) bool {
+	if errors.Is(err, api.ErrLifetimeWatcherNotRenewable) {
+		return false
+	}
+
+	var responseErr *api.ResponseError
+	if errors.As(err, &responseErr) {
+		return responseErr.StatusCode >= http.StatusInternalServerError ||
+			responseErr.StatusCode == http.StatusTooManyRequests
+	}
+
+	return true
+}
+
+// isMaxTTLError reports whether an error renewing a token is because it has
+// reached its max TTL, and so can't be renewed any further.
+func isMaxTTLError(err error) bool {
+	var responseErr *api.ResponseError
+	if !errors.As(err, &responseErr) || responseErr.StatusCode != http.StatusBadRequest {
+		return false
+	}
+	for _, e := range responseErr.Errors {
+		if strings.Contains(e, "past the max TTL") {
+			return true
+		}
+	}
+	return false
+}
+
 // autoAuthBackoff tracks exponential backoff state.
 type autoAuthBackoff struct {
 	backoff *backoff.Backoff
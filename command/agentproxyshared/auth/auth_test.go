@@ -5,13 +5,25 @@ package auth
 
 import (
 	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"github.com/hashicorp/go-hclog"
 	"github.com/hashicorp/vault/api"
 	"github.com/hashicorp/vault/builtin/credential/userpass"
+	"github.com/hashicorp/vault/command/agentproxyshared/errorfile"
 	vaulthttp "github.com/hashicorp/vault/http"
 	"github.com/hashicorp/vault/sdk/helper/consts"
 	"github.com/hashicorp/vault/sdk/helper/logging"
@@ -73,12 +85,16 @@ func TestAuthHandler(t *testing.T) {
 	vault.TestWaitActive(t, cluster.Cores[0].Core)
 	client := cluster.Cores[0].Client
 
-	ctx, cancelFunc := context.WithCancel(context.Background())
-
 	ah := NewAuthHandler(&AuthHandlerConfig{
 		Logger: logging.NewVaultLogger(hclog.Trace).Named("auth.handler"),
 		Client: client,
 	})
+	if !ah.LastAuthTime().IsZero() {
+		t.Fatal("expected zero last auth time before running")
+	}
+
+	ctx, cancelFunc := context.WithCancel(context.Background())
+	defer cancelFunc()
 
 	am := newUserpassTestMethod(t, client)
 	errCh := make(chan error)
@@ -107,6 +123,10 @@ consumption:
 			}
 		}
 	}
+
+	if ah.LastAuthTime().IsZero() {
+		t.Fatal("expected last auth time to be set after authenticating")
+	}
 }
 
 func TestAgentBackoff(t *testing.T) {
@@ -198,3 +218,2135 @@ func TestAgentMinBackoffCustom(t *testing.T) {
 		}
 	}
 }
+
+func TestAuthHandler_ExpiryWatcher(t *testing.T) {
+	ah := NewAuthHandler(&AuthHandlerConfig{
+		Logger:             logging.NewVaultLogger(hclog.Trace).Named("auth.handler"),
+		EnableEventCh:      true,
+		ExpiryWarnFraction: 0.5,
+	})
+
+	expectWarning := func(t *testing.T, within time.Duration) AuthEvent {
+		t.Helper()
+		select {
+		case event := <-ah.EventCh:
+			if event.Type != TokenNearExpiry {
+				t.Fatalf("expected %q event, got %q", TokenNearExpiry, event.Type)
+			}
+			return event
+		case <-time.After(within):
+			t.Fatal("timed out waiting for near expiry event")
+		}
+		return AuthEvent{}
+	}
+	expectNone := func(t *testing.T, within time.Duration) {
+		t.Helper()
+		select {
+		case event := <-ah.EventCh:
+			t.Fatalf("unexpected event: %v", event)
+		case <-time.After(within):
+		}
+	}
+
+	w := ah.startExpiryWatcher(200 * time.Millisecond)
+	if event := expectWarning(t, 5*time.Second); event.TTL != 100*time.Millisecond {
+		t.Fatalf("expected remaining TTL of 100ms, got %s", event.TTL)
+	}
+	// It's only emitted once for each TTL, even once the lifetime watcher
+	// is done
+	w.done()
+	expectNone(t, 100*time.Millisecond)
+	w.Stop()
+
+	// Stopping the watcher before it fires should suppress the event
+	w = ah.startExpiryWatcher(200 * time.Millisecond)
+	w.Stop()
+	w.done()
+	expectNone(t, 300*time.Millisecond)
+
+	// A renewal from the lifetime watcher re-arms it with the renewed TTL
+	w = ah.startExpiryWatcher(200 * time.Millisecond)
+	defer w.Stop()
+	start := time.Now()
+	w.renewed(&api.RenewOutput{
+		RenewedAt: start,
+		Secret:    &api.Secret{Auth: &api.SecretAuth{LeaseDuration: 1}},
+	})
+	expectWarning(t, 5*time.Second)
+	if elapsed := time.Since(start); elapsed < 500*time.Millisecond {
+		t.Fatalf("expected the warning after half the renewed TTL, got it after %s", elapsed)
+	}
+
+	// The lifetime watcher being done emits it straight away
+	w = ah.startExpiryWatcher(time.Hour)
+	defer w.Stop()
+	w.done()
+	if event := expectWarning(t, time.Second); event.TTL <= 30*time.Minute {
+		t.Fatalf("expected the time left until expiry as the TTL, got %s", event.TTL)
+	}
+
+	// Watchers aren't started for tokens that don't expire
+	if w := ah.startExpiryWatcher(0); w != nil {
+		t.Fatal("expected no watcher for a token without a TTL")
+	}
+}
+
+func TestAuthHandler_TokenValidator(t *testing.T) {
+	coreConfig := &vault.CoreConfig{
+		CredentialBackends: map[string]logical.Factory{
+			"userpass": userpass.Factory,
+		},
+	}
+	cluster := vault.NewTestCluster(t, coreConfig, &vault.TestClusterOptions{
+		HandlerFunc: vaulthttp.Handler,
+	})
+	cluster.Start()
+	defer cluster.Cleanup()
+
+	vault.TestWaitActive(t, cluster.Cores[0].Core)
+	client := cluster.Cores[0].Client
+
+	// Reject the first token, and accept any after that
+	var validated []string
+	ah := NewAuthHandler(&AuthHandlerConfig{
+		Logger:     logging.NewVaultLogger(hclog.Trace).Named("auth.handler"),
+		Client:     client,
+		MinBackoff: 100 * time.Millisecond,
+		TokenValidator: func(_ context.Context, secret *api.Secret) error {
+			validated = append(validated, secret.Auth.ClientToken)
+			if len(validated) == 1 {
+				return errors.New("missing instance_id")
+			}
+			return nil
+		},
+	})
+
+	ctx, cancelFunc := context.WithCancel(context.Background())
+	defer cancelFunc()
+
+	am := newUserpassTestMethod(t, client)
+	errCh := make(chan error)
+	go func() {
+		errCh <- ah.Run(ctx, am)
+	}()
+
+	select {
+	case token := <-ah.OutputCh:
+		if len(validated) != 2 {
+			t.Fatalf("expected the validator to have been called twice, got %d", len(validated))
+		}
+		if token == validated[0] {
+			t.Fatal("rejected token was delivered")
+		}
+		if token != validated[1] {
+			t.Fatal("delivered token was not validated")
+		}
+	case err := <-errCh:
+		t.Fatalf("auth handler exited: %v", err)
+	case <-time.After(10 * time.Second):
+		t.Fatal("timed out waiting for token")
+	}
+
+	cancelFunc()
+	for range ah.OutputCh {
+	}
+	if err := <-errCh; err != nil {
+		t.Fatal(err)
+	}
+
+	// The rejected token should have been revoked
+	lookupClient, err := client.Clone()
+	if err != nil {
+		t.Fatal(err)
+	}
+	lookupClient.SetToken(cluster.RootToken)
+	if _, err := lookupClient.Auth().Token().Lookup(validated[0]); err == nil {
+		t.Fatal("expected the rejected token to have been revoked")
+	}
+	if _, err := lookupClient.Auth().Token().Lookup(validated[1]); err != nil {
+		t.Fatalf("expected the delivered token to be valid: %v", err)
+	}
+}
+
+type loginTestMethod struct{}
+
+func (loginTestMethod) Authenticate(context.Context, *api.Client) (string, http.Header, map[string]interface{}, error) {
+	return "auth/test/login", nil, map[string]interface{}{}, nil
+}
+
+func (loginTestMethod) NewCreds() chan struct{} {
+	return nil
+}
+
+func (loginTestMethod) CredSuccess() {
+}
+
+func (loginTestMethod) Shutdown() {
+}
+
+func TestAuthHandler_Namespace(t *testing.T) {
+	// Fail the first login, so that the namespace can be checked on a retry
+	var l sync.Mutex
+	var namespaces []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		l.Lock()
+		namespaces = append(namespaces, r.Header.Get(consts.NamespaceHeaderName))
+		attempt := len(namespaces)
+		l.Unlock()
+
+		if attempt == 1 {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"auth": {"client_token": "test-token", "lease_duration": 3600, "renewable": false}}`))
+	}))
+	defer server.Close()
+
+	config := api.DefaultConfig()
+	config.Address = server.URL
+	client, err := api.NewClient(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.SetNamespace("other/")
+
+	ah := NewAuthHandler(&AuthHandlerConfig{
+		Logger:     logging.NewVaultLogger(hclog.Trace).Named("auth.handler"),
+		Client:     client,
+		MinBackoff: 100 * time.Millisecond,
+		Namespace:  "ns1/",
+	})
+
+	ctx, cancelFunc := context.WithCancel(context.Background())
+	defer cancelFunc()
+
+	errCh := make(chan error)
+	go func() {
+		errCh <- ah.Run(ctx, loginTestMethod{})
+	}()
+
+	select {
+	case <-ah.OutputCh:
+	case err := <-errCh:
+		t.Fatalf("auth handler exited: %v", err)
+	case <-time.After(10 * time.Second):
+		t.Fatal("timed out waiting for token")
+	}
+
+	cancelFunc()
+	for range ah.OutputCh {
+	}
+	if err := <-errCh; err != nil {
+		t.Fatal(err)
+	}
+
+	l.Lock()
+	defer l.Unlock()
+	if len(namespaces) < 2 {
+		t.Fatalf("expected at least 2 login attempts, got %d", len(namespaces))
+	}
+	for i, ns := range namespaces {
+		if ns != "ns1/" {
+			t.Fatalf("expected request %d to use namespace %q, got %q", i, "ns1/", ns)
+		}
+	}
+}
+
+// TestAuthHandler_AuthHeaders tests that the AuthHeaders are sent with every
+// login attempt, without accumulating across them, and that Vault's own
+// headers are rejected.
+func TestAuthHandler_AuthHeaders(t *testing.T) {
+	// Fail the first login, so that the headers can be checked on a retry
+	var l sync.Mutex
+	var gatewayKeys [][]string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		l.Lock()
+		gatewayKeys = append(gatewayKeys, r.Header.Values("X-Gateway-Key"))
+		attempt := len(gatewayKeys)
+		l.Unlock()
+
+		if attempt == 1 {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"auth": {"client_token": "test-token", "lease_duration": 3600, "renewable": false}}`))
+	}))
+	defer server.Close()
+
+	config := api.DefaultConfig()
+	config.Address = server.URL
+	client, err := api.NewClient(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ah := NewAuthHandler(&AuthHandlerConfig{
+		Logger:      logging.NewVaultLogger(hclog.Trace).Named("auth.handler"),
+		Client:      client,
+		MinBackoff:  100 * time.Millisecond,
+		AuthHeaders: http.Header{"x-gateway-key": []string{"secret"}},
+	})
+
+	ctx, cancelFunc := context.WithCancel(context.Background())
+	defer cancelFunc()
+
+	errCh := make(chan error)
+	go func() {
+		errCh <- ah.Run(ctx, loginTestMethod{})
+	}()
+
+	select {
+	case <-ah.OutputCh:
+	case err := <-errCh:
+		t.Fatalf("auth handler exited: %v", err)
+	case <-time.After(10 * time.Second):
+		t.Fatal("timed out waiting for token")
+	}
+
+	cancelFunc()
+	for range ah.OutputCh {
+	}
+	if err := <-errCh; err != nil {
+		t.Fatal(err)
+	}
+
+	l.Lock()
+	defer l.Unlock()
+	if len(gatewayKeys) < 2 {
+		t.Fatalf("expected at least 2 login attempts, got %d", len(gatewayKeys))
+	}
+	for i, values := range gatewayKeys {
+		if !reflect.DeepEqual(values, []string{"secret"}) {
+			t.Fatalf("expected request %d to have X-Gateway-Key %q, got %q", i, "secret", values)
+		}
+	}
+
+	ah = NewAuthHandler(&AuthHandlerConfig{
+		Logger:      logging.NewVaultLogger(hclog.Trace).Named("auth.handler"),
+		Client:      client,
+		AuthHeaders: http.Header{"x-vault-token": []string{"root"}},
+	})
+	err = ah.Run(context.Background(), loginTestMethod{})
+	if err == nil || !strings.Contains(err.Error(), "reserved") {
+		t.Fatalf("expected reserved header error, got %v", err)
+	}
+}
+
+func TestAuthHandler_RenewalErrors(t *testing.T) {
+	testCases := map[string]struct {
+		status      int
+		body        string
+		eventType   AuthEventType
+		logins      int
+		exitOnError bool
+	}{
+		"transient": {
+			status:    http.StatusServiceUnavailable,
+			eventType: RenewalFailedTransient,
+			logins:    1,
+		},
+		"transient with exit on error": {
+			status:      http.StatusServiceUnavailable,
+			eventType:   RenewalFailedTransient,
+			logins:      1,
+			exitOnError: true,
+		},
+		"permanent": {
+			status:    http.StatusBadRequest,
+			eventType: RenewalFailedPermanent,
+			logins:    2,
+		},
+		"max ttl": {
+			status:    http.StatusBadRequest,
+			body:      `{"errors": ["past the max TTL, cannot renew"]}`,
+			eventType: TokenMaxTTLReached,
+			logins:    2,
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			// Fail the first renewal with the test case's status, and succeed
+			// for any after that
+			var l sync.Mutex
+			var logins, renewals int
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				l.Lock()
+				defer l.Unlock()
+
+				switch r.URL.Path {
+				case "/v1/auth/test/login":
+					logins++
+				case "/v1/auth/token/renew-self":
+					renewals++
+					if renewals == 1 {
+						w.WriteHeader(tc.status)
+						w.Write([]byte(tc.body))
+						return
+					}
+				}
+				w.Header().Set("Content-Type", "application/json")
+				w.Write([]byte(`{"auth": {"client_token": "test-token", "lease_duration": 3600, "renewable": true}}`))
+			}))
+			defer server.Close()
+
+			config := api.DefaultConfig()
+			config.Address = server.URL
+			client, err := api.NewClient(config)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			ah := NewAuthHandler(&AuthHandlerConfig{
+				Logger:        logging.NewVaultLogger(hclog.Trace).Named("auth.handler"),
+				Client:        client,
+				MinBackoff:    100 * time.Millisecond,
+				EnableEventCh: true,
+				ExitOnError:   tc.exitOnError,
+			})
+
+			ctx, cancelFunc := context.WithCancel(context.Background())
+			defer cancelFunc()
+
+			errCh := make(chan error)
+			go func() {
+				errCh <- ah.Run(ctx, loginTestMethod{})
+			}()
+			go func() {
+				for range ah.OutputCh {
+				}
+			}()
+
+			var event AuthEvent
+			for event.Type != tc.eventType {
+				select {
+				case event = <-ah.EventCh:
+					if event.Type != tc.eventType && event.Type != TokenIssued {
+						t.Fatalf("expected %q event, got %q", tc.eventType, event.Type)
+					}
+				case err := <-errCh:
+					t.Fatalf("auth handler exited: %v", err)
+				case <-time.After(10 * time.Second):
+					t.Fatal("timed out waiting for renewal failure event")
+				}
+			}
+			if event.Error == nil {
+				t.Fatal("expected event to have an error")
+			}
+
+			// Wait for the token to be renewed successfully
+			deadline := time.Now().Add(10 * time.Second)
+			for {
+				l.Lock()
+				done := renewals >= 2
+				l.Unlock()
+				if done {
+					break
+				}
+				if time.Now().After(deadline) {
+					t.Fatal("timed out waiting for renewal")
+				}
+				time.Sleep(50 * time.Millisecond)
+			}
+
+			cancelFunc()
+			if err := <-errCh; err != nil {
+				t.Fatal(err)
+			}
+
+			l.Lock()
+			defer l.Unlock()
+			if logins != tc.logins {
+				t.Fatalf("expected %d logins, got %d", tc.logins, logins)
+			}
+		})
+	}
+}
+
+func TestAuthHandler_AuthRequestTimeout(t *testing.T) {
+	// Hang the first login until it times out, and fail the second with a
+	// server error, both of which are retried without backing off
+	var l sync.Mutex
+	var logins int
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		l.Lock()
+		logins++
+		attempt := logins
+		l.Unlock()
+
+		switch attempt {
+		case 1:
+			<-release
+			return
+		case 2:
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"auth": {"client_token": "test-token", "lease_duration": 3600, "renewable": false}}`))
+	}))
+	defer server.Close()
+	defer close(release)
+
+	config := api.DefaultConfig()
+	config.Address = server.URL
+	client, err := api.NewClient(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ah := NewAuthHandler(&AuthHandlerConfig{
+		Logger:             logging.NewVaultLogger(hclog.Trace).Named("auth.handler"),
+		Client:             client,
+		MinBackoff:         time.Minute,
+		MaxBackoff:         time.Minute,
+		AuthRequestTimeout: 200 * time.Millisecond,
+	})
+
+	ctx, cancelFunc := context.WithCancel(context.Background())
+	defer cancelFunc()
+
+	errCh := make(chan error)
+	go func() {
+		errCh <- ah.Run(ctx, loginTestMethod{})
+	}()
+
+	select {
+	case <-ah.OutputCh:
+	case err := <-errCh:
+		t.Fatalf("auth handler exited: %v", err)
+	case <-time.After(10 * time.Second):
+		t.Fatal("timed out waiting for token")
+	}
+
+	cancelFunc()
+	for range ah.OutputCh {
+	}
+	if err := <-errCh; err != nil {
+		t.Fatal(err)
+	}
+
+	l.Lock()
+	defer l.Unlock()
+	if logins != 3 {
+		t.Fatalf("expected 3 login attempts, got %d", logins)
+	}
+}
+
+func TestAuthHandler_TokenEvents(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"auth": {"client_token": "test-token", "lease_duration": 2, "renewable": true}}`))
+	}))
+	defer server.Close()
+
+	config := api.DefaultConfig()
+	config.Address = server.URL
+	client, err := api.NewClient(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ah := NewAuthHandler(&AuthHandlerConfig{
+		Logger:        logging.NewVaultLogger(hclog.Trace).Named("auth.handler"),
+		Client:        client,
+		EnableEventCh: true,
+	})
+
+	ctx, cancelFunc := context.WithCancel(context.Background())
+	defer cancelFunc()
+
+	errCh := make(chan error)
+	go func() {
+		errCh <- ah.Run(ctx, loginTestMethod{})
+	}()
+	go func() {
+		for range ah.OutputCh {
+		}
+	}()
+
+	// A new token is issued, and then renewed
+	for _, expected := range []AuthEvent{
+		{Type: TokenIssued, TTL: 2 * time.Second},
+		{Type: TokenRenewed, TTL: 2 * time.Second, Renewed: true},
+	} {
+		select {
+		case event := <-ah.EventCh:
+			if event.Type != expected.Type || event.TTL != expected.TTL || event.Renewed != expected.Renewed {
+				t.Fatalf("expected %+v, got %+v", expected, event)
+			}
+		case err := <-errCh:
+			t.Fatalf("auth handler exited: %v", err)
+		case <-time.After(10 * time.Second):
+			t.Fatalf("timed out waiting for %q event", expected.Type)
+		}
+	}
+
+	cancelFunc()
+	if err := <-errCh; err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestAuthHandler_RenewalSent tests that when the token's lease is renewed,
+// it's sent again to the sinks and templates, which take it as a renewal.
+func TestAuthHandler_RenewalSent(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"auth": {"client_token": "test-token", "lease_duration": 2, "renewable": true}}`))
+	}))
+	defer server.Close()
+
+	config := api.DefaultConfig()
+	config.Address = server.URL
+	client, err := api.NewClient(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ah := NewAuthHandler(&AuthHandlerConfig{
+		Logger:                logging.NewVaultLogger(hclog.Trace).Named("auth.handler"),
+		Client:                client,
+		EnableTemplateTokenCh: true,
+	})
+
+	ctx, cancelFunc := context.WithCancel(context.Background())
+	defer cancelFunc()
+
+	errCh := make(chan error)
+	go func() {
+		errCh <- ah.Run(ctx, loginTestMethod{})
+	}()
+
+	// The lifetime watcher renews the token as soon as it starts, so it's
+	// received once when issued, and again when renewed
+	for i := 0; i < 2; i++ {
+		for name, ch := range map[string]chan string{"sinks": ah.OutputCh, "templates": ah.TemplateTokenCh} {
+			select {
+			case token := <-ch:
+				if token != "test-token" {
+					t.Fatalf("expected %s to receive %q, got %q", name, "test-token", token)
+				}
+			case err := <-errCh:
+				t.Fatalf("auth handler exited: %v", err)
+			case <-time.After(10 * time.Second):
+				t.Fatalf("timed out waiting for token %d to be sent to %s", i, name)
+			}
+		}
+	}
+
+	cancelFunc()
+	go func() {
+		for range ah.OutputCh {
+		}
+	}()
+	go func() {
+		for range ah.TemplateTokenCh {
+		}
+	}()
+	if err := <-errCh; err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestAuthHandler_ExpectedPolicies tests that an event listing the policies
+// beyond those expected is emitted for a token which has them, and that the
+// token is still delivered.
+func TestAuthHandler_ExpectedPolicies(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"auth": {"client_token": "test-token", "lease_duration": 0, "renewable": false, "policies": ["default", "app", "admin"], "identity_policies": ["ops", "app"]}}`))
+	}))
+	defer server.Close()
+
+	config := api.DefaultConfig()
+	config.Address = server.URL
+	client, err := api.NewClient(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ah := NewAuthHandler(&AuthHandlerConfig{
+		Logger:           logging.NewVaultLogger(hclog.Trace).Named("auth.handler"),
+		Client:           client,
+		EnableEventCh:    true,
+		ExpectedPolicies: []string{"default", "app"},
+	})
+
+	ctx, cancelFunc := context.WithCancel(context.Background())
+	defer cancelFunc()
+
+	errCh := make(chan error)
+	go func() {
+		errCh <- ah.Run(ctx, loginTestMethod{})
+	}()
+	go func() {
+		for range ah.OutputCh {
+		}
+	}()
+
+	for _, expected := range []AuthEvent{
+		{Type: UnexpectedPolicies, Policies: []string{"admin", "ops"}},
+		{Type: TokenIssued},
+	} {
+		select {
+		case event := <-ah.EventCh:
+			if event.Type != expected.Type || !reflect.DeepEqual(event.Policies, expected.Policies) {
+				t.Fatalf("expected %+v, got %+v", expected, event)
+			}
+		case err := <-errCh:
+			t.Fatalf("auth handler exited: %v", err)
+		case <-time.After(10 * time.Second):
+			t.Fatalf("timed out waiting for %q event", expected.Type)
+		}
+	}
+
+	cancelFunc()
+	if err := <-errCh; err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestTokenStore tests that a persisted token is read back with its expiry,
+// and can't be read with a different key.
+func TestTokenStore(t *testing.T) {
+	key := make([]byte, 32)
+	keyPath := filepath.Join(t.TempDir(), "key")
+	if err := os.WriteFile(keyPath, []byte(base64.StdEncoding.EncodeToString(key)+"\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	store, err := NewTokenStore(filepath.Join(t.TempDir(), "token"), KeyFromFile(keyPath))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, _, err := store.Load(); !errors.Is(err, ErrNoPersistedToken) {
+		t.Fatalf("expected ErrNoPersistedToken, got %v", err)
+	}
+
+	expiry := time.Now().Add(time.Hour).Round(0)
+	if err := store.Save("test-token", expiry); err != nil {
+		t.Fatal(err)
+	}
+	contents, err := os.ReadFile(store.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(contents), "test-token") {
+		t.Fatal("expected the persisted token to be encrypted")
+	}
+	token, loadedExpiry, err := store.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token != "test-token" || !loadedExpiry.Equal(expiry) {
+		t.Fatalf("unexpected token %q expiring at %s", token, loadedExpiry)
+	}
+
+	key[0] = 1
+	os.WriteFile(keyPath, []byte(base64.StdEncoding.EncodeToString(key)), 0o600)
+	if _, _, err := store.Load(); err == nil {
+		t.Fatal("expected error loading the token with a different key")
+	}
+
+	t.Setenv("TEST_TOKEN_STORE_KEY", "c2hvcnQ=")
+	if _, err := KeyFromEnv("TEST_TOKEN_STORE_KEY").Key(); err == nil {
+		t.Fatal("expected error for a key of the wrong length")
+	}
+}
+
+// TestAuthHandler_PersistedToken tests that the token is persisted once it's
+// obtained, and delivered by a handler which fails to authenticate when it
+// starts because Vault is failing, but not if authentication is rejected, the
+// token can't be looked up, or it has expired.
+func TestAuthHandler_PersistedToken(t *testing.T) {
+	var up atomic.Bool
+	up.Store(true)
+	var lookupStatus atomic.Int64
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if status := lookupStatus.Load(); status != 0 && r.URL.Path == "/v1/auth/token/lookup-self" {
+			w.WriteHeader(int(status))
+			return
+		}
+		if !up.Load() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"auth": {"client_token": "test-token", "lease_duration": 3600, "renewable": false}}`))
+	}))
+	defer server.Close()
+
+	config := api.DefaultConfig()
+	config.Address = server.URL
+	config.MaxRetries = 0
+	client, err := api.NewClient(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Setenv("TEST_TOKEN_STORE_KEY", base64.StdEncoding.EncodeToString(make([]byte, 32)))
+	store, err := NewTokenStore(filepath.Join(t.TempDir(), "token"), KeyFromEnv("TEST_TOKEN_STORE_KEY"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	run := func() {
+		t.Helper()
+		ah := NewAuthHandler(&AuthHandlerConfig{
+			Logger:     logging.NewVaultLogger(hclog.Trace).Named("auth.handler"),
+			Client:     client,
+			MinBackoff: 10 * time.Millisecond,
+			MaxBackoff: 100 * time.Millisecond,
+			TokenStore: store,
+		})
+		ctx, cancelFunc := context.WithCancel(context.Background())
+		defer cancelFunc()
+		errCh := make(chan error)
+		go func() {
+			errCh <- ah.Run(ctx, loginTestMethod{})
+		}()
+
+		select {
+		case token := <-ah.OutputCh:
+			if token != "test-token" {
+				t.Fatalf("unexpected token %q", token)
+			}
+		case err := <-errCh:
+			t.Fatalf("auth handler exited: %v", err)
+		case <-time.After(10 * time.Second):
+			t.Fatal("timed out waiting for token")
+		}
+		cancelFunc()
+		if err := <-errCh; err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	run()
+	if token, _, err := store.Load(); err != nil || token != "test-token" {
+		t.Fatalf("expected the token to be persisted, got %q, %v", token, err)
+	}
+
+	up.Store(false)
+	run()
+
+	outage := &api.ResponseError{StatusCode: http.StatusServiceUnavailable}
+	for name, tc := range map[string]struct {
+		err           error
+		lookupStatus  int
+		expiry        time.Time
+		exitAfterAuth bool
+	}{
+		"rejected":        {err: &api.ResponseError{StatusCode: http.StatusForbidden}},
+		"revoked":         {err: outage, lookupStatus: http.StatusForbidden},
+		"expired":         {err: outage, expiry: time.Now().Add(-time.Second)},
+		"exit after auth": {err: outage, exitAfterAuth: true},
+	} {
+		t.Run(name, func(t *testing.T) {
+			if tc.expiry.IsZero() {
+				tc.expiry = time.Now().Add(time.Hour)
+			}
+			if err := store.Save("test-token", tc.expiry); err != nil {
+				t.Fatal(err)
+			}
+			lookupStatus.Store(int64(tc.lookupStatus))
+			defer lookupStatus.Store(0)
+
+			ah := NewAuthHandler(&AuthHandlerConfig{
+				Logger:        logging.NewVaultLogger(hclog.Trace).Named("auth.handler"),
+				Client:        client,
+				TokenStore:    store,
+				ExitAfterAuth: tc.exitAfterAuth,
+			})
+			ah.usePersistedToken(context.Background(), client, tc.err)
+			if _, ok := ah.CurrentToken(); ok {
+				t.Fatal("expected the persisted token not to be used")
+			}
+		})
+	}
+}
+
+// TestAuthHandler_DroppedTokenRenewed tests that a token dropped rather than
+// sent to the sinks isn't taken as delivered, so that when it's delivered
+// again, it's reported as issued rather than renewed.
+func TestAuthHandler_DroppedTokenRenewed(t *testing.T) {
+	ah := NewAuthHandler(&AuthHandlerConfig{
+		Logger:                logging.NewVaultLogger(hclog.Trace).Named("auth.handler"),
+		EnableEventCh:         true,
+		OutputDeliveryMode:    OutputDeliveryDrop,
+		OutputDeliveryTimeout: 10 * time.Millisecond,
+	})
+
+	deliver := func() bool {
+		t.Helper()
+		ah.deliverToken(context.Background(), "test-token", time.Minute, "")
+		event := <-ah.EventCh
+		if renewed := event.Type == TokenRenewed; renewed != event.Renewed {
+			t.Fatalf("expected a %s event to have Renewed set to %t", event.Type, renewed)
+		}
+		return event.Renewed
+	}
+
+	// OutputCh's buffer is full, so the token is dropped
+	ah.OutputCh <- "waiting"
+	if deliver() {
+		t.Fatal("expected the first token not to be renewed")
+	}
+	<-ah.OutputCh
+	if deliver() {
+		t.Fatal("expected the token not to be renewed, as it was dropped before")
+	}
+	<-ah.OutputCh
+	if !deliver() {
+		t.Fatal("expected the token to be renewed once it has been sent")
+	}
+}
+
+// TestAuthHandler_OutputDeliveryMode tests that, with an OutputCh nothing
+// reads from, the handler keeps re-authenticating unless it's set to block.
+func TestAuthHandler_OutputDeliveryMode(t *testing.T) {
+	var issued atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(w, `{"auth": {"client_token": "test-token-%d", "lease_duration": 1, "renewable": false}}`, issued.Add(1))
+	}))
+	defer server.Close()
+
+	config := api.DefaultConfig()
+	config.Address = server.URL
+	client, err := api.NewClient(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, mode := range []OutputDeliveryMode{OutputDeliveryBlock, OutputDeliveryDrop, OutputDeliveryLatest} {
+		t.Run(string(mode), func(t *testing.T) {
+			issued.Store(0)
+			ah := NewAuthHandler(&AuthHandlerConfig{
+				Logger:                logging.NewVaultLogger(hclog.Trace).Named("auth.handler"),
+				Client:                client,
+				EnableEventCh:         true,
+				MinBackoff:            10 * time.Millisecond,
+				MaxBackoff:            10 * time.Millisecond,
+				OutputDeliveryMode:    mode,
+				OutputDeliveryTimeout: 10 * time.Millisecond,
+			})
+
+			ctx, cancelFunc := context.WithCancel(context.Background())
+			defer cancelFunc()
+
+			errCh := make(chan error)
+			go func() {
+				errCh <- ah.Run(ctx, loginTestMethod{})
+			}()
+
+			// The first token fills OutputCh's buffer, after which a blocking
+			// handler can't deliver any more
+			expected := 3
+			if mode == OutputDeliveryBlock {
+				expected = 1
+			}
+			timeout := time.After(10 * time.Second)
+			for delivered := 0; delivered < expected; {
+				select {
+				case event := <-ah.EventCh:
+					if event.Type == TokenIssued {
+						delivered++
+					}
+				case err := <-errCh:
+					t.Fatalf("auth handler exited: %v", err)
+				case <-timeout:
+					t.Fatalf("timed out waiting for %d tokens to be delivered, got %d", expected, delivered)
+				}
+			}
+
+			if mode == OutputDeliveryBlock {
+				select {
+				case event := <-ah.EventCh:
+					if event.Type == TokenIssued {
+						t.Fatal("expected delivery to block")
+					}
+				case <-time.After(3 * time.Second):
+				}
+			}
+
+			cancelFunc()
+			if mode == OutputDeliveryBlock {
+				// Unblock the handler, which is sending the second token
+				<-ah.OutputCh
+			}
+			if err := <-errCh; err != nil {
+				t.Fatal(err)
+			}
+
+			token := <-ah.OutputCh
+			switch mode {
+			case OutputDeliveryDrop:
+				if token != "test-token-1" {
+					t.Fatalf("expected the first token to be left waiting, got %q", token)
+				}
+			case OutputDeliveryLatest:
+				if token == "test-token-1" {
+					t.Fatal("expected the first token to be replaced")
+				}
+			}
+		})
+	}
+}
+
+// TestHealthy_Default tests that methods without a health check are healthy.
+func TestHealthy_Default(t *testing.T) {
+	if err := Healthy(context.Background(), &loginTestMethod{}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestAuthHandler_ErrorFile tests that a failed login is recorded in the
+// ErrorFile, and cleared once authentication succeeds.
+func TestAuthHandler_ErrorFile(t *testing.T) {
+	var requests atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if requests.Add(1) == 1 {
+			w.WriteHeader(http.StatusForbidden)
+			w.Write([]byte(`{"errors": ["permission denied"]}`))
+			return
+		}
+		w.Write([]byte(`{"auth": {"client_token": "test-token", "lease_duration": 3600, "renewable": false}}`))
+	}))
+	defer server.Close()
+
+	config := api.DefaultConfig()
+	config.Address = server.URL
+	client, err := api.NewClient(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(t.TempDir(), "last-error")
+	ah := NewAuthHandler(&AuthHandlerConfig{
+		Logger:        logging.NewVaultLogger(hclog.Trace).Named("auth.handler"),
+		Client:        client,
+		EnableEventCh: true,
+		MinBackoff:    time.Second,
+		MaxBackoff:    time.Second,
+		ErrorFile:     errorfile.New(path, nil),
+	})
+
+	ctx, cancelFunc := context.WithCancel(context.Background())
+	defer cancelFunc()
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- ah.Run(ctx, loginTestMethod{})
+	}()
+
+	// The error is recorded before the handler backs off
+	var contents []byte
+	for i := 0; i < 50 && len(contents) == 0; i++ {
+		time.Sleep(20 * time.Millisecond)
+		contents, _ = os.ReadFile(path)
+	}
+	if !strings.Contains(string(contents), "auth: error authenticating") || !strings.Contains(string(contents), "permission denied") {
+		t.Fatalf("unexpected error file contents %q", contents)
+	}
+
+	timeout := time.After(10 * time.Second)
+	for issued := false; !issued; {
+		select {
+		case event := <-ah.EventCh:
+			issued = event.Type == TokenIssued
+		case err := <-errCh:
+			t.Fatalf("auth handler exited: %v", err)
+		case <-timeout:
+			t.Fatal("timed out waiting for a token")
+		}
+	}
+
+	// The file is cleared once the handler has finished authenticating
+	for i := 0; i < 50; i++ {
+		if contents, _ = os.ReadFile(path); len(contents) == 0 {
+			break
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	if len(contents) != 0 {
+		t.Fatalf("expected error file to be emptied, got %q", contents)
+	}
+}
+
+// TestAuthHandler_RenewIncrement tests that renewals request the configured
+// increment, and that an invalid increment is rejected.
+func TestAuthHandler_RenewIncrement(t *testing.T) {
+	increments := make(chan interface{}, 10)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if r.URL.Path == "/v1/auth/token/renew-self" {
+			var body map[string]interface{}
+			if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			increments <- body["increment"]
+		}
+		// Vault grants less than the increment requested
+		w.Write([]byte(`{"auth": {"client_token": "test-token", "lease_duration": 2, "renewable": true}}`))
+	}))
+	defer server.Close()
+
+	config := api.DefaultConfig()
+	config.Address = server.URL
+	client, err := api.NewClient(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ah := NewAuthHandler(&AuthHandlerConfig{
+		Logger:         logging.NewVaultLogger(hclog.Trace).Named("auth.handler"),
+		Client:         client,
+		RenewIncrement: time.Minute,
+	})
+
+	ctx, cancelFunc := context.WithCancel(context.Background())
+	defer cancelFunc()
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- ah.Run(ctx, loginTestMethod{})
+	}()
+
+	select {
+	case increment := <-increments:
+		if increment != float64(60) {
+			t.Fatalf("expected an increment of 60, got %v", increment)
+		}
+	case err := <-errCh:
+		t.Fatalf("auth handler exited: %v", err)
+	case <-time.After(10 * time.Second):
+		t.Fatal("timed out waiting for renewal")
+	}
+
+	for _, increment := range []time.Duration{-time.Second, 1500 * time.Millisecond} {
+		ah := NewAuthHandler(&AuthHandlerConfig{
+			Logger:         logging.NewVaultLogger(hclog.Trace).Named("auth.handler"),
+			Client:         client,
+			RenewIncrement: increment,
+		})
+		if err := ah.Run(ctx, loginTestMethod{}); err == nil {
+			t.Fatalf("expected error for increment %s", increment)
+		}
+	}
+}
+
+// TestAuthHandler_Pause tests that a paused handler doesn't re-authenticate
+// or renew its token until it's resumed, unless RenewWhilePaused is set.
+func TestAuthHandler_Pause(t *testing.T) {
+	var logins, renewals atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		// Each login issues a new token
+		n := logins.Load()
+		if r.URL.Path == "/v1/auth/token/renew-self" {
+			renewals.Add(1)
+		} else {
+			n = logins.Add(1)
+		}
+		fmt.Fprintf(w, `{"auth": {"client_token": "test-token-%d", "lease_duration": 2, "renewable": true}}`, n)
+	}))
+	defer server.Close()
+
+	config := api.DefaultConfig()
+	config.Address = server.URL
+	client, err := api.NewClient(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, renewWhilePaused := range []bool{false, true} {
+		t.Run(fmt.Sprintf("renew while paused %t", renewWhilePaused), func(t *testing.T) {
+			logins.Store(0)
+			renewals.Store(0)
+			ah := NewAuthHandler(&AuthHandlerConfig{
+				Logger:           logging.NewVaultLogger(hclog.Trace).Named("auth.handler"),
+				Client:           client,
+				EnableEventCh:    true,
+				RenewWhilePaused: renewWhilePaused,
+			})
+
+			ctx, cancelFunc := context.WithCancel(context.Background())
+			defer cancelFunc()
+			errCh := make(chan error, 1)
+			go func() {
+				errCh <- ah.Run(ctx, loginTestMethod{})
+			}()
+			go func() {
+				for range ah.OutputCh {
+				}
+			}()
+
+			waitForEvent := func(eventType AuthEventType) {
+				t.Helper()
+				timeout := time.After(10 * time.Second)
+				for {
+					select {
+					case event := <-ah.EventCh:
+						if event.Type == eventType {
+							return
+						}
+					case err := <-errCh:
+						t.Fatalf("auth handler exited: %v", err)
+					case <-timeout:
+						t.Fatalf("timed out waiting for %s event", eventType)
+					}
+				}
+			}
+
+			// The lifetime watcher renews the token as soon as it starts
+			waitForEvent(TokenIssued)
+			waitForEvent(TokenRenewed)
+			ah.Pause()
+			waitForEvent(Paused)
+			if !ah.Paused() {
+				t.Fatal("expected handler to be paused")
+			}
+
+			// Re-authentication is deferred while paused
+			ah.InvalidToken <- errors.New("invalid token")
+			renewalsBefore := renewals.Load()
+			time.Sleep(3 * time.Second)
+			if n := logins.Load(); n != 1 {
+				t.Fatalf("expected 1 login while paused, got %d", n)
+			}
+			renewed := renewals.Load() > renewalsBefore
+			if renewed != renewWhilePaused {
+				t.Fatalf("expected renewal while paused to be %t, got %t", renewWhilePaused, renewed)
+			}
+
+			ah.Resume()
+			if ah.Paused() {
+				t.Fatal("expected handler to be resumed")
+			}
+			waitForEvent(Resumed)
+			waitForEvent(TokenIssued)
+			if n := logins.Load(); n != 2 {
+				t.Fatalf("expected 2 logins after resuming, got %d", n)
+			}
+		})
+	}
+}
+
+// TestAuthHandler_PauseAfterStop tests that pausing and resuming a handler
+// whose Run has returned doesn't emit on its closed EventCh.
+func TestAuthHandler_PauseAfterStop(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"auth": {"client_token": "test-token", "lease_duration": 3600, "renewable": false}}`))
+	}))
+	defer server.Close()
+
+	config := api.DefaultConfig()
+	config.Address = server.URL
+	client, err := api.NewClient(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ah := NewAuthHandler(&AuthHandlerConfig{
+		Logger:        logging.NewVaultLogger(hclog.Trace).Named("auth.handler"),
+		Client:        client,
+		EnableEventCh: true,
+	})
+
+	ctx, cancelFunc := context.WithCancel(context.Background())
+	cancelFunc()
+	if err := ah.Run(ctx, loginTestMethod{}); err != nil {
+		t.Fatal(err)
+	}
+
+	ah.Pause()
+	ah.Resume()
+	for event := range ah.EventCh {
+		if event.Type == Paused || event.Type == Resumed {
+			t.Fatalf("unexpected %q event after the handler stopped", event.Type)
+		}
+	}
+}
+
+// TestAuthHandler_RecentEvents tests that only the most recent events are
+// kept, oldest first, and that none are kept by default.
+func TestAuthHandler_RecentEvents(t *testing.T) {
+	ah := NewAuthHandler(&AuthHandlerConfig{
+		Logger:           logging.NewVaultLogger(hclog.Trace),
+		EventHistorySize: 3,
+	})
+	if events := ah.RecentEvents(); len(events) != 0 {
+		t.Fatalf("expected no events, got %v", events)
+	}
+
+	types := []AuthEventType{TokenIssued, TokenRenewed, RenewalFailedTransient, RenewalFailedPermanent, TokenIssued}
+	for i, typ := range types {
+		ah.emitEvent(AuthEvent{Type: typ})
+		if events := ah.RecentEvents(); len(events) != min(i+1, 3) {
+			t.Fatalf("expected %d events, got %d", min(i+1, 3), len(events))
+		}
+	}
+	events := ah.RecentEvents()
+	for i, event := range events {
+		if event.Type != types[i+2] {
+			t.Fatalf("expected event %d to be %q, got %q", i, types[i+2], event.Type)
+		}
+		if event.Time.IsZero() {
+			t.Fatalf("expected event %d to have a time", i)
+		}
+	}
+
+	ah = NewAuthHandler(&AuthHandlerConfig{Logger: logging.NewVaultLogger(hclog.Trace)})
+	ah.emitEvent(AuthEvent{Type: TokenIssued})
+	if events := ah.RecentEvents(); events != nil {
+		t.Fatalf("expected no events, got %v", events)
+	}
+}
+
+// TestAuthHandler_TriggerReauth tests that TriggerReauth causes a single
+// re-authentication, however many times it's called meanwhile, and does
+// nothing once the handler has stopped.
+func TestAuthHandler_TriggerReauth(t *testing.T) {
+	var logins atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := logins.Load()
+		if r.URL.Path == "/v1/auth/test/login" {
+			n = logins.Add(1)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(w, `{"auth": {"client_token": "test-token-%d", "lease_duration": 3600, "renewable": false}}`, n)
+	}))
+	defer server.Close()
+
+	config := api.DefaultConfig()
+	config.Address = server.URL
+	client, err := api.NewClient(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ah := NewAuthHandler(&AuthHandlerConfig{
+		Logger:        logging.NewVaultLogger(hclog.Trace).Named("auth.handler"),
+		Client:        client,
+		EnableEventCh: true,
+	})
+
+	ctx, cancelFunc := context.WithCancel(context.Background())
+	defer cancelFunc()
+
+	errCh := make(chan error)
+	go func() {
+		errCh <- ah.Run(ctx, loginTestMethod{})
+	}()
+	go func() {
+		for range ah.OutputCh {
+		}
+	}()
+
+	waitForEvent := func(eventType AuthEventType) AuthEvent {
+		t.Helper()
+		for {
+			select {
+			case event := <-ah.EventCh:
+				if event.Type == eventType {
+					return event
+				}
+			case err := <-errCh:
+				t.Fatalf("auth handler exited: %v", err)
+			case <-time.After(10 * time.Second):
+				t.Fatalf("timed out waiting for %q event", eventType)
+			}
+		}
+	}
+
+	waitForEvent(TokenIssued)
+	ah.TriggerReauth("token revoked")
+	ah.TriggerReauth("token revoked again")
+	if event := waitForEvent(ReauthTriggered); event.Reason != "token revoked" {
+		t.Fatalf("expected reason %q, got %q", "token revoked", event.Reason)
+	}
+	waitForEvent(TokenIssued)
+
+	// Give any extra re-authentication time to happen
+	time.Sleep(500 * time.Millisecond)
+	if n := logins.Load(); n != 2 {
+		t.Fatalf("expected 2 logins, got %d", n)
+	}
+
+	cancelFunc()
+	if err := <-errCh; err != nil {
+		t.Fatal(err)
+	}
+
+	// Once stopped, requests are ignored rather than left unread, and no
+	// event is emitted on the closed EventCh
+	ah.TriggerReauth("token revoked after stopping")
+	if n := len(ah.reauthCh); n != 0 {
+		t.Fatalf("expected no pending re-authentication requests, got %d", n)
+	}
+	for event := range ah.EventCh {
+		if event.Type == ReauthTriggered {
+			t.Fatalf("unexpected %q event after the handler stopped", event.Type)
+		}
+	}
+}
+
+// TestAuthHandler_CurrentToken tests that the current token is available
+// once it's delivered, and no longer once it has expired or the handler has
+// stopped.
+func TestAuthHandler_CurrentToken(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"auth": {"client_token": "test-token", "lease_duration": 3600, "renewable": false}}`))
+	}))
+	defer server.Close()
+
+	config := api.DefaultConfig()
+	config.Address = server.URL
+	client, err := api.NewClient(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ah := NewAuthHandler(&AuthHandlerConfig{
+		Logger:        logging.NewVaultLogger(hclog.Trace).Named("auth.handler"),
+		Client:        client,
+		EnableEventCh: true,
+	})
+	if _, ok := ah.CurrentToken(); ok {
+		t.Fatal("expected no current token before authenticating")
+	}
+
+	ctx, cancelFunc := context.WithCancel(context.Background())
+	defer cancelFunc()
+
+	errCh := make(chan error)
+	go func() {
+		errCh <- ah.Run(ctx, loginTestMethod{})
+	}()
+	go func() {
+		for range ah.OutputCh {
+		}
+	}()
+
+	select {
+	case <-ah.EventCh:
+	case <-time.After(10 * time.Second):
+		t.Fatal("timed out waiting for token")
+	}
+	if token, ok := ah.CurrentToken(); !ok || token != "test-token" {
+		t.Fatalf("expected current token %q, got %q", "test-token", token)
+	}
+
+	// An expired token isn't current
+	ah.setCurrentToken("expired-token", time.Nanosecond)
+	time.Sleep(time.Millisecond)
+	if _, ok := ah.CurrentToken(); ok {
+		t.Fatal("expected no current token once it has expired")
+	}
+
+	cancelFunc()
+	if err := <-errCh; err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := ah.CurrentToken(); ok {
+		t.Fatal("expected no current token once stopped")
+	}
+}
+
+// TestAuthHandler_TokenSequence tests that tokens are numbered in the order
+// they're first delivered, and that only the most recent are remembered.
+func TestAuthHandler_TokenSequence(t *testing.T) {
+	ah := NewAuthHandler(&AuthHandlerConfig{
+		Logger: logging.NewVaultLogger(hclog.Trace).Named("auth.handler"),
+	})
+	if _, ok := ah.TokenSequence("token-1"); ok {
+		t.Fatal("expected no sequence number before the token is delivered")
+	}
+
+	ah.sequences.stamp("token-1")
+	ah.sequences.stamp("token-2")
+	// A renewed token keeps its number
+	ah.sequences.stamp("token-1")
+	first, _ := ah.TokenSequence("token-1")
+	second, _ := ah.TokenSequence("token-2")
+	if first >= second {
+		t.Fatalf("expected token-1 to be numbered before token-2, got %d and %d", first, second)
+	}
+
+	for i := 0; i < maxSequencedTokens; i++ {
+		ah.sequences.stamp(fmt.Sprintf("token-%d", i+3))
+	}
+	if _, ok := ah.TokenSequence("token-1"); ok {
+		t.Fatal("expected token-1 to be forgotten")
+	}
+	if seq, ok := ah.TokenSequence(fmt.Sprintf("token-%d", maxSequencedTokens+2)); !ok || seq <= second {
+		t.Fatalf("expected the latest token to be numbered after token-2, got %d", seq)
+	}
+}
+
+type transientErrorTestMethod struct {
+	loginTestMethod
+	failures atomic.Int32
+}
+
+func (m *transientErrorTestMethod) Authenticate(ctx context.Context, client *api.Client) (string, http.Header, map[string]interface{}, error) {
+	if m.failures.Add(-1) >= 0 {
+		return "", nil, nil, &TransientError{Err: errors.New("device busy")}
+	}
+	return m.loginTestMethod.Authenticate(ctx, client)
+}
+
+// TestAuthHandler_TransientAuthErrors tests that an auth method's transient
+// errors are retried before the handler backs off, so that they don't stop a
+// handler set to exit on errors.
+func TestAuthHandler_TransientAuthErrors(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"auth": {"client_token": "test-token", "lease_duration": 3600, "renewable": false}}`))
+	}))
+	defer server.Close()
+
+	config := api.DefaultConfig()
+	config.Address = server.URL
+	client, err := api.NewClient(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for name, tc := range map[string]struct {
+		failures int32
+		exits    bool
+	}{
+		"retried":   {failures: authRequestRetries},
+		"exhausted": {failures: authRequestRetries + 1, exits: true},
+	} {
+		t.Run(name, func(t *testing.T) {
+			ah := NewAuthHandler(&AuthHandlerConfig{
+				Logger:        logging.NewVaultLogger(hclog.Trace).Named("auth.handler"),
+				Client:        client,
+				EnableEventCh: true,
+				ExitOnError:   true,
+			})
+			method := &transientErrorTestMethod{}
+			method.failures.Store(tc.failures)
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			errCh := make(chan error, 1)
+			go func() {
+				errCh <- ah.Run(ctx, method)
+			}()
+
+			timeout := time.After(10 * time.Second)
+			for {
+				select {
+				case event := <-ah.EventCh:
+					if event.Type != TokenIssued {
+						continue
+					}
+					if tc.exits {
+						t.Fatal("expected the handler to exit")
+					}
+					return
+				case err := <-errCh:
+					if !tc.exits {
+						t.Fatalf("auth handler exited: %v", err)
+					}
+					var transientErr *TransientError
+					if !errors.As(err, &transientErr) {
+						t.Fatalf("expected transient error, got %v", err)
+					}
+					return
+				case <-timeout:
+					t.Fatal("timed out")
+				}
+			}
+		})
+	}
+}
+
+// loginMethod completes the login itself, returning a fixed login response.
+type loginMethod struct {
+	loginTestMethod
+}
+
+func (loginMethod) Authenticate(context.Context, *api.Client) (string, http.Header, map[string]interface{}, error) {
+	return "", nil, nil, errors.New("unexpected call to Authenticate")
+}
+
+func (loginMethod) Login(context.Context, *api.Client) (*api.Secret, error) {
+	return &api.Secret{
+		Auth: &api.SecretAuth{ClientToken: "login-token", LeaseDuration: 3600},
+	}, nil
+}
+
+// TestAuthHandler_Login tests that the response from the Login of a method
+// implementing AuthMethodWithLogin is used, without the handler making a
+// login request itself.
+func TestAuthHandler_Login(t *testing.T) {
+	var requests atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer server.Close()
+
+	config := api.DefaultConfig()
+	config.Address = server.URL
+	client, err := api.NewClient(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ah := NewAuthHandler(&AuthHandlerConfig{
+		Logger: logging.NewVaultLogger(hclog.Trace).Named("auth.handler"),
+		Client: client,
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- ah.Run(ctx, loginMethod{})
+	}()
+
+	select {
+	case token := <-ah.OutputCh:
+		if token != "login-token" {
+			t.Fatalf("unexpected token %q", token)
+		}
+	case err := <-errCh:
+		t.Fatalf("auth handler exited: %v", err)
+	case <-time.After(10 * time.Second):
+		t.Fatal("timed out waiting for token")
+	}
+	if n := requests.Load(); n != 0 {
+		t.Fatalf("expected no requests to Vault, got %d", n)
+	}
+}
+
+// tokenTestMethod records the tokens the handler authenticates with.
+type tokenTestMethod struct {
+	loginTestMethod
+	tokens chan string
+}
+
+func (m tokenTestMethod) Authenticated(token string) {
+	m.tokens <- token
+}
+
+// TestAuthHandler_Authenticated tests that a method implementing
+// AuthMethodWithToken is given the token it authenticated.
+func TestAuthHandler_Authenticated(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"auth": {"client_token": "test-token", "lease_duration": 3600, "renewable": false}}`))
+	}))
+	defer server.Close()
+
+	config := api.DefaultConfig()
+	config.Address = server.URL
+	client, err := api.NewClient(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ah := NewAuthHandler(&AuthHandlerConfig{
+		Logger: logging.NewVaultLogger(hclog.Trace).Named("auth.handler"),
+		Client: client,
+	})
+	method := tokenTestMethod{tokens: make(chan string, 1)}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go ah.Run(ctx, method)
+	go func() {
+		for range ah.OutputCh {
+		}
+	}()
+
+	select {
+	case token := <-method.tokens:
+		if token != "test-token" {
+			t.Fatalf("unexpected token %q", token)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("timed out waiting for token")
+	}
+}
+
+// rejectionTestMethod logs in with a password which is replaced, as a
+// credential file would be rewritten, while Vault is rejecting it.
+type rejectionTestMethod struct {
+	loginTestMethod
+	password atomic.Value
+	rejected atomic.Int32
+	replace  bool
+}
+
+func (m *rejectionTestMethod) Authenticate(context.Context, *api.Client) (string, http.Header, map[string]interface{}, error) {
+	return "auth/test/login", nil, map[string]interface{}{"password": m.password.Load()}, nil
+}
+
+func (m *rejectionTestMethod) Rejected(context.Context, error) bool {
+	m.rejected.Add(1)
+	if !m.replace {
+		return false
+	}
+	m.password.Store("new-password")
+	return true
+}
+
+// TestAuthHandler_Rejection tests that a method implementing
+// AuthMethodWithRejection is only asked for new credentials once Vault
+// rejects its old ones, and that they're retried within the same attempt.
+func TestAuthHandler_Rejection(t *testing.T) {
+	var logins atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		logins.Add(1)
+		var body map[string]interface{}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			t.Error(err)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if body["password"] != "new-password" {
+			w.WriteHeader(http.StatusForbidden)
+			w.Write([]byte(`{"errors": ["permission denied"]}`))
+			return
+		}
+		w.Write([]byte(`{"auth": {"client_token": "test-token", "lease_duration": 3600, "renewable": false}}`))
+	}))
+	defer server.Close()
+
+	config := api.DefaultConfig()
+	config.Address = server.URL
+	client, err := api.NewClient(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for name, tc := range map[string]struct {
+		password string
+		replace  bool
+		rejected int32
+		logins   int32
+	}{
+		"accepted":  {password: "new-password", replace: true, rejected: 0, logins: 1},
+		"replaced":  {password: "old-password", replace: true, rejected: 1, logins: 2},
+		"unchanged": {password: "old-password", replace: false, rejected: 1, logins: 1},
+	} {
+		t.Run(name, func(t *testing.T) {
+			logins.Store(0)
+			// The backoff keeps any attempt after the first from being made
+			// while the test runs
+			ah := NewAuthHandler(&AuthHandlerConfig{
+				Logger:     logging.NewVaultLogger(hclog.Trace).Named("auth.handler"),
+				Client:     client,
+				MinBackoff: time.Minute,
+				MaxBackoff: time.Minute,
+			})
+			method := &rejectionTestMethod{replace: tc.replace}
+			method.password.Store(tc.password)
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			errCh := make(chan error, 1)
+			go func() {
+				errCh <- ah.Run(ctx, method)
+			}()
+
+			timeout := time.After(10 * time.Second)
+			if tc.replace {
+				select {
+				case token := <-ah.OutputCh:
+					if token != "test-token" {
+						t.Fatalf("unexpected token %q", token)
+					}
+				case err := <-errCh:
+					t.Fatalf("auth handler exited: %v", err)
+				case <-timeout:
+					t.Fatal("timed out waiting for token")
+				}
+			} else {
+				for method.rejected.Load() == 0 {
+					select {
+					case token := <-ah.OutputCh:
+						t.Fatalf("unexpected token %q", token)
+					case <-timeout:
+						t.Fatal("timed out waiting for rejection")
+					case <-time.After(10 * time.Millisecond):
+					}
+				}
+			}
+			if rejected := method.rejected.Load(); rejected != tc.rejected {
+				t.Fatalf("expected the method to be told of %d rejections, got %d", tc.rejected, rejected)
+			}
+			if n := logins.Load(); n != tc.logins {
+				t.Fatalf("expected %d logins, got %d", tc.logins, n)
+			}
+		})
+	}
+}
+
+// TestAuthHandler_ReauthLimit tests that the handler holds off
+// re-authenticating once it has authenticated MaxReauthsPerWindow times
+// within the Window, until the window allows another.
+func TestAuthHandler_ReauthLimit(t *testing.T) {
+	var logins atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := logins.Load()
+		if r.URL.Path == "/v1/auth/test/login" {
+			n = logins.Add(1)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(w, `{"auth": {"client_token": "test-token-%d", "lease_duration": 3600, "renewable": false}}`, n)
+	}))
+	defer server.Close()
+
+	config := api.DefaultConfig()
+	config.Address = server.URL
+	client, err := api.NewClient(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ah := NewAuthHandler(&AuthHandlerConfig{
+		Logger:              logging.NewVaultLogger(hclog.Trace).Named("auth.handler"),
+		Client:              client,
+		EnableEventCh:       true,
+		MaxReauthsPerWindow: 2,
+	})
+	if err := ah.Run(context.Background(), loginTestMethod{}); err == nil {
+		t.Fatal("expected an error without a window")
+	}
+
+	window := 2 * time.Second
+	ah = NewAuthHandler(&AuthHandlerConfig{
+		Logger:              logging.NewVaultLogger(hclog.Trace).Named("auth.handler"),
+		Client:              client,
+		EnableEventCh:       true,
+		MaxReauthsPerWindow: 2,
+		Window:              window,
+	})
+
+	ctx, cancelFunc := context.WithCancel(context.Background())
+	defer cancelFunc()
+
+	errCh := make(chan error)
+	go func() {
+		errCh <- ah.Run(ctx, loginTestMethod{})
+	}()
+	go func() {
+		for range ah.OutputCh {
+		}
+	}()
+
+	waitForEvent := func(eventType AuthEventType) AuthEvent {
+		t.Helper()
+		for {
+			select {
+			case event := <-ah.EventCh:
+				if event.Type == eventType {
+					return event
+				}
+			case err := <-errCh:
+				t.Fatalf("auth handler exited: %v", err)
+			case <-time.After(10 * time.Second):
+				t.Fatalf("timed out waiting for %q event", eventType)
+			}
+		}
+	}
+
+	start := time.Now()
+	waitForEvent(TokenIssued)
+	ah.TriggerReauth("token revoked")
+	waitForEvent(TokenIssued)
+	ah.TriggerReauth("token revoked again")
+	if event := waitForEvent(ReauthRateLimited); event.Error == nil {
+		t.Fatal("expected the event to have an error")
+	}
+	if n := logins.Load(); n != 2 {
+		t.Fatalf("expected 2 logins, got %d", n)
+	}
+	if _, ok := ah.CurrentToken(); !ok {
+		t.Fatal("expected the current token to be kept")
+	}
+
+	waitForEvent(TokenIssued)
+	if elapsed := time.Since(start); elapsed < window {
+		t.Fatalf("expected to re-authenticate once the window allowed it, after %s", elapsed)
+	}
+	if n := logins.Load(); n != 3 {
+		t.Fatalf("expected 3 logins, got %d", n)
+	}
+
+	cancelFunc()
+	if err := <-errCh; err != nil {
+		t.Fatal(err)
+	}
+}
+
+type tokenParametersTestMethod struct {
+	loginTestMethod
+}
+
+func (tokenParametersTestMethod) TokenParameters(overrides *TokenOverrides) map[string]interface{} {
+	return StandardTokenParameters(overrides)
+}
+
+// tokenFileParametersTestMethod authenticates like the token_file method,
+// with a token to look up rather than a login.
+type tokenFileParametersTestMethod struct {
+	tokenParametersTestMethod
+}
+
+func (tokenFileParametersTestMethod) Authenticate(context.Context, *api.Client) (string, http.Header, map[string]interface{}, error) {
+	return "auth/token/lookup-self", nil, map[string]interface{}{"token": "file-token"}, nil
+}
+
+// TestAuthHandler_TokenOverrides tests that TokenOverrides are added to the
+// login request of methods which support token parameters, that a child of
+// the token_file method's token is created with them, and that they're
+// rejected for other methods.
+func TestAuthHandler_TokenOverrides(t *testing.T) {
+	type request struct {
+		path  string
+		token string
+		body  map[string]interface{}
+	}
+	requests := make(chan request, 10)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body map[string]interface{}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			t.Error(err)
+		}
+		requests <- request{path: r.URL.Path, token: r.Header.Get("X-Vault-Token"), body: body}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"auth": {"client_token": "test-token", "lease_duration": 1800, "renewable": false, "policies": ["default"]}}`))
+	}))
+	defer server.Close()
+
+	config := api.DefaultConfig()
+	config.Address = server.URL
+	client, err := api.NewClient(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	renewable := true
+	overrides := &TokenOverrides{
+		TTL:       time.Hour,
+		Policies:  []string{"app"},
+		NumUses:   5,
+		Renewable: &renewable,
+	}
+	params := map[string]interface{}{
+		"ttl":       "1h0m0s",
+		"policies":  []interface{}{"app"},
+		"num_uses":  float64(5),
+		"renewable": true,
+	}
+	for name, tc := range map[string]struct {
+		method   AuthMethod
+		expected request
+	}{
+		"login": {
+			method:   tokenParametersTestMethod{},
+			expected: request{path: "/v1/auth/test/login", body: params},
+		},
+		"token file": {
+			method:   tokenFileParametersTestMethod{},
+			expected: request{path: "/v1/auth/token/create", token: "file-token", body: params},
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			ah := NewAuthHandler(&AuthHandlerConfig{
+				Logger:         logging.NewVaultLogger(hclog.Trace).Named("auth.handler"),
+				Client:         client,
+				TokenOverrides: overrides,
+			})
+
+			ctx, cancelFunc := context.WithCancel(context.Background())
+			defer cancelFunc()
+
+			errCh := make(chan error)
+			go func() {
+				errCh <- ah.Run(ctx, tc.method)
+			}()
+
+			select {
+			case token := <-ah.OutputCh:
+				if token != "test-token" {
+					t.Fatalf("unexpected token %q", token)
+				}
+			case err := <-errCh:
+				t.Fatalf("auth handler exited: %v", err)
+			case <-time.After(10 * time.Second):
+				t.Fatal("timed out waiting for token")
+			}
+			if req := <-requests; !reflect.DeepEqual(req, tc.expected) {
+				t.Fatalf("expected request %v, got %v", tc.expected, req)
+			}
+
+			cancelFunc()
+			for range ah.OutputCh {
+			}
+			if err := <-errCh; err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+
+	ah := NewAuthHandler(&AuthHandlerConfig{
+		Logger:         logging.NewVaultLogger(hclog.Trace).Named("auth.handler"),
+		Client:         client,
+		TokenOverrides: overrides,
+	})
+	if err := ah.Run(context.Background(), loginTestMethod{}); err == nil || !strings.Contains(err.Error(), "token parameters") {
+		t.Fatalf("expected error for a method without token parameters, got %v", err)
+	}
+
+	ah = NewAuthHandler(&AuthHandlerConfig{
+		Logger:         logging.NewVaultLogger(hclog.Trace).Named("auth.handler"),
+		Client:         client,
+		TokenOverrides: &TokenOverrides{NumUses: -1},
+	})
+	if err := ah.Run(context.Background(), tokenParametersTestMethod{}); err == nil || !strings.Contains(err.Error(), "num_uses") {
+		t.Fatalf("expected num_uses error, got %v", err)
+	}
+}
+
+// TestAuthHandler_NonExpiringToken tests that a token without a lease
+// duration isn't renewed, nor treated as expired, which would have the
+// handler re-authenticate over and over.
+func TestAuthHandler_NonExpiringToken(t *testing.T) {
+	var logins atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		logins.Add(1)
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"auth": {"client_token": "test-token", "policies": ["default"]}}`))
+	}))
+	defer server.Close()
+
+	config := api.DefaultConfig()
+	config.Address = server.URL
+	client, err := api.NewClient(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ah := NewAuthHandler(&AuthHandlerConfig{
+		Logger:        logging.NewVaultLogger(hclog.Trace).Named("auth.handler"),
+		Client:        client,
+		MinBackoff:    10 * time.Millisecond,
+		EnableEventCh: true,
+	})
+
+	ctx, cancelFunc := context.WithCancel(context.Background())
+	defer cancelFunc()
+
+	errCh := make(chan error)
+	go func() {
+		errCh <- ah.Run(ctx, loginTestMethod{})
+	}()
+	go func() {
+		for range ah.OutputCh {
+		}
+	}()
+
+	for _, expected := range []AuthEventType{TokenIssued, TokenNonExpiring} {
+		select {
+		case event := <-ah.EventCh:
+			if event.Type != expected {
+				t.Fatalf("expected %q event, got %+v", expected, event)
+			}
+		case err := <-errCh:
+			t.Fatalf("auth handler exited: %v", err)
+		case <-time.After(10 * time.Second):
+			t.Fatalf("timed out waiting for %q event", expected)
+		}
+	}
+
+	select {
+	case event := <-ah.EventCh:
+		t.Fatalf("expected no more events, got %+v", event)
+	case <-time.After(500 * time.Millisecond):
+	}
+	if n := logins.Load(); n != 1 {
+		t.Fatalf("expected 1 login, got %d", n)
+	}
+	if token, ok := ah.CurrentToken(); !ok || token != "test-token" {
+		t.Fatalf("expected current token, got %q", token)
+	}
+
+	cancelFunc()
+	if err := <-errCh; err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestAuthHandler_ErrorClassifier tests that the ErrorClassifier decides
+// whether a failed authentication is retried or stops the handler.
+func TestAuthHandler_ErrorClassifier(t *testing.T) {
+	var logins atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch logins.Add(1) {
+		case 1:
+			w.WriteHeader(http.StatusTooManyRequests)
+			w.Write([]byte(`{"errors": ["rate limited"]}`))
+		case 2:
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"errors": ["invalid role"]}`))
+		default:
+			w.Write([]byte(`{"auth": {"client_token": "test-token", "lease_duration": 3600, "renewable": false}}`))
+		}
+	}))
+	defer server.Close()
+
+	config := api.DefaultConfig()
+	config.Address = server.URL
+	client, err := api.NewClient(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var classified []int
+	ah := NewAuthHandler(&AuthHandlerConfig{
+		Logger: logging.NewVaultLogger(hclog.Trace).Named("auth.handler"),
+		Client: client,
+		// The retry waits for the min backoff, rather than an hour
+		MinBackoff: 10 * time.Millisecond,
+		MaxBackoff: time.Hour,
+		ErrorClassifier: func(err error) ErrorAction {
+			var respErr *api.ResponseError
+			if !errors.As(err, &respErr) {
+				return ErrorActionBackoff
+			}
+			classified = append(classified, respErr.StatusCode)
+			if respErr.StatusCode == http.StatusTooManyRequests {
+				return ErrorActionRetry
+			}
+			return ErrorActionExit
+		},
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	err = ah.Run(ctx, loginTestMethod{})
+	var respErr *api.ResponseError
+	if !errors.As(err, &respErr) || respErr.StatusCode != http.StatusBadRequest {
+		t.Fatalf("expected the handler to exit with the bad request, got %v", err)
+	}
+	if len(classified) != 2 || classified[0] != http.StatusTooManyRequests || classified[1] != http.StatusBadRequest {
+		t.Fatalf("unexpected classified errors: %v", classified)
+	}
+	if n := logins.Load(); n != 2 {
+		t.Fatalf("expected 2 logins, got %d", n)
+	}
+}
@@ -0,0 +1,234 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: BUSL-1.1
+
+// Package authtest provides a fake auto-auth method, for testing code built on
+// the auth handler without a Vault server to authenticate against.
+package authtest
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/vault/api"
+	"github.com/hashicorp/vault/command/agentproxyshared/auth"
+)
+
+// LoginPath is the path the fake method logs in with.
+const LoginPath = "auth/authtest/login"
+
+// DefaultTTL is the TTL of the tokens returned by a Method whose TTL isn't set.
+const DefaultTTL = time.Hour
+
+// ErrNoResults is returned by Authenticate if a Method was created with no
+// tokens or errors to return.
+var ErrNoResults = errors.New("no scripted tokens or errors")
+
+var _ auth.AuthMethodWithClient = (*Method)(nil)
+
+type result struct {
+	token string
+	err   error
+}
+
+// Method is a fake auth.AuthMethod, which returns a scripted sequence of
+// tokens and errors from successive logins. Once the sequence is exhausted,
+// its last entry is repeated.
+//
+// The login requests are answered by the client returned from AuthClient,
+// rather than sent to Vault, so the tokens can't be used for anything else.
+// They aren't renewable, so the auth handler re-authenticates once they
+// reach their TTL.
+type Method struct {
+	// TTL is the TTL of the returned tokens, in whole seconds, which defaults
+	// to DefaultTTL. It must be set before the method is used.
+	TTL time.Duration
+
+	l             sync.Mutex
+	results       []result
+	next          int
+	calls         int
+	credSuccesses int
+	shutdown      bool
+	newCreds      chan struct{}
+}
+
+// WithTokens returns a Method whose logins return the given tokens, in order.
+func WithTokens(tokens ...string) *Method {
+	return (&Method{newCreds: make(chan struct{}, 1)}).ThenTokens(tokens...)
+}
+
+// WithErrors returns a Method whose logins fail with the given errors, in
+// order.
+func WithErrors(errs ...error) *Method {
+	return (&Method{newCreds: make(chan struct{}, 1)}).ThenErrors(errs...)
+}
+
+// ThenTokens appends tokens to the sequence returned by the method, e.g. for a
+// login to succeed after the errors given to WithErrors.
+func (m *Method) ThenTokens(tokens ...string) *Method {
+	m.l.Lock()
+	defer m.l.Unlock()
+	for _, token := range tokens {
+		m.results = append(m.results, result{token: token})
+	}
+	return m
+}
+
+// ThenErrors appends errors to the sequence returned by the method.
+func (m *Method) ThenErrors(errs ...error) *Method {
+	m.l.Lock()
+	defer m.l.Unlock()
+	for _, err := range errs {
+		m.results = append(m.results, result{err: err})
+	}
+	return m
+}
+
+// Calls returns the number of times Authenticate has been called.
+func (m *Method) Calls() int {
+	m.l.Lock()
+	defer m.l.Unlock()
+	return m.calls
+}
+
+// CredSuccesses returns the number of times CredSuccess has been called,
+// i.e. the number of tokens the auth handler has accepted.
+func (m *Method) CredSuccesses() int {
+	m.l.Lock()
+	defer m.l.Unlock()
+	return m.credSuccesses
+}
+
+// IsShutdown returns whether Shutdown has been called.
+func (m *Method) IsShutdown() bool {
+	m.l.Lock()
+	defer m.l.Unlock()
+	return m.shutdown
+}
+
+// TriggerNewCreds signals that the method has new credentials, which makes
+// the auth handler re-authenticate if it has enable_reauth_on_new_credentials
+// set.
+func (m *Method) TriggerNewCreds() {
+	select {
+	case m.newCreds <- struct{}{}:
+	default:
+	}
+}
+
+func (m *Method) Authenticate(_ context.Context, _ *api.Client) (string, http.Header, map[string]interface{}, error) {
+	m.l.Lock()
+	defer m.l.Unlock()
+
+	m.calls++
+	if len(m.results) == 0 {
+		return "", nil, nil, ErrNoResults
+	}
+	r := m.results[m.next]
+	if m.next < len(m.results)-1 {
+		m.next++
+	}
+	if r.err != nil {
+		return "", nil, nil, r.err
+	}
+	return LoginPath, nil, map[string]interface{}{
+		"token": r.token,
+	}, nil
+}
+
+// AuthClient returns a copy of client whose requests are answered by the
+// method: logins succeed with the token they were made with, and all other
+// requests fail.
+func (m *Method) AuthClient(client *api.Client) (*api.Client, error) {
+	config := client.CloneConfig()
+	config.HttpClient.Transport = roundTripper{ttl: m.ttl()}
+
+	authClient, err := api.NewClient(config)
+	if err != nil {
+		return nil, err
+	}
+	authClient.SetHeaders(client.Headers())
+	authClient.SetToken(client.Token())
+	return authClient, nil
+}
+
+func (m *Method) NewCreds() chan struct{} {
+	return m.newCreds
+}
+
+func (m *Method) CredSuccess() {
+	m.l.Lock()
+	defer m.l.Unlock()
+	m.credSuccesses++
+}
+
+func (m *Method) Shutdown() {
+	m.l.Lock()
+	defer m.l.Unlock()
+	m.shutdown = true
+}
+
+func (m *Method) ttl() time.Duration {
+	if m.TTL == 0 {
+		return DefaultTTL
+	}
+	return m.TTL
+}
+
+// roundTripper answers the requests made by clients returned from
+// Method.AuthClient.
+type roundTripper struct {
+	ttl time.Duration
+}
+
+func (rt roundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.URL.Path != "/v1/"+LoginPath || (req.Method != http.MethodPut && req.Method != http.MethodPost) {
+		return response(req, http.StatusNotFound, map[string]interface{}{
+			"errors": []string{fmt.Sprintf("unsupported request %s %s", req.Method, req.URL.Path)},
+		}), nil
+	}
+
+	var data struct {
+		Token string `json:"token"`
+	}
+	if req.Body != nil {
+		defer req.Body.Close()
+		if err := json.NewDecoder(req.Body).Decode(&data); err != nil {
+			return response(req, http.StatusBadRequest, map[string]interface{}{
+				"errors": []string{fmt.Sprintf("error decoding login data: %v", err)},
+			}), nil
+		}
+	}
+
+	return response(req, http.StatusOK, map[string]interface{}{
+		"auth": map[string]interface{}{
+			"client_token":   data.Token,
+			"accessor":       data.Token + "-accessor",
+			"policies":       []string{"default"},
+			"lease_duration": int(rt.ttl.Seconds()),
+			"renewable":      false,
+		},
+	}), nil
+}
+
+func response(req *http.Request, status int, body map[string]interface{}) *http.Response {
+	encoded, _ := json.Marshal(body)
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", status, http.StatusText(status)),
+		StatusCode:    status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        http.Header{"Content-Type": []string{"application/json"}},
+		Body:          io.NopCloser(bytes.NewReader(encoded)),
+		ContentLength: int64(len(encoded)),
+		Request:       req,
+	}
+}
@@ -0,0 +1,80 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: BUSL-1.1
+
+package authtest
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/vault/api"
+	"github.com/hashicorp/vault/command/agentproxyshared/auth"
+	"github.com/hashicorp/vault/sdk/helper/logging"
+)
+
+func TestMethod(t *testing.T) {
+	client, err := api.NewClient(api.DefaultConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Fail the first login, and then have each token expire so that the
+	// handler re-authenticates
+	am := WithErrors(errors.New("login failed")).ThenTokens("token-1", "token-2")
+	am.TTL = 2 * time.Second
+
+	ah := auth.NewAuthHandler(&auth.AuthHandlerConfig{
+		Logger:     logging.NewVaultLogger(hclog.Trace).Named("auth.handler"),
+		Client:     client,
+		MinBackoff: 100 * time.Millisecond,
+	})
+
+	ctx, cancelFunc := context.WithCancel(context.Background())
+	defer cancelFunc()
+
+	errCh := make(chan error)
+	go func() {
+		errCh <- ah.Run(ctx, am)
+	}()
+
+	// The last token is repeated once the others have been used
+	for _, expected := range []string{"token-1", "token-2", "token-2"} {
+		select {
+		case token := <-ah.OutputCh:
+			if token != expected {
+				t.Fatalf("expected token %q, got %q", expected, token)
+			}
+		case err := <-errCh:
+			t.Fatalf("auth handler exited: %v", err)
+		case <-time.After(10 * time.Second):
+			t.Fatalf("timed out waiting for %q", expected)
+		}
+	}
+
+	cancelFunc()
+	for range ah.OutputCh {
+	}
+	if err := <-errCh; err != nil {
+		t.Fatal(err)
+	}
+
+	if calls := am.Calls(); calls != 4 {
+		t.Fatalf("expected 4 calls to Authenticate, got %d", calls)
+	}
+	if successes := am.CredSuccesses(); successes != 3 {
+		t.Fatalf("expected 3 calls to CredSuccess, got %d", successes)
+	}
+}
+
+func TestMethod_NoResults(t *testing.T) {
+	am := WithTokens()
+	if _, _, _, err := am.Authenticate(context.Background(), nil); !errors.Is(err, ErrNoResults) {
+		t.Fatalf("expected ErrNoResults, got %v", err)
+	}
+	if calls := am.Calls(); calls != 1 {
+		t.Fatalf("expected 1 call to Authenticate, got %d", calls)
+	}
+}
@@ -22,6 +22,15 @@ import (
 	"golang.org/x/crypto/blake2b"
 )
 
+const (
+	// certReadAttempts is how many times the cert/key files are read before
+	// giving up, if they're being rotated and the pair doesn't yet match.
+	certReadAttempts = 5
+	// certReadRetryInterval is the time between attempts to read the
+	// cert/key files.
+	certReadRetryInterval = 500 * time.Millisecond
+)
+
 type certMethod struct {
 	logger    hclog.Logger
 	mountPath string
@@ -169,8 +178,17 @@ func (c *certMethod) AuthClient(client *api.Client) (*api.Client, error) {
 	clientToAuth := client
 
 	if c.isCertConfigured() {
-		// Return cached client if present
-		if c.client != nil && !c.reload {
+		// The files are read on every authentication, so that certificates
+		// rotated on disk are used for the next login. Reading them before
+		// building the client also ensures we don't pick up a cert/key pair
+		// which is only partially written.
+		hash, err := c.readCert()
+		if err != nil {
+			return nil, err
+		}
+
+		// Return cached client if present and the files haven't changed
+		if c.client != nil && !c.reload && hash == *c.latestHash {
 			return c.client, nil
 		}
 
@@ -192,13 +210,8 @@ func (c *certMethod) AuthClient(client *api.Client) (*api.Client, error) {
 		}
 
 		// set last hash if load it successfully
-		if hash, err := c.hashCert(c.clientCert, c.clientKey, c.caCert); err != nil {
-			return nil, err
-		} else {
-			c.latestHash = &hash
-		}
+		c.latestHash = &hash
 
-		var err error
 		clientToAuth, err = api.NewClient(config)
 		if err != nil {
 			return nil, err
@@ -214,6 +227,32 @@ func (c *certMethod) AuthClient(client *api.Client) (*api.Client, error) {
 	return clientToAuth, nil
 }
 
+// readCert hashes the cert/key and ca files, retrying for a short time if they
+// can't be loaded, e.g. because the cert has been rotated but the new key has
+// not been written yet.
+func (c *certMethod) readCert() (string, error) {
+	var err error
+	for attempt := 1; ; attempt++ {
+		var hash string
+		hash, err = c.hashCert(c.clientCert, c.clientKey, c.caCert)
+		if err == nil {
+			return hash, nil
+		}
+		if attempt == certReadAttempts {
+			break
+		}
+
+		c.logger.Debug("error loading cert/key files, they may be being rotated, retrying", "error", err)
+		select {
+		case <-c.stopCh:
+			return "", err
+		case <-time.After(certReadRetryInterval):
+		}
+	}
+
+	return "", fmt.Errorf("error loading cert/key files: %w", err)
+}
+
 // hashCert returns reads and verifies the given cert/key pair and return the hashing result
 // in string representation. Otherwise, returns an error.
 // As the pair of cert/key and ca cert are optional because they may be configured externally
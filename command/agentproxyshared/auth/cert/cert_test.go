@@ -232,6 +232,77 @@ func TestCertAuthMethod_AuthClient_withCertsReload(t *testing.T) {
 	}
 }
 
+// TestCertAuthMethod_AuthClient_withCertsRotated ensures that a cert/key pair
+// rotated on disk is used for the next login, even if it's only partially
+// written when AuthClient is called.
+func TestCertAuthMethod_AuthClient_withCertsRotated(t *testing.T) {
+	dir := t.TempDir()
+	certPath := filepath.Join(dir, "app.crt")
+	keyPath := filepath.Join(dir, "app.key")
+	if err := copyFile("./test-fixtures/keys/cert.pem", certPath); err != nil {
+		t.Fatal("copy cert file failed", err)
+	}
+	if err := copyFile("./test-fixtures/keys/key.pem", keyPath); err != nil {
+		t.Fatal("copy key file failed", err)
+	}
+
+	config := &auth.AuthConfig{
+		Logger:    hclog.NewNullLogger(),
+		MountPath: "cert-test",
+		Config: map[string]interface{}{
+			"name":        "with-certs-rotated",
+			"client_cert": certPath,
+			"client_key":  keyPath,
+		},
+	}
+
+	method, err := NewCertAuthMethod(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer method.Shutdown()
+
+	client, err := api.NewClient(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	clientToUse, err := method.(auth.AuthMethodWithClient).AuthClient(client)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The files haven't changed, so the cached client is returned
+	cachedClient, err := method.(auth.AuthMethodWithClient).AuthClient(client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cachedClient != clientToUse {
+		t.Fatal("expected AuthClient to return the cached client")
+	}
+
+	// Rotate the cert, but only write the matching key a little later
+	if err := copyFile("./test-fixtures/keys/cert1.pem", certPath); err != nil {
+		t.Fatal("update cert file failed", err)
+	}
+	errCh := make(chan error, 1)
+	go func() {
+		time.Sleep(certReadRetryInterval)
+		errCh <- copyFile("./test-fixtures/keys/key1.pem", keyPath)
+	}()
+
+	rotatedClient, err := method.(auth.AuthMethodWithClient).AuthClient(client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := <-errCh; err != nil {
+		t.Fatal("update key file failed", err)
+	}
+	if rotatedClient == clientToUse {
+		t.Fatal("expected AuthClient to return a new client for the rotated cert")
+	}
+}
+
 // TestCertAuthMethod_hashCert_withEmptyPaths tests hashCert() if it works well with optional options.
 func TestCertAuthMethod_hashCert_withEmptyPaths(t *testing.T) {
 	c := &certMethod{
@@ -0,0 +1,69 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: BUSL-1.1
+
+package auth
+
+import (
+	"context"
+	"time"
+)
+
+// ErrorAction is what the AuthHandler does after an attempt to authenticate
+// fails, as decided by an ErrorClassifier.
+type ErrorAction string
+
+const (
+	// ErrorActionBackoff waits for the handler's exponential backoff before
+	// authenticating again, the same as when there's no ErrorClassifier. With
+	// ExitOnError set, Run returns the error instead once the backoff's
+	// retries are exhausted. It's also taken for any unknown action.
+	ErrorActionBackoff ErrorAction = "backoff"
+	// ErrorActionRetry authenticates again after MinBackoff, without growing
+	// the backoff or counting against its retries, for errors known to clear
+	// quickly.
+	ErrorActionRetry ErrorAction = "retry"
+	// ErrorActionMaxBackoff waits for MaxBackoff before authenticating again,
+	// without growing the backoff or counting against its retries, for errors
+	// such as rate limiting which are only made worse by retrying sooner.
+	ErrorActionMaxBackoff ErrorAction = "max-backoff"
+	// ErrorActionExit stops the handler, with Run returning the error, for
+	// errors which retrying won't fix.
+	ErrorActionExit ErrorAction = "exit"
+)
+
+// ErrorClassifier decides what the AuthHandler does after an attempt to
+// authenticate fails with err, overriding its built-in handling. It's called
+// with the errors of each step of authenticating, such as logging in, looking
+// up a preloaded token or validating a new token, but not with those of
+// renewing a token, which are handled as before. Errors from Vault can be
+// unwrapped to an *api.ResponseError to classify them by their status code.
+type ErrorClassifier func(err error) ErrorAction
+
+// backoffAfterError waits before the next attempt to authenticate after one
+// failed with err, as decided by the ErrorClassifier, returning false if Run
+// should return instead.
+func (ah *AuthHandler) backoffAfterError(ctx context.Context, backoff *autoAuthBackoff, err error) bool {
+	action := ErrorActionBackoff
+	if ah.errorClassifier != nil && err != nil {
+		action = ah.errorClassifier(err)
+	}
+
+	var wait time.Duration
+	switch action {
+	case ErrorActionExit:
+		ah.logger.Error("error classified as fatal, stopping auth handler", "error", err)
+		return false
+	case ErrorActionRetry:
+		wait = ah.minBackoff
+	case ErrorActionMaxBackoff:
+		wait = ah.maxBackoff
+	default:
+		return backoffSleep(ctx, backoff)
+	}
+	ah.logger.Debug("waiting before authenticating again", "action", action, "wait", wait)
+	select {
+	case <-time.After(wait):
+	case <-ctx.Done():
+	}
+	return true
+}
@@ -0,0 +1,300 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: BUSL-1.1
+
+package auth
+
+import (
+	"sync"
+	"time"
+
+	"github.com/hashicorp/vault/api"
+)
+
+// AuthEventType identifies the kind of an AuthEvent.
+type AuthEventType string
+
+const (
+	// TokenNearExpiry is emitted when the current token has less than the
+	// configured ExpiryWarnFraction of its TTL remaining.
+	TokenNearExpiry AuthEventType = "token-near-expiry"
+	// RenewalFailedTransient is emitted when renewing the current token fails
+	// with an error that is likely to be temporary, such as a network error.
+	// Renewal is retried with a backoff of its own until the token expires,
+	// even if the handler is set to exit on errors.
+	RenewalFailedTransient AuthEventType = "renewal-failed-transient"
+	// RenewalFailedPermanent is emitted when renewing the current token fails
+	// with an error that retrying won't fix, such as the token having been
+	// revoked. The handler re-authenticates after backing off, as it does
+	// after a failed authentication, or if it's set to exit on errors,
+	// exits.
+	RenewalFailedPermanent AuthEventType = "renewal-failed-permanent"
+	// TokenMaxTTLReached is emitted when renewing the current token fails
+	// because it has reached its max TTL. This is expected, rather than an
+	// error, and the handler re-authenticates straight away.
+	TokenMaxTTLReached AuthEventType = "token-max-ttl-reached"
+	// TokenIssued is emitted when a new token obtained by authenticating has
+	// been delivered to the sinks, and the templates and exec process if
+	// enabled.
+	TokenIssued AuthEventType = "token-issued"
+	// TokenRenewed is emitted when the current token's lease is renewed, or
+	// authenticating returns the same token as was last sent to the sinks,
+	// e.g. one re-read by the token_file method. Either way, the token is
+	// sent to the sinks and templates again, and the SinkServer and template
+	// Server pass it on to RenewalSinks and OnTokenRenewed, with
+	// hookcontext.Renewed set, rather than writing or rendering it again.
+	// Renewed is always set.
+	TokenRenewed AuthEventType = "token-renewed"
+	// ReauthTriggered is emitted when re-authentication is requested with
+	// TriggerReauth. Reason holds the reason given.
+	ReauthTriggered AuthEventType = "reauth-triggered"
+	// Paused is emitted when the handler is paused, after which it doesn't
+	// re-authenticate until it's resumed.
+	Paused AuthEventType = "paused"
+	// Resumed is emitted when a paused handler is resumed.
+	Resumed AuthEventType = "resumed"
+	// UnexpectedPolicies is emitted when a token obtained by authenticating
+	// has policies beyond the configured ExpectedPolicies. Policies holds
+	// the unexpected policies. The token is still used.
+	UnexpectedPolicies AuthEventType = "unexpected-policies"
+	// ReauthRateLimited is emitted when the handler has authenticated
+	// MaxReauthsPerWindow times within the Window, and holds off
+	// re-authenticating, keeping the current token, until the window allows
+	// another. Error describes the limit and how long it holds off for.
+	ReauthRateLimited AuthEventType = "reauth-rate-limited"
+	// TokenNonExpiring is emitted when a token obtained by authenticating
+	// has no lease duration, such as a root token or one with no TTL, so
+	// isn't renewed. It's informational; the handler keeps the token until
+	// it's asked to re-authenticate.
+	TokenNonExpiring AuthEventType = "token-non-expiring"
+)
+
+// AuthEvent describes a notable occurrence in the lifecycle of the tokens
+// managed by an AuthHandler. Events are delivered on AuthHandler.EventCh when
+// EnableEventCh is set, and kept for AuthHandler.RecentEvents when
+// EventHistorySize is.
+type AuthEvent struct {
+	Type AuthEventType
+	Time time.Time
+	// TTL is the remaining TTL of the token at the time of the event, if
+	// relevant to the event type.
+	TTL time.Duration
+	// Error is the error associated with the event, if any.
+	Error error
+	// Renewed is set on TokenRenewed events, whose token is the same as the
+	// one last delivered, only with an extended lease, so consumers can skip
+	// work that's only needed for a new token, such as registering it.
+	Renewed bool
+	// Reason is the reason given for ReauthTriggered events.
+	Reason string
+	// Policies are the policies not expected on the token, for
+	// UnexpectedPolicies events.
+	Policies []string
+}
+
+// emitEvent records an event in the handler's history, and sends it on
+// EventCh, if either is enabled. Events are dropped from EventCh rather than
+// blocking the auth handler if the consumer is not keeping up, and dropped
+// altogether once Run has returned.
+func (ah *AuthHandler) emitEvent(event AuthEvent) {
+	ah.eventL.Lock()
+	defer ah.eventL.Unlock()
+	ah.emitEventLocked(event)
+}
+
+// emitEventLocked is emitEvent, called with eventL held.
+func (ah *AuthHandler) emitEventLocked(event AuthEvent) {
+	if ah.stopped {
+		return
+	}
+	if event.Time.IsZero() {
+		event.Time = time.Now()
+	}
+	ah.eventHistory.add(event)
+	if !ah.enableEventCh {
+		return
+	}
+
+	select {
+	case ah.EventCh <- event:
+	default:
+		ah.logger.Warn("auth event channel is full, dropping event", "type", event.Type)
+	}
+}
+
+// RecentEvents returns the most recent AuthEvents emitted by the handler,
+// oldest first, up to the configured EventHistorySize. Unlike EventCh, it
+// doesn't need to be consumed, so it suits diagnostics which only need to
+// see what happened lately. It returns nil if EventHistorySize is unset.
+func (ah *AuthHandler) RecentEvents() []AuthEvent {
+	return ah.eventHistory.list()
+}
+
+// eventHistory is a ring buffer holding the most recent AuthEvents. A nil
+// *eventHistory holds nothing.
+type eventHistory struct {
+	l      sync.Mutex
+	events []AuthEvent
+	// next is the index in events that the next event is written to
+	next int
+	full bool
+}
+
+func newEventHistory(size int) *eventHistory {
+	if size <= 0 {
+		return nil
+	}
+	return &eventHistory{events: make([]AuthEvent, size)}
+}
+
+// add adds an event, replacing the oldest if the history is full.
+func (h *eventHistory) add(event AuthEvent) {
+	if h == nil {
+		return
+	}
+	h.l.Lock()
+	defer h.l.Unlock()
+	h.events[h.next] = event
+	h.next = (h.next + 1) % len(h.events)
+	if h.next == 0 {
+		h.full = true
+	}
+}
+
+// list returns a copy of the events, oldest first.
+func (h *eventHistory) list() []AuthEvent {
+	if h == nil {
+		return nil
+	}
+	h.l.Lock()
+	defer h.l.Unlock()
+	if !h.full {
+		return append([]AuthEvent(nil), h.events[:h.next]...)
+	}
+	return append(append([]AuthEvent(nil), h.events[h.next:]...), h.events[:h.next]...)
+}
+
+// expiryWatcher emits a TokenNearExpiry event once the token it watches is
+// within the handler's ExpiryWarnFraction of expiring. It's driven by the
+// LifetimeWatcher watching the token, which runs whether or not the token is
+// being renewed: each renewal received on its RenewCh is passed to renewed,
+// re-arming the warning from the renewed TTL, and once its DoneCh reports the
+// token has reached the end of its life, done emits the warning if it hasn't
+// been already. The warning is emitted at most once for each TTL.
+type expiryWatcher struct {
+	ah       *AuthHandler
+	fraction float64
+
+	l         sync.Mutex
+	timer     *time.Timer
+	expiresAt time.Time
+	warned    bool
+	stopped   bool
+}
+
+// startExpiryWatcher starts an expiryWatcher for a token with the given TTL.
+// It returns nil if expiry warnings are disabled or the token does not expire.
+func (ah *AuthHandler) startExpiryWatcher(ttl time.Duration) *expiryWatcher {
+	if ah.expiryWarnFraction <= 0 || ttl <= 0 {
+		return nil
+	}
+	w := &expiryWatcher{
+		ah:       ah,
+		fraction: ah.expiryWarnFraction,
+	}
+	w.l.Lock()
+	defer w.l.Unlock()
+	w.arm(time.Now(), ttl)
+	return w
+}
+
+// arm schedules the warning for a token with the given TTL as of from. It's
+// called with the lock held.
+func (w *expiryWatcher) arm(from time.Time, ttl time.Duration) {
+	if w.timer != nil {
+		w.timer.Stop()
+	}
+	w.expiresAt = from.Add(ttl)
+	w.warned = false
+	remaining := time.Duration(float64(ttl) * w.fraction)
+	w.timer = time.AfterFunc(time.Until(w.expiresAt.Add(-remaining)), func() {
+		w.warn(remaining)
+	})
+}
+
+// renewed re-arms the warning with the TTL of a renewal received on the
+// LifetimeWatcher's RenewCh. It's a no-op on a nil watcher.
+func (w *expiryWatcher) renewed(renewal *api.RenewOutput) {
+	if w == nil || renewal == nil {
+		return
+	}
+	w.l.Lock()
+	defer w.l.Unlock()
+	if w.stopped {
+		return
+	}
+	ttl := tokenTTL(renewal.Secret)
+	if ttl <= 0 {
+		// The renewal didn't report a TTL, so the current one stands
+		return
+	}
+	renewedAt := renewal.RenewedAt
+	if renewedAt.IsZero() {
+		renewedAt = time.Now()
+	}
+	w.arm(renewedAt, ttl)
+}
+
+// done emits the warning, if it hasn't been already, once the
+// LifetimeWatcher's DoneCh reports that the token can't be renewed any
+// further and is about to expire. It's a no-op on a nil watcher.
+func (w *expiryWatcher) done() {
+	if w == nil {
+		return
+	}
+	w.warn(-1)
+}
+
+// warn emits the TokenNearExpiry event, with remaining as its TTL, or if
+// it's negative, the time left until the token expires, unless it's been
+// emitted for the current TTL or the watcher has been stopped.
+func (w *expiryWatcher) warn(remaining time.Duration) {
+	w.l.Lock()
+	defer w.l.Unlock()
+	if w.warned || w.stopped {
+		return
+	}
+	w.warned = true
+	if remaining < 0 {
+		remaining = max(time.Until(w.expiresAt), 0)
+	}
+	// Emitted with the lock held, so that nothing is emitted once Stop has
+	// returned
+	w.ah.logger.Warn("auth token is nearing expiry", "ttl_remaining", remaining)
+	w.ah.emitEvent(AuthEvent{
+		Type: TokenNearExpiry,
+		TTL:  remaining,
+	})
+}
+
+// Stop stops the watcher, after which it emits nothing. It is safe to call on
+// a nil or already stopped watcher.
+func (w *expiryWatcher) Stop() {
+	if w == nil {
+		return
+	}
+	w.l.Lock()
+	defer w.l.Unlock()
+	w.stopped = true
+	if w.timer != nil {
+		w.timer.Stop()
+	}
+}
+
+// tokenTTL returns the TTL of the token contained in an auth response or
+// renewal, or zero if it has none.
+func tokenTTL(secret *api.Secret) time.Duration {
+	if secret == nil || secret.Auth == nil {
+		return 0
+	}
+	return time.Duration(secret.Auth.LeaseDuration) * time.Second
+}
@@ -0,0 +1,408 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: BUSL-1.1
+
+package oidc
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/go-secure-stdlib/base62"
+	"github.com/hashicorp/vault/api"
+	"github.com/hashicorp/vault/command/agentproxyshared/auth"
+	"github.com/hashicorp/vault/sdk/helper/parseutil"
+)
+
+const (
+	// callbackModeClient has the OIDC provider redirect the browser to a
+	// listener started by the method, as the CLI does.
+	callbackModeClient = "client"
+
+	defaultCallbackHost   = "localhost"
+	defaultCallbackPort   = "8250"
+	defaultCallbackMethod = "http"
+	defaultListenAddress  = "localhost"
+	defaultLoginTimeout   = 2 * time.Minute
+
+	// defaultTokenCacheFile is the file in the user's home directory the
+	// token is cached in, unless token_cache_path is set.
+	defaultTokenCacheFile = ".vault-agent-oidc-token"
+)
+
+// oidcMethod authenticates interactively with the OIDC flow of Vault's
+// jwt/oidc auth method, printing the URL to visit to complete the login. It's
+// intended for running Agent or Proxy on a developer's machine, rather than
+// for machine identities.
+type oidcMethod struct {
+	logger    hclog.Logger
+	mountPath string
+	role      string
+
+	callbackHost   string
+	callbackPort   string
+	callbackMethod string
+	listenAddress  string
+	loginTimeout   time.Duration
+
+	// tokenCachePath is the file the token from the last login is written
+	// to, and read from at startup, so that restarting doesn't need another
+	// login in the browser. Empty if the token isn't cached.
+	tokenCachePath string
+	loggedIn       bool
+
+	// out is where the URL to visit is printed
+	out io.Writer
+}
+
+var _ auth.AuthMethodWithLogin = &oidcMethod{}
+
+// callbackResult is the outcome of the provider redirecting to the callback
+// listener.
+type callbackResult struct {
+	secret *api.Secret
+	err    error
+}
+
+func NewOIDCAuthMethod(conf *auth.AuthConfig) (auth.AuthMethod, error) {
+	if conf == nil {
+		return nil, errors.New("empty config")
+	}
+	if conf.Config == nil {
+		return nil, errors.New("empty config data")
+	}
+
+	o := &oidcMethod{
+		logger:         conf.Logger,
+		mountPath:      conf.MountPath,
+		callbackHost:   defaultCallbackHost,
+		callbackPort:   defaultCallbackPort,
+		callbackMethod: defaultCallbackMethod,
+		listenAddress:  defaultListenAddress,
+		loginTimeout:   defaultLoginTimeout,
+		out:            os.Stderr,
+	}
+
+	roleRaw, ok := conf.Config["role"]
+	if !ok {
+		return nil, errors.New("missing 'role' value")
+	}
+	o.role, ok = roleRaw.(string)
+	if !ok {
+		return nil, errors.New("could not convert 'role' config value to string")
+	}
+	if o.role == "" {
+		return nil, errors.New("'role' value is empty")
+	}
+
+	for key, val := range map[string]*string{
+		"callback_host":   &o.callbackHost,
+		"callback_port":   &o.callbackPort,
+		"callback_method": &o.callbackMethod,
+		"listen_address":  &o.listenAddress,
+	} {
+		raw, ok := conf.Config[key]
+		if !ok {
+			continue
+		}
+		*val, ok = raw.(string)
+		if !ok {
+			return nil, fmt.Errorf("could not convert '%s' config value to string", key)
+		}
+	}
+
+	if mountRaw, ok := conf.Config["mount"]; ok {
+		mount, ok := mountRaw.(string)
+		if !ok {
+			return nil, errors.New("could not convert 'mount' config value to string")
+		}
+		if mount != "" {
+			o.mountPath = "auth/" + mount
+		}
+	}
+	if o.mountPath == "" {
+		return nil, errors.New("no mount path or 'mount' value given")
+	}
+
+	callbackMode := callbackModeClient
+	if modeRaw, ok := conf.Config["callback_mode"]; ok {
+		callbackMode, ok = modeRaw.(string)
+		if !ok {
+			return nil, errors.New("could not convert 'callback_mode' config value to string")
+		}
+	}
+	switch callbackMode {
+	case callbackModeClient:
+	case "device", "direct":
+		return nil, fmt.Errorf("'callback_mode' %q is not supported by Vault's OIDC auth method, only %q is", callbackMode, callbackModeClient)
+	default:
+		return nil, fmt.Errorf("unknown 'callback_mode' %q", callbackMode)
+	}
+
+	if timeoutRaw, ok := conf.Config["login_timeout"]; ok {
+		timeout, err := parseutil.ParseDurationSecond(timeoutRaw)
+		if err != nil {
+			return nil, fmt.Errorf("error parsing 'login_timeout' value: %w", err)
+		}
+		o.loginTimeout = timeout
+	}
+
+	if cachePathRaw, ok := conf.Config["token_cache_path"]; ok {
+		o.tokenCachePath, ok = cachePathRaw.(string)
+		if !ok {
+			return nil, errors.New("could not convert 'token_cache_path' config value to string")
+		}
+	} else if home, err := os.UserHomeDir(); err == nil {
+		o.tokenCachePath = filepath.Join(home, defaultTokenCacheFile)
+	}
+
+	return o, nil
+}
+
+// Authenticate returns an error, as the login is completed by Login, which
+// the auth handler calls instead.
+func (o *oidcMethod) Authenticate(context.Context, *api.Client) (string, http.Header, map[string]interface{}, error) {
+	return "", nil, nil, errors.New("the oidc method completes the login itself, with Login")
+}
+
+// Login returns the response to the OIDC login, waiting for it to be completed
+// in the browser. At startup, the cached token is used instead if Vault still
+// accepts it. Later logins always use the browser, as the handler only logs
+// in again once its token can no longer be used.
+func (o *oidcMethod) Login(ctx context.Context, client *api.Client) (*api.Secret, error) {
+	if !o.loggedIn {
+		o.loggedIn = true
+		if secret := o.cachedLogin(ctx, client); secret != nil {
+			o.logger.Info("using cached token", "path", o.tokenCachePath)
+			return secret, nil
+		}
+	}
+
+	secret, err := o.login(ctx, client)
+	if err != nil {
+		return nil, err
+	}
+	// A wrapped token can't be used again, so isn't cached
+	if secret.WrapInfo == nil {
+		if err := o.cacheToken(secret.Auth.ClientToken); err != nil {
+			o.logger.Warn("error caching token", "path", o.tokenCachePath, "error", err)
+		}
+	}
+	return secret, nil
+}
+
+// login runs the OIDC flow, waiting for the login to be completed in the
+// browser, and returns Vault's response to it.
+func (o *oidcMethod) login(ctx context.Context, client *api.Client) (*api.Secret, error) {
+	o.logger.Trace("beginning authentication")
+
+	clientNonce, err := base62.Random(20)
+	if err != nil {
+		return nil, fmt.Errorf("error generating client nonce: %w", err)
+	}
+
+	listener, err := net.Listen("tcp", net.JoinHostPort(o.listenAddress, o.callbackPort))
+	if err != nil {
+		return nil, fmt.Errorf("error starting callback listener: %w", err)
+	}
+	defer listener.Close()
+
+	// Only the login itself is wrapped, if the handler wraps tokens, so the
+	// auth URL is fetched with a client which doesn't wrap responses
+	urlClient, err := client.CloneWithHeaders()
+	if err != nil {
+		return nil, fmt.Errorf("error cloning client: %w", err)
+	}
+	redirectURI := fmt.Sprintf("%s://%s/oidc/callback", o.callbackMethod, net.JoinHostPort(o.callbackHost, o.callbackPort))
+	secret, err := urlClient.Logical().WriteWithContext(ctx, o.mountPath+"/oidc/auth_url", map[string]interface{}{
+		"role":         o.role,
+		"redirect_uri": redirectURI,
+		"client_nonce": clientNonce,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error fetching OIDC auth URL: %w", err)
+	}
+	var authURL string
+	if secret != nil {
+		authURL, _ = secret.Data["auth_url"].(string)
+	}
+	if authURL == "" {
+		return nil, fmt.Errorf("unable to authorize role %q with redirect_uri %q", o.role, redirectURI)
+	}
+	parsedURL, err := url.Parse(authURL)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing OIDC auth URL: %w", err)
+	}
+	state := parsedURL.Query().Get("state")
+	if state == "" {
+		return nil, errors.New("OIDC auth URL has no state")
+	}
+
+	loginCtx, cancel := context.WithTimeout(ctx, o.loginTimeout)
+	defer cancel()
+
+	doneCh := make(chan callbackResult, 1)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/oidc/callback", o.callbackHandler(loginCtx, client, state, clientNonce, doneCh))
+	server := &http.Server{Handler: mux}
+	go server.Serve(listener)
+	defer server.Close()
+
+	o.logger.Info("waiting for OIDC login to be completed", "url", authURL)
+	fmt.Fprintf(o.out, "Complete the login via your OIDC provider. Open the following link in your browser:\n\n    %s\n\n", authURL)
+
+	var result callbackResult
+	select {
+	case result = <-doneCh:
+	case <-loginCtx.Done():
+		return nil, fmt.Errorf("timed out waiting for OIDC login: %w", loginCtx.Err())
+	}
+	if result.err != nil {
+		return nil, fmt.Errorf("error completing OIDC login: %w", result.err)
+	}
+	if result.secret == nil || (result.secret.WrapInfo == nil && (result.secret.Auth == nil || result.secret.Auth.ClientToken == "")) {
+		return nil, errors.New("OIDC login returned no token")
+	}
+	return result.secret, nil
+}
+
+// callbackHandler completes the login with the state and code the provider
+// redirects the browser with, sending the result to doneCh. Redirects with a
+// state other than the login's are rejected without completing it, so that
+// only the provider's redirect is used.
+func (o *oidcMethod) callbackHandler(ctx context.Context, client *api.Client, state, clientNonce string, doneCh chan<- callbackResult) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		if req.FormValue("state") != state {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintln(w, "Vault login failed: invalid state")
+			return
+		}
+
+		path := o.mountPath + "/oidc/callback"
+		data := map[string][]string{
+			"state":        {state},
+			"code":         {req.FormValue("code")},
+			"client_nonce": {clientNonce},
+		}
+
+		var result callbackResult
+		defer func() {
+			if result.err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				fmt.Fprintf(w, "Vault login failed: %s\n", result.err)
+			} else {
+				fmt.Fprintln(w, "Vault login successful. You can close this window.")
+			}
+			select {
+			case doneCh <- result:
+			default:
+			}
+		}()
+
+		// With the form_post response mode, the id_token is first posted to
+		// Vault, and the login is then completed as for a redirect
+		if req.Method == http.MethodPost {
+			body, err := json.Marshal(map[string]string{
+				"state":        state,
+				"code":         req.FormValue("code"),
+				"id_token":     req.FormValue("id_token"),
+				"client_nonce": clientNonce,
+			})
+			if err != nil {
+				result.err = err
+				return
+			}
+			resp, err := client.Logical().WriteRawWithContext(ctx, path, body)
+			if resp != nil {
+				resp.Body.Close()
+			}
+			if err != nil {
+				result.err = err
+				return
+			}
+		}
+
+		result.secret, result.err = client.Logical().ReadWithDataWithContext(ctx, path, data)
+	}
+}
+
+// cachedLogin returns a login response for the cached token, or nil if there
+// isn't one, or Vault doesn't accept it.
+func (o *oidcMethod) cachedLogin(ctx context.Context, client *api.Client) *api.Secret {
+	// A wrapped token is wanted, which the cached one can't be given as
+	if o.tokenCachePath == "" || client.CurrentWrappingLookupFunc() != nil {
+		return nil
+	}
+	token, err := os.ReadFile(o.tokenCachePath)
+	if err != nil || len(bytes.TrimSpace(token)) == 0 {
+		return nil
+	}
+
+	lookupClient, err := client.CloneWithHeaders()
+	if err != nil {
+		return nil
+	}
+	lookupClient.SetToken(string(bytes.TrimSpace(token)))
+	secret, err := lookupClient.Auth().Token().LookupSelfWithContext(ctx)
+	if err != nil || secret == nil {
+		o.logger.Debug("cached token can't be used", "error", err)
+		return nil
+	}
+
+	id, _ := secret.TokenID()
+	accessor, _ := secret.TokenAccessor()
+	policies, _ := secret.TokenPolicies()
+	ttl, _ := secret.TokenTTL()
+	renewable, _ := secret.TokenIsRenewable()
+	return &api.Secret{
+		Auth: &api.SecretAuth{
+			ClientToken:   id,
+			Accessor:      accessor,
+			Policies:      policies,
+			LeaseDuration: int(ttl.Seconds()),
+			Renewable:     renewable,
+		},
+	}
+}
+
+// cacheToken writes token to the token cache file, replacing it atomically.
+func (o *oidcMethod) cacheToken(token string) error {
+	if o.tokenCachePath == "" {
+		return nil
+	}
+	f, err := os.CreateTemp(filepath.Dir(o.tokenCachePath), filepath.Base(o.tokenCachePath)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	// CreateTemp creates the file readable only by its owner
+	if _, err := f.WriteString(token); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), o.tokenCachePath)
+}
+
+func (o *oidcMethod) NewCreds() chan struct{} {
+	return nil
+}
+
+func (o *oidcMethod) CredSuccess() {
+}
+
+func (o *oidcMethod) Shutdown() {
+}
@@ -0,0 +1,296 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: BUSL-1.1
+
+package oidc
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/vault/api"
+	"github.com/hashicorp/vault/command/agentproxyshared/auth"
+)
+
+// syncBuffer is a bytes.Buffer safe to read while it's written to.
+type syncBuffer struct {
+	l sync.Mutex
+	b bytes.Buffer
+}
+
+func (s *syncBuffer) Write(p []byte) (int, error) {
+	s.l.Lock()
+	defer s.l.Unlock()
+	return s.b.Write(p)
+}
+
+func (s *syncBuffer) String() string {
+	s.l.Lock()
+	defer s.l.Unlock()
+	return s.b.String()
+}
+
+// freePort returns a port which was free when it was checked.
+func freePort(t *testing.T) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	_, port, err := net.SplitHostPort(ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return port
+}
+
+func TestNewOIDCAuthMethod(t *testing.T) {
+	for name, tc := range map[string]struct {
+		mountPath string
+		config    map[string]interface{}
+		expected  string
+		err       bool
+	}{
+		"mount path":    {mountPath: "auth/oidc", config: map[string]interface{}{"role": "dev"}, expected: "auth/oidc"},
+		"mount":         {mountPath: "auth/oidc", config: map[string]interface{}{"role": "dev", "mount": "sso"}, expected: "auth/sso"},
+		"client mode":   {mountPath: "auth/oidc", config: map[string]interface{}{"role": "dev", "callback_mode": "client"}, expected: "auth/oidc"},
+		"no role":       {mountPath: "auth/oidc", config: map[string]interface{}{}, err: true},
+		"no mount":      {config: map[string]interface{}{"role": "dev"}, err: true},
+		"device mode":   {mountPath: "auth/oidc", config: map[string]interface{}{"role": "dev", "callback_mode": "device"}, err: true},
+		"unknown mode":  {mountPath: "auth/oidc", config: map[string]interface{}{"role": "dev", "callback_mode": "other"}, err: true},
+		"bad timeout":   {mountPath: "auth/oidc", config: map[string]interface{}{"role": "dev", "login_timeout": "soon"}, err: true},
+		"bad port type": {mountPath: "auth/oidc", config: map[string]interface{}{"role": "dev", "callback_port": 8250}, err: true},
+	} {
+		t.Run(name, func(t *testing.T) {
+			am, err := NewOIDCAuthMethod(&auth.AuthConfig{
+				Logger:    hclog.NewNullLogger(),
+				MountPath: tc.mountPath,
+				Config:    tc.config,
+			})
+			if tc.err {
+				if err == nil {
+					t.Fatal("expected error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if mountPath := am.(*oidcMethod).mountPath; mountPath != tc.expected {
+				t.Fatalf("expected mount path %q, got %q", tc.expected, mountPath)
+			}
+		})
+	}
+}
+
+// TestOIDCAuthenticate tests that Authenticate prints the auth URL, and once
+// the provider redirects to the callback, completes the login and returns the
+// token to be looked up.
+// TestOIDCLogin tests that Login completes the login with the provider's
+// redirect, ignoring redirects with another state, returns Vault's login
+// response, and caches its token for the next startup.
+func TestOIDCLogin(t *testing.T) {
+	var (
+		l           sync.Mutex
+		clientNonce string
+		lookups     int
+	)
+	vault := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch r.URL.Path {
+		case "/v1/auth/oidc/oidc/auth_url":
+			var data map[string]string
+			if err := json.NewDecoder(r.Body).Decode(&data); err != nil || data["role"] != "dev" {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			l.Lock()
+			clientNonce = data["client_nonce"]
+			l.Unlock()
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"data": map[string]interface{}{
+					// Stands in for the provider, which would redirect here
+					"auth_url": data["redirect_uri"] + "?state=st&code=cd",
+				},
+			})
+		case "/v1/auth/oidc/oidc/callback":
+			q := r.URL.Query()
+			l.Lock()
+			valid := q.Get("state") == "st" && q.Get("code") == "cd" && q.Get("client_nonce") == clientNonce
+			l.Unlock()
+			if !valid {
+				w.WriteHeader(http.StatusBadRequest)
+				w.Write([]byte(`{"errors":["invalid state"]}`))
+				return
+			}
+			w.Write([]byte(`{"auth": {"client_token": "oidc-token", "policies": ["dev"], "lease_duration": 3600, "renewable": true}}`))
+		case "/v1/auth/token/lookup-self":
+			l.Lock()
+			lookups++
+			l.Unlock()
+			if r.Header.Get("X-Vault-Token") != "oidc-token" {
+				w.WriteHeader(http.StatusForbidden)
+				w.Write([]byte(`{"errors":["permission denied"]}`))
+				return
+			}
+			w.Write([]byte(`{"data": {"id": "oidc-token", "policies": ["dev"], "ttl": 1800, "renewable": true}}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer vault.Close()
+
+	client, err := api.NewClient(&api.Config{Address: vault.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cachePath := filepath.Join(t.TempDir(), "oidc-token")
+	newMethod := func() *oidcMethod {
+		am, err := NewOIDCAuthMethod(&auth.AuthConfig{
+			Logger:    hclog.NewNullLogger(),
+			MountPath: "auth/oidc",
+			Config: map[string]interface{}{
+				"role":             "dev",
+				"callback_host":    "127.0.0.1",
+				"listen_address":   "127.0.0.1",
+				"callback_port":    freePort(t),
+				"login_timeout":    "10s",
+				"token_cache_path": cachePath,
+			},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return am.(*oidcMethod)
+	}
+
+	am := newMethod()
+	out := &syncBuffer{}
+	am.out = out
+
+	// Act as the browser, visiting the printed URL after a stray request to
+	// the callback, which mustn't complete the login
+	go func() {
+		for i := 0; i < 100; i++ {
+			for _, field := range strings.Fields(out.String()) {
+				if !strings.HasPrefix(field, "http://") {
+					continue
+				}
+				stray, err := http.Get(strings.Replace(field, "state=st", "state=other", 1))
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				stray.Body.Close()
+				if stray.StatusCode != http.StatusBadRequest {
+					t.Errorf("expected the stray request to be rejected, got status %d", stray.StatusCode)
+				}
+
+				resp, err := http.Get(field)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				resp.Body.Close()
+				return
+			}
+			time.Sleep(50 * time.Millisecond)
+		}
+		t.Error("no URL printed")
+	}()
+
+	secret, err := am.Login(context.Background(), client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if secret.Auth == nil || secret.Auth.ClientToken != "oidc-token" || secret.Auth.LeaseDuration != 3600 {
+		t.Fatalf("expected the login response, got %#v", secret.Auth)
+	}
+	l.Lock()
+	if lookups != 0 {
+		t.Fatalf("expected no token lookups, got %d", lookups)
+	}
+	l.Unlock()
+	cached, err := os.ReadFile(cachePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(cached) != "oidc-token" {
+		t.Fatalf("expected the token to be cached, got %q", cached)
+	}
+
+	// After a restart, the cached token is used without a login
+	am = newMethod()
+	am.out = &syncBuffer{}
+	secret, err = am.Login(context.Background(), client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if secret.Auth == nil || secret.Auth.ClientToken != "oidc-token" || secret.Auth.LeaseDuration != 1800 || !secret.Auth.Renewable {
+		t.Fatalf("expected the cached token, got %#v", secret.Auth)
+	}
+	l.Lock()
+	if lookups != 1 {
+		t.Fatalf("expected the cached token to be looked up once, got %d", lookups)
+	}
+	l.Unlock()
+	if printed := am.out.(*syncBuffer).String(); printed != "" {
+		t.Fatalf("expected no login URL to be printed, got %q", printed)
+	}
+
+	if _, _, _, err := am.Authenticate(context.Background(), client); err == nil {
+		t.Fatal("expected Authenticate to return an error")
+	}
+}
+
+// TestOIDCLogin_Timeout tests that Login gives up if the login isn't
+// completed within the login timeout.
+func TestOIDCLogin_Timeout(t *testing.T) {
+	vault := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"data": {"auth_url": "https://provider.example.com/authorize?state=st"}}`))
+	}))
+	defer vault.Close()
+
+	client, err := api.NewClient(&api.Config{Address: vault.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	am, err := NewOIDCAuthMethod(&auth.AuthConfig{
+		Logger:    hclog.NewNullLogger(),
+		MountPath: "auth/oidc",
+		Config: map[string]interface{}{
+			"role":             "dev",
+			"callback_host":    "127.0.0.1",
+			"listen_address":   "127.0.0.1",
+			"callback_port":    freePort(t),
+			"login_timeout":    "100ms",
+			"token_cache_path": "",
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := &syncBuffer{}
+	am.(*oidcMethod).out = out
+
+	if _, err := am.(*oidcMethod).Login(context.Background(), client); err == nil {
+		t.Fatal("expected error")
+	}
+	if !strings.Contains(out.String(), "https://provider.example.com/authorize") {
+		t.Fatalf("expected the auth URL to be printed, got %q", out.String())
+	}
+}
@@ -0,0 +1,93 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: BUSL-1.1
+
+package auth
+
+import (
+	"context"
+	"sync"
+)
+
+// pauseState tracks whether an AuthHandler is paused. changed is closed, and
+// replaced, each time the handler is paused or resumed, so that the Run loop
+// can wait for either.
+type pauseState struct {
+	l       sync.Mutex
+	paused  bool
+	changed chan struct{}
+}
+
+// set updates the state, returning false if it was already as requested.
+func (p *pauseState) set(paused bool) bool {
+	p.l.Lock()
+	defer p.l.Unlock()
+	if p.paused == paused {
+		return false
+	}
+	p.paused = paused
+	if p.changed != nil {
+		close(p.changed)
+		p.changed = nil
+	}
+	return true
+}
+
+// get returns whether the handler is paused, and a channel which is closed
+// when that changes.
+func (p *pauseState) get() (bool, <-chan struct{}) {
+	p.l.Lock()
+	defer p.l.Unlock()
+	if p.changed == nil {
+		p.changed = make(chan struct{})
+	}
+	return p.paused, p.changed
+}
+
+// Pause stops the handler from re-authenticating, e.g. during maintenance of
+// the auth method's backend, until Resume is called. The current token is
+// kept, and nothing new is sent to the sinks, templates or exec process. If a
+// re-authentication is triggered while paused, because the token expired,
+// was found to be invalid, or the method has new credentials, it happens once
+// the handler is resumed. Unless RenewWhilePaused is set, the token isn't
+// renewed while paused either. A Paused event is emitted.
+func (ah *AuthHandler) Pause() {
+	if !ah.pause.set(true) {
+		return
+	}
+	ah.logger.Info("auth handler paused")
+	ah.emitEvent(AuthEvent{Type: Paused})
+}
+
+// Resume undoes Pause, re-authenticating straight away if that was triggered
+// while paused, and otherwise resuming renewal of the current token. A
+// Resumed event is emitted.
+func (ah *AuthHandler) Resume() {
+	if !ah.pause.set(false) {
+		return
+	}
+	ah.logger.Info("auth handler resumed")
+	ah.emitEvent(AuthEvent{Type: Resumed})
+}
+
+// Paused returns whether the handler is paused.
+func (ah *AuthHandler) Paused() bool {
+	paused, _ := ah.pause.get()
+	return paused
+}
+
+// waitWhilePaused blocks until the handler isn't paused, returning false if
+// ctx is done first.
+func (ah *AuthHandler) waitWhilePaused(ctx context.Context) bool {
+	for {
+		paused, changed := ah.pause.get()
+		if !paused {
+			return true
+		}
+		ah.logger.Info("auth handler is paused, waiting to be resumed before authenticating")
+		select {
+		case <-ctx.Done():
+			return false
+		case <-changed:
+		}
+	}
+}
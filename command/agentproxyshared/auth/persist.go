@@ -0,0 +1,311 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: BUSL-1.1
+
+package auth
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/vault/api"
+)
+
+// persistedTokenMinTTL is the least TTL a persisted token must have left to
+// be used.
+const persistedTokenMinTTL = 30 * time.Second
+
+// persistedTokenAAD is the additional data authenticated with persisted
+// tokens, so that the key can't be used to pass off other data as a token.
+var persistedTokenAAD = []byte("vault-agent-persisted-token")
+
+// ErrNoPersistedToken is returned by TokenStore.Load when no token has been
+// persisted.
+var ErrNoPersistedToken = errors.New("no persisted token")
+
+// KeySource provides the AES-256 key with which a TokenStore encrypts the
+// tokens it persists.
+type KeySource interface {
+	Key() ([]byte, error)
+}
+
+// KeySourceFunc is a KeySource implemented by a function.
+type KeySourceFunc func() ([]byte, error)
+
+func (f KeySourceFunc) Key() ([]byte, error) {
+	return f()
+}
+
+// KeyFromFile returns a KeySource which reads the key, base64 encoded, from
+// the file at path. The file is read each time the key is needed, so it can
+// be rotated, although tokens persisted with the previous key can't then be
+// read.
+func KeyFromFile(path string) KeySource {
+	return KeySourceFunc(func() ([]byte, error) {
+		encoded, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("error reading key file: %w", err)
+		}
+		return decodeKey(string(encoded))
+	})
+}
+
+// KeyFromEnv returns a KeySource which reads the key, base64 encoded, from
+// the environment variable name.
+func KeyFromEnv(name string) KeySource {
+	return KeySourceFunc(func() ([]byte, error) {
+		encoded, ok := os.LookupEnv(name)
+		if !ok {
+			return nil, fmt.Errorf("environment variable %s is not set", name)
+		}
+		return decodeKey(encoded)
+	})
+}
+
+// decodeKey decodes a base64 encoded AES-256 key.
+func decodeKey(encoded string) ([]byte, error) {
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+	if err != nil {
+		return nil, fmt.Errorf("error decoding key: %w", err)
+	}
+	if len(key) != 32 {
+		return nil, fmt.Errorf("key must be 32 bytes, got %d", len(key))
+	}
+	return key, nil
+}
+
+// TokenStore persists the auto-auth token to disk, encrypted, so that if
+// Vault can't be reached when the agent starts, the AuthHandler can deliver
+// the token it last obtained, if it's still valid, until Vault is back. It's
+// unrelated to the persistent cache of the API proxy.
+type TokenStore struct {
+	path string
+	key  KeySource
+}
+
+// persistedToken is the plaintext of a persisted token.
+type persistedToken struct {
+	Token string `json:"token"`
+	// Expiry is when the token expires, or the zero time if it doesn't
+	Expiry time.Time `json:"expiry,omitempty"`
+}
+
+// persistedTokenFile is the contents of the file holding a persisted token.
+type persistedTokenFile struct {
+	Nonce      []byte `json:"nonce"`
+	Ciphertext []byte `json:"ciphertext"`
+}
+
+// NewTokenStore returns a TokenStore which persists the token to the file at
+// path, encrypted with the key from key.
+func NewTokenStore(path string, key KeySource) (*TokenStore, error) {
+	if path == "" {
+		return nil, errors.New("no path provided")
+	}
+	if key == nil {
+		return nil, errors.New("no key source provided")
+	}
+	return &TokenStore{
+		path: path,
+		key:  key,
+	}, nil
+}
+
+// Save persists token, which expires at expiry, or never if it's the zero
+// time, replacing the token persisted before.
+func (s *TokenStore) Save(token string, expiry time.Time) error {
+	gcm, err := s.cipher()
+	if err != nil {
+		return err
+	}
+	plaintext, err := json.Marshal(&persistedToken{
+		Token:  token,
+		Expiry: expiry,
+	})
+	if err != nil {
+		return err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return fmt.Errorf("error generating nonce: %w", err)
+	}
+	contents, err := json.Marshal(&persistedTokenFile{
+		Nonce:      nonce,
+		Ciphertext: gcm.Seal(nil, nonce, plaintext, persistedTokenAAD),
+	})
+	if err != nil {
+		return err
+	}
+
+	tmpFile, err := os.CreateTemp(filepath.Dir(s.path), filepath.Base(s.path)+".tmp.")
+	if err != nil {
+		return fmt.Errorf("error creating temp file: %w", err)
+	}
+	defer os.Remove(tmpFile.Name())
+	if err := tmpFile.Chmod(0o600); err != nil {
+		tmpFile.Close()
+		return fmt.Errorf("error setting permissions of temp file: %w", err)
+	}
+	if _, err := tmpFile.Write(contents); err != nil {
+		tmpFile.Close()
+		return fmt.Errorf("error writing temp file: %w", err)
+	}
+	if err := tmpFile.Close(); err != nil {
+		return fmt.Errorf("error closing temp file: %w", err)
+	}
+	if err := os.Rename(tmpFile.Name(), s.path); err != nil {
+		return fmt.Errorf("error renaming temp file: %w", err)
+	}
+	return nil
+}
+
+// Load returns the persisted token, and when it expires, or the zero time if
+// it doesn't. It returns ErrNoPersistedToken if none has been persisted.
+func (s *TokenStore) Load() (string, time.Time, error) {
+	contents, err := os.ReadFile(s.path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return "", time.Time{}, ErrNoPersistedToken
+	}
+	if err != nil {
+		return "", time.Time{}, err
+	}
+
+	var file persistedTokenFile
+	if err := json.Unmarshal(contents, &file); err != nil {
+		return "", time.Time{}, fmt.Errorf("error parsing persisted token: %w", err)
+	}
+	gcm, err := s.cipher()
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	if len(file.Nonce) != gcm.NonceSize() {
+		return "", time.Time{}, errors.New("invalid persisted token nonce")
+	}
+	plaintext, err := gcm.Open(nil, file.Nonce, file.Ciphertext, persistedTokenAAD)
+	if err != nil {
+		return "", time.Time{}, fmt.Errorf("error decrypting persisted token: %w", err)
+	}
+
+	var persisted persistedToken
+	if err := json.Unmarshal(plaintext, &persisted); err != nil {
+		return "", time.Time{}, fmt.Errorf("error parsing persisted token: %w", err)
+	}
+	if persisted.Token == "" {
+		return "", time.Time{}, ErrNoPersistedToken
+	}
+	return persisted.Token, persisted.Expiry, nil
+}
+
+// cipher returns the AES-GCM cipher with the store's key.
+func (s *TokenStore) cipher() (cipher.AEAD, error) {
+	key, err := s.key.Key()
+	if err != nil {
+		return nil, fmt.Errorf("error getting key: %w", err)
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// persistToken saves a newly delivered or renewed token to the TokenStore, if
+// there is one. Wrapped tokens can only be unwrapped once, so they aren't
+// persisted.
+func (ah *AuthHandler) persistToken(token string, expiry time.Time) {
+	if ah.tokenStore == nil || ah.wrapTTL > 0 {
+		return
+	}
+	if err := ah.tokenStore.Save(token, expiry); err != nil {
+		ah.logger.Warn("error persisting token", "error", err)
+	}
+}
+
+// usePersistedToken delivers the token from the TokenStore, if there is one,
+// so that the sinks and templates have a token while Vault can't be reached
+// at startup. It's only tried once, if authenticating failed with err because
+// Vault can't be reached or is failing, see isOutageError, and nothing has been
+// delivered yet. It's never used if the handler's tokens are only delivered
+// once, with ExitAfterAuth, as it may not be valid. The token must have at
+// least persistedTokenMinTTL left, and is looked up with client first, in
+// case Vault can be reached for that, so that it isn't used if it has been
+// revoked.
+func (ah *AuthHandler) usePersistedToken(ctx context.Context, client *api.Client, err error) {
+	if ah.tokenStore == nil || ah.wrapTTL > 0 || ah.exitAfterAuth || ah.lastDelivered != "" || ah.triedPersistedToken {
+		return
+	}
+	if !isOutageError(err) {
+		return
+	}
+	ah.triedPersistedToken = true
+
+	token, expiry, err := ah.tokenStore.Load()
+	switch {
+	case errors.Is(err, ErrNoPersistedToken):
+		return
+	case err != nil:
+		ah.logger.Warn("error loading persisted token", "error", err)
+		return
+	}
+
+	var ttl time.Duration
+	if !expiry.IsZero() {
+		ttl = time.Until(expiry)
+	}
+
+	lookupClient, err := client.CloneWithHeaders()
+	if err != nil {
+		ah.logger.Warn("error creating client to look up persisted token, not using it", "error", err)
+		return
+	}
+	lookupClient.SetToken(token)
+	secret, err := ah.doAuthRequest(ctx, lookupClient.Auth().Token().LookupSelfWithContext)
+	switch {
+	case err == nil:
+		if lookedUp, err := secret.TokenTTL(); err == nil && lookedUp > 0 {
+			ttl = lookedUp
+		}
+	case isOutageError(err):
+		ah.logger.Debug("couldn't look up persisted token, relying on its persisted expiry", "error", err)
+	default:
+		ah.logger.Info("persisted token is no longer valid, not using it", "error", err)
+		return
+	}
+	if !expiry.IsZero() && ttl < persistedTokenMinTTL {
+		ah.logger.Info("persisted token has expired or is about to, not using it", "ttl", ttl)
+		return
+	}
+
+	ah.logger.Warn("authentication failed, using persisted token until it succeeds", "ttl", ttl)
+	// It wasn't issued by an attempt, so has no trace for the servers to join
+	ah.deliverToken(context.Background(), token, ttl, "")
+}
+
+// isOutageError returns whether err is one returned while Vault can't be
+// reached or is failing, i.e. a transport error, a timeout or a 5xx
+// response, rather than one rejecting the request.
+func isOutageError(err error) bool {
+	if err == nil {
+		return false
+	}
+	var responseErr *api.ResponseError
+	if errors.As(err, &responseErr) {
+		return responseErr.StatusCode >= http.StatusInternalServerError
+	}
+	var urlErr *url.Error
+	var netErr net.Error
+	return errors.As(err, &urlErr) || errors.As(err, &netErr) || errors.Is(err, context.DeadlineExceeded)
+}
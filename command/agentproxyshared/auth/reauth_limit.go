@@ -0,0 +1,80 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: BUSL-1.1
+
+package auth
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// reauthLimiter caps how many times the handler authenticates within a
+// sliding window, as a safety valve against re-authentication storms
+// exhausting token quotas.
+type reauthLimiter struct {
+	max    int
+	window time.Duration
+	// times are those of the authentications within the window, oldest
+	// first
+	times []time.Time
+}
+
+// record counts an authentication at now.
+func (l *reauthLimiter) record(now time.Time) {
+	if l == nil {
+		return
+	}
+	l.expire(now)
+	l.times = append(l.times, now)
+}
+
+// wait returns how long from now until another authentication is allowed, or
+// zero if it's allowed straight away.
+func (l *reauthLimiter) wait(now time.Time) time.Duration {
+	if l == nil {
+		return 0
+	}
+	l.expire(now)
+	if len(l.times) < l.max {
+		return 0
+	}
+	return l.times[len(l.times)-l.max].Add(l.window).Sub(now)
+}
+
+// expire forgets the authentications which have left the window.
+func (l *reauthLimiter) expire(now time.Time) {
+	i := 0
+	for i < len(l.times) && !l.times[i].Add(l.window).After(now) {
+		i++
+	}
+	l.times = l.times[i:]
+}
+
+// waitForReauthLimit blocks while the handler has already authenticated
+// MaxReauthsPerWindow times within the Window, keeping the current token,
+// returning false if ctx is done first. An error is logged and a
+// ReauthRateLimited event emitted when it starts waiting.
+func (ah *AuthHandler) waitForReauthLimit(ctx context.Context) bool {
+	wait := ah.reauthLimiter.wait(time.Now())
+	if wait <= 0 {
+		return true
+	}
+
+	err := fmt.Errorf("re-authenticated %d times within %s, holding off re-authenticating for %s", ah.reauthLimiter.max, ah.reauthLimiter.window, wait.Round(time.Second))
+	ah.logger.Error("re-authentication rate limit reached, keeping the current token", "error", err, "wait", wait)
+	ah.errorFile.Record(errorFileSource, "re-authentication rate limit reached", err)
+	ah.emitEvent(AuthEvent{
+		Type:  ReauthRateLimited,
+		Error: err,
+	})
+
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return false
+	case <-timer.C:
+		return true
+	}
+}
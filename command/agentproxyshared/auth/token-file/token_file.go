@@ -10,10 +10,12 @@ import (
 	"net/http"
 	"os"
 	"strings"
+	"time"
 
 	"github.com/hashicorp/go-hclog"
 	"github.com/hashicorp/vault/api"
 	"github.com/hashicorp/vault/command/agentproxyshared/auth"
+	"github.com/hashicorp/vault/sdk/helper/parseutil"
 )
 
 type tokenFileMethod struct {
@@ -22,8 +24,27 @@ type tokenFileMethod struct {
 
 	cachedToken   string
 	tokenFilePath string
+
+	// rereadOnAuthFailure, if set, makes Rejected read the file once more
+	// when Vault rejects the token, in case it was being rewritten
+	rereadOnAuthFailure bool
+
+	// startupWaitForToken is how long the first Authenticate waits for the
+	// token file to appear and be non-empty, for when it's written by a
+	// provisioner shortly after the agent starts
+	startupWaitForToken time.Duration
+	authenticated       bool
 }
 
+var (
+	_ auth.AuthMethodWithTokenParameters = &tokenFileMethod{}
+	_ auth.AuthMethodWithRejection       = &tokenFileMethod{}
+)
+
+// tokenFilePollInterval is how often the token file is checked while waiting
+// for it at startup.
+const tokenFilePollInterval = 100 * time.Millisecond
+
 func NewTokenFileAuthMethod(conf *auth.AuthConfig) (auth.AuthMethod, error) {
 	if conf == nil {
 		return nil, errors.New("empty config")
@@ -49,30 +70,126 @@ func NewTokenFileAuthMethod(conf *auth.AuthConfig) (auth.AuthMethod, error) {
 		return nil, errors.New("'token_file_path' value is empty")
 	}
 
+	if rereadRaw, ok := conf.Config["reread_on_auth_failure"]; ok {
+		reread, err := parseutil.ParseBool(rereadRaw)
+		if err != nil {
+			return nil, fmt.Errorf("error parsing 'reread_on_auth_failure' value: %w", err)
+		}
+		a.rereadOnAuthFailure = reread
+	}
+
+	if waitRaw, ok := conf.Config["startup_wait_for_token"]; ok {
+		wait, err := parseutil.ParseDurationSecond(waitRaw)
+		if err != nil {
+			return nil, fmt.Errorf("error parsing 'startup_wait_for_token' value: %w", err)
+		}
+		if wait < 0 {
+			return nil, errors.New("'startup_wait_for_token' value must not be negative")
+		}
+		a.startupWaitForToken = wait
+	}
+
 	return a, nil
 }
 
 func (a *tokenFileMethod) Authenticate(ctx context.Context, client *api.Client) (string, http.Header, map[string]interface{}, error) {
+	if !a.authenticated && a.startupWaitForToken > 0 {
+		a.waitForToken(ctx)
+	}
+	if err := a.readToken(); err != nil {
+		return "", nil, nil, err
+	}
+	a.authenticated = true
+
+	// i.e. auth/token/lookup-self
+	return fmt.Sprintf("%s/lookup-self", a.mountPath), nil, map[string]interface{}{
+		"token": a.cachedToken,
+	}, nil
+}
+
+// waitForToken polls until the token file exists and is non-empty, for up to
+// startupWaitForToken, or until ctx is done. If the file still isn't there,
+// the error is left for readToken to return.
+func (a *tokenFileMethod) waitForToken(ctx context.Context) {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	timer := time.NewTimer(a.startupWaitForToken)
+	defer timer.Stop()
+	ticker := time.NewTicker(tokenFilePollInterval)
+	defer ticker.Stop()
+
+	for {
+		if info, err := os.Stat(a.tokenFilePath); err == nil && info.Size() > 0 {
+			return
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-timer.C:
+			a.logger.Warn("token file not available before startup wait elapsed", "path", a.tokenFilePath, "wait", a.startupWaitForToken)
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// readToken reads the token file, falling back to the token last read if the
+// file can't be read or is empty.
+func (a *tokenFileMethod) readToken() error {
 	token, err := os.ReadFile(a.tokenFilePath)
 	if err != nil {
 		if a.cachedToken == "" {
-			return "", nil, nil, fmt.Errorf("error reading token file and no cached token known: %w", err)
+			return fmt.Errorf("error reading token file and no cached token known: %w", err)
 		}
 		a.logger.Warn("error reading token file", "error", err)
 	}
 	if len(token) == 0 {
 		if a.cachedToken == "" {
-			return "", nil, nil, errors.New("token file empty and no cached token known")
+			return errors.New("token file empty and no cached token known")
 		}
 		a.logger.Warn("token file exists but read empty value, re-using cached value")
 	} else {
 		a.cachedToken = strings.TrimSpace(string(token))
 	}
+	return nil
+}
 
-	// i.e. auth/token/lookup-self
-	return fmt.Sprintf("%s/lookup-self", a.mountPath), nil, map[string]interface{}{
-		"token": a.cachedToken,
-	}, nil
+// Rejected re-reads the token file if reread_on_auth_failure is set, and
+// returns whether it now holds a different token, as a provisioner may have
+// been part way through replacing a stale one.
+func (a *tokenFileMethod) Rejected(_ context.Context, err error) bool {
+	if !a.rereadOnAuthFailure {
+		return false
+	}
+	rejected := a.cachedToken
+	if readErr := a.readToken(); readErr != nil {
+		return false
+	}
+	if a.cachedToken == rejected {
+		return false
+	}
+	a.logger.Warn("token from file was rejected, retrying with the token file's new token", "error", err)
+	return true
+}
+
+// TokenParameters returns Vault's standard token creation parameters, as with
+// token overrides, the auth handler uses the token read from the file to
+// create a child token with them, rather than using the token itself.
+func (a *tokenFileMethod) TokenParameters(overrides *auth.TokenOverrides) map[string]interface{} {
+	return auth.StandardTokenParameters(overrides)
+}
+
+// Healthy returns an error if the token file doesn't exist or is empty.
+func (a *tokenFileMethod) Healthy(_ context.Context) error {
+	info, err := os.Stat(a.tokenFilePath)
+	if err != nil {
+		return fmt.Errorf("error reading token file: %w", err)
+	}
+	if info.Size() == 0 {
+		return errors.New("token file is empty")
+	}
+	return nil
 }
 
 func (a *tokenFileMethod) NewCreds() chan struct{} {
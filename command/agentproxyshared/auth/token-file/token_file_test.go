@@ -4,9 +4,12 @@
 package token_file
 
 import (
+	"context"
+	"errors"
 	"os"
 	"path/filepath"
 	"testing"
+	"time"
 
 	log "github.com/hashicorp/go-hclog"
 	"github.com/hashicorp/vault/command/agentproxyshared/auth"
@@ -82,3 +85,161 @@ func TestNewTokenFileAuthenticate(t *testing.T) {
 		t.Fatal("Token file removed")
 	}
 }
+
+// TestTokenFileRereadOnAuthFailure tests that with reread_on_auth_failure set,
+// the file is only re-read once Vault rejects its token, and that the retry
+// is only asked for if the file has a new token.
+func TestTokenFileRereadOnAuthFailure(t *testing.T) {
+	tokenFileName := filepath.Join(t.TempDir(), "token_file")
+	rejected := errors.New("permission denied")
+
+	for _, tc := range []struct {
+		reread  bool
+		replace bool
+		retry   bool
+	}{
+		{reread: false, replace: true, retry: false},
+		{reread: true, replace: false, retry: false},
+		{reread: true, replace: true, retry: true},
+	} {
+		if err := os.WriteFile(tokenFileName, []byte("stale-token"), 0o600); err != nil {
+			t.Fatal(err)
+		}
+
+		am, err := NewTokenFileAuthMethod(&auth.AuthConfig{
+			Logger: logging.NewVaultLogger(log.Trace),
+			Config: map[string]interface{}{
+				"token_file_path":        tokenFileName,
+				"reread_on_auth_failure": tc.reread,
+			},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// No client is needed, as the token isn't looked up up front
+		_, _, data, err := am.Authenticate(context.Background(), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if token := data["token"].(string); token != "stale-token" {
+			t.Fatalf("expected token %q, got %q", "stale-token", token)
+		}
+
+		// The provisioner replaces the token while it's being rejected
+		if tc.replace {
+			if err := os.WriteFile(tokenFileName, []byte("new-token"), 0o600); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if retry := am.(auth.AuthMethodWithRejection).Rejected(context.Background(), rejected); retry != tc.retry {
+			t.Fatalf("reread %t, replace %t: expected retry %t, got %t", tc.reread, tc.replace, tc.retry, retry)
+		}
+		if !tc.retry {
+			continue
+		}
+
+		_, _, data, err = am.Authenticate(context.Background(), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if token := data["token"].(string); token != "new-token" {
+			t.Fatalf("expected token %q, got %q", "new-token", token)
+		}
+	}
+}
+
+func TestNewTokenFileRereadOnAuthFailureInvalid(t *testing.T) {
+	_, err := NewTokenFileAuthMethod(&auth.AuthConfig{
+		Logger: logging.NewVaultLogger(log.Trace),
+		Config: map[string]interface{}{
+			"token_file_path":        "/tmp/token",
+			"reread_on_auth_failure": "sometimes",
+		},
+	})
+	if err == nil {
+		t.Fatal("expected error parsing reread_on_auth_failure")
+	}
+}
+
+// TestTokenFileHealthy tests that the token file method is only healthy when
+// the token file exists and isn't empty.
+func TestTokenFileHealthy(t *testing.T) {
+	tokenFileName := filepath.Join(t.TempDir(), "token_file")
+	am, err := NewTokenFileAuthMethod(&auth.AuthConfig{
+		Logger: logging.NewVaultLogger(log.Trace),
+		Config: map[string]interface{}{
+			"token_file_path": tokenFileName,
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := auth.Healthy(context.Background(), am); err == nil {
+		t.Fatal("expected error for missing token file")
+	}
+
+	if err := os.WriteFile(tokenFileName, nil, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := auth.Healthy(context.Background(), am); err == nil {
+		t.Fatal("expected error for empty token file")
+	}
+
+	if err := os.WriteFile(tokenFileName, []byte("super-secret-token"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := auth.Healthy(context.Background(), am); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestTokenFileStartupWaitForToken tests that the first authentication waits
+// for the token file to be written, and gives up once the wait has elapsed.
+func TestTokenFileStartupWaitForToken(t *testing.T) {
+	tokenFileName := filepath.Join(t.TempDir(), "token_file")
+	newMethod := func(wait string) auth.AuthMethod {
+		am, err := NewTokenFileAuthMethod(&auth.AuthConfig{
+			Logger: logging.NewVaultLogger(log.Trace),
+			Config: map[string]interface{}{
+				"token_file_path":        tokenFileName,
+				"startup_wait_for_token": wait,
+			},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return am
+	}
+
+	start := time.Now()
+	if _, _, _, err := newMethod("200ms").Authenticate(context.Background(), nil); err == nil {
+		t.Fatal("expected error for missing token file")
+	}
+	if elapsed := time.Since(start); elapsed < 200*time.Millisecond {
+		t.Fatalf("expected to wait for the token file, returned after %s", elapsed)
+	}
+
+	go func() {
+		time.Sleep(300 * time.Millisecond)
+		os.WriteFile(tokenFileName, []byte("super-secret-token"), 0o600)
+	}()
+	_, _, data, err := newMethod("10s").Authenticate(context.Background(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data["token"] != "super-secret-token" {
+		t.Fatalf("unexpected token %v", data["token"])
+	}
+
+	if _, err := NewTokenFileAuthMethod(&auth.AuthConfig{
+		Logger: logging.NewVaultLogger(log.Trace),
+		Config: map[string]interface{}{
+			"token_file_path":        tokenFileName,
+			"startup_wait_for_token": "-1s",
+		},
+	}); err == nil {
+		t.Fatal("expected error for a negative startup_wait_for_token")
+	}
+}
@@ -0,0 +1,143 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: BUSL-1.1
+
+package auth
+
+import (
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/vault/api"
+)
+
+// TokenOverrides are parameters of the token created when authenticating,
+// overriding the defaults of the auth method's role. They can only be set
+// for auth methods which implement AuthMethodWithTokenParameters.
+type TokenOverrides struct {
+	// TTL, if set, is the token's TTL. Vault clamps it to the mount's and
+	// role's max TTL, in which case a warning is logged.
+	TTL time.Duration
+	// Policies, if set, are the token's policies. Vault may only grant a
+	// subset of them, in which case a warning is logged.
+	Policies []string
+	// NumUses, if set, is how many times the token can be used.
+	NumUses int
+	// Renewable, if set, is whether the token can be renewed.
+	Renewable *bool
+}
+
+// AuthMethodWithTokenParameters is an extended interface for auth methods
+// whose login accepts parameters of the token it creates, so that the
+// AuthHandlerConfig's TokenOverrides can be applied to it. For the token_file
+// method, which returns auth/token/lookup-self rather than a login path, the
+// parameters are used to create a child of the token read from the file,
+// with auth/token/create.
+type AuthMethodWithTokenParameters interface {
+	AuthMethod
+	// TokenParameters returns the request parameters to add to the data
+	// returned by Authenticate to create the token as set by overrides.
+	// Methods which accept Vault's standard token parameters can return
+	// StandardTokenParameters.
+	TokenParameters(overrides *TokenOverrides) map[string]interface{}
+}
+
+// StandardTokenParameters returns the set overrides as Vault's standard token
+// creation parameters: ttl, policies, num_uses and renewable.
+func StandardTokenParameters(overrides *TokenOverrides) map[string]interface{} {
+	params := make(map[string]interface{})
+	if overrides.TTL > 0 {
+		params["ttl"] = overrides.TTL.String()
+	}
+	if len(overrides.Policies) > 0 {
+		params["policies"] = overrides.Policies
+	}
+	if overrides.NumUses > 0 {
+		params["num_uses"] = overrides.NumUses
+	}
+	if overrides.Renewable != nil {
+		params["renewable"] = *overrides.Renewable
+	}
+	return params
+}
+
+// validate returns an error if any of the overrides can't be a parameter of a
+// token.
+func (o *TokenOverrides) validate() error {
+	if o == nil {
+		return nil
+	}
+	if o.TTL < 0 || o.TTL%time.Second != 0 {
+		return errors.New("token override ttl must be a positive whole number of seconds")
+	}
+	if o.NumUses < 0 {
+		return errors.New("token override num_uses must not be negative")
+	}
+	for _, policy := range o.Policies {
+		if strings.TrimSpace(policy) == "" {
+			return errors.New("token override policies must not be empty")
+		}
+	}
+	return nil
+}
+
+// tokenParameters returns the request parameters for the TokenOverrides, if
+// they're set and the method supports them.
+func (ah *AuthHandler) tokenParameters(am AuthMethod) map[string]interface{} {
+	tp, ok := am.(AuthMethodWithTokenParameters)
+	if ah.tokenOverrides == nil || !ok {
+		return nil
+	}
+	return tp.TokenParameters(ah.tokenOverrides)
+}
+
+// applyTokenOverrides returns the login request data with the TokenOverrides
+// added, if the method supports them.
+func (ah *AuthHandler) applyTokenOverrides(am AuthMethod, data map[string]interface{}) map[string]interface{} {
+	params := ah.tokenParameters(am)
+	if len(params) == 0 {
+		return data
+	}
+	// The method's data is copied, as it may be reused between attempts
+	overridden := make(map[string]interface{}, len(data)+len(params))
+	for key, value := range data {
+		overridden[key] = value
+	}
+	for key, value := range params {
+		overridden[key] = value
+	}
+	return overridden
+}
+
+// checkTokenOverrides logs a warning for each of the TokenOverrides Vault
+// didn't apply in full to the token it created, such as a TTL clamped to the
+// max TTL, so that operators know the token's shape differs from that they
+// configured. Like checkPolicies, it only observes the token.
+func (ah *AuthHandler) checkTokenOverrides(am AuthMethod, secret *api.Secret) {
+	if _, ok := am.(AuthMethodWithTokenParameters); ah.tokenOverrides == nil || !ok || secret.Auth == nil {
+		return
+	}
+	overrides := ah.tokenOverrides
+
+	if granted := time.Duration(secret.Auth.LeaseDuration) * time.Second; overrides.TTL > 0 && granted < overrides.TTL {
+		ah.logger.Warn("token ttl override was clamped by Vault", "requested", overrides.TTL, "granted", granted)
+	}
+	if len(overrides.Policies) > 0 {
+		granted := make(map[string]struct{}, len(secret.Auth.TokenPolicies))
+		for _, policy := range secret.Auth.TokenPolicies {
+			granted[policy] = struct{}{}
+		}
+		var missing []string
+		for _, policy := range overrides.Policies {
+			if _, ok := granted[policy]; !ok {
+				missing = append(missing, policy)
+			}
+		}
+		if len(missing) > 0 {
+			ah.logger.Warn("token policies override was not granted in full by Vault", "missing_policies", missing)
+		}
+	}
+	if overrides.Renewable != nil && *overrides.Renewable && !secret.Auth.Renewable {
+		ah.logger.Warn("token renewable override was not granted by Vault, the token can't be renewed")
+	}
+}
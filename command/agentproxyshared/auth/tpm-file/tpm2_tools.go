@@ -0,0 +1,124 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: BUSL-1.1
+
+package tpm_file
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/hashicorp/vault/command/agentproxyshared/auth"
+)
+
+// tpm2ToolsUnsealer unseals objects with the tpm2-tools commands, talking to
+// the TPM through device.
+type tpm2ToolsUnsealer struct {
+	device string
+}
+
+var _ unsealer = (*tpm2ToolsUnsealer)(nil)
+
+// Available returns an error if the TPM device doesn't exist, or the
+// tpm2-tools commands aren't installed.
+func (u *tpm2ToolsUnsealer) Available() error {
+	if _, err := os.Stat(u.device); err != nil {
+		return fmt.Errorf("TPM is unavailable: %w", err)
+	}
+	for _, tool := range []string{"tpm2_load", "tpm2_unseal"} {
+		if _, err := exec.LookPath(tool); err != nil {
+			return fmt.Errorf("TPM is unavailable, tpm2-tools are required: %w", err)
+		}
+	}
+	return nil
+}
+
+// Unseal loads obj under the parent key, and unseals it, satisfying the PCR
+// policy if it has one.
+func (u *tpm2ToolsUnsealer) Unseal(ctx context.Context, obj *sealedObject, parentHandle string, policy pcrPolicy) ([]byte, error) {
+	dir, err := os.MkdirTemp("", "vault-tpm-file")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+
+	publicPath := filepath.Join(dir, "sealed.pub")
+	privatePath := filepath.Join(dir, "sealed.priv")
+	contextPath := filepath.Join(dir, "sealed.ctx")
+	if err := os.WriteFile(publicPath, obj.public, 0o600); err != nil {
+		return nil, err
+	}
+	if err := os.WriteFile(privatePath, obj.private, 0o600); err != nil {
+		return nil, err
+	}
+
+	if _, err := u.run(ctx, "tpm2_load", "-C", parentHandle, "-u", publicPath, "-r", privatePath, "-c", contextPath); err != nil {
+		return nil, err
+	}
+
+	args := []string{"-c", contextPath}
+	if selection := policy.String(); selection != "" {
+		args = append(args, "-p", "pcr:"+selection)
+	}
+	return u.run(ctx, "tpm2_unseal", args...)
+}
+
+// run runs a tpm2-tools command against the device, returning its output.
+func (u *tpm2ToolsUnsealer) run(ctx context.Context, tool string, args ...string) ([]byte, error) {
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, tool, args...)
+	cmd.Env = append(os.Environ(), "TPM2TOOLS_TCTI=device:"+u.device)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	if err := cmd.Run(); err != nil {
+		output := strings.TrimSpace(stderr.String())
+		err = fmt.Errorf("%s failed: %w: %s", tool, err, output)
+		if isTransientTPMError(output) {
+			return nil, &auth.TransientError{Err: err}
+		}
+		return nil, err
+	}
+	return stdout.Bytes(), nil
+}
+
+// transientTPMResponseCodes are the TPM warnings meaning that the command
+// wasn't run, but would likely succeed if sent again.
+var transientTPMResponseCodes = map[uint64]bool{
+	0x902: true, // TPM_RC_OBJECT_MEMORY
+	0x903: true, // TPM_RC_SESSION_MEMORY
+	0x904: true, // TPM_RC_MEMORY
+	0x908: true, // TPM_RC_YIELDED
+	0x909: true, // TPM_RC_CANCELED
+	0x90a: true, // TPM_RC_TESTING
+	0x922: true, // TPM_RC_RETRY
+}
+
+var responseCodeRe = regexp.MustCompile(`0x[0-9a-fA-F]+`)
+
+// isTransientTPMError reports whether the error output of a tpm2-tools
+// command shows the TPM was busy, rather than refusing the command, e.g.
+// because the PCRs don't match the policy.
+func isTransientTPMError(output string) bool {
+	if strings.Contains(output, "Device or resource busy") {
+		return true
+	}
+	for _, match := range responseCodeRe.FindAllString(output, -1) {
+		code, err := strconv.ParseUint(match[2:], 16, 32)
+		if err != nil {
+			continue
+		}
+		// The TSS puts the layer which returned the code in the upper bits,
+		// with the TPM's own codes at layer 0
+		if code>>16 == 0 && transientTPMResponseCodes[code] {
+			return true
+		}
+	}
+	return false
+}
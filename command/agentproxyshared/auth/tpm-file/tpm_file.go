@@ -0,0 +1,223 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: BUSL-1.1
+
+package tpm_file
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/go-secure-stdlib/parseutil"
+	"github.com/hashicorp/vault/api"
+	"github.com/hashicorp/vault/command/agentproxyshared/auth"
+)
+
+const (
+	defaultParentHandle = "0x81000001"
+	defaultPCRBank      = "sha256"
+	defaultTPMDevice    = "/dev/tpmrm0"
+
+	// maxPCR is the highest PCR index a PC client TPM has.
+	maxPCR = 23
+)
+
+// sealedObject is the public and private parts of a TPM object sealing the
+// token, as written by tpm2_create.
+type sealedObject struct {
+	public  []byte
+	private []byte
+}
+
+// pcrPolicy is the PCRs the token was sealed to, which must hold the same
+// values as when it was sealed for the TPM to unseal it. It's empty if the
+// token wasn't sealed to any.
+type pcrPolicy struct {
+	bank string
+	pcrs []int
+}
+
+// String returns the policy as a tpm2-tools PCR selection, e.g. sha256:0,7.
+func (p pcrPolicy) String() string {
+	if len(p.pcrs) == 0 {
+		return ""
+	}
+	pcrs := make([]string, 0, len(p.pcrs))
+	for _, pcr := range p.pcrs {
+		pcrs = append(pcrs, fmt.Sprintf("%d", pcr))
+	}
+	return fmt.Sprintf("%s:%s", p.bank, strings.Join(pcrs, ","))
+}
+
+// unsealer unseals a sealed object with the TPM.
+type unsealer interface {
+	// Available returns an error if the TPM can't be used at all.
+	Available() error
+
+	// Unseal returns the data sealed in obj. Errors which may clear up if
+	// retried straight away are returned as an *auth.TransientError.
+	Unseal(ctx context.Context, obj *sealedObject, parentHandle string, policy pcrPolicy) ([]byte, error)
+}
+
+type tpmFileMethod struct {
+	logger    hclog.Logger
+	mountPath string
+
+	sealedBlobPath string
+	parentHandle   string
+	policy         pcrPolicy
+
+	unsealer unsealer
+}
+
+// NewTPMFileAuthMethod returns a method which, like the token_file method,
+// authenticates with an existing token, read from a blob sealed by the TPM.
+func NewTPMFileAuthMethod(conf *auth.AuthConfig) (auth.AuthMethod, error) {
+	if conf == nil {
+		return nil, errors.New("empty config")
+	}
+	if conf.Config == nil {
+		return nil, errors.New("empty config data")
+	}
+
+	a := &tpmFileMethod{
+		logger:       conf.Logger,
+		mountPath:    "auth/token",
+		parentHandle: defaultParentHandle,
+		policy: pcrPolicy{
+			bank: defaultPCRBank,
+		},
+	}
+
+	sealedBlobPathRaw, ok := conf.Config["sealed_blob_path"]
+	if !ok {
+		return nil, errors.New("missing 'sealed_blob_path' value")
+	}
+	a.sealedBlobPath, ok = sealedBlobPathRaw.(string)
+	if !ok {
+		return nil, errors.New("could not convert 'sealed_blob_path' config value to string")
+	}
+	if a.sealedBlobPath == "" {
+		return nil, errors.New("'sealed_blob_path' value is empty")
+	}
+
+	if parentHandleRaw, ok := conf.Config["parent_handle"]; ok {
+		a.parentHandle, ok = parentHandleRaw.(string)
+		if !ok {
+			return nil, errors.New("could not convert 'parent_handle' config value to string")
+		}
+		if a.parentHandle == "" {
+			return nil, errors.New("'parent_handle' value is empty")
+		}
+	}
+
+	if pcrBankRaw, ok := conf.Config["pcr_bank"]; ok {
+		a.policy.bank, ok = pcrBankRaw.(string)
+		if !ok {
+			return nil, errors.New("could not convert 'pcr_bank' config value to string")
+		}
+		switch a.policy.bank {
+		case "sha1", "sha256", "sha384", "sha512":
+		default:
+			return nil, fmt.Errorf("unknown 'pcr_bank' value %q", a.policy.bank)
+		}
+	}
+
+	if pcrsRaw, ok := conf.Config["pcrs"]; ok {
+		pcrs, err := parseutil.SafeParseIntSliceRange(pcrsRaw, 0, maxPCR, maxPCR+1)
+		if err != nil {
+			return nil, fmt.Errorf("error parsing 'pcrs' value: %w", err)
+		}
+		for _, pcr := range pcrs {
+			a.policy.pcrs = append(a.policy.pcrs, int(pcr))
+		}
+	}
+
+	tpmDevice := defaultTPMDevice
+	if tpmDeviceRaw, ok := conf.Config["tpm_device"]; ok {
+		tpmDevice, ok = tpmDeviceRaw.(string)
+		if !ok {
+			return nil, errors.New("could not convert 'tpm_device' config value to string")
+		}
+		if tpmDevice == "" {
+			return nil, errors.New("'tpm_device' value is empty")
+		}
+	}
+	a.unsealer = &tpm2ToolsUnsealer{
+		device: tpmDevice,
+	}
+
+	return a, nil
+}
+
+func (a *tpmFileMethod) Authenticate(ctx context.Context, client *api.Client) (string, http.Header, map[string]interface{}, error) {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	if err := a.unsealer.Available(); err != nil {
+		return "", nil, nil, err
+	}
+
+	obj, err := a.readSealedObject()
+	if err != nil {
+		return "", nil, nil, err
+	}
+
+	token, err := a.unsealer.Unseal(ctx, obj, a.parentHandle, a.policy)
+	if err != nil {
+		return "", nil, nil, fmt.Errorf("error unsealing token: %w", err)
+	}
+	tokenStr := strings.TrimSpace(string(token))
+	if tokenStr == "" {
+		return "", nil, nil, errors.New("unsealed token is empty")
+	}
+
+	// i.e. auth/token/lookup-self
+	return fmt.Sprintf("%s/lookup-self", a.mountPath), nil, map[string]interface{}{
+		"token": tokenStr,
+	}, nil
+}
+
+// readSealedObject reads the public and private parts of the sealed object,
+// from the sealed blob path with .pub and .priv appended.
+func (a *tpmFileMethod) readSealedObject() (*sealedObject, error) {
+	public, err := os.ReadFile(a.sealedBlobPath + ".pub")
+	if err != nil {
+		return nil, fmt.Errorf("error reading sealed blob public part: %w", err)
+	}
+	private, err := os.ReadFile(a.sealedBlobPath + ".priv")
+	if err != nil {
+		return nil, fmt.Errorf("error reading sealed blob private part: %w", err)
+	}
+	if len(public) == 0 || len(private) == 0 {
+		return nil, errors.New("sealed blob is empty")
+	}
+	return &sealedObject{
+		public:  public,
+		private: private,
+	}, nil
+}
+
+// Healthy returns an error if the TPM is unavailable, or the sealed blob
+// can't be read. It doesn't unseal the token.
+func (a *tpmFileMethod) Healthy(_ context.Context) error {
+	if err := a.unsealer.Available(); err != nil {
+		return err
+	}
+	_, err := a.readSealedObject()
+	return err
+}
+
+func (a *tpmFileMethod) NewCreds() chan struct{} {
+	return nil
+}
+
+func (a *tpmFileMethod) CredSuccess() {
+}
+
+func (a *tpmFileMethod) Shutdown() {
+}
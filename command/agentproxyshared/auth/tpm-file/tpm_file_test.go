@@ -0,0 +1,186 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: BUSL-1.1
+
+package tpm_file
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	log "github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/vault/command/agentproxyshared/auth"
+	"github.com/hashicorp/vault/sdk/helper/logging"
+)
+
+type testUnsealer struct {
+	availableErr error
+	unsealErr    error
+	token        string
+
+	parentHandle string
+	policy       pcrPolicy
+}
+
+func (u *testUnsealer) Available() error {
+	return u.availableErr
+}
+
+func (u *testUnsealer) Unseal(_ context.Context, obj *sealedObject, parentHandle string, policy pcrPolicy) ([]byte, error) {
+	u.parentHandle = parentHandle
+	u.policy = policy
+	if u.unsealErr != nil {
+		return nil, u.unsealErr
+	}
+	return []byte(u.token), nil
+}
+
+func writeSealedBlob(t *testing.T) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "token")
+	if err := os.WriteFile(path+".pub", []byte("public"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path+".priv", []byte("private"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestNewTPMFileAuthMethodConfig(t *testing.T) {
+	logger := logging.NewVaultLogger(log.Trace)
+	for name, config := range map[string]map[string]interface{}{
+		"empty":          {},
+		"empty path":     {"sealed_blob_path": ""},
+		"unknown bank":   {"sealed_blob_path": "token", "pcr_bank": "md5"},
+		"pcr range":      {"sealed_blob_path": "token", "pcrs": []interface{}{0, 24}},
+		"empty device":   {"sealed_blob_path": "token", "tpm_device": ""},
+		"empty handle":   {"sealed_blob_path": "token", "parent_handle": ""},
+		"invalid handle": {"sealed_blob_path": "token", "parent_handle": 1},
+	} {
+		t.Run(name, func(t *testing.T) {
+			_, err := NewTPMFileAuthMethod(&auth.AuthConfig{
+				Logger: logger.Named("auth.method"),
+				Config: config,
+			})
+			if err == nil {
+				t.Fatal("expected error")
+			}
+		})
+	}
+
+	am, err := NewTPMFileAuthMethod(&auth.AuthConfig{
+		Logger: logger.Named("auth.method"),
+		Config: map[string]interface{}{
+			"sealed_blob_path": "token",
+			"pcrs":             "0,2,7",
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	policy := am.(*tpmFileMethod).policy
+	if policy.String() != "sha256:0,2,7" {
+		t.Fatalf("unexpected policy %q", policy.String())
+	}
+}
+
+func TestTPMFileAuthenticate(t *testing.T) {
+	logger := logging.NewVaultLogger(log.Trace)
+	am, err := NewTPMFileAuthMethod(&auth.AuthConfig{
+		Logger: logger.Named("auth.method"),
+		Config: map[string]interface{}{
+			"sealed_blob_path": writeSealedBlob(t),
+			"parent_handle":    "0x81000002",
+			"pcr_bank":         "sha1",
+			"pcrs":             []interface{}{0, 7},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	unsealer := &testUnsealer{token: "super-secret-token\n"}
+	am.(*tpmFileMethod).unsealer = unsealer
+
+	path, headers, data, err := am.Authenticate(context.Background(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if path != "auth/token/lookup-self" {
+		t.Fatalf("Incorrect path, was %s", path)
+	}
+	if headers != nil {
+		t.Fatalf("Expected no headers, instead got %v", headers)
+	}
+	if data["token"] != "super-secret-token" {
+		t.Fatalf("unexpected token %v", data["token"])
+	}
+	if unsealer.parentHandle != "0x81000002" {
+		t.Fatalf("unexpected parent handle %q", unsealer.parentHandle)
+	}
+	if expected := (pcrPolicy{bank: "sha1", pcrs: []int{0, 7}}); !reflect.DeepEqual(unsealer.policy, expected) {
+		t.Fatalf("expected policy %v, got %v", expected, unsealer.policy)
+	}
+}
+
+func TestTPMFileAuthenticateErrors(t *testing.T) {
+	logger := logging.NewVaultLogger(log.Trace)
+	am, err := NewTPMFileAuthMethod(&auth.AuthConfig{
+		Logger: logger.Named("auth.method"),
+		Config: map[string]interface{}{
+			"sealed_blob_path": writeSealedBlob(t),
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	method := am.(*tpmFileMethod)
+
+	// The TPM being unavailable is reported as such
+	method.unsealer = &testUnsealer{availableErr: errors.New("TPM is unavailable: no device")}
+	if _, _, _, err := am.Authenticate(context.Background(), nil); err == nil || !strings.Contains(err.Error(), "TPM is unavailable") {
+		t.Fatalf("expected unavailable error, got %v", err)
+	}
+	if err := method.Healthy(context.Background()); err == nil {
+		t.Fatal("expected unhealthy method")
+	}
+
+	// Transient errors stay transient, so the handler retries them
+	method.unsealer = &testUnsealer{unsealErr: &auth.TransientError{Err: errors.New("busy")}}
+	_, _, _, err = am.Authenticate(context.Background(), nil)
+	var transientErr *auth.TransientError
+	if !errors.As(err, &transientErr) {
+		t.Fatalf("expected transient error, got %v", err)
+	}
+
+	method.unsealer = &testUnsealer{}
+	if _, _, _, err := am.Authenticate(context.Background(), nil); err == nil {
+		t.Fatal("expected error for empty token")
+	}
+
+	// A missing blob is an error, rather than an empty token
+	method.sealedBlobPath = filepath.Join(t.TempDir(), "missing")
+	method.unsealer = &testUnsealer{token: "token"}
+	if _, _, _, err := am.Authenticate(context.Background(), nil); err == nil {
+		t.Fatal("expected error for missing blob")
+	}
+}
+
+func TestIsTransientTPMError(t *testing.T) {
+	for output, expected := range map[string]bool{
+		"ERROR:esys:src/tss2-esys/api/Esys_Unseal.c:295:Esys_Unseal_Finish() Received TPM Error\nErrorCode (0x00000922)": true,
+		"WARNING:esys: Esys_Load_Finish() Received TPM Error\nErrorCode (0x00000908)":                                    true,
+		"ERROR: Esys_PolicyPCR ErrorCode (0x0000099d)":                                                                   false,
+		"ERROR:tcti: Failed to open device file /dev/tpmrm0: Device or resource busy":                                    true,
+		"ERROR: Esys_Unseal_Finish ErrorCode (0x000a0922)":                                                               false,
+		"ERROR: Unable to run tpm2_unseal":                                                                               false,
+	} {
+		if actual := isTransientTPMError(output); actual != expected {
+			t.Errorf("expected %v for %q", expected, output)
+		}
+	}
+}
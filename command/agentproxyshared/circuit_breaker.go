@@ -0,0 +1,282 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: BUSL-1.1
+
+package agentproxyshared
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/armon/go-metrics"
+	log "github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/vault/api"
+)
+
+const (
+	// DefaultCircuitBreakerFailureThreshold is the default number of
+	// consecutive failures to connect to Vault after which the breaker opens.
+	DefaultCircuitBreakerFailureThreshold = 5
+
+	// DefaultCircuitBreakerCooldown is the default time the breaker stays
+	// open before letting a connection through to probe whether Vault has
+	// recovered.
+	DefaultCircuitBreakerCooldown = 30 * time.Second
+)
+
+// ErrCircuitOpen is returned instead of connecting to Vault while the circuit
+// breaker is open.
+var ErrCircuitOpen = errors.New("circuit breaker is open, not connecting to Vault")
+
+// CircuitBreakerState is the state of a CircuitBreaker.
+type CircuitBreakerState string
+
+const (
+	// CircuitClosed is the normal state, in which connections are made.
+	CircuitClosed CircuitBreakerState = "closed"
+	// CircuitOpen is the state after too many consecutive failures, in which
+	// connections fail straight away with ErrCircuitOpen.
+	CircuitOpen CircuitBreakerState = "open"
+	// CircuitHalfOpen is the state once the cooldown has elapsed, in which a
+	// single connection is let through as a probe. The breaker closes if it
+	// succeeds, and opens again if it fails.
+	CircuitHalfOpen CircuitBreakerState = "half-open"
+)
+
+// CircuitBreakerEvent describes a change in the state of a CircuitBreaker.
+type CircuitBreakerEvent struct {
+	From CircuitBreakerState
+	To   CircuitBreakerState
+	Time time.Time
+	// Error is the failure which opened the breaker, if any.
+	Error error
+}
+
+// CircuitBreakerConfig is the configuration of a CircuitBreaker.
+type CircuitBreakerConfig struct {
+	Logger log.Logger
+	// FailureThreshold is the number of consecutive failures after which the
+	// breaker opens. It defaults to DefaultCircuitBreakerFailureThreshold.
+	FailureThreshold int
+	// Cooldown is how long the breaker stays open before probing. It
+	// defaults to DefaultCircuitBreakerCooldown.
+	Cooldown time.Duration
+	// MetricsSignifier is the first argument we will give to
+	// metrics.SetGauge, signifying what the name of the application is.
+	MetricsSignifier string
+	// EnableEventCh enables delivery of CircuitBreakerEvents on the
+	// breaker's EventCh.
+	EnableEventCh bool
+	// Dial, if set, is the dialer which the breaker's Dial and DialContext
+	// connect with, such as a Failover's.
+	Dial func(ctx context.Context, network, addr string) (net.Conn, error)
+}
+
+// CircuitBreaker stops connections to Vault from being attempted for a
+// while once too many consecutive attempts have failed, so that when Vault is
+// down, the components sharing it, such as auto-auth, the template runner and
+// the API proxy, don't each keep retrying against it independently.
+//
+// It works at the level of connections, as the transport of the Vault
+// client is shared by every client cloned from it, and can't be replaced, and
+// consul-template only lets its dialer be customized. Only failures to
+// connect are counted, so a Vault server which is up, but returning errors,
+// doesn't open the breaker. Requests on connections already open aren't
+// short-circuited.
+type CircuitBreaker struct {
+	EventCh chan CircuitBreakerEvent
+
+	logger           log.Logger
+	threshold        int
+	cooldown         time.Duration
+	metricsSignifier string
+	enableEventCh    bool
+	now              func() time.Time
+
+	// dial is the dialer used by Dial and DialContext
+	dial func(ctx context.Context, network, addr string) (net.Conn, error)
+
+	l        sync.Mutex
+	state    CircuitBreakerState
+	failures int
+	openedAt time.Time
+	probing  bool
+}
+
+// NewCircuitBreaker creates a new closed CircuitBreaker.
+func NewCircuitBreaker(conf *CircuitBreakerConfig) *CircuitBreaker {
+	cb := &CircuitBreaker{
+		EventCh:          make(chan CircuitBreakerEvent, 10),
+		logger:           conf.Logger,
+		threshold:        conf.FailureThreshold,
+		cooldown:         conf.Cooldown,
+		metricsSignifier: conf.MetricsSignifier,
+		enableEventCh:    conf.EnableEventCh,
+		now:              time.Now,
+		state:            CircuitClosed,
+	}
+	if cb.logger == nil {
+		cb.logger = log.NewNullLogger()
+	}
+	if cb.threshold <= 0 {
+		cb.threshold = DefaultCircuitBreakerFailureThreshold
+	}
+	if cb.cooldown <= 0 {
+		cb.cooldown = DefaultCircuitBreakerCooldown
+	}
+	dial := conf.Dial
+	if dial == nil {
+		dial = (&net.Dialer{
+			Timeout:   30 * time.Second,
+			KeepAlive: 30 * time.Second,
+		}).DialContext
+	}
+	cb.dial = cb.wrap(dial)
+	return cb
+}
+
+// InstallOnClient has the transport of client, which is shared by every
+// client cloned from it, make its connections through the breaker. It must
+// be called before client is used or cloned, and before a ClientTLSReloader
+// is created for it.
+func (cb *CircuitBreaker) InstallOnClient(client *api.Client) error {
+	if client == nil {
+		return errors.New("no client provided")
+	}
+	transport, ok := client.CloneConfig().HttpClient.Transport.(*http.Transport)
+	if !ok {
+		return errors.New("client's transport can't be wrapped")
+	}
+	dial := transport.DialContext
+	if dial == nil {
+		dial = (&net.Dialer{}).DialContext
+	}
+	transport.DialContext = cb.wrap(dial)
+	return nil
+}
+
+// Dial connects to addr through the breaker. With DialContext, it lets the
+// breaker be used as consul-template's custom dialer.
+func (cb *CircuitBreaker) Dial(network, addr string) (net.Conn, error) {
+	return cb.dial(context.Background(), network, addr)
+}
+
+// DialContext connects to addr through the breaker.
+func (cb *CircuitBreaker) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	return cb.dial(ctx, network, addr)
+}
+
+// State returns the current state of the breaker.
+func (cb *CircuitBreaker) State() CircuitBreakerState {
+	cb.l.Lock()
+	defer cb.l.Unlock()
+	return cb.state
+}
+
+// wrap returns a dialer which only calls dial if the breaker allows it, and
+// records the result.
+func (cb *CircuitBreaker) wrap(dial func(ctx context.Context, network, addr string) (net.Conn, error)) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		probe, err := cb.allow()
+		if err != nil {
+			return nil, fmt.Errorf("error connecting to %s: %w", addr, err)
+		}
+		conn, err := dial(ctx, network, addr)
+		cb.record(probe, err, ctx.Err() != nil)
+		return conn, err
+	}
+}
+
+// allow returns an error if a connection mustn't be attempted, and whether
+// the connection is the half-open breaker's probe.
+func (cb *CircuitBreaker) allow() (bool, error) {
+	cb.l.Lock()
+	defer cb.l.Unlock()
+
+	switch cb.state {
+	case CircuitOpen:
+		if cb.now().Sub(cb.openedAt) < cb.cooldown {
+			return false, ErrCircuitOpen
+		}
+		cb.setState(CircuitHalfOpen, nil)
+		fallthrough
+	case CircuitHalfOpen:
+		if cb.probing {
+			return false, ErrCircuitOpen
+		}
+		cb.probing = true
+		return true, nil
+	default:
+		return false, nil
+	}
+}
+
+// record updates the breaker with the result of a connection attempt.
+// Attempts abandoned by the caller, with their context done, don't count as
+// failures.
+func (cb *CircuitBreaker) record(probe bool, err error, abandoned bool) {
+	cb.l.Lock()
+	defer cb.l.Unlock()
+
+	if probe {
+		cb.probing = false
+	}
+	switch {
+	case err == nil:
+		cb.failures = 0
+		if cb.state != CircuitClosed {
+			cb.setState(CircuitClosed, nil)
+		}
+	case abandoned:
+	case probe && cb.state == CircuitHalfOpen:
+		cb.openedAt = cb.now()
+		cb.setState(CircuitOpen, err)
+	case cb.state == CircuitClosed:
+		cb.failures++
+		if cb.failures >= cb.threshold {
+			cb.openedAt = cb.now()
+			cb.setState(CircuitOpen, err)
+		}
+	}
+}
+
+// setState changes the state of the breaker, and emits an event. The lock
+// must be held.
+func (cb *CircuitBreaker) setState(state CircuitBreakerState, err error) {
+	event := CircuitBreakerEvent{
+		From:  cb.state,
+		To:    state,
+		Time:  cb.now(),
+		Error: err,
+	}
+	cb.state = state
+
+	switch state {
+	case CircuitOpen:
+		cb.logger.Warn("circuit breaker opened, not connecting to Vault", "cooldown", cb.cooldown, "error", err)
+	case CircuitHalfOpen:
+		cb.logger.Info("circuit breaker half-open, probing Vault")
+	case CircuitClosed:
+		cb.logger.Info("circuit breaker closed, Vault is reachable")
+	}
+	if cb.metricsSignifier != "" {
+		var open float32
+		if state != CircuitClosed {
+			open = 1
+		}
+		metrics.SetGauge([]string{cb.metricsSignifier, "circuit_breaker", "open"}, open)
+	}
+
+	if !cb.enableEventCh {
+		return
+	}
+	select {
+	case cb.EventCh <- event:
+	default:
+		cb.logger.Warn("circuit breaker event channel full, dropping event", "state", state)
+	}
+}
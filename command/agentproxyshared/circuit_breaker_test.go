@@ -0,0 +1,161 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: BUSL-1.1
+
+package agentproxyshared
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/vault/api"
+)
+
+// TestCircuitBreaker tests that the breaker opens after the configured number
+// of consecutive failures, short-circuits connections during the cooldown,
+// and lets a single probe through once it's half-open, closing if it
+// succeeds and opening again if it fails.
+func TestCircuitBreaker(t *testing.T) {
+	now := time.Now()
+	cb := NewCircuitBreaker(&CircuitBreakerConfig{
+		FailureThreshold: 3,
+		Cooldown:         time.Minute,
+		EnableEventCh:    true,
+	})
+	cb.now = func() time.Time { return now }
+
+	dialErr := errors.New("connection refused")
+	var dials int
+	var fail bool
+	dial := cb.wrap(func(context.Context, string, string) (net.Conn, error) {
+		dials++
+		if fail {
+			return nil, dialErr
+		}
+		return &net.TCPConn{}, nil
+	})
+	connect := func() error {
+		_, err := dial(context.Background(), "tcp", "vault:8200")
+		return err
+	}
+	expectEvent := func(from, to CircuitBreakerState) {
+		t.Helper()
+		select {
+		case event := <-cb.EventCh:
+			if event.From != from || event.To != to {
+				t.Fatalf("expected event from %q to %q, got %#v", from, to, event)
+			}
+		default:
+			t.Fatalf("expected event from %q to %q", from, to)
+		}
+	}
+
+	// A success resets the count of consecutive failures
+	fail = true
+	for i := 0; i < 2; i++ {
+		if err := connect(); !errors.Is(err, dialErr) {
+			t.Fatalf("expected dial error, got %v", err)
+		}
+	}
+	fail = false
+	if err := connect(); err != nil {
+		t.Fatal(err)
+	}
+	fail = true
+	for i := 0; i < 3; i++ {
+		if err := connect(); !errors.Is(err, dialErr) {
+			t.Fatalf("expected dial error, got %v", err)
+		}
+	}
+	expectEvent(CircuitClosed, CircuitOpen)
+
+	// Connections are short-circuited during the cooldown
+	dials = 0
+	if err := connect(); !errors.Is(err, ErrCircuitOpen) {
+		t.Fatalf("expected circuit open error, got %v", err)
+	}
+	if dials != 0 {
+		t.Fatalf("expected no dials while open, got %d", dials)
+	}
+
+	// A failed probe opens the breaker again
+	now = now.Add(time.Minute)
+	if err := connect(); !errors.Is(err, dialErr) {
+		t.Fatalf("expected dial error, got %v", err)
+	}
+	expectEvent(CircuitOpen, CircuitHalfOpen)
+	expectEvent(CircuitHalfOpen, CircuitOpen)
+	if cb.State() != CircuitOpen {
+		t.Fatalf("expected breaker to be open, got %q", cb.State())
+	}
+	if err := connect(); !errors.Is(err, ErrCircuitOpen) {
+		t.Fatalf("expected circuit open error, got %v", err)
+	}
+
+	// A successful probe closes it
+	now = now.Add(time.Minute)
+	fail = false
+	if err := connect(); err != nil {
+		t.Fatal(err)
+	}
+	expectEvent(CircuitOpen, CircuitHalfOpen)
+	expectEvent(CircuitHalfOpen, CircuitClosed)
+	if cb.State() != CircuitClosed {
+		t.Fatalf("expected breaker to be closed, got %q", cb.State())
+	}
+}
+
+// TestCircuitBreaker_Abandoned tests that connections abandoned by the caller
+// don't count as failures.
+func TestCircuitBreaker_Abandoned(t *testing.T) {
+	cb := NewCircuitBreaker(&CircuitBreakerConfig{FailureThreshold: 1})
+	dial := cb.wrap(func(ctx context.Context, _, _ string) (net.Conn, error) {
+		return nil, ctx.Err()
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := dial(ctx, "tcp", "vault:8200"); !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected context canceled, got %v", err)
+	}
+	if cb.State() != CircuitClosed {
+		t.Fatalf("expected breaker to stay closed, got %q", cb.State())
+	}
+}
+
+// TestCircuitBreaker_InstallOnClient tests that requests made by clients
+// cloned from a client the breaker is installed on are short-circuited once
+// it's open.
+func TestCircuitBreaker_InstallOnClient(t *testing.T) {
+	// Take an address nothing is listening on
+	server := httptest.NewServer(http.NotFoundHandler())
+	server.Close()
+
+	config := api.DefaultConfig()
+	config.Address = server.URL
+	config.MaxRetries = 0
+	client, err := api.NewClient(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cb := NewCircuitBreaker(&CircuitBreakerConfig{FailureThreshold: 1})
+	if err := cb.InstallOnClient(client); err != nil {
+		t.Fatal(err)
+	}
+	clone, err := client.CloneWithHeaders()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := clone.Sys().Health(); err == nil || errors.Is(err, ErrCircuitOpen) {
+		t.Fatalf("expected connection error, got %v", err)
+	}
+	if _, err := clone.Sys().Health(); !errors.Is(err, ErrCircuitOpen) {
+		t.Fatalf("expected circuit open error, got %v", err)
+	}
+}
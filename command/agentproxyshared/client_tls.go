@@ -0,0 +1,114 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: BUSL-1.1
+
+package agentproxyshared
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"sync/atomic"
+
+	log "github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/vault/api"
+)
+
+// ClientTLSReloader lets the CA and client certificate files a Vault client
+// was configured with be re-read without restarting, e.g. when the CA that
+// signed Vault's certificate is rotated.
+//
+// The client's transport is shared by every client cloned from it, such as
+// those used for auto-auth and by sinks, and it can't safely be replaced
+// while they're in use. Instead, the transport is set up to make its TLS
+// connections with whichever configuration was loaded last. Requests already
+// in flight complete on the connections they're using, and idle connections
+// are closed on reload, so that later requests use the new configuration.
+//
+// Connections to Vault made through an HTTP proxy keep the configuration the
+// client was created with.
+type ClientTLSReloader struct {
+	logger    log.Logger
+	tlsConfig *api.TLSConfig
+	transport *http.Transport
+
+	// base is the transport's TLS configuration when the reloader was
+	// created, which the files are loaded into afresh on each reload
+	base    *tls.Config
+	dial    func(ctx context.Context, network, addr string) (net.Conn, error)
+	current atomic.Pointer[tls.Config]
+}
+
+// NewClientTLSReloader sets up client's transport so that the files in
+// tlsConfig, which the client must already be configured with, can be
+// re-read by ReloadTLS. It must be called before client is used, or cloned.
+func NewClientTLSReloader(logger log.Logger, client *api.Client, tlsConfig *api.TLSConfig) (*ClientTLSReloader, error) {
+	if client == nil {
+		return nil, errors.New("no client provided")
+	}
+	if tlsConfig == nil {
+		return nil, errors.New("no TLS config provided")
+	}
+
+	transport, ok := client.CloneConfig().HttpClient.Transport.(*http.Transport)
+	if !ok {
+		return nil, errors.New("client's transport can't be reloaded")
+	}
+
+	r := &ClientTLSReloader{
+		logger:    logger,
+		tlsConfig: tlsConfig,
+		transport: transport,
+		base:      transport.TLSClientConfig.Clone(),
+		dial:      transport.DialContext,
+	}
+	if r.base == nil {
+		r.base = &tls.Config{}
+	}
+	if r.dial == nil {
+		r.dial = (&net.Dialer{}).DialContext
+	}
+	if err := r.load(); err != nil {
+		return nil, err
+	}
+	transport.DialTLSContext = r.dialTLS
+
+	return r, nil
+}
+
+// ReloadTLS re-reads the CA and client certificate files, and uses them for
+// new connections to Vault. If they can't be read, the configuration already
+// in use is kept, and an error is returned. The paths of the files aren't
+// changed.
+func (r *ClientTLSReloader) ReloadTLS() error {
+	if err := r.load(); err != nil {
+		return fmt.Errorf("error reloading Vault client TLS configuration, keeping the current one: %w", err)
+	}
+	r.transport.CloseIdleConnections()
+	r.logger.Info("reloaded Vault client TLS configuration")
+	return nil
+}
+
+// load reads the files into a copy of the base configuration, and makes it
+// current.
+func (r *ClientTLSReloader) load() error {
+	// ConfigureTLS modifies the TLS configuration of the config's transport
+	// in place
+	config := &api.Config{
+		HttpClient: &http.Client{
+			Transport: &http.Transport{TLSClientConfig: r.base.Clone()},
+		},
+	}
+	if err := config.ConfigureTLS(r.tlsConfig); err != nil {
+		return err
+	}
+	r.current.Store(config.TLSConfig())
+	return nil
+}
+
+// dialTLS makes a TLS connection with the current configuration.
+func (r *ClientTLSReloader) dialTLS(ctx context.Context, network, addr string) (net.Conn, error) {
+	return dialTLS(ctx, r.dial, r.current.Load(), network, addr)
+}
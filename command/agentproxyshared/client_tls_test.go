@@ -0,0 +1,112 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: BUSL-1.1
+
+package agentproxyshared
+
+import (
+	"crypto/tls"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+
+	hclog "github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/vault/api"
+	"github.com/hashicorp/vault/helper/testhelpers/certhelpers"
+	"github.com/hashicorp/vault/sdk/helper/logging"
+)
+
+// TestClientTLSReloader tests that once Vault's CA is rotated, the client
+// trusts the new CA after ReloadTLS, and that a failed reload keeps the CA in
+// use.
+func TestClientTLSReloader(t *testing.T) {
+	newServerCert := func() (certhelpers.Certificate, *tls.Certificate) {
+		ca := certhelpers.NewCert(t, certhelpers.CommonName("ca"), certhelpers.IsCA(true), certhelpers.SelfSign())
+		cert := certhelpers.NewCert(t, certhelpers.CommonName("vault"), certhelpers.IP("127.0.0.1"), certhelpers.Parent(ca))
+		return ca, &cert.TLSCert
+	}
+	oldCA, oldCert := newServerCert()
+	newCA, newCert := newServerCert()
+
+	var serverCert atomic.Pointer[tls.Certificate]
+	serverCert.Store(oldCert)
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"initialized": true, "sealed": false}`))
+	}))
+	server.TLS = &tls.Config{
+		// httptest adds its own certificate, which is used for clients that
+		// don't send SNI instead of calling GetCertificate
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			return &tls.Config{Certificates: []tls.Certificate{*serverCert.Load()}}, nil
+		},
+	}
+	server.StartTLS()
+	defer server.Close()
+
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	if err := os.WriteFile(caFile, oldCA.Pem, 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	config := api.DefaultConfig()
+	config.Address = server.URL
+	tlsConfig := &api.TLSConfig{CACert: caFile}
+	if err := config.ConfigureTLS(tlsConfig); err != nil {
+		t.Fatal(err)
+	}
+	client, err := api.NewClient(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reloader, err := NewClientTLSReloader(logging.NewVaultLogger(hclog.Trace), client, tlsConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Clones share the transport, so are reloaded too
+	clone, err := client.Clone()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	check := func(expectErr bool) {
+		t.Helper()
+		for _, c := range []*api.Client{client, clone} {
+			_, err := c.Sys().Health()
+			if expectErr && err == nil {
+				t.Fatal("expected error")
+			}
+			if !expectErr && err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	check(false)
+
+	// The CA is rotated, and the client doesn't yet trust the new one
+	serverCert.Store(newCert)
+	client.CloneConfig().HttpClient.Transport.(*http.Transport).CloseIdleConnections()
+	check(true)
+
+	// A failed reload keeps the old CA
+	if err := os.WriteFile(caFile, []byte("not a certificate"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := reloader.ReloadTLS(); err == nil {
+		t.Fatal("expected error reloading invalid CA")
+	}
+	serverCert.Store(oldCert)
+	check(false)
+
+	serverCert.Store(newCert)
+	if err := os.WriteFile(caFile, newCA.Pem, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := reloader.ReloadTLS(); err != nil {
+		t.Fatal(err)
+	}
+	check(false)
+}
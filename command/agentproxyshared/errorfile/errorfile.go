@@ -0,0 +1,134 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: BUSL-1.1
+
+// Package errorfile keeps a file holding the most recent auto-auth or sink
+// failure, so that it can be alerted on, e.g. by a node exporter textfile
+// collector, without scraping logs.
+package errorfile
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/go-hclog"
+)
+
+// File holds the last error from each of the components sharing it, such as
+// the auth handler and sink server. When a component records an error, the
+// file is replaced with a single line holding the time and message. When it
+// succeeds again, its error is cleared, and the file is emptied, or if
+// another component's error is outstanding, holds that one instead.
+//
+// A nil *File is valid, and does nothing, so that components can call it
+// without checking whether it's configured.
+type File struct {
+	path   string
+	logger hclog.Logger
+
+	l      sync.Mutex
+	errors map[string]entry
+}
+
+type entry struct {
+	time    time.Time
+	message string
+}
+
+// New returns a File which writes to path. The file is not created until
+// there's an error to record.
+func New(path string, logger hclog.Logger) *File {
+	if logger == nil {
+		logger = hclog.NewNullLogger()
+	}
+	return &File{
+		path:   path,
+		logger: logger,
+		errors: make(map[string]entry),
+	}
+}
+
+// Path returns the path of the file.
+func (f *File) Path() string {
+	if f == nil {
+		return ""
+	}
+	return f.path
+}
+
+// Record makes msg, and err if it isn't nil, the current error from source.
+func (f *File) Record(source, msg string, err error) {
+	if f == nil {
+		return
+	}
+	if err != nil {
+		msg = fmt.Sprintf("%s: %s", msg, err)
+	}
+
+	f.l.Lock()
+	defer f.l.Unlock()
+	f.errors[source] = entry{time: time.Now(), message: msg}
+	f.write()
+}
+
+// Clear clears the error from source, if it has one.
+func (f *File) Clear(source string) {
+	if f == nil {
+		return
+	}
+
+	f.l.Lock()
+	defer f.l.Unlock()
+	if _, ok := f.errors[source]; !ok {
+		return
+	}
+	delete(f.errors, source)
+	f.write()
+}
+
+// write replaces the file's contents with the latest outstanding error, or
+// empties it if there are none. It must be called with the lock held.
+func (f *File) write() {
+	var (
+		latest       entry
+		latestSource string
+	)
+	for source, e := range f.errors {
+		if latestSource == "" || e.time.After(latest.time) {
+			latest, latestSource = e, source
+		}
+	}
+
+	var contents []byte
+	if latestSource != "" {
+		contents = []byte(fmt.Sprintf("%s %s: %s\n", latest.time.UTC().Format(time.RFC3339), latestSource, latest.message))
+	}
+
+	// Write to a temporary file and rename it into place, so that readers
+	// never see a partially written error
+	tmp, err := os.CreateTemp(filepath.Dir(f.path), filepath.Base(f.path)+".tmp")
+	if err != nil {
+		f.logger.Error("error creating temporary error file", "path", f.path, "error", err)
+		return
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(contents); err != nil {
+		tmp.Close()
+		f.logger.Error("error writing error file", "path", f.path, "error", err)
+		return
+	}
+	if err := tmp.Chmod(0o644); err != nil {
+		tmp.Close()
+		f.logger.Error("error setting error file permissions", "path", f.path, "error", err)
+		return
+	}
+	if err := tmp.Close(); err != nil {
+		f.logger.Error("error writing error file", "path", f.path, "error", err)
+		return
+	}
+	if err := os.Rename(tmp.Name(), f.path); err != nil {
+		f.logger.Error("error replacing error file", "path", f.path, "error", err)
+	}
+}
@@ -0,0 +1,64 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: BUSL-1.1
+
+package errorfile
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func readFile(t *testing.T, path string) string {
+	t.Helper()
+	contents, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(contents)
+}
+
+// TestFile tests that the file holds the latest outstanding error, and is
+// emptied once every source has succeeded.
+func TestFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "last-error")
+	f := New(path, nil)
+
+	// Nothing is written until there's an error
+	f.Clear("auth")
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Fatalf("expected no file, got %v", err)
+	}
+
+	f.Record("auth", "error authenticating", errors.New("permission denied"))
+	if contents := readFile(t, path); !strings.HasSuffix(contents, " auth: error authenticating: permission denied\n") {
+		t.Fatalf("unexpected contents %q", contents)
+	}
+
+	f.Record("sink", "error writing token to sink", nil)
+	if contents := readFile(t, path); !strings.HasSuffix(contents, " sink: error writing token to sink\n") {
+		t.Fatalf("unexpected contents %q", contents)
+	}
+
+	// The auth error is still outstanding
+	f.Clear("sink")
+	if contents := readFile(t, path); !strings.HasSuffix(contents, " auth: error authenticating: permission denied\n") {
+		t.Fatalf("unexpected contents %q", contents)
+	}
+
+	f.Clear("auth")
+	if contents := readFile(t, path); contents != "" {
+		t.Fatalf("expected empty file, got %q", contents)
+	}
+}
+
+func TestFile_Nil(t *testing.T) {
+	var f *File
+	f.Record("auth", "error authenticating", nil)
+	f.Clear("auth")
+	if f.Path() != "" {
+		t.Fatal("expected no path")
+	}
+}
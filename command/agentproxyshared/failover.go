@@ -0,0 +1,434 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: BUSL-1.1
+
+package agentproxyshared
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/armon/go-metrics"
+	log "github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/vault/api"
+)
+
+// DefaultFailoverProbeTimeout is the default time allowed for the health
+// check of each address probed when failing over.
+const DefaultFailoverProbeTimeout = 5 * time.Second
+
+// FailoverEvent describes a switch of the address a Failover connects to.
+type FailoverEvent struct {
+	From string
+	To   string
+	Time time.Time
+	// Error is the failure to connect to From which caused the failover.
+	Error error
+}
+
+// FailoverConfig is the configuration of a Failover.
+type FailoverConfig struct {
+	Logger log.Logger
+	// Addresses are the addresses of Vault, in order of preference. They
+	// must all have the same scheme.
+	Addresses []string
+	// ProbeTimeout is the time allowed for the health check of each address
+	// probed. It defaults to DefaultFailoverProbeTimeout.
+	ProbeTimeout time.Duration
+	// MetricsSignifier is the first argument we will give to
+	// metrics.IncrCounter, signifying what the name of the application is.
+	MetricsSignifier string
+	// EnableEventCh enables delivery of FailoverEvents on the failover's
+	// EventCh.
+	EnableEventCh bool
+}
+
+// Failover lets the agent keep reaching Vault when the endpoint it's using
+// is down entirely, such as when a region is lost, by connecting to the next
+// of several addresses. This is unlike Vault's own HA, in which standbys
+// redirect or forward requests to the active node, as that relies on the
+// endpoint being up.
+//
+// Like the CircuitBreaker, it works at the level of connections, so that it
+// can be shared by the Vault client and consul-template, which only lets its
+// dialer be customized. Connections to any of the addresses are made to the
+// one currently in use, starting with the first. When a connection to it
+// fails, the addresses are health checked in order, and the first healthy
+// one is used from then on, until a connection to it fails in turn. TLS
+// certificates are verified against the host name of the address connected
+// to, unless a server name is configured, which takes a TLS dialer that knows
+// where each connection went: the transport's own, installed by
+// InstallOnClient, or a TLSDialer for consul-template.
+type Failover struct {
+	EventCh chan FailoverEvent
+
+	logger           log.Logger
+	addresses        []*url.URL
+	probeTimeout     time.Duration
+	metricsSignifier string
+	enableEventCh    bool
+
+	// dial is the dialer used by Dial and DialContext
+	dial func(ctx context.Context, network, addr string) (net.Conn, error)
+
+	// probeClient health checks addresses, connecting to them directly
+	probeClient *http.Client
+
+	l      sync.Mutex
+	active int
+
+	// probeLock is held while failing over, so that connections failing
+	// together only probe the addresses once
+	probeLock sync.Mutex
+}
+
+// NewFailover creates a new Failover, connecting to the first of its
+// addresses.
+func NewFailover(conf *FailoverConfig) (*Failover, error) {
+	if len(conf.Addresses) == 0 {
+		return nil, errors.New("no addresses provided")
+	}
+	addresses, err := ParseFailoverAddresses(conf.Addresses)
+	if err != nil {
+		return nil, err
+	}
+
+	f := &Failover{
+		EventCh:          make(chan FailoverEvent, 10),
+		logger:           conf.Logger,
+		addresses:        addresses,
+		probeTimeout:     conf.ProbeTimeout,
+		metricsSignifier: conf.MetricsSignifier,
+		enableEventCh:    conf.EnableEventCh,
+	}
+	if f.logger == nil {
+		f.logger = log.NewNullLogger()
+	}
+	if f.probeTimeout <= 0 {
+		f.probeTimeout = DefaultFailoverProbeTimeout
+	}
+	dial := (&net.Dialer{
+		Timeout:   30 * time.Second,
+		KeepAlive: 30 * time.Second,
+	}).DialContext
+	f.dial = f.wrap(dial)
+	f.probeClient = f.newProbeClient(dial, nil)
+	return f, nil
+}
+
+// ParseFailoverAddresses parses the addresses of Vault to fail over between,
+// which must be http or https URLs, all with the same scheme.
+func ParseFailoverAddresses(addresses []string) ([]*url.URL, error) {
+	parsed := make([]*url.URL, 0, len(addresses))
+	for _, address := range addresses {
+		u, err := url.Parse(address)
+		if err != nil {
+			return nil, fmt.Errorf("invalid address %q: %w", address, err)
+		}
+		if u.Scheme != "http" && u.Scheme != "https" {
+			return nil, fmt.Errorf("invalid address %q: scheme must be http or https", address)
+		}
+		if u.Host == "" {
+			return nil, fmt.Errorf("invalid address %q: no host", address)
+		}
+		if len(parsed) > 0 && u.Scheme != parsed[0].Scheme {
+			return nil, fmt.Errorf("invalid address %q: all addresses must have the same scheme", address)
+		}
+		parsed = append(parsed, u)
+	}
+	return parsed, nil
+}
+
+// InstallOnClient has the transport of client, which is shared by every
+// client cloned from it, make its connections through the failover. It must
+// be called before client is used or cloned, and before a CircuitBreaker or
+// ClientTLSReloader is installed on it, so that they see a connection fail
+// only once every address has.
+func (f *Failover) InstallOnClient(client *api.Client) error {
+	if client == nil {
+		return errors.New("no client provided")
+	}
+	transport, ok := client.CloneConfig().HttpClient.Transport.(*http.Transport)
+	if !ok {
+		return errors.New("client's transport can't be wrapped")
+	}
+	dial := transport.DialContext
+	if dial == nil {
+		dial = (&net.Dialer{}).DialContext
+	}
+	f.probeClient = f.newProbeClient(dial, transport.TLSClientConfig)
+	transport.DialContext = f.wrap(dial)
+	if f.addresses[0].Scheme == "https" && transport.DialTLSContext == nil {
+		// The transport's dialer is looked up for each connection, so that
+		// it includes any CircuitBreaker installed after the failover
+		tlsConfig := transport.TLSClientConfig
+		if tlsConfig == nil {
+			tlsConfig = &tls.Config{}
+		}
+		transport.DialTLSContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return dialTLS(ctx, transport.DialContext, tlsConfig, network, addr)
+		}
+	}
+	return nil
+}
+
+// Dial connects to addr through the failover. With DialContext, it lets the
+// failover be used as consul-template's custom dialer.
+func (f *Failover) Dial(network, addr string) (net.Conn, error) {
+	return f.dial(context.Background(), network, addr)
+}
+
+// DialContext connects to addr through the failover.
+func (f *Failover) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	return f.dial(ctx, network, addr)
+}
+
+// Active returns the address currently connected to.
+func (f *Failover) Active() string {
+	f.l.Lock()
+	defer f.l.Unlock()
+	return f.addresses[f.active].String()
+}
+
+// wrap returns a dialer which connects to the active address in place of
+// any of the addresses, failing over if that fails.
+func (f *Failover) wrap(dial func(ctx context.Context, network, addr string) (net.Conn, error)) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		if !f.handles(addr) {
+			return dial(ctx, network, addr)
+		}
+
+		active := f.activeIndex()
+		conn, err := f.dialAddress(ctx, dial, network, active)
+		if err == nil || ctx.Err() != nil || errors.Is(err, ErrCircuitOpen) {
+			return conn, err
+		}
+
+		next, ok := f.failover(ctx, active, err)
+		if !ok {
+			return nil, err
+		}
+		return f.dialAddress(ctx, dial, network, next)
+	}
+}
+
+// dialAddress connects to the address at index idx, recording its host name
+// on the connection for TLS.
+func (f *Failover) dialAddress(ctx context.Context, dial func(ctx context.Context, network, addr string) (net.Conn, error), network string, idx int) (net.Conn, error) {
+	u := f.addresses[idx]
+	conn, err := dial(ctx, network, hostPort(u))
+	if err != nil {
+		return nil, err
+	}
+	return &failoverConn{Conn: conn, host: u.Hostname()}, nil
+}
+
+// failoverConn is a connection made by a Failover, which may be to another
+// address than the one asked for.
+type failoverConn struct {
+	net.Conn
+	// host is the host name of the address connected to
+	host string
+}
+
+// TLSDialer makes TLS connections with a dialer, verifying certificates
+// against the host name of the address each connection is actually made to,
+// which a Failover may have changed. It lets consul-template, which only lets
+// its dialer be customized, and so does TLS itself over whichever connection
+// it's given, connect to Vault over TLS through a Failover: it's given the
+// TLSDialer with a plain http address.
+type TLSDialer struct {
+	dial   func(ctx context.Context, network, addr string) (net.Conn, error)
+	config *tls.Config
+}
+
+// NewTLSDialer returns a TLSDialer which connects with dial, and makes TLS
+// connections with config.
+func NewTLSDialer(dial func(ctx context.Context, network, addr string) (net.Conn, error), config *tls.Config) *TLSDialer {
+	if config == nil {
+		config = &tls.Config{}
+	}
+	return &TLSDialer{
+		dial:   dial,
+		config: config,
+	}
+}
+
+// Dial makes a TLS connection to addr.
+func (d *TLSDialer) Dial(network, addr string) (net.Conn, error) {
+	return d.DialContext(context.Background(), network, addr)
+}
+
+// DialContext makes a TLS connection to addr.
+func (d *TLSDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	return dialTLS(ctx, d.dial, d.config, network, addr)
+}
+
+// dialTLS connects to addr with dial, and makes a TLS connection over it with
+// config, whose server name defaults to the host connected to.
+func dialTLS(ctx context.Context, dial func(ctx context.Context, network, addr string) (net.Conn, error), config *tls.Config, network, addr string) (net.Conn, error) {
+	conn, err := dial(ctx, network, addr)
+	if err != nil {
+		return nil, err
+	}
+	tlsConn, err := tlsHandshake(ctx, conn, config, addr)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return tlsConn, nil
+}
+
+// tlsHandshake makes a TLS connection over conn, made to addr, with config.
+// Unless config has a server name, certificates are verified against the
+// host name conn was made to, which is that of addr unless a Failover made
+// it to another address.
+func tlsHandshake(ctx context.Context, conn net.Conn, config *tls.Config, addr string) (net.Conn, error) {
+	config = config.Clone()
+	if config.ServerName == "" {
+		if fc, ok := conn.(*failoverConn); ok {
+			config.ServerName = fc.host
+		} else {
+			host, _, err := net.SplitHostPort(addr)
+			if err != nil {
+				return nil, err
+			}
+			config.ServerName = host
+		}
+	}
+	tlsConn := tls.Client(conn, config)
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		return nil, err
+	}
+	return tlsConn, nil
+}
+
+// handles returns whether addr is the host and port of any of the addresses.
+func (f *Failover) handles(addr string) bool {
+	for _, u := range f.addresses {
+		if hostPort(u) == addr {
+			return true
+		}
+	}
+	return false
+}
+
+func (f *Failover) activeIndex() int {
+	f.l.Lock()
+	defer f.l.Unlock()
+	return f.active
+}
+
+// failover health checks the addresses other than the failed one, in order,
+// and switches to the first healthy one. It returns false if none are.
+func (f *Failover) failover(ctx context.Context, failed int, dialErr error) (int, bool) {
+	f.probeLock.Lock()
+	defer f.probeLock.Unlock()
+
+	// Another connection may have failed over while this one waited
+	if active := f.activeIndex(); active != failed {
+		return active, true
+	}
+
+	f.logger.Warn("error connecting to Vault, probing other addresses", "address", f.addresses[failed].String(), "error", dialErr)
+	for idx, u := range f.addresses {
+		if idx == failed {
+			continue
+		}
+		if err := f.probe(ctx, u); err != nil {
+			f.logger.Debug("address failed health check", "address", u.String(), "error", err)
+			continue
+		}
+		f.setActive(failed, idx, dialErr)
+		return idx, true
+	}
+
+	f.logger.Error("no Vault address is healthy", "error", dialErr)
+	return failed, false
+}
+
+// probe returns an error unless the Vault at u reports itself healthy, as an
+// unsealed active, standby or performance standby node.
+func (f *Failover) probe(ctx context.Context, u *url.URL) error {
+	ctx, cancel := context.WithTimeout(ctx, f.probeTimeout)
+	defer cancel()
+
+	healthURL := u.JoinPath("v1", "sys", "health")
+	healthURL.RawQuery = "standbyok=true&perfstandbyok=true"
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, healthURL.String(), nil)
+	if err != nil {
+		return err
+	}
+	resp, err := f.probeClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("health check responded with %s", resp.Status)
+	}
+	return nil
+}
+
+// setActive switches to the address at index to, and emits an event.
+func (f *Failover) setActive(from, to int, err error) {
+	f.l.Lock()
+	f.active = to
+	f.l.Unlock()
+
+	event := FailoverEvent{
+		From:  f.addresses[from].String(),
+		To:    f.addresses[to].String(),
+		Time:  time.Now(),
+		Error: err,
+	}
+	f.logger.Warn("failed over to another Vault address", "from", event.From, "to", event.To)
+	if f.metricsSignifier != "" {
+		metrics.IncrCounterWithLabels([]string{f.metricsSignifier, "failover"}, 1, []metrics.Label{{Name: "address", Value: event.To}})
+	}
+
+	if !f.enableEventCh {
+		return
+	}
+	select {
+	case f.EventCh <- event:
+	default:
+		f.logger.Warn("failover event channel full, dropping event", "address", event.To)
+	}
+}
+
+// newProbeClient returns a client for health checks which connects with dial,
+// bypassing the failover, and never follows redirects to another node.
+func (f *Failover) newProbeClient(dial func(ctx context.Context, network, addr string) (net.Conn, error), tlsConfig *tls.Config) *http.Client {
+	if tlsConfig != nil {
+		tlsConfig = tlsConfig.Clone()
+	}
+	return &http.Client{
+		Transport: &http.Transport{
+			DialContext:       dial,
+			TLSClientConfig:   tlsConfig,
+			DisableKeepAlives: true,
+		},
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+}
+
+// hostPort returns the host and port to connect to for u.
+func hostPort(u *url.URL) string {
+	if u.Port() != "" {
+		return u.Host
+	}
+	port := "80"
+	if u.Scheme == "https" {
+		port = "443"
+	}
+	return net.JoinHostPort(u.Hostname(), port)
+}
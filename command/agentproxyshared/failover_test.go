@@ -0,0 +1,180 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: BUSL-1.1
+
+package agentproxyshared
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/hashicorp/vault/api"
+)
+
+// TestFailover tests that a client's connections fail over to the first
+// healthy address when the one in use can't be reached, and stay with it.
+func TestFailover(t *testing.T) {
+	// An address nothing is listening on
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	down := "http://" + ln.Addr().String()
+	ln.Close()
+
+	sealed := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer sealed.Close()
+
+	var requests int
+	healthy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/sys/health" {
+			requests++
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"data": {"foo": "bar"}}`))
+	}))
+	defer healthy.Close()
+
+	f, err := NewFailover(&FailoverConfig{
+		Addresses:     []string{down, sealed.URL, healthy.URL},
+		EnableEventCh: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config := api.DefaultConfig()
+	config.Address = down
+	config.MaxRetries = 0
+	client, err := api.NewClient(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := f.InstallOnClient(client); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 2; i++ {
+		secret, err := client.Logical().Read("secret/foo")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if secret == nil || secret.Data["foo"] != "bar" {
+			t.Fatalf("unexpected response: %#v", secret)
+		}
+	}
+	if requests != 2 {
+		t.Fatalf("expected 2 requests to the healthy address, got %d", requests)
+	}
+	if f.Active() != healthy.URL {
+		t.Fatalf("expected %s to be active, got %s", healthy.URL, f.Active())
+	}
+
+	select {
+	case event := <-f.EventCh:
+		if event.From != down || event.To != healthy.URL || event.Error == nil {
+			t.Fatalf("unexpected event: %#v", event)
+		}
+	default:
+		t.Fatal("expected failover event")
+	}
+	select {
+	case event := <-f.EventCh:
+		t.Fatalf("unexpected second event: %#v", event)
+	default:
+	}
+
+	// With no healthy address, the original error is returned
+	healthy.Close()
+	if _, err := client.Logical().Read("secret/foo"); err == nil {
+		t.Fatal("expected error with no healthy address")
+	}
+	if f.Active() != healthy.URL {
+		t.Fatalf("expected %s to stay active, got %s", healthy.URL, f.Active())
+	}
+
+	if _, err := NewFailover(&FailoverConfig{
+		Addresses: []string{"https://vault-a:8200", "http://vault-b:8200"},
+	}); err == nil {
+		t.Fatal("expected error for addresses with different schemes")
+	}
+}
+
+// TestFailover_TLS tests that once a client has failed over to an address
+// with another host name, certificates are verified against that host name
+// rather than the one the client was configured with, both with the client's
+// own transport and with a TLSDialer.
+func TestFailover_TLS(t *testing.T) {
+	// An address nothing is listening on, named differently from the healthy
+	// one, whose certificate is only valid for 127.0.0.1
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, port, err := net.SplitHostPort(ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	down := "https://localhost:" + port
+	ln.Close()
+
+	healthy := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"data": {"foo": "bar"}}`))
+	}))
+	defer healthy.Close()
+	roots := x509.NewCertPool()
+	roots.AddCert(healthy.Certificate())
+
+	f, err := NewFailover(&FailoverConfig{
+		Addresses: []string{down, healthy.URL},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config := api.DefaultConfig()
+	config.Address = down
+	config.MaxRetries = 0
+	config.HttpClient.Transport.(*http.Transport).TLSClientConfig = &tls.Config{RootCAs: roots}
+	client, err := api.NewClient(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := f.InstallOnClient(client); err != nil {
+		t.Fatal(err)
+	}
+
+	secret, err := client.Logical().Read("secret/foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if secret == nil || secret.Data["foo"] != "bar" {
+		t.Fatalf("unexpected response: %#v", secret)
+	}
+
+	// consul-template is given a plain http address, and does no TLS itself
+	dialer := NewTLSDialer(f.DialContext, &tls.Config{RootCAs: roots})
+	httpClient := &http.Client{
+		Transport: &http.Transport{DialContext: dialer.DialContext},
+	}
+	resp, err := httpClient.Get("http://localhost:" + port + "/v1/secret/foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("unexpected status: %s", resp.Status)
+	}
+
+	// A configured server name is still used
+	dialer = NewTLSDialer(f.DialContext, &tls.Config{RootCAs: roots, ServerName: "localhost"})
+	if _, err := dialer.Dial("tcp", "localhost:"+port); err == nil {
+		t.Fatal("expected certificate verification to fail for the configured server name")
+	}
+}
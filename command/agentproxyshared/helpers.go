@@ -25,7 +25,9 @@ import (
 	"github.com/hashicorp/vault/command/agentproxyshared/auth/kubernetes"
 	"github.com/hashicorp/vault/command/agentproxyshared/auth/ldap"
 	"github.com/hashicorp/vault/command/agentproxyshared/auth/oci"
+	"github.com/hashicorp/vault/command/agentproxyshared/auth/oidc"
 	token_file "github.com/hashicorp/vault/command/agentproxyshared/auth/token-file"
+	tpm_file "github.com/hashicorp/vault/command/agentproxyshared/auth/tpm-file"
 	"github.com/hashicorp/vault/command/agentproxyshared/cache"
 	"github.com/hashicorp/vault/command/agentproxyshared/cache/cacheboltdb"
 	"github.com/hashicorp/vault/command/agentproxyshared/cache/cachememdb"
@@ -59,8 +61,12 @@ func GetAutoAuthMethodFromConfig(autoAuthMethodType string, authConfig *auth.Aut
 		return approle.NewApproleAuthMethod(authConfig)
 	case "oci":
 		return oci.NewOCIAuthMethod(authConfig, vaultAddress)
+	case "oidc":
+		return oidc.NewOIDCAuthMethod(authConfig)
 	case "token_file":
 		return token_file.NewTokenFileAuthMethod(authConfig)
+	case "tpm_file":
+		return tpm_file.NewTPMFileAuthMethod(authConfig)
 	case "pcf": // Deprecated.
 		return cf.NewCFAuthMethod(authConfig)
 	case "ldap":
@@ -0,0 +1,77 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: BUSL-1.1
+
+// Package hookcontext provides the context values passed to user supplied
+// hooks, such as custom sinks and template renderers, so that they can make
+// requests to Vault with the current auto-auth token without building their
+// own client.
+package hookcontext
+
+import (
+	"context"
+
+	"github.com/hashicorp/vault/api"
+)
+
+type contextKey int
+
+const (
+	tokenKey contextKey = iota
+	clientKey
+	renewedKey
+)
+
+// WithToken returns a copy of ctx carrying the current auto-auth token.
+func WithToken(ctx context.Context, token string) context.Context {
+	return context.WithValue(ctx, tokenKey, token)
+}
+
+// Token returns the auto-auth token carried by ctx, if any.
+func Token(ctx context.Context) (string, bool) {
+	token, ok := ctx.Value(tokenKey).(string)
+	return token, ok && token != ""
+}
+
+// WithRenewed returns a copy of ctx recording whether its token is the same
+// token as was delivered before, such as one re-read by the token_file auth
+// method, rather than a newly issued one.
+func WithRenewed(ctx context.Context, renewed bool) context.Context {
+	return context.WithValue(ctx, renewedKey, renewed)
+}
+
+// Renewed returns whether the token carried by ctx is the same token as was
+// delivered before, rather than a newly issued one, so that hooks can skip
+// work that's only needed for a new token, such as registering it.
+func Renewed(ctx context.Context) bool {
+	renewed, _ := ctx.Value(renewedKey).(bool)
+	return renewed
+}
+
+// WithClient returns a copy of ctx carrying a client authenticated with the
+// current auto-auth token.
+func WithClient(ctx context.Context, client *api.Client) context.Context {
+	return context.WithValue(ctx, clientKey, client)
+}
+
+// Client returns the authenticated client carried by ctx, if any. A new client
+// is created for each token, so it's never authenticated with a stale one.
+func Client(ctx context.Context) (*api.Client, bool) {
+	client, ok := ctx.Value(clientKey).(*api.Client)
+	return client, ok && client != nil
+}
+
+// New returns a copy of ctx carrying token and, if client isn't nil, a clone of
+// client authenticated with token.
+func New(ctx context.Context, client *api.Client, token string) (context.Context, error) {
+	ctx = WithToken(ctx, token)
+	if client == nil {
+		return ctx, nil
+	}
+
+	hookClient, err := client.CloneWithHeaders()
+	if err != nil {
+		return nil, err
+	}
+	hookClient.SetToken(token)
+	return WithClient(ctx, hookClient), nil
+}
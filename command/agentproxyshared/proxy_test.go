@@ -0,0 +1,168 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: BUSL-1.1
+
+package agentproxyshared
+
+import (
+	"context"
+	"encoding/base64"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+
+	"github.com/hashicorp/vault/api"
+)
+
+// stubProxy is an HTTP proxy which requires basic authentication, and counts
+// the requests it proxies, both plain and tunneled with CONNECT.
+type stubProxy struct {
+	*httptest.Server
+	requests atomic.Int32
+	connects atomic.Int32
+}
+
+func newStubProxy(t *testing.T, username, password string) *stubProxy {
+	t.Helper()
+	p := &stubProxy{}
+	auth := "Basic " + base64.StdEncoding.EncodeToString([]byte(username+":"+password))
+	p.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Proxy-Authorization") != auth {
+			w.WriteHeader(http.StatusProxyAuthRequired)
+			return
+		}
+
+		if r.Method == http.MethodConnect {
+			p.connects.Add(1)
+			upstream, err := net.Dial("tcp", r.Host)
+			if err != nil {
+				w.WriteHeader(http.StatusBadGateway)
+				return
+			}
+			defer upstream.Close()
+			conn, buf, err := w.(http.Hijacker).Hijack()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+			conn.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n"))
+			go io.Copy(upstream, buf)
+			io.Copy(conn, upstream)
+			return
+		}
+
+		p.requests.Add(1)
+		outReq := r.Clone(r.Context())
+		outReq.RequestURI = ""
+		outReq.Header.Del("Proxy-Authorization")
+		resp, err := http.DefaultTransport.RoundTrip(outReq)
+		if err != nil {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		defer resp.Body.Close()
+		for k, v := range resp.Header {
+			w.Header()[k] = v
+		}
+		w.WriteHeader(resp.StatusCode)
+		io.Copy(w, resp.Body)
+	}))
+	t.Cleanup(p.Close)
+	return p
+}
+
+func newStubVault(t *testing.T) *httptest.Server {
+	t.Helper()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"data": {"foo": "bar"}}`))
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+// TestConfigureProxy tests that a client configured with a proxy URL makes
+// its requests through the proxy, authenticating with the URL's credentials.
+func TestConfigureProxy(t *testing.T) {
+	vault := newStubVault(t)
+	proxy := newStubProxy(t, "user", "pass")
+
+	newClient := func(proxyURL string) *api.Client {
+		config := api.DefaultConfig()
+		config.Address = vault.URL
+		config.MaxRetries = 0
+		client, err := api.NewClient(config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := ConfigureProxy(client, proxyURL); err != nil {
+			t.Fatal(err)
+		}
+		return client
+	}
+
+	client := newClient("http://user:pass@" + proxy.Listener.Addr().String())
+	secret, err := client.Logical().Read("secret/foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if secret == nil || secret.Data["foo"] != "bar" {
+		t.Fatalf("unexpected response: %#v", secret)
+	}
+	if proxy.requests.Load() != 1 {
+		t.Fatalf("expected 1 request through the proxy, got %d", proxy.requests.Load())
+	}
+
+	client = newClient("http://user:wrong@" + proxy.Listener.Addr().String())
+	if _, err := client.Logical().Read("secret/foo"); err == nil {
+		t.Fatal("expected error with the wrong proxy credentials")
+	}
+
+	if err := ConfigureProxy(newClient(""), "socks5://"+proxy.Listener.Addr().String()); err == nil {
+		t.Fatal("expected error for a proxy URL with an unsupported scheme")
+	}
+}
+
+// TestProxyDialer tests that the dialer tunnels connections through the
+// proxy with CONNECT, authenticating with the URL's credentials.
+func TestProxyDialer(t *testing.T) {
+	vault := newStubVault(t)
+	proxy := newStubProxy(t, "user", "pass")
+
+	get := func(proxyURL string) (*http.Response, error) {
+		dialer, err := NewProxyDialer(proxyURL, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		client := &http.Client{Transport: &http.Transport{DialContext: dialer.DialContext}}
+		return client.Get(vault.URL + "/v1/secret/foo")
+	}
+
+	resp, err := get("http://user:pass@" + proxy.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", resp.StatusCode)
+	}
+	if proxy.connects.Load() != 1 {
+		t.Fatalf("expected 1 connection through the proxy, got %d", proxy.connects.Load())
+	}
+
+	if _, err := get("http://user:wrong@" + proxy.Listener.Addr().String()); err == nil {
+		t.Fatal("expected error with the wrong proxy credentials")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	dialer, err := NewProxyDialer("http://"+proxy.Listener.Addr().String(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := dialer.DialContext(ctx, "tcp", vault.Listener.Addr().String()); err == nil {
+		t.Fatal("expected error with a cancelled context")
+	}
+}
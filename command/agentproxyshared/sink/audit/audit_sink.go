@@ -0,0 +1,267 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: BUSL-1.1
+
+package audit
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	hclog "github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/go-secure-stdlib/parseutil"
+	"github.com/hashicorp/go-uuid"
+	"github.com/hashicorp/vault/command/agentproxyshared/hookcontext"
+	"github.com/hashicorp/vault/command/agentproxyshared/sink"
+	"github.com/hashicorp/vault/helper/osutil"
+)
+
+// auditSink is a Sink implementation that appends a record of each new token
+// to a file, as a JSON object on its own line, for a local audit trail of
+// token rotation. The token itself is never written, only its accessor, which
+// is looked up with the client passed in the context by the SinkServer.
+//
+// The file is never truncated. If rotateBytes is set, once the file reaches
+// that size, it's renamed with the time added to its name, as Vault's own log
+// files are, and a new file started, keeping at most rotateMaxFiles of the
+// renamed files, if set.
+type auditSink struct {
+	logger         hclog.Logger
+	path           string
+	rotateBytes    int64
+	rotateMaxFiles int
+
+	l    sync.Mutex
+	file *os.File
+	size int64
+}
+
+var _ sink.ContextSink = (*auditSink)(nil)
+
+// Record is the record of a token written to the audit sink.
+type Record struct {
+	Time     time.Time `json:"time"`
+	Accessor string    `json:"accessor"`
+	// LeaseDuration is the token's TTL, in seconds, when it was delivered
+	LeaseDuration int64 `json:"lease_duration"`
+	// CorrelationID is the ID of the request with which the token was
+	// looked up, which identifies the lookup in Vault's audit log, or if
+	// Vault didn't return one, a random UUID
+	CorrelationID string `json:"correlation_id"`
+}
+
+// NewAuditSink creates a new audit sink with the given configuration. The
+// file is created, if it doesn't exist, when the first token is written.
+func NewAuditSink(conf *sink.SinkConfig) (sink.Sink, error) {
+	if conf.Logger == nil {
+		return nil, errors.New("nil logger provided")
+	}
+
+	conf.Logger.Info("creating audit sink")
+
+	a := &auditSink{
+		logger: conf.Logger,
+	}
+
+	pathRaw, ok := conf.Config["path"]
+	if !ok {
+		return nil, errors.New("'path' not specified for audit sink")
+	}
+	path, ok := pathRaw.(string)
+	if !ok || path == "" {
+		return nil, errors.New("could not parse 'path' as string")
+	}
+	path, err := osutil.ExpandEnv(path)
+	if err != nil {
+		return nil, fmt.Errorf("could not expand 'path': %w", err)
+	}
+	a.path = path
+
+	if rotateBytesRaw, ok := conf.Config["rotate_bytes"]; ok {
+		rotateBytes, err := parseutil.SafeParseInt(rotateBytesRaw)
+		if err != nil {
+			return nil, fmt.Errorf("could not parse 'rotate_bytes': %w", err)
+		}
+		if rotateBytes < 0 {
+			return nil, errors.New("'rotate_bytes' must not be negative")
+		}
+		a.rotateBytes = int64(rotateBytes)
+	}
+
+	if rotateMaxFilesRaw, ok := conf.Config["rotate_max_files"]; ok {
+		rotateMaxFiles, err := parseutil.SafeParseInt(rotateMaxFilesRaw)
+		if err != nil {
+			return nil, fmt.Errorf("could not parse 'rotate_max_files': %w", err)
+		}
+		if rotateMaxFiles < 0 {
+			return nil, errors.New("'rotate_max_files' must not be negative")
+		}
+		a.rotateMaxFiles = rotateMaxFiles
+	}
+
+	a.logger.Info("audit sink configured", "path", a.path, "rotate_bytes", a.rotateBytes, "rotate_max_files", a.rotateMaxFiles)
+
+	return a, nil
+}
+
+// WriteToken implements the Sink interface. It always fails, as the audit
+// sink needs a client to look up the token's accessor with, which is only
+// passed to WriteTokenWithContext.
+func (a *auditSink) WriteToken(token string) error {
+	return a.WriteTokenWithContext(context.Background(), token)
+}
+
+// WriteTokenWithContext implements the ContextSink interface, appending a
+// record of the token to the file. The token is looked up with the client in
+// ctx, rather than the token given, which may have been response-wrapped or
+// encrypted.
+func (a *auditSink) WriteTokenWithContext(ctx context.Context, _ string) error {
+	a.logger.Trace("enter write_token", "path", a.path)
+	defer a.logger.Trace("exit write_token", "path", a.path)
+
+	client, ok := hookcontext.Client(ctx)
+	if !ok {
+		return errors.New("no client to look up the token with, not writing out to audit sink")
+	}
+	secret, err := client.Auth().Token().LookupSelfWithContext(ctx)
+	if err != nil {
+		return fmt.Errorf("error looking up token, not writing out to audit sink: %w", err)
+	}
+	accessor, err := secret.TokenAccessor()
+	if err != nil {
+		return fmt.Errorf("error reading token's accessor, not writing out to audit sink: %w", err)
+	}
+	ttl, err := secret.TokenTTL()
+	if err != nil {
+		return fmt.Errorf("error reading token's TTL, not writing out to audit sink: %w", err)
+	}
+	correlationID := secret.RequestID
+	if correlationID == "" {
+		if correlationID, err = uuid.GenerateUUID(); err != nil {
+			return fmt.Errorf("error generating correlation ID: %w", err)
+		}
+	}
+
+	line, err := json.Marshal(&Record{
+		Time:          time.Now().UTC(),
+		Accessor:      accessor,
+		LeaseDuration: int64(ttl.Seconds()),
+		CorrelationID: correlationID,
+	})
+	if err != nil {
+		return fmt.Errorf("error encoding audit record: %w", err)
+	}
+	line = append(line, '\n')
+
+	a.l.Lock()
+	defer a.l.Unlock()
+	if err := a.append(line); err != nil {
+		return err
+	}
+
+	a.logger.Info("token rotation recorded", "path", a.path, "correlation_id", correlationID)
+	return nil
+}
+
+// append writes line to the end of the file, in one call, so that a record is
+// never split, rotating the file first if it would grow beyond rotateBytes.
+func (a *auditSink) append(line []byte) error {
+	if a.file != nil && a.rotateBytes > 0 && a.size > 0 && a.size+int64(len(line)) > a.rotateBytes {
+		if err := a.rotate(); err != nil {
+			return fmt.Errorf("error rotating audit file: %w", err)
+		}
+	}
+	if a.file == nil {
+		if err := a.open(); err != nil {
+			return fmt.Errorf("error opening audit file: %w", err)
+		}
+	}
+
+	n, err := a.file.Write(line)
+	a.size += int64(n)
+	if err != nil {
+		return fmt.Errorf("error writing audit record: %w", err)
+	}
+	if err := a.file.Sync(); err != nil {
+		return fmt.Errorf("error syncing audit file: %w", err)
+	}
+	return nil
+}
+
+// open opens the file for appending, creating it if needed.
+func (a *auditSink) open() error {
+	f, err := os.OpenFile(a.path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o600)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	a.file, a.size = f, info.Size()
+	return nil
+}
+
+// rotate closes the file and renames it with the current time added to its
+// name, e.g. "audit-1700000000000000000.log" for "audit.log", pruning the
+// oldest renamed files beyond rotateMaxFiles. The next write opens a new file.
+func (a *auditSink) rotate() error {
+	if err := a.file.Close(); err != nil {
+		return err
+	}
+	a.file, a.size = nil, 0
+
+	pattern := a.rotatedNamePattern()
+	if err := os.Rename(a.path, fmt.Sprintf(pattern, strconv.FormatInt(time.Now().UnixNano(), 10))); err != nil {
+		return err
+	}
+	if a.rotateMaxFiles == 0 {
+		return nil
+	}
+
+	matches, err := filepath.Glob(fmt.Sprintf(pattern, "*"))
+	if err != nil {
+		return err
+	}
+	if len(matches) <= a.rotateMaxFiles {
+		return nil
+	}
+	sort.Strings(matches)
+	for _, match := range matches[:len(matches)-a.rotateMaxFiles] {
+		if err := os.Remove(match); err != nil {
+			a.logger.Warn("error removing rotated audit file", "path", match, "error", err)
+		}
+	}
+	return nil
+}
+
+// rotatedNamePattern returns the pattern of the names of rotated files, with
+// the time given as the one argument.
+func (a *auditSink) rotatedNamePattern() string {
+	ext := filepath.Ext(a.path)
+	if ext == "" {
+		ext = ".log"
+	}
+	return strings.ReplaceAll(strings.TrimSuffix(a.path, filepath.Ext(a.path)), "%", "%%") + "-%s" + ext
+}
+
+// Close implements io.Closer, closing the file.
+func (a *auditSink) Close() error {
+	a.l.Lock()
+	defer a.l.Unlock()
+	if a.file == nil {
+		return nil
+	}
+	err := a.file.Close()
+	a.file = nil
+	return err
+}
@@ -0,0 +1,172 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: BUSL-1.1
+
+package audit
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	hclog "github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/vault/api"
+	"github.com/hashicorp/vault/command/agentproxyshared/hookcontext"
+	"github.com/hashicorp/vault/command/agentproxyshared/sink"
+	"github.com/hashicorp/vault/sdk/helper/logging"
+)
+
+func newTestAuditSink(t *testing.T, config map[string]interface{}) sink.ContextSink {
+	t.Helper()
+	s, err := NewAuditSink(&sink.SinkConfig{
+		Logger: logging.NewVaultLogger(hclog.Trace).Named("sink.audit"),
+		Config: config,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.(io.Closer).Close() })
+	return s.(sink.ContextSink)
+}
+
+// newTestContext returns the context the SinkServer would pass when writing
+// token, with a client for a server which answers lookups of it.
+func newTestContext(t *testing.T, token string) context.Context {
+	t.Helper()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/auth/token/lookup-self" || r.Header.Get("X-Vault-Token") != token {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"request_id": "request-` + token + `", "data": {"accessor": "accessor-` + token + `", "ttl": 3600}}`))
+	}))
+	t.Cleanup(server.Close)
+
+	config := api.DefaultConfig()
+	config.Address = server.URL
+	client, err := api.NewClient(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, err := hookcontext.New(context.Background(), client, token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ctx
+}
+
+func readRecords(t *testing.T, path string) []Record {
+	t.Helper()
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	var records []Record
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var record Record
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			t.Fatal(err)
+		}
+		records = append(records, record)
+	}
+	if err := scanner.Err(); err != nil {
+		t.Fatal(err)
+	}
+	return records
+}
+
+// TestAuditSink tests that a record of each token is appended to the file,
+// including after the sink is recreated, without the token itself.
+func TestAuditSink(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	config := map[string]interface{}{"path": path}
+
+	s := newTestAuditSink(t, config)
+	if err := s.WriteTokenWithContext(newTestContext(t, "token-1"), "token-1"); err != nil {
+		t.Fatal(err)
+	}
+	s.(io.Closer).Close()
+
+	s = newTestAuditSink(t, config)
+	if err := s.WriteTokenWithContext(newTestContext(t, "token-2"), "token-2"); err != nil {
+		t.Fatal(err)
+	}
+
+	records := readRecords(t, path)
+	if len(records) != 2 {
+		t.Fatalf("expected 2 records, got %d", len(records))
+	}
+	for idx, token := range []string{"token-1", "token-2"} {
+		record := records[idx]
+		if record.Accessor != "accessor-"+token || record.CorrelationID != "request-"+token || record.LeaseDuration != 3600 || record.Time.IsZero() {
+			t.Fatalf("unexpected record %#v", record)
+		}
+	}
+
+	contents, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(contents), `"token-`) {
+		t.Fatalf("expected no token in the audit file, got %q", contents)
+	}
+
+	if err := s.WriteToken("token-3"); err == nil {
+		t.Fatal("expected error writing without a client")
+	}
+}
+
+// TestAuditSink_Rotate tests that the file is rotated once it would grow
+// beyond rotate_bytes, keeping at most rotate_max_files rotated files.
+func TestAuditSink_Rotate(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "audit.log")
+	s := newTestAuditSink(t, map[string]interface{}{
+		"path":             path,
+		"rotate_bytes":     "10",
+		"rotate_max_files": 2,
+	})
+
+	tokens := []string{"token-1", "token-2", "token-3", "token-4"}
+	for _, token := range tokens {
+		if err := s.WriteTokenWithContext(newTestContext(t, token), token); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Each record is larger than rotate_bytes, so is written to its own file
+	records := readRecords(t, path)
+	if len(records) != 1 || records[0].Accessor != "accessor-token-4" {
+		t.Fatalf("unexpected records %#v", records)
+	}
+	rotated, err := filepath.Glob(filepath.Join(dir, "audit-*.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rotated) != 2 {
+		t.Fatalf("expected 2 rotated files, got %v", rotated)
+	}
+	if records := readRecords(t, rotated[1]); len(records) != 1 || records[0].Accessor != "accessor-token-3" {
+		t.Fatalf("unexpected records in newest rotated file %#v", records)
+	}
+
+	for _, config := range []map[string]interface{}{
+		{},
+		{"path": path, "rotate_bytes": -1},
+		{"path": path, "rotate_max_files": "many"},
+	} {
+		if _, err := NewAuditSink(&sink.SinkConfig{Logger: hclog.NewNullLogger(), Config: config}); err == nil {
+			t.Fatalf("expected error for config %v", config)
+		}
+	}
+}
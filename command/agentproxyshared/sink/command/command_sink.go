@@ -0,0 +1,160 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: BUSL-1.1
+
+package command
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	hclog "github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/vault/command/agentproxyshared/sink"
+	"github.com/hashicorp/vault/sdk/helper/parseutil"
+)
+
+const (
+	// TokenDeliveryEnv passes the token to the command in an environment
+	// variable.
+	TokenDeliveryEnv = "env"
+
+	// TokenDeliveryStdin passes the token to the command on its standard
+	// input.
+	TokenDeliveryStdin = "stdin"
+
+	defaultEnvVar  = "VAULT_TOKEN"
+	defaultTimeout = 30 * time.Second
+)
+
+// commandSink is a Sink implementation that runs a command each time a new
+// token is written to it, for processes that want to be told about a new
+// token rather than watch a file.
+type commandSink struct {
+	logger        hclog.Logger
+	command       []string
+	tokenDelivery string
+	envVar        string
+	timeout       time.Duration
+}
+
+var _ sink.ContextSink = (*commandSink)(nil)
+
+// NewCommandSink creates a new command sink with the given configuration.
+// The command isn't run until a token is written.
+func NewCommandSink(conf *sink.SinkConfig) (sink.Sink, error) {
+	if conf.Logger == nil {
+		return nil, errors.New("nil logger provided")
+	}
+
+	conf.Logger.Info("creating command sink")
+
+	c := &commandSink{
+		logger:        conf.Logger,
+		tokenDelivery: TokenDeliveryEnv,
+		envVar:        defaultEnvVar,
+		timeout:       defaultTimeout,
+	}
+
+	commandRaw, ok := conf.Config["command"]
+	if !ok {
+		return nil, errors.New("'command' not specified for command sink")
+	}
+	switch command := commandRaw.(type) {
+	case string:
+		c.command = []string{command}
+	case []string:
+		c.command = command
+	case []interface{}:
+		for _, arg := range command {
+			s, ok := arg.(string)
+			if !ok {
+				return nil, errors.New("could not parse 'command' as a list of strings")
+			}
+			c.command = append(c.command, s)
+		}
+	default:
+		return nil, errors.New("could not parse 'command' as a string or list of strings")
+	}
+	if len(c.command) == 0 || c.command[0] == "" {
+		return nil, errors.New("'command' is empty")
+	}
+
+	if deliveryRaw, ok := conf.Config["token_delivery"]; ok {
+		c.tokenDelivery, ok = deliveryRaw.(string)
+		if !ok {
+			return nil, errors.New("could not parse 'token_delivery' as string")
+		}
+	}
+	switch c.tokenDelivery {
+	case TokenDeliveryEnv, TokenDeliveryStdin:
+	default:
+		return nil, fmt.Errorf("unknown 'token_delivery' %q, must be %q or %q", c.tokenDelivery, TokenDeliveryEnv, TokenDeliveryStdin)
+	}
+
+	if envVarRaw, ok := conf.Config["env_var"]; ok {
+		c.envVar, ok = envVarRaw.(string)
+		if !ok || c.envVar == "" || strings.Contains(c.envVar, "=") {
+			return nil, errors.New("could not parse 'env_var' as an environment variable name")
+		}
+	}
+
+	if timeoutRaw, ok := conf.Config["timeout"]; ok {
+		timeout, err := parseutil.ParseDurationSecond(timeoutRaw)
+		if err != nil {
+			return nil, fmt.Errorf("could not parse 'timeout': %w", err)
+		}
+		if timeout <= 0 {
+			return nil, errors.New("'timeout' must be positive")
+		}
+		c.timeout = timeout
+	}
+
+	c.logger.Info("command sink configured", "command", c.command[0], "token_delivery", c.tokenDelivery)
+
+	return c, nil
+}
+
+// WriteToken implements the Sink interface, running the command with the
+// token.
+func (c *commandSink) WriteToken(token string) error {
+	return c.WriteTokenWithContext(context.Background(), token)
+}
+
+// WriteTokenWithContext implements the ContextSink interface, running the
+// command with the token. The command is killed if it runs for longer than
+// the timeout, or ctx is done first. Its output is logged, and an error is
+// returned if it fails, so that it's retried.
+func (c *commandSink) WriteTokenWithContext(ctx context.Context, token string) error {
+	c.logger.Trace("enter write_token", "command", c.command[0])
+	defer c.logger.Trace("exit write_token", "command", c.command[0])
+
+	ctx, cancel := context.WithTimeout(ctx, c.timeout)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, c.command[0], c.command[1:]...)
+	cmd.Env = os.Environ()
+	switch c.tokenDelivery {
+	case TokenDeliveryEnv:
+		cmd.Env = append(cmd.Env, c.envVar+"="+token)
+	case TokenDeliveryStdin:
+		cmd.Stdin = strings.NewReader(token)
+	}
+
+	output, err := cmd.CombinedOutput()
+	if len(output) > 0 {
+		c.logger.Info("command output", "command", c.command[0], "output", strings.TrimSpace(string(output)))
+	}
+	if ctx.Err() != nil {
+		return fmt.Errorf("command %s did not complete: %w", c.command[0], ctx.Err())
+	}
+	if err != nil {
+		return fmt.Errorf("command %s failed: %w", c.command[0], err)
+	}
+
+	c.logger.Info("command run with token", "command", c.command[0])
+	return nil
+}
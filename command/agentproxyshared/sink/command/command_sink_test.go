@@ -0,0 +1,110 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: BUSL-1.1
+
+//go:build !windows
+
+package command
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	hclog "github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/vault/command/agentproxyshared/sink"
+	"github.com/hashicorp/vault/sdk/helper/logging"
+)
+
+func newTestCommandSink(t *testing.T, config map[string]interface{}) (sink.Sink, error) {
+	t.Helper()
+	return NewCommandSink(&sink.SinkConfig{
+		Logger: logging.NewVaultLogger(hclog.Trace).Named("sink.command"),
+		Config: config,
+	})
+}
+
+func TestCommandSink(t *testing.T) {
+	for name, tc := range map[string]struct {
+		config map[string]interface{}
+	}{
+		"env": {
+			config: map[string]interface{}{
+				"command": []interface{}{"sh", "-c", `printf %s "$VAULT_TOKEN" > "$OUT"`},
+			},
+		},
+		"env var": {
+			config: map[string]interface{}{
+				"command": []interface{}{"sh", "-c", `printf %s "$MY_TOKEN" > "$OUT"`},
+				"env_var": "MY_TOKEN",
+			},
+		},
+		"stdin": {
+			config: map[string]interface{}{
+				"command":        []interface{}{"sh", "-c", `cat > "$OUT"`},
+				"token_delivery": "stdin",
+			},
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			out := filepath.Join(t.TempDir(), "out")
+			t.Setenv("OUT", out)
+
+			s, err := newTestCommandSink(t, tc.config)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := s.WriteToken("test-token"); err != nil {
+				t.Fatal(err)
+			}
+
+			written, err := os.ReadFile(out)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(written) != "test-token" {
+				t.Fatalf("expected the command to be given test-token, got %q", written)
+			}
+		})
+	}
+}
+
+func TestCommandSink_Errors(t *testing.T) {
+	s, err := newTestCommandSink(t, map[string]interface{}{
+		"command": []interface{}{"sh", "-c", "echo failing; exit 1"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.WriteToken("test-token"); err == nil {
+		t.Fatal("expected error from failing command")
+	}
+
+	s, err = newTestCommandSink(t, map[string]interface{}{
+		"command": []interface{}{"sleep", "10"},
+		"timeout": "100ms",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.WriteToken("test-token"); err == nil {
+		t.Fatal("expected error from command timing out")
+	}
+}
+
+func TestNewCommandSink_InvalidConfig(t *testing.T) {
+	for name, config := range map[string]map[string]interface{}{
+		"no command":       {},
+		"empty command":    {"command": []interface{}{}},
+		"non-string arg":   {"command": []interface{}{"sh", 1}},
+		"unknown delivery": {"command": "true", "token_delivery": "file"},
+		"bad env var":      {"command": "true", "env_var": "A=B"},
+		"bad timeout":      {"command": "true", "timeout": "soon"},
+		"negative timeout": {"command": "true", "timeout": "-1s"},
+	} {
+		t.Run(name, func(t *testing.T) {
+			if _, err := newTestCommandSink(t, config); err == nil {
+				t.Fatal("expected error")
+			}
+		})
+	}
+}
@@ -0,0 +1,58 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: BUSL-1.1
+
+package sink
+
+import "time"
+
+// SinkEventType identifies the kind of a SinkEvent.
+type SinkEventType string
+
+const (
+	// QuorumNotMet is emitted when, after a delivery cycle, fewer sinks hold
+	// the current token than the configured MinSuccessfulSinks.
+	QuorumNotMet SinkEventType = "quorum-not-met"
+	// SinkReadOnly is emitted when writing to a sink first fails with
+	// ErrReadOnly. The sink keeps its last token while it's read-only.
+	SinkReadOnly SinkEventType = "sink-read-only"
+	// SinkRecovered is emitted when a token is written to a sink which was
+	// read-only.
+	SinkRecovered SinkEventType = "sink-recovered"
+	// SinkLocked is emitted when a write to a sink is skipped because its
+	// destination is locked by another writer, such as another agent
+	// misconfigured with the same sink path.
+	SinkLocked SinkEventType = "sink-locked"
+)
+
+// SinkEvent describes a notable occurrence in the delivery of tokens to sinks.
+// Events are delivered on SinkServer.EventCh when EnableEventCh is set.
+type SinkEvent struct {
+	Type SinkEventType
+	Time time.Time
+	// Sink is the name of the sink the event is for, if any; see
+	// SinkConfig.Name.
+	Sink string
+	// Succeeded is the number of sinks the current token has been written
+	// to, and Required the number it must be written to.
+	Succeeded int
+	Required  int
+	// Error is the error which caused the event, if any.
+	Error error
+}
+
+// emitEvent sends an event on EventCh if it is enabled. Events are dropped
+// rather than blocking the sink server if the consumer is not keeping up.
+func (ss *SinkServer) emitEvent(event SinkEvent) {
+	if !ss.enableEventCh {
+		return
+	}
+	if event.Time.IsZero() {
+		event.Time = time.Now()
+	}
+
+	select {
+	case ss.EventCh <- event:
+	default:
+		ss.logger.Warn("sink event channel is full, dropping event", "type", event.Type)
+	}
+}
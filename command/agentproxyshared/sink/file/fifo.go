@@ -0,0 +1,151 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: BUSL-1.1
+
+package file
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	hclog "github.com/hashicorp/go-hclog"
+)
+
+// fifoRetryInterval is how often a pending token is retried while the named
+// pipe has no reader.
+const fifoRetryInterval = 250 * time.Millisecond
+
+// fifoWriter delivers tokens to a named pipe. The latest token is held until a
+// reader opens the pipe, and each token is delivered to a single reader, so
+// that a consumer blocking on the pipe receives exactly one token per
+// rotation.
+type fifoWriter struct {
+	path    string
+	created bool
+	logger  hclog.Logger
+
+	l     sync.Mutex
+	token string
+
+	notifyCh chan struct{}
+	stopCh   chan struct{}
+	doneCh   chan struct{}
+	stopOnce sync.Once
+}
+
+// newFIFOWriter creates the named pipe at path if it doesn't exist, and
+// starts delivering tokens to it.
+func newFIFOWriter(path string, mode os.FileMode, owner, group int, logger hclog.Logger) (*fifoWriter, error) {
+	w := &fifoWriter{
+		path:     path,
+		logger:   logger,
+		notifyCh: make(chan struct{}, 1),
+		stopCh:   make(chan struct{}),
+		doneCh:   make(chan struct{}),
+	}
+
+	fi, err := os.Lstat(path)
+	switch {
+	case os.IsNotExist(err):
+		if err := makeFIFO(path, mode); err != nil {
+			return nil, fmt.Errorf("error creating named pipe %s: %w", path, err)
+		}
+		w.created = true
+		if err := os.Lchown(path, owner, group); err != nil {
+			os.Remove(path)
+			return nil, fmt.Errorf("error changing ownership of %s: %w", path, err)
+		}
+	case err != nil:
+		return nil, fmt.Errorf("error stat-ing %s: %w", path, err)
+	case fi.Mode()&os.ModeNamedPipe == 0:
+		return nil, fmt.Errorf("%s exists and is not a named pipe", path)
+	}
+
+	go w.run()
+
+	return w, nil
+}
+
+// setToken replaces any pending token with the given one, to be delivered
+// when a reader next connects.
+func (w *fifoWriter) setToken(token string) {
+	w.l.Lock()
+	w.token = token
+	w.l.Unlock()
+
+	select {
+	case w.notifyCh <- struct{}{}:
+	default:
+	}
+}
+
+func (w *fifoWriter) run() {
+	defer close(w.doneCh)
+
+	for {
+		select {
+		case <-w.stopCh:
+			return
+		case <-w.notifyCh:
+		}
+
+		for {
+			w.l.Lock()
+			token := w.token
+			w.l.Unlock()
+			if token == "" {
+				break
+			}
+
+			err := writeFIFO(w.path, token)
+			if err == nil {
+				w.l.Lock()
+				if w.token == token {
+					w.token = ""
+				}
+				w.l.Unlock()
+				w.logger.Info("token written", "path", w.path)
+				continue
+			}
+			if !isNoReader(err) {
+				w.logger.Error("error writing token to named pipe, retrying", "path", w.path, "error", err)
+			}
+
+			select {
+			case <-w.stopCh:
+				return
+			case <-time.After(fifoRetryInterval):
+			}
+		}
+	}
+}
+
+// stop stops delivering tokens, discarding any that are pending, and removes
+// the named pipe if it was created by the writer.
+func (w *fifoWriter) stop() {
+	w.stopOnce.Do(func() {
+		close(w.stopCh)
+		<-w.doneCh
+		if w.created {
+			if err := os.Remove(w.path); err != nil && !os.IsNotExist(err) {
+				w.logger.Warn("error removing named pipe", "path", w.path, "error", err)
+			}
+		}
+	})
+}
+
+// stagedFIFOToken implements sink.StagedToken for sinks writing to a named
+// pipe. There's no temporary location to stage to, so committing simply
+// queues the token for delivery.
+type stagedFIFOToken struct {
+	w     *fifoWriter
+	token string
+}
+
+func (s *stagedFIFOToken) Commit(bool) error {
+	s.w.setToken(s.token)
+	return nil
+}
+
+func (s *stagedFIFOToken) Discard() {}
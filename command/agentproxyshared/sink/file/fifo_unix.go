@@ -0,0 +1,36 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: BUSL-1.1
+
+//go:build !windows
+
+package file
+
+import (
+	"errors"
+	"os"
+	"syscall"
+)
+
+func makeFIFO(path string, mode os.FileMode) error {
+	return syscall.Mkfifo(path, uint32(mode.Perm()))
+}
+
+// writeFIFO writes the token to the named pipe if it currently has a reader.
+// Opening the pipe is non-blocking, so ENXIO is returned when there is none.
+func writeFIFO(path, token string) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|syscall.O_NONBLOCK, 0)
+	if err != nil {
+		return err
+	}
+
+	_, err = f.WriteString(token)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// isNoReader returns whether the error indicates the named pipe has no reader.
+func isNoReader(err error) bool {
+	return errors.Is(err, syscall.ENXIO)
+}
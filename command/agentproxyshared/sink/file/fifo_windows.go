@@ -0,0 +1,25 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: BUSL-1.1
+
+//go:build windows
+
+package file
+
+import (
+	"errors"
+	"os"
+)
+
+var errFIFOUnsupported = errors.New("named pipe sinks are not supported on windows")
+
+func makeFIFO(string, os.FileMode) error {
+	return errFIFOUnsupported
+}
+
+func writeFIFO(string, string) error {
+	return errFIFOUnsupported
+}
+
+func isNoReader(error) bool {
+	return false
+}
@@ -4,11 +4,15 @@
 package file
 
 import (
+	"bytes"
 	"errors"
 	"fmt"
 	"os"
 	"path/filepath"
+	"runtime"
 	"strings"
+	"sync"
+	"syscall"
 
 	hclog "github.com/hashicorp/go-hclog"
 	uuid "github.com/hashicorp/go-uuid"
@@ -23,8 +27,44 @@ type fileSink struct {
 	owner  int
 	group  int
 	logger hclog.Logger
+
+	// fifo is set if the sink writes to a named pipe rather than a file
+	fifo *fifoWriter
+
+	// lock is set if the sink takes an advisory lock on a file alongside its
+	// path before writing, which it holds until it's closed
+	lock *sinkLock
+
+	// verifyWrite is set if each token written is read back and compared
+	// before it's renamed into place, rewriting it up to verifyWriteRetries
+	// times if it doesn't match
+	verifyWrite        bool
+	verifyWriteRetries int
+}
+
+// sinkLock is the advisory lock held by a fileSink.
+type sinkLock struct {
+	l    sync.Mutex
+	file *os.File
 }
 
+// defaultVerifyWriteRetries is how many times a token which doesn't match when
+// read back is rewritten, if "verify_write" is set and "verify_write_retries"
+// isn't.
+const defaultVerifyWriteRetries = 3
+
+// errWriteMismatch is returned when a token read back from its temp file
+// doesn't match what was written.
+var errWriteMismatch = errors.New("token read back doesn't match what was written")
+
+// readFile reads back written files to verify them. It's replaced in tests to
+// simulate corrupted writes.
+var readFile = os.ReadFile
+
+// LockFileExt is the extension added to a file sink's path to give the path
+// of the file it locks, if configured with "lock".
+const LockFileExt = ".lock"
+
 // NewFileSink creates a new file sink with the given configuration
 func NewFileSink(conf *sink.SinkConfig) (sink.Sink, error) {
 	if conf.Logger == nil {
@@ -34,10 +74,11 @@ func NewFileSink(conf *sink.SinkConfig) (sink.Sink, error) {
 	conf.Logger.Info("creating file sink")
 
 	f := &fileSink{
-		logger: conf.Logger,
-		mode:   0o640,
-		owner:  os.Getuid(),
-		group:  os.Getgid(),
+		logger:             conf.Logger,
+		mode:               0o640,
+		owner:              os.Getuid(),
+		group:              os.Getgid(),
+		verifyWriteRetries: defaultVerifyWriteRetries,
 	}
 
 	pathRaw, ok := conf.Config["path"]
@@ -49,6 +90,10 @@ func NewFileSink(conf *sink.SinkConfig) (sink.Sink, error) {
 		return nil, errors.New("could not parse 'path' as string")
 	}
 
+	path, err := osutil.ExpandEnv(path)
+	if err != nil {
+		return nil, fmt.Errorf("could not expand 'path': %w", err)
+	}
 	f.path = path
 
 	if modeRaw, ok := conf.Config["mode"]; ok {
@@ -86,11 +131,85 @@ func NewFileSink(conf *sink.SinkConfig) (sink.Sink, error) {
 		f.group = group
 	}
 
-	if err := f.WriteToken(""); err != nil {
+	var isFIFO bool
+	if fifoRaw, ok := conf.Config["fifo"]; ok {
+		fifo, typeOK := fifoRaw.(bool)
+		if !typeOK {
+			return nil, errors.New("could not parse 'fifo' as bool")
+		}
+		isFIFO = fifo
+	}
+
+	if lockRaw, ok := conf.Config["lock"]; ok {
+		lock, typeOK := lockRaw.(bool)
+		if !typeOK {
+			return nil, errors.New("could not parse 'lock' as bool")
+		}
+		if lock && isFIFO {
+			return nil, errors.New("'lock' cannot be used with 'fifo'")
+		}
+		if lock && runtime.GOOS == "windows" {
+			return nil, errors.New("'lock' is not supported on windows")
+		}
+		if lock {
+			f.lock = &sinkLock{}
+		}
+	}
+
+	if verifyWriteRaw, ok := conf.Config["verify_write"]; ok {
+		verifyWrite, typeOK := verifyWriteRaw.(bool)
+		if !typeOK {
+			return nil, errors.New("could not parse 'verify_write' as bool")
+		}
+		if verifyWrite && isFIFO {
+			return nil, errors.New("'verify_write' cannot be used with 'fifo'")
+		}
+		f.verifyWrite = verifyWrite
+	}
+
+	if retriesRaw, ok := conf.Config["verify_write_retries"]; ok {
+		retries, typeOK := retriesRaw.(int)
+		if !typeOK {
+			return nil, errors.New("could not parse 'verify_write_retries' as integer")
+		}
+		if retries < 0 {
+			return nil, errors.New("'verify_write_retries' must not be negative")
+		}
+		f.verifyWriteRetries = retries
+	}
+
+	if pathTemplateRaw, ok := conf.Config["path_template"]; ok {
+		pathTemplate, typeOK := pathTemplateRaw.(bool)
+		if !typeOK {
+			return nil, errors.New("could not parse 'path_template' as bool")
+		}
+		if pathTemplate {
+			if isFIFO {
+				return nil, errors.New("'path_template' cannot be used with 'fifo'")
+			}
+			if f.lock != nil {
+				return nil, errors.New("'path_template' cannot be used with 'lock'")
+			}
+			p, err := newPathTemplateSink(f)
+			if err != nil {
+				return nil, err
+			}
+			f.logger.Info("file sink configured", "path_template", f.path, "mode", f.mode, "owner", f.owner, "group", f.group)
+			return p, nil
+		}
+	}
+
+	if isFIFO {
+		fifo, err := newFIFOWriter(f.path, f.mode, f.owner, f.group, f.logger)
+		if err != nil {
+			return nil, err
+		}
+		f.fifo = fifo
+	} else if err := f.WriteToken(""); err != nil {
 		return nil, fmt.Errorf("error during write check: %w", err)
 	}
 
-	f.logger.Info("file sink configured", "path", f.path, "mode", f.mode, "owner", f.owner, "group", f.group)
+	f.logger.Info("file sink configured", "path", f.path, "mode", f.mode, "owner", f.owner, "group", f.group, "fifo", isFIFO, "lock", f.lock != nil, "verify_write", f.verifyWrite)
 
 	return f, nil
 }
@@ -99,14 +218,148 @@ func NewFileSink(conf *sink.SinkConfig) (sink.Sink, error) {
 // disk. It writes into the path's directory into a temp file and does an
 // atomic rename to ensure consistency. If a blank token is passed in, it
 // performs a write check but does not write a blank value to the final
-// location.
+// location. If the sink is a named pipe, the token is instead queued to be
+// written when a reader next opens the pipe.
 func (f *fileSink) WriteToken(token string) error {
 	f.logger.Trace("enter write_token", "path", f.path)
 	defer f.logger.Trace("exit write_token", "path", f.path)
 
+	if f.fifo != nil {
+		if token != "" {
+			f.fifo.setToken(token)
+		}
+		return nil
+	}
+
+	staged, err := f.stageToken(token)
+	if err != nil {
+		return err
+	}
+
+	// Now, if we were just doing a write check (blank token), remove the file
+	// and exit; otherwise, atomically rename it
+	if token == "" {
+		err = os.Remove(staged.tmpPath)
+		if err != nil {
+			return fmt.Errorf("error removing temp file %s during write check: %w", staged.tmpPath, err)
+		}
+		return nil
+	}
+
+	return staged.Commit(false)
+}
+
+// StageToken implements the StagedSink interface and writes the token to a
+// temp file in the path's directory, without renaming it into place.
+func (f *fileSink) StageToken(token string) (sink.StagedToken, error) {
+	if token == "" {
+		return nil, errors.New("cannot stage a blank token")
+	}
+	if f.fifo != nil {
+		return &stagedFIFOToken{w: f.fifo, token: token}, nil
+	}
+	return f.stageToken(token)
+}
+
+// ClearToken implements the ClearableSink interface, removing the token file,
+// or discarding any token waiting to be written to the sink's named pipe.
+func (f *fileSink) ClearToken() error {
+	if f.fifo != nil {
+		f.fifo.setToken("")
+		return nil
+	}
+
+	if err := f.acquireLock(); err != nil {
+		return err
+	}
+	if err := os.Remove(f.path); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("error removing %s: %w", f.path, err)
+	}
+	f.logger.Info("token removed", "path", f.path)
+	return nil
+}
+
+// Close stops writing to the sink's named pipe, if it has one, removing the
+// pipe if the sink created it, and releases the sink's lock, if held.
+func (f *fileSink) Close() error {
+	if f.fifo != nil {
+		f.fifo.stop()
+	}
+
+	if f.lock == nil {
+		return nil
+	}
+	f.lock.l.Lock()
+	defer f.lock.l.Unlock()
+	if f.lock.file != nil {
+		f.lock.file.Close()
+		f.lock.file = nil
+	}
+	return nil
+}
+
+// acquireLock takes an exclusive advisory lock on the sink's lock file, if
+// the sink is configured to lock, and holds it until the sink is closed, so
+// that another agent writing to the same path fails rather than replacing
+// this one's tokens. The lock file is left in place when the lock is
+// released, as removing it would let two writers lock different files.
+func (f *fileSink) acquireLock() error {
+	if f.lock == nil {
+		return nil
+	}
+
+	f.lock.l.Lock()
+	defer f.lock.l.Unlock()
+	if f.lock.file != nil {
+		return nil
+	}
+
+	lockPath := f.path + LockFileExt
+	lockFile, err := os.OpenFile(lockPath, os.O_RDWR|os.O_CREATE, f.mode)
+	if err != nil {
+		return readOnlyError(fmt.Errorf("error opening lock file %s: %w", lockPath, err))
+	}
+	if err := flock(lockFile); err != nil {
+		lockFile.Close()
+		if isLockHeld(err) {
+			return fmt.Errorf("%w: %s is locked, check whether another agent is configured with the sink path %s", sink.ErrLocked, lockPath, f.path)
+		}
+		return fmt.Errorf("error locking %s: %w", lockPath, err)
+	}
+
+	f.logger.Debug("locked sink", "path", lockPath)
+	f.lock.file = lockFile
+	return nil
+}
+
+// stageToken writes the token to a temp file alongside the sink's path, once
+// it holds the sink's lock, if configured. If the token is blank, a random
+// value is written instead for write checks, which don't need the lock. If
+// the sink verifies writes, a temp file which doesn't read back as written is
+// removed and written again, up to verifyWriteRetries times.
+func (f *fileSink) stageToken(token string) (*stagedFile, error) {
+	if token != "" {
+		if err := f.acquireLock(); err != nil {
+			return nil, err
+		}
+	}
+
+	for attempt := 0; ; attempt++ {
+		staged, err := f.writeTempFile(token)
+		if !errors.Is(err, errWriteMismatch) || attempt >= f.verifyWriteRetries {
+			return staged, err
+		}
+		f.logger.Warn("token read back doesn't match what was written, rewriting", "path", f.path, "attempt", attempt+1)
+	}
+}
+
+// writeTempFile writes the token, or a random value if it's blank, to a new
+// temp file alongside the sink's path, reading it back if the sink verifies
+// writes.
+func (f *fileSink) writeTempFile(token string) (*stagedFile, error) {
 	u, err := uuid.GenerateUUID()
 	if err != nil {
-		return fmt.Errorf("error generating a uuid during write check: %w", err)
+		return nil, fmt.Errorf("error generating a uuid during write check: %w", err)
 	}
 
 	targetDir := filepath.Dir(f.path)
@@ -115,11 +368,11 @@ func (f *fileSink) WriteToken(token string) error {
 
 	tmpFile, err := os.OpenFile(filepath.Join(targetDir, fmt.Sprintf("%s.tmp.%s", fileName, tmpSuffix)), os.O_WRONLY|os.O_CREATE, f.mode)
 	if err != nil {
-		return fmt.Errorf("error opening temp file in dir %s for writing: %w", targetDir, err)
+		return nil, readOnlyError(fmt.Errorf("error opening temp file in dir %s for writing: %w", targetDir, err))
 	}
 
 	if err := osutil.Chown(tmpFile, f.owner, f.group); err != nil {
-		return fmt.Errorf("error changing ownership of %s: %w", tmpFile.Name(), err)
+		return nil, fmt.Errorf("error changing ownership of %s: %w", tmpFile.Name(), err)
 	}
 
 	valToWrite := token
@@ -132,29 +385,96 @@ func (f *fileSink) WriteToken(token string) error {
 		// Attempt closing and deleting but ignore any error
 		tmpFile.Close()
 		os.Remove(tmpFile.Name())
-		return fmt.Errorf("error writing to %s: %w", tmpFile.Name(), err)
+		return nil, fmt.Errorf("error writing to %s: %w", tmpFile.Name(), err)
+	}
+
+	if f.verifyWrite {
+		// Flushed first, so that it's read back from storage where possible
+		if err := tmpFile.Sync(); err != nil {
+			tmpFile.Close()
+			os.Remove(tmpFile.Name())
+			return nil, fmt.Errorf("error syncing %s: %w", tmpFile.Name(), err)
+		}
 	}
 
 	err = tmpFile.Close()
 	if err != nil {
-		return fmt.Errorf("error closing %s: %w", tmpFile.Name(), err)
+		return nil, fmt.Errorf("error closing %s: %w", tmpFile.Name(), err)
 	}
 
-	// Now, if we were just doing a write check (blank token), remove the file
-	// and exit; otherwise, atomically rename it
-	if token == "" {
-		err = os.Remove(tmpFile.Name())
+	if f.verifyWrite {
+		written, err := readFile(tmpFile.Name())
+		if err == nil && !bytes.Equal(written, []byte(valToWrite)) {
+			err = errWriteMismatch
+		}
 		if err != nil {
-			return fmt.Errorf("error removing temp file %s during write check: %w", tmpFile.Name(), err)
+			os.Remove(tmpFile.Name())
+			return nil, fmt.Errorf("error verifying %s: %w", tmpFile.Name(), err)
 		}
-		return nil
 	}
 
-	err = os.Rename(tmpFile.Name(), f.path)
+	return &stagedFile{
+		sink:    f,
+		tmpPath: tmpFile.Name(),
+	}, nil
+}
+
+// stagedFile is a token written to a temp file by a fileSink, waiting to be
+// renamed into place.
+type stagedFile struct {
+	sink    *fileSink
+	tmpPath string
+}
+
+// Commit atomically renames the temp file to the sink's path. If sync is
+// true, the directory is fsynced afterwards so that the rename is durable.
+func (s *stagedFile) Commit(sync bool) error {
+	f := s.sink
+	err := os.Rename(s.tmpPath, f.path)
 	if err != nil {
-		return fmt.Errorf("error renaming temp file %s to target file %s: %w", tmpFile.Name(), f.path, err)
+		return readOnlyError(fmt.Errorf("error renaming temp file %s to target file %s: %w", s.tmpPath, f.path, err))
+	}
+
+	if sync {
+		if err := syncDir(filepath.Dir(f.path)); err != nil {
+			return fmt.Errorf("error syncing directory of %s: %w", f.path, err)
+		}
 	}
 
 	f.logger.Info("token written", "path", f.path)
 	return nil
 }
+
+// Discard removes the temp file, ignoring any error.
+func (s *stagedFile) Discard() {
+	os.Remove(s.tmpPath)
+}
+
+// readOnlyError wraps err with sink.ErrReadOnly if it was caused by the
+// sink's directory being on a read-only filesystem, e.g. after a volume has
+// been remounted read-only. The file at the sink's path is left untouched by
+// failed writes, so it keeps the last token written until the filesystem is
+// writable again.
+func readOnlyError(err error) error {
+	if errors.Is(err, syscall.EROFS) {
+		return fmt.Errorf("%w: %w", sink.ErrReadOnly, err)
+	}
+	return err
+}
+
+// syncDir fsyncs a directory, which is required on some platforms to ensure a
+// rename within it has been persisted. Directories can't be synced on
+// Windows, so this is a no-op there.
+func syncDir(dir string) error {
+	if runtime.GOOS == "windows" {
+		return nil
+	}
+
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+
+	return d.Sync()
+}
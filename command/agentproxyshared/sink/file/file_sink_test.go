@@ -4,14 +4,23 @@
 package file
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"path/filepath"
+	"strings"
 	"syscall"
 	"testing"
 
 	hclog "github.com/hashicorp/go-hclog"
 	uuid "github.com/hashicorp/go-uuid"
+	"github.com/hashicorp/vault/api"
+	"github.com/hashicorp/vault/command/agentproxyshared/hookcontext"
 	"github.com/hashicorp/vault/command/agentproxyshared/sink"
+	"github.com/hashicorp/vault/sdk/helper/consts"
 	"github.com/hashicorp/vault/sdk/helper/logging"
 )
 
@@ -76,6 +85,41 @@ func TestFileSink(t *testing.T) {
 	}
 }
 
+func TestFileSinkPathEnv(t *testing.T) {
+	log := logging.NewVaultLogger(hclog.Trace)
+
+	tmpDir := t.TempDir()
+	t.Setenv("FILE_SINK_TEST_DIR", tmpDir)
+
+	config := &sink.SinkConfig{
+		Logger: log.Named("sink.file"),
+		Config: map[string]interface{}{
+			"path": "${FILE_SINK_TEST_DIR}/token",
+		},
+	}
+	fs, err := NewFileSink(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	uuidStr, _ := uuid.GenerateUUID()
+	if err := fs.WriteToken(uuidStr); err != nil {
+		t.Fatal(err)
+	}
+	fileBytes, err := os.ReadFile(filepath.Join(tmpDir, "token"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(fileBytes) != uuidStr {
+		t.Fatalf("expected %s, got %s", uuidStr, string(fileBytes))
+	}
+
+	config.Config["path"] = "${FILE_SINK_TEST_UNDEFINED}/token"
+	if _, err := NewFileSink(config); err == nil || !strings.Contains(err.Error(), "FILE_SINK_TEST_UNDEFINED") {
+		t.Fatalf("expected undefined variable error, got: %v", err)
+	}
+}
+
 func testFileSinkMode(t *testing.T, log hclog.Logger, gid int) (*sink.SinkConfig, string) {
 	tmpDir := t.TempDir()
 
@@ -197,3 +241,257 @@ func TestFileSinkMode_Ownership(t *testing.T) {
 		t.Fatalf("expected %s, got %s", uuidStr, string(fileBytes))
 	}
 }
+
+// TestFileSinkFIFO tests that a file sink configured as a named pipe buffers
+// the latest token until a reader connects, and removes the pipe on close.
+func TestFileSinkFIFO(t *testing.T) {
+	log := logging.NewVaultLogger(hclog.Trace)
+
+	path := filepath.Join(t.TempDir(), "token")
+
+	config := &sink.SinkConfig{
+		Logger: log.Named("sink.file"),
+		Config: map[string]interface{}{
+			"path": path,
+			"fifo": true,
+		},
+	}
+	s, err := NewFileSink(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fi, err := os.Lstat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Mode()&os.ModeNamedPipe == 0 {
+		t.Fatalf("expected %s to be a named pipe, got mode %s", path, fi.Mode())
+	}
+
+	// With no reader connected, only the latest token should be delivered
+	if err := s.WriteToken("first"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.WriteToken("second"); err != nil {
+		t.Fatal(err)
+	}
+
+	fileBytes, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(fileBytes) != "second" {
+		t.Fatalf("expected second, got %s", string(fileBytes))
+	}
+
+	if err := s.(*fileSink).Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Lstat(path); !os.IsNotExist(err) {
+		t.Fatalf("expected named pipe to be removed, got err: %v", err)
+	}
+}
+
+func TestFileSinkPathTemplate(t *testing.T) {
+	log := logging.NewVaultLogger(hclog.Trace)
+	tmpDir := t.TempDir()
+
+	// Look up tokens "t1" and "t2" as having accessors "acc1" and "acc2"
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token := r.Header.Get(consts.AuthHeaderName)
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(w, `{"data": {"accessor": "acc%s", "meta": {"role": "web", "bad": "../escape"}}}`, strings.TrimPrefix(token, "t"))
+	}))
+	defer server.Close()
+
+	config := api.DefaultConfig()
+	config.Address = server.URL
+	client, err := api.NewClient(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	newSink := func(path string) sink.ContextSink {
+		t.Helper()
+		s, err := NewFileSink(&sink.SinkConfig{
+			Logger: log.Named("sink.file"),
+			Config: map[string]interface{}{
+				"path":          filepath.Join(tmpDir, path),
+				"path_template": true,
+			},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return s.(sink.ContextSink)
+	}
+	write := func(s sink.ContextSink, token string) error {
+		ctx, err := hookcontext.New(context.Background(), client, token)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return s.WriteTokenWithContext(ctx, token)
+	}
+
+	s := newSink("{{ .Metadata.role }}-{{ .Accessor }}")
+
+	// The write check leaves nothing behind in the directory
+	if entries, err := os.ReadDir(tmpDir); err != nil || len(entries) != 0 {
+		t.Fatalf("expected no files left by the write check, got %v (%v)", entries, err)
+	}
+
+	if err := write(s, "t1"); err != nil {
+		t.Fatal(err)
+	}
+	if b, err := os.ReadFile(filepath.Join(tmpDir, "web-acc1")); err != nil || string(b) != "t1" {
+		t.Fatalf("expected t1 in web-acc1, got %q (%v)", b, err)
+	}
+
+	// The previous file is removed once the path changes
+	if err := write(s, "t2"); err != nil {
+		t.Fatal(err)
+	}
+	if b, err := os.ReadFile(filepath.Join(tmpDir, "web-acc2")); err != nil || string(b) != "t2" {
+		t.Fatalf("expected t2 in web-acc2, got %q (%v)", b, err)
+	}
+	if _, err := os.Stat(filepath.Join(tmpDir, "web-acc1")); !os.IsNotExist(err) {
+		t.Fatalf("expected web-acc1 to have been removed, got %v", err)
+	}
+
+	// Tokens can't be written without a client to look them up with
+	if err := s.WriteToken("t3"); err == nil {
+		t.Fatal("expected error writing token without a client")
+	}
+
+	// Values which would escape the directory are left out
+	s = newSink("{{ .Metadata.bad }}")
+	if err := write(s, "t1"); err == nil || !strings.Contains(err.Error(), `map has no entry for key "bad"`) {
+		t.Fatalf("expected missing key error, got %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(filepath.Dir(tmpDir), "escape")); !os.IsNotExist(err) {
+		t.Fatalf("expected no token outside of the sink's directory, got %v", err)
+	}
+}
+
+// TestFileSinkLock tests that a file sink configured to lock holds its lock
+// until it's closed, and that another sink with the same path skips its
+// writes with ErrLocked meanwhile.
+func TestFileSinkLock(t *testing.T) {
+	log := logging.NewVaultLogger(hclog.Trace)
+	path := filepath.Join(t.TempDir(), "token")
+
+	newSink := func() *sink.SinkConfig {
+		config := &sink.SinkConfig{
+			Logger: log.Named("sink.file"),
+			Config: map[string]interface{}{
+				"path": path,
+				"lock": true,
+			},
+		}
+		s, err := NewFileSink(config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		config.Sink = s
+		return config
+	}
+	first, second := newSink(), newSink()
+
+	if err := first.WriteToken("first"); err != nil {
+		t.Fatal(err)
+	}
+	if err := second.WriteToken("second"); !errors.Is(err, sink.ErrLocked) {
+		t.Fatalf("expected ErrLocked, got %v", err)
+	}
+	if err := second.Sink.(sink.ClearableSink).ClearToken(); !errors.Is(err, sink.ErrLocked) {
+		t.Fatalf("expected ErrLocked clearing the token, got %v", err)
+	}
+	if token, err := os.ReadFile(path); err != nil || string(token) != "first" {
+		t.Fatalf("expected the first sink's token, got %q, %v", token, err)
+	}
+
+	if err := first.Sink.(*fileSink).Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := second.WriteToken("second"); err != nil {
+		t.Fatal(err)
+	}
+	if token, err := os.ReadFile(path); err != nil || string(token) != "second" {
+		t.Fatalf("expected the second sink's token, got %q, %v", token, err)
+	}
+
+	_, err := NewFileSink(&sink.SinkConfig{
+		Logger: log.Named("sink.file"),
+		Config: map[string]interface{}{
+			"path": path,
+			"lock": true,
+			"fifo": true,
+		},
+	})
+	if err == nil {
+		t.Fatal("expected error using lock with fifo")
+	}
+}
+
+// TestFileSinkVerifyWrite tests that with verify_write, a token which reads
+// back corrupted is rewritten, and that an error is returned, leaving the
+// previous token in place, once the retries are exhausted.
+func TestFileSinkVerifyWrite(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "token")
+	config := &sink.SinkConfig{
+		Logger: logging.NewVaultLogger(hclog.Trace).Named("sink.file"),
+		Config: map[string]interface{}{
+			"path":                 path,
+			"verify_write":         true,
+			"verify_write_retries": 2,
+		},
+	}
+	s, err := NewFileSink(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config.Sink = s
+
+	// Corrupt the first reads of each write
+	var corrupt, reads int
+	readFile = func(name string) ([]byte, error) {
+		reads++
+		b, err := os.ReadFile(name)
+		if reads <= corrupt {
+			b = append(b, 0)
+		}
+		return b, err
+	}
+	defer func() { readFile = os.ReadFile }()
+
+	corrupt = 2
+	if err := config.WriteToken("first"); err != nil {
+		t.Fatal(err)
+	}
+	if reads != 3 {
+		t.Fatalf("expected 3 reads, got %d", reads)
+	}
+
+	reads, corrupt = 0, 3
+	if err := config.WriteToken("second"); !errors.Is(err, errWriteMismatch) {
+		t.Fatalf("expected a mismatch error, got %v", err)
+	}
+	if token, err := os.ReadFile(path); err != nil || string(token) != "first" {
+		t.Fatalf("expected the first token, got %q, %v", token, err)
+	}
+	tmpFiles, err := filepath.Glob(path + ".tmp.*")
+	if err != nil || len(tmpFiles) != 0 {
+		t.Fatalf("expected temp files to be removed, got %v, %v", tmpFiles, err)
+	}
+
+	for _, conf := range []map[string]interface{}{
+		{"path": path, "verify_write": "yes"},
+		{"path": path, "verify_write_retries": -1},
+		{"path": path, "verify_write": true, "fifo": true},
+	} {
+		if _, err := NewFileSink(&sink.SinkConfig{Logger: hclog.NewNullLogger(), Config: conf}); err == nil {
+			t.Fatalf("expected error for config %v", conf)
+		}
+	}
+}
@@ -0,0 +1,22 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: BUSL-1.1
+
+//go:build !windows
+
+package file
+
+import (
+	"errors"
+	"os"
+	"syscall"
+)
+
+// flock takes an exclusive advisory lock on the file without waiting for it.
+func flock(f *os.File) error {
+	return syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+}
+
+// isLockHeld returns whether the error indicates the lock is held elsewhere.
+func isLockHeld(err error) bool {
+	return errors.Is(err, syscall.EWOULDBLOCK)
+}
@@ -0,0 +1,21 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: BUSL-1.1
+
+//go:build windows
+
+package file
+
+import (
+	"errors"
+	"os"
+)
+
+var errLockUnsupported = errors.New("locking file sinks is not supported on windows")
+
+func flock(*os.File) error {
+	return errLockUnsupported
+}
+
+func isLockHeld(error) bool {
+	return false
+}
@@ -0,0 +1,190 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: BUSL-1.1
+
+package file
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/template"
+
+	"github.com/hashicorp/vault/command/agentproxyshared/hookcontext"
+	"github.com/hashicorp/vault/command/agentproxyshared/sink"
+	"github.com/hashicorp/vault/helper/osutil"
+)
+
+// pathTemplateSink is a file sink whose path is a template, rendered with
+// details of each token written to it. It doesn't implement sink.StagedSink,
+// since the path can't be rendered without the context the SinkServer passes
+// to WriteTokenWithContext.
+type pathTemplateSink struct {
+	f    *fileSink
+	tmpl *template.Template
+
+	// current is the path the last token was written to
+	current string
+}
+
+// pathTemplateData is the data the path template is rendered with.
+type pathTemplateData struct {
+	Accessor string
+	Metadata map[string]string
+}
+
+var (
+	_ sink.ContextSink   = (*pathTemplateSink)(nil)
+	_ sink.ClearableSink = (*pathTemplateSink)(nil)
+)
+
+func newPathTemplateSink(f *fileSink) (*pathTemplateSink, error) {
+	tmpl, err := template.New("path").Option("missingkey=error").Parse(f.path)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse 'path' as a template: %w", err)
+	}
+
+	// The token's details aren't known until it's written, so the write check
+	// is done in the path's directory, as long as that doesn't depend on them.
+	if dir := filepath.Dir(f.path); !strings.Contains(dir, "{{") {
+		if err := f.checkDirWritable(dir); err != nil {
+			return nil, fmt.Errorf("error during write check: %w", err)
+		}
+	}
+
+	return &pathTemplateSink{f: f, tmpl: tmpl}, nil
+}
+
+// checkDirWritable returns an error unless a file can be created in dir with
+// the sink's mode and ownership, and written to. The probe file is created
+// with a unique name, so that it can't clash with any other file, and is
+// removed afterwards.
+func (f *fileSink) checkDirWritable(dir string) error {
+	probe, err := os.CreateTemp(dir, ".vault-agent-write-check-*")
+	if err != nil {
+		return readOnlyError(fmt.Errorf("error creating probe file in dir %s: %w", dir, err))
+	}
+	err = probe.Chmod(f.mode)
+	if err == nil {
+		err = osutil.Chown(probe, f.owner, f.group)
+	}
+	if err == nil {
+		_, err = probe.WriteString("write check")
+	}
+	if closeErr := probe.Close(); err == nil {
+		err = closeErr
+	}
+	if removeErr := os.Remove(probe.Name()); err == nil && removeErr != nil {
+		err = fmt.Errorf("error removing probe file %s: %w", probe.Name(), removeErr)
+	}
+	return err
+}
+
+// WriteToken implements the Sink interface. The token's details are looked up
+// with the client the SinkServer passes to WriteTokenWithContext, so tokens
+// can't be written without one.
+func (p *pathTemplateSink) WriteToken(token string) error {
+	return p.WriteTokenWithContext(context.Background(), token)
+}
+
+// WriteTokenWithContext implements the ContextSink interface, looking up the
+// token to render the path, and writing it there. If the path has changed
+// since the last token was written, the previous file is removed.
+func (p *pathTemplateSink) WriteTokenWithContext(ctx context.Context, token string) error {
+	path, err := p.render(ctx)
+	if err != nil {
+		return err
+	}
+
+	f := *p.f
+	f.path = path
+	if err := f.WriteToken(token); err != nil {
+		return err
+	}
+
+	if p.current != "" && p.current != path {
+		if err := os.Remove(p.current); err != nil && !os.IsNotExist(err) {
+			p.f.logger.Warn("error removing token from previous path", "path", p.current, "error", err)
+		} else {
+			p.f.logger.Info("token removed from previous path", "path", p.current)
+		}
+	}
+	p.current = path
+	return nil
+}
+
+// ClearToken implements the ClearableSink interface, removing the last token
+// written.
+func (p *pathTemplateSink) ClearToken() error {
+	if p.current == "" {
+		return nil
+	}
+	if err := os.Remove(p.current); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("error removing %s: %w", p.current, err)
+	}
+	p.f.logger.Info("token removed", "path", p.current)
+	p.current = ""
+	return nil
+}
+
+// render looks up the token carried by ctx, and renders the path with its
+// details. Values which could change the directory the path is in are left
+// out, so rendering fails if they're used.
+func (p *pathTemplateSink) render(ctx context.Context) (string, error) {
+	client, ok := hookcontext.Client(ctx)
+	if !ok {
+		return "", errors.New("no client to look up the token with, which is needed to render the path")
+	}
+	secret, err := client.Auth().Token().LookupSelfWithContext(ctx)
+	if err != nil {
+		return "", fmt.Errorf("error looking up token to render path: %w", err)
+	}
+
+	accessor, err := secret.TokenAccessor()
+	if err != nil {
+		return "", fmt.Errorf("error reading token accessor: %w", err)
+	}
+	metadata, err := secret.TokenMetadata()
+	if err != nil {
+		return "", fmt.Errorf("error reading token metadata: %w", err)
+	}
+
+	data := pathTemplateData{
+		Metadata: make(map[string]string, len(metadata)),
+	}
+	if accessor != "" && !safePathElement(accessor) {
+		return "", fmt.Errorf("token accessor %q is not a valid file name", accessor)
+	}
+	data.Accessor = accessor
+	for k, v := range metadata {
+		if !safePathElement(v) {
+			p.f.logger.Debug("leaving token metadata value out of path template, as it isn't a valid file name", "key", k)
+			continue
+		}
+		data.Metadata[k] = v
+	}
+
+	var b strings.Builder
+	if err := p.tmpl.Execute(&b, data); err != nil {
+		return "", fmt.Errorf("error rendering path: %w", err)
+	}
+	path := b.String()
+	if path == "" || strings.HasSuffix(filepath.ToSlash(path), "/") {
+		return "", fmt.Errorf("rendered path %q has no file name", path)
+	}
+	for _, elem := range strings.Split(filepath.ToSlash(path), "/") {
+		if elem == ".." {
+			return "", fmt.Errorf("rendered path %q contains %q", path, elem)
+		}
+	}
+	return path, nil
+}
+
+// safePathElement returns whether s can be used as a single element of a
+// path, without referring to another directory.
+func safePathElement(s string) bool {
+	return s != "" && s != "." && s != ".." &&
+		!strings.ContainsAny(s, `/\`+"\x00")
+}
@@ -5,17 +5,28 @@ package file
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"path/filepath"
+	"strings"
 	"sync/atomic"
+	"syscall"
 	"testing"
 	"time"
 
 	"github.com/hashicorp/go-hclog"
 	"github.com/hashicorp/go-uuid"
+	"github.com/hashicorp/vault/api"
+	"github.com/hashicorp/vault/command/agentproxyshared/hookcontext"
 	"github.com/hashicorp/vault/command/agentproxyshared/sink"
+	"github.com/hashicorp/vault/helper/dhutil"
+	"github.com/hashicorp/vault/sdk/helper/jsonutil"
 	"github.com/hashicorp/vault/sdk/helper/logging"
 )
 
@@ -156,3 +167,986 @@ func TestSinkServerRetry(t *testing.T) {
 		t.Fatal("should have reset tokenRenewalInProgress to false")
 	}
 }
+
+func TestSinkServerConsistentWrite(t *testing.T) {
+	log := logging.NewVaultLogger(hclog.Trace)
+
+	fs1, path1 := testFileSink(t, log)
+	fs2, path2 := testFileSink(t, log)
+	fs3, path3 := testFileSink(t, log)
+
+	// Remove the third sink's directory so that staging to it fails
+	if err := os.RemoveAll(path3); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancelFunc := context.WithCancel(context.Background())
+	defer cancelFunc()
+
+	ss := sink.NewSinkServer(&sink.SinkServerConfig{
+		Logger:              log.Named("sink.server"),
+		ConsistentWrite:     true,
+		ConsistentWriteSync: true,
+	})
+
+	in := make(chan string)
+	sinks := []*sink.SinkConfig{fs1, fs2, fs3}
+	errCh := make(chan error)
+	tokenRenewalInProgress := &atomic.Bool{}
+	tokenRenewalInProgress.Store(true)
+	go func() {
+		errCh <- ss.Run(ctx, in, sinks, tokenRenewalInProgress)
+	}()
+
+	uuidStr, _ := uuid.GenerateUUID()
+	in <- uuidStr
+
+	// No sink should have been written while staging to one of them fails
+	time.Sleep(time.Second)
+	for _, path := range []string{path1, path2} {
+		if _, err := os.Stat(fmt.Sprintf("%s/token", path)); !os.IsNotExist(err) {
+			t.Fatalf("expected no token in %s, got err: %v", path, err)
+		}
+		entries, err := os.ReadDir(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(entries) != 0 {
+			t.Fatalf("expected staged files in %s to be discarded, found %d entries", path, len(entries))
+		}
+	}
+
+	// Once the directory exists, a retry should write all sinks
+	if err := os.MkdirAll(path3, 0o755); err != nil {
+		t.Fatal(err)
+	}
+
+	deadline := time.Now().Add(10 * time.Second)
+	for tokenRenewalInProgress.Load() {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for sinks to be written")
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	for _, path := range []string{path1, path2, path3} {
+		fileBytes, err := ioutil.ReadFile(fmt.Sprintf("%s/token", path))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if string(fileBytes) != uuidStr {
+			t.Fatalf("expected %s, got %s", uuidStr, string(fileBytes))
+		}
+	}
+
+	cancelFunc()
+	if err := <-errCh; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSinkServerInitRetry(t *testing.T) {
+	log := logging.NewVaultLogger(hclog.Trace)
+
+	// The sink's directory doesn't exist until after the server has started
+	dir := filepath.Join(t.TempDir(), "not-yet-mounted")
+	sc := &sink.SinkConfig{
+		Logger: log.Named("sink.file"),
+		Config: map[string]interface{}{
+			"path": filepath.Join(dir, "token"),
+		},
+		NewSink: NewFileSink,
+	}
+
+	ctx, cancelFunc := context.WithCancel(context.Background())
+	defer cancelFunc()
+
+	ss := sink.NewSinkServer(&sink.SinkServerConfig{
+		Logger:          log.Named("sink.server"),
+		SinkInitTimeout: 10 * time.Second,
+	})
+
+	in := make(chan string, 1)
+	errCh := make(chan error)
+	tokenRenewalInProgress := &atomic.Bool{}
+	tokenRenewalInProgress.Store(true)
+	go func() {
+		errCh <- ss.Run(ctx, in, []*sink.SinkConfig{sc}, tokenRenewalInProgress)
+	}()
+
+	in <- "token"
+	time.Sleep(500 * time.Millisecond)
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+
+	deadline := time.Now().Add(10 * time.Second)
+	for tokenRenewalInProgress.Load() {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for sink to be written")
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	fileBytes, err := ioutil.ReadFile(filepath.Join(dir, "token"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(fileBytes) != "token" {
+		t.Fatalf("expected token, got %s", string(fileBytes))
+	}
+
+	cancelFunc()
+	if err := <-errCh; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSinkServerInitTimeout(t *testing.T) {
+	log := logging.NewVaultLogger(hclog.Trace)
+
+	sc := &sink.SinkConfig{
+		Logger: log.Named("sink.file"),
+		Config: map[string]interface{}{
+			"path": filepath.Join(t.TempDir(), "missing", "token"),
+		},
+		NewSink: NewFileSink,
+	}
+
+	ss := sink.NewSinkServer(&sink.SinkServerConfig{
+		Logger:          log.Named("sink.server"),
+		SinkInitTimeout: 100 * time.Millisecond,
+	})
+
+	err := ss.Run(context.Background(), make(chan string), []*sink.SinkConfig{sc}, &atomic.Bool{})
+	if err == nil {
+		t.Fatal("expected error creating sink")
+	}
+}
+
+func TestSinkServerMaxTokenAge(t *testing.T) {
+	log := logging.NewVaultLogger(hclog.Trace)
+
+	fs1, path1 := testFileSink(t, log)
+	fs1.MaxTokenAge = time.Second
+	fs2, path2 := testFileSink(t, log)
+
+	ctx, cancelFunc := context.WithCancel(context.Background())
+	defer cancelFunc()
+
+	ss := sink.NewSinkServer(&sink.SinkServerConfig{
+		Logger: log.Named("sink.server"),
+	})
+
+	in := make(chan string)
+	sinks := []*sink.SinkConfig{fs1, fs2}
+	errCh := make(chan error)
+	go func() {
+		errCh <- ss.Run(ctx, in, sinks, &atomic.Bool{})
+	}()
+
+	uuidStr, _ := uuid.GenerateUUID()
+	in <- uuidStr
+
+	readToken := func(path string) string {
+		t.Helper()
+		fileBytes, err := ioutil.ReadFile(fmt.Sprintf("%s/token", path))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(fileBytes)
+	}
+
+	// The token is still fresh
+	time.Sleep(500 * time.Millisecond)
+	if token := readToken(path1); token != uuidStr {
+		t.Fatalf("expected %s, got %s", uuidStr, token)
+	}
+
+	// Only the sink with a max token age should be cleared once it passes
+	time.Sleep(1500 * time.Millisecond)
+	if _, err := os.Stat(fmt.Sprintf("%s/token", path1)); !os.IsNotExist(err) {
+		t.Fatalf("expected stale token to have been removed, got err: %v", err)
+	}
+	if token := readToken(path2); token != uuidStr {
+		t.Fatalf("expected %s, got %s", uuidStr, token)
+	}
+
+	// A new token is written as usual
+	uuidStr, _ = uuid.GenerateUUID()
+	in <- uuidStr
+	time.Sleep(500 * time.Millisecond)
+	if token := readToken(path1); token != uuidStr {
+		t.Fatalf("expected %s, got %s", uuidStr, token)
+	}
+
+	cancelFunc()
+	if err := <-errCh; err != nil {
+		t.Fatal(err)
+	}
+}
+
+type flakySink struct {
+	failures int32
+}
+
+func (f *flakySink) WriteToken(token string) error {
+	if atomic.AddInt32(&f.failures, -1) >= 0 {
+		return errors.New("flaky")
+	}
+	return nil
+}
+
+func TestSinkServerResults(t *testing.T) {
+	log := logging.NewVaultLogger(hclog.Trace)
+
+	fs1, _ := testFileSink(t, log)
+	fs1.Name = "file"
+
+	// An unnamed sink is identified by a hash of its path
+	fs2, _ := testFileSink(t, log)
+	sum := sha256.Sum256([]byte(fs2.Config["path"].(string)))
+	fs2Name := "sink-" + hex.EncodeToString(sum[:4])
+
+	ctx, cancelFunc := context.WithCancel(context.Background())
+	defer cancelFunc()
+
+	results := make(chan []sink.SinkResult, 10)
+	ss := sink.NewSinkServer(&sink.SinkServerConfig{
+		Logger:  log.Named("sink.server"),
+		Results: results,
+	})
+
+	in := make(chan string)
+	sinks := []*sink.SinkConfig{fs1, {Sink: &flakySink{failures: 1}}, fs2}
+	errCh := make(chan error)
+	go func() {
+		errCh <- ss.Run(ctx, in, sinks, &atomic.Bool{})
+	}()
+
+	uuidStr, _ := uuid.GenerateUUID()
+	in <- uuidStr
+
+	nextResults := func() []sink.SinkResult {
+		t.Helper()
+		select {
+		case r := <-results:
+			return r
+		case <-time.After(10 * time.Second):
+			t.Fatal("timed out waiting for sink results")
+		}
+		return nil
+	}
+
+	// The first cycle writes to every sink, one of which fails
+	r := nextResults()
+	if len(r) != 3 {
+		t.Fatalf("expected 3 results, got %d: %v", len(r), r)
+	}
+	if r[0].Name != "file" || !r[0].Success || r[0].Error != nil || r[0].BytesWritten != len(uuidStr) {
+		t.Fatalf("unexpected result for file sink: %#v", r[0])
+	}
+	if r[1].Name != "sink[1]" || r[1].Success || r[1].Error == nil || r[1].BytesWritten != 0 {
+		t.Fatalf("unexpected result for flaky sink: %#v", r[1])
+	}
+	if r[2].Name != fs2Name || !r[2].Success {
+		t.Fatalf("unexpected result for unnamed file sink: %#v", r[2])
+	}
+
+	// The retry only writes to the sink which failed
+	r = nextResults()
+	if len(r) != 1 {
+		t.Fatalf("expected 1 result, got %d: %v", len(r), r)
+	}
+	if r[0].Name != "sink[1]" || !r[0].Success || r[0].Error != nil || r[0].BytesWritten != len(uuidStr) {
+		t.Fatalf("unexpected result for flaky sink: %#v", r[0])
+	}
+
+	cancelFunc()
+	if err := <-errCh; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSinkServerSinkStatuses(t *testing.T) {
+	log := logging.NewVaultLogger(hclog.Trace)
+
+	fs, _ := testFileSink(t, log)
+	fs.Name = "file"
+	path := fs.Config["path"].(string)
+
+	ctx, cancelFunc := context.WithCancel(context.Background())
+	defer cancelFunc()
+
+	results := make(chan []sink.SinkResult, 10)
+	ss := sink.NewSinkServer(&sink.SinkServerConfig{
+		Logger:  log.Named("sink.server"),
+		Results: results,
+	})
+	if statuses := ss.SinkStatuses(); statuses != nil {
+		t.Fatalf("expected no statuses before running, got %v", statuses)
+	}
+
+	in := make(chan string)
+	sinks := []*sink.SinkConfig{fs, {Sink: &flakySink{failures: 1}}}
+	errCh := make(chan error)
+	go func() {
+		errCh <- ss.Run(ctx, in, sinks, &atomic.Bool{})
+	}()
+
+	uuidStr, _ := uuid.GenerateUUID()
+	in <- uuidStr
+
+	nextResults := func() {
+		t.Helper()
+		select {
+		case <-results:
+		case <-time.After(10 * time.Second):
+			t.Fatal("timed out waiting for sink results")
+		}
+	}
+
+	// The first cycle fails to write to the flaky sink
+	nextResults()
+	statuses := ss.SinkStatuses()
+	if len(statuses) != 2 {
+		t.Fatalf("expected 2 statuses, got %d: %v", len(statuses), statuses)
+	}
+	if s := statuses[0]; s.Name != "file" || s.Destination != path || s.LastWrite.IsZero() || s.LastError != nil {
+		t.Fatalf("unexpected status for file sink: %#v", s)
+	}
+	if s := statuses[1]; s.Name != "sink[1]" || s.Destination != "" || !s.LastWrite.IsZero() || s.LastError == nil || s.LastErrorTime.IsZero() {
+		t.Fatalf("unexpected status for flaky sink: %#v", s)
+	}
+
+	// The retry succeeds, keeping the last error
+	nextResults()
+	if s := ss.SinkStatuses()[1]; s.LastError == nil || !s.LastWrite.After(s.LastErrorTime) {
+		t.Fatalf("unexpected status for flaky sink: %#v", s)
+	}
+
+	cancelFunc()
+	if err := <-errCh; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSinkServerMinSuccessfulSinks(t *testing.T) {
+	log := logging.NewVaultLogger(hclog.Trace)
+
+	fs1, _ := testFileSink(t, log)
+
+	ctx, cancelFunc := context.WithCancel(context.Background())
+	defer cancelFunc()
+
+	ss := sink.NewSinkServer(&sink.SinkServerConfig{
+		Logger:             log.Named("sink.server"),
+		MinSuccessfulSinks: 2,
+		EnableEventCh:      true,
+	})
+
+	in := make(chan string)
+	sinks := []*sink.SinkConfig{fs1, {Sink: &flakySink{failures: 1}}, {Sink: &flakySink{failures: 1}}}
+	errCh := make(chan error)
+	go func() {
+		errCh <- ss.Run(ctx, in, sinks, &atomic.Bool{})
+	}()
+
+	uuidStr, _ := uuid.GenerateUUID()
+	in <- uuidStr
+
+	// Only one sink succeeds in the first cycle
+	select {
+	case event := <-ss.EventCh:
+		if event.Type != sink.QuorumNotMet || event.Succeeded != 1 || event.Required != 2 {
+			t.Fatalf("unexpected event: %#v", event)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("timed out waiting for quorum event")
+	}
+
+	// Once the retries succeed, the quorum is met
+	select {
+	case event := <-ss.EventCh:
+		t.Fatalf("unexpected event: %#v", event)
+	case <-time.After(5 * time.Second):
+	}
+
+	cancelFunc()
+	if err := <-errCh; err != nil {
+		t.Fatal(err)
+	}
+
+	// The server can't start if the quorum can never be met
+	ss = sink.NewSinkServer(&sink.SinkServerConfig{
+		Logger:             log.Named("sink.server"),
+		MinSuccessfulSinks: 2,
+	})
+	err := ss.Run(context.Background(), in, []*sink.SinkConfig{fs1}, &atomic.Bool{})
+	if err == nil || !strings.Contains(err.Error(), "min successful sinks") {
+		t.Fatalf("expected min successful sinks error, got: %v", err)
+	}
+}
+
+// contextSink records the token it's written, and the token and client from
+// the context it's written with.
+type contextSink struct {
+	writtenCh chan struct{}
+	token     string
+	ctxToken  string
+	client    *api.Client
+}
+
+func (c *contextSink) WriteToken(string) error {
+	return errors.New("expected WriteTokenWithContext to be used")
+}
+
+func (c *contextSink) WriteTokenWithContext(ctx context.Context, token string) error {
+	c.token = token
+	c.ctxToken, _ = hookcontext.Token(ctx)
+	c.client, _ = hookcontext.Client(ctx)
+	close(c.writtenCh)
+	return nil
+}
+
+func TestSinkServerContextSink(t *testing.T) {
+	log := logging.NewVaultLogger(hclog.Trace)
+
+	client, err := api.NewClient(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancelFunc := context.WithCancel(context.Background())
+	defer cancelFunc()
+
+	ss := sink.NewSinkServer(&sink.SinkServerConfig{
+		Logger: log.Named("sink.server"),
+		Client: client,
+	})
+
+	cs := &contextSink{writtenCh: make(chan struct{})}
+	in := make(chan string)
+	errCh := make(chan error)
+	go func() {
+		errCh <- ss.Run(ctx, in, []*sink.SinkConfig{{Sink: cs}}, &atomic.Bool{})
+	}()
+
+	uuidStr, _ := uuid.GenerateUUID()
+	in <- uuidStr
+
+	select {
+	case <-cs.writtenCh:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for token to be written")
+	}
+
+	if cs.token != uuidStr || cs.ctxToken != uuidStr {
+		t.Fatalf("expected token %s to be written and in the context, got %q and %q", uuidStr, cs.token, cs.ctxToken)
+	}
+	if cs.client == nil || cs.client == client || cs.client.Token() != uuidStr {
+		t.Fatal("expected a new client authenticated with the token in the context")
+	}
+
+	cancelFunc()
+	if err := <-errCh; err != nil {
+		t.Fatal(err)
+	}
+}
+
+// renewalSink records the tokens it's written, and those it's told have been
+// renewed, with whether their contexts were marked renewed.
+type renewalSink struct {
+	writes   chan bool
+	renewals chan bool
+}
+
+func (r *renewalSink) WriteToken(string) error {
+	return errors.New("expected WriteTokenWithContext to be used")
+}
+
+func (r *renewalSink) WriteTokenWithContext(ctx context.Context, _ string) error {
+	r.writes <- hookcontext.Renewed(ctx)
+	return nil
+}
+
+func (r *renewalSink) TokenRenewed(ctx context.Context, _ string) error {
+	r.renewals <- hookcontext.Renewed(ctx)
+	return nil
+}
+
+// TestSinkServerRenewalSink tests that a token delivered again isn't written
+// again, but passed to RenewalSinks with the context marked renewed.
+func TestSinkServerRenewalSink(t *testing.T) {
+	log := logging.NewVaultLogger(hclog.Trace)
+
+	ctx, cancelFunc := context.WithCancel(context.Background())
+	defer cancelFunc()
+
+	ss := sink.NewSinkServer(&sink.SinkServerConfig{
+		Logger: log.Named("sink.server"),
+	})
+
+	rs := &renewalSink{writes: make(chan bool, 4), renewals: make(chan bool, 4)}
+	in := make(chan string)
+	errCh := make(chan error)
+	go func() {
+		errCh <- ss.Run(ctx, in, []*sink.SinkConfig{{Sink: rs}}, &atomic.Bool{})
+	}()
+
+	receive := func(ch chan bool, what string) bool {
+		t.Helper()
+		select {
+		case renewed := <-ch:
+			return renewed
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timed out waiting for %s", what)
+			return false
+		}
+	}
+	for _, token := range []string{"test-token", "test-token-2"} {
+		in <- token
+		if receive(rs.writes, "token to be written") {
+			t.Fatal("expected a new token not to be marked renewed")
+		}
+		in <- token
+		if !receive(rs.renewals, "token to be renewed") {
+			t.Fatal("expected a token delivered again to be marked renewed")
+		}
+	}
+
+	cancelFunc()
+	if err := <-errCh; err != nil {
+		t.Fatal(err)
+	}
+	if len(rs.writes) != 0 {
+		t.Fatal("expected tokens delivered again not to be written again")
+	}
+}
+
+// readOnlySink fails writes as if its filesystem were read-only until its
+// failures are used up, and then writes to the wrapped sink.
+type readOnlySink struct {
+	sink.Sink
+	failures int32
+}
+
+func (r *readOnlySink) WriteToken(token string) error {
+	if atomic.AddInt32(&r.failures, -1) >= 0 {
+		return readOnlyError(&os.PathError{Op: "open", Path: "token", Err: syscall.EROFS})
+	}
+	return r.Sink.WriteToken(token)
+}
+
+func TestSinkServerReadOnly(t *testing.T) {
+	log := logging.NewVaultLogger(hclog.Trace)
+
+	fs, tmpDir := testFileSink(t, log)
+	path := filepath.Join(tmpDir, "token")
+	rs := &readOnlySink{Sink: fs.Sink}
+	fs.Sink = rs
+	fs.Name = "file"
+
+	ctx, cancelFunc := context.WithCancel(context.Background())
+	defer cancelFunc()
+
+	ss := sink.NewSinkServer(&sink.SinkServerConfig{
+		Logger:        log.Named("sink.server"),
+		EnableEventCh: true,
+	})
+
+	in := make(chan string)
+	errCh := make(chan error)
+	go func() {
+		errCh <- ss.Run(ctx, in, []*sink.SinkConfig{fs}, &atomic.Bool{})
+	}()
+
+	readToken := func() string {
+		t.Helper()
+		token, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(token)
+	}
+	nextEvent := func() sink.SinkEvent {
+		t.Helper()
+		select {
+		case event := <-ss.EventCh:
+			return event
+		case <-time.After(10 * time.Second):
+			t.Fatal("timed out waiting for sink event")
+		}
+		return sink.SinkEvent{}
+	}
+
+	in <- "token-1"
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		if token, err := os.ReadFile(path); err == nil && string(token) == "token-1" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for first token")
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	// The sink keeps the last token while it's read-only
+	atomic.StoreInt32(&rs.failures, 2)
+	in <- "token-2"
+	if event := nextEvent(); event.Type != sink.SinkReadOnly || event.Sink != "file" {
+		t.Fatalf("unexpected event: %#v", event)
+	}
+	if token := readToken(); token != "token-1" {
+		t.Fatalf("expected sink to keep its last token, got %q", token)
+	}
+
+	// The failed write is only reported once, and the sink recovers once the
+	// failures are used up
+	if event := nextEvent(); event.Type != sink.SinkRecovered || event.Sink != "file" {
+		t.Fatalf("unexpected event: %#v", event)
+	}
+	if token := readToken(); token != "token-2" {
+		t.Fatalf("expected sink to have the new token, got %q", token)
+	}
+
+	cancelFunc()
+	if err := <-errCh; err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestSinkServerLocked tests that an event is emitted when a write to a sink
+// is skipped because another writer holds its lock.
+func TestSinkServerLocked(t *testing.T) {
+	log := logging.NewVaultLogger(hclog.Trace)
+	path := filepath.Join(t.TempDir(), "token")
+	newSink := func() *sink.SinkConfig {
+		config := &sink.SinkConfig{
+			Logger: log.Named("sink.file"),
+			Name:   "file",
+			Config: map[string]interface{}{
+				"path": path,
+				"lock": true,
+			},
+		}
+		s, err := NewFileSink(config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		config.Sink = s
+		return config
+	}
+
+	other := newSink()
+	if err := other.WriteToken("other"); err != nil {
+		t.Fatal(err)
+	}
+	defer other.Sink.(*fileSink).Close()
+
+	ctx, cancelFunc := context.WithCancel(context.Background())
+	defer cancelFunc()
+
+	ss := sink.NewSinkServer(&sink.SinkServerConfig{
+		Logger:        log.Named("sink.server"),
+		EnableEventCh: true,
+	})
+	in := make(chan string)
+	errCh := make(chan error)
+	go func() {
+		errCh <- ss.Run(ctx, in, []*sink.SinkConfig{newSink()}, &atomic.Bool{})
+	}()
+
+	in <- "token-1"
+	select {
+	case event := <-ss.EventCh:
+		if event.Type != sink.SinkLocked || event.Sink != "file" || !errors.Is(event.Error, sink.ErrLocked) {
+			t.Fatalf("unexpected event: %#v", event)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("timed out waiting for sink event")
+	}
+	if token, err := os.ReadFile(path); err != nil || string(token) != "other" {
+		t.Fatalf("expected the other writer's token, got %q, %v", token, err)
+	}
+
+	cancelFunc()
+	if err := <-errCh; err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestSinkServerEncrypted tests that a token written to a file sink with
+// dh_type set is encrypted to the consumer's public key, so it's never
+// written to disk in plaintext.
+func TestSinkServerEncrypted(t *testing.T) {
+	log := logging.NewVaultLogger(hclog.Trace)
+
+	fs, tmpDir := testFileSink(t, log)
+
+	pub, pri, err := dhutil.GeneratePublicPrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	pubKeyInfo, err := jsonutil.EncodeJSON(&dhutil.PublicKeyInfo{
+		Curve25519PublicKey: pub,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	fs.DHPath = filepath.Join(tmpDir, "dh-pub-key")
+	if err := os.WriteFile(fs.DHPath, pubKeyInfo, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	fs.DHType = "curve25519"
+	fs.DeriveKey = true
+	fs.AAD = "aad"
+
+	ss := sink.NewSinkServer(&sink.SinkServerConfig{
+		Logger: log.Named("sink.server"),
+	})
+	ctx, cancelFunc := context.WithCancel(context.Background())
+	defer cancelFunc()
+	in := make(chan string)
+	errCh := make(chan error)
+	go func() {
+		errCh <- ss.Run(ctx, in, []*sink.SinkConfig{fs}, &atomic.Bool{})
+	}()
+
+	in <- "token"
+	var fileBytes []byte
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		fileBytes, err = os.ReadFile(filepath.Join(tmpDir, "token"))
+		if err == nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal(err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	cancelFunc()
+	if err := <-errCh; err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(fileBytes), "token") {
+		t.Fatalf("expected token to be encrypted, got %s", fileBytes)
+	}
+
+	resp := new(dhutil.Envelope)
+	if err := jsonutil.DecodeJSON(fileBytes, resp); err != nil {
+		t.Fatal(err)
+	}
+	shared, err := dhutil.GenerateSharedSecret(pri, resp.Curve25519PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	aesKey, err := dhutil.DeriveSharedKey(shared, pub, resp.Curve25519PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	val, err := dhutil.DecryptAES(aesKey, resp.EncryptedPayload, resp.Nonce, []byte("aad"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(val) != "token" {
+		t.Fatalf("expected %q, got %q", "token", val)
+	}
+}
+
+// TestSinkServerEmitAccessor tests that sinks configured to emit the accessor
+// are written the token's accessor, looked up once, and the others the token.
+func TestSinkServerEmitAccessor(t *testing.T) {
+	log := logging.NewVaultLogger(hclog.Trace)
+
+	var lookups atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/auth/token/lookup-self" || r.Header.Get("X-Vault-Token") != "test-token" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		lookups.Add(1)
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"data": {"accessor": "test-accessor"}}`))
+	}))
+	defer server.Close()
+
+	config := api.DefaultConfig()
+	config.Address = server.URL
+	client, err := api.NewClient(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tokenSink, tokenPath := testFileSink(t, log)
+	accessorSink1, accessorPath1 := testFileSink(t, log)
+	accessorSink1.Emit = sink.EmitAccessor
+	accessorSink2, accessorPath2 := testFileSink(t, log)
+	accessorSink2.Emit = sink.EmitAccessor
+
+	ctx, cancelFunc := context.WithCancel(context.Background())
+	defer cancelFunc()
+	ss := sink.NewSinkServer(&sink.SinkServerConfig{
+		Logger:        log.Named("sink.server"),
+		Client:        client,
+		ExitAfterAuth: true,
+	})
+	in := make(chan string, 1)
+	in <- "test-token"
+	if err := ss.Run(ctx, in, []*sink.SinkConfig{tokenSink, accessorSink1, accessorSink2}, &atomic.Bool{}); err != nil {
+		t.Fatal(err)
+	}
+
+	for path, expected := range map[string]string{
+		tokenPath:     "test-token",
+		accessorPath1: "test-accessor",
+		accessorPath2: "test-accessor",
+	} {
+		fileBytes, err := os.ReadFile(filepath.Join(path, "token"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(fileBytes) != expected {
+			t.Fatalf("expected %q, got %q", expected, string(fileBytes))
+		}
+	}
+	if lookups.Load() != 1 {
+		t.Fatalf("expected the accessor to be looked up once, got %d", lookups.Load())
+	}
+
+	accessorSink1.WrapTTL = time.Minute
+	if err := ss.Run(ctx, in, []*sink.SinkConfig{accessorSink1}, &atomic.Bool{}); err == nil || !strings.Contains(err.Error(), "can't response-wrap") {
+		t.Fatalf("expected error response-wrapping the accessor, got %v", err)
+	}
+}
+
+// TestSinkServerReadinessProbe_PerSink tests that a sink whose consumer isn't
+// ready doesn't hold back the token from the other sinks, with and without
+// consistent writes.
+func TestSinkServerReadinessProbe_PerSink(t *testing.T) {
+	for _, consistentWrite := range []bool{false, true} {
+		t.Run(fmt.Sprintf("consistent_write_%t", consistentWrite), func(t *testing.T) {
+			log := logging.NewVaultLogger(hclog.Trace)
+
+			gatedSink, gatedPath := testFileSink(t, log)
+			otherSink, otherPath := testFileSink(t, log)
+
+			var probes atomic.Int32
+			var otherWritten atomic.Bool
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if probes.Add(1) < 3 {
+					w.WriteHeader(http.StatusServiceUnavailable)
+					return
+				}
+				if _, err := os.Stat(filepath.Join(otherPath, "token")); err == nil {
+					otherWritten.Store(true)
+				}
+			}))
+			defer server.Close()
+			gatedSink.ReadinessProbe = &sink.ReadinessProbe{
+				URL:      server.URL,
+				Interval: 10 * time.Millisecond,
+			}
+
+			ctx, cancelFunc := context.WithCancel(context.Background())
+			defer cancelFunc()
+			ss := sink.NewSinkServer(&sink.SinkServerConfig{
+				Logger:          log.Named("sink.server"),
+				ExitAfterAuth:   true,
+				ConsistentWrite: consistentWrite,
+			})
+			in := make(chan string, 1)
+			in <- "test-token"
+			if err := ss.Run(ctx, in, []*sink.SinkConfig{gatedSink, otherSink}, &atomic.Bool{}); err != nil {
+				t.Fatal(err)
+			}
+
+			if !otherWritten.Load() {
+				t.Fatal("expected the other sink to be written before the probe passed")
+			}
+			fileBytes, err := os.ReadFile(filepath.Join(gatedPath, "token"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(fileBytes) != "test-token" {
+				t.Fatalf("expected %q, got %q", "test-token", string(fileBytes))
+			}
+			if probes.Load() != 3 {
+				t.Fatalf("expected 3 probes, got %d", probes.Load())
+			}
+		})
+	}
+}
+
+func TestSinkServerReadinessProbe(t *testing.T) {
+	log := logging.NewVaultLogger(hclog.Trace)
+
+	gatedSink, gatedPath := testFileSink(t, log)
+	otherSink, otherPath := testFileSink(t, log)
+
+	var probes atomic.Int32
+	var writtenEarly atomic.Bool
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, err := os.Stat(filepath.Join(gatedPath, "token")); err == nil {
+			writtenEarly.Store(true)
+		}
+		if probes.Add(1) < 3 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+	}))
+	defer server.Close()
+	gatedSink.ReadinessProbe = &sink.ReadinessProbe{
+		URL:      server.URL,
+		Interval: 10 * time.Millisecond,
+	}
+
+	ctx, cancelFunc := context.WithCancel(context.Background())
+	defer cancelFunc()
+	ss := sink.NewSinkServer(&sink.SinkServerConfig{
+		Logger:        log.Named("sink.server"),
+		ExitAfterAuth: true,
+	})
+	in := make(chan string, 1)
+	in <- "test-token"
+	if err := ss.Run(ctx, in, []*sink.SinkConfig{gatedSink, otherSink}, &atomic.Bool{}); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, path := range []string{gatedPath, otherPath} {
+		fileBytes, err := os.ReadFile(filepath.Join(path, "token"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(fileBytes) != "test-token" {
+			t.Fatalf("expected %q, got %q", "test-token", string(fileBytes))
+		}
+	}
+	if probes.Load() != 3 {
+		t.Fatalf("expected 3 probes, got %d", probes.Load())
+	}
+	if writtenEarly.Load() {
+		t.Fatal("expected the token to be held back until the probe passed")
+	}
+
+	// Once the probe has passed, later tokens are written without probing
+	in <- "test-token-2"
+	if err := ss.Run(ctx, in, []*sink.SinkConfig{gatedSink}, &atomic.Bool{}); err != nil {
+		t.Fatal(err)
+	}
+	fileBytes, err := os.ReadFile(filepath.Join(gatedPath, "token"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(fileBytes) != "test-token-2" || probes.Load() != 3 {
+		t.Fatalf("expected %q written without probing, got %q after %d probes", "test-token-2", string(fileBytes), probes.Load())
+	}
+
+	gatedSink.ReadinessProbe.URL = "localhost:8080/ready"
+	if err := ss.Run(ctx, in, []*sink.SinkConfig{gatedSink}, &atomic.Bool{}); err == nil || !strings.Contains(err.Error(), "invalid readiness probe URL") {
+		t.Fatalf("expected invalid readiness probe URL error, got %v", err)
+	}
+}
@@ -0,0 +1,134 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: BUSL-1.1
+
+package kubernetes
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	hclog "github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/vault/command/agentproxyshared/sink"
+	"github.com/hashicorp/vault/serviceregistration/kubernetes/client"
+)
+
+const defaultDataKey = "token"
+
+// namespaceFile holds the namespace of the pod's service account, which is
+// used if no namespace is configured. It's a variable so tests can override
+// it.
+var namespaceFile = "/var/run/secrets/kubernetes.io/serviceaccount/namespace"
+
+// kubernetesSink is a Sink implementation that writes a token to a key of a
+// Kubernetes secret, using the pod's service account.
+type kubernetesSink struct {
+	logger     hclog.Logger
+	client     *client.Client
+	namespace  string
+	secretName string
+	dataKey    string
+
+	// lastToken is the token the secret is known to hold, so that it isn't
+	// updated with the same value again
+	lastToken string
+}
+
+// NewKubernetesSink creates a new Kubernetes secret sink with the given
+// configuration. It must be running in a Kubernetes pod, and the secret must
+// already exist.
+func NewKubernetesSink(conf *sink.SinkConfig) (sink.Sink, error) {
+	if conf.Logger == nil {
+		return nil, errors.New("nil logger provided")
+	}
+
+	conf.Logger.Info("creating kubernetes sink")
+
+	k := &kubernetesSink{
+		logger:  conf.Logger,
+		dataKey: defaultDataKey,
+	}
+
+	secretNameRaw, ok := conf.Config["secret_name"]
+	if !ok {
+		return nil, errors.New("'secret_name' not specified for kubernetes sink")
+	}
+	k.secretName, ok = secretNameRaw.(string)
+	if !ok || k.secretName == "" {
+		return nil, errors.New("could not parse 'secret_name' as string")
+	}
+
+	if dataKeyRaw, ok := conf.Config["data_key"]; ok {
+		k.dataKey, ok = dataKeyRaw.(string)
+		if !ok || k.dataKey == "" {
+			return nil, errors.New("could not parse 'data_key' as string")
+		}
+	}
+
+	if namespaceRaw, ok := conf.Config["namespace"]; ok {
+		k.namespace, ok = namespaceRaw.(string)
+		if !ok || k.namespace == "" {
+			return nil, errors.New("could not parse 'namespace' as string")
+		}
+	} else {
+		namespace, err := os.ReadFile(namespaceFile)
+		if err != nil {
+			return nil, fmt.Errorf("'namespace' not specified, and unable to read the service account's namespace: %w", err)
+		}
+		k.namespace = strings.TrimSpace(string(namespace))
+	}
+
+	c, err := client.New(conf.Logger.Named("client"))
+	if err != nil {
+		return nil, fmt.Errorf("error creating kubernetes client: %w", err)
+	}
+	k.client = c
+
+	// Check the secret can be read, and find out what it holds
+	if err := k.readToken(); err != nil {
+		k.client.Shutdown()
+		return nil, err
+	}
+
+	k.logger.Info("kubernetes sink configured", "namespace", k.namespace, "secret_name", k.secretName, "data_key", k.dataKey)
+
+	return k, nil
+}
+
+// WriteToken implements the Sink interface, setting the secret's data key to
+// the token. The secret isn't updated if it already holds the token. Updates
+// which are throttled by the API server fail, and are retried with the sink
+// server's backoff.
+func (k *kubernetesSink) WriteToken(token string) error {
+	if token == k.lastToken {
+		k.logger.Debug("secret already holds token, skipping update")
+		return nil
+	}
+
+	if err := k.client.PatchSecretData(k.namespace, k.secretName, map[string][]byte{
+		k.dataKey: []byte(token),
+	}); err != nil {
+		return fmt.Errorf("error updating secret %s/%s: %w", k.namespace, k.secretName, err)
+	}
+	k.lastToken = token
+
+	k.logger.Info("token written", "namespace", k.namespace, "secret_name", k.secretName)
+	return nil
+}
+
+// Close stops any requests to the Kubernetes API which are being retried.
+func (k *kubernetesSink) Close() error {
+	k.client.Shutdown()
+	return nil
+}
+
+// readToken reads the token currently held by the secret.
+func (k *kubernetesSink) readToken() error {
+	secret, err := k.client.GetSecret(k.namespace, k.secretName)
+	if err != nil {
+		return fmt.Errorf("error reading secret %s/%s: %w", k.namespace, k.secretName, err)
+	}
+	k.lastToken = string(secret.Data[k.dataKey])
+	return nil
+}
@@ -0,0 +1,210 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: BUSL-1.1
+
+package kubernetes
+
+import (
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	hclog "github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/vault/command/agentproxyshared/sink"
+	"github.com/hashicorp/vault/sdk/helper/logging"
+	"github.com/hashicorp/vault/serviceregistration/kubernetes/client"
+	kubetest "github.com/hashicorp/vault/serviceregistration/kubernetes/testing"
+)
+
+const (
+	testNamespace  = "vault-agent"
+	testSecretName = "vault-token"
+)
+
+// secretServer is a fake Kubernetes API which serves a single secret, and
+// throttles the first throttle patches to it.
+type secretServer struct {
+	l        sync.Mutex
+	data     map[string][]byte
+	patches  int
+	throttle int
+}
+
+func (s *secretServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.l.Lock()
+	defer s.l.Unlock()
+
+	if r.URL.Path != "/api/v1/namespaces/"+testNamespace+"/secrets/"+testSecretName {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPatch:
+		if s.throttle > 0 {
+			s.throttle--
+			w.Header().Set("Retry-After", "0")
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		if ct := r.Header.Get("Content-Type"); ct != "application/merge-patch+json" {
+			w.WriteHeader(http.StatusUnsupportedMediaType)
+			return
+		}
+		var patch client.Secret
+		if err := json.NewDecoder(r.Body).Decode(&patch); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		for k, v := range patch.Data {
+			s.data[k] = v
+		}
+		s.patches++
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	json.NewEncoder(w).Encode(&client.Secret{
+		Metadata: &client.Metadata{Name: testSecretName},
+		Data:     s.data,
+	})
+}
+
+func (s *secretServer) state() (map[string][]byte, int) {
+	s.l.Lock()
+	defer s.l.Unlock()
+	return s.data, s.patches
+}
+
+func testKubernetesSink(t *testing.T, srv *secretServer) {
+	t.Helper()
+
+	_, testConf, closeFunc := kubetest.Server(t)
+	t.Cleanup(closeFunc)
+
+	ts := httptest.NewServer(srv)
+	t.Cleanup(ts.Close)
+	host, port, err := net.SplitHostPort(ts.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client.Scheme = testConf.ClientScheme
+	client.TokenFile = testConf.PathToTokenFile
+	client.RootCAFile = testConf.PathToRootCAFile
+	t.Setenv(client.EnvVarKubernetesServiceHost, host)
+	t.Setenv(client.EnvVarKubernetesServicePort, port)
+}
+
+func TestKubernetesSink(t *testing.T) {
+	srv := &secretServer{
+		data: map[string][]byte{
+			"ca.crt": []byte("ca"),
+			"token":  []byte("existing"),
+		},
+		throttle: 1,
+	}
+	testKubernetesSink(t, srv)
+
+	origNamespaceFile := namespaceFile
+	t.Cleanup(func() { namespaceFile = origNamespaceFile })
+	namespaceFile = filepath.Join(t.TempDir(), "namespace")
+	if err := os.WriteFile(namespaceFile, []byte(testNamespace+"\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := NewKubernetesSink(&sink.SinkConfig{
+		Logger: logging.NewVaultLogger(hclog.Trace),
+		Config: map[string]interface{}{
+			"secret_name": testSecretName,
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.(io.Closer).Close()
+
+	// The secret already holds the token, so isn't updated
+	if err := s.WriteToken("existing"); err != nil {
+		t.Fatal(err)
+	}
+	if _, patches := srv.state(); patches != 0 {
+		t.Fatalf("expected no patches, got %d", patches)
+	}
+
+	// The first patch is throttled, and fails for the sink server to retry
+	if err := s.WriteToken("new"); err == nil {
+		t.Fatal("expected the throttled update to fail")
+	}
+	if _, patches := srv.state(); patches != 0 {
+		t.Fatalf("expected no patches, got %d", patches)
+	}
+	if err := s.WriteToken("new"); err != nil {
+		t.Fatal(err)
+	}
+	data, patches := srv.state()
+	if patches != 1 {
+		t.Fatalf("expected 1 patch, got %d", patches)
+	}
+	if string(data["token"]) != "new" {
+		t.Fatalf("expected token %q, got %q", "new", data["token"])
+	}
+	if string(data["ca.crt"]) != "ca" {
+		t.Fatalf("expected other keys to be kept, got %v", data)
+	}
+
+	if err := s.WriteToken("new"); err != nil {
+		t.Fatal(err)
+	}
+	if _, patches := srv.state(); patches != 1 {
+		t.Fatalf("expected 1 patch, got %d", patches)
+	}
+}
+
+func TestKubernetesSink_DataKey(t *testing.T) {
+	srv := &secretServer{data: map[string][]byte{}}
+	testKubernetesSink(t, srv)
+
+	s, err := NewKubernetesSink(&sink.SinkConfig{
+		Logger: logging.NewVaultLogger(hclog.Trace),
+		Config: map[string]interface{}{
+			"namespace":   testNamespace,
+			"secret_name": testSecretName,
+			"data_key":    "vault-token",
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.(io.Closer).Close()
+
+	if err := s.WriteToken("token"); err != nil {
+		t.Fatal(err)
+	}
+	data, _ := srv.state()
+	if string(data["vault-token"]) != "token" {
+		t.Fatalf("expected token %q, got %v", "token", data)
+	}
+}
+
+func TestKubernetesSink_MissingSecret(t *testing.T) {
+	testKubernetesSink(t, &secretServer{})
+
+	_, err := NewKubernetesSink(&sink.SinkConfig{
+		Logger: logging.NewVaultLogger(hclog.Trace),
+		Config: map[string]interface{}{
+			"namespace":   testNamespace,
+			"secret_name": "missing",
+		},
+	})
+	if err == nil {
+		t.Fatal("expected error for missing secret")
+	}
+}
@@ -0,0 +1,108 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: BUSL-1.1
+
+package sink
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+const (
+	// DefaultReadinessProbeInterval is the default time between checks of a
+	// ReadinessProbe which hasn't passed.
+	DefaultReadinessProbeInterval = 2 * time.Second
+	// DefaultReadinessProbeTimeout is the default time allowed for each check
+	// of a ReadinessProbe.
+	DefaultReadinessProbeTimeout = time.Second
+)
+
+// ErrNotReady is wrapped by the errors reported in the SinkStatus of sinks
+// which haven't been written because their ReadinessProbe hasn't passed yet.
+var ErrNotReady = errors.New("sink consumer is not ready")
+
+// ReadinessProbe gates the first write to a sink on the readiness of the
+// sink's consumer, such as an application in the same pod, so that it doesn't
+// read the sink before it's ready to. Until a GET of URL returns 200, the
+// token is held back from the sink and the probe retried every Interval, while
+// the token is written to the other sinks as usual, including with consistent
+// writes. Each sink's probe is checked on its own, and once it has passed,
+// it's never checked again, including for later tokens.
+type ReadinessProbe struct {
+	URL string
+	// Interval is the time between checks until the probe passes. It
+	// defaults to DefaultReadinessProbeInterval.
+	Interval time.Duration
+	// Timeout is the time allowed for each check. It defaults to
+	// DefaultReadinessProbeTimeout.
+	Timeout time.Duration
+}
+
+// validate returns an error if the probe's URL isn't an http or https URL, or
+// its durations are negative.
+func (p *ReadinessProbe) validate() error {
+	u, err := url.Parse(p.URL)
+	if err != nil {
+		return fmt.Errorf("invalid readiness probe URL: %w", err)
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("invalid readiness probe URL %q: must be an http or https URL", p.URL)
+	}
+	if p.Interval < 0 || p.Timeout < 0 {
+		return errors.New("readiness probe interval and timeout must not be negative")
+	}
+	return nil
+}
+
+func (p *ReadinessProbe) interval() time.Duration {
+	if p.Interval <= 0 {
+		return DefaultReadinessProbeInterval
+	}
+	return p.Interval
+}
+
+// check returns an error unless a GET of the probe's URL returns 200.
+func (p *ReadinessProbe) check(ctx context.Context, client *http.Client) error {
+	timeout := p.Timeout
+	if timeout <= 0 {
+		timeout = DefaultReadinessProbeTimeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, p.URL, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 4096))
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("readiness probe responded with %s", resp.Status)
+	}
+	return nil
+}
+
+// checkReady returns an error wrapping ErrNotReady if the sink has a
+// ReadinessProbe which hasn't passed, checking it first if so.
+func (ss *SinkServer) checkReady(ctx context.Context, name string, s *SinkConfig) error {
+	if s.ReadinessProbe == nil || s.ready {
+		return nil
+	}
+	if err := s.ReadinessProbe.check(ctx, ss.probeClient); err != nil {
+		err = fmt.Errorf("%w: %v", ErrNotReady, err)
+		ss.statuses.failed(s, err)
+		return err
+	}
+	s.ready = true
+	ss.logger.Info("sink consumer is ready, writing token", "sink", name)
+	return nil
+}
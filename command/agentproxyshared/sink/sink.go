@@ -5,18 +5,32 @@ package sink
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
+	"math"
 	"math/rand"
+	"net/http"
 	"os"
 	"sync/atomic"
 	"time"
 
+	"github.com/armon/go-metrics"
+	cleanhttp "github.com/hashicorp/go-cleanhttp"
 	"github.com/hashicorp/go-hclog"
 	"github.com/hashicorp/vault/api"
+	"github.com/hashicorp/vault/command/agentproxyshared/errorfile"
+	"github.com/hashicorp/vault/command/agentproxyshared/hookcontext"
+	"github.com/hashicorp/vault/command/agentproxyshared/tracing"
 	"github.com/hashicorp/vault/helper/dhutil"
+	"github.com/hashicorp/vault/helper/logging"
+	"github.com/hashicorp/vault/sdk/helper/backoff"
+	"github.com/hashicorp/vault/sdk/helper/consts"
 	"github.com/hashicorp/vault/sdk/helper/jsonutil"
+	"go.opentelemetry.io/otel/attribute"
 )
 
 type Sink interface {
@@ -27,8 +41,120 @@ type SinkReader interface {
 	Token() string
 }
 
+// StagedSink is implemented by sinks which can separate writing a token from
+// making it visible at their destination. This allows the SinkServer to stage
+// a token in every sink before committing it to any of them.
+type StagedSink interface {
+	Sink
+	// StageToken writes the token to a temporary location without making it
+	// visible at the sink's destination.
+	StageToken(string) (StagedToken, error)
+}
+
+// StagedToken is a token which has been staged by a StagedSink.
+type StagedToken interface {
+	// Commit makes the staged token visible at the sink's destination. If
+	// sync is true, the sink should also ensure the change is durable, e.g.
+	// by fsyncing the destination's directory.
+	Commit(sync bool) error
+	// Discard removes the staged token without committing it.
+	Discard()
+}
+
+// ContextSink is implemented by sinks which take a context when writing a
+// token, which the SinkServer uses in place of WriteToken. The context carries
+// the token being delivered, before any response wrapping or encryption, and
+// if the SinkServer has a Client, a client authenticated with it; see the
+// hookcontext package.
+type ContextSink interface {
+	Sink
+	WriteTokenWithContext(ctx context.Context, token string) error
+}
+
+// RenewalSink is implemented by sinks which are told when the token last
+// written to them is delivered again, rather than a new one, as the auth
+// handler does when the token's lease is renewed, or an auth method re-reads
+// the same token. The SinkServer doesn't write the token again, but calls
+// TokenRenewed, with the same context as for ContextSinks, on which
+// hookcontext.Renewed is set.
+type RenewalSink interface {
+	Sink
+	TokenRenewed(ctx context.Context, token string) error
+}
+
+// ClearableSink is implemented by sinks which can remove the token they
+// hold, e.g. because it has become stale. See SinkConfig.MaxTokenAge.
+type ClearableSink interface {
+	Sink
+	ClearToken() error
+}
+
+// ErrSinkWriteAborted is the error reported in a SinkResult for a sink which
+// wasn't written because writing the token to another sink failed first. This
+// only happens when consistent writes are enabled.
+var ErrSinkWriteAborted = errors.New("write aborted after writing to another sink failed")
+
+// ErrReadOnly is wrapped by errors returned by sinks whose destination is on a
+// read-only filesystem. Since remounting the filesystem read-write may take
+// some time, the SinkServer only logs these errors periodically while it
+// retries the sink.
+var ErrReadOnly = errors.New("sink destination is on a read-only filesystem")
+
+// ErrLocked is wrapped by errors returned by sinks which skipped writing the
+// token because their destination is locked by another writer.
+var ErrLocked = errors.New("sink destination is locked by another writer")
+
+// readOnlyLogInterval is how often the SinkServer logs that a sink is still
+// read-only.
+const readOnlyLogInterval = time.Minute
+
+// errorFileSource identifies the server's errors in the ErrorFile.
+const errorFileSource = "sink"
+
+// The values of SinkConfig.Emit.
+const (
+	EmitToken    = "token"
+	EmitAccessor = "accessor"
+)
+
+// SinkResult is the outcome of writing a token to a single sink.
+type SinkResult struct {
+	// Name identifies the sink, see SinkConfig.Name.
+	Name    string
+	Success bool
+	Error   error
+	// BytesWritten is the length of the value written to the sink, after
+	// any response wrapping and encryption.
+	BytesWritten int
+}
+
 type SinkConfig struct {
 	Sink
+	// Name, if set, identifies the sink in the SinkServer's logs, metrics,
+	// SinkResults and SinkEvents. It defaults to a hash of the sink's path,
+	// e.g. "sink-1a2b3c4d", so that long or sensitive paths aren't exposed,
+	// or for sinks without a path, to its position in the list of sinks
+	// given to the SinkServer, e.g. "sink[0]".
+	Name string
+	// MaxTokenAge, if set, is how long the token in the sink may go without
+	// being replaced before the SinkServer clears it, if the sink is a
+	// ClearableSink, so that consumers fail closed rather than using a token
+	// which may have been revoked. Note that renewing a token doesn't write
+	// it to sinks again, so this should be longer than the token's maximum
+	// TTL.
+	MaxTokenAge time.Duration
+	// Emit is what's written to the sink: EmitToken, the default, or
+	// EmitAccessor, the token's accessor, looked up with the token, so that
+	// the sink can be used to revoke tokens without exposing them. Accessors
+	// can be encrypted, but not response-wrapped.
+	Emit string
+	// ReadinessProbe, if set, holds back the first token written to the sink
+	// until the probe passes, see ReadinessProbe.
+	ReadinessProbe *ReadinessProbe
+	// NewSink, if set, is used by the SinkServer to create the Sink when it
+	// starts if it hasn't already been created. See
+	// SinkServerConfig.SinkInitTimeout.
+	NewSink            func(*SinkConfig) (Sink, error)
 	Logger             hclog.Logger
 	Config             map[string]interface{}
 	Client             *api.Client
@@ -40,6 +166,14 @@ type SinkConfig struct {
 	cachedRemotePubKey []byte
 	cachedPubKey       []byte
 	cachedPriKey       []byte
+	lastWrite          time.Time
+	cleared            bool
+	// ready is set once the sink's ReadinessProbe has passed
+	ready bool
+	// readOnlySince is when writes to the sink started failing with
+	// ErrReadOnly, and readOnlyLogged when that was last logged
+	readOnlySince  time.Time
+	readOnlyLogged time.Time
 }
 
 type SinkServerConfig struct {
@@ -47,24 +181,118 @@ type SinkServerConfig struct {
 	Client        *api.Client
 	Context       context.Context
 	ExitAfterAuth bool
+	// ConsistentWrite, when set, stages a new token in all sinks that
+	// support it before committing it to any of them, so that the window in
+	// which some sinks hold the new token and others the old one is kept
+	// as small as possible. True atomicity across multiple files isn't
+	// possible, but this narrows the window substantially compared to
+	// writing each sink in turn.
+	ConsistentWrite bool
+	// ConsistentWriteSync, if set along with ConsistentWrite, additionally
+	// syncs each staged token to stable storage as it's committed.
+	ConsistentWriteSync bool
+	// SinkInitTimeout is how long the server will retry, with backoff,
+	// creating sinks which have a NewSink function but no Sink when it
+	// starts. If zero, creation is attempted once and Run fails if it
+	// doesn't succeed.
+	SinkInitTimeout time.Duration
+	// Namespace, if set, overrides the namespace of Client when
+	// response-wrapping tokens for sinks with a WrapTTL. By default the
+	// namespace of Client, i.e. that of auto-auth, is used.
+	Namespace string
+	// Results, if set, receives the outcome of writing to each sink after
+	// every delivery cycle. A cycle is a single attempt at writing a token
+	// to each sink it's due to be written to: every sink for a new token,
+	// and for retries, the sinks which failed in the previous cycle. Results
+	// are dropped if the channel isn't ready to receive them.
+	Results chan<- []SinkResult
+	// MinSuccessfulSinks, if set, is the number of sinks a token must be
+	// written to before it's considered published. After any delivery cycle
+	// which leaves fewer sinks holding the current token, an error is logged
+	// and a QuorumNotMet event emitted.
+	MinSuccessfulSinks int
+	// EnableEventCh enables delivery of SinkEvents on the server's EventCh.
+	EnableEventCh bool
+	// LogRateLimitWindow, if set, is the window within which repeats of the
+	// errors logged while writing to sinks is failing are collapsed into a
+	// count, so that an outage doesn't flood the logs.
+	LogRateLimitWindow time.Duration
+	// RedactTokens, if set, replaces anything in the server's log messages
+	// and arguments which looks like a Vault token with "REDACTED", at every
+	// level including trace. It's a safety net for environments where tokens
+	// must never reach the logs, see logging.NewRedactingLogger. It's off by
+	// default, as redacting adds a pattern match to each log call.
+	RedactTokens bool
+	// ErrorFile, if set, is updated with each failure to write a token to a
+	// sink, and cleared once the token has been written to every sink.
+	ErrorFile *errorfile.File
+	// MetricsSignifier, if set, is the first argument we will give to
+	// metrics.IncrCounterWithLabels, signifying what the name of the
+	// application is. Writes to each sink are counted, labeled with its name.
+	MetricsSignifier string
+	// Tracer, if set, traces each write of a token to the sinks. Sharing the
+	// auth handler's Tracer makes the spans part of the trace of the
+	// authentication which issued the token, and ContextSinks are passed the
+	// context of the span for their write.
+	Tracer *tracing.Tracer
 }
 
 // SinkServer is responsible for pushing tokens to sinks
 type SinkServer struct {
-	logger        hclog.Logger
-	client        *api.Client
-	random        *rand.Rand
-	exitAfterAuth bool
-	remaining     *int32
+	EventCh             chan SinkEvent
+	logger              hclog.Logger
+	errLogger           *logging.RateLimitedLogger
+	client              *api.Client
+	random              *rand.Rand
+	exitAfterAuth       bool
+	consistentWrite     bool
+	consistentWriteSync bool
+	sinkInitTimeout     time.Duration
+	namespace           string
+	results             chan<- []SinkResult
+	minSuccessfulSinks  int
+	enableEventCh       bool
+	remaining           *int32
+	errorFile           *errorfile.File
+	metricsSignifier    string
+	tracer              *tracing.Tracer
+
+	// probeClient checks the sinks' readiness probes
+	probeClient *http.Client
+
+	// accessorToken is the token whose accessor was last looked up, and
+	// accessor that accessor
+	accessorToken string
+	accessor      string
+
+	// statuses are those of the sinks, see SinkStatuses
+	statuses sinkStatuses
 }
 
 func NewSinkServer(conf *SinkServerConfig) *SinkServer {
+	logger := conf.Logger
+	if conf.RedactTokens {
+		logger = logging.NewRedactingLogger(logger)
+	}
 	ss := &SinkServer{
-		logger:        conf.Logger,
-		client:        conf.Client,
-		random:        rand.New(rand.NewSource(int64(time.Now().Nanosecond()))),
-		exitAfterAuth: conf.ExitAfterAuth,
-		remaining:     new(int32),
+		EventCh:             make(chan SinkEvent, 10),
+		logger:              logger,
+		errLogger:           logging.NewRateLimitedLogger(logger, conf.LogRateLimitWindow),
+		client:              conf.Client,
+		random:              rand.New(rand.NewSource(int64(time.Now().Nanosecond()))),
+		exitAfterAuth:       conf.ExitAfterAuth,
+		consistentWrite:     conf.ConsistentWrite,
+		consistentWriteSync: conf.ConsistentWriteSync,
+		sinkInitTimeout:     conf.SinkInitTimeout,
+		namespace:           conf.Namespace,
+		results:             conf.Results,
+		minSuccessfulSinks:  conf.MinSuccessfulSinks,
+		enableEventCh:       conf.EnableEventCh,
+		remaining:           new(int32),
+		errorFile:           conf.ErrorFile,
+		metricsSignifier:    conf.MetricsSignifier,
+		tracer:              conf.Tracer,
+		probeClient:         cleanhttp.DefaultClient(),
 	}
 
 	return ss
@@ -73,51 +301,280 @@ func NewSinkServer(conf *SinkServerConfig) *SinkServer {
 // Run executes the server's run loop, which is responsible for reading
 // in new tokens and pushing them out to the various sinks.
 func (ss *SinkServer) Run(ctx context.Context, incoming chan string, sinks []*SinkConfig, tokenWriteInProgress *atomic.Bool) error {
+	type sinkToken struct {
+		sink  *SinkConfig
+		token string
+	}
+
 	latestToken := new(string)
+	names := sinkNames(sinks)
+	hookCtx := ctx
+	var cycle *deliveryCycle
+	// delivered is the set of sinks the latest token has been written to
+	delivered := make(map[*SinkConfig]struct{}, len(sinks))
+
+	// Sinks whose readiness probes haven't passed are probed again on their
+	// own timers, sending them on probeCh, so that waiting for one sink's
+	// consumer doesn't hold back the others. probing is the set of sinks
+	// waiting to be probed again, which are written the latest token once
+	// their probe passes.
+	probeCh := make(chan *SinkConfig)
+	probing := make(map[*SinkConfig]struct{})
+	stopped := make(chan struct{})
+	defer close(stopped)
+	probeLater := func(s *SinkConfig, err error) {
+		if _, ok := probing[s]; ok {
+			return
+		}
+		probing[s] = struct{}{}
+		atomic.AddInt32(ss.remaining, 1)
+		interval := s.ReadinessProbe.interval()
+		ss.logger.Debug("sink consumer not ready, holding back token", "sink", names[s], "error", err, "interval", interval.String())
+		time.AfterFunc(interval, func() {
+			select {
+			case probeCh <- s:
+			case <-stopped:
+			}
+		})
+	}
+
 	writeSink := func(currSink *SinkConfig, currToken string) error {
 		if currToken != *latestToken {
 			return nil
 		}
-		var err error
+		if err := ss.checkReady(ctx, names[currSink], currSink); err != nil {
+			probeLater(currSink, err)
+			return nil
+		}
+		spanCtx, span := ss.tracer.Start(hookCtx, "sink.write", attribute.String("sink", names[currSink]))
+		currToken, err := ss.prepareToken(currSink, currToken)
+		if err == nil {
+			err = currSink.writeToken(spanCtx, currToken)
+		}
+		tracing.End(span, err)
+		if err != nil {
+			ss.writeFailed(names[currSink], currSink, err)
+			cycle.record(currSink, 0, err)
+			return err
+		}
+		ss.written(names[currSink], currSink)
+		cycle.record(currSink, len(currToken), nil)
+		return nil
+	}
+
+	// writeAllSinks is used instead of writeSink when consistent writes are
+	// enabled. It stages the token in every sink that supports staging, and
+	// only once all have succeeded does it commit them in sequence and write
+	// to any remaining sinks.
+	writeAllSinks := func(currToken string) (err error) {
+		if currToken != *latestToken {
+			return nil
+		}
+		spanCtx, span := ss.tracer.Start(hookCtx, "sink.write_all", attribute.Int("sinks", len(sinks)))
+		defer func() {
+			tracing.End(span, err)
+		}()
+
+		// The token is held back from each sink until its consumer is ready,
+		// and written to the others together
+		ready := make([]*SinkConfig, 0, len(sinks))
+		for _, s := range sinks {
+			if err := ss.checkReady(ctx, names[s], s); err != nil {
+				probeLater(s, err)
+				continue
+			}
+			ready = append(ready, s)
+		}
 
-		if currSink.WrapTTL != 0 {
-			if currToken, err = currSink.wrapToken(ss.client, currSink.WrapTTL, currToken); err != nil {
+		type pendingWrite struct {
+			sink   *SinkConfig
+			token  string
+			staged StagedToken
+		}
+		pending := make([]pendingWrite, 0, len(sinks))
+		discard := func(writes []pendingWrite) {
+			for _, w := range writes {
+				if w.staged != nil {
+					w.staged.Discard()
+				}
+			}
+		}
+
+		for _, s := range ready {
+			token, err := ss.prepareToken(s, currToken)
+			if err != nil {
+				discard(pending)
+				ss.writeFailed(names[s], s, err)
+				cycle.record(s, 0, err)
+				cycle.abort(ready)
 				return err
 			}
+			w := pendingWrite{sink: s, token: token}
+			if stagedSink, ok := s.Sink.(StagedSink); ok {
+				if w.staged, err = stagedSink.StageToken(token); err != nil {
+					discard(pending)
+					ss.writeFailed(names[s], s, err)
+					err = fmt.Errorf("error staging token: %w", err)
+					cycle.record(s, 0, err)
+					cycle.abort(ready)
+					return err
+				}
+			}
+			pending = append(pending, w)
 		}
 
-		if currSink.DHType != "" {
-			if currToken, err = currSink.encryptToken(currToken); err != nil {
+		for i, w := range pending {
+			var err error
+			if w.staged != nil {
+				err = w.staged.Commit(ss.consistentWriteSync)
+			} else {
+				err = w.sink.writeToken(spanCtx, w.token)
+			}
+			if err != nil {
+				discard(pending[i+1:])
+				ss.writeFailed(names[w.sink], w.sink, err)
+				cycle.record(w.sink, 0, err)
+				cycle.abort(ready)
 				return err
 			}
+			ss.written(names[w.sink], w.sink)
+			cycle.record(w.sink, len(w.token), nil)
 		}
 
-		return currSink.WriteToken(currToken)
+		return nil
 	}
 
 	if incoming == nil {
 		return errors.New("sink server: incoming channel is nil")
 	}
 
+	if ss.minSuccessfulSinks > len(sinks) {
+		return fmt.Errorf("sink server: min successful sinks (%d) is greater than the number of sinks (%d)", ss.minSuccessfulSinks, len(sinks))
+	}
+
+	for _, s := range sinks {
+		switch s.Emit {
+		case "", EmitToken:
+		case EmitAccessor:
+			if s.WrapTTL != 0 {
+				return fmt.Errorf("sink server: sink %s can't response-wrap the accessor it emits", names[s])
+			}
+		default:
+			return fmt.Errorf("sink server: sink %s has invalid emit %q", names[s], s.Emit)
+		}
+		if s.ReadinessProbe != nil {
+			if err := s.ReadinessProbe.validate(); err != nil {
+				return fmt.Errorf("sink server: sink %s: %w", names[s], err)
+			}
+		}
+	}
+
+	ss.statuses.reset(names, sinks)
 	ss.logger.Info("starting sink server")
+	if err := ss.initSinks(ctx, sinks); err != nil {
+		tokenWriteInProgress.Store(false)
+		return err
+	}
+
 	defer func() {
+		// Give sinks holding resources, such as named pipes, a chance to
+		// clean them up
+		for _, s := range sinks {
+			if closer, ok := s.Sink.(io.Closer); ok {
+				if err := closer.Close(); err != nil {
+					ss.logger.Warn("error closing sink", "sink", names[s], "error", err)
+				}
+			}
+		}
 		tokenWriteInProgress.Store(false)
+		ss.errLogger.Close()
 		ss.logger.Info("sink server stopped")
 	}()
 
-	type sinkToken struct {
-		sink  *SinkConfig
-		token string
-	}
 	sinkCh := make(chan sinkToken, len(sinks))
+
+	var staleCheckCh <-chan time.Time
+	if interval := staleCheckInterval(sinks); interval > 0 {
+		now := time.Now()
+		for _, s := range sinks {
+			s.lastWrite = now
+		}
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		staleCheckCh = ticker.C
+	}
+
+	// deliver writes st's token to its sink, or every sink if it's nil,
+	// retrying with backoff on failure, and returns whether the server should
+	// stop.
+	deliver := func(st sinkToken) bool {
+		select {
+		case <-ctx.Done():
+			return true
+		default:
+		}
+
+		var err error
+		if st.sink == nil {
+			err = writeAllSinks(st.token)
+		} else {
+			err = writeSink(st.sink, st.token)
+		}
+		if cycle.done() {
+			for _, s := range cycle.succeeded {
+				delivered[s] = struct{}{}
+			}
+			ss.publishResults(cycle.results)
+			ss.checkQuorum(len(delivered))
+			cycle = cycle.next(sinks, ss.consistentWrite)
+		}
+		if err != nil {
+			backoff := 2*time.Second + time.Duration(ss.random.Int63()%int64(time.Second*2)-int64(time.Second))
+			logArgs := []interface{}{"error", err, "backoff", backoff.String()}
+			if st.sink != nil {
+				logArgs = append([]interface{}{"sink", names[st.sink]}, logArgs...)
+			}
+			if errors.Is(err, ErrReadOnly) {
+				// Already logged, at a limited rate, by writeFailed
+				ss.logger.Trace("error returned by sink function, retrying", logArgs...)
+			} else {
+				ss.errLogger.Error("error returned by sink function, retrying", logArgs...)
+			}
+			ss.errorFile.Record(errorFileSource, "error returned by sink function", err)
+			timer := time.NewTimer(backoff)
+			select {
+			case <-ctx.Done():
+				timer.Stop()
+				return true
+			case <-timer.C:
+				atomic.AddInt32(ss.remaining, 1)
+				sinkCh <- st
+			}
+			return false
+		}
+		if atomic.LoadInt32(ss.remaining) == 0 {
+			tokenWriteInProgress.Store(false)
+			ss.errorFile.Clear(errorFileSource)
+			if ss.exitAfterAuth {
+				return true
+			}
+		}
+		return false
+	}
+
 	for {
 		select {
 		case <-ctx.Done():
 			return nil
 
+		case <-staleCheckCh:
+			ss.clearStaleSinks(names, sinks)
+
 		case token := <-incoming:
 			if len(sinks) > 0 {
-				if token != *latestToken {
+				if token == *latestToken {
+					ss.tokenRenewed(hookCtx, names, sinks, delivered, token)
+				} else {
 
 					// Drain the existing funcs
 				drainLoop:
@@ -131,10 +588,19 @@ func (ss *SinkServer) Run(ctx context.Context, incoming chan string, sinks []*Si
 					}
 
 					*latestToken = token
+					hookCtx = ss.newHookContext(ss.tracer.TokenContext(ctx, token), token)
+					cycle = newDeliveryCycle(names, sinks)
+					clear(delivered)
 
-					for _, s := range sinks {
+					if ss.consistentWrite {
+						// A nil sink means the token is written to all sinks at once
 						atomic.AddInt32(ss.remaining, 1)
-						sinkCh <- sinkToken{s, token}
+						sinkCh <- sinkToken{nil, token}
+					} else {
+						for _, s := range sinks {
+							atomic.AddInt32(ss.remaining, 1)
+							sinkCh <- sinkToken{s, token}
+						}
 					}
 				}
 			} else {
@@ -145,38 +611,390 @@ func (ss *SinkServer) Run(ctx context.Context, incoming chan string, sinks []*Si
 					return nil
 				}
 			}
+		case s := <-probeCh:
+			delete(probing, s)
+			atomic.AddInt32(ss.remaining, -1)
+			if deliver(sinkToken{s, *latestToken}) {
+				return nil
+			}
+
 		case st := <-sinkCh:
 			atomic.AddInt32(ss.remaining, -1)
-			select {
-			case <-ctx.Done():
+			if deliver(st) {
 				return nil
-			default:
 			}
+		}
+	}
+}
 
-			if err := writeSink(st.sink, st.token); err != nil {
-				backoff := 2*time.Second + time.Duration(ss.random.Int63()%int64(time.Second*2)-int64(time.Second))
-				ss.logger.Error("error returned by sink function, retrying", "error", err, "backoff", backoff.String())
-				timer := time.NewTimer(backoff)
-				select {
-				case <-ctx.Done():
-					timer.Stop()
-					return nil
-				case <-timer.C:
-					atomic.AddInt32(ss.remaining, 1)
-					sinkCh <- st
-				}
-			} else {
-				if atomic.LoadInt32(ss.remaining) == 0 {
-					tokenWriteInProgress.Store(false)
-					if ss.exitAfterAuth {
-						return nil
-					}
-				}
+// deliveryCycle collects the outcome of writing a token to each sink it's due
+// to be written to, so that they can be published together as SinkResults.
+type deliveryCycle struct {
+	names     map[*SinkConfig]string
+	pending   map[*SinkConfig]struct{}
+	failed    []*SinkConfig
+	succeeded []*SinkConfig
+	results   []SinkResult
+}
+
+func newDeliveryCycle(names map[*SinkConfig]string, sinks []*SinkConfig) *deliveryCycle {
+	c := &deliveryCycle{
+		names:   names,
+		pending: make(map[*SinkConfig]struct{}, len(sinks)),
+	}
+	for _, s := range sinks {
+		c.pending[s] = struct{}{}
+	}
+	return c
+}
+
+// record adds the outcome of writing to the sink, if it's due to be written
+// to in this cycle and hasn't been already.
+func (c *deliveryCycle) record(s *SinkConfig, bytesWritten int, err error) {
+	if c == nil {
+		return
+	}
+	if _, ok := c.pending[s]; !ok {
+		return
+	}
+	delete(c.pending, s)
+	if err != nil {
+		c.failed = append(c.failed, s)
+	} else {
+		c.succeeded = append(c.succeeded, s)
+	}
+	c.results = append(c.results, SinkResult{
+		Name:         c.names[s],
+		Success:      err == nil,
+		Error:        err,
+		BytesWritten: bytesWritten,
+	})
+}
+
+// abort records any of the sinks that haven't been written to in this cycle
+// as failed with ErrSinkWriteAborted.
+func (c *deliveryCycle) abort(sinks []*SinkConfig) {
+	for _, s := range sinks {
+		c.record(s, 0, ErrSinkWriteAborted)
+	}
+}
+
+// done reports whether every sink due to be written to in this cycle has been.
+func (c *deliveryCycle) done() bool {
+	return c != nil && len(c.pending) == 0
+}
+
+// next returns the cycle in which the sinks that failed in this one will be
+// retried, or nil if none did. With consistent writes, all of the sinks are
+// written again.
+func (c *deliveryCycle) next(sinks []*SinkConfig, consistentWrite bool) *deliveryCycle {
+	switch {
+	case len(c.failed) == 0:
+		return nil
+	case consistentWrite:
+		return newDeliveryCycle(c.names, sinks)
+	default:
+		return newDeliveryCycle(c.names, c.failed)
+	}
+}
+
+// sinkNames returns the name identifying each sink, see SinkConfig.Name.
+func sinkNames(sinks []*SinkConfig) map[*SinkConfig]string {
+	names := make(map[*SinkConfig]string, len(sinks))
+	for i, s := range sinks {
+		switch path, _ := s.Config["path"].(string); {
+		case s.Name != "":
+			names[s] = s.Name
+		case path != "":
+			sum := sha256.Sum256([]byte(path))
+			names[s] = "sink-" + hex.EncodeToString(sum[:4])
+		default:
+			names[s] = fmt.Sprintf("sink[%d]", i)
+		}
+	}
+	return names
+}
+
+// publishResults sends the results of a delivery cycle to the results channel,
+// if one is configured and ready to receive them.
+func (ss *SinkServer) publishResults(results []SinkResult) {
+	if ss.results == nil {
+		return
+	}
+	select {
+	case ss.results <- results:
+	default:
+		ss.logger.Warn("sink results channel is full, dropping results")
+	}
+}
+
+// checkQuorum reports when the current token has been written to fewer than
+// the minimum number of sinks required at the end of a delivery cycle.
+func (ss *SinkServer) checkQuorum(succeeded int) {
+	if succeeded >= ss.minSuccessfulSinks {
+		return
+	}
+
+	ss.errLogger.Error("token has not been written to the minimum number of sinks", "succeeded", succeeded, "required", ss.minSuccessfulSinks)
+	ss.emitEvent(SinkEvent{
+		Type:      QuorumNotMet,
+		Succeeded: succeeded,
+		Required:  ss.minSuccessfulSinks,
+	})
+}
+
+// staleCheckInterval returns how often sinks should be checked for tokens
+// older than their MaxTokenAge, or zero if no sink has one.
+func staleCheckInterval(sinks []*SinkConfig) time.Duration {
+	var interval time.Duration
+	for _, s := range sinks {
+		if s.MaxTokenAge > 0 && (interval == 0 || s.MaxTokenAge < interval) {
+			interval = s.MaxTokenAge
+		}
+	}
+	return interval / 2
+}
+
+// clearStaleSinks empties any sinks whose token hasn't been replaced within
+// their MaxTokenAge.
+func (ss *SinkServer) clearStaleSinks(names map[*SinkConfig]string, sinks []*SinkConfig) {
+	for _, s := range sinks {
+		if s.MaxTokenAge <= 0 || s.cleared || time.Since(s.lastWrite) < s.MaxTokenAge {
+			continue
+		}
+
+		clearable, ok := s.Sink.(ClearableSink)
+		if !ok {
+			ss.logger.Warn("token in sink is older than max token age, but the sink doesn't support clearing it", "sink", names[s], "max_token_age", s.MaxTokenAge.String())
+			s.cleared = true
+			continue
+		}
+
+		ss.logger.Warn("token in sink is older than max token age, clearing", "sink", names[s], "max_token_age", s.MaxTokenAge.String())
+		if err := clearable.ClearToken(); err != nil {
+			ss.errLogger.Error("error clearing stale token from sink, retrying", "sink", names[s], "error", err)
+			continue
+		}
+		s.cleared = true
+	}
+}
+
+// writeToken writes the token to the sink, passing ctx to sinks that take
+// one.
+func (s *SinkConfig) writeToken(ctx context.Context, token string) error {
+	if contextSink, ok := s.Sink.(ContextSink); ok {
+		return contextSink.WriteTokenWithContext(ctx, token)
+	}
+	return s.WriteToken(token)
+}
+
+// newHookContext returns the context passed to ContextSinks when writing the
+// token.
+func (ss *SinkServer) newHookContext(ctx context.Context, token string) context.Context {
+	ctx = hookcontext.WithRenewed(ctx, false)
+	hookCtx, err := hookcontext.New(ctx, ss.client, token)
+	if err != nil {
+		ss.logger.Warn("error creating client for sinks, only passing the token", "error", err)
+		return hookcontext.WithToken(ctx, token)
+	}
+	return hookCtx
+}
+
+// tokenRenewed tells the RenewalSinks the token has been written to that it
+// has been delivered again.
+func (ss *SinkServer) tokenRenewed(hookCtx context.Context, names map[*SinkConfig]string, sinks []*SinkConfig, delivered map[*SinkConfig]struct{}, token string) {
+	ctx := hookcontext.WithRenewed(hookCtx, true)
+	for _, s := range sinks {
+		renewalSink, ok := s.Sink.(RenewalSink)
+		if !ok {
+			continue
+		}
+		if _, ok := delivered[s]; !ok {
+			continue
+		}
+		if err := renewalSink.TokenRenewed(ctx, token); err != nil {
+			ss.logger.Warn("error telling sink of renewed token", "sink", names[s], "error", err)
+		}
+	}
+}
+
+// written records that a token has been written to the sink, logging its
+// recovery if it was read-only.
+func (ss *SinkServer) written(name string, s *SinkConfig) {
+	s.lastWrite = time.Now()
+	s.cleared = false
+	ss.countWrite(name, "success")
+	ss.statuses.written(s)
+
+	if s.readOnlySince.IsZero() {
+		return
+	}
+	ss.logger.Info("sink is writable again, token written", "sink", name, "read_only_for", time.Since(s.readOnlySince).String())
+	s.readOnlySince = time.Time{}
+	s.readOnlyLogged = time.Time{}
+	ss.emitEvent(SinkEvent{
+		Type: SinkRecovered,
+		Sink: name,
+	})
+}
+
+// countWrite counts a write to the named sink with the given outcome, if
+// metrics are enabled.
+func (ss *SinkServer) countWrite(name, outcome string) {
+	if ss.metricsSignifier == "" {
+		return
+	}
+	metrics.IncrCounterWithLabels([]string{ss.metricsSignifier, "sink", "write", outcome}, 1, []metrics.Label{
+		{Name: "sink", Value: name},
+	})
+}
+
+// writeFailed tracks sinks whose writes fail because their destination is
+// read-only. The sink is degraded, keeping the last token written to it, until
+// a write succeeds; the error is logged when that starts, and then at most
+// once every readOnlyLogInterval. Writes skipped because the destination is
+// locked are reported with an event each time.
+func (ss *SinkServer) writeFailed(name string, s *SinkConfig, err error) {
+	ss.countWrite(name, "failure")
+	ss.statuses.failed(s, err)
+	if errors.Is(err, ErrLocked) {
+		ss.emitEvent(SinkEvent{
+			Type:  SinkLocked,
+			Sink:  name,
+			Error: err,
+		})
+		return
+	}
+	if !errors.Is(err, ErrReadOnly) {
+		return
+	}
+
+	now := time.Now()
+	switch {
+	case s.readOnlySince.IsZero():
+		s.readOnlySince = now
+		s.readOnlyLogged = now
+		ss.logger.Error("sink destination is read-only, keeping its last token and retrying", "sink", name, "error", err)
+		ss.emitEvent(SinkEvent{
+			Type: SinkReadOnly,
+			Sink: name,
+		})
+	case now.Sub(s.readOnlyLogged) >= readOnlyLogInterval:
+		s.readOnlyLogged = now
+		ss.logger.Error("sink destination is still read-only, retrying", "sink", name, "read_only_for", now.Sub(s.readOnlySince).String(), "error", err)
+	}
+}
+
+// initSinks creates any sinks which have not yet been created, retrying with
+// backoff until the sink init timeout elapses.
+func (ss *SinkServer) initSinks(ctx context.Context, sinks []*SinkConfig) error {
+	var pending []*SinkConfig
+	for _, s := range sinks {
+		if s.Sink == nil && s.NewSink != nil {
+			pending = append(pending, s)
+		}
+	}
+	if len(pending) == 0 {
+		return nil
+	}
+
+	initCtx, cancel := context.WithTimeout(ctx, ss.sinkInitTimeout)
+	defer cancel()
+	initBackoff := backoff.NewBackoff(math.MaxInt, consts.DefaultMinBackoff, consts.DefaultMaxBackoff)
+
+	for {
+		var lastErr error
+		remaining := pending[:0]
+		for _, s := range pending {
+			snk, err := s.NewSink(s)
+			if err != nil {
+				lastErr = err
+				remaining = append(remaining, s)
+				continue
 			}
+			s.Sink = snk
+		}
+		pending = remaining
+		if len(pending) == 0 {
+			return nil
+		}
+
+		sleep, _ := initBackoff.Next()
+		ss.errLogger.Warn("error creating sink, retrying", "error", lastErr, "remaining", len(pending), "backoff", sleep.String())
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-initCtx.Done():
+			return fmt.Errorf("sink server: error creating sinks: %w", lastErr)
+		case <-time.After(sleep):
 		}
 	}
 }
 
+// prepareToken applies any response wrapping and encryption configured for the
+// sink to the token, or its accessor if that's what the sink emits, returning
+// the value that should be written.
+func (ss *SinkServer) prepareToken(currSink *SinkConfig, currToken string) (string, error) {
+	var err error
+
+	if currSink.Emit == EmitAccessor {
+		if currToken, err = ss.lookupAccessor(currToken); err != nil {
+			return "", err
+		}
+	}
+
+	if currSink.WrapTTL != 0 {
+		if currToken, err = currSink.wrapToken(ss.client, ss.namespace, currSink.WrapTTL, currToken); err != nil {
+			return "", err
+		}
+	}
+
+	if currSink.DHType != "" {
+		if currToken, err = currSink.encryptToken(currToken); err != nil {
+			return "", err
+		}
+	}
+
+	return currToken, nil
+}
+
+// lookupAccessor returns the accessor of token, looking it up with the token
+// itself. The accessor of the latest token is cached, so that it's only looked
+// up once however many sinks emit it.
+func (ss *SinkServer) lookupAccessor(token string) (string, error) {
+	if token == ss.accessorToken {
+		return ss.accessor, nil
+	}
+	if ss.client == nil {
+		return "", errors.New("no client to look up the token's accessor with, not writing out to sink")
+	}
+
+	lookupClient, err := ss.client.CloneWithHeaders()
+	if err != nil {
+		return "", fmt.Errorf("error deriving client for token lookup, not writing out to sink: %w", err)
+	}
+	if ss.namespace != "" {
+		lookupClient.SetNamespace(ss.namespace)
+	}
+	lookupClient.SetToken(token)
+
+	secret, err := lookupClient.Auth().Token().LookupSelf()
+	if err != nil {
+		return "", fmt.Errorf("error looking up token's accessor, not writing out to sink: %w", err)
+	}
+	accessor, err := secret.TokenAccessor()
+	if err != nil {
+		return "", fmt.Errorf("error reading token's accessor, not writing out to sink: %w", err)
+	}
+	if accessor == "" {
+		return "", errors.New("token has no accessor, not writing out to sink")
+	}
+
+	ss.accessorToken, ss.accessor = token, accessor
+	return accessor, nil
+}
+
 func (s *SinkConfig) encryptToken(token string) (string, error) {
 	var aesKey []byte
 	var err error
@@ -242,12 +1060,16 @@ func (s *SinkConfig) encryptToken(token string) (string, error) {
 	return string(m), nil
 }
 
-func (s *SinkConfig) wrapToken(client *api.Client, wrapTTL time.Duration, token string) (string, error) {
+func (s *SinkConfig) wrapToken(client *api.Client, namespace string, wrapTTL time.Duration, token string) (string, error) {
 	wrapClient, err := client.CloneWithHeaders()
 	if err != nil {
 		return "", fmt.Errorf("error deriving client for wrapping, not writing out to sink: %w)", err)
 	}
 
+	if namespace != "" {
+		wrapClient.SetNamespace(namespace)
+	}
+
 	wrapClient.SetToken(token)
 	wrapClient.SetWrappingLookupFunc(func(string, string) string {
 		return wrapTTL.String()
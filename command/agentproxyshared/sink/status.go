@@ -0,0 +1,104 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: BUSL-1.1
+
+package sink
+
+import (
+	"net/url"
+	"sync"
+	"time"
+)
+
+// SinkStatus is the state of writing tokens to a single sink, as returned by
+// SinkServer.SinkStatuses.
+type SinkStatus struct {
+	// Name identifies the sink, see SinkConfig.Name.
+	Name string
+	// Destination is where the sink writes tokens to, such as its path or
+	// URL, if it has one.
+	Destination string
+	// LastWrite is when a token was last written to the sink, or zero if
+	// none has been.
+	LastWrite time.Time
+	// LastError is the error the last failed write to the sink returned,
+	// and LastErrorTime when that was. They're kept after later writes
+	// succeed, which LastWrite being after LastErrorTime shows.
+	LastError     error
+	LastErrorTime time.Time
+}
+
+// sinkStatuses holds the status of each sink the SinkServer is running with.
+type sinkStatuses struct {
+	l        sync.Mutex
+	statuses []*SinkStatus
+	bySink   map[*SinkConfig]*SinkStatus
+}
+
+// SinkStatuses returns the status of each sink the SinkServer is running
+// with, in the order they were given to Run. It's safe to call while the
+// server is running, and returns nil before Run is called.
+func (ss *SinkServer) SinkStatuses() []SinkStatus {
+	ss.statuses.l.Lock()
+	defer ss.statuses.l.Unlock()
+	if ss.statuses.statuses == nil {
+		return nil
+	}
+	statuses := make([]SinkStatus, 0, len(ss.statuses.statuses))
+	for _, status := range ss.statuses.statuses {
+		statuses = append(statuses, *status)
+	}
+	return statuses
+}
+
+// reset replaces the statuses with empty ones for the sinks.
+func (s *sinkStatuses) reset(names map[*SinkConfig]string, sinks []*SinkConfig) {
+	s.l.Lock()
+	defer s.l.Unlock()
+	s.statuses = make([]*SinkStatus, 0, len(sinks))
+	s.bySink = make(map[*SinkConfig]*SinkStatus, len(sinks))
+	for _, sink := range sinks {
+		status := &SinkStatus{
+			Name:        names[sink],
+			Destination: sinkDestination(sink),
+		}
+		s.statuses = append(s.statuses, status)
+		s.bySink[sink] = status
+	}
+}
+
+// written records that a token was written to the sink.
+func (s *sinkStatuses) written(sink *SinkConfig) {
+	s.l.Lock()
+	defer s.l.Unlock()
+	if status, ok := s.bySink[sink]; ok {
+		status.LastWrite = time.Now()
+	}
+}
+
+// failed records that writing a token to the sink failed with err.
+func (s *sinkStatuses) failed(sink *SinkConfig, err error) {
+	s.l.Lock()
+	defer s.l.Unlock()
+	if status, ok := s.bySink[sink]; ok {
+		status.LastError = err
+		status.LastErrorTime = time.Now()
+	}
+}
+
+// sinkDestination returns where the sink writes tokens to, from its path, URL
+// or Kubernetes secret name, with any password in its URL redacted.
+func sinkDestination(s *SinkConfig) string {
+	for _, key := range []string{"path", "url", "secret_name"} {
+		dest, _ := s.Config[key].(string)
+		if dest == "" {
+			continue
+		}
+		if key == "url" {
+			if u, err := url.Parse(dest); err == nil {
+				dest = u.Redacted()
+			}
+		}
+		return dest
+	}
+	return ""
+}
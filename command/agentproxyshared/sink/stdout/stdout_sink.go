@@ -0,0 +1,117 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: BUSL-1.1
+
+package stdout
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	hclog "github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/vault/command/agentproxyshared/sink"
+)
+
+const (
+	// FormatPlain writes each token on its own line.
+	FormatPlain = "plain"
+
+	// FormatJSON writes each token as a JSON object on its own line, with the
+	// time it was written.
+	FormatJSON = "json"
+)
+
+// stdoutSink is a Sink implementation that writes each token to standard
+// output, or another io.Writer, so that it can be piped into another process.
+type stdoutSink struct {
+	logger hclog.Logger
+	format string
+
+	l sync.Mutex
+	w io.Writer
+}
+
+// jsonToken is the JSON framing of a token written with FormatJSON.
+type jsonToken struct {
+	Token string    `json:"token"`
+	Time  time.Time `json:"time"`
+}
+
+// NewStdoutSink creates a new stdout sink, which writes to os.Stdout, with
+// the given configuration.
+func NewStdoutSink(conf *sink.SinkConfig) (sink.Sink, error) {
+	return NewStdoutSinkWithWriter(conf, os.Stdout)
+}
+
+// NewStdoutSinkWithWriter creates a new stdout sink which writes to w
+// instead of os.Stdout.
+func NewStdoutSinkWithWriter(conf *sink.SinkConfig, w io.Writer) (sink.Sink, error) {
+	if conf.Logger == nil {
+		return nil, errors.New("nil logger provided")
+	}
+	if w == nil {
+		return nil, errors.New("nil writer provided")
+	}
+
+	conf.Logger.Info("creating stdout sink")
+
+	s := &stdoutSink{
+		logger: conf.Logger,
+		format: FormatPlain,
+		w:      w,
+	}
+
+	if formatRaw, ok := conf.Config["format"]; ok {
+		s.format, ok = formatRaw.(string)
+		if !ok {
+			return nil, errors.New("could not parse 'format' as string")
+		}
+	}
+	switch s.format {
+	case FormatPlain, FormatJSON:
+	default:
+		return nil, fmt.Errorf("unknown 'format' %q, must be %q or %q", s.format, FormatPlain, FormatJSON)
+	}
+
+	s.logger.Info("stdout sink configured", "format", s.format)
+
+	return s, nil
+}
+
+// WriteToken implements the Sink interface, writing the token on its own
+// line, and flushing the writer if it's buffered.
+func (s *stdoutSink) WriteToken(token string) error {
+	s.logger.Trace("enter write_token")
+	defer s.logger.Trace("exit write_token")
+
+	line := []byte(token)
+	if s.format == FormatJSON {
+		var err error
+		line, err = json.Marshal(jsonToken{Token: token, Time: time.Now().UTC()})
+		if err != nil {
+			return fmt.Errorf("error encoding token: %w", err)
+		}
+	}
+	line = append(line, '\n')
+
+	s.l.Lock()
+	defer s.l.Unlock()
+
+	// The line is written in one call, so that a consumer never reads part
+	// of a token
+	if _, err := s.w.Write(line); err != nil {
+		return fmt.Errorf("error writing token: %w", err)
+	}
+	if f, ok := s.w.(interface{ Flush() error }); ok {
+		if err := f.Flush(); err != nil {
+			return fmt.Errorf("error flushing token: %w", err)
+		}
+	}
+
+	s.logger.Info("token written")
+	return nil
+}
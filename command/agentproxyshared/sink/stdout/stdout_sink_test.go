@@ -0,0 +1,71 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: BUSL-1.1
+
+package stdout
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	hclog "github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/vault/command/agentproxyshared/sink"
+	"github.com/hashicorp/vault/sdk/helper/logging"
+)
+
+func newTestStdoutSink(t *testing.T, config map[string]interface{}, w *bufio.Writer) (sink.Sink, error) {
+	t.Helper()
+	return NewStdoutSinkWithWriter(&sink.SinkConfig{
+		Logger: logging.NewVaultLogger(hclog.Trace).Named("sink.stdout"),
+		Config: config,
+	}, w)
+}
+
+func TestStdoutSink(t *testing.T) {
+	var out bytes.Buffer
+	s, err := newTestStdoutSink(t, nil, bufio.NewWriter(&out))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Each token is flushed straight away
+	for _, token := range []string{"token-1", "token-2"} {
+		if err := s.WriteToken(token); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if out.String() != "token-1\ntoken-2\n" {
+		t.Fatalf("unexpected output %q", out.String())
+	}
+}
+
+func TestStdoutSink_JSON(t *testing.T) {
+	var out bytes.Buffer
+	s, err := newTestStdoutSink(t, map[string]interface{}{"format": "json"}, bufio.NewWriter(&out))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.WriteToken("test-token"); err != nil {
+		t.Fatal(err)
+	}
+
+	if !strings.HasSuffix(out.String(), "}\n") || strings.Count(out.String(), "\n") != 1 {
+		t.Fatalf("expected a single line, got %q", out.String())
+	}
+	var written jsonToken
+	if err := json.Unmarshal(out.Bytes(), &written); err != nil {
+		t.Fatal(err)
+	}
+	if written.Token != "test-token" || written.Time.IsZero() {
+		t.Fatalf("unexpected output %q", out.String())
+	}
+}
+
+func TestStdoutSink_Format(t *testing.T) {
+	_, err := newTestStdoutSink(t, map[string]interface{}{"format": "yaml"}, bufio.NewWriter(&bytes.Buffer{}))
+	if err == nil || !strings.Contains(err.Error(), `unknown 'format' "yaml"`) {
+		t.Fatalf("expected unknown format error, got %v", err)
+	}
+}
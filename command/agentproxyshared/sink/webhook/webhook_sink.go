@@ -0,0 +1,255 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: BUSL-1.1
+
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/hashicorp/go-cleanhttp"
+	hclog "github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/go-secure-stdlib/parseutil"
+	"github.com/hashicorp/vault/command/agentproxyshared/hookcontext"
+	"github.com/hashicorp/vault/command/agentproxyshared/sink"
+	"github.com/hashicorp/vault/sdk/helper/backoff"
+)
+
+const (
+	defaultTimeout    = 10 * time.Second
+	defaultMaxRetries = 3
+	minRetryBackoff   = 500 * time.Millisecond
+	maxRetryBackoff   = 10 * time.Second
+)
+
+// webhookSink is a Sink implementation that POSTs a notification to a URL
+// each time a new token is written to it, such as to an event bus, so that
+// token rotation can be acted on without a custom process. The notification
+// carries the token's accessor, looked up with the client passed in the
+// context by the SinkServer, and not the token itself unless includeToken is
+// set.
+//
+// A failed POST is retried with backoff up to maxRetries times, after which
+// the error is returned, so that the SinkServer retries it later.
+type webhookSink struct {
+	logger       hclog.Logger
+	url          string
+	headers      http.Header
+	includeToken bool
+	timeout      time.Duration
+	maxRetries   int
+	client       *http.Client
+}
+
+var _ sink.ContextSink = (*webhookSink)(nil)
+
+// Notification is the JSON body of the POST made by the webhook sink.
+type Notification struct {
+	Time     time.Time `json:"time"`
+	Accessor string    `json:"accessor"`
+	// LeaseDuration is the token's TTL, in seconds, when it was delivered
+	LeaseDuration int64 `json:"lease_duration"`
+	// Token is only set if include_token is, and is the token as written to
+	// the sink, so it may be response-wrapped or encrypted
+	Token string `json:"token,omitempty"`
+}
+
+// NewWebhookSink creates a new webhook sink with the given configuration.
+// Nothing is sent until a token is written.
+func NewWebhookSink(conf *sink.SinkConfig) (sink.Sink, error) {
+	if conf.Logger == nil {
+		return nil, errors.New("nil logger provided")
+	}
+
+	conf.Logger.Info("creating webhook sink")
+
+	w := &webhookSink{
+		logger:     conf.Logger,
+		headers:    make(http.Header),
+		timeout:    defaultTimeout,
+		maxRetries: defaultMaxRetries,
+		client:     cleanhttp.DefaultClient(),
+	}
+
+	urlRaw, ok := conf.Config["url"]
+	if !ok {
+		return nil, errors.New("'url' not specified for webhook sink")
+	}
+	w.url, ok = urlRaw.(string)
+	if !ok || w.url == "" {
+		return nil, errors.New("could not parse 'url' as string")
+	}
+	u, err := url.Parse(w.url)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse 'url': %w", err)
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, errors.New("'url' must be an http or https URL")
+	}
+
+	if headersRaw, ok := conf.Config["headers"]; ok {
+		if err := parseHeaders(w.headers, headersRaw); err != nil {
+			return nil, err
+		}
+	}
+
+	if includeTokenRaw, ok := conf.Config["include_token"]; ok {
+		w.includeToken, err = parseutil.ParseBool(includeTokenRaw)
+		if err != nil {
+			return nil, fmt.Errorf("could not parse 'include_token': %w", err)
+		}
+	}
+
+	if timeoutRaw, ok := conf.Config["timeout"]; ok {
+		w.timeout, err = parseutil.ParseDurationSecond(timeoutRaw)
+		if err != nil {
+			return nil, fmt.Errorf("could not parse 'timeout': %w", err)
+		}
+		if w.timeout <= 0 {
+			return nil, errors.New("'timeout' must be positive")
+		}
+	}
+
+	if maxRetriesRaw, ok := conf.Config["max_retries"]; ok {
+		w.maxRetries, err = parseutil.SafeParseInt(maxRetriesRaw)
+		if err != nil {
+			return nil, fmt.Errorf("could not parse 'max_retries': %w", err)
+		}
+		if w.maxRetries < 0 {
+			return nil, errors.New("'max_retries' must not be negative")
+		}
+	}
+
+	w.logger.Info("webhook sink configured", "url", w.url, "include_token", w.includeToken, "max_retries", w.maxRetries)
+
+	return w, nil
+}
+
+// parseHeaders adds the headers configured as raw, a map of names to values,
+// to headers. HCL decodes a nested map as a list of maps, so both are
+// accepted.
+func parseHeaders(headers http.Header, raw interface{}) error {
+	var maps []map[string]interface{}
+	switch h := raw.(type) {
+	case map[string]interface{}:
+		maps = []map[string]interface{}{h}
+	case []map[string]interface{}:
+		maps = h
+	default:
+		return errors.New("could not parse 'headers' as a map of strings")
+	}
+	for _, m := range maps {
+		for key, valueRaw := range m {
+			value, ok := valueRaw.(string)
+			if !ok || key == "" {
+				return errors.New("could not parse 'headers' as a map of strings")
+			}
+			headers.Set(key, value)
+		}
+	}
+	return nil
+}
+
+// WriteToken implements the Sink interface. It always fails, as the webhook
+// sink needs a client to look up the token's accessor with, which is only
+// passed to WriteTokenWithContext.
+func (w *webhookSink) WriteToken(token string) error {
+	return w.WriteTokenWithContext(context.Background(), token)
+}
+
+// WriteTokenWithContext implements the ContextSink interface, POSTing a
+// notification of the token to the URL. The token is looked up with the
+// client in ctx, rather than the token given, which may have been
+// response-wrapped or encrypted.
+func (w *webhookSink) WriteTokenWithContext(ctx context.Context, token string) error {
+	w.logger.Trace("enter write_token", "url", w.url)
+	defer w.logger.Trace("exit write_token", "url", w.url)
+
+	client, ok := hookcontext.Client(ctx)
+	if !ok {
+		return errors.New("no client to look up the token with, not sending webhook")
+	}
+	secret, err := client.Auth().Token().LookupSelfWithContext(ctx)
+	if err != nil {
+		return fmt.Errorf("error looking up token, not sending webhook: %w", err)
+	}
+	accessor, err := secret.TokenAccessor()
+	if err != nil {
+		return fmt.Errorf("error reading token's accessor, not sending webhook: %w", err)
+	}
+	ttl, err := secret.TokenTTL()
+	if err != nil {
+		return fmt.Errorf("error reading token's TTL, not sending webhook: %w", err)
+	}
+
+	notification := &Notification{
+		Time:          time.Now().UTC(),
+		Accessor:      accessor,
+		LeaseDuration: int64(ttl.Seconds()),
+	}
+	if w.includeToken {
+		notification.Token = token
+	}
+	body, err := json.Marshal(notification)
+	if err != nil {
+		return fmt.Errorf("error encoding webhook notification: %w", err)
+	}
+
+	retryBackoff := backoff.NewBackoff(w.maxRetries, minRetryBackoff, maxRetryBackoff)
+	for {
+		err := w.post(ctx, body)
+		if err == nil {
+			break
+		}
+		sleep, maxRetryErr := retryBackoff.Next()
+		if maxRetryErr != nil {
+			return fmt.Errorf("error sending webhook: %w", err)
+		}
+		w.logger.Warn("error sending webhook, retrying", "url", w.url, "error", err, "backoff", sleep.String())
+
+		timer := time.NewTimer(sleep)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return fmt.Errorf("error sending webhook: %w", err)
+		case <-timer.C:
+		}
+	}
+
+	w.logger.Info("token rotation notification sent", "url", w.url, "accessor", accessor)
+	return nil
+}
+
+// post makes a single POST of body to the URL, returning an error unless it
+// responds with a 2xx status.
+func (w *webhookSink) post(ctx context.Context, body []byte) error {
+	ctx, cancel := context.WithTimeout(ctx, w.timeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, w.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header = w.headers.Clone()
+	if req.Header.Get("Content-Type") == "" {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return err
+	}
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 4096))
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("webhook responded with %s", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,169 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: BUSL-1.1
+
+package webhook
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	hclog "github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/vault/api"
+	"github.com/hashicorp/vault/command/agentproxyshared/hookcontext"
+	"github.com/hashicorp/vault/command/agentproxyshared/sink"
+	"github.com/hashicorp/vault/sdk/helper/logging"
+)
+
+func newTestWebhookSink(t *testing.T, config map[string]interface{}) sink.ContextSink {
+	t.Helper()
+	s, err := NewWebhookSink(&sink.SinkConfig{
+		Logger: logging.NewVaultLogger(hclog.Trace).Named("sink.webhook"),
+		Config: config,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s.(sink.ContextSink)
+}
+
+// newTestContext returns the context the SinkServer would pass when writing
+// token, with a client for a server which answers lookups of it.
+func newTestContext(t *testing.T, token string) context.Context {
+	t.Helper()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/auth/token/lookup-self" || r.Header.Get("X-Vault-Token") != token {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"data": {"accessor": "accessor-` + token + `", "ttl": 3600}}`))
+	}))
+	t.Cleanup(server.Close)
+
+	config := api.DefaultConfig()
+	config.Address = server.URL
+	client, err := api.NewClient(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, err := hookcontext.New(context.Background(), client, token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ctx
+}
+
+// webhookReceiver records the notifications POSTed to it, after failing the
+// first failures attempts.
+type webhookReceiver struct {
+	l             sync.Mutex
+	failures      int
+	attempts      int
+	gatewayKeys   []string
+	notifications []map[string]interface{}
+}
+
+func (rcv *webhookReceiver) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	rcv.l.Lock()
+	defer rcv.l.Unlock()
+	rcv.attempts++
+	if rcv.attempts <= rcv.failures {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+	var notification map[string]interface{}
+	if r.Method != http.MethodPost || json.NewDecoder(r.Body).Decode(&notification) != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	rcv.gatewayKeys = append(rcv.gatewayKeys, r.Header.Get("X-Gateway-Key"))
+	rcv.notifications = append(rcv.notifications, notification)
+}
+
+// TestWebhookSink tests that a notification of each token is POSTed with the
+// configured headers, retried after a failure, and carries the token only
+// when include_token is set.
+func TestWebhookSink(t *testing.T) {
+	rcv := &webhookReceiver{failures: 1}
+	server := httptest.NewServer(rcv)
+	defer server.Close()
+
+	config := map[string]interface{}{
+		"url": server.URL,
+		"headers": []map[string]interface{}{
+			{"X-Gateway-Key": "gateway-secret"},
+		},
+	}
+	s := newTestWebhookSink(t, config)
+	if err := s.WriteTokenWithContext(newTestContext(t, "token-1"), "token-1"); err != nil {
+		t.Fatal(err)
+	}
+
+	config["include_token"] = true
+	s = newTestWebhookSink(t, config)
+	if err := s.WriteTokenWithContext(newTestContext(t, "token-2"), "token-2"); err != nil {
+		t.Fatal(err)
+	}
+
+	rcv.l.Lock()
+	defer rcv.l.Unlock()
+	if rcv.attempts != 3 || len(rcv.notifications) != 2 {
+		t.Fatalf("expected 2 notifications in 3 attempts, got %d in %d", len(rcv.notifications), rcv.attempts)
+	}
+	for idx, token := range []string{"token-1", "token-2"} {
+		notification := rcv.notifications[idx]
+		if notification["accessor"] != "accessor-"+token || notification["lease_duration"] != float64(3600) || notification["time"] == "" {
+			t.Fatalf("unexpected notification %#v", notification)
+		}
+		if rcv.gatewayKeys[idx] != "gateway-secret" {
+			t.Fatalf("expected X-Gateway-Key header, got %q", rcv.gatewayKeys[idx])
+		}
+	}
+	if _, ok := rcv.notifications[0]["token"]; ok {
+		t.Fatalf("expected no token without include_token, got %#v", rcv.notifications[0])
+	}
+	if rcv.notifications[1]["token"] != "token-2" {
+		t.Fatalf("expected token with include_token, got %#v", rcv.notifications[1])
+	}
+}
+
+// TestWebhookSink_MaxRetries tests that an error is returned once the
+// retries are exhausted, so that the SinkServer retries the write.
+func TestWebhookSink_MaxRetries(t *testing.T) {
+	rcv := &webhookReceiver{failures: 10}
+	server := httptest.NewServer(rcv)
+	defer server.Close()
+
+	s := newTestWebhookSink(t, map[string]interface{}{
+		"url":         server.URL,
+		"max_retries": 0,
+	})
+	err := s.WriteTokenWithContext(newTestContext(t, "token-1"), "token-1")
+	if err == nil || !strings.Contains(err.Error(), "503") {
+		t.Fatalf("expected error from webhook, got %v", err)
+	}
+	if rcv.attempts != 1 {
+		t.Fatalf("expected 1 attempt, got %d", rcv.attempts)
+	}
+
+	if err := s.WriteToken("token-1"); err == nil {
+		t.Fatal("expected error writing without a client")
+	}
+
+	for _, config := range []map[string]interface{}{
+		{},
+		{"url": "ftp://example.com"},
+		{"url": server.URL, "headers": "X-Gateway-Key"},
+		{"url": server.URL, "max_retries": -1},
+		{"url": server.URL, "include_token": "maybe"},
+	} {
+		if _, err := NewWebhookSink(&sink.SinkConfig{Logger: hclog.NewNullLogger(), Config: config}); err == nil {
+			t.Fatalf("expected error for config %v", config)
+		}
+	}
+}
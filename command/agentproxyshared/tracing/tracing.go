@@ -0,0 +1,105 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: BUSL-1.1
+
+// Package tracing traces auto-auth with OpenTelemetry, so that authenticating,
+// writing the token to sinks and rendering templates with it show up as one
+// trace.
+package tracing
+
+import (
+	"context"
+	"sync"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+	"go.opentelemetry.io/otel/trace/noop"
+)
+
+// CorrelationIDKey is the span attribute holding the request ID of the
+// authentication which issued the token a span is for.
+const CorrelationIDKey = attribute.Key("vault.correlation_id")
+
+type contextKey int
+
+const correlationIDKey contextKey = iota
+
+// noopSpan is returned by a nil Tracer.
+var noopSpan trace.Span = noop.Span{}
+
+// Tracer starts spans with an OpenTelemetry tracer, and links the spans of
+// the servers a token is delivered to to the trace of the authentication
+// which issued it. The auth handler, sink server and template server should
+// share one Tracer. A nil Tracer traces nothing, and costs nothing.
+type Tracer struct {
+	tracer trace.Tracer
+
+	l             sync.Mutex
+	token         string
+	tokenSpan     trace.SpanContext
+	correlationID string
+}
+
+// NewTracer returns a Tracer starting spans with tracer.
+func NewTracer(tracer trace.Tracer) *Tracer {
+	return &Tracer{
+		tracer: tracer,
+	}
+}
+
+// Start starts a span with attrs as a child of any span in ctx, adding the
+// correlation ID of any token ctx is for.
+func (t *Tracer) Start(ctx context.Context, name string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	if t == nil {
+		return ctx, noopSpan
+	}
+	if correlationID, ok := ctx.Value(correlationIDKey).(string); ok && correlationID != "" {
+		attrs = append(attrs, CorrelationIDKey.String(correlationID))
+	}
+	return t.tracer.Start(ctx, name, trace.WithAttributes(attrs...))
+}
+
+// TokenIssued records that token was issued by the authentication traced by
+// the span in ctx, whose request had the given ID, so that the spans of the
+// servers it's delivered to join its trace. Only the latest token is kept.
+func (t *Tracer) TokenIssued(ctx context.Context, token, correlationID string) {
+	if t == nil {
+		return
+	}
+	span := trace.SpanFromContext(ctx)
+	if correlationID != "" {
+		span.SetAttributes(CorrelationIDKey.String(correlationID))
+	}
+
+	t.l.Lock()
+	defer t.l.Unlock()
+	t.token = token
+	t.tokenSpan = span.SpanContext()
+	t.correlationID = correlationID
+}
+
+// TokenContext returns a copy of ctx carrying the span of the authentication
+// which issued token, so that spans started with it join that trace. If token
+// isn't the latest issued, ctx is returned as it is.
+func (t *Tracer) TokenContext(ctx context.Context, token string) context.Context {
+	if t == nil {
+		return ctx
+	}
+
+	t.l.Lock()
+	defer t.l.Unlock()
+	if token != t.token || !t.tokenSpan.IsValid() {
+		return ctx
+	}
+	ctx = trace.ContextWithSpanContext(ctx, t.tokenSpan)
+	return context.WithValue(ctx, correlationIDKey, t.correlationID)
+}
+
+// End ends span, marking it failed if err isn't nil.
+func End(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
@@ -0,0 +1,75 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: BUSL-1.1
+
+package tracing
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+func TestTracer_Nil(t *testing.T) {
+	var tracer *Tracer
+	ctx := context.Background()
+
+	spanCtx, span := tracer.Start(ctx, "test")
+	if spanCtx != ctx {
+		t.Fatal("expected the context to be returned as it is")
+	}
+	if span.IsRecording() || span.SpanContext().IsValid() {
+		t.Fatal("expected a no-op span")
+	}
+	End(span, errors.New("failed"))
+
+	tracer.TokenIssued(ctx, "token", "request-id")
+	if tracer.TokenContext(ctx, "token") != ctx {
+		t.Fatal("expected the context to be returned as it is")
+	}
+}
+
+func TestTracer_TokenContext(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+	tracer := NewTracer(provider.Tracer("test"))
+
+	authCtx, authSpan := tracer.Start(context.Background(), "auth")
+	tracer.TokenIssued(authCtx, "token", "request-id")
+	End(authSpan, nil)
+
+	// Only the latest token is linked to its authentication
+	if ctx := tracer.TokenContext(context.Background(), "old-token"); trace.SpanContextFromContext(ctx).IsValid() {
+		t.Fatal("expected no span for an old token")
+	}
+
+	_, writeSpan := tracer.Start(tracer.TokenContext(context.Background(), "token"), "write")
+	End(writeSpan, errors.New("write failed"))
+
+	ended := recorder.Ended()
+	if len(ended) != 2 {
+		t.Fatalf("expected 2 spans, got %d", len(ended))
+	}
+	auth, write := ended[0], ended[1]
+	if write.Parent().SpanID() != auth.SpanContext().SpanID() || write.SpanContext().TraceID() != auth.SpanContext().TraceID() {
+		t.Fatal("expected the write span to be a child of the auth span")
+	}
+	for _, span := range ended {
+		found := false
+		for _, attr := range span.Attributes() {
+			if attr.Key == CorrelationIDKey && attr.Value.AsString() == "request-id" {
+				found = true
+			}
+		}
+		if !found {
+			t.Fatalf("expected span %s to have the correlation ID", span.Name())
+		}
+	}
+	if write.Status().Code != codes.Error {
+		t.Fatalf("expected the write span to have failed, got %v", write.Status())
+	}
+}
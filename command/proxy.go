@@ -13,6 +13,7 @@ import (
 	"net/http"
 	"os"
 	"path/filepath"
+	"slices"
 	"sort"
 	"strings"
 	"sync"
@@ -32,8 +33,13 @@ import (
 	"github.com/hashicorp/vault/command/agentproxyshared/auth"
 	"github.com/hashicorp/vault/command/agentproxyshared/cache"
 	"github.com/hashicorp/vault/command/agentproxyshared/sink"
+	"github.com/hashicorp/vault/command/agentproxyshared/sink/audit"
+	commandsink "github.com/hashicorp/vault/command/agentproxyshared/sink/command"
 	"github.com/hashicorp/vault/command/agentproxyshared/sink/file"
 	"github.com/hashicorp/vault/command/agentproxyshared/sink/inmem"
+	"github.com/hashicorp/vault/command/agentproxyshared/sink/kubernetes"
+	"github.com/hashicorp/vault/command/agentproxyshared/sink/stdout"
+	"github.com/hashicorp/vault/command/agentproxyshared/sink/webhook"
 	"github.com/hashicorp/vault/command/agentproxyshared/winsvc"
 	proxyConfig "github.com/hashicorp/vault/command/proxy/config"
 	"github.com/hashicorp/vault/helper/logging"
@@ -204,6 +210,18 @@ func (c *ProxyCommand) Run(args []string) int {
 	}
 
 	c.applyConfigOverrides(f, config) // This only needs to happen on start-up to aggregate config from flags and env vars
+
+	// Only tokens are written to stdout by a stdout sink, so that they can be
+	// piped into another process
+	if config.AutoAuth != nil && slices.ContainsFunc(config.AutoAuth.Sinks, func(sc *proxyConfig.Sink) bool {
+		return sc.Type == "stdout"
+	}) {
+		if c.logFlags.flagCombineLogs {
+			c.UI.Error("The stdout sink can't be used with -combine-logs, as logs would be mixed in with tokens")
+			return 1
+		}
+		c.UI = stderrUI()
+	}
 	c.config = config
 
 	l, err := c.newLogger()
@@ -258,6 +276,26 @@ func (c *ProxyCommand) Run(args []string) int {
 		return 1
 	}
 
+	// Allow the CA and client certificate files used to reach Vault to be
+	// re-read on SIGHUP, along with the listeners' certificates.
+	if c.flagCACert != "" || c.flagCAPath != "" || c.flagClientCert != "" || c.flagClientKey != "" {
+		clientTLSReloader, err := agentproxyshared.NewClientTLSReloader(c.logger.Named("client.tls"), client, &api.TLSConfig{
+			CACert:        c.flagCACert,
+			CAPath:        c.flagCAPath,
+			ClientCert:    c.flagClientCert,
+			ClientKey:     c.flagClientKey,
+			TLSServerName: c.flagTLSServerName,
+			Insecure:      c.flagTLSSkipVerify,
+		})
+		if err != nil {
+			c.UI.Error(fmt.Sprintf("Error configuring client TLS reloading: %v", err))
+			return 1
+		}
+		c.tlsReloadFuncsLock.Lock()
+		c.tlsReloadFuncs = append(c.tlsReloadFuncs, clientTLSReloader.ReloadTLS)
+		c.tlsReloadFuncsLock.Unlock()
+	}
+
 	serverHealth, err := client.Sys().Health()
 	// We don't have any special behaviour if the error != nil, as this
 	// is not worth stopping the Proxy process over.
@@ -319,30 +357,50 @@ func (c *ProxyCommand) Run(args []string) int {
 			sinkClient.SetDisableKeepAlives(true)
 		}
 
+		sinkInitTimeout := config.AutoAuth.SinkInitTimeout
 		for _, sc := range config.AutoAuth.Sinks {
+			var newSink func(*sink.SinkConfig) (sink.Sink, error)
 			switch sc.Type {
 			case "file":
-				config := &sink.SinkConfig{
-					Logger:    c.logger.Named("sink.file"),
-					Config:    sc.Config,
-					Client:    sinkClient,
-					WrapTTL:   sc.WrapTTL,
-					DHType:    sc.DHType,
-					DeriveKey: sc.DeriveKey,
-					DHPath:    sc.DHPath,
-					AAD:       sc.AAD,
-				}
-				s, err := file.NewFileSink(config)
-				if err != nil {
-					c.UI.Error(fmt.Errorf("error creating file sink: %w", err).Error())
-					return 1
-				}
-				config.Sink = s
-				sinks = append(sinks, config)
+				newSink = file.NewFileSink
+			case "kubernetes":
+				newSink = kubernetes.NewKubernetesSink
+			case "command":
+				newSink = commandsink.NewCommandSink
+			case "stdout":
+				newSink = stdout.NewStdoutSink
+			case "audit":
+				newSink = audit.NewAuditSink
+			case "webhook":
+				newSink = webhook.NewWebhookSink
 			default:
 				c.UI.Error(fmt.Sprintf("Unknown sink type %q", sc.Type))
 				return 1
 			}
+
+			config := &sink.SinkConfig{
+				Logger:    c.logger.Named("sink." + sc.Type),
+				Config:    sc.Config,
+				Client:    sinkClient,
+				WrapTTL:   sc.WrapTTL,
+				DHType:    sc.DHType,
+				DeriveKey: sc.DeriveKey,
+				DHPath:    sc.DHPath,
+				AAD:       sc.AAD,
+			}
+			s, err := newSink(config)
+			switch {
+			case err != nil && sinkInitTimeout > 0:
+				// Leave it to the sink server to retry creating the sink
+				c.logger.Warn(fmt.Sprintf("error creating %s sink, will retry", sc.Type), "error", err, "sink_init_timeout", sinkInitTimeout)
+				config.NewSink = newSink
+			case err != nil:
+				c.UI.Error(fmt.Errorf("error creating %s sink: %w", sc.Type, err).Error())
+				return 1
+			default:
+				config.Sink = s
+			}
+			sinks = append(sinks, config)
 		}
 
 		authConfig := &auth.AuthConfig{
@@ -549,9 +607,12 @@ func (c *ProxyCommand) Run(args []string) int {
 			return 1
 		}
 
-		// Override the set namespace with the auto-auth specific namespace
+		// Override the set namespace with the auto-auth specific namespace.
+		// The auth handler applies it on every authentication attempt, and
+		// the sink server uses it when response-wrapping tokens.
+		var authNamespace string
 		if !namespaceSetByEnvironmentVariable && config.AutoAuth.Method.Namespace != "" {
-			ahClient.SetNamespace(config.AutoAuth.Method.Namespace)
+			authNamespace = config.AutoAuth.Method.Namespace
 		}
 
 		if config.DisableIdleConnsAutoAuth {
@@ -573,15 +634,19 @@ func (c *ProxyCommand) Run(args []string) int {
 			ExitOnError:                  config.AutoAuth.Method.ExitOnError,
 			UserAgent:                    useragent.ProxyAutoAuthString(),
 			MetricsSignifier:             "proxy",
+			AuthMethodName:               config.AutoAuth.Method.Type,
+			Namespace:                    authNamespace,
 		})
 
 		authInProgress = ah.AuthInProgress
 		invalidTokenErrCh = ah.InvalidToken
 
 		ss = sink.NewSinkServer(&sink.SinkServerConfig{
-			Logger:        c.logger.Named("sink.server"),
-			Client:        ahClient,
-			ExitAfterAuth: config.ExitAfterAuth,
+			Logger:          c.logger.Named("sink.server"),
+			Client:          ahClient,
+			ExitAfterAuth:   config.ExitAfterAuth,
+			Namespace:       authNamespace,
+			SinkInitTimeout: config.AutoAuth.SinkInitTimeout,
 		})
 	}
 
@@ -1149,6 +1214,7 @@ func (c *ProxyCommand) loadConfig(paths []string) (*proxyConfig.Config, error) {
 // Currently only reloading the following are supported:
 // * log level
 // * TLS certs for listeners
+// * CA and client certificate files used to reach Vault
 func (c *ProxyCommand) reloadConfig(paths []string) error {
 	// Notify systemd that the server is reloading
 	c.notifySystemd(systemd.SdNotifyReloading)
@@ -118,6 +118,12 @@ type AutoAuth struct {
 	Sinks  []*Sink `hcl:"sinks"`
 
 	EnableReauthOnNewCredentials bool `hcl:"enable_reauth_on_new_credentials"`
+
+	// SinkInitTimeout is how long sinks which fail to be created at startup,
+	// e.g. because their directory doesn't exist yet, will be retried before
+	// the proxy gives up. By default, the proxy fails immediately.
+	SinkInitTimeoutRaw interface{}   `hcl:"sink_init_timeout"`
+	SinkInitTimeout    time.Duration `hcl:"-"`
 }
 
 // Method represents the configuration for the authentication backend
@@ -747,6 +753,14 @@ func parseAutoAuth(result *Config, list *ast.ObjectList) error {
 		result.AutoAuth.Method.MinBackoffRaw = nil
 	}
 
+	if result.AutoAuth.SinkInitTimeoutRaw != nil {
+		var err error
+		if result.AutoAuth.SinkInitTimeout, err = parseutil.ParseDurationSecond(result.AutoAuth.SinkInitTimeoutRaw); err != nil {
+			return err
+		}
+		result.AutoAuth.SinkInitTimeoutRaw = nil
+	}
+
 	return nil
 }
 
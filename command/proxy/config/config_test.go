@@ -203,3 +203,41 @@ func TestLoadConfigFile_ProxyCacheStaticSecrets(t *testing.T) {
 		t.Fatal(diff)
 	}
 }
+
+// TestLoadConfigFile_SinkInitTimeout tests loading a config file with an
+// auto-auth sink_init_timeout.
+func TestLoadConfigFile_SinkInitTimeout(t *testing.T) {
+	config, err := LoadConfigFile("./test-fixtures/config-sink-init-timeout.hcl")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := &Config{
+		SharedConfig: &configutil.SharedConfig{
+			PidFile: "./pidfile",
+		},
+		AutoAuth: &AutoAuth{
+			Method: &Method{
+				Type:      "aws",
+				MountPath: "auth/aws",
+				Config: map[string]interface{}{
+					"role": "foobar",
+				},
+			},
+			Sinks: []*Sink{
+				{
+					Type: "file",
+					Config: map[string]interface{}{
+						"path": "/tmp/file-foo",
+					},
+				},
+			},
+			SinkInitTimeout: 30 * time.Second,
+		},
+	}
+
+	config.Prune()
+	if diff := deep.Equal(config, expected); diff != nil {
+		t.Fatal(diff)
+	}
+}
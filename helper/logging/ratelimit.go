@@ -0,0 +1,114 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: BUSL-1.1
+
+package logging
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/go-hclog"
+)
+
+// RateLimitedLogger logs through an hclog.Logger, collapsing repeats of the
+// same message at the same level within a window. The first occurrence of a
+// message is logged straight away, and later ones are counted until the window
+// has passed. The next occurrence after that is logged, and starts a new
+// window, after a line giving the number that were suppressed, such as
+// "4 messages suppressed". Counts not yet logged are logged by Close.
+//
+// Messages are matched on their text alone, so that repeats of an error are
+// collapsed even when the error itself varies. It's intended for the error
+// paths of retry loops, which otherwise log on every attempt during an outage.
+type RateLimitedLogger struct {
+	logger hclog.Logger
+	window time.Duration
+
+	l       sync.Mutex
+	entries map[rateLimitKey]*rateLimitEntry
+}
+
+type rateLimitKey struct {
+	level hclog.Level
+	msg   string
+}
+
+type rateLimitEntry struct {
+	logged     time.Time
+	suppressed int
+}
+
+// NewRateLimitedLogger returns a RateLimitedLogger logging to logger. If
+// window isn't positive, every message is logged.
+func NewRateLimitedLogger(logger hclog.Logger, window time.Duration) *RateLimitedLogger {
+	return &RateLimitedLogger{
+		logger:  logger,
+		window:  window,
+		entries: make(map[rateLimitKey]*rateLimitEntry),
+	}
+}
+
+// Error logs msg at the error level, unless it's been logged within the
+// window.
+func (r *RateLimitedLogger) Error(msg string, args ...interface{}) {
+	r.Log(hclog.Error, msg, args...)
+}
+
+// Warn logs msg at the warn level, unless it's been logged within the window.
+func (r *RateLimitedLogger) Warn(msg string, args ...interface{}) {
+	r.Log(hclog.Warn, msg, args...)
+}
+
+// Log logs msg at the given level, unless it's been logged within the window.
+func (r *RateLimitedLogger) Log(level hclog.Level, msg string, args ...interface{}) {
+	if r.window <= 0 {
+		r.logger.Log(level, msg, args...)
+		return
+	}
+
+	now := time.Now()
+	key := rateLimitKey{level: level, msg: msg}
+
+	r.l.Lock()
+	entry, ok := r.entries[key]
+	if ok && now.Sub(entry.logged) < r.window {
+		entry.suppressed++
+		r.l.Unlock()
+		return
+	}
+	var suppressed int
+	if ok {
+		suppressed = entry.suppressed
+	}
+	r.entries[key] = &rateLimitEntry{logged: now}
+	r.l.Unlock()
+
+	r.logSuppressed(key, suppressed)
+	r.logger.Log(level, msg, args...)
+}
+
+// Close logs the number of each message suppressed since it was last logged,
+// so that they aren't lost on shutdown. The logger can still be used after.
+func (r *RateLimitedLogger) Close() {
+	r.l.Lock()
+	entries := r.entries
+	r.entries = make(map[rateLimitKey]*rateLimitEntry)
+	r.l.Unlock()
+
+	for key, entry := range entries {
+		r.logSuppressed(key, entry.suppressed)
+	}
+}
+
+// logSuppressed logs the number of the message suppressed, if any were.
+func (r *RateLimitedLogger) logSuppressed(key rateLimitKey, suppressed int) {
+	if suppressed == 0 {
+		return
+	}
+	noun := "messages"
+	if suppressed == 1 {
+		noun = "message"
+	}
+	r.logger.Log(key.level, fmt.Sprintf("%d %s suppressed", suppressed, noun), "message", key.msg)
+}
@@ -0,0 +1,68 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: BUSL-1.1
+
+package logging
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/go-hclog"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRateLimitedLogger(t *testing.T) {
+	var buf bytes.Buffer
+	logger := NewRateLimitedLogger(hclog.New(&hclog.LoggerOptions{
+		Output: &buf,
+		Level:  hclog.Trace,
+	}), 100*time.Millisecond)
+
+	for i := 0; i < 5; i++ {
+		logger.Error("error authenticating", "attempt", i)
+	}
+	logger.Warn("error authenticating")
+	logger.Error("error writing token")
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	require.Len(t, lines, 3)
+	require.Contains(t, lines[0], "[ERROR] error authenticating: attempt=0")
+	require.Contains(t, lines[1], "[WARN]  error authenticating")
+	require.Contains(t, lines[2], "[ERROR] error writing token")
+
+	// Once the window has passed, the message is logged after a count of
+	// those suppressed
+	time.Sleep(150 * time.Millisecond)
+	buf.Reset()
+	logger.Error("error authenticating", "attempt", 5)
+	lines = strings.Split(strings.TrimSpace(buf.String()), "\n")
+	require.Len(t, lines, 2)
+	require.Contains(t, lines[0], `[ERROR] 4 messages suppressed: message="error authenticating"`)
+	require.Contains(t, lines[1], "[ERROR] error authenticating: attempt=5")
+
+	buf.Reset()
+	logger.Error("error authenticating", "attempt", 6)
+	require.Empty(t, buf.String())
+
+	// Counts not yet logged are logged on Close, and only once
+	logger.Close()
+	require.Contains(t, buf.String(), `[ERROR] 1 message suppressed: message="error authenticating"`)
+	require.Equal(t, 1, strings.Count(buf.String(), "\n"))
+	buf.Reset()
+	logger.Close()
+	require.Empty(t, buf.String())
+}
+
+func TestRateLimitedLogger_NoWindow(t *testing.T) {
+	var buf bytes.Buffer
+	logger := NewRateLimitedLogger(hclog.New(&hclog.LoggerOptions{
+		Output: &buf,
+	}), 0)
+
+	for i := 0; i < 3; i++ {
+		logger.Error("error authenticating")
+	}
+	require.Equal(t, 3, strings.Count(buf.String(), "error authenticating"))
+}
@@ -0,0 +1,196 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: BUSL-1.1
+
+package logging
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"regexp"
+	"strings"
+
+	"github.com/hashicorp/go-hclog"
+)
+
+// Redacted replaces each token redacted from log output.
+const Redacted = "REDACTED"
+
+// tokenPattern matches Vault tokens: service, batch and recovery tokens, with
+// either their current "hvs.", "hvb." and "hvr." prefixes or their legacy
+// "s.", "b." and "r." ones.
+var tokenPattern = regexp.MustCompile(`\b(?:hv[sbr]|[sbr])\.[A-Za-z0-9_-]{20,}`)
+
+// RedactTokens returns s with each substring which looks like a Vault token
+// replaced with Redacted.
+func RedactTokens(s string) string {
+	// Every token has a dot, so most messages can skip the regexp
+	if !strings.Contains(s, ".") {
+		return s
+	}
+	return tokenPattern.ReplaceAllString(s, Redacted)
+}
+
+// redactingLogger is an hclog.Logger which redacts tokens from its messages
+// and arguments before logging them, see NewRedactingLogger.
+type redactingLogger struct {
+	hclog.Logger
+}
+
+// NewRedactingLogger returns a logger which logs to logger with each
+// substring of a message or argument which looks like a Vault token replaced
+// with Redacted, at every level. String, error and fmt.Stringer arguments are
+// redacted; others, such as numbers and durations, can't hold a token and are
+// logged as they are. Loggers derived from it with Named, ResetNamed and With,
+// and its standard loggers and writers, redact tokens too.
+//
+// It's a safety net for environments where tokens must never be logged, even
+// at the trace level, rather than a reason to log them: it can't recognize
+// tokens in other shapes, such as when split across arguments. Redacting costs
+// a pattern match per message and argument, so it's only worth it where the
+// logger is created with the option enabled; loggers which don't need it
+// shouldn't be wrapped.
+func NewRedactingLogger(logger hclog.Logger) hclog.Logger {
+	if logger == nil {
+		return nil
+	}
+	if _, ok := logger.(*redactingLogger); ok {
+		return logger
+	}
+	return &redactingLogger{Logger: logger}
+}
+
+func (r *redactingLogger) Log(level hclog.Level, msg string, args ...interface{}) {
+	r.Logger.Log(level, RedactTokens(msg), redactArgs(args)...)
+}
+
+func (r *redactingLogger) Trace(msg string, args ...interface{}) {
+	r.Log(hclog.Trace, msg, args...)
+}
+
+func (r *redactingLogger) Debug(msg string, args ...interface{}) {
+	r.Log(hclog.Debug, msg, args...)
+}
+
+func (r *redactingLogger) Info(msg string, args ...interface{}) {
+	r.Log(hclog.Info, msg, args...)
+}
+
+func (r *redactingLogger) Warn(msg string, args ...interface{}) {
+	r.Log(hclog.Warn, msg, args...)
+}
+
+func (r *redactingLogger) Error(msg string, args ...interface{}) {
+	r.Log(hclog.Error, msg, args...)
+}
+
+func (r *redactingLogger) With(args ...interface{}) hclog.Logger {
+	return &redactingLogger{Logger: r.Logger.With(redactArgs(args)...)}
+}
+
+func (r *redactingLogger) Named(name string) hclog.Logger {
+	return &redactingLogger{Logger: r.Logger.Named(name)}
+}
+
+func (r *redactingLogger) ResetNamed(name string) hclog.Logger {
+	return &redactingLogger{Logger: r.Logger.ResetNamed(name)}
+}
+
+func (r *redactingLogger) StandardLogger(opts *hclog.StandardLoggerOptions) *log.Logger {
+	if opts == nil {
+		opts = &hclog.StandardLoggerOptions{}
+	}
+	return log.New(r.StandardWriter(opts), "", 0)
+}
+
+func (r *redactingLogger) StandardWriter(opts *hclog.StandardLoggerOptions) io.Writer {
+	return NewRedactingWriter(r.Logger.StandardWriter(opts))
+}
+
+// redactArgs returns args with tokens redacted from their values. Keys, at
+// even positions, are left as they are. args is only copied if a value needs
+// redacting.
+func redactArgs(args []interface{}) []interface{} {
+	var redacted []interface{}
+	for i := 1; i < len(args); i += 2 {
+		var s string
+		switch v := args[i].(type) {
+		case string:
+			s = v
+		case error:
+			s = v.Error()
+		case fmt.Stringer:
+			s = v.String()
+		case []string:
+			if r := redactStrings(v); r != nil {
+				if redacted == nil {
+					redacted = append([]interface{}(nil), args...)
+				}
+				redacted[i] = r
+			}
+			continue
+		default:
+			continue
+		}
+		// Errors and Stringers are logged as they are unless they hold a
+		// token, so that hclog formats them as usual
+		r := RedactTokens(s)
+		if r == s {
+			continue
+		}
+		if redacted == nil {
+			redacted = append([]interface{}(nil), args...)
+		}
+		redacted[i] = r
+	}
+	if redacted == nil {
+		return args
+	}
+	return redacted
+}
+
+// redactStrings returns a copy of ss with tokens redacted, or nil if none of
+// them hold a token.
+func redactStrings(ss []string) []string {
+	var redacted []string
+	for i, s := range ss {
+		r := RedactTokens(s)
+		if r == s {
+			continue
+		}
+		if redacted == nil {
+			redacted = append([]string(nil), ss...)
+		}
+		redacted[i] = r
+	}
+	return redacted
+}
+
+// redactingWriter is an io.Writer which redacts tokens from what's written to
+// it, see NewRedactingWriter.
+type redactingWriter struct {
+	w io.Writer
+}
+
+// NewRedactingWriter returns a writer which writes to w with each substring
+// which looks like a Vault token replaced with Redacted, such as for the log
+// output of libraries which don't log through an hclog.Logger. Each write is
+// redacted on its own, so it's intended for writers receiving whole log lines.
+func NewRedactingWriter(w io.Writer) io.Writer {
+	if w == nil {
+		return nil
+	}
+	if _, ok := w.(*redactingWriter); ok {
+		return w
+	}
+	return &redactingWriter{w: w}
+}
+
+// Write writes p to the underlying writer with tokens redacted, returning
+// len(p) on success, as callers don't expect the redacted length.
+func (r *redactingWriter) Write(p []byte) (int, error) {
+	if _, err := io.WriteString(r.w, RedactTokens(string(p))); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
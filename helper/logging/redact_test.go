@@ -0,0 +1,58 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: BUSL-1.1
+
+package logging
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	"github.com/hashicorp/go-hclog"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRedactTokens(t *testing.T) {
+	cases := map[string]string{
+		"token hvs.CAESIJ2Kq7hvZ8F1lL3nQ0rT5uWxYz":   "token REDACTED",
+		"hvb.AAAAAQKx3lMnOpQrStUvWxYz0123456789":     "REDACTED",
+		"legacy s.Xq7hvZ8F1lL3nQ0rT5uWxYzA, renewed": "legacy REDACTED, renewed",
+		"short s.abc":              "short s.abc",
+		"path secret/data/foo.bar": "path secret/data/foo.bar",
+		"no tokens here":           "no tokens here",
+	}
+	for in, want := range cases {
+		require.Equal(t, want, RedactTokens(in), in)
+	}
+}
+
+func TestRedactingLogger(t *testing.T) {
+	const token = "hvs.CAESIJ2Kq7hvZ8F1lL3nQ0rT5uWxYz"
+
+	var buf bytes.Buffer
+	logger := NewRedactingLogger(hclog.New(&hclog.LoggerOptions{
+		Output: &buf,
+		Level:  hclog.Trace,
+	}))
+
+	logger.Trace("got token "+token, "token", token, "error", errors.New("invalid token "+token), "tokens", []string{token}, "attempt", 1)
+	require.NotContains(t, buf.String(), token)
+	require.Contains(t, buf.String(), "got token REDACTED")
+	require.Contains(t, buf.String(), "token=REDACTED")
+	require.Contains(t, buf.String(), `error="invalid token REDACTED"`)
+	require.Contains(t, buf.String(), "attempt=1")
+
+	// Derived loggers redact too
+	buf.Reset()
+	logger.Named("auth").With("token", token).Info("authenticated")
+	require.NotContains(t, buf.String(), token)
+	require.Contains(t, buf.String(), "auth: authenticated: token=REDACTED")
+
+	buf.Reset()
+	logger.StandardLogger(nil).Printf("[INFO] renewed %s", token)
+	require.NotContains(t, buf.String(), token)
+	require.Contains(t, buf.String(), "renewed REDACTED")
+
+	// Wrapping again doesn't redact twice
+	require.Equal(t, logger, NewRedactingLogger(logger))
+}
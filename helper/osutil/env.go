@@ -0,0 +1,29 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: BUSL-1.1
+
+package osutil
+
+import (
+	"fmt"
+	"os"
+	"strings"
+)
+
+// ExpandEnv replaces ${var} or $var in s with the value of the environment
+// variable, as os.ExpandEnv does, but returns an error naming any variables
+// that aren't set rather than replacing them with an empty string. Variables
+// set to an empty value are expanded as usual.
+func ExpandEnv(s string) (string, error) {
+	var missing []string
+	expanded := os.Expand(s, func(name string) string {
+		value, ok := os.LookupEnv(name)
+		if !ok {
+			missing = append(missing, name)
+		}
+		return value
+	})
+	if len(missing) > 0 {
+		return "", fmt.Errorf("undefined environment variables in %q: %s", s, strings.Join(missing, ", "))
+	}
+	return expanded, nil
+}
@@ -0,0 +1,59 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: BUSL-1.1
+
+package osutil
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestExpandEnv(t *testing.T) {
+	t.Setenv("OSUTIL_TEST_POD", "pod-1")
+	t.Setenv("OSUTIL_TEST_EMPTY", "")
+
+	testCases := map[string]struct {
+		in       string
+		expected string
+		err      string
+	}{
+		"no variables": {
+			in:       "/run/secrets/token",
+			expected: "/run/secrets/token",
+		},
+		"braces": {
+			in:       "/run/secrets/${OSUTIL_TEST_POD}/token",
+			expected: "/run/secrets/pod-1/token",
+		},
+		"no braces": {
+			in:       "/run/secrets/$OSUTIL_TEST_POD/token",
+			expected: "/run/secrets/pod-1/token",
+		},
+		"empty": {
+			in:       "/run/secrets/${OSUTIL_TEST_EMPTY}token",
+			expected: "/run/secrets/token",
+		},
+		"undefined": {
+			in:  "/run/${OSUTIL_TEST_UNDEFINED_1}/${OSUTIL_TEST_POD}/${OSUTIL_TEST_UNDEFINED_2}",
+			err: "OSUTIL_TEST_UNDEFINED_1, OSUTIL_TEST_UNDEFINED_2",
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			actual, err := ExpandEnv(tc.in)
+			if tc.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.err) {
+					t.Fatalf("expected error containing %q, got: %v", tc.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if actual != tc.expected {
+				t.Fatalf("expected %q, got %q", tc.expected, actual)
+			}
+		})
+	}
+}
@@ -27,9 +27,10 @@ var (
 	RetryMax     = 10
 
 	// Standard errs
-	ErrNamespaceUnset = errors.New(`"namespace" is unset`)
-	ErrPodNameUnset   = errors.New(`"podName" is unset`)
-	ErrNotInCluster   = errors.New("unable to load in-cluster configuration, KUBERNETES_SERVICE_HOST and KUBERNETES_SERVICE_PORT must be defined")
+	ErrNamespaceUnset  = errors.New(`"namespace" is unset`)
+	ErrPodNameUnset    = errors.New(`"podName" is unset`)
+	ErrSecretNameUnset = errors.New(`"secretName" is unset`)
+	ErrNotInCluster    = errors.New("unable to load in-cluster configuration, KUBERNETES_SERVICE_HOST and KUBERNETES_SERVICE_PORT must be defined")
 )
 
 // Client is a minimal Kubernetes client. We rolled our own because the existing
@@ -127,6 +128,64 @@ func (c *Client) PatchPod(namespace, podName string, patches ...*Patch) error {
 	return c.do(req, nil)
 }
 
+// GetSecret gets a secret from the Kubernetes API.
+func (c *Client) GetSecret(namespace, secretName string) (*Secret, error) {
+	endpoint := fmt.Sprintf("/api/v1/namespaces/%s/secrets/%s", namespace, secretName)
+	method := http.MethodGet
+
+	// Validate that we received required parameters.
+	if namespace == "" {
+		return nil, ErrNamespaceUnset
+	}
+	if secretName == "" {
+		return nil, ErrSecretNameUnset
+	}
+
+	req, err := http.NewRequest(method, c.config.Host+endpoint, nil)
+	if err != nil {
+		return nil, err
+	}
+	secret := &Secret{}
+	if err := c.do(req, secret); err != nil {
+		return nil, err
+	}
+	return secret, nil
+}
+
+// PatchSecretData sets the given keys in the secret's data, leaving any
+// other keys as they are.
+func (c *Client) PatchSecretData(namespace, secretName string, data map[string][]byte) error {
+	endpoint := fmt.Sprintf("/api/v1/namespaces/%s/secrets/%s", namespace, secretName)
+	method := http.MethodPatch
+
+	// Validate that we received required parameters.
+	if namespace == "" {
+		return ErrNamespaceUnset
+	}
+	if secretName == "" {
+		return ErrSecretNameUnset
+	}
+	if len(data) == 0 {
+		// No work to perform.
+		return nil
+	}
+
+	// A merge patch only replaces the keys it contains. The values are
+	// base64 encoded when marshalled, as the API expects.
+	body, err := json.Marshal(map[string]interface{}{
+		"data": data,
+	})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(method, c.config.Host+endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/merge-patch+json")
+	return c.do(req, nil)
+}
+
 // do executes the given request, retrying if necessary.
 func (c *Client) do(req *http.Request, ptrToReturnObj interface{}) error {
 	// Finish setting up a valid request.
@@ -237,6 +296,14 @@ type Metadata struct {
 	Labels map[string]string `json:"labels,omitempty"`
 }
 
+type Secret struct {
+	Metadata *Metadata `json:"metadata,omitempty"`
+
+	// The values are base64 encoded by the API, and decoded when the
+	// secret is unmarshalled.
+	Data map[string][]byte `json:"data,omitempty"`
+}
+
 type PatchOperation string
 
 const (